@@ -0,0 +1,192 @@
+package kite
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+)
+
+// Acknowledgements give at-least-once delivery of the messages sent by
+// a Client with the Acks option. After the client enabled them with the
+// "kite.acks" method, the remote kite replies to every received dnode
+// message with an ack frame, which carries the number of messages it has
+// received during the session. The client keeps the sent messages, which
+// are not acknowledged yet, and sends them again over the next session
+// if the previous one broke.
+//
+// The messages are numbered by the counters kept for session resumption,
+// so the ack frames carry no sequence numbers of their own.
+const ackFrame = "kite.ack:"
+
+// ErrAckWindowFull is returned when a message can't be sent because
+// the client has reached the maximum number of unacknowledged messages.
+var ErrAckWindowFull = errors.New("can't send, too many unacknowledged messages")
+
+// AckOptions configures acknowledgements of messages sent by a Client.
+type AckOptions struct {
+	// Window is the maximum number of sent messages, which are not
+	// acknowledged yet. Sending more messages fails with ErrAckWindowFull.
+	//
+	// If Window is 0, the default value of 1024 is used.
+	Window int
+}
+
+func (opts *AckOptions) window() int {
+	if opts.Window > 0 {
+		return opts.Window
+	}
+	return 1024
+}
+
+// ackState keeps the messages sent by a Client, which were not
+// acknowledged yet. It is guarded by resumeState.mu, as the messages
+// are numbered by the sent counter.
+type ackState struct {
+	tracking bool             // whether sent messages are kept
+	pending  []pendingMessage // messages sent over the current session
+	stale    [][]byte         // messages of broken sessions, sent again on connect
+
+	// remote is non-zero when the received messages are acknowledged,
+	// it's accessed atomically
+	remote int32
+}
+
+// pendingMessage is a sent message, which waits for acknowledgement.
+type pendingMessage struct {
+	seq uint64
+	p   []byte
+}
+
+// resetAcks makes the messages, which were not acknowledged during
+// the previous session, to be sent again. It must be called with
+// c.resume.mu held.
+func (c *Client) resetAcks() {
+	for _, msg := range c.acks.pending {
+		c.acks.stale = append(c.acks.stale, msg.p)
+	}
+
+	c.acks.pending = nil
+	c.acks.tracking = c.Acks != nil
+}
+
+// trackAck keeps the message, which was sent as seq-th one during
+// the session. It must be called with c.resume.mu held.
+func (c *Client) trackAck(seq uint64, p []byte) {
+	if c.acks.tracking {
+		c.acks.pending = append(c.acks.pending, pendingMessage{seq: seq, p: p})
+	}
+}
+
+// acking reports whether the sent messages are kept until they're
+// acknowledged.
+func (c *Client) acking() bool {
+	c.resume.mu.Lock()
+	defer c.resume.mu.Unlock()
+
+	return c.acks.tracking
+}
+
+// checkAckWindow fails if the client can't send more messages before
+// the sent ones are acknowledged.
+func (c *Client) checkAckWindow() error {
+	if c.Acks == nil {
+		return nil
+	}
+
+	c.resume.mu.Lock()
+	defer c.resume.mu.Unlock()
+
+	if len(c.acks.pending)+len(c.acks.stale) >= c.Acks.window() {
+		return ErrAckWindowFull
+	}
+
+	return nil
+}
+
+// handleAck drops the messages acknowledged by the ack frame.
+func (c *Client) handleAck(p []byte) {
+	received, err := strconv.ParseUint(string(p[len(ackFrame):]), 10, 64)
+	if err != nil {
+		c.LocalKite.Log.Warning("invalid ack frame: %s", p)
+		return
+	}
+
+	c.resume.mu.Lock()
+	defer c.resume.mu.Unlock()
+
+	i := 0
+	for i < len(c.acks.pending) && c.acks.pending[i].seq <= received {
+		i++
+	}
+
+	c.acks.pending = c.acks.pending[i:]
+}
+
+// sendAck acknowledges the messages received during the session,
+// if the remote kite asked for it.
+func (c *Client) sendAck() {
+	if atomic.LoadInt32(&c.acks.remote) == 0 {
+		return
+	}
+
+	session := c.getSession()
+	if session == nil {
+		return
+	}
+
+	received := atomic.LoadUint64(&c.resume.received)
+
+	if err := c.sendFrame(session, ackFrame+strconv.FormatUint(received, 10)); err != nil {
+		c.LocalKite.Log.Debug("Unable to send ack: %s", err)
+	}
+}
+
+// enableAcks asks the remote kite to acknowledge the messages received
+// over the new session and sends again the messages, which were not
+// acknowledged over the previous ones.
+func (c *Client) enableAcks() {
+	if c.Acks == nil || c.URL == "" {
+		return
+	}
+
+	_, err := c.TellWithTimeout("kite.acks", c.config().Timeout)
+
+	c.resume.mu.Lock()
+	if err != nil {
+		c.acks.tracking = false
+		c.acks.pending = nil
+	}
+	stale := c.acks.stale
+	c.acks.stale = nil
+	c.resume.mu.Unlock()
+
+	if err != nil {
+		c.LocalKite.Log.Warning("Acknowledgements with %s are not available: %s", c.URL, err)
+	}
+
+	ctx := c.context()
+
+	for i, p := range stale {
+		select {
+		case c.send <- &message{p: p}:
+		case <-ctx.Done():
+			// The session broke again, the rest is sent over the next one.
+			c.resume.mu.Lock()
+			c.acks.stale = append(stale[i:], c.acks.stale...)
+			c.resume.mu.Unlock()
+			return
+		case <-c.closeChan:
+			return
+		}
+	}
+}
+
+// handleAcks makes the caller's messages acknowledged, see Client.Acks.
+func (k *Kite) handleAcks(r *Request) (interface{}, error) {
+	atomic.StoreInt32(&r.Client.acks.remote, 1)
+
+	// Acknowledge the messages received so far, including this call.
+	r.Client.sendAck()
+
+	return true, nil
+}
@@ -0,0 +1,109 @@
+package kite
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/dnode"
+	"github.com/koding/kite/v2/sockjsclient"
+)
+
+// lossySession loses the message sent after drop is set and breaks.
+type lossySession struct {
+	Session
+	drop *int32
+}
+
+func (s *lossySession) Send(msg string) error {
+	if atomic.CompareAndSwapInt32(s.drop, 1, 0) {
+		s.Session.Close(3000, "Go away!")
+		return nil
+	}
+
+	return s.Session.Send(msg)
+}
+
+func TestClient_Acks(t *testing.T) {
+	cfg := config.New()
+	cfg.Port = 3668
+	cfg.DisableAuthentication = true
+
+	received := make(chan string, 16)
+
+	k := NewWithConfig("acks", "0.0.1", cfg)
+	k.HandleFunc("record", func(r *Request) (interface{}, error) {
+		received <- r.Args.One().MustString()
+		return nil, nil
+	})
+
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	var drop int32
+
+	c := New("acks-client", "0.0.1").NewClient("http://127.0.0.1:3668/kite")
+	c.Acks = &AckOptions{}
+	c.Transport = TransportFunc(func(url string, cfg *config.Config) (Session, error) {
+		session, err := sockjsclient.DialWebsocket(url, cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		return &lossySession{Session: session, drop: &drop}, nil
+	})
+
+	connected, err := c.DialForever()
+	if err != nil {
+		t.Fatalf("DialForever()=%s", err)
+	}
+	defer c.Close()
+
+	<-connected
+
+	if _, err := c.TellWithTimeout("record", 5*time.Second, "first"); err != nil {
+		t.Fatalf("Tell()=%s", err)
+	}
+
+	if s := <-received; s != "first" {
+		t.Fatalf("got %q, want %q", s, "first")
+	}
+
+	// Wait for the acknowledgements of the sent messages.
+	for timeout := time.After(5 * time.Second); ; {
+		c.resume.mu.Lock()
+		pending := len(c.acks.pending)
+		c.resume.mu.Unlock()
+
+		if pending == 0 {
+			break
+		}
+
+		select {
+		case <-timeout:
+			t.Fatalf("got %d unacknowledged messages, want 0", pending)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	// The message is lost with the session, it's sent again after
+	// the client reconnects.
+	atomic.StoreInt32(&drop, 1)
+
+	args := c.wrapMethodArgs([]interface{}{"lost"}, dnode.Function{}, "", 0, nil)
+
+	if _, _, err := c.marshalAndSend("record", args); err != nil {
+		t.Fatalf("marshalAndSend()=%s", err)
+	}
+
+	select {
+	case s := <-received:
+		if s != "lost" {
+			t.Fatalf("got %q, want %q", s, "lost")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the lost message")
+	}
+}
@@ -0,0 +1,173 @@
+package kite
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditRecord describes a single request served by the kite.
+type AuditRecord struct {
+	Time      time.Time     `json:"time"`
+	RequestID string        `json:"requestID"`
+	Username  string        `json:"username"`
+	KiteID    string        `json:"kiteID"`
+	Method    string        `json:"method"`
+	Status    string        `json:"status"` // "ok" or the type of the error
+	Error     string        `json:"error,omitempty"`
+	Latency   time.Duration `json:"latency"`
+}
+
+// AuditSink receives audit records of the requests served by the kite.
+//
+// Audit is called after the response is sent to the caller, from
+// the goroutine which served the request, so it may be called
+// concurrently.
+type AuditSink interface {
+	Audit(*AuditRecord) error
+}
+
+// AuditSinkFunc is a type adapter to allow the use of ordinary functions
+// as audit sinks.
+type AuditSinkFunc func(*AuditRecord) error
+
+// Audit calls f(rec).
+func (f AuditSinkFunc) Audit(rec *AuditRecord) error {
+	return f(rec)
+}
+
+// UseAuditSink enables the audit log, each request served by the kite
+// is recorded to the given sink. Requests rejected during authentication
+// are recorded with an empty username.
+func (k *Kite) UseAuditSink(sink AuditSink) {
+	k.handlersMu.Lock()
+	k.auditSinks = append(k.auditSinks, sink)
+	k.handlersMu.Unlock()
+}
+
+// auditFunc wraps the response callback of the request, so the request
+// is recorded once the response is sent. It returns callFunc unchanged
+// if the audit log is not enabled.
+func (k *Kite) auditFunc(r *Request, callFunc func(interface{}, *Error)) func(interface{}, *Error) {
+	k.handlersMu.RLock()
+	sinks := k.auditSinks
+	k.handlersMu.RUnlock()
+
+	if len(sinks) == 0 {
+		return callFunc
+	}
+
+	start := time.Now()
+
+	return func(result interface{}, err *Error) {
+		callFunc(result, err)
+
+		rec := &AuditRecord{
+			Time:      start.UTC(),
+			RequestID: r.ID,
+			Username:  r.Username,
+			KiteID:    r.Client.Kite.ID,
+			Method:    r.Method,
+			Status:    "ok",
+			Latency:   time.Since(start),
+		}
+
+		if err != nil {
+			rec.Status = err.Type
+			rec.Error = err.Message
+		}
+
+		for _, sink := range sinks {
+			if e := sink.Audit(rec); e != nil {
+				k.Log.Error("audit: unable to record request %s: %s", r.ID, e)
+			}
+		}
+	}
+}
+
+// WriterAuditSink writes audit records as JSON lines.
+type WriterAuditSink struct {
+	mu  sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+}
+
+var _ AuditSink = (*WriterAuditSink)(nil)
+
+// NewWriterAuditSink gives new sink, which writes records to w.
+func NewWriterAuditSink(w io.Writer) *WriterAuditSink {
+	return &WriterAuditSink{
+		w:   w,
+		enc: json.NewEncoder(w),
+	}
+}
+
+// NewFileAuditSink gives new sink, which appends records to the file
+// under the given path. The file is created if it does not exist.
+func NewFileAuditSink(path string) (*WriterAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewWriterAuditSink(f), nil
+}
+
+// Audit implements the AuditSink interface.
+func (s *WriterAuditSink) Audit(rec *AuditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.enc.Encode(rec)
+}
+
+// Close closes the underlying writer, if it implements io.Closer.
+func (s *WriterAuditSink) Close() error {
+	if c, ok := s.w.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+// WebhookAuditSink posts each audit record as JSON to the given URL.
+type WebhookAuditSink struct {
+	// URL is the address of the webhook.
+	URL string
+
+	// Client is used to make the requests. If nil, http.DefaultClient
+	// is used.
+	Client *http.Client
+}
+
+var _ AuditSink = (*WebhookAuditSink)(nil)
+
+// Audit implements the AuditSink interface.
+func (s *WebhookAuditSink) Audit(rec *AuditRecord) error {
+	p, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Post(s.URL, "application/json", bytes.NewReader(p))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook responded with %q", resp.Status)
+	}
+
+	return nil
+}
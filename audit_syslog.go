@@ -0,0 +1,46 @@
+// +build !windows,!plan9
+
+package kite
+
+import (
+	"encoding/json"
+	"log/syslog"
+)
+
+// SyslogAuditSink writes audit records as JSON messages to the system
+// log. Requests which failed are logged with the warning priority.
+type SyslogAuditSink struct {
+	w *syslog.Writer
+}
+
+var _ AuditSink = (*SyslogAuditSink)(nil)
+
+// NewSyslogAuditSink gives new sink, which writes records to the local
+// syslog daemon with the given tag.
+func NewSyslogAuditSink(tag string) (*SyslogAuditSink, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SyslogAuditSink{w: w}, nil
+}
+
+// Audit implements the AuditSink interface.
+func (s *SyslogAuditSink) Audit(rec *AuditRecord) error {
+	p, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	if rec.Status != "ok" {
+		return s.w.Warning(string(p))
+	}
+
+	return s.w.Info(string(p))
+}
+
+// Close closes the connection to the syslog daemon.
+func (s *SyslogAuditSink) Close() error {
+	return s.w.Close()
+}
@@ -0,0 +1,87 @@
+package kite
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/koding/kite/v2/config"
+)
+
+func TestKite_UseAuditSink(t *testing.T) {
+	cfg := config.New()
+	cfg.DisableAuthentication = true
+	cfg.Port = 3650
+
+	k := NewWithConfig("audit", "0.0.1", cfg)
+	k.HandleFunc("ok", func(r *Request) (interface{}, error) {
+		return "ok", nil
+	})
+	k.HandleFunc("fail", func(r *Request) (interface{}, error) {
+		return nil, errors.New("failed")
+	})
+
+	// Sinks are called in order, so buf is written once the record
+	// is received from the channel.
+	var buf bytes.Buffer
+	k.UseAuditSink(NewWriterAuditSink(&buf))
+
+	records := make(chan *AuditRecord, 2)
+	k.UseAuditSink(AuditSinkFunc(func(rec *AuditRecord) error {
+		records <- rec
+		return nil
+	}))
+
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	ccfg := config.New()
+	ccfg.Username = "auditor"
+
+	ck := NewWithConfig("audit-client", "0.0.1", ccfg)
+	c := ck.NewClient("http://127.0.0.1:3650/kite")
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	cases := []struct {
+		method string
+		status string
+	}{
+		{"ok", "ok"},
+		{"fail", "genericError"},
+	}
+
+	for _, cas := range cases {
+		c.Tell(cas.method)
+
+		select {
+		case rec := <-records:
+			if rec.Method != cas.method || rec.Status != cas.status {
+				t.Fatalf("got method=%q status=%q, want method=%q status=%q", rec.Method, rec.Status, cas.method, cas.status)
+			}
+
+			if rec.Username != "auditor" || rec.KiteID != ck.Id || rec.RequestID == "" {
+				t.Fatalf("got %+v, want username=auditor kiteID=%s and non-empty request ID", rec, ck.Id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timed out waiting for audit record", cas.method)
+		}
+	}
+
+	dec := json.NewDecoder(&buf)
+	for _, cas := range cases {
+		var rec AuditRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatalf("Decode()=%s", err)
+		}
+
+		if rec.Method != cas.method {
+			t.Fatalf("got %q, want %q", rec.Method, cas.method)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package kite
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrBroadcast is returned by Broadcast, when the method call failed
+// for at least one of the clients.
+type ErrBroadcast struct {
+	// Clients are the clients, for which the call failed.
+	Clients []*Client
+
+	// Errs has the length of Clients, it contains the errors of the calls.
+	Errs []error
+}
+
+// Error implements the built-in error interface.
+func (err *ErrBroadcast) Error() string {
+	if len(err.Errs) == 1 {
+		return err.Errs[0].Error()
+	}
+
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "The broadcast failed for the following kites:\n\n")
+
+	for i, e := range err.Errs {
+		fmt.Fprintf(&buf, "\t[%s] %s\n", err.Clients[i].Kite, e)
+	}
+
+	return buf.String()
+}
+
+// addConnected registers the client served by ServeSession.
+func (k *Kite) addConnected(c *Client) {
+	k.connectedMu.Lock()
+	defer k.connectedMu.Unlock()
+
+	if k.connected == nil {
+		k.connected = make(map[*Client]struct{})
+	}
+
+	k.connected[c] = struct{}{}
+}
+
+func (k *Kite) removeConnected(c *Client) {
+	k.connectedMu.Lock()
+	delete(k.connected, c)
+	k.connectedMu.Unlock()
+}
+
+// Clients gives the clients of the remote kites currently connected
+// to the Kite. A client stays connected while its session is resumable,
+// see Config.ResumeGracePeriod.
+func (k *Kite) Clients() []*Client {
+	k.connectedMu.RLock()
+	defer k.connectedMu.RUnlock()
+
+	clients := make([]*Client, 0, len(k.connected))
+	for c := range k.connected {
+		clients = append(clients, c)
+	}
+
+	return clients
+}
+
+// Broadcast calls the method with args on every kite connected to the Kite,
+// which is meant for notifying them about server-side events. The calls
+// are made concurrently, each one times out after Config.Timeout.
+//
+// Broadcast waits until all calls are done. If any of them failed,
+// it returns *ErrBroadcast with the errors of the failed calls.
+func (k *Kite) Broadcast(method string, args ...interface{}) error {
+	var timeout time.Duration
+	if k.Config != nil {
+		timeout = k.config().Timeout
+	}
+
+	clients := k.Clients()
+	errs := make([]error, len(clients))
+
+	var wg sync.WaitGroup
+
+	for i, c := range clients {
+		wg.Add(1)
+
+		go func(i int, c *Client) {
+			defer wg.Done()
+
+			_, errs[i] = c.TellWithTimeout(method, timeout, args...)
+		}(i, c)
+	}
+
+	wg.Wait()
+
+	var err ErrBroadcast
+
+	for i, e := range errs {
+		if e != nil {
+			err.Clients = append(err.Clients, clients[i])
+			err.Errs = append(err.Errs, e)
+		}
+	}
+
+	if len(err.Errs) != 0 {
+		return &err
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package kite
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/koding/kite/v2/config"
+)
+
+func TestBroadcast(t *testing.T) {
+	cfg := config.New()
+	cfg.Port = 3670
+	cfg.DisableAuthentication = true
+	cfg.Timeout = 5 * time.Second
+
+	k := NewWithConfig("server", "0.0.1", cfg)
+	k.HandleFunc("ping", func(r *Request) (interface{}, error) {
+		return "pong", nil
+	})
+
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	notified := make(chan string, 2)
+
+	var clients []*Client
+
+	for _, name := range []string{"first", "second", "failing"} {
+		name := name
+
+		l := New(name, "0.0.1")
+		l.HandleFunc("notify", func(r *Request) (interface{}, error) {
+			if name == "failing" {
+				return nil, errors.New("not interested")
+			}
+
+			notified <- name + ":" + r.Args.One().MustString()
+			return nil, nil
+		})
+
+		c := l.NewClient("http://127.0.0.1:3670/kite")
+		if err := c.Dial(); err != nil {
+			t.Fatalf("Dial()=%s", err)
+		}
+		defer c.Close()
+
+		// The server registers the client when the session is served.
+		if _, err := c.TellWithTimeout("ping", 5*time.Second); err != nil {
+			t.Fatalf("Tell()=%s", err)
+		}
+
+		clients = append(clients, c)
+	}
+
+	if n := len(k.Clients()); n != 3 {
+		t.Fatalf("got %d clients, want 3", n)
+	}
+
+	err := k.Broadcast("notify", "hello")
+
+	e, ok := err.(*ErrBroadcast)
+	if !ok {
+		t.Fatalf("got %#v, want *ErrBroadcast", err)
+	}
+
+	if len(e.Clients) != 1 || e.Clients[0].Kite.Name != "failing" {
+		t.Fatalf("got %d failed clients, want the failing one: %s", len(e.Clients), e)
+	}
+
+	got := map[string]bool{<-notified: true, <-notified: true}
+	if !got["first:hello"] || !got["second:hello"] {
+		t.Fatalf("got %v notifications", got)
+	}
+
+	clients[2].Close()
+
+	for timeout := time.After(5 * time.Second); len(k.Clients()) != 2; {
+		select {
+		case <-timeout:
+			t.Fatalf("got %d clients, want 2", len(k.Clients()))
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	if err := k.Broadcast("notify", "again"); err != nil {
+		t.Fatalf("Broadcast()=%s", err)
+	}
+}
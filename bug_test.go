@@ -6,7 +6,7 @@ import (
 	"net/http/httptest"
 	"testing"
 
-	"github.com/koding/kite"
+	"github.com/koding/kite/v2"
 )
 
 func TestKite_MultipleDial(t *testing.T) {
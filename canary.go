@@ -0,0 +1,250 @@
+package kite
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/koding/kite/v2/dnode"
+	"github.com/koding/kite/v2/protocol"
+)
+
+// CanaryRoute describes a group of kites, which receives a share of
+// the traffic sent with Canary.
+type CanaryRoute struct {
+	// Version is a version constraint of the kites, e.g. "~> 1.0"
+	// or ">= 2.0, < 3.0", which replaces the Version field of the
+	// canary query.
+	Version string
+
+	// Weight is the relative share of the traffic sent to the route.
+	// Routes with zero weight receive no traffic.
+	Weight int
+}
+
+// CanaryStats are the metrics collected for a single route.
+type CanaryStats struct {
+	Version string        // version constraint of the route
+	Weight  int           // weight of the route
+	Kites   int           // number of kites resolved for the route
+	Calls   int64         // number of calls sent to the route
+	Errors  int64         // number of calls that failed
+	Latency time.Duration // total latency of the calls
+}
+
+// Canary splits traffic between groups of kites matching the same query,
+// that differ in version. It can be used for gradual rollouts, e.g.
+// sending 95% of calls to version 1.x and 5% to version 2.x of a worker
+// kite:
+//
+//	c := k.NewCanary(&protocol.KontrolQuery{
+//	    Username: "koding",
+//	    Name:     "worker",
+//	}, kite.CanaryRoute{"~> 1.0", 95}, kite.CanaryRoute{"~> 2.0", 5})
+//
+//	if err := c.Refresh(); err != nil {
+//	    return err
+//	}
+//	defer c.Close()
+//
+//	result, err := c.Tell("process", job)
+type Canary struct {
+	query  protocol.KontrolQuery
+	routes []*canaryRoute
+	kite   *Kite
+
+	mu   sync.Mutex // protects rand and the clients of routes
+	rand *rand.Rand
+}
+
+type canaryRoute struct {
+	CanaryRoute
+
+	clients []*canaryClient
+	next    int // round-robin index of the next client
+
+	calls   int64
+	errors  int64
+	latency time.Duration
+}
+
+type canaryClient struct {
+	*Client
+
+	mu     sync.Mutex // protects dialed
+	dialed bool
+}
+
+// ErrNoCanaryRoutes is returned by Canary when none of the routes with
+// positive weight has a kite available.
+var ErrNoCanaryRoutes = errors.New("no kites available for canary routes")
+
+// NewCanary gives new canary for the given query and routes. The kites of
+// the routes are not resolved until Refresh is called.
+func (k *Kite) NewCanary(query *protocol.KontrolQuery, routes ...CanaryRoute) *Canary {
+	c := &Canary{
+		query: *query,
+		kite:  k,
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	for _, r := range routes {
+		c.routes = append(c.routes, &canaryRoute{CanaryRoute: r})
+	}
+
+	return c
+}
+
+// Refresh resolves the kites of each route with GetKites and replaces
+// the previously resolved ones, which are closed. A route with no kites
+// available is not an error, it receives no traffic until the next
+// refresh.
+func (c *Canary) Refresh() error {
+	clients := make([][]*Client, len(c.routes))
+
+	for i, r := range c.routes {
+		query := c.query
+		query.Version = r.Version
+
+		kites, err := c.kite.GetKites(&query)
+		if err == ErrNoKitesAvailable {
+			continue
+		}
+		if err != nil {
+			for _, kites := range clients[:i] {
+				Close(kites)
+			}
+			return err
+		}
+
+		clients[i] = kites
+	}
+
+	for i, kites := range clients {
+		c.setClients(i, kites)
+	}
+
+	return nil
+}
+
+func (c *Canary) setClients(i int, clients []*Client) {
+	cc := make([]*canaryClient, len(clients))
+	for j, client := range clients {
+		cc[j] = &canaryClient{Client: client}
+	}
+
+	c.mu.Lock()
+	old := c.routes[i].clients
+	c.routes[i].clients = cc
+	c.routes[i].next = 0
+	c.mu.Unlock()
+
+	for _, client := range old {
+		client.Close()
+	}
+}
+
+// pick gives the next client of a route chosen by weight.
+func (c *Canary) pick() (*canaryRoute, *canaryClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	total := 0
+	for _, r := range c.routes {
+		if r.Weight > 0 && len(r.clients) != 0 {
+			total += r.Weight
+		}
+	}
+
+	if total == 0 {
+		return nil, nil, ErrNoCanaryRoutes
+	}
+
+	n := c.rand.Intn(total)
+
+	for _, r := range c.routes {
+		if r.Weight <= 0 || len(r.clients) == 0 {
+			continue
+		}
+
+		if n -= r.Weight; n < 0 {
+			client := r.clients[r.next%len(r.clients)]
+			r.next++
+			return r, client, nil
+		}
+	}
+
+	panic("unreachable")
+}
+
+// Tell calls the method on a kite chosen by the route weights. The kite
+// is dialed on first use.
+func (c *Canary) Tell(method string, args ...interface{}) (*dnode.Partial, error) {
+	return c.TellWithTimeout(method, 0, args...)
+}
+
+// TellWithTimeout is like Tell, but it fails when the response is not
+// received within the timeout.
+func (c *Canary) TellWithTimeout(method string, timeout time.Duration, args ...interface{}) (*dnode.Partial, error) {
+	r, client, err := c.pick()
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+
+	result, err := client.tell(method, timeout, args...)
+
+	c.mu.Lock()
+	r.calls++
+	r.latency += time.Since(start)
+	if err != nil {
+		r.errors++
+	}
+	c.mu.Unlock()
+
+	return result, err
+}
+
+func (c *canaryClient) tell(method string, timeout time.Duration, args ...interface{}) (*dnode.Partial, error) {
+	c.mu.Lock()
+	if !c.dialed {
+		if err := c.Dial(); err != nil {
+			c.mu.Unlock()
+			return nil, err
+		}
+		c.dialed = true
+	}
+	c.mu.Unlock()
+
+	return c.TellWithTimeout(method, timeout, args...)
+}
+
+// Stats gives the metrics collected for each route, in the order
+// the routes were passed to NewCanary.
+func (c *Canary) Stats() []CanaryStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := make([]CanaryStats, len(c.routes))
+	for i, r := range c.routes {
+		stats[i] = CanaryStats{
+			Version: r.Version,
+			Weight:  r.Weight,
+			Kites:   len(r.clients),
+			Calls:   r.calls,
+			Errors:  r.errors,
+			Latency: r.latency,
+		}
+	}
+
+	return stats
+}
+
+// Close closes the clients of all routes.
+func (c *Canary) Close() {
+	for i := range c.routes {
+		c.setClients(i, nil)
+	}
+}
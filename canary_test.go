@@ -0,0 +1,73 @@
+package kite
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/protocol"
+)
+
+func TestCanary(t *testing.T) {
+	versions := []string{"1.0.0", "2.0.0"}
+	routes := []CanaryRoute{{"~> 1.0", 3}, {"~> 2.0", 1}}
+
+	calls := make(map[string]int)
+
+	k := New("canary", "0.0.1")
+	c := k.NewCanary(&protocol.KontrolQuery{Name: "worker"}, routes...)
+	defer c.Close()
+
+	if _, err := c.Tell("version"); err != ErrNoCanaryRoutes {
+		t.Fatalf("got %v, want %v", err, ErrNoCanaryRoutes)
+	}
+
+	for i, v := range versions {
+		cfg := config.New()
+		cfg.DisableAuthentication = true
+		cfg.Port = 3651 + i
+
+		w := NewWithConfig("worker", v, cfg)
+		w.HandleFunc("version", func(r *Request) (interface{}, error) {
+			return r.LocalKite.Kite().Version, nil
+		})
+
+		go w.Run()
+		<-w.ServerReadyNotify()
+		defer w.Close()
+
+		client := k.NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", cfg.Port))
+		client.Kite = *w.Kite()
+
+		c.setClients(i, []*Client{client})
+	}
+
+	const n = 200
+
+	for i := 0; i < n; i++ {
+		result, err := c.TellWithTimeout("version", *timeout)
+		if err != nil {
+			t.Fatalf("TellWithTimeout()=%s", err)
+		}
+
+		calls[result.MustString()]++
+	}
+
+	stats := c.Stats()
+
+	for i, v := range versions {
+		if stats[i].Calls != int64(calls[v]) {
+			t.Fatalf("%s: got %d calls, want %d", v, stats[i].Calls, calls[v])
+		}
+
+		if stats[i].Errors != 0 || stats[i].Kites != 1 || stats[i].Version != routes[i].Version {
+			t.Fatalf("%s: got %+v", v, stats[i])
+		}
+	}
+
+	// With 3:1 weights the canary version is expected to get ~50
+	// of 200 calls, both bounds are far from the mean.
+	if n := calls["2.0.0"]; n < 15 || n > 100 {
+		t.Fatalf("got %d calls to the canary version, want ~%d", n, 50)
+	}
+}
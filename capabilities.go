@@ -0,0 +1,140 @@
+package kite
+
+import (
+	"strings"
+
+	version "github.com/hashicorp/go-version"
+	"github.com/koding/kite/v2/protocol"
+	"github.com/koding/kite/v2/sockjsclient"
+)
+
+// Capabilities gives the capability manifest of the kite, which is
+// exchanged with the remote kites calling Client.RemoteCapabilities.
+func (k *Kite) Capabilities() *protocol.Capabilities {
+	methods := k.Methods()
+
+	features := []string{"channel", "acks", "pubsub"}
+
+	k.handlersMu.RLock()
+	if k.webRTCPeers != nil {
+		features = append(features, "webrtc")
+	}
+	k.handlersMu.RUnlock()
+
+	if k.Config.ResumeGracePeriod > 0 {
+		features = append(features, "resume")
+	}
+
+	return &protocol.Capabilities{
+		Version:          k.version,
+		Methods:          methods,
+		Features:         features,
+		MinClientVersion: k.MinClientVersion,
+	}
+}
+
+// RemoteCapabilities gives the capability manifest of the remote kite.
+// The manifest is requested once per connection, the manifest of the
+// local kite is sent along, so the remote kite can get it without
+// another request.
+//
+// It returns an error of type "methodNotFound" for remote kites,
+// which do not support capability negotiation.
+func (c *Client) RemoteCapabilities() (*protocol.Capabilities, error) {
+	c.capabilitiesMu.Lock()
+	caps := c.remoteCapabilities
+	c.capabilitiesMu.Unlock()
+
+	if caps != nil {
+		return caps, nil
+	}
+
+	result, err := c.TellWithTimeout("kite.capabilities", c.config().Timeout, c.LocalKite.Capabilities())
+	if err != nil {
+		return nil, err
+	}
+
+	caps = &protocol.Capabilities{}
+	if err := result.Unmarshal(caps); err != nil {
+		return nil, err
+	}
+
+	c.setRemoteCapabilities(caps)
+
+	return caps, nil
+}
+
+func (c *Client) setRemoteCapabilities(caps *protocol.Capabilities) {
+	c.capabilitiesMu.Lock()
+	c.remoteCapabilities = caps
+	c.capabilitiesMu.Unlock()
+}
+
+// handleCapabilities stores the capability manifest of the caller, if
+// it was sent, and replies with the manifest of the kite.
+func (k *Kite) handleCapabilities(r *Request) (interface{}, error) {
+	if args, err := r.Args.SliceOfLength(1); err == nil {
+		var caps protocol.Capabilities
+
+		if err := args[0].Unmarshal(&caps); err == nil {
+			r.Client.setRemoteCapabilities(&caps)
+		}
+	}
+
+	return k.Capabilities(), nil
+}
+
+// checkClientVersion compares the version of the remote kite, which
+// connected to this kite, with MinClientVersion. Outdated kites are
+// logged once per connection and rejected if RejectOutdatedClients is true.
+//
+// Built-in "kite." methods are never rejected.
+func (k *Kite) checkClientVersion(c *Client, method string) *Error {
+	if k.MinClientVersion == "" || strings.HasPrefix(method, "kite.") {
+		return nil
+	}
+
+	// Only kites which connected to us are checked.
+	if _, ok := c.session.(*sockjsclient.WebsocketSession); ok || dialedByTransport(c.session) {
+		return nil
+	}
+
+	c.versionCheck.Do(func() {
+		c.m.RLock()
+		remote := c.Kite
+		c.m.RUnlock()
+
+		if !k.outdated(remote.Version) {
+			return
+		}
+
+		if !k.RejectOutdatedClients {
+			k.Log.Warning("Kite %s is older than the minimum supported version %s", &remote, k.MinClientVersion)
+			return
+		}
+
+		c.versionErr = &Error{
+			Type:    "outdatedClientError",
+			Message: "kite version " + remote.Version + " is older than the minimum supported version " + k.MinClientVersion,
+		}
+	})
+
+	return c.versionErr
+}
+
+// outdated tells whether v is older than MinClientVersion. Versions
+// which can't be parsed are considered outdated.
+func (k *Kite) outdated(v string) bool {
+	min, err := version.NewVersion(k.MinClientVersion)
+	if err != nil {
+		k.Log.Error("Invalid minimum client version %q: %s", k.MinClientVersion, err)
+		return false
+	}
+
+	cur, err := version.NewVersion(v)
+	if err != nil {
+		return true
+	}
+
+	return cur.LessThan(min)
+}
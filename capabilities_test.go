@@ -0,0 +1,61 @@
+package kite
+
+import (
+	"testing"
+
+	"github.com/koding/kite/v2/config"
+)
+
+func TestCapabilities(t *testing.T) {
+	cfg := config.New()
+	cfg.DisableAuthentication = true
+	cfg.Port = 3645
+
+	ksrv := NewWithConfig("capabilities-server", "1.2.0", cfg)
+	ksrv.MinClientVersion = "1.0.0"
+	ksrv.RejectOutdatedClients = true
+	ksrv.HandleFunc("square", func(r *Request) (interface{}, error) {
+		n := r.Args.One().MustFloat64()
+		return n * n, nil
+	})
+
+	go ksrv.Run()
+	<-ksrv.ServerReadyNotify()
+	defer ksrv.Close()
+
+	for _, v := range []string{"0.9.0", "1.0.0"} {
+		c := New("capabilities-client", v).NewClient("http://127.0.0.1:3645/kite")
+		if err := c.Dial(); err != nil {
+			t.Fatalf("%s: Dial()=%s", v, err)
+		}
+		defer c.Close()
+
+		caps, err := c.RemoteCapabilities()
+		if err != nil {
+			t.Fatalf("%s: RemoteCapabilities()=%s", v, err)
+		}
+
+		if caps.Version != "1.2.0" || caps.MinClientVersion != "1.0.0" {
+			t.Fatalf("%s: got %+v", v, caps)
+		}
+
+		var found bool
+		for _, m := range caps.Methods {
+			found = found || m == "square"
+		}
+
+		if !found {
+			t.Fatalf("%s: square method is missing from %v", v, caps.Methods)
+		}
+
+		_, err = c.Tell("square", 2)
+
+		if v == "0.9.0" {
+			if e, ok := err.(*Error); !ok || e.Type != "outdatedClientError" {
+				t.Fatalf("%s: got %v, want outdatedClientError", v, err)
+			}
+		} else if err != nil {
+			t.Fatalf("%s: Tell()=%s", v, err)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package kite
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/koding/kite/v2/dnode"
+)
+
+// ChannelWindow is the number of messages a channel buffers before
+// the sending side blocks until the receiving side reads them.
+var ChannelWindow = 64
+
+// ErrChannelClosed is returned when sending on a closed channel.
+var ErrChannelClosed = errors.New("channel is closed")
+
+// ChannelHandler serves a channel opened by a remote kite.
+// The channel is closed when the handler returns.
+type ChannelHandler func(*Request, *Channel)
+
+// Channel is a bidirectional, flow-controlled stream of messages between
+// two kites. It is multiplexed over the session of a Client, alongside
+// regular method calls.
+//
+// Use Client.OpenChannel to open a channel and Kite.HandleChannel to
+// serve channels opened by other kites.
+type Channel struct {
+	// Name is the name the channel was opened with.
+	Name string
+
+	remote channelFuncs
+
+	recvC  chan *dnode.Partial
+	closeC chan struct{}
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	credits  int  // number of messages we can send
+	consumed int  // number of received messages not yet acked
+	closed   bool // set when the channel got closed on either side
+	err      error
+}
+
+// channelFuncs are the functions each side of the channel gives
+// to the other one.
+type channelFuncs struct {
+	Name  string         `json:"name,omitempty"`
+	Send  dnode.Function `json:"send"`
+	Ack   dnode.Function `json:"ack"`
+	Close dnode.Function `json:"close"`
+}
+
+func newChannel(name string) *Channel {
+	ch := &Channel{
+		Name:    name,
+		recvC:   make(chan *dnode.Partial, ChannelWindow),
+		closeC:  make(chan struct{}),
+		credits: ChannelWindow,
+	}
+
+	ch.cond = sync.NewCond(&ch.mu)
+
+	return ch
+}
+
+// funcs gives local functions to be called by the other side.
+func (ch *Channel) funcs() channelFuncs {
+	return channelFuncs{
+		Name: ch.Name,
+		Send: dnode.PersistentCallback(func(args *dnode.Partial) {
+			select {
+			case ch.recvC <- args.One():
+			default:
+				// The other side does not respect the window.
+				ch.close(errors.New("channel window exceeded"), true)
+			}
+		}),
+		Ack: dnode.PersistentCallback(func(args *dnode.Partial) {
+			n := args.One().MustFloat64()
+
+			ch.mu.Lock()
+			ch.credits += int(n)
+			ch.cond.Broadcast()
+			ch.mu.Unlock()
+		}),
+		Close: dnode.PersistentCallback(func(*dnode.Partial) {
+			ch.close(io.EOF, false)
+		}),
+	}
+}
+
+// watch closes the channel when the given done channel is closed,
+// which happens when the session the channel is multiplexed over
+// is disconnected.
+func (ch *Channel) watch(done <-chan struct{}) {
+	go func() {
+		select {
+		case <-done:
+			ch.close(ErrChannelClosed, false)
+		case <-ch.closeC:
+		}
+	}()
+}
+
+// Send sends the message to the other side. It blocks when the other
+// side does not receive the messages fast enough.
+func (ch *Channel) Send(v interface{}) error {
+	ch.mu.Lock()
+	for ch.credits == 0 && !ch.closed {
+		ch.cond.Wait()
+	}
+
+	if ch.closed {
+		ch.mu.Unlock()
+		return ErrChannelClosed
+	}
+
+	ch.credits--
+	ch.mu.Unlock()
+
+	return ch.remote.Send.Call(v)
+}
+
+// Recv receives the next message from the other side. It returns io.EOF
+// after the other side closed the channel and all messages were received.
+func (ch *Channel) Recv() (*dnode.Partial, error) {
+	var msg *dnode.Partial
+
+	select {
+	case msg = <-ch.recvC:
+	case <-ch.closeC:
+		select {
+		case msg = <-ch.recvC:
+		default:
+			ch.mu.Lock()
+			err := ch.err
+			ch.mu.Unlock()
+			return nil, err
+		}
+	}
+
+	ch.mu.Lock()
+	ch.consumed++
+	n := ch.consumed
+	ack := n >= ChannelWindow/2
+	if ack {
+		ch.consumed = 0
+	}
+	ch.mu.Unlock()
+
+	// Let the other side know it can send more.
+	if ack {
+		ch.remote.Ack.Call(n)
+	}
+
+	return msg, nil
+}
+
+// CloseNotify returns a channel that is closed when the Channel is closed.
+func (ch *Channel) CloseNotify() <-chan struct{} {
+	return ch.closeC
+}
+
+// Close closes the channel and notifies the other side.
+func (ch *Channel) Close() error {
+	ch.close(io.EOF, true)
+	return nil
+}
+
+func (ch *Channel) close(err error, notify bool) {
+	ch.mu.Lock()
+	if ch.closed {
+		ch.mu.Unlock()
+		return
+	}
+
+	ch.closed = true
+	ch.err = err
+	ch.cond.Broadcast()
+	ch.mu.Unlock()
+
+	close(ch.closeC)
+
+	if notify && ch.remote.Close.IsValid() {
+		ch.remote.Close.Call()
+	}
+}
+
+// OpenChannel opens a channel with the given name to the remote kite,
+// which must serve it with Kite.HandleChannel.
+//
+// The channel is closed when the client disconnects.
+func (c *Client) OpenChannel(name string) (*Channel, error) {
+	ch := newChannel(name)
+
+	result, err := c.Tell("kite.openChannel", ch.funcs())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := result.Unmarshal(&ch.remote); err != nil {
+		return nil, err
+	}
+
+	ch.watch(c.context().Done())
+
+	return ch, nil
+}
+
+// HandleChannel registers the handler for channels with the given name
+// opened by remote kites with Client.OpenChannel.
+func (k *Kite) HandleChannel(name string, handler ChannelHandler) {
+	k.handlersMu.Lock()
+	if k.channelHandlers == nil {
+		k.channelHandlers = make(map[string]ChannelHandler)
+	}
+	k.channelHandlers[name] = handler
+	k.handlersMu.Unlock()
+}
+
+func (k *Kite) handleOpenChannel(r *Request) (interface{}, error) {
+	var remote channelFuncs
+	r.Args.One().MustUnmarshal(&remote)
+
+	k.handlersMu.RLock()
+	handler, ok := k.channelHandlers[remote.Name]
+	k.handlersMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("channel %q is not found", remote.Name)
+	}
+
+	// Channels are gated by readiness checks like regular methods.
+	if err := k.checkReady(remote.Name); err != nil {
+		return nil, err
+	}
+
+	ch := newChannel(remote.Name)
+	ch.remote = remote
+	ch.watch(r.Context.Done())
+
+	go func() {
+		defer ch.Close()
+		handler(r, ch)
+	}()
+
+	return ch.funcs(), nil
+}
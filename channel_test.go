@@ -0,0 +1,85 @@
+package kite
+
+import (
+	"io"
+	"testing"
+
+	"github.com/koding/kite/v2/config"
+)
+
+func TestChannel(t *testing.T) {
+	// Authentication must be disabled before the default
+	// kite.openChannel method is registered.
+	cfg := config.New()
+	cfg.DisableAuthentication = true
+	cfg.Port = 3639
+
+	ksrv := NewWithConfig("channel-server", "0.0.1", cfg)
+
+	// Echo all messages back, until the other side closes the channel.
+	ksrv.HandleChannel("echo", func(r *Request, ch *Channel) {
+		for {
+			msg, err := ch.Recv()
+			if err != nil {
+				return
+			}
+
+			if err := ch.Send(msg.MustString()); err != nil {
+				return
+			}
+		}
+	})
+
+	go ksrv.Run()
+	<-ksrv.ServerReadyNotify()
+	defer ksrv.Close()
+
+	c := New("channel-client", "0.0.1").NewClient("http://127.0.0.1:3639/kite")
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	if _, err := c.OpenChannel("unknown"); err == nil {
+		t.Fatal("expected OpenChannel to fail for unknown channel")
+	}
+
+	ch, err := c.OpenChannel("echo")
+	if err != nil {
+		t.Fatalf("OpenChannel()=%s", err)
+	}
+
+	n := 3 * ChannelWindow
+	done := make(chan error, 1)
+
+	go func() {
+		for i := 0; i < n; i++ {
+			if err := ch.Send("hello"); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	for i := 0; i < n; i++ {
+		msg, err := ch.Recv()
+		if err != nil {
+			t.Fatalf("Recv()=%s", err)
+		}
+
+		if s := msg.MustString(); s != "hello" {
+			t.Fatalf("got %q, want %q", s, "hello")
+		}
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("Send()=%s", err)
+	}
+
+	ch.Close()
+
+	if _, err := ch.Recv(); err != io.EOF {
+		t.Fatalf("got %v, want %v", err, io.EOF)
+	}
+}
@@ -12,26 +12,17 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/koding/kite/config"
-	"github.com/koding/kite/dnode"
-	"github.com/koding/kite/protocol"
-	"github.com/koding/kite/sockjsclient"
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/dnode"
+	"github.com/koding/kite/v2/kitekey"
+	"github.com/koding/kite/v2/protocol"
+	"github.com/koding/kite/v2/sockjsclient"
 
 	"github.com/cenkalti/backoff"
 	"github.com/gorilla/websocket"
-	"github.com/igm/sockjs-go/sockjs"
 )
 
-var forever backoff.BackOff
-
-func init() {
-	b := backoff.NewExponentialBackOff()
-	b.MaxElapsedTime = 365 * 24 * time.Hour // 1 year
-
-	forever = &lockedBackoff{b: b}
-}
-
-func nopSetSession(sockjs.Session) {}
+func nopSetSession(Session) {}
 
 // Client is the client for communicating with another Kite.
 // It has Tell() and Go() methods for calling methods sync/async way.
@@ -52,15 +43,57 @@ type Client struct {
 	// broke.
 	Reconnect bool
 
+	// Queue, when non-nil, makes the client buffer method calls made
+	// while it is not connected (e.g. during redial after the connection
+	// broke) and send them once the connection is established again.
+	//
+	// The field must be set before calling Dial or DialForever.
+	Queue *QueueOptions
+
+	// Acks, when non-nil, makes the remote kite acknowledge the messages
+	// sent by the client. Messages not acknowledged before the connection
+	// broke are sent again once the client connects again, which gives
+	// at-least-once delivery: a message may be received more than once,
+	// but it's not lost silently.
+	//
+	// The remote kite must support acknowledgements, otherwise messages
+	// are sent without them. The field must be set before calling Dial
+	// or DialForever.
+	Acks *AckOptions
+
 	// URL specifies the SockJS URL of the remote kite.
 	URL string
 
+	// Metadata is sent along with each method call to the remote kite,
+	// which can read it from Request.Metadata.
+	//
+	// NewClient initializes it with a copy of LocalKite.Config.Metadata.
+	// Use WithMetadata to add entries while the client is in use.
+	Metadata map[string]string
+
+	// Transport, when non-nil, is used to dial the remote kite instead
+	// of the SockJS transport configured with Config.Transport.
+	Transport Transport
+
 	// Config is used when setting up client connection to
 	// the remote kite.
 	//
 	// If Config is nil, LocalKite.Config is used instead.
 	Config *config.Config
 
+	// TokenByID, when true, makes the client send the ID of its token
+	// instead of the token itself, when authenticating with a token.
+	// The remote kite fetches the token from Kontrol on first use.
+	//
+	// It is meant for large tokens, which exceed header limits
+	// of proxies in front of the remote kite.
+	TokenByID bool
+
+	// PingInterval, when non-zero, makes the client ping the remote kite
+	// with the given interval while it is connected, in order to keep
+	// the moving average given by Latency up to date.
+	PingInterval time.Duration
+
 	// Concurrent specified whether we should process incoming messages concurrently.
 	//
 	// Defaults to true.
@@ -107,12 +140,15 @@ type Client struct {
 	// authMu protects Auth field.
 	authMu sync.Mutex
 
+	// metadataMu protects Metadata field.
+	metadataMu sync.Mutex
+
 	// To signal about the close
 	closeChan chan struct{}
 
 	// closeRenewer is used to stop renewing tokens when client
-	// is closed but was not dialed
-	closeRenewer chan struct{}
+	// is closed
+	closeRenewer func()
 
 	// interrupt is used to signalise readloop that
 	// session was interrupted.
@@ -124,9 +160,19 @@ type Client struct {
 	// SockJS session
 	// TODO: replace this with a proper interface to support multiple
 	// transport/protocols
-	session sockjs.Session
+	session Session
 	send    chan *message
 
+	// hubRunning says whether sendHub is running, it's protected by hubMu.
+	hubRunning bool
+	hubMu      sync.Mutex
+
+	// resume keeps the state of session resumption.
+	resume resumeState
+
+	// acks keeps the messages waiting for acknowledgement, see Acks.
+	acks ackState
+
 	// ctx and cancel keeps track of session lifetime
 	ctxMu  sync.Mutex
 	ctx    context.Context
@@ -141,17 +187,42 @@ type Client struct {
 	// dnode scrubber for saving callbacks sent to remote.
 	scrubber *dnode.Scrubber
 
-	// Time to wait before redial connection.
-	redialBackOff backoff.BackOff
+	// queue buffers outgoing messages when Queue is non-nil,
+	// it is created by sendQueue method.
+	queue     *sendQueue
+	queueOnce sync.Once
+
+	// subscriptions are made again after every reconnect.
+	subscriptions   map[string]*subscription
+	subscriptionsMu sync.Mutex
+
+	// remoteCapabilities is the manifest of the remote kite, it's reset
+	// on every new session.
+	remoteCapabilities *protocol.Capabilities
+	capabilitiesMu     sync.Mutex
+
+	// versionCheck ensures the version of a connected kite is compared
+	// with LocalKite.MinClientVersion only once, versionErr is the result.
+	versionCheck sync.Once
+	versionErr   *Error
+
+	// latency is the moving average of round-trip times measured by Ping.
+	latency   time.Duration
+	latencyMu sync.Mutex
+
+	// interceptors are run on every outgoing call.
+	interceptors   []Interceptor
+	interceptorsMu sync.RWMutex
 
 	// on connect/disconnect handlers are invoked after every
 	// connect/disconnect.
-	onConnectHandlers     []func()
-	onDisconnectHandlers  []func()
-	onTokenExpireHandlers []func()
-	onTokenRenewHandlers  []func(string)
+	onConnectHandlers          []func()
+	onDisconnectHandlers       []func()
+	onTokenExpireHandlers      []func()
+	onTokenRenewHandlers       []func(string)
+	onReconnectAttemptHandlers []func(*ReconnectAttempt)
 
-	testHookSetSession func(sockjs.Session)
+	testHookSetSession func(Session)
 
 	// For protecting access over OnConnect and OnDisconnect handlers.
 	m sync.RWMutex
@@ -173,6 +244,20 @@ type callOptions struct {
 	Auth             *Auth          `json:"authentication"`
 	WithArgs         *dnode.Partial `json:"withArgs" dnode:"-"`
 	ResponseCallback dnode.Function `json:"responseCallback"`
+
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// RequestID is the ID of the request, which is reused by the remote
+	// kite for the Request.ID.
+	RequestID string `json:"requestId,omitempty"`
+
+	// Timeout is the time in milliseconds the caller waits for the
+	// response. The remote kite bounds the Request.Context by it.
+	Timeout int64 `json:"timeout,omitempty"`
+
+	// Stream is set when the caller reads the result as a stream,
+	// see Client.TellStream.
+	Stream *streamFuncs `json:"stream,omitempty"`
 }
 
 // callOptionsOut is the same structure with callOptions.
@@ -186,7 +271,7 @@ type callOptionsOut struct {
 
 // Authentication is used when connecting a Client.
 type Auth struct {
-	// Type can be "kiteKey", "token" or "sessionID" for now.
+	// Type can be "kiteKey", "token", "tokenID" or "sessionID" for now.
 	Type string `json:"type"`
 	Key  string `json:"key"`
 }
@@ -206,7 +291,6 @@ func (k *Kite) NewClient(remoteURL string) *Client {
 		URL:                remoteURL,
 		disconnect:         make(chan struct{}),
 		closeChan:          make(chan struct{}),
-		redialBackOff:      forever,
 		scrubber:           dnode.NewScrubber(),
 		testHookSetSession: nopSetSession,
 		Concurrent:         true,
@@ -214,10 +298,33 @@ func (k *Kite) NewClient(remoteURL string) *Client {
 		interrupt:          make(chan error, 1),
 		ctx:                context.Background(),
 		cancel:             func() {},
+		resume:             resumeState{requests: make(chan *resumeRequest)},
+	}
+
+	if k.Config != nil {
+		c.scrubber.TTL = k.Config.CallbackTTL
+	}
+
+	c.scrubber.OnCallbackExpired = func(id uint64) {
+		k.Log.Debug("Callback %d sent to %s expired", id, c.URL)
+		k.callOnCallbackExpiredHandlers(c, id)
+	}
+
+	if k.Config != nil && len(k.Config.Metadata) != 0 {
+		c.Metadata = make(map[string]string, len(k.Config.Metadata))
+
+		for key, value := range k.Config.Metadata {
+			c.Metadata[key] = value
+		}
 	}
 
 	c.OnConnect(c.setContext)
+	c.OnConnect(c.flushQueue)
+	c.OnConnect(c.startPings)
+	c.OnConnect(c.registerResume)
+	c.OnConnect(c.enableAcks)
 	c.OnDisconnect(c.closeContext)
+	c.OnDisconnect(c.offlineQueue)
 
 	k.OnRegister(c.updateAuth)
 
@@ -230,6 +337,34 @@ func (c *Client) SetUsername(username string) {
 	c.muProt.Unlock()
 }
 
+// WithMetadata adds the key and value to the metadata sent along with
+// each method call, replacing any previous value of the key. It is safe
+// to use concurrently with method calls. It returns the client, so calls
+// can be chained:
+//
+//	c.WithMetadata("tenant", "acme").WithMetadata("locale", "en-US")
+func (c *Client) WithMetadata(key, value string) *Client {
+	c.metadataMu.Lock()
+	defer c.metadataMu.Unlock()
+
+	// Copy on write, so messages being sent are not affected.
+	metadata := make(map[string]string, len(c.Metadata)+1)
+	for k, v := range c.Metadata {
+		metadata[k] = v
+	}
+	metadata[key] = value
+
+	c.Metadata = metadata
+
+	return c
+}
+
+func (c *Client) metadata() map[string]string {
+	c.metadataMu.Lock()
+	defer c.metadataMu.Unlock()
+	return c.Metadata
+}
+
 // Dial connects to the remote Kite. Returns error if it can't.
 func (c *Client) Dial() (err error) {
 	// zero means no timeout
@@ -238,7 +373,21 @@ func (c *Client) Dial() (err error) {
 
 // DialTimeout acts like Dial but takes a timeout.
 func (c *Client) DialTimeout(timeout time.Duration) error {
-	err := c.dial(timeout)
+	if timeout <= 0 {
+		return c.DialContext(context.Background())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return c.DialContext(ctx)
+}
+
+// DialContext acts like Dial, but it's aborted when the ctx is done.
+// The ctx is used for dialing only, once connected, canceling it
+// does not disconnect the client.
+func (c *Client) DialContext(ctx context.Context) error {
+	err := c.dial(ctx)
 
 	c.LocalKite.Log.Debug("Dialing '%s' kite: %s (error: %v)", c.Kite.Name, c.URL, err)
 
@@ -252,11 +401,21 @@ func (c *Client) DialTimeout(timeout time.Duration) error {
 }
 
 // Dial connects to the remote Kite. If it can't connect, it retries
-// indefinitely. It returns a channel to check if it's connected or not.
+// with the backoff configured by Config.Redial, indefinitely by default.
+// It returns a channel to check if it's connected or not, which is also
+// closed when the client gives up.
 func (c *Client) DialForever() (connected chan bool, err error) {
+	return c.DialForeverContext(context.Background())
+}
+
+// DialForeverContext acts like DialForever, but it stops dialing when
+// the ctx is done before the client connects, closing the returned
+// channel. The redials after the client disconnects are not affected
+// by the ctx, they are stopped with Close.
+func (c *Client) DialForeverContext(ctx context.Context) (connected chan bool, err error) {
 	c.Reconnect = true
 	connected = make(chan bool, 1) // This will be closed on first connection.
-	go c.dialForever(connected)
+	go c.dialForever(ctx, connected)
 	return
 }
 
@@ -300,42 +459,37 @@ func (c *Client) authCopy() *Auth {
 	}
 
 	authCopy := *c.Auth
-	return &authCopy
-}
 
-func (c *Client) dial(timeout time.Duration) (err error) {
-	transport := c.config().Transport
+	if c.TokenByID && authCopy.Type == "token" {
+		if id, err := kitekey.TokenID(authCopy.Key); err == nil {
+			authCopy.Type = "tokenID"
+			authCopy.Key = id
+		} else {
+			c.LocalKite.Log.Warning("unable to reference token by ID: %s", err)
+		}
+	}
 
-	c.LocalKite.Log.Debug("Client transport is set to '%s'", transport)
+	return &authCopy
+}
 
-	var session sockjs.Session
+func (c *Client) setAuthKey(key string) {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
 
-	switch transport {
-	case config.WebSocket:
-		session, err = sockjsclient.DialWebsocket(c.URL, c.config())
-	case config.XHRPolling:
-		session, err = sockjsclient.DialXHR(c.URL, c.config())
-	case config.Auto:
-		session, err = sockjsclient.DialWebsocket(c.URL, c.config())
-		if err == websocket.ErrBadHandshake {
-			// In cases when kite server is behind a proxy that do
-			// not support websocket connections, fall back to XHR.
-			session, err = sockjsclient.DialXHR(c.URL, c.config())
-		}
-	default:
-		return fmt.Errorf("Connection transport is not known '%v'", transport)
+	if c.Auth != nil {
+		c.Auth.Key = key
 	}
+}
 
+func (c *Client) dial(ctx context.Context) error {
+	session, err := c.dialSessionContext(ctx)
 	if err != nil {
 		return err
 	}
 
+	c.resetResume()
 	c.setSession(session)
-	c.wg.Add(1)
-	go c.sendHub()
-
-	// Reset the wait time.
-	c.redialBackOff.Reset()
+	c.startSendHub()
 
 	// Must be run in a goroutine because a handler may wait a response from
 	// server.
@@ -344,7 +498,78 @@ func (c *Client) dial(timeout time.Duration) (err error) {
 	return nil
 }
 
-func (c *Client) dialForever(connectNotifyChan chan bool) {
+// dialSessionContext dials a new session with the remote kite, unless
+// the ctx is done first. The transports do not take a context, so
+// a session dialed after the ctx is done is closed.
+func (c *Client) dialSessionContext(ctx context.Context) (Session, error) {
+	if ctx.Done() == nil {
+		return c.dialSession()
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		session Session
+		err     error
+	}
+
+	done := make(chan result, 1)
+
+	go func() {
+		session, err := c.dialSession()
+		done <- result{session, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.session, res.err
+	case <-ctx.Done():
+		go func() {
+			if res := <-done; res.session != nil {
+				res.session.Close(3000, "Go away!")
+			}
+		}()
+
+		return nil, ctx.Err()
+	}
+}
+
+// dialSession dials a new session with the remote kite.
+func (c *Client) dialSession() (session Session, err error) {
+	transport := c.config().Transport
+
+	c.LocalKite.Log.Debug("Client transport is set to '%s'", transport)
+
+	uri, cfg := c.dialURL()
+
+	switch {
+	case c.Transport != nil:
+		session, err = c.dialTransport()
+	case transport == config.WebSocket:
+		session, err = sockjsclient.DialWebsocket(uri, cfg)
+	case transport == config.XHRPolling:
+		session, err = sockjsclient.DialXHR(uri, cfg)
+	case transport == config.Auto:
+		session, err = sockjsclient.DialWebsocket(uri, cfg)
+		if err == websocket.ErrBadHandshake {
+			// In cases when kite server is behind a proxy that do
+			// not support websocket connections, fall back to XHR.
+			session, err = sockjsclient.DialXHR(uri, cfg)
+		}
+	default:
+		return nil, fmt.Errorf("Connection transport is not known '%v'", transport)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+func (c *Client) dialForever(ctx context.Context, connectNotifyChan chan bool) {
 	dial := func() error {
 		if !c.reconnect() {
 			return nil
@@ -352,7 +577,7 @@ func (c *Client) dialForever(connectNotifyChan chan bool) {
 
 		c.LocalKite.Log.Info("Dialing '%s' kite: %s", c.Kite.Name, c.URL)
 
-		if err := c.dial(0); err != nil {
+		if err := c.dial(ctx); err != nil {
 			c.LocalKite.Log.Warning("Dialing '%s' kite error: %s: %v", c.Kite.Name, c.URL, err)
 
 			return err
@@ -361,7 +586,41 @@ func (c *Client) dialForever(connectNotifyChan chan bool) {
 		return nil
 	}
 
-	backoff.Retry(dial, c.redialBackOff) // this will retry dial forever
+	b := c.redialBackOff()
+
+	for attempt := 1; ; attempt++ {
+		err := dial()
+		if err == nil {
+			break
+		}
+
+		if ctx.Err() != nil {
+			c.LocalKite.Log.Info("Dialing '%s' kite canceled: %s", c.Kite.Name, c.URL)
+			c.stopDialing(connectNotifyChan)
+			return
+		}
+
+		delay := b.NextBackOff()
+
+		c.callOnReconnectAttemptHandlers(&ReconnectAttempt{
+			Attempt: attempt,
+			Err:     err,
+			Delay:   delay,
+			GaveUp:  delay == backoff.Stop,
+		})
+
+		if delay == backoff.Stop {
+			c.LocalKite.Log.Error("Giving up dialing '%s' kite after %d attempts: %s", c.Kite.Name, attempt, c.URL)
+			c.stopDialing(connectNotifyChan)
+			return
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-c.closeChan:
+		case <-ctx.Done():
+		}
+	}
 
 	if connectNotifyChan != nil {
 		close(connectNotifyChan)
@@ -370,27 +629,98 @@ func (c *Client) dialForever(connectNotifyChan chan bool) {
 	go c.run()
 }
 
+// stopDialing notifies the waiters, that the client is not going
+// to connect.
+func (c *Client) stopDialing(connectNotifyChan chan bool) {
+	c.disconnectMu.Lock()
+	if c.disconnect != nil {
+		close(c.disconnect)
+		c.disconnect = nil
+	}
+	c.disconnectMu.Unlock()
+
+	if connectNotifyChan != nil {
+		close(connectNotifyChan)
+	}
+}
+
+// redialBackOff gives the backoff between redials, configured
+// with Config.Redial.
+func (c *Client) redialBackOff() backoff.BackOff {
+	r := c.config().Redial
+
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = r.MaxElapsedTime
+
+	if r.InitialInterval > 0 {
+		b.InitialInterval = r.InitialInterval
+	}
+
+	if r.MaxInterval > 0 {
+		b.MaxInterval = r.MaxInterval
+	}
+
+	if r.Multiplier > 0 {
+		b.Multiplier = r.Multiplier
+	}
+
+	switch {
+	case r.Jitter > 0:
+		b.RandomizationFactor = r.Jitter
+	case r.Jitter < 0:
+		b.RandomizationFactor = 0
+	}
+
+	b.Reset()
+
+	return b
+}
+
+// RemoteAddr gives the network address of the remote kite, or an empty
+// string if it's not known, e.g. the client is not connected.
 func (c *Client) RemoteAddr() string {
+	remoteAddr, _, _ := c.sessionInfo()
+	return remoteAddr
+}
+
+// UserAgent gives the User-Agent of the HTTP request, which opened the
+// session of the remote kite. It's empty for the sessions dialed by the
+// client and the ones not made over HTTP.
+func (c *Client) UserAgent() string {
+	_, userAgent, _ := c.sessionInfo()
+	return userAgent
+}
+
+// TransportName gives the name of the transport of the session, like
+// "websocket", "xhr", "xhr_streaming", "eventsource", "webrtc" or "nats",
+// or an empty string if it's not known.
+func (c *Client) TransportName() string {
+	_, _, transport := c.sessionInfo()
+	return transport
+}
+
+func (c *Client) sessionInfo() (remoteAddr, userAgent, transport string) {
 	session := c.getSession()
 	if session == nil {
-		return ""
-	}
-
-	websocketsession, ok := session.(*sockjsclient.WebsocketSession)
-	if !ok {
-		return ""
+		return "", "", ""
 	}
 
-	return websocketsession.RemoteAddr()
+	return sessionInfo(session)
 }
 
 // run consumes incoming dnode messages. Reconnects if necessary.
 func (c *Client) run() {
-	err := c.readLoop()
+	err := c.superviseReadLoop()
 	if err != nil {
 		c.LocalKite.Log.Debug("readloop err: %s", err)
 	}
 
+	// the session continues, if it's resumed within the grace period
+	if c.resumeSession() {
+		go c.run()
+		return
+	}
+
 	// falls here when connection disconnects
 	c.callOnDisconnectHandlers()
 
@@ -410,7 +740,7 @@ func (c *Client) run() {
 		c.disconnectMu.Lock()
 		c.disconnect = make(chan struct{}, 1)
 		c.disconnectMu.Unlock()
-		go c.dialForever(nil)
+		go c.dialForever(context.Background(), nil)
 	}
 }
 
@@ -432,6 +762,17 @@ func (c *Client) readLoop() error {
 			return err
 		}
 
+		if isControlFrame(p) {
+			if err := c.handleControlFrame(p); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		atomic.AddUint64(&c.resume.received, 1)
+		c.sendAck()
+
 		msg, fn, err := c.processMessage(p)
 		if err != nil {
 			if _, ok := err.(dnode.CallbackNotFoundError); !ok {
@@ -489,24 +830,37 @@ func (c *Client) processMessage(data []byte) (msg *dnode.Message, fn interface{}
 	defer func() {
 		if err != nil {
 			onError(err)
+			c.LocalKite.emit(&Event{Type: EventError, Client: c, Err: err})
 		}
 	}()
 
 	msg = &dnode.Message{}
 
-	if err = json.Unmarshal(data, &msg); err != nil {
+	data, attachments, err := dnode.SplitAttachments(data)
+	if err != nil {
 		return nil, nil, err
 	}
 
-	sender := func(id uint64, args []interface{}) error {
-		// do not name the error variable to "err" here, it's a trap for
-		// shadowing variables
-		_, _, e := c.marshalAndSend(id, args)
-		return e
+	if err = json.Unmarshal(data, &msg); err != nil {
+		return nil, nil, err
 	}
 
 	// Replace function placeholders with real functions.
-	if err := dnode.ParseCallbacks(msg, sender); err != nil {
+	if len(msg.Callbacks) != 0 {
+		sender := func(id uint64, args []interface{}) error {
+			// do not name the error variable to "err" here, it's a trap for
+			// shadowing variables
+			_, _, e := c.marshalAndSend(id, args)
+			return e
+		}
+
+		if err := dnode.ParseCallbacks(msg, sender); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Replace binary placeholders with received attachments.
+	if err := dnode.ParseAttachments(msg, attachments); err != nil {
 		return nil, nil, err
 	}
 
@@ -525,7 +879,7 @@ func (c *Client) processMessage(data []byte) (msg *dnode.Message, fn interface{}
 
 		return msg, callback, nil
 	case string:
-		m, ok := c.LocalKite.handlers[method]
+		m, ok := c.LocalKite.method(method)
 		if !ok {
 			err = dnode.MethodNotFoundError{
 				Method: method,
@@ -540,9 +894,14 @@ func (c *Client) processMessage(data []byte) (msg *dnode.Message, fn interface{}
 	}
 }
 
-func (c *Client) Close() {
+// Close closes the connection to the remote kite and stops redialing.
+// Pending method calls fail with a "disconnect" error.
+//
+// Close is safe to be called many times and concurrently, only the first
+// call closes the client, the subsequent ones return nil.
+func (c *Client) Close() error {
 	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
-		return // TODO: ErrAlreadyClosed
+		return nil
 	}
 
 	c.muReconnect.Lock()
@@ -553,38 +912,62 @@ func (c *Client) Close() {
 
 	close(c.closeChan)
 
+	if q := c.sendQueue(); q != nil {
+		q.close(errors.New("can't send, client is closed"))
+	}
+
 	if c.closeRenewer != nil {
-		select {
-		case c.closeRenewer <- struct{}{}:
-		default:
-		}
+		c.closeRenewer()
 	}
 
 	// wait for consumers to finish buffered messages
 	c.wg.Wait()
 
 	if session := c.getSession(); session != nil {
-		session.Close(3000, "Go away!")
+		err := session.Close(3000, "Go away!")
+
+		// The session may have been already closed by the remote side.
+		if err != nil && !sockjsclient.IsSessionClosed(err) {
+			return err
+		}
 	}
+
+	return nil
 }
 
 // sendhub sends the msg received from the send channel to the remote client
 func (c *Client) sendHub() {
 	defer c.wg.Done()
+	defer func() {
+		if v := recover(); v != nil {
+			p := c.handlePanic("sendHub", v)
+
+			c.hubMu.Lock()
+			c.hubRunning = false
+			c.hubMu.Unlock()
+
+			// The readloop may already be interrupted, thus the non-blocking send.
+			select {
+			case c.interrupt <- p:
+			default:
+			}
+		}
+	}()
 
 	for {
 		select {
 		case msg := <-c.send:
 			c.LocalKite.Log.Debug("sending: %s", msg)
-			session := c.getSession()
+			session, err := c.sendPayload(msg.p)
 			if session == nil {
 				c.LocalKite.Log.Error("not connected")
 				continue
 			}
 
-			err := session.Send(string(msg.p))
 			if err != nil {
-				if msg.errC != nil {
+				// The message is sent again when the session is resumed,
+				// or over the next session if it's not acknowledged.
+				if msg.errC != nil && !c.resumable() && !c.acking() {
 					msg.errC <- err
 				}
 
@@ -596,7 +979,10 @@ func (c *Client) sendHub() {
 					}
 
 					c.LocalKite.Log.Error("error sending to %s: %s", session.ID(), err)
-					return
+
+					if c.stopSendHub(session) {
+						return
+					}
 				}
 			}
 		case <-c.closeChan:
@@ -606,6 +992,35 @@ func (c *Client) sendHub() {
 	}
 }
 
+// startSendHub starts sendHub, unless it's already running.
+func (c *Client) startSendHub() {
+	c.hubMu.Lock()
+	defer c.hubMu.Unlock()
+
+	if c.hubRunning {
+		return
+	}
+
+	c.hubRunning = true
+	c.wg.Add(1)
+	go c.sendHub()
+}
+
+// stopSendHub is called by sendHub when the session broke. It returns
+// false, if the session was already replaced and sendHub should continue.
+func (c *Client) stopSendHub(session Session) bool {
+	c.hubMu.Lock()
+	defer c.hubMu.Unlock()
+
+	if c.getSession() != session {
+		return false
+	}
+
+	c.hubRunning = false
+
+	return true
+}
+
 // OnConnect adds a callback which is called when client connects
 // to a remote kite.
 func (c *Client) OnConnect(handler func()) {
@@ -638,6 +1053,30 @@ func (c *Client) OnTokenRenew(handler func(token string)) {
 	c.m.Unlock()
 }
 
+// ReconnectAttempt describes a failed attempt to redial the remote kite.
+type ReconnectAttempt struct {
+	// Attempt is the number of the attempt, starting from 1.
+	Attempt int
+
+	// Err is the reason the attempt failed.
+	Err error
+
+	// Delay is the time until the next attempt.
+	Delay time.Duration
+
+	// GaveUp is true when the client stops redialing, as the
+	// Config.Redial.MaxElapsedTime has passed.
+	GaveUp bool
+}
+
+// OnReconnectAttempt adds a callback which is called when the client
+// fails to redial the remote kite, see DialForever and Reconnect.
+func (c *Client) OnReconnectAttempt(handler func(*ReconnectAttempt)) {
+	c.m.Lock()
+	c.onReconnectAttemptHandlers = append(c.onReconnectAttemptHandlers, handler)
+	c.m.Unlock()
+}
+
 // callOnConnectHandlers runs the registered connect handlers.
 func (c *Client) callOnConnectHandlers() {
 	c.m.RLock()
@@ -651,6 +1090,20 @@ func (c *Client) callOnConnectHandlers() {
 	}
 }
 
+// callOnReconnectAttemptHandlers runs the registered reconnect attempt
+// handlers.
+func (c *Client) callOnReconnectAttemptHandlers(attempt *ReconnectAttempt) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	for _, handler := range c.onReconnectAttemptHandlers {
+		func() {
+			defer nopRecover()
+			handler(attempt)
+		}()
+	}
+}
+
 // callOnDisconnectHandlers runs the registered disconnect handlers.
 func (c *Client) callOnDisconnectHandlers() {
 	c.m.RLock()
@@ -692,13 +1145,17 @@ func (c *Client) callOnTokenRenewHandlers(token string) {
 	}
 }
 
-func (c *Client) wrapMethodArgs(args []interface{}, responseCallback dnode.Function) []interface{} {
+func (c *Client) wrapMethodArgs(args []interface{}, responseCallback dnode.Function, requestID string, timeout time.Duration, stream *streamFuncs) []interface{} {
 	options := callOptionsOut{
 		WithArgs: args,
 		callOptions: callOptions{
 			Kite:             *c.LocalKite.Kite(),
 			Auth:             c.authCopy(),
 			ResponseCallback: responseCallback,
+			Metadata:         c.metadata(),
+			RequestID:        requestID,
+			Timeout:          int64(timeout / time.Millisecond),
+			Stream:           stream,
 		},
 	}
 	return []interface{}{options}
@@ -713,11 +1170,7 @@ func (c *Client) Tell(method string, args ...interface{}) (result *dnode.Partial
 
 // SendWebRTCRequest sends requests to kontrol for signalling purposes.
 func (c *Client) SendWebRTCRequest(req *protocol.WebRTCSignalMessage) error {
-	timeout := time.Duration(0)
-	if c.Config != nil {
-		timeout = c.Config.Timeout
-	}
-	_, err := c.TellWithTimeout(WebRTCHandlerName, timeout, req)
+	_, err := c.TellWithTimeout(WebRTCHandlerName, c.config().Timeout, req)
 	return err
 }
 
@@ -739,18 +1192,64 @@ func (c *Client) Go(method string, args ...interface{}) chan *response {
 // extra argument that is the timeout for waiting reply from the remote Kite.
 // If timeout is given 0, the behavior is same as Go().
 func (c *Client) GoWithTimeout(method string, timeout time.Duration, args ...interface{}) chan *response {
+	return c.goWithID(method, timeout, "", args, nil)
+}
+
+// TellWithContext does the same thing with Tell() method except the call
+// is sent with the request ID carried by the ctx, see RequestIDFromContext.
+// Passing the Request.Context of a handler correlates the call with the
+// request being handled. If the ctx has a deadline, the call times out
+// when it's exceeded.
+func (c *Client) TellWithContext(ctx context.Context, method string, args ...interface{}) (result *dnode.Partial, err error) {
+	response := <-c.GoWithContext(ctx, method, args...)
+	return response.Result, response.Err
+}
+
+// GoWithContext does the same thing with Go() method except the call
+// is sent with the request ID carried by the ctx, like TellWithContext().
+func (c *Client) GoWithContext(ctx context.Context, method string, args ...interface{}) chan *response {
+	var timeout time.Duration
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if timeout = time.Until(deadline); timeout <= 0 {
+			timeout = time.Nanosecond
+		}
+	}
+
+	id, _ := RequestIDFromContext(ctx)
+
+	return c.goWithID(method, timeout, id, args, nil)
+}
+
+// goWithID sends the method with the given request ID, a new one
+// is generated if it's empty. The stream, if not nil, are the functions
+// of the reader of the streamed result.
+func (c *Client) goWithID(method string, timeout time.Duration, requestID string, args []interface{}, stream *streamFuncs) chan *response {
+	if requestID == "" {
+		requestID = c.LocalKite.newID()
+	}
+
 	// We will return this channel to the caller.
 	// It can wait on this channel to get the response.
 	responseChan := make(chan *response, 1)
 
-	c.sendMethod(method, args, timeout, responseChan)
+	if call := c.interceptedCall(timeout, requestID, stream); call != nil {
+		go func() {
+			result, err := call(method, args)
+			responseChan <- &response{result, err}
+		}()
+
+		return responseChan
+	}
+
+	c.sendMethod(method, args, timeout, requestID, stream, responseChan)
 
 	return responseChan
 }
 
 // sendMethod wraps the arguments, adds a response callback,
 // marshals the message and send it over the wire.
-func (c *Client) sendMethod(method string, args []interface{}, timeout time.Duration, responseChan chan *response) {
+func (c *Client) sendMethod(method string, args []interface{}, timeout time.Duration, requestID string, stream *streamFuncs, responseChan chan *response) {
 	// To clean the sent callback after response is received.
 	// Send/Receive in a channel to prevent race condition because
 	// the callback is run in a separate goroutine.
@@ -759,16 +1258,17 @@ func (c *Client) sendMethod(method string, args []interface{}, timeout time.Dura
 	// When a callback is called it will send the response to this channel.
 	doneChan := make(chan *response, 1)
 
-	cb := c.makeResponseCallback(doneChan, removeCallback, method, args)
-	args = c.wrapMethodArgs(args, cb)
+	cb := c.makeResponseCallback(doneChan, removeCallback, method, args, requestID)
+	args = c.wrapMethodArgs(args, cb, requestID, timeout, stream)
 
 	callbacks, errC, err := c.marshalAndSend(method, args)
 	if err != nil {
 		responseChan <- &response{
 			Result: nil,
 			Err: &Error{
-				Type:    "sendError",
-				Message: err.Error(),
+				Type:      "sendError",
+				Message:   err.Error(),
+				RequestID: requestID,
 			},
 		}
 		return
@@ -799,8 +1299,18 @@ func (c *Client) sendMethod(method string, args []interface{}, timeout time.Dura
 			responseChan <- &response{
 				nil,
 				&Error{
-					Type:    "disconnect",
-					Message: "Remote kite has disconnected",
+					Type:      "disconnect",
+					Message:   "Remote kite has disconnected",
+					RequestID: requestID,
+				},
+			}
+		case <-c.closeChan:
+			responseChan <- &response{
+				nil,
+				&Error{
+					Type:      "disconnect",
+					Message:   "Client is closed",
+					RequestID: requestID,
 				},
 			}
 		case err := <-errC:
@@ -808,8 +1318,9 @@ func (c *Client) sendMethod(method string, args []interface{}, timeout time.Dura
 				responseChan <- &response{
 					nil,
 					&Error{
-						Type:    "sendError",
-						Message: err.Error(),
+						Type:      "sendError",
+						Message:   err.Error(),
+						RequestID: requestID,
 					},
 				}
 			}
@@ -817,8 +1328,9 @@ func (c *Client) sendMethod(method string, args []interface{}, timeout time.Dura
 			responseChan <- &response{
 				nil,
 				&Error{
-					Type:    "timeout",
-					Message: fmt.Sprintf("No response to %q method in %s", method, timeout),
+					Type:      "timeout",
+					Message:   fmt.Sprintf("No response to %q method in %s", method, timeout),
+					RequestID: requestID,
 				},
 			}
 
@@ -836,8 +1348,8 @@ func (c *Client) sendMethod(method string, args []interface{}, timeout time.Dura
 // marshalAndSend takes a method and arguments, scrubs the arguments to create
 // a dnode message, marshals the message to JSON and sends it over the wire.
 func (c *Client) marshalAndSend(method interface{}, arguments []interface{}) (callbacks map[string]dnode.Path, errC <-chan error, err error) {
-	// scrub trough the arguments and save any callbacks.
-	callbacks = c.scrubber.Scrub(arguments)
+	// scrub trough the arguments and save any callbacks and attachments.
+	callbacks, attachments := c.scrubber.ScrubAttachments(arguments)
 
 	defer func() {
 		if err != nil {
@@ -850,18 +1362,7 @@ func (c *Client) marshalAndSend(method interface{}, arguments []interface{}) (ca
 		arguments = make([]interface{}, 0)
 	}
 
-	rawArgs, err := json.Marshal(arguments)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	msg := dnode.Message{
-		Method:    method,
-		Arguments: &dnode.Partial{Raw: rawArgs},
-		Callbacks: callbacks,
-	}
-
-	p, err := json.Marshal(msg)
+	p, err := encodeMessage(method, arguments, callbacks, attachments)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -870,34 +1371,57 @@ func (c *Client) marshalAndSend(method interface{}, arguments []interface{}) (ca
 	case <-c.closeChan:
 		return nil, nil, errors.New("can't send, client is closed")
 	default:
-		if c.getSession() == nil {
-			return nil, nil, errors.New("can't send, session is not established yet")
+		if err := c.checkAckWindow(); err != nil {
+			return nil, nil, err
 		}
 
 		errC := make(chan error, 1)
 
-		c.send <- &message{
+		msg := &message{
 			p:    p,
 			errC: errC,
 		}
 
+		if q := c.sendQueue(); q != nil {
+			queued, err := q.push(msg)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if queued {
+				return callbacks, errC, nil
+			}
+		}
+
+		if c.getSession() == nil {
+			return nil, nil, errors.New("can't send, session is not established yet")
+		}
+
+		select {
+		case c.send <- msg:
+		case <-c.closeChan:
+			return nil, nil, errors.New("can't send, client is closed")
+		}
+
 		return callbacks, errC, nil
 	}
 }
 
-func (c *Client) getSession() sockjs.Session {
+func (c *Client) getSession() Session {
 	c.m.RLock()
 	defer c.m.RUnlock()
 
 	return c.session
 }
 
-func (c *Client) setSession(session sockjs.Session) {
+func (c *Client) setSession(session Session) {
 	c.testHookSetSession(session)
 
 	c.m.Lock()
 	c.session = session
 	c.m.Unlock()
+
+	c.setRemoteCapabilities(nil)
 }
 
 // Used to remove callbacks after error occurs in send().
@@ -915,7 +1439,7 @@ func (c *Client) config() *config.Config {
 	if c.Config != nil {
 		return c.Config
 	}
-	return c.LocalKite.Config
+	return c.LocalKite.config()
 }
 
 // sendCallbackID send the callback number to be deleted after response is received.
@@ -946,7 +1470,7 @@ func sendCallbackID(callbacks map[string]dnode.Path, ch chan<- uint64) {
 // makeResponseCallback prepares and returns a callback function sent to the server.
 // The caller of the Tell() is blocked until the server calls this callback function.
 // Sets theResponse and notifies the caller by sending to done channel.
-func (c *Client) makeResponseCallback(doneChan chan *response, removeCallback <-chan uint64, method string, args []interface{}) dnode.Function {
+func (c *Client) makeResponseCallback(doneChan chan *response, removeCallback <-chan uint64, method string, args []interface{}, requestID string) dnode.Function {
 	return dnode.Callback(func(arguments *dnode.Partial) {
 		// Single argument of response callback.
 		var resp struct {
@@ -957,6 +1481,10 @@ func (c *Client) makeResponseCallback(doneChan chan *response, removeCallback <-
 		// Notify that the callback is finished.
 		defer func() {
 			if resp.Err != nil {
+				if resp.Err.RequestID == "" {
+					resp.Err.RequestID = requestID
+				}
+
 				c.LocalKite.Log.Debug("Error received from kite: %q method: %q args: %#v err: %s", c.Kite.Name, method, args, resp.Err.Error())
 				doneChan <- &response{resp.Result, resp.Err}
 			} else {
@@ -1022,30 +1550,13 @@ func onError(err error) {
 			response := Response{
 				Result: nil,
 				Error: &Error{
-					Type:    "methodNotFound",
-					Message: err.Error(),
+					Type:      "methodNotFound",
+					Message:   err.Error(),
+					RequestID: options.RequestID,
 				},
+				ID: options.RequestID,
 			}
 			options.ResponseCallback.Call(response)
 		}
 	}
 }
-
-type lockedBackoff struct {
-	mu sync.Mutex
-	b  backoff.BackOff
-}
-
-func (lb *lockedBackoff) NextBackOff() time.Duration {
-	lb.mu.Lock()
-	defer lb.mu.Unlock()
-
-	return lb.b.NextBackOff()
-}
-
-func (lb *lockedBackoff) Reset() {
-	lb.mu.Lock()
-	defer lb.mu.Unlock()
-
-	lb.b.Reset()
-}
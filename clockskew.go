@@ -0,0 +1,114 @@
+package kite
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/koding/kite/v2/kitekey"
+)
+
+// clockSkew holds the clock skew measured against Kontrol.
+type clockSkew struct {
+	mu       sync.Mutex
+	skew     time.Duration
+	exceeded bool // whether skew exceeds the threshold
+}
+
+// ClockSkew gives the difference between the local time and the time of
+// Kontrol, measured with the Date header of the last Kontrol response.
+// It is positive when the local clock is ahead of Kontrol's one.
+//
+// The skew is measured with a precision of one second, it is 0 until
+// the Kite receives any response from Kontrol.
+func (k *Kite) ClockSkew() time.Duration {
+	k.clockSkew.mu.Lock()
+	defer k.clockSkew.mu.Unlock()
+
+	return k.clockSkew.skew
+}
+
+func (k *Kite) clockSkewThreshold() time.Duration {
+	switch {
+	case k.Config.ClockSkewThreshold != 0:
+		return k.Config.ClockSkewThreshold
+	case k.Config.TokenLeeway != 0:
+		return k.Config.TokenLeeway
+	default:
+		return time.Minute
+	}
+}
+
+// checkClockSkew measures the clock skew with the Date header of
+// the Kontrol response. When the skew exceeds the threshold, a warning
+// is logged and EventClockSkew is sent, so operators know why tokens
+// are rejected.
+func (k *Kite) checkClockSkew(source string, h http.Header) {
+	threshold := k.clockSkewThreshold()
+	if threshold < 0 {
+		return
+	}
+
+	date, err := http.ParseTime(h.Get("Date"))
+	if err != nil {
+		return
+	}
+
+	skew := time.Now().Sub(date).Truncate(time.Second)
+	exceeded := skew > threshold || -skew > threshold
+
+	k.clockSkew.mu.Lock()
+	changed := exceeded != k.clockSkew.exceeded
+	k.clockSkew.skew = skew
+	k.clockSkew.exceeded = exceeded
+	k.clockSkew.mu.Unlock()
+
+	if !changed {
+		return
+	}
+
+	if exceeded {
+		k.Log.Warning("Clock skew with Kontrol (%s) is %s, which exceeds %s: tokens may be rejected "+
+			"as expired or not valid yet; synchronize the clocks or increase TokenLeeway", source, skew, threshold)
+	} else {
+		k.Log.Info("Clock skew with Kontrol (%s) is %s, back within %s", source, skew, threshold)
+	}
+
+	k.emit(&Event{
+		Type: EventClockSkew,
+		Skew: skew,
+	})
+}
+
+// validateTokenTime validates the exp, nbf and iat claims of the token,
+// tolerating the clock skew of Config.TokenLeeway.
+func (k *Kite) validateTokenTime(claims *kitekey.KiteClaims) error {
+	now := jwt.TimeFunc()
+	leeway := k.Config.TokenLeeway
+
+	var msg string
+
+	switch {
+	case !claims.VerifyExpiresAt(now.Add(-leeway).Unix(), false):
+		msg = fmt.Sprintf("token is expired by %v", now.Sub(time.Unix(claims.ExpiresAt, 0)))
+	case !claims.VerifyNotBefore(now.Add(leeway).Unix(), false):
+		msg = "token is not valid yet"
+	case !claims.VerifyIssuedAt(now.Add(leeway).Unix(), false):
+		msg = "token used before issued"
+	default:
+		return nil
+	}
+
+	k.clockSkew.mu.Lock()
+	skew, exceeded := k.clockSkew.skew, k.clockSkew.exceeded
+	k.clockSkew.mu.Unlock()
+
+	if exceeded {
+		msg += fmt.Sprintf(" (clock skew with Kontrol is %s)", skew)
+	}
+
+	return errors.New(msg)
+}
@@ -0,0 +1,134 @@
+package kite
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/koding/kite/v2/kitekey"
+)
+
+func TestClockSkew(t *testing.T) {
+	var offset int64 // time.Duration, accessed atomically
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		date := time.Now().Add(time.Duration(atomic.LoadInt64(&offset)))
+		w.Header().Set("Date", date.UTC().Format(http.TimeFormat))
+		w.Write([]byte(`{"keys":[]}`))
+	}))
+	defer srv.Close()
+
+	k := New("clockskew", "0.0.1")
+	k.Config.JWKSURL = srv.URL
+
+	sub := k.SubscribeEvents(4, EventClockSkew)
+	defer sub.Unsubscribe()
+
+	fetch := func(d time.Duration) {
+		atomic.StoreInt64(&offset, int64(d))
+
+		if _, err := k.fetchJWKS(); err != nil {
+			t.Fatalf("fetchJWKS()=%s", err)
+		}
+	}
+
+	fetch(0)
+
+	if skew := k.ClockSkew(); skew < -time.Second || skew > time.Second {
+		t.Fatalf("got %s skew, want ~0s", skew)
+	}
+
+	select {
+	case ev := <-sub.C:
+		t.Fatalf("unexpected event: %+v", ev)
+	default:
+	}
+
+	fetch(-10 * time.Minute)
+
+	if skew := k.ClockSkew(); skew < 9*time.Minute || skew > 11*time.Minute {
+		t.Fatalf("got %s skew, want ~10m", skew)
+	}
+
+	select {
+	case ev := <-sub.C:
+		if ev.Skew != k.ClockSkew() {
+			t.Fatalf("got %s skew, want %s", ev.Skew, k.ClockSkew())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for EventClockSkew")
+	}
+
+	// The event is not sent again while the skew exceeds the threshold.
+	fetch(-10 * time.Minute)
+
+	select {
+	case ev := <-sub.C:
+		t.Fatalf("unexpected event: %+v", ev)
+	default:
+	}
+
+	fetch(0)
+
+	select {
+	case ev := <-sub.C:
+		if ev.Skew < -time.Second || ev.Skew > time.Second {
+			t.Fatalf("got %s skew, want ~0s", ev.Skew)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for EventClockSkew")
+	}
+}
+
+func TestTokenLeeway(t *testing.T) {
+	k := New("leeway", "0.0.1")
+
+	now := time.Now()
+
+	expired := &kitekey.KiteClaims{
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: now.Add(-30 * time.Second).Unix(),
+		},
+	}
+
+	notYet := &kitekey.KiteClaims{
+		StandardClaims: jwt.StandardClaims{
+			IssuedAt:  now.Add(30 * time.Second).Unix(),
+			NotBefore: now.Add(30 * time.Second).Unix(),
+			ExpiresAt: now.Add(time.Hour).Unix(),
+		},
+	}
+
+	err := k.validateTokenTime(expired)
+	if err == nil || !strings.Contains(err.Error(), "token is expired") {
+		t.Fatalf("got %v, want token is expired error", err)
+	}
+
+	if err := k.validateTokenTime(notYet); err == nil {
+		t.Fatal("expected token to be not valid yet")
+	}
+
+	k.Config.TokenLeeway = time.Minute
+
+	if err := k.validateTokenTime(expired); err != nil {
+		t.Fatalf("validateTokenTime()=%s", err)
+	}
+
+	if err := k.validateTokenTime(notYet); err != nil {
+		t.Fatalf("validateTokenTime()=%s", err)
+	}
+
+	k.Config.TokenLeeway = 0
+	k.checkClockSkew("test", http.Header{
+		"Date": {now.Add(-5 * time.Minute).UTC().Format(http.TimeFormat)},
+	})
+
+	err = k.validateTokenTime(expired)
+	if err == nil || !strings.Contains(err.Error(), "token is expired") || !strings.Contains(err.Error(), "clock skew") {
+		t.Fatalf("got %v, want token is expired error with clock skew", err)
+	}
+}
@@ -0,0 +1,277 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/koding/kite/v2/kitekey"
+
+	"github.com/koding/multiconfig"
+)
+
+// File describes the Config fields, which can be set in a configuration
+// file or with command line flags. Zero values are not applied.
+//
+// Example kite.yaml file:
+//
+//	username: koding
+//	port: 6000
+//	transport: WebSocket
+//	kontrolURL: https://koding.com/kontrol/kite
+//	timeout: 30s
+type File struct {
+	KiteKeyFile string `json:"kiteKeyFile" yaml:"kiteKeyFile" toml:"kiteKeyFile"` // path to the kite.key
+
+	Username    string `json:"username" yaml:"username" toml:"username"`
+	Environment string `json:"environment" yaml:"environment" toml:"environment"`
+	Region      string `json:"region" yaml:"region" toml:"region"`
+	ID          string `json:"id" yaml:"id" toml:"id"`
+	IP          string `json:"ip" yaml:"ip" toml:"ip"`
+	Port        int    `json:"port" yaml:"port" toml:"port"`
+	MaxPort     int    `json:"maxPort" yaml:"maxPort" toml:"maxPort"`
+	Transport   string `json:"transport" yaml:"transport" toml:"transport"` // "WebSocket", "XHRPolling" or "auto"
+	RegisterURL string `json:"registerURL" yaml:"registerURL" toml:"registerURL"`
+
+	DisableAuthentication bool `json:"disableAuthentication" yaml:"disableAuthentication" toml:"disableAuthentication"`
+	DisableConcurrency    bool `json:"disableConcurrency" yaml:"disableConcurrency" toml:"disableConcurrency"`
+
+	KontrolURL  string `json:"kontrolURL" yaml:"kontrolURL" toml:"kontrolURL"`
+	KontrolKey  string `json:"kontrolKey" yaml:"kontrolKey" toml:"kontrolKey"`
+	KontrolUser string `json:"kontrolUser" yaml:"kontrolUser" toml:"kontrolUser"`
+	JWKSURL     string `json:"jwksURL" yaml:"jwksURL" toml:"jwksURL"`
+
+	Timeout            Duration `json:"timeout" yaml:"timeout" toml:"timeout"`
+	HandshakeTimeout   Duration `json:"handshakeTimeout" yaml:"handshakeTimeout" toml:"handshakeTimeout"`
+	VerifyTTL          Duration `json:"verifyTTL" yaml:"verifyTTL" toml:"verifyTTL"`
+	TokenLeeway        Duration `json:"tokenLeeway" yaml:"tokenLeeway" toml:"tokenLeeway"`
+	ClockSkewThreshold Duration `json:"clockSkewThreshold" yaml:"clockSkewThreshold" toml:"clockSkewThreshold"`
+
+	// ReadBufferSize and WriteBufferSize set the buffer sizes
+	// of websocket client connections.
+	ReadBufferSize  int `json:"readBufferSize" yaml:"readBufferSize" toml:"readBufferSize"`
+	WriteBufferSize int `json:"writeBufferSize" yaml:"writeBufferSize" toml:"writeBufferSize"`
+
+	TLSCertFile string `json:"tlsCertFile" yaml:"tlsCertFile" toml:"tlsCertFile"`
+	TLSKeyFile  string `json:"tlsKeyFile" yaml:"tlsKeyFile" toml:"tlsKeyFile"`
+
+	PreferEnvironment bool `json:"preferEnvironment" yaml:"preferEnvironment" toml:"preferEnvironment"`
+	PreferRegion      bool `json:"preferRegion" yaml:"preferRegion" toml:"preferRegion"`
+
+	DisableBuiltins []string          `json:"disableBuiltins" yaml:"disableBuiltins" toml:"disableBuiltins"`
+	Metadata        map[string]string `json:"metadata" yaml:"metadata" toml:"metadata"`
+}
+
+// Load gives a new Config, which is read from the given file, environment
+// variables and command line arguments, in that order. Values read later
+// override the earlier ones.
+//
+// If path is empty, no file is read. If args is nil, no flags are parsed.
+func Load(path string, args []string) (*Config, error) {
+	c := New()
+
+	if path != "" {
+		if err := c.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.ReadEnvironmentVariables(); err != nil {
+		return nil, err
+	}
+
+	if args != nil {
+		if err := c.ReadFlags(args); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// FromFile gives a new Config read from the given file, overridden
+// with the environment variables.
+//
+// The format of the file is chosen by its extension, supported ones
+// are ".json", ".yaml", ".yml" and ".toml".
+func FromFile(path string) (*Config, error) {
+	return Load(path, nil)
+}
+
+// ReadFile reads the given file and applies its values to c.
+func (c *Config) ReadFile(path string) error {
+	var loader multiconfig.Loader
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		loader = &multiconfig.JSONLoader{Path: path}
+	case ".yaml", ".yml":
+		loader = &multiconfig.YAMLLoader{Path: path}
+	case ".toml":
+		loader = &multiconfig.TOMLLoader{Path: path}
+	default:
+		return fmt.Errorf("config: unsupported file format: %q", path)
+	}
+
+	var f File
+
+	if err := loader.Load(&f); err != nil {
+		return fmt.Errorf("config: unable to read %q: %s", path, err)
+	}
+
+	return f.Apply(c)
+}
+
+// ReadFlags parses the given command line arguments and applies
+// the values of the flags to c. See (*File).Flags for the list of flags.
+func (c *Config) ReadFlags(args []string) error {
+	var f File
+
+	fs := flag.NewFlagSet("kite", flag.ContinueOnError)
+	f.Flags(fs)
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	return f.Apply(c)
+}
+
+// Flags registers flags for the fields of f in the given flag set.
+//
+// It can be used to add the kite flags to the flag set of an application.
+func (f *File) Flags(fs *flag.FlagSet) {
+	fs.StringVar(&f.KiteKeyFile, "kite-key", "", "Path to the kite.key file.")
+	fs.StringVar(&f.Username, "username", "", "Username of the kite.")
+	fs.StringVar(&f.Environment, "environment", "", "Environment of the kite.")
+	fs.StringVar(&f.Region, "region", "", "Region of the kite.")
+	fs.StringVar(&f.ID, "id", "", "ID of the kite.")
+	fs.StringVar(&f.IP, "ip", "", "IP address to listen on.")
+	fs.IntVar(&f.Port, "port", 0, "Port number to listen on.")
+	fs.IntVar(&f.MaxPort, "max-port", 0, "Last port number to try, if the port is taken.")
+	fs.StringVar(&f.RegisterURL, "register-url", "", "URL to register with, if it differs from the listening address.")
+	fs.StringVar(&f.Transport, "transport", "", "Transport to use: WebSocket, XHRPolling or auto.")
+	fs.BoolVar(&f.DisableAuthentication, "disable-authentication", false, "Do not require authentication for requests.")
+	fs.BoolVar(&f.DisableConcurrency, "disable-concurrency", false, "Do not process messages concurrently.")
+	fs.StringVar(&f.KontrolURL, "kontrol-url", "", "URL of Kontrol.")
+	fs.StringVar(&f.KontrolUser, "kontrol-user", "", "Username of Kontrol.")
+	fs.StringVar(&f.JWKSURL, "jwks-url", "", "URL of the JWKS document of Kontrol.")
+	fs.Var(&f.Timeout, "timeout", "Timeout of kite requests and XHR polling.")
+	fs.Var(&f.HandshakeTimeout, "handshake-timeout", "Timeout of the websocket handshake.")
+	fs.Var(&f.VerifyTTL, "verify-ttl", "Time the results of key verification are cached for.")
+	fs.Var(&f.TokenLeeway, "token-leeway", "Clock skew tolerated when validating tokens.")
+	fs.Var(&f.ClockSkewThreshold, "clock-skew-threshold", "Clock skew with Kontrol above which a warning is logged.")
+	fs.IntVar(&f.ReadBufferSize, "read-buffer-size", 0, "Read buffer size of websocket connections.")
+	fs.IntVar(&f.WriteBufferSize, "write-buffer-size", 0, "Write buffer size of websocket connections.")
+	fs.StringVar(&f.TLSCertFile, "tls-cert", "", "Path to the TLS certificate file.")
+	fs.StringVar(&f.TLSKeyFile, "tls-key", "", "Path to the TLS key file.")
+	fs.BoolVar(&f.PreferEnvironment, "prefer-environment", false, "Prefer kites from the same environment.")
+	fs.BoolVar(&f.PreferRegion, "prefer-region", false, "Prefer kites from the same region.")
+}
+
+// Apply sets the non-zero values of f in the given config.
+func (f *File) Apply(c *Config) error {
+	if f.KiteKeyFile != "" {
+		key, err := kitekey.ParseFile(f.KiteKeyFile)
+		if err != nil {
+			return err
+		}
+
+		if err := c.ReadToken(key); err != nil {
+			return err
+		}
+	}
+
+	setString(&c.Username, f.Username)
+	setString(&c.Environment, f.Environment)
+	setString(&c.Region, f.Region)
+	setString(&c.Id, f.ID)
+	setString(&c.IP, f.IP)
+	setString(&c.RegisterURL, f.RegisterURL)
+	setString(&c.KontrolURL, f.KontrolURL)
+	setString(&c.KontrolKey, f.KontrolKey)
+	setString(&c.KontrolUser, f.KontrolUser)
+	setString(&c.JWKSURL, f.JWKSURL)
+	setString(&c.TLSCertFile, f.TLSCertFile)
+	setString(&c.TLSKeyFile, f.TLSKeyFile)
+
+	if f.Port != 0 {
+		c.Port = f.Port
+	}
+
+	if f.MaxPort != 0 {
+		c.MaxPort = f.MaxPort
+	}
+
+	if f.Transport != "" {
+		transport, ok := Transports[f.Transport]
+		if !ok {
+			return fmt.Errorf("transport '%s' doesn't exists", f.Transport)
+		}
+
+		c.Transport = transport
+	}
+
+	c.DisableAuthentication = c.DisableAuthentication || f.DisableAuthentication
+	c.DisableConcurrency = c.DisableConcurrency || f.DisableConcurrency
+	c.PreferEnvironment = c.PreferEnvironment || f.PreferEnvironment
+	c.PreferRegion = c.PreferRegion || f.PreferRegion
+
+	if f.Timeout != 0 {
+		c.Timeout = time.Duration(f.Timeout)
+
+		if c.Client != nil {
+			c.Client.Timeout = time.Duration(f.Timeout)
+		}
+	}
+
+	if f.VerifyTTL != 0 {
+		c.VerifyTTL = time.Duration(f.VerifyTTL)
+	}
+
+	if f.TokenLeeway != 0 {
+		c.TokenLeeway = time.Duration(f.TokenLeeway)
+	}
+
+	if f.ClockSkewThreshold != 0 {
+		c.ClockSkewThreshold = time.Duration(f.ClockSkewThreshold)
+	}
+
+	if c.Websocket != nil {
+		if f.HandshakeTimeout != 0 {
+			c.Websocket.HandshakeTimeout = time.Duration(f.HandshakeTimeout)
+		}
+
+		if f.ReadBufferSize != 0 {
+			c.Websocket.ReadBufferSize = f.ReadBufferSize
+		}
+
+		if f.WriteBufferSize != 0 {
+			c.Websocket.WriteBufferSize = f.WriteBufferSize
+		}
+	}
+
+	if len(f.DisableBuiltins) != 0 {
+		c.DisableBuiltins = f.DisableBuiltins
+	}
+
+	if len(f.Metadata) != 0 {
+		if c.Metadata == nil {
+			c.Metadata = make(map[string]string, len(f.Metadata))
+		}
+
+		for k, v := range f.Metadata {
+			c.Metadata[k] = v
+		}
+	}
+
+	return nil
+}
+
+func setString(dst *string, s string) {
+	if s != "" {
+		*dst = s
+	}
+}
@@ -0,0 +1,73 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/koding/kite/v2/config"
+)
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kite-config")
+	if err != nil {
+		t.Fatalf("TempDir()=%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"kite.json": `{"username":"file","region":"eu","port":6000,"transport":"XHRPolling","timeout":"30s","readBufferSize":4096}`,
+		"kite.yaml": "username: file\nregion: eu\nport: 6000\ntransport: XHRPolling\ntimeout: 30s\nreadBufferSize: 4096\n",
+		"kite.toml": "username = \"file\"\nregion = \"eu\"\nport = 6000\ntransport = \"XHRPolling\"\ntimeout = \"30s\"\nreadBufferSize = 4096\n",
+	}
+
+	os.Setenv("KITE_REGION", "us")
+	defer os.Unsetenv("KITE_REGION")
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+
+			if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatalf("WriteFile()=%s", err)
+			}
+
+			c, err := config.Load(path, []string{"-port", "7000"})
+			if err != nil {
+				t.Fatalf("Load()=%s", err)
+			}
+
+			if c.Username != "file" {
+				t.Errorf("got username %q, want %q", c.Username, "file")
+			}
+
+			if c.Region != "us" {
+				t.Errorf("got region %q, want the environment to override it with %q", c.Region, "us")
+			}
+
+			if c.Port != 7000 {
+				t.Errorf("got port %d, want the flag to override it with %d", c.Port, 7000)
+			}
+
+			if c.Transport != config.XHRPolling {
+				t.Errorf("got transport %s, want %s", c.Transport, config.Transport(config.XHRPolling))
+			}
+
+			if c.Timeout != 30*time.Second || c.Client.Timeout != 30*time.Second {
+				t.Errorf("got timeouts %s and %s, want %s", c.Timeout, c.Client.Timeout, 30*time.Second)
+			}
+
+			if c.Websocket.ReadBufferSize != 4096 {
+				t.Errorf("got read buffer size %d, want %d", c.Websocket.ReadBufferSize, 4096)
+			}
+		})
+	}
+}
+
+func TestLoadUnsupported(t *testing.T) {
+	if _, err := config.FromFile("kite.ini"); err == nil {
+		t.Fatal("expected error for unsupported file format")
+	}
+}
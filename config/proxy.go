@@ -0,0 +1,89 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// proxyTransports caches transports of the proxied clients, keyed by
+// proxy URL, so connections to the proxy are reused.
+var proxyTransports = struct {
+	sync.Mutex
+	m map[string]*http.Transport
+}{
+	m: make(map[string]*http.Transport),
+}
+
+// Proxy gives the URL of the proxy the request should be sent through,
+// or nil if the request should not be proxied. It can be used as
+// http.Transport.Proxy.
+//
+// The proxy is given by ProxyURL, if it's set, otherwise it's read
+// from the environment with http.ProxyFromEnvironment.
+func (c *Config) Proxy(req *http.Request) (*url.URL, error) {
+	if c.ProxyURL == "" {
+		return http.ProxyFromEnvironment(req)
+	}
+
+	return parseProxyURL(c.ProxyURL)
+}
+
+// ProxyClient gives the client, which sends its requests through the
+// proxy given by ProxyURL. If ProxyURL is empty or the client has
+// a custom transport, the client is returned as is - the default
+// transport already honors the proxy environment variables.
+func (c *Config) ProxyClient(client *http.Client) *http.Client {
+	if c.ProxyURL == "" || client.Transport != nil {
+		return client
+	}
+
+	proxyTransports.Lock()
+	t, ok := proxyTransports.m[c.ProxyURL]
+	if !ok {
+		t = newProxyTransport(c.ProxyURL)
+		proxyTransports.m[c.ProxyURL] = t
+	}
+	proxyTransports.Unlock()
+
+	proxied := *client
+	proxied.Transport = t
+
+	return &proxied
+}
+
+// newProxyTransport gives a transport configured like the default one,
+// which sends requests through the given proxy.
+func newProxyTransport(proxyURL string) *http.Transport {
+	return &http.Transport{
+		Proxy: func(*http.Request) (*url.URL, error) {
+			return parseProxyURL(proxyURL)
+		},
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+func parseProxyURL(proxyURL string) (*url.URL, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %s", err)
+	}
+
+	switch u.Scheme {
+	case "http", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy URL scheme: %q", u.Scheme)
+	}
+
+	return u, nil
+}
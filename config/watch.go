@@ -0,0 +1,219 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// WatchInterval is the default interval the Watcher checks the file
+// for changes.
+var WatchInterval = 5 * time.Second
+
+// Duration is a time.Duration, which is encoded as a string, like "1m30s".
+// It can be used as a flag.Value.
+type Duration time.Duration
+
+// String implements the flag.Value interface.
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// Set implements the flag.Value interface.
+func (d *Duration) Set(s string) error {
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(dur)
+	return nil
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (d *Duration) UnmarshalText(p []byte) error {
+	return d.Set(string(p))
+}
+
+// RateLimit describes a request rate limit of a method, see
+// (*kite.Method).Throttle for details.
+type RateLimit struct {
+	FillInterval Duration `json:"fillInterval"`
+	Capacity     int64    `json:"capacity"`
+}
+
+// Reloadable holds the settings, which can be changed without restarting
+// the kite. Zero values are not applied.
+type Reloadable struct {
+	LogLevel         string               `json:"logLevel,omitempty"`         // "debug", "info", "warning", ...
+	Timeout          Duration             `json:"timeout,omitempty"`          // see Config.Timeout
+	HandshakeTimeout Duration             `json:"handshakeTimeout,omitempty"` // see Config.Websocket
+	KontrolKey       string               `json:"kontrolKey,omitempty"`       // trusted kontrol public key
+	RateLimits       map[string]RateLimit `json:"rateLimits,omitempty"`       // keyed by method name
+}
+
+// Apply sets the non-zero settings of r in the given config.
+func (r *Reloadable) Apply(c *Config) {
+	// The client and the dialer are replaced with updated copies instead
+	// of being changed in place, as they may be in use already.
+	if r.Timeout != 0 {
+		c.Timeout = time.Duration(r.Timeout)
+
+		if c.Client != nil {
+			client := *c.Client
+			client.Timeout = time.Duration(r.Timeout)
+			c.Client = &client
+		}
+	}
+
+	if r.HandshakeTimeout != 0 && c.Websocket != nil {
+		dialer := *c.Websocket
+		dialer.HandshakeTimeout = time.Duration(r.HandshakeTimeout)
+		c.Websocket = &dialer
+	}
+
+	if r.KontrolKey != "" {
+		c.KontrolKey = r.KontrolKey
+	}
+}
+
+// Watcher reloads the Reloadable settings from a JSON file, when
+// the file changes or the process receives SIGHUP.
+type Watcher struct {
+	path string
+
+	mu        sync.Mutex
+	current   *Reloadable
+	modTime   time.Time
+	listeners []func(*Reloadable)
+
+	closeC chan struct{}
+	once   sync.Once
+}
+
+// Watch reads the settings from the file under the given path and
+// watches it for changes, until the Watcher is closed.
+//
+// The file is checked for changes every WatchInterval.
+func Watch(path string) (*Watcher, error) {
+	w := &Watcher{
+		path:   path,
+		closeC: make(chan struct{}),
+	}
+
+	if _, err := w.read(); err != nil {
+		return nil, err
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go w.watch(hup, WatchInterval)
+
+	return w, nil
+}
+
+// Current gives the most recently read settings.
+func (w *Watcher) Current() *Reloadable {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.current
+}
+
+// OnReload registers a listener, which is called with the new settings
+// each time the file is reloaded.
+func (w *Watcher) OnReload(fn func(*Reloadable)) {
+	w.mu.Lock()
+	w.listeners = append(w.listeners, fn)
+	w.mu.Unlock()
+}
+
+// Reload reads the file and notifies the listeners.
+func (w *Watcher) Reload() error {
+	r, err := w.read()
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	listeners := w.listeners
+	w.mu.Unlock()
+
+	for _, fn := range listeners {
+		fn(r)
+	}
+
+	return nil
+}
+
+// Close stops watching the file.
+func (w *Watcher) Close() error {
+	w.once.Do(func() { close(w.closeC) })
+	return nil
+}
+
+func (w *Watcher) read() (*Reloadable, error) {
+	fi, err := os.Stat(w.path)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var r Reloadable
+	if err := json.Unmarshal(p, &r); err != nil {
+		return nil, err
+	}
+
+	w.mu.Lock()
+	w.current = &r
+	w.modTime = fi.ModTime()
+	w.mu.Unlock()
+
+	return &r, nil
+}
+
+func (w *Watcher) changed() bool {
+	fi, err := os.Stat(w.path)
+	if err != nil {
+		return false
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return !fi.ModTime().Equal(w.modTime)
+}
+
+func (w *Watcher) watch(hup chan os.Signal, interval time.Duration) {
+	defer signal.Stop(hup)
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-w.closeC:
+			return
+		case <-hup:
+			w.Reload()
+		case <-t.C:
+			if w.changed() {
+				w.Reload()
+			}
+		}
+	}
+}
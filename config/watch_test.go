@@ -0,0 +1,75 @@
+// +build !windows
+
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/koding/kite/v2/config"
+)
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kite-watch")
+	if err != nil {
+		t.Fatalf("TempDir()=%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "kite.json")
+
+	if err := ioutil.WriteFile(path, []byte(`{"logLevel":"debug","timeout":"10s"}`), 0644); err != nil {
+		t.Fatalf("WriteFile()=%s", err)
+	}
+
+	w, err := config.Watch(path)
+	if err != nil {
+		t.Fatalf("Watch()=%s", err)
+	}
+	defer w.Close()
+
+	if r := w.Current(); r.LogLevel != "debug" || r.Timeout != config.Duration(10*time.Second) {
+		t.Fatalf("got %+v, want logLevel=debug and timeout=10s", r)
+	}
+
+	reloaded := make(chan *config.Reloadable, 1)
+	w.OnReload(func(r *config.Reloadable) {
+		reloaded <- r
+	})
+
+	content := `{"timeout":"1m","handshakeTimeout":"5s","rateLimits":{"square":{"fillInterval":"1s","capacity":10}}}`
+
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile()=%s", err)
+	}
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatalf("Kill()=%s", err)
+	}
+
+	var r *config.Reloadable
+	select {
+	case r = <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for reload")
+	}
+
+	if limit := r.RateLimits["square"]; limit.Capacity != 10 || limit.FillInterval != config.Duration(time.Second) {
+		t.Fatalf("got %+v, want capacity=10 and fillInterval=1s", limit)
+	}
+
+	cfg := config.New()
+	r.Apply(cfg)
+
+	if cfg.Timeout != time.Minute {
+		t.Fatalf("got %s, want %s", cfg.Timeout, time.Minute)
+	}
+
+	if cfg.Websocket.HandshakeTimeout != 5*time.Second {
+		t.Fatalf("got %s, want %s", cfg.Websocket.HandshakeTimeout, 5*time.Second)
+	}
+}
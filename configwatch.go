@@ -0,0 +1,54 @@
+package kite
+
+import (
+	"time"
+
+	"github.com/koding/kite/v2/config"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// WatchConfig applies the settings read by the given watcher to the kite,
+// and applies them again each time the watcher reloads them.
+//
+// The log level, timeouts, rate limits of the registered methods and
+// the trusted kontrol key can be changed this way. Rate limits for
+// methods which are not registered are ignored.
+func (k *Kite) WatchConfig(w *config.Watcher) {
+	w.OnReload(k.applyReloadable)
+
+	if r := w.Current(); r != nil {
+		k.applyReloadable(r)
+	}
+}
+
+func (k *Kite) applyReloadable(r *config.Reloadable) {
+	if r.LogLevel != "" && k.SetLogLevel != nil {
+		k.SetLogLevel(parseLevel(r.LogLevel))
+	}
+
+	k.configMu.Lock()
+	r.Apply(k.Config)
+
+	if r.KontrolKey != "" {
+		key, err := jwt.ParseRSAPublicKeyFromPEM([]byte(r.KontrolKey))
+		if err != nil {
+			k.Log.Error("unable to reload kontrol key: %s", err)
+		} else {
+			k.kontrolKey = key
+		}
+	}
+	k.configMu.Unlock()
+
+	for name, limit := range r.RateLimits {
+		m, ok := k.method(name)
+		if !ok {
+			k.Log.Warning("unable to reload rate limit: method %q is not registered", name)
+			continue
+		}
+
+		m.setThrottle(time.Duration(limit.FillInterval), limit.Capacity)
+	}
+
+	k.Log.Debug("config reloaded")
+}
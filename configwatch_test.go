@@ -0,0 +1,85 @@
+package kite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/koding/kite/v2/config"
+)
+
+func TestKite_WatchConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kite-watch")
+	if err != nil {
+		t.Fatalf("TempDir()=%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "kite.json")
+	content := `{"timeout":"3s","rateLimits":{"foo":{"fillInterval":"1m","capacity":1}}}`
+
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile()=%s", err)
+	}
+
+	w, err := config.Watch(path)
+	if err != nil {
+		t.Fatalf("Watch()=%s", err)
+	}
+	defer w.Close()
+
+	k := New("testkite", "0.0.1")
+	defer k.Close()
+
+	k.HandleFunc("foo", func(r *Request) (interface{}, error) {
+		return "handle", nil
+	}).Throttle(time.Second, 100)
+
+	k.WatchConfig(w)
+
+	if k.Config.Timeout != 3*time.Second {
+		t.Fatalf("got %s, want %s", k.Config.Timeout, 3*time.Second)
+	}
+
+	bucket := k.handlers["foo"].bucket
+	if bucket == nil || bucket.Capacity() != 1 {
+		t.Fatalf("got %+v, want bucket with capacity 1", bucket)
+	}
+
+	content = `{"rateLimits":{"foo":{"fillInterval":"1m","capacity":0}}}`
+
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile()=%s", err)
+	}
+
+	if err := w.Reload(); err != nil {
+		t.Fatalf("Reload()=%s", err)
+	}
+
+	if bucket := k.handlers["foo"].bucket; bucket != nil {
+		t.Fatalf("got %+v, want throttling to be disabled", bucket)
+	}
+
+	// Reading the config while it's reloaded must not race.
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 100; i++ {
+			cfg := k.config()
+			_, _ = cfg.Timeout, cfg.Websocket.HandshakeTimeout
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		k.applyReloadable(&config.Reloadable{
+			Timeout:          config.Duration(time.Duration(i+1) * time.Second),
+			HandshakeTimeout: config.Duration(time.Duration(i+1) * time.Second),
+		})
+	}
+
+	<-done
+}
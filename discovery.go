@@ -0,0 +1,188 @@
+package kite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/koding/kite/v2/protocol"
+)
+
+// Discovery resolves kites matching the query, when kontrol is unreachable.
+// See Kite.Discovery.
+type Discovery interface {
+	Discover(*protocol.KontrolQuery) ([]*protocol.KiteWithToken, error)
+}
+
+// DiscoveryFunc is a type adapter to allow the use of ordinary functions
+// as discovery.
+type DiscoveryFunc func(*protocol.KontrolQuery) ([]*protocol.KiteWithToken, error)
+
+// Discover calls f(query).
+func (f DiscoveryFunc) Discover(query *protocol.KontrolQuery) ([]*protocol.KiteWithToken, error) {
+	return f(query)
+}
+
+// ErrUnknownService is returned by DNSDiscovery, when the queried kite name
+// is not one of the configured service names.
+var ErrUnknownService = errors.New("unknown service name")
+
+// DNSDiscovery discovers kites with DNS SRV records. For a query with
+// "worker" name it looks up the following record:
+//
+//	_kite._tcp.worker.<Domain>
+//
+// Each target of the record becomes a kite with the register URL
+// of "http://<target>:<port>/kite". DNS carries no other information
+// about the kites, so the remaining fields are copied from the query.
+type DNSDiscovery struct {
+	// Domain is the domain, under which the records are looked up.
+	Domain string
+
+	// Names are the known service names, only these are looked up.
+	// If empty, any name is.
+	Names []string
+
+	// Scheme is the scheme of the register URLs, "http" by default.
+	Scheme string
+
+	// Resolver is used for lookups. If nil, net.DefaultResolver is used.
+	Resolver *net.Resolver
+}
+
+var _ Discovery = (*DNSDiscovery)(nil)
+
+// Discover implements the Discovery interface.
+func (d *DNSDiscovery) Discover(query *protocol.KontrolQuery) ([]*protocol.KiteWithToken, error) {
+	if query.Name == "" {
+		return nil, errors.New("kite name is required for DNS discovery")
+	}
+
+	if !d.known(query.Name) {
+		return nil, ErrUnknownService
+	}
+
+	r := d.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+
+	_, addrs, err := r.LookupSRV(context.Background(), "kite", "tcp", query.Name+"."+d.Domain)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.kites(query, addrs), nil
+}
+
+func (d *DNSDiscovery) known(name string) bool {
+	if len(d.Names) == 0 {
+		return true
+	}
+
+	for _, n := range d.Names {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// kites gives the kites for the SRV records, in the order returned
+// by the resolver, which is sorted by priority and weight.
+func (d *DNSDiscovery) kites(query *protocol.KontrolQuery, addrs []*net.SRV) []*protocol.KiteWithToken {
+	scheme := d.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	kites := make([]*protocol.KiteWithToken, len(addrs))
+
+	for i, addr := range addrs {
+		host := net.JoinHostPort(strings.TrimSuffix(addr.Target, "."), strconv.Itoa(int(addr.Port)))
+
+		kites[i] = &protocol.KiteWithToken{
+			Kite: protocol.Kite{
+				Username:    query.Username,
+				Environment: query.Environment,
+				Name:        query.Name,
+				Version:     query.Version,
+				Region:      query.Region,
+				Hostname:    query.Hostname,
+				ID:          query.ID,
+			},
+			URL: fmt.Sprintf("%s://%s/kite", scheme, host),
+		}
+	}
+
+	return kites
+}
+
+// errKontrolNotConnected is used as the reason of falling back to discovery,
+// when the connection to kontrol is not established in time.
+var errKontrolNotConnected = errors.New("not connected to kontrol")
+
+// getKitesOrDiscover gives the kites matching the query from kontrol. If
+// k.Discovery is set and kontrol is unreachable, the kites are discovered
+// instead.
+func (k *Kite) getKitesOrDiscover(query *protocol.KontrolQuery) ([]*Client, error) {
+	if k.Discovery == nil {
+		return k.getKites(protocol.GetKitesArgs{Query: query})
+	}
+
+	// nil value of timeout means no timeout, see Client.sendMethod
+	var timeout <-chan time.Time
+	if k.config().Timeout > 0 {
+		timeout = time.After(k.config().Timeout)
+	}
+
+	select {
+	case <-k.kontrol.readyConnected:
+	case <-timeout:
+		return k.discover(query, errKontrolNotConnected)
+	}
+
+	clients, err := k.getKites(protocol.GetKitesArgs{Query: query})
+	if e, ok := err.(*Error); ok && (e.Type == "timeout" || e.Type == "disconnect" || e.Type == "sendError") {
+		return k.discover(query, err)
+	}
+
+	return clients, err
+}
+
+func (k *Kite) discover(query *protocol.KontrolQuery, reason error) ([]*Client, error) {
+	kites, err := k.Discovery.Discover(query)
+	if err != nil {
+		return nil, fmt.Errorf("kontrol is unreachable (%s) and discovery failed: %s", reason, err)
+	}
+
+	k.Log.Warning("Kontrol is unreachable (%s), discovered %d kites for %q", reason, len(kites), query.Name)
+
+	clients := make([]*Client, len(kites))
+	for i, currentKite := range kites {
+		auth := &Auth{
+			Type: "token",
+			Key:  currentKite.Token,
+		}
+
+		// Discovered kites have no token, so the kite key is used
+		// to authenticate instead.
+		if currentKite.Token == "" {
+			auth = &Auth{
+				Type: "kiteKey",
+				Key:  k.KiteKey(),
+			}
+		}
+
+		clients[i] = k.NewClient(currentKite.URL)
+		clients[i].Kite = currentKite.Kite
+		clients[i].Auth = auth
+	}
+
+	return clients, nil
+}
@@ -0,0 +1,90 @@
+package kite
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/protocol"
+)
+
+func TestDNSDiscovery_Kites(t *testing.T) {
+	d := &DNSDiscovery{Domain: "example.com", Names: []string{"worker"}}
+
+	if _, err := d.Discover(&protocol.KontrolQuery{Name: "other"}); err != ErrUnknownService {
+		t.Fatalf("got %v, want %v", err, ErrUnknownService)
+	}
+
+	query := &protocol.KontrolQuery{Username: "koding", Name: "worker"}
+	addrs := []*net.SRV{
+		{Target: "worker1.example.com.", Port: 3000},
+		{Target: "worker2.example.com.", Port: 3001},
+	}
+
+	kites := d.kites(query, addrs)
+
+	want := []string{"http://worker1.example.com:3000/kite", "http://worker2.example.com:3001/kite"}
+
+	if len(kites) != len(want) {
+		t.Fatalf("got %d kites, want %d", len(kites), len(want))
+	}
+
+	for i, k := range kites {
+		if k.URL != want[i] || k.Kite.Name != "worker" || k.Kite.Username != "koding" {
+			t.Fatalf("%d: got %+v, want URL %s", i, k, want[i])
+		}
+	}
+}
+
+func TestGetKites_Discovery(t *testing.T) {
+	cfg := config.New()
+	cfg.DisableAuthentication = true
+	cfg.Port = 3656
+
+	w := NewWithConfig("worker", "0.0.1", cfg)
+	w.HandleFunc("hello", func(r *Request) (interface{}, error) {
+		return "hello", nil
+	})
+
+	go w.Run()
+	<-w.ServerReadyNotify()
+	defer w.Close()
+
+	ccfg := config.New()
+	ccfg.KontrolURL = "http://127.0.0.1:3657/kite" // nothing listens here
+	ccfg.Timeout = 500 * time.Millisecond
+
+	k := NewWithConfig("discovery", "0.0.1", ccfg)
+	defer k.Close()
+
+	k.Discovery = DiscoveryFunc(func(query *protocol.KontrolQuery) ([]*protocol.KiteWithToken, error) {
+		return []*protocol.KiteWithToken{{
+			Kite: protocol.Kite{Name: query.Name},
+			URL:  "http://127.0.0.1:3656/kite",
+		}}, nil
+	})
+
+	clients, err := k.GetKites(&protocol.KontrolQuery{Name: "worker"})
+	if err != nil {
+		t.Fatalf("GetKites()=%s", err)
+	}
+	defer Close(clients)
+
+	if len(clients) != 1 {
+		t.Fatalf("got %d clients, want %d", len(clients), 1)
+	}
+
+	if err := clients[0].Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+
+	result, err := clients[0].TellWithTimeout("hello", 5*time.Second)
+	if err != nil {
+		t.Fatalf("TellWithTimeout()=%s", err)
+	}
+
+	if s := result.MustString(); s != "hello" {
+		t.Fatalf("got %q, want %q", s, "hello")
+	}
+}
@@ -0,0 +1,297 @@
+package dnode
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Raw is the type for sending and receiving binary blobs in dnode messages.
+//
+// Raw values are not encoded into the JSON message. They are replaced
+// with a "[Binary]" placeholder and sent as attachments following
+// the message, see AppendAttachments. The receiving side sets them back
+// when the arguments are unmarshaled into a Raw value, so the blobs are
+// never parsed as JSON.
+type Raw []byte
+
+// MarshalJSON gives the placeholder of the attachment.
+func (Raw) MarshalJSON() ([]byte, error) {
+	return []byte(`"[Binary]"`), nil
+}
+
+// UnmarshalJSON does nothing, the value is set from the attachment.
+func (*Raw) UnmarshalJSON([]byte) error {
+	return nil
+}
+
+var rawType = reflect.TypeOf(Raw(nil))
+
+// AttachmentSpec is a structure encapsulating a received attachment
+// and its path in the arguments structure.
+type AttachmentSpec struct {
+	Path Path
+	Data []byte
+}
+
+// ParseAttachments assigns the attachments received with the message to
+// the paths of the message's "attachments" field.
+func ParseAttachments(msg *Message, attachments [][]byte) error {
+	if len(msg.Attachments) != len(attachments) {
+		return fmt.Errorf("got %d attachments, want %d", len(attachments), len(msg.Attachments))
+	}
+
+	if len(attachments) != 0 && msg.Arguments == nil {
+		return errors.New("attachments sent without arguments")
+	}
+
+	if len(attachments) != 0 {
+		specs := make([]AttachmentSpec, len(msg.Arguments.AttachmentSpecs), len(msg.Arguments.AttachmentSpecs)+len(attachments))
+		copy(specs, msg.Arguments.AttachmentSpecs)
+		msg.Arguments.AttachmentSpecs = specs
+	}
+
+	for i, path := range msg.Attachments {
+		spec := AttachmentSpec{path, attachments[i]}
+		msg.Arguments.AttachmentSpecs = append(msg.Arguments.AttachmentSpecs, spec)
+	}
+
+	return nil
+}
+
+// The attachments are appended to the JSON message, each one is
+// prefixed with a separator, its encoding and its length:
+//
+//	{"method":...}\x1e<encoding><length>:<data>\x1e<encoding><length>:<data>
+//
+// The separator is the ASCII record separator, which never occurs in JSON
+// text, so plain JSON messages are left intact, even the ones with
+// newlines sent by pretty-printing peers. The data is sent as is over
+// transports, which deliver messages byte for byte, and base64 encoded
+// over text based ones, see EncodeAttachments.
+const (
+	attachmentSeparator = '\x1e'
+	attachmentRaw       = 'r'
+	attachmentBase64    = 'b'
+)
+
+var attachmentEncoding = base64.StdEncoding
+
+// AttachmentsLen gives the number of bytes AppendAttachments appends
+// for the attachments.
+func AttachmentsLen(attachments [][]byte) int {
+	var n int
+	for _, p := range attachments {
+		n += 3 + len(strconv.Itoa(len(p))) + len(p)
+	}
+	return n
+}
+
+// AppendAttachments appends the raw attachments to the encoded message.
+func AppendAttachments(msg []byte, attachments [][]byte) []byte {
+	if len(attachments) == 0 {
+		return msg
+	}
+
+	// grow the message once for all the attachments.
+	if n := len(msg) + AttachmentsLen(attachments); n > cap(msg) {
+		grown := make([]byte, len(msg), n)
+		copy(grown, msg)
+		msg = grown
+	}
+
+	for _, p := range attachments {
+		msg = append(msg, attachmentSeparator, attachmentRaw)
+		msg = strconv.AppendInt(msg, int64(len(p)), 10)
+		msg = append(msg, ':')
+		msg = append(msg, p...)
+	}
+
+	return msg
+}
+
+// EncodeAttachments gives the message with its raw attachments base64
+// encoded, so it can be sent over text based transports. The message is
+// returned as is if it has no attachments.
+func EncodeAttachments(data []byte) ([]byte, error) {
+	if bytes.IndexByte(data, attachmentSeparator) == -1 {
+		return data, nil
+	}
+
+	msg, attachments, err := SplitAttachments(data)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(msg)
+	for _, p := range attachments {
+		size := attachmentEncoding.EncodedLen(len(p))
+		n += 3 + len(strconv.Itoa(size)) + size
+	}
+
+	encoded := make([]byte, len(msg), n)
+	copy(encoded, msg)
+
+	for _, p := range attachments {
+		size := attachmentEncoding.EncodedLen(len(p))
+
+		encoded = append(encoded, attachmentSeparator, attachmentBase64)
+		encoded = strconv.AppendInt(encoded, int64(size), 10)
+		encoded = append(encoded, ':')
+
+		off := len(encoded)
+		encoded = encoded[:off+size]
+		attachmentEncoding.Encode(encoded[off:], p)
+	}
+
+	return encoded, nil
+}
+
+// SplitAttachments splits the data into the encoded message and its
+// attachments.
+func SplitAttachments(data []byte) (msg []byte, attachments [][]byte, err error) {
+	i := bytes.IndexByte(data, attachmentSeparator)
+	if i == -1 {
+		return data, nil, nil
+	}
+
+	msg, data = data[:i], data[i:]
+
+	for len(data) != 0 {
+		if len(data) < 2 || data[0] != attachmentSeparator {
+			return nil, nil, errors.New("invalid attachment separator")
+		}
+
+		j := bytes.IndexByte(data, ':')
+		if j == -1 {
+			return nil, nil, errors.New("missing attachment length")
+		}
+
+		n, err := strconv.Atoi(string(data[2:j]))
+		if err != nil || n < 0 || n > len(data)-j-1 {
+			return nil, nil, fmt.Errorf("invalid attachment length: %q", data[2:j])
+		}
+
+		p := data[j+1 : j+1+n]
+
+		switch data[1] {
+		case attachmentRaw:
+			p = append([]byte(nil), p...)
+		case attachmentBase64:
+			decoded := make([]byte, attachmentEncoding.DecodedLen(n))
+
+			m, err := attachmentEncoding.Decode(decoded, p)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid attachment: %s", err)
+			}
+
+			p = decoded[:m]
+		default:
+			return nil, nil, fmt.Errorf("invalid attachment encoding: %q", data[1])
+		}
+
+		attachments = append(attachments, p)
+		data = data[j+1+n:]
+	}
+
+	return msg, attachments, nil
+}
+
+func setAttachment(value reflect.Value, path Path, data []byte) error {
+	i := 0
+	for {
+		if value.IsValid() && value.Type() == rawType {
+			if i != len(path) {
+				return fmt.Errorf("attachment path too long: %v", path)
+			}
+			value.SetBytes(data)
+			return nil
+		}
+
+		switch value.Kind() {
+		case reflect.Slice:
+			if i == len(path) {
+				return fmt.Errorf("attachment path too short: %v", path)
+			}
+
+			index, err := pathIndex(path[i])
+			if err != nil {
+				return err
+			}
+
+			if index < 0 || index >= value.Len() {
+				return nil
+			}
+
+			value = value.Index(index)
+			i++
+		case reflect.Map:
+			if i == len(path) {
+				return fmt.Errorf("attachment path too short: %v", path)
+			}
+
+			key, ok := path[i].(string)
+			if !ok {
+				return fmt.Errorf("invalid path: %#v", path[i])
+			}
+
+			// Map values are not addressable, so the blob is set
+			// directly if it is the last element of the path.
+			if elem := value.Type().Elem(); i == len(path)-1 && (elem == rawType || elem.Kind() == reflect.Interface) {
+				value.SetMapIndex(reflect.ValueOf(key), reflect.ValueOf(Raw(data)))
+				return nil
+			}
+
+			value = value.MapIndex(reflect.ValueOf(key))
+			i++
+		case reflect.Ptr:
+			value = value.Elem()
+		case reflect.Interface:
+			if i == len(path) {
+				value.Set(reflect.ValueOf(Raw(data)))
+				return nil
+			}
+			value = value.Elem()
+		case reflect.Struct:
+			if innerPartial, ok := value.Addr().Interface().(*Partial); ok {
+				spec := AttachmentSpec{path[i:], data}
+				innerPartial.AttachmentSpecs = append(innerPartial.AttachmentSpecs, spec)
+				return nil
+			}
+
+			name, ok := path[i].(string)
+			if !ok {
+				return fmt.Errorf("invalid path: %#v", path[i])
+			}
+
+			value = value.FieldByName(strings.ToUpper(name[0:1]) + name[1:])
+			i++
+		case reflect.Invalid:
+			// attachment path does not exist, skip
+			return nil
+		default:
+			return fmt.Errorf("unhandled value of kind '%v' in attachment path: %v", value.Kind(), path)
+		}
+	}
+}
+
+func pathIndex(v interface{}) (int, error) {
+	switch v := v.(type) {
+	case string:
+		index, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("integer expected in path, got '%v'", v)
+		}
+		return index, nil
+	case float64:
+		return int(v), nil
+	case int:
+		return v, nil
+	default:
+		return 0, fmt.Errorf("unknown path type: %#v", v)
+	}
+}
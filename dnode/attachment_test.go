@@ -0,0 +1,150 @@
+package dnode
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestAttachments(t *testing.T) {
+	type file struct {
+		Name    string `json:"name"`
+		Content Raw    `json:"content"`
+	}
+
+	blob := []byte{0x00, 0xff, '\n', 0x1e, ':', 0x7f}
+
+	args := []interface{}{
+		Raw("first"),
+		&file{Name: "blob.bin", Content: blob},
+	}
+
+	s := NewScrubber()
+	callbacks, attachments := s.ScrubAttachments(args)
+
+	rawArgs, err := json.Marshal(args)
+	if err != nil {
+		t.Fatalf("Marshal()=%s", err)
+	}
+
+	msg := Message{
+		Method:    "upload",
+		Arguments: &Partial{Raw: rawArgs},
+		Callbacks: callbacks,
+	}
+
+	var blobs [][]byte
+	for _, a := range attachments {
+		msg.Attachments = append(msg.Attachments, a.Path)
+		blobs = append(blobs, a.Data)
+	}
+
+	p, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Marshal()=%s", err)
+	}
+
+	if bytes.Contains(p, blob) {
+		t.Fatalf("attachment encoded into the message: %s", p)
+	}
+
+	full := AppendAttachments(p, blobs)
+
+	if n := len(full) - len(p); n != AttachmentsLen(blobs) {
+		t.Fatalf("got %d attachments bytes, want %d", AttachmentsLen(blobs), n)
+	}
+
+	encoded, err := EncodeAttachments(full)
+	if err != nil {
+		t.Fatalf("EncodeAttachments()=%s", err)
+	}
+
+	if !utf8.Valid(encoded) {
+		t.Fatalf("encoded attachments are not valid UTF-8: %q", encoded)
+	}
+
+	data, gotBlobs, err := SplitAttachments(full)
+	if err != nil {
+		t.Fatalf("SplitAttachments()=%s", err)
+	}
+
+	if !reflect.DeepEqual(gotBlobs, blobs) {
+		t.Fatalf("got %q, want %q", gotBlobs, blobs)
+	}
+
+	encodedData, encodedBlobs, err := SplitAttachments(encoded)
+	if err != nil {
+		t.Fatalf("SplitAttachments()=%s", err)
+	}
+
+	if !bytes.Equal(encodedData, data) || !reflect.DeepEqual(encodedBlobs, blobs) {
+		t.Fatalf("got %q, want %q", encodedBlobs, blobs)
+	}
+
+	var got Message
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal()=%s", err)
+	}
+
+	if err := ParseAttachments(&got, gotBlobs); err != nil {
+		t.Fatalf("ParseAttachments()=%s", err)
+	}
+
+	var first Raw
+	var second file
+
+	a := got.Arguments.MustSliceOfLength(2)
+	a[0].MustUnmarshal(&first)
+	a[1].MustUnmarshal(&second)
+
+	if string(first) != "first" {
+		t.Fatalf("got %q, want %q", first, "first")
+	}
+
+	if second.Name != "blob.bin" || !bytes.Equal(second.Content, blob) {
+		t.Fatalf("got %+v, want content %q", second, blob)
+	}
+
+	var generic []interface{}
+	got.Arguments.MustUnmarshal(&generic)
+
+	if raw, ok := generic[0].(Raw); !ok || string(raw) != "first" {
+		t.Fatalf("got %#v, want Raw(%q)", generic[0], "first")
+	}
+
+	if raw, ok := generic[1].(map[string]interface{})["content"].(Raw); !ok || !bytes.Equal(raw, blob) {
+		t.Fatalf("got %#v, want Raw(%q)", generic[1], blob)
+	}
+}
+
+func TestSplitAttachmentsInvalid(t *testing.T) {
+	cases := []string{
+		"{}\x1e",
+		"{}\x1eb4",
+		"{}\x1eb4:YQ==x",
+		"{}\x1eb10:YQ==",
+		"{}\x1eb4:!!!!",
+		"{}\x1ex1:a",
+	}
+
+	for _, cas := range cases {
+		if _, _, err := SplitAttachments([]byte(cas)); err == nil {
+			t.Errorf("%q: expected error", cas)
+		}
+	}
+}
+
+func TestSplitAttachmentsNewline(t *testing.T) {
+	data := []byte("{\n  \"method\": \"foo\",\n  \"arguments\": []\n}\n")
+
+	msg, attachments, err := SplitAttachments(data)
+	if err != nil {
+		t.Fatalf("SplitAttachments()=%s", err)
+	}
+
+	if !bytes.Equal(msg, data) || len(attachments) != 0 {
+		t.Fatalf("got %q, %q, want %q", msg, attachments, data)
+	}
+}
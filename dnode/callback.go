@@ -29,10 +29,12 @@ func (f Function) IsValid() bool {
 }
 
 func (f Function) MarshalJSON() ([]byte, error) {
-	if _, ok := f.Caller.(callback); !ok {
+	switch f.Caller.(type) {
+	case callback, persistentCallback:
+		return []byte(`"[Function]"`), nil
+	default:
 		return []byte(`null`), nil
 	}
-	return []byte(`"[Function]"`), nil
 }
 
 func (*Function) UnmarshalJSON(data []byte) error {
@@ -46,6 +48,16 @@ func Callback(f func(*Partial)) Function {
 	}
 }
 
+// PersistentCallback is like Callback, but the function never expires
+// after it's sent, see Scrubber.TTL. It's meant for functions, which the
+// remote side may call rarely during the whole connection, and which
+// are removed with Scrubber.RemoveCallback when no longer needed.
+func PersistentCallback(f func(*Partial)) Function {
+	return Function{
+		Caller: persistentCallback(f),
+	}
+}
+
 type callback func(*Partial)
 
 func (f callback) Call(args ...interface{}) error {
@@ -53,6 +65,12 @@ func (f callback) Call(args ...interface{}) error {
 	panic("you cannot call your own callback method")
 }
 
+type persistentCallback func(*Partial)
+
+func (f persistentCallback) Call(args ...interface{}) error {
+	panic("you cannot call your own callback method")
+}
+
 // functionReceived is a type implementing caller interface.
 // It is used to set the Function when a callback function is received.
 type functionReceived func(...interface{}) error
@@ -76,6 +94,19 @@ type Path []interface{}
 // parseCallbacks parses the message's "callbacks" field and prepares
 // callback functions in "arguments" field.
 func ParseCallbacks(msg *Message, sender func(id uint64, args []interface{}) error) error {
+	if len(msg.Callbacks) == 0 {
+		return nil
+	}
+
+	if msg.Arguments == nil {
+		return errors.New("callbacks sent without arguments")
+	}
+
+	// allocate the specs at once, there's one for each callback.
+	specs := make([]CallbackSpec, len(msg.Arguments.CallbackSpecs), len(msg.Arguments.CallbackSpecs)+len(msg.Callbacks))
+	copy(specs, msg.Arguments.CallbackSpecs)
+	msg.Arguments.CallbackSpecs = specs
+
 	// Parse callbacks field and create callback functions.
 	for methodID, path := range msg.Callbacks {
 		id, err := strconv.ParseUint(methodID, 10, 64)
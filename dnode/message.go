@@ -13,4 +13,8 @@ type Message struct {
 
 	// Integer map of callback paths in arguments
 	Callbacks map[string]Path `json:"callbacks"`
+
+	// Paths of binary attachments in arguments, in the order they
+	// follow the message
+	Attachments []Path `json:"attachments,omitempty"`
 }
@@ -9,8 +9,9 @@ import (
 
 // Partial is the type of "arguments" field in dnode.Message.
 type Partial struct {
-	Raw           []byte
-	CallbackSpecs []CallbackSpec
+	Raw             []byte
+	CallbackSpecs   []CallbackSpec
+	AttachmentSpecs []AttachmentSpec
 }
 
 // MarshalJSON returns the raw bytes of the Partial.
@@ -29,7 +30,8 @@ func (p *Partial) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
-// Unmarshal unmarshals the raw data (p.Raw) into v and prepares callbacks.
+// Unmarshal unmarshals the raw data (p.Raw) into v and prepares callbacks
+// and attachments.
 // v must be a struct that is the type of expected arguments.
 func (p *Partial) Unmarshal(v interface{}) error {
 	if p == nil {
@@ -48,6 +50,12 @@ func (p *Partial) Unmarshal(v interface{}) error {
 		}
 	}
 
+	for _, spec := range p.AttachmentSpecs {
+		if err := setAttachment(value, spec.Path, spec.Data); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
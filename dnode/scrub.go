@@ -13,25 +13,46 @@ import (
 // exported methods of func(*Partial) signature. Other functions must be
 // wrapped by Callback function.
 func (s *Scrubber) Scrub(obj interface{}) (callbacks map[string]Path) {
+	callbacks, _ = s.ScrubAttachments(obj)
+	return callbacks
+}
+
+// ScrubAttachments works like Scrub, additionally it collects the Raw values
+// of obj, which must be sent as message attachments.
+func (s *Scrubber) ScrubAttachments(obj interface{}) (callbacks map[string]Path, attachments []AttachmentSpec) {
 	callbacks = make(map[string]Path)
 	rv := reflect.ValueOf(obj)
 
 	k := rv.Kind()
 	if k != reflect.Array && k != reflect.Slice && k != reflect.Struct && k != reflect.Map {
-		return nil
+		return nil, nil
 	}
 
-	s.collect(rv, make(Path, 0), callbacks)
-	return callbacks
+	// The path is extended in place while walking the object, reserve
+	// enough room for the usual nesting of arguments so it's not
+	// reallocated on every level.
+	s.collect(rv, make(Path, 0, scrubPathCap), callbacks, &attachments)
+	return callbacks, attachments
 }
 
+// scrubPathCap is the initial capacity of the path used by Scrubber.
+const scrubPathCap = 8
+
 var dnodeFunctionType = reflect.TypeOf(new(Function)).Elem()
 
-func (s *Scrubber) collect(rv reflect.Value, path Path, callbacks map[string]Path) {
+func (s *Scrubber) collect(rv reflect.Value, path Path, callbacks map[string]Path, attachments *[]AttachmentSpec) {
+	// binary blobs are sent after the message.
+	if rv.IsValid() && rv.Type() == rawType {
+		pathCopy := make(Path, len(path))
+		copy(pathCopy, path)
+		*attachments = append(*attachments, AttachmentSpec{pathCopy, rv.Bytes()})
+		return
+	}
+
 	switch rv.Kind() {
 	case reflect.Interface:
 		if !rv.IsNil() {
-			s.collect(rv.Elem(), path, callbacks)
+			s.collect(rv.Elem(), path, callbacks, attachments)
 		}
 	case reflect.Ptr:
 		if rv.IsNil() {
@@ -39,28 +60,31 @@ func (s *Scrubber) collect(rv reflect.Value, path Path, callbacks map[string]Pat
 		}
 		// collect from structs that define pointer reciver methods.
 		if elem := rv.Elem(); elem.Kind() == reflect.Struct {
-			s.fields(elem, path, callbacks)
+			s.fields(elem, path, callbacks, attachments)
 			s.methods(rv, path, callbacks)
 		} else {
-			s.collect(elem, path, callbacks)
+			s.collect(elem, path, callbacks, attachments)
 		}
 	case reflect.Array, reflect.Slice:
 		for i, v := 0, rv.Len(); i < v; i++ {
-			s.collect(rv.Index(i), append(path, i), callbacks)
+			s.collect(rv.Index(i), append(path, i), callbacks, attachments)
 		}
 	case reflect.Map:
 		for _, mrv := range rv.MapKeys() {
-			s.collect(rv.MapIndex(mrv), append(path, mrv.String()), callbacks)
+			s.collect(rv.MapIndex(mrv), append(path, mrv.String()), callbacks, attachments)
 		}
 	case reflect.Struct:
 		// register callback functions wrapper.
 		if rv.Type() == dnodeFunctionType {
-			if cb := rv.Interface().(Function); cb.Caller != nil {
-				s.register(cb.Caller.(callback), path, callbacks)
+			switch cb := rv.Interface().(Function).Caller.(type) {
+			case callback:
+				s.register(cb, false, path, callbacks)
+			case persistentCallback:
+				s.register(cb, true, path, callbacks)
 			}
 			return
 		}
-		s.fields(rv, path, callbacks)
+		s.fields(rv, path, callbacks, attachments)
 		s.methods(rv, path, callbacks)
 	case reflect.Func:
 		panic("cannot marshal func, use Callback() to wrap it")
@@ -68,7 +92,7 @@ func (s *Scrubber) collect(rv reflect.Value, path Path, callbacks map[string]Pat
 }
 
 // fields walks over a structure and scrubs its fields.
-func (s *Scrubber) fields(rv reflect.Value, path Path, callbacks map[string]Path) {
+func (s *Scrubber) fields(rv reflect.Value, path Path, callbacks map[string]Path, attachments *[]AttachmentSpec) {
 	for i := 0; i < rv.NumField(); i++ {
 		sf := rv.Type().Field(i)
 		if sf.PkgPath != "" && !sf.Anonymous { // unexported.
@@ -95,9 +119,9 @@ func (s *Scrubber) fields(rv reflect.Value, path Path, callbacks map[string]Path
 		}
 
 		if sf.Anonymous {
-			s.collect(rv.Field(i), path, callbacks)
+			s.collect(rv.Field(i), path, callbacks, attachments)
 		} else {
-			s.collect(rv.Field(i), append(path, name), callbacks)
+			s.collect(rv.Field(i), append(path, name), callbacks, attachments)
 		}
 	}
 }
@@ -113,14 +137,15 @@ func (s *Scrubber) methods(rv reflect.Value, path Path, callbacks map[string]Pat
 
 			name := rv.Type().Method(i).Name
 			name = strings.ToLower(name[0:1]) + name[1:]
-			s.register(cb, append(path, name), callbacks)
+			s.register(cb, false, append(path, name), callbacks)
 		}
 	}
 }
 
 // register is called when a function/method is found in arguments array. It
 // assigns an unique ID to the passed callback and stores it internally.
-func (s *Scrubber) register(cb func(*Partial), path Path, callbacks map[string]Path) {
+// Persistent callbacks never expire.
+func (s *Scrubber) register(cb func(*Partial), persistent bool, path Path, callbacks map[string]Path) {
 	// do not register nil callbacks.
 	if cb == nil {
 		return
@@ -131,9 +156,7 @@ func (s *Scrubber) register(cb func(*Partial), path Path, callbacks map[string]P
 	seq := strconv.FormatUint(next, 10)
 
 	// save in scubber callbacks.
-	s.Lock()
-	s.callbacks[next] = cb
-	s.Unlock()
+	s.save(next, cb, persistent)
 
 	// Add to callback map to be sent to remote. Make a copy of path because it
 	// is reused in caller.
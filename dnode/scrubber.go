@@ -1,21 +1,49 @@
 package dnode
 
-import "sync"
+import (
+	"sync"
+	"time"
+)
+
+// DefaultCallbackTTL is the time after which a registered callback, which
+// was not called, is removed, if Scrubber.TTL is 0. If it's not positive,
+// which is the default, callbacks never expire.
+var DefaultCallbackTTL time.Duration
 
 type Scrubber struct {
 	// Next callback number.
 	// Incremented atomically by register().
 	seq uint64
 
+	// TTL is the time after which a registered callback expires, unless it
+	// is called, which resets the time. Expired callbacks are removed, so
+	// callbacks never called by the remote side do not consume memory.
+	//
+	// If TTL is 0, DefaultCallbackTTL is used. If negative, callbacks
+	// never expire. Callbacks wrapped with PersistentCallback never
+	// expire regardless of the TTL.
+	TTL time.Duration
+
+	// OnCallbackExpired, when non-nil, is called with the ID of every
+	// expired callback.
+	OnCallbackExpired func(id uint64)
+
 	// Reference to sent callbacks are saved in this map.
 	sync.Mutex // protects
-	callbacks  map[uint64]func(*Partial)
+	callbacks  map[uint64]*registered
+	nextSweep  time.Time // when expired callbacks are looked for
+}
+
+// registered is a callback saved by the scrubber.
+type registered struct {
+	fn      func(*Partial)
+	expires time.Time // zero if the callback does not expire
 }
 
 // New returns a pointer to a new Scrubber.
 func NewScrubber() *Scrubber {
 	return &Scrubber{
-		callbacks: make(map[uint64]func(*Partial)),
+		callbacks: make(map[uint64]*registered),
 	}
 }
 
@@ -27,9 +55,71 @@ func (s *Scrubber) RemoveCallback(id uint64) {
 	s.Unlock()
 }
 
+// GetCallback gives the callback with id, or nil if there's no such
+// callback or it expired. Getting the callback resets its expiration.
 func (s *Scrubber) GetCallback(id uint64) func(*Partial) {
 	s.Lock()
-	fn := s.callbacks[id]
+	defer s.Unlock()
+
+	r, ok := s.callbacks[id]
+	if !ok {
+		return nil
+	}
+
+	if !r.expires.IsZero() {
+		r.expires = time.Now().Add(s.ttl())
+	}
+
+	return r.fn
+}
+
+// Len gives the number of registered callbacks.
+func (s *Scrubber) Len() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.callbacks)
+}
+
+func (s *Scrubber) ttl() time.Duration {
+	if s.TTL != 0 {
+		return s.TTL
+	}
+	return DefaultCallbackTTL
+}
+
+// save stores the callback with id and removes the expired ones.
+func (s *Scrubber) save(id uint64, cb func(*Partial), persistent bool) {
+	now := time.Now()
+	ttl := s.ttl()
+
+	r := &registered{fn: cb}
+	if !persistent && ttl > 0 {
+		r.expires = now.Add(ttl)
+	}
+
+	var expired []uint64
+
+	s.Lock()
+	s.callbacks[id] = r
+
+	// The expired callbacks are looked for at most twice per TTL,
+	// so registering callbacks is not slowed down by the sweeps.
+	if ttl > 0 && !now.Before(s.nextSweep) {
+		for id, r := range s.callbacks {
+			if !r.expires.IsZero() && now.After(r.expires) {
+				delete(s.callbacks, id)
+				expired = append(expired, id)
+			}
+		}
+
+		s.nextSweep = now.Add(ttl / 2)
+	}
 	s.Unlock()
-	return fn
+
+	if s.OnCallbackExpired != nil {
+		for _, id := range expired {
+			s.OnCallbackExpired(id)
+		}
+	}
 }
@@ -1,6 +1,10 @@
 package dnode
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+	"time"
+)
 
 func TestScrubUnscrub(t *testing.T) {
 	scrubber := NewScrubber()
@@ -48,3 +52,47 @@ func TestScrubUnscrub(t *testing.T) {
 		t.Error("callback is not called")
 	}
 }
+
+func TestScrubberExpiry(t *testing.T) {
+	var expired []uint64
+
+	scrubber := NewScrubber()
+	scrubber.TTL = 50 * time.Millisecond
+	scrubber.OnCallbackExpired = func(id uint64) {
+		expired = append(expired, id)
+	}
+
+	nop := func(*Partial) {}
+
+	// 0 is never called, 1 is called, 2 never expires.
+	scrubber.Scrub([]interface{}{Callback(nop), Callback(nop), PersistentCallback(nop)})
+
+	if n := scrubber.Len(); n != 3 {
+		t.Fatalf("got %d callbacks, want 3", n)
+	}
+
+	for i := 0; i < 4; i++ {
+		time.Sleep(20 * time.Millisecond)
+
+		if scrubber.GetCallback(1) == nil {
+			t.Fatal("called callback expired")
+		}
+	}
+
+	// Registering a callback removes the expired ones.
+	scrubber.Scrub([]interface{}{Callback(nop)})
+
+	if want := []uint64{0}; !reflect.DeepEqual(expired, want) {
+		t.Fatalf("got %v expired, want %v", expired, want)
+	}
+
+	if scrubber.GetCallback(0) != nil {
+		t.Fatal("expired callback was not removed")
+	}
+
+	for _, id := range []uint64{1, 2, 3} {
+		if scrubber.GetCallback(id) == nil {
+			t.Fatalf("callback %d was removed", id)
+		}
+	}
+}
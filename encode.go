@@ -0,0 +1,99 @@
+package kite
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+
+	"github.com/koding/kite/v2/dnode"
+)
+
+// maxPooledBufferSize is the capacity above which encode buffers are not
+// put back to the pool, so a single large message does not keep its
+// memory around.
+const maxPooledBufferSize = 64 * 1024
+
+// encodeBuffer is a buffer with a JSON encoder writing into it. They are
+// pooled, so sending a message does not allocate a new buffer, growing it
+// along the way, for each encoded value.
+type encodeBuffer struct {
+	bytes.Buffer
+	enc *json.Encoder
+}
+
+var encodeBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := &encodeBuffer{}
+		b.enc = json.NewEncoder(&b.Buffer)
+		return b
+	},
+}
+
+func getEncodeBuffer() *encodeBuffer {
+	return encodeBufferPool.Get().(*encodeBuffer)
+}
+
+func putEncodeBuffer(b *encodeBuffer) {
+	if b.Cap() > maxPooledBufferSize {
+		return
+	}
+
+	b.Reset()
+	encodeBufferPool.Put(b)
+}
+
+// encode gives the JSON encoding of v, the same as json.Marshal does. The
+// returned slice is valid until the buffer is reset.
+func (b *encodeBuffer) encode(v interface{}) ([]byte, error) {
+	b.Reset()
+
+	if err := b.enc.Encode(v); err != nil {
+		return nil, err
+	}
+
+	// Encoder terminates each value with a newline.
+	return bytes.TrimSuffix(b.Bytes(), []byte{'\n'}), nil
+}
+
+// encodeMessage encodes the dnode message with its arguments followed by
+// the attachments. The returned slice is allocated with its exact size, as
+// it's kept by the client until sent, or acknowledged.
+func encodeMessage(method interface{}, arguments []interface{}, callbacks map[string]dnode.Path, attachments []dnode.AttachmentSpec) ([]byte, error) {
+	args := getEncodeBuffer()
+	defer putEncodeBuffer(args)
+
+	rawArgs, err := args.encode(arguments)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := dnode.Message{
+		Method:    method,
+		Arguments: &dnode.Partial{Raw: rawArgs},
+		Callbacks: callbacks,
+	}
+
+	var blobs [][]byte
+	if len(attachments) != 0 {
+		msg.Attachments = make([]dnode.Path, len(attachments))
+		blobs = make([][]byte, len(attachments))
+
+		for i, a := range attachments {
+			msg.Attachments[i] = a.Path
+			blobs[i] = a.Data
+		}
+	}
+
+	buf := getEncodeBuffer()
+	defer putEncodeBuffer(buf)
+
+	m, err := buf.encode(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	p := make([]byte, len(m), len(m)+dnode.AttachmentsLen(blobs))
+	copy(p, m)
+
+	return dnode.AppendAttachments(p, blobs), nil
+}
@@ -0,0 +1,102 @@
+package kite
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/koding/kite/v2/dnode"
+)
+
+func TestEncodeMessage(t *testing.T) {
+	s := dnode.NewScrubber()
+
+	args := []interface{}{
+		"<html> &  ",
+		map[string]interface{}{"blob": dnode.Raw("\x00\xff\n")},
+		dnode.Callback(func(*dnode.Partial) {}),
+	}
+
+	callbacks, attachments := s.ScrubAttachments(args)
+
+	p, err := encodeMessage("method", args, callbacks, attachments)
+	if err != nil {
+		t.Fatalf("encodeMessage()=%s", err)
+	}
+
+	if len(p) != cap(p) {
+		t.Fatalf("got capacity %d, want %d", cap(p), len(p))
+	}
+
+	// The message must be encoded exactly as with json.Marshal.
+	rawArgs, err := json.Marshal(args)
+	if err != nil {
+		t.Fatalf("Marshal()=%s", err)
+	}
+
+	msg := dnode.Message{
+		Method:    "method",
+		Arguments: &dnode.Partial{Raw: rawArgs},
+		Callbacks: callbacks,
+	}
+
+	var blobs [][]byte
+	for _, a := range attachments {
+		msg.Attachments = append(msg.Attachments, a.Path)
+		blobs = append(blobs, a.Data)
+	}
+
+	want, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Marshal()=%s", err)
+	}
+
+	want = dnode.AppendAttachments(want, blobs)
+
+	if !bytes.Equal(p, want) {
+		t.Fatalf("got %q, want %q", p, want)
+	}
+
+	// Encoding must not be affected by the previously pooled buffers.
+	if _, err := encodeMessage("method", []interface{}{func() {}}, nil, nil); err == nil {
+		t.Fatal("expected error encoding a func")
+	}
+
+	p, err = encodeMessage(1, []interface{}{}, map[string]dnode.Path{}, nil)
+	if err != nil {
+		t.Fatalf("encodeMessage()=%s", err)
+	}
+
+	if want := `{"method":1,"arguments":[],"callbacks":{}}`; string(p) != want {
+		t.Fatalf("got %q, want %q", p, want)
+	}
+}
+
+func BenchmarkEncodeMessage(b *testing.B) {
+	s := dnode.NewScrubber()
+
+	args := []interface{}{
+		map[string]interface{}{
+			"kite":    "bench",
+			"payload": bytes.Repeat([]byte("x"), 512),
+			"tags":    []string{"a", "b", "c"},
+		},
+		dnode.Callback(func(*dnode.Partial) {}),
+	}
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		callbacks, attachments := s.ScrubAttachments(args)
+
+		if _, err := encodeMessage("bench", args, callbacks, attachments); err != nil {
+			b.Fatal(err)
+		}
+
+		for id := range callbacks {
+			n, _ := strconv.ParseUint(id, 10, 64)
+			s.RemoveCallback(n)
+		}
+	}
+}
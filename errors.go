@@ -3,20 +3,176 @@ package kite
 import (
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
 
-	"github.com/koding/kite/dnode"
+	"github.com/koding/kite/v2/dnode"
 )
 
 // ErrKeyNotTrusted is returned by verify functions when the key
 // should not be trusted.
 var ErrKeyNotTrusted = errors.New("kontrol key is not trusted")
 
+// ErrorType is a machine-readable type of an Error, see Error.Type.
+type ErrorType string
+
+// The types of the errors returned by the kite package. Applications can
+// define their own types with RegisterErrorType.
+const (
+	ErrorGeneric         ErrorType = "genericError"
+	ErrorArgument        ErrorType = "argumentError"
+	ErrorBadRequest      ErrorType = "badRequest"
+	ErrorAuthentication  ErrorType = "authenticationError"
+	ErrorAuthorization   ErrorType = "authorizationError"
+	ErrorMethodNotFound  ErrorType = "methodNotFound"
+	ErrorRequestLimit    ErrorType = "requestLimitError"
+	ErrorTooBusy         ErrorType = "tooBusy"
+	ErrorOutdatedClient  ErrorType = "outdatedClientError"
+	ErrorNotReady        ErrorType = "notReadyError"
+	ErrorTimeout         ErrorType = "timeout"
+	ErrorSend            ErrorType = "sendError"
+	ErrorDisconnect      ErrorType = "disconnect"
+	ErrorInvalidResponse ErrorType = "invalidResponse"
+)
+
+var errorTypes = struct {
+	sync.RWMutex
+	m map[ErrorType]bool // retryable by type
+}{
+	m: map[ErrorType]bool{
+		ErrorGeneric:         false,
+		ErrorArgument:        false,
+		ErrorBadRequest:      false,
+		ErrorAuthentication:  false,
+		ErrorAuthorization:   false,
+		ErrorMethodNotFound:  false,
+		ErrorRequestLimit:    true,
+		ErrorTooBusy:         true,
+		ErrorOutdatedClient:  false,
+		ErrorNotReady:        true,
+		ErrorTimeout:         true,
+		ErrorSend:            true,
+		ErrorDisconnect:      true,
+		ErrorInvalidResponse: false,
+	},
+}
+
+// RegisterErrorType registers an error type defined by the application.
+// The retryable tells whether a call, which failed with an error of the
+// type, can be retried. Errors of the registered types created with
+// WrapErr or returned from handlers are marked as retryable, which is
+// sent over the wire along with the type.
+//
+// RegisterErrorType panics if the type is empty or already registered.
+func RegisterErrorType(t ErrorType, retryable bool) {
+	if t == "" {
+		panic("kite: error type cannot be empty")
+	}
+
+	errorTypes.Lock()
+	defer errorTypes.Unlock()
+
+	if _, ok := errorTypes.m[t]; ok {
+		panic(fmt.Sprintf("kite: error type %q is already registered", t))
+	}
+
+	errorTypes.m[t] = retryable
+}
+
+// Registered tells whether the type is one of the kite package
+// or was registered with RegisterErrorType.
+func (t ErrorType) Registered() bool {
+	errorTypes.RLock()
+	_, ok := errorTypes.m[t]
+	errorTypes.RUnlock()
+	return ok
+}
+
+// Retryable tells whether a call, which failed with an error of the type,
+// can be retried. Unregistered types are not retryable.
+func (t ErrorType) Retryable() bool {
+	errorTypes.RLock()
+	retryable := errorTypes.m[t]
+	errorTypes.RUnlock()
+	return retryable
+}
+
+// WrapErr gives an Error of the type t, whose message is the one of err.
+// The code and the request ID are kept if err is an *Error already, the
+// err itself is given by the Cause method of the returned error.
+//
+// It returns nil if err is nil.
+func WrapErr(t ErrorType, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	e := &Error{
+		Type:      string(t),
+		Message:   err.Error(),
+		Retryable: t.Retryable(),
+		cause:     err,
+	}
+
+	if kiteErr, ok := err.(*Error); ok {
+		e.Message = kiteErr.Message
+		e.CodeVal = kiteErr.CodeVal
+		e.RequestID = kiteErr.RequestID
+	}
+
+	return e
+}
+
+// IsRetryable tells whether the call, which failed with err, can be retried.
+// The err is retryable if it's an *Error, which was marked as retryable
+// by the remote kite or whose type is retryable.
+func IsRetryable(err error) bool {
+	e, ok := err.(*Error)
+	if !ok || e == nil {
+		return false
+	}
+
+	return e.Retryable || ErrorType(e.Type).Retryable()
+}
+
 // Error is the type of the kite related errors returned from kite package.
 type Error struct {
-	Type      string `json:"type"`
+	Type      string `json:"type"` // one of ErrorType values
 	Message   string `json:"message"`
 	CodeVal   string `json:"code"`
 	RequestID string `json:"id"`
+	Retryable bool   `json:"retryable,omitempty"`
+
+	// CodeData holds the debug details of the error, which are sent
+	// to trusted callers only, see Config.DebugErrors. Unless the
+	// remote kite customized them with Kite.ErrorDetails, the details
+	// are of the ErrorDetails form, decoded into a map.
+	CodeData interface{} `json:"codeData,omitempty"`
+
+	cause error
+}
+
+// ErrorDetails are the default debug details of an error.
+type ErrorDetails struct {
+	// Chain has the messages of the error and the errors wrapped by it,
+	// which are obtained with their Unwrap or Cause methods.
+	Chain []string `json:"chain,omitempty"`
+
+	// Stack is the stack trace of a panic, each frame is of the
+	// "function file:line" form. Files are given relative to
+	// their GOPATH or GOROOT.
+	Stack []string `json:"stack,omitempty"`
+}
+
+// ErrorType gives the type of the error.
+func (e Error) ErrorType() ErrorType {
+	return ErrorType(e.Type)
+}
+
+// Cause gives the error wrapped with WrapErr, it's nil for errors
+// received from remote kites.
+func (e Error) Cause() error {
+	return e.cause
 }
 
 func (e Error) Code() string {
@@ -49,12 +205,12 @@ func createError(req *Request, r interface{}) *Error {
 		kiteErr = err
 	case *dnode.ArgumentError:
 		kiteErr = &Error{
-			Type:    "argumentError",
+			Type:    string(ErrorArgument),
 			Message: err.Error(),
 		}
 	default:
 		kiteErr = &Error{
-			Type:    "genericError",
+			Type:    string(ErrorGeneric),
 			Message: fmt.Sprint(r),
 		}
 	}
@@ -63,5 +219,109 @@ func createError(req *Request, r interface{}) *Error {
 		kiteErr.RequestID = req.ID
 	}
 
+	if !kiteErr.Retryable {
+		kiteErr.Retryable = kiteErr.ErrorType().Retryable()
+	}
+
 	return kiteErr
 }
+
+// withDetails gives a copy of the error with debug details, if they are
+// enabled for the request. The r is the error returned by the handler or
+// the value it panicked with.
+func withDetails(req *Request, method *Method, kiteErr *Error, r interface{}, stack []byte) *Error {
+	if kiteErr == nil || req == nil || !req.LocalKite.debugErrors(req, method) {
+		return kiteErr
+	}
+
+	e := *kiteErr
+
+	if fn := req.LocalKite.ErrorDetails; fn != nil {
+		e.CodeData = fn(req, r, stack)
+	} else {
+		e.CodeData = &ErrorDetails{
+			Chain: errorChain(r),
+			Stack: sanitizeStack(stack),
+		}
+	}
+
+	return &e
+}
+
+// debugErrors tells whether debug details of errors are sent to the caller.
+func (k *Kite) debugErrors(r *Request, method *Method) bool {
+	if !k.Config.DebugErrors {
+		return false
+	}
+
+	if r.Username != "" && r.Username == k.Config.Username {
+		return true
+	}
+
+	k.handlersMu.RLock()
+	p, ok := k.trustPolicies[method.group]
+	k.handlersMu.RUnlock()
+
+	return ok && p.match(r)
+}
+
+// errorChain gives the messages of err and the errors wrapped by it.
+func errorChain(r interface{}) []string {
+	err, ok := r.(error)
+	if !ok {
+		return []string{fmt.Sprint(r)}
+	}
+
+	var chain []string
+
+	// The number of errors is limited in case the chain has a cycle.
+	for i := 0; err != nil && i < 32; i++ {
+		chain = append(chain, err.Error())
+
+		switch e := err.(type) {
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		case interface{ Cause() error }:
+			err = e.Cause()
+		default:
+			err = nil
+		}
+	}
+
+	return chain
+}
+
+// sanitizeStack converts the stack trace given by debug.Stack into
+// "function file:line" frames. The arguments of functions, the absolute
+// paths of files and the frames of the runtime are stripped.
+func sanitizeStack(stack []byte) []string {
+	var frames []string
+
+	lines := strings.Split(strings.TrimSpace(string(stack)), "\n")
+
+	// The first line is the header of the goroutine, then each frame
+	// is a function followed by its file on a tab indented line.
+	for i := 1; i+1 < len(lines); i += 2 {
+		fn, file := lines[i], strings.TrimSpace(lines[i+1])
+
+		if j := strings.LastIndexByte(fn, '('); j != -1 {
+			fn = fn[:j]
+		}
+
+		if j := strings.LastIndex(file, " +0x"); j != -1 {
+			file = file[:j]
+		}
+
+		if j := strings.LastIndex(file, "/src/"); j != -1 {
+			file = file[j+len("/src/"):]
+		}
+
+		if strings.HasPrefix(file, "runtime/") {
+			continue
+		}
+
+		frames = append(frames, fn+" "+file)
+	}
+
+	return frames
+}
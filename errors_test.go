@@ -0,0 +1,143 @@
+package kite
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/koding/kite/v2/config"
+)
+
+const errorQuotaExceeded ErrorType = "quotaExceeded"
+
+func TestWrapErr(t *testing.T) {
+	if !errorQuotaExceeded.Registered() {
+		RegisterErrorType(errorQuotaExceeded, true)
+	}
+
+	cfg := config.New()
+	cfg.Port = 3663
+	cfg.DisableAuthentication = true
+
+	k := NewWithConfig("errors", "0.0.1", cfg)
+
+	cause := errors.New("quota of 10 calls is exceeded")
+
+	k.HandleFunc("quota", func(r *Request) (interface{}, error) {
+		return nil, WrapErr(errorQuotaExceeded, cause)
+	})
+
+	k.HandleFunc("denied", func(r *Request) (interface{}, error) {
+		return nil, WrapErr(ErrorAuthorization, &Error{Message: "denied", CodeVal: "role"})
+	})
+
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	c := New("errors-client", "0.0.1").NewClient("http://127.0.0.1:3663/kite")
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	_, err := c.Tell("quota")
+
+	e, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("got %#v, want *Error", err)
+	}
+
+	if e.ErrorType() != errorQuotaExceeded || e.Message != cause.Error() || !e.Retryable || !IsRetryable(err) {
+		t.Fatalf("got %#v, want retryable %s error", e, errorQuotaExceeded)
+	}
+
+	_, err = c.Tell("denied")
+
+	if e, ok := err.(*Error); !ok || e.ErrorType() != ErrorAuthorization || e.CodeVal != "role" || IsRetryable(err) {
+		t.Fatalf("got %#v, want not retryable %s error", err, ErrorAuthorization)
+	}
+
+	if WrapErr(ErrorGeneric, nil) != nil {
+		t.Fatal("want WrapErr() to return nil for nil error")
+	}
+
+	if err := WrapErr(ErrorTimeout, cause).(*Error); err.Cause() != cause || !IsRetryable(err) {
+		t.Fatalf("got %#v, want retryable error caused by %v", err, cause)
+	}
+}
+
+func TestDebugErrors(t *testing.T) {
+	cfg := config.New()
+	cfg.Port = 3664
+	cfg.DisableAuthentication = true
+	cfg.DebugErrors = true
+
+	k := NewWithConfig("debugerrors", "0.0.1", cfg)
+
+	k.HandleFunc("panic", func(r *Request) (interface{}, error) {
+		panic("handler panicked")
+	})
+
+	k.HandleFunc("wrapped", func(r *Request) (interface{}, error) {
+		return nil, WrapErr(ErrorBadRequest, errors.New("invalid name"))
+	})
+
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	c := New("debugerrors-client", "0.0.1").NewClient("http://127.0.0.1:3664/kite")
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	_, err := c.Tell("panic")
+
+	e, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("got %#v, want *Error", err)
+	}
+
+	details, ok := e.CodeData.(map[string]interface{})
+	if !ok {
+		t.Fatalf("got %#v, want error details", e.CodeData)
+	}
+
+	if stack, ok := details["stack"].([]interface{}); !ok || len(stack) == 0 {
+		t.Fatalf("got %#v, want stack trace", details["stack"])
+	}
+
+	_, err = c.Tell("wrapped")
+
+	if e, ok = err.(*Error); !ok {
+		t.Fatalf("got %#v, want *Error", err)
+	}
+
+	details, _ = e.CodeData.(map[string]interface{})
+
+	if chain, ok := details["chain"].([]interface{}); !ok || len(chain) != 2 || chain[1] != "invalid name" {
+		t.Fatalf("got %#v, want chain of 2 errors", details["chain"])
+	}
+
+	k.Config.DebugErrors = false
+
+	if _, err = c.Tell("wrapped"); err.(*Error).CodeData != nil {
+		t.Fatalf("got %#v, want no details", err.(*Error).CodeData)
+	}
+}
+
+func TestSanitizeStack(t *testing.T) {
+	stack := []byte(`goroutine 1 [running]:
+runtime/debug.Stack(0x0, 0x0, 0x0)
+	/usr/local/go/src/runtime/debug/stack.go:24 +0x9d
+main.handler(0xc420010000, 0x1, 0x1)
+	/home/user/go/src/github.com/example/app/main.go:42 +0x4f
+`)
+
+	got := sanitizeStack(stack)
+
+	if len(got) != 1 || got[0] != "main.handler github.com/example/app/main.go:42" {
+		t.Fatalf("got %q, want main.handler frame", got)
+	}
+}
@@ -0,0 +1,174 @@
+package kite
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/koding/kite/v2/protocol"
+)
+
+// EventType describes a lifecycle event of the Kite.
+type EventType int
+
+const (
+	// EventConnect is sent when a remote kite connects to the Kite.
+	EventConnect EventType = iota
+
+	// EventDisconnect is sent when a connected remote kite disconnects.
+	EventDisconnect
+
+	// EventRegister is sent when the Kite registers to Kontrol.
+	EventRegister
+
+	// EventToken is sent when a token used to call a remote kite
+	// is issued, renewed, fails to renew or expires.
+	EventToken
+
+	// EventError is sent when processing of an incoming message fails.
+	EventError
+
+	// EventHeartbeat is sent after each heartbeat sent to Kontrol
+	// by a kite registered via HTTP.
+	EventHeartbeat
+
+	// EventPanic is sent when a goroutine of a connection panics,
+	// Err is the *Panic value.
+	EventPanic
+
+	// EventClockSkew is sent when the clock skew between the Kite and
+	// Kontrol exceeds Config.ClockSkewThreshold, and again when it falls
+	// back below it. Skew is the measured skew.
+	EventClockSkew
+)
+
+var eventTypes = map[EventType]string{
+	EventConnect:    "connect",
+	EventDisconnect: "disconnect",
+	EventRegister:   "register",
+	EventToken:      "token",
+	EventError:      "error",
+	EventHeartbeat:  "heartbeat",
+	EventPanic:      "panic",
+	EventClockSkew:  "clockSkew",
+}
+
+// String implements the fmt.Stringer interface.
+func (t EventType) String() string {
+	if s, ok := eventTypes[t]; ok {
+		return s
+	}
+
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Event describes a single lifecycle event of the Kite. Only the fields
+// relevant for the event type are set.
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// Client is the remote kite, set for EventConnect, EventDisconnect,
+	// EventError and EventPanic.
+	Client *Client
+
+	// Register is the result of registration, set for EventRegister.
+	Register *protocol.RegisterResult
+
+	// Token describes the change of the token, set for EventToken.
+	Token *TokenEvent
+
+	// Err is set for EventError, EventPanic and for failed heartbeats.
+	Err error
+
+	// Skew is the local time minus the time of Kontrol, set for
+	// EventClockSkew.
+	Skew time.Duration
+}
+
+// EventSubscription receives events of the Kite, see SubscribeEvents.
+type EventSubscription struct {
+	// C is the channel on which the events are delivered. It is closed
+	// by Unsubscribe.
+	C <-chan *Event
+
+	c       chan *Event
+	types   map[EventType]struct{}
+	dropped int64
+	k       *Kite
+}
+
+// SubscribeEvents subscribes to lifecycle events of the Kite. If no types
+// are given, all events are delivered.
+//
+// Events are buffered up to the given size. The delivery never blocks,
+// events which do not fit into the buffer are dropped and can be counted
+// with Dropped. The subscription must be closed with Unsubscribe.
+//
+// SubscribeEvents complements the OnConnect, OnDisconnect, OnRegister and
+// OnTokenEvent callbacks, which are still called.
+func (k *Kite) SubscribeEvents(buffer int, types ...EventType) *EventSubscription {
+	c := make(chan *Event, buffer)
+
+	s := &EventSubscription{
+		C: c,
+		c: c,
+		k: k,
+	}
+
+	if len(types) != 0 {
+		s.types = make(map[EventType]struct{}, len(types))
+		for _, typ := range types {
+			s.types[typ] = struct{}{}
+		}
+	}
+
+	k.handlersMu.Lock()
+	k.eventSubs = append(k.eventSubs, s)
+	k.handlersMu.Unlock()
+
+	return s
+}
+
+// Unsubscribe stops delivery of the events and closes the C channel.
+// Calling Unsubscribe more than once is a nop.
+func (s *EventSubscription) Unsubscribe() {
+	s.k.handlersMu.Lock()
+	defer s.k.handlersMu.Unlock()
+
+	for i, sub := range s.k.eventSubs {
+		if sub == s {
+			s.k.eventSubs = append(s.k.eventSubs[:i], s.k.eventSubs[i+1:]...)
+			close(s.c)
+			return
+		}
+	}
+}
+
+// Dropped gives the number of events which were dropped, because
+// the buffer of the subscription was full.
+func (s *EventSubscription) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// emit delivers the event to all subscriptions.
+func (k *Kite) emit(ev *Event) {
+	ev.Time = time.Now()
+
+	k.handlersMu.RLock()
+	defer k.handlersMu.RUnlock()
+
+	for _, s := range k.eventSubs {
+		if s.types != nil {
+			if _, ok := s.types[ev.Type]; !ok {
+				continue
+			}
+		}
+
+		select {
+		case s.c <- ev:
+		default:
+			atomic.AddInt64(&s.dropped, 1)
+		}
+	}
+}
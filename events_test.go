@@ -0,0 +1,55 @@
+package kite
+
+import (
+	"testing"
+	"time"
+
+	"github.com/koding/kite/v2/config"
+)
+
+func TestKite_SubscribeEvents(t *testing.T) {
+	cfg := config.New()
+	cfg.Port = 3654
+
+	k := NewWithConfig("events", "0.0.1", cfg)
+
+	events := k.SubscribeEvents(10, EventConnect, EventDisconnect)
+	unbuffered := k.SubscribeEvents(0)
+
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	c := New("events-client", "0.0.1").NewClient("http://127.0.0.1:3654/kite")
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+
+	for _, typ := range []EventType{EventConnect, EventDisconnect} {
+		select {
+		case ev := <-events.C:
+			if ev.Type != typ || ev.Client == nil || ev.Time.IsZero() {
+				t.Fatalf("got %+v, want %s event", ev, typ)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s event", typ)
+		}
+
+		if typ == EventConnect {
+			c.Close()
+		}
+	}
+
+	if n := unbuffered.Dropped(); n != 2 {
+		t.Fatalf("got %d dropped events, want %d", n, 2)
+	}
+
+	events.Unsubscribe()
+	events.Unsubscribe()
+
+	if _, ok := <-events.C; ok {
+		t.Fatal("expected channel to be closed")
+	}
+
+	unbuffered.Unsubscribe()
+}
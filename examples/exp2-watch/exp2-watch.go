@@ -10,9 +10,9 @@ import (
 	"math/rand"
 	"time"
 
-	"github.com/koding/kite"
-	"github.com/koding/kite/config"
-	"github.com/koding/kite/protocol"
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/protocol"
 )
 
 func init() {
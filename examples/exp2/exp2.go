@@ -5,8 +5,8 @@ import (
 	"math/rand"
 	"time"
 
-	"github.com/koding/kite"
-	"github.com/koding/kite/examples/math"
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/examples/math"
 )
 
 func init() {
@@ -7,8 +7,8 @@ import (
 	"net/url"
 	"strconv"
 
-	"github.com/koding/kite"
-	"github.com/koding/kite/config"
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/config"
 )
 
 var (
@@ -4,8 +4,8 @@ import (
 	"flag"
 	"fmt"
 
-	"github.com/koding/kite"
-	"github.com/koding/kite/examples/math"
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/examples/math"
 )
 
 var arg = flag.Int("arg", 4, "An argument to send to the kite server.")
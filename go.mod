@@ -0,0 +1,44 @@
+module github.com/koding/kite/v2
+
+go 1.12
+
+require (
+	github.com/BurntSushi/toml v0.3.0
+	github.com/armon/go-radix v0.0.0-20170727155443-1fca145dffbc
+	github.com/bgentry/speakeasy v0.1.0
+	github.com/cenkalti/backoff v1.1.0
+	github.com/coreos/etcd v3.3.8+incompatible
+	github.com/coreos/go-semver v0.2.0
+	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/fatih/camelcase v1.0.0
+	github.com/fatih/color v1.7.0
+	github.com/fatih/structs v1.0.0
+	github.com/gorilla/mux v1.6.2
+	github.com/gorilla/websocket v1.2.0
+	github.com/hashicorp/errwrap v0.0.0-20141028054710-7554cd9344ce
+	github.com/hashicorp/go-multierror v0.0.0-20171204182908-b7773ae21874
+	github.com/hashicorp/go-version v0.0.0-20180322230233-23480c066577
+	github.com/igm/sockjs-go v0.0.0-20171030210102-c8a8c6429d10
+	github.com/juju/ratelimit v1.0.1
+	github.com/koding/cache v0.0.0-20161222233015-e8a81b0b3f20
+	github.com/koding/logging v0.0.0-20160720134017-8b5a689ed69b
+	github.com/koding/multiconfig v0.0.0-20171124222453-69c27309b2d7
+	github.com/koding/websocketproxy v0.0.0-20180518005506-944ae4ae170f
+	github.com/lann/builder v0.0.0-20180216234317-1b87b36280d0
+	github.com/lann/ps v0.0.0-20150810152359-62de8c46ede0
+	github.com/lann/squirrel v0.0.0-20170825200431-a6b93000bd21
+	github.com/lib/pq v0.0.0-20180523175426-90697d60dd84
+	github.com/mattn/go-colorable v0.0.9
+	github.com/mattn/go-isatty v0.0.3
+	github.com/mitchellh/cli v0.0.0-20180414170447-c48282d14eba
+	github.com/posener/complete v1.1.1
+	github.com/satori/go.uuid v1.2.1-0.20180103174451-36e9d2ebbde5
+	github.com/ugorji/go v1.1.1
+	golang.org/x/crypto v0.0.0-20180617042118-027cca12c2d6
+	golang.org/x/net v0.0.0-20180611182652-db08ff08e862
+	golang.org/x/sys v0.0.0-20180616030259-6c888cc515d3
+	gopkg.in/asn1-ber.v1 v1.0.0-20181015200546-f715ec2f112d
+	gopkg.in/ldap.v2 v2.5.1
+	gopkg.in/mgo.v2 v2.0.0-20180705113604-9856a29383ce
+	gopkg.in/yaml.v2 v2.2.1
+)
@@ -8,13 +8,14 @@ import (
 	"os"
 	"os/exec"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/koding/cache"
-	"github.com/koding/kite/protocol"
-	"github.com/koding/kite/sockjsclient"
-	"github.com/koding/kite/systeminfo"
+	"github.com/koding/kite/v2/protocol"
+	"github.com/koding/kite/v2/sockjsclient"
+	"github.com/koding/kite/v2/systeminfo"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
@@ -72,6 +73,11 @@ func (w *webRTCHandler) ServeKite(r *Request) (interface{}, error) {
 
 	w.registerSrc(r.Client)
 
+	// Announcements only make the source reachable by the other peers.
+	if strings.EqualFold(args.Type, signalAnnounce) {
+		return nil, nil
+	}
+
 	dst, err := w.getDst(args.Dst)
 	if err != nil {
 		return nil, err
@@ -86,6 +92,14 @@ func (k *Kite) addDefaultHandlers() {
 	k.HandleFunc("kite.heartbeat", k.handleHeartbeat)
 	k.HandleFunc("kite.ping", handlePing).DisableAuthentication()
 	k.HandleFunc("kite.tunnel", handleTunnel)
+	k.HandleFunc("kite.refreshKey", k.handleRefreshKey)
+	k.HandleFunc("kite.displaced", k.handleDisplaced)
+	k.HandleFunc("kite.capabilities", k.handleCapabilities)
+	k.HandleFunc("kite.resume", k.handleResume)
+	k.HandleFunc("kite.acks", k.handleAcks)
+	k.HandleFunc("kite.openChannel", k.handleOpenChannel)
+	k.HandleFunc("kite.subscribe", k.handleSubscribe)
+	k.HandleFunc("kite.unsubscribe", k.handleUnsubscribe)
 	k.HandleFunc("kite.log", k.handleLog)
 	k.HandleFunc("kite.print", handlePrint)
 	k.HandleFunc("kite.prompt", handlePrompt)
@@ -96,6 +110,35 @@ func (k *Kite) addDefaultHandlers() {
 	if k.WebRTCHandler != nil {
 		k.Handle(WebRTCHandlerName, k.WebRTCHandler)
 	}
+
+	k.methodsMu.Lock()
+	for _, method := range k.Config.DisableBuiltins {
+		delete(k.handlers, strings.TrimSpace(method))
+	}
+	k.methodsMu.Unlock()
+
+	for method, usernames := range k.Config.BuiltinACL {
+		if m, ok := k.method(method); ok {
+			m.PreHandleFunc(allowUsernames(usernames))
+		}
+	}
+}
+
+// allowUsernames gives a handler which rejects requests from users
+// not listed in usernames.
+func allowUsernames(usernames []string) HandlerFunc {
+	return func(r *Request) (interface{}, error) {
+		for _, username := range usernames {
+			if r.Username == username {
+				return nil, nil
+			}
+		}
+
+		return nil, &Error{
+			Type:    "authorizationError",
+			Message: fmt.Sprintf("user %q is not allowed to call %q", r.Username, r.Method),
+		}
+	}
 }
 
 // handleSystemInfo returns info about the system (CPU, memory, disk...).
@@ -153,13 +196,19 @@ func handleNotifyDarwin(r *Request) (interface{}, error) {
 }
 
 // handleTunnel opens two websockets, one to proxy kite and one to itself,
-// then it copies the message between them.
+// then it copies the message between them. If the proxy applies a stream
+// layer to the tunnel, it's unwrapped with Kite.TunnelLayer.
 func handleTunnel(r *Request) (interface{}, error) {
 	var args struct {
-		URL string
+		URL   string
+		Layer bool
 	}
 	r.Args.One().MustUnmarshal(&args)
 
+	if args.Layer && r.LocalKite.TunnelLayer == nil {
+		return nil, errors.New("tunnel stream layer is not set")
+	}
+
 	parsed, err := url.Parse(args.URL)
 	if err != nil {
 		return nil, err
@@ -175,6 +224,17 @@ func handleTunnel(r *Request) (interface{}, error) {
 
 	session := sockjsclient.NewWebsocketSession(remoteConn)
 
-	go r.LocalKite.sockjsHandler(session)
+	if !args.Layer {
+		go r.LocalKite.sockjsHandler(session)
+		return nil, nil
+	}
+
+	layered, err := NewLayeredSession(session, r.LocalKite.TunnelLayer)
+	if err != nil {
+		session.Close(3000, "Go away!")
+		return nil, err
+	}
+
+	go r.LocalKite.ServeSession(layered)
 	return nil, nil
 }
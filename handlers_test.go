@@ -0,0 +1,60 @@
+package kite
+
+import (
+	"testing"
+
+	"github.com/koding/kite/v2/config"
+)
+
+func TestBuiltins(t *testing.T) {
+	cfg := config.New()
+	cfg.DisableAuthentication = true
+	cfg.Port = 3646
+	cfg.DisableBuiltins = []string{"kite.log"}
+	cfg.BuiltinACL = map[string][]string{
+		"kite.systemInfo": {"admin"},
+	}
+
+	ksrv := NewWithConfig("builtins-server", "0.0.1", cfg)
+
+	go ksrv.Run()
+	<-ksrv.ServerReadyNotify()
+	defer ksrv.Close()
+
+	cases := map[string]struct {
+		username string
+		method   string
+		errType  string
+	}{
+		"disabled method":     {"alice", "kite.log", "methodNotFound"},
+		"method not in acl":   {"alice", "kite.ping", ""},
+		"user not allowed":    {"alice", "kite.systemInfo", "authorizationError"},
+		"user allowed by acl": {"admin", "kite.systemInfo", ""},
+	}
+
+	for name, cas := range cases {
+		t.Run(name, func(t *testing.T) {
+			ccfg := config.New()
+			ccfg.Username = cas.username
+
+			c := NewWithConfig("builtins-client", "0.0.1", ccfg).NewClient("http://127.0.0.1:3646/kite")
+			if err := c.Dial(); err != nil {
+				t.Fatalf("Dial()=%s", err)
+			}
+			defer c.Close()
+
+			_, err := c.Tell(cas.method, "")
+
+			if cas.errType == "" {
+				if err != nil {
+					t.Fatalf("Tell(%q)=%s", cas.method, err)
+				}
+				return
+			}
+
+			if e, ok := err.(*Error); !ok || e.Type != cas.errType {
+				t.Fatalf("got %v, want %s", err, cas.errType)
+			}
+		})
+	}
+}
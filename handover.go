@@ -0,0 +1,104 @@
+package kite
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// listenFDEnv is the environment variable, which holds the file descriptor
+// of the socket handed over to the new process of a kite.
+const listenFDEnv = "KITE_LISTEN_FD"
+
+// Handover starts a new process of the kite executable, with the same
+// arguments and environment, which serves on the listening socket of
+// the kite instead of opening a new one. It's used to upgrade kites
+// without downtime:
+//
+//	if _, err := k.Handover(); err != nil {
+//		k.Log.Error("handover failed: %s", err)
+//		return
+//	}
+//
+//	k.Listener().DrainTimeout = 30 * time.Second
+//	k.Close()
+//
+// The socket is shared by both processes until the kite is closed,
+// so no connection is refused during the upgrade. Clients of the
+// closed kite reconnect to the new process; sessions are continued
+// if Config.ResumeGracePeriod is set.
+//
+// Handover is not supported on Windows.
+func (k *Kite) Handover() (*os.Process, error) {
+	k.mu.Lock()
+	socket := k.socket
+	k.mu.Unlock()
+
+	if socket == nil {
+		return nil, errors.New("kite is not listening")
+	}
+
+	f, err := listenerFile(socket)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{f}
+	// The first of ExtraFiles becomes the file descriptor 3.
+	cmd.Env = append(os.Environ(), listenFDEnv+"=3")
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	k.Log.Info("Handed over %s to process %d", socket.Addr(), cmd.Process.Pid)
+
+	return cmd.Process, nil
+}
+
+// listenerFile gives a duplicate of the file descriptor of the listener.
+func listenerFile(l net.Listener) (*os.File, error) {
+	switch l := l.(type) {
+	case *net.TCPListener:
+		return l.File()
+	case *net.UnixListener:
+		// The socket file must outlive the listener, since the new
+		// process listens on it.
+		l.SetUnlinkOnClose(false)
+		return l.File()
+	default:
+		return nil, fmt.Errorf("unable to hand over %T listener", l)
+	}
+}
+
+// inheritListener gives the listener of the socket handed over
+// with the given file descriptor.
+func inheritListener(fd string) (net.Listener, error) {
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s value: %s", listenFDEnv, err)
+	}
+
+	f := os.NewFile(uintptr(n), "kite")
+	defer f.Close()
+
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to inherit socket %d: %s", n, err)
+	}
+
+	return l, nil
+}
@@ -0,0 +1,82 @@
+// +build !windows
+
+package kite
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/koding/kite/v2/config"
+)
+
+func TestHandoverListener(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:3667")
+	if err != nil {
+		t.Fatalf("Listen()=%s", err)
+	}
+
+	f, err := listenerFile(l)
+	if err != nil {
+		t.Fatalf("listenerFile()=%s", err)
+	}
+
+	// The kite takes ownership of the file descriptor, like the new
+	// process does, so it must not be closed by the file.
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatalf("Dup()=%s", err)
+	}
+
+	// The socket is open as long as the handed over descriptor is.
+	f.Close()
+	l.Close()
+
+	os.Setenv(listenFDEnv, strconv.Itoa(fd))
+	defer os.Unsetenv(listenFDEnv)
+
+	cfg := config.New()
+	cfg.DisableAuthentication = true
+
+	k := NewWithConfig("handover", "0.0.1", cfg)
+	k.HandleFunc("foo", func(*Request) (interface{}, error) {
+		return "bar", nil
+	})
+
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	if port := k.Port(); port != 3667 {
+		t.Fatalf("got port %d, want 3667", port)
+	}
+
+	if fd := os.Getenv(listenFDEnv); fd != "" {
+		t.Fatalf("got %s=%q, want it to be unset", listenFDEnv, fd)
+	}
+
+	c := New("exp", "0.0.1").NewClient("http://127.0.0.1:3667/kite")
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	res, err := c.Tell("foo")
+	if err != nil {
+		t.Fatalf("Tell()=%s", err)
+	}
+
+	if s := res.MustString(); s != "bar" {
+		t.Fatalf("got %q, want %q", s, "bar")
+	}
+}
+
+func TestHandoverNotListening(t *testing.T) {
+	k := New("handover", "0.0.1")
+
+	if _, err := k.Handover(); err == nil {
+		t.Fatal("want Handover() to fail")
+	}
+}
@@ -7,13 +7,15 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/cenkalti/backoff"
-	"github.com/koding/kite/protocol"
+	"github.com/koding/kite/v2/protocol"
 )
 
 type heartbeatReq struct {
@@ -51,8 +53,9 @@ func newHeartbeatReq(r *Request) (*heartbeatReq, error) {
 
 func (k *Kite) processHeartbeats() {
 	var (
-		ping func() error
-		t    = time.NewTicker(time.Second) // dummy initial value
+		ping     func() error
+		interval time.Duration
+		t        = time.NewTimer(time.Second) // dummy initial value
 	)
 
 	t.Stop()
@@ -60,13 +63,18 @@ func (k *Kite) processHeartbeats() {
 	for {
 		select {
 		case <-t.C:
-			switch err := ping(); err {
+			err := ping()
+
+			switch err {
 			case nil:
+				t.Reset(k.jitter(interval))
 			case errRegisterAgain:
-				t.Stop()
 			default:
 				k.Log.Error("%s", err)
+				t.Reset(k.jitter(interval))
 			}
+
+			k.emit(&Event{Type: EventHeartbeat, Err: err})
 		case <-k.closeC:
 			t.Stop()
 			return
@@ -77,12 +85,28 @@ func (k *Kite) processHeartbeats() {
 				continue
 			}
 
-			t = time.NewTicker(req.interval)
+			interval = req.interval
 			ping = req.ping
+
+			t = time.NewTimer(k.jitter(interval))
 		}
 	}
 }
 
+// jitter randomly spreads the heartbeat interval by Config.HeartbeatJitter.
+func (k *Kite) jitter(interval time.Duration) time.Duration {
+	j := k.Config.HeartbeatJitter
+	if j <= 0 || interval <= 0 {
+		return interval
+	}
+
+	if j > 1 {
+		j = 1
+	}
+
+	return interval + time.Duration((2*rand.Float64()-1)*j*float64(interval))
+}
+
 // RegisterHTTPForever is just like RegisterHTTP however it first tries to
 // register forever until a response from kontrol is received. It's useful to
 // use it during app initializations. After the registration a reconnect is
@@ -137,6 +161,7 @@ func (k *Kite) RegisterHTTP(kiteURL *url.URL) (*registerResult, error) {
 			Type: "kiteKey",
 			Key:  k.KiteKey(),
 		},
+		Labels: k.Config.Labels,
 	}
 
 	data, err := json.Marshal(&args)
@@ -144,12 +169,16 @@ func (k *Kite) RegisterHTTP(kiteURL *url.URL) (*registerResult, error) {
 		return nil, err
 	}
 
-	resp, err := k.Config.Client.Post(registerURL, "application/json", bytes.NewReader(data))
+	cfg := k.config()
+
+	resp, err := cfg.ProxyClient(cfg.Client).Post(registerURL, "application/json", bytes.NewReader(data))
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
+	k.checkClockSkew(registerURL, resp.Header)
+
 	var rr protocol.RegisterResult
 	if err := json.NewDecoder(resp.Body).Decode(&rr); err != nil {
 		return nil, err
@@ -192,19 +221,27 @@ func (k *Kite) sendHeartbeats(interval time.Duration, kiteURL *url.URL) {
 		k.Log.Fatal("HeartbeatURL is malformed: %s", err)
 	}
 
-	q := u.Query()
-	q.Set("id", k.Id)
-	u.RawQuery = q.Encode()
+	var heartbeatFunc func() error
+
+	heartbeatFunc = func() error {
+		// The interval tells kontrol the kite accepts interval changes.
+		q := u.Query()
+		q.Set("id", k.Id)
+		q.Set("interval", strconv.FormatInt(int64(interval/time.Second), 10))
+		u.RawQuery = q.Encode()
 
-	heartbeatFunc := func() error {
 		k.Log.Debug("Sending heartbeat to %s", u)
 
-		resp, err := k.Config.Client.Get(u.String())
+		cfg := k.config()
+
+		resp, err := cfg.ProxyClient(cfg.Client).Get(u.String())
 		if err != nil {
 			return err
 		}
 		defer resp.Body.Close()
 
+		k.checkClockSkew(heartbeatURL, resp.Header)
+
 		if resp.StatusCode != http.StatusOK {
 			return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 		}
@@ -220,6 +257,30 @@ func (k *Kite) sendHeartbeats(interval time.Duration, kiteURL *url.URL) {
 
 		k.Log.Debug("Heartbeat response received %q", p)
 
+		// Kontrol may change the interval with a "pong <seconds>" response.
+		if fields := strings.Fields(string(p)); len(fields) == 2 && fields[0] == "pong" {
+			n, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("malformed heartbeat response: %s", p)
+			}
+
+			if d := time.Duration(n) * time.Second; d != interval {
+				k.Log.Debug("Changing heartbeat interval from %s to %s", interval, d)
+
+				interval = d
+
+				// Called by processHeartbeats, which reads heartbeatC.
+				go func() {
+					k.heartbeatC <- &heartbeatReq{
+						ping:     heartbeatFunc,
+						interval: d,
+					}
+				}()
+			}
+
+			return nil
+		}
+
 		switch string(p) {
 		case "pong":
 			return nil
@@ -0,0 +1,41 @@
+package kite
+
+import (
+	"testing"
+	"time"
+
+	"github.com/koding/kite/v2/config"
+)
+
+func TestHeartbeatJitter(t *testing.T) {
+	cfg := config.New()
+	cfg.HeartbeatJitter = 0.1
+
+	k := NewWithConfig("jitter", "0.0.1", cfg)
+	defer k.Close()
+
+	interval := 10 * time.Second
+	spread := false
+
+	for i := 0; i < 100; i++ {
+		d := k.jitter(interval)
+
+		if d < 9*time.Second || d > 11*time.Second {
+			t.Fatalf("got %s, want interval within 10%% of %s", d, interval)
+		}
+
+		if d != interval {
+			spread = true
+		}
+	}
+
+	if !spread {
+		t.Fatal("want heartbeats to be spread")
+	}
+
+	k.Config.HeartbeatJitter = 0
+
+	if d := k.jitter(interval); d != interval {
+		t.Fatalf("got %s, want %s", d, interval)
+	}
+}
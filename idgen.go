@@ -0,0 +1,221 @@
+package kite
+
+import (
+	crand "crypto/rand"
+	"encoding/hex"
+	"errors"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// crockford is the Crockford's base32 alphabet, which keeps the order
+// of the encoded numbers.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// SnowflakeEpoch is the time the timestamps of snowflake IDs start at.
+var SnowflakeEpoch = time.Date(2018, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// IDGenerator generates unique IDs of requests and kite instances,
+// see Kite.UseIDGenerator.
+type IDGenerator interface {
+	NewID() string
+}
+
+// IDGeneratorFunc is an adapter to allow the use of ordinary functions
+// as ID generators.
+type IDGeneratorFunc func() string
+
+// NewID implements the IDGenerator interface.
+func (f IDGeneratorFunc) NewID() string {
+	return f()
+}
+
+// ULID generates 26 characters long ULIDs, made of the time in
+// milliseconds and 80 random bits, which sort by the time they were
+// generated at. See https://github.com/ulid/spec.
+var ULID IDGenerator = IDGeneratorFunc(newULID)
+
+func newULID() string {
+	var p [16]byte
+
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	for i := 5; i >= 0; i-- {
+		p[i] = byte(ms)
+		ms >>= 8
+	}
+
+	crand.Read(p[6:])
+
+	return encodeCrockford(p[:], 26)
+}
+
+// TimeUUID generates version 7 UUIDs, made of the time in milliseconds
+// and 74 random bits, which sort by the time they were generated at.
+// Unlike ULIDs, they are valid kite IDs for the postgres storage of kontrol.
+var TimeUUID IDGenerator = IDGeneratorFunc(newTimeUUID)
+
+func newTimeUUID() string {
+	var p [16]byte
+
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	for i := 5; i >= 0; i-- {
+		p[i] = byte(ms)
+		ms >>= 8
+	}
+
+	crand.Read(p[6:])
+
+	p[6] = p[6]&0x0f | 0x70 // version 7
+	p[8] = p[8]&0x3f | 0x80 // RFC 4122 variant
+
+	h := hex.EncodeToString(p[:])
+
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// Snowflake generates 13 characters long IDs of 64 bits made of the time
+// in milliseconds since SnowflakeEpoch, a 10-bit node and a 12-bit sequence
+// number. The IDs sort by the time they were generated at and the node
+// that generated an ID is given by ParseSnowflake.
+type Snowflake struct {
+	node int64
+
+	mu   sync.Mutex
+	last int64 // time of the last ID
+	seq  int64 // sequence number of the last ID
+}
+
+// NewSnowflake gives a snowflake generator for the node, which must be
+// unique among the generators of the IDs and between 0 and 1023.
+func NewSnowflake(node int64) *Snowflake {
+	return &Snowflake{node: node & 0x3ff}
+}
+
+// NewID implements the IDGenerator interface.
+func (s *Snowflake) NewID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := snowflakeTime()
+
+	// Keep the IDs ordered when the clock goes back.
+	if now < s.last {
+		now = s.last
+	}
+
+	if now == s.last {
+		s.seq = (s.seq + 1) & 0xfff
+
+		if s.seq == 0 {
+			// The sequence is exhausted, wait for the next millisecond.
+			for now <= s.last {
+				time.Sleep(100 * time.Microsecond)
+				now = snowflakeTime()
+			}
+		}
+	} else {
+		s.seq = 0
+	}
+
+	s.last = now
+
+	id := uint64(now)<<22 | uint64(s.node)<<12 | uint64(s.seq)
+
+	var p [8]byte
+	for i := 7; i >= 0; i-- {
+		p[i] = byte(id)
+		id >>= 8
+	}
+
+	return encodeCrockford(p[:], 13)
+}
+
+func snowflakeTime() int64 {
+	return int64(time.Since(SnowflakeEpoch) / time.Millisecond)
+}
+
+// ParseSnowflake gives the time the snowflake ID was generated at
+// and the node that generated it.
+func ParseSnowflake(id string) (t time.Time, node int64, err error) {
+	if len(id) != 13 {
+		return time.Time{}, 0, errors.New("invalid snowflake ID length")
+	}
+
+	var n uint64
+
+	for i := 0; i < len(id); i++ {
+		c := strings.IndexByte(crockford, id[i])
+		if c == -1 || (i == 0 && c > 1) {
+			return time.Time{}, 0, errors.New("invalid snowflake ID")
+		}
+
+		n = n<<5 | uint64(c)
+	}
+
+	ms := int64(n >> 22)
+	t = SnowflakeEpoch.Add(time.Duration(ms) * time.Millisecond)
+
+	return t, int64(n>>12) & 0x3ff, nil
+}
+
+// snowflakeNode gives the node of the default request ID generator
+// of the kite with the given ID.
+func snowflakeNode(kiteID string) int64 {
+	h := fnv.New32a()
+	h.Write([]byte(kiteID))
+	return int64(h.Sum32() & 0x3ff)
+}
+
+// encodeCrockford encodes p, a big-endian number, to n base32 characters.
+func encodeCrockford(p []byte, n int) string {
+	s := make([]byte, n)
+
+	var acc uint
+	var bits uint
+
+	i := len(p) - 1
+	for j := n - 1; j >= 0; j-- {
+		for bits < 5 && i >= 0 {
+			acc |= uint(p[i]) << bits
+			bits += 8
+			i--
+		}
+
+		s[j] = crockford[acc&0x1f]
+		acc >>= 5
+
+		if bits >= 5 {
+			bits -= 5
+		} else {
+			bits = 0
+		}
+	}
+
+	return string(s)
+}
+
+// UseIDGenerator makes the kite generate the IDs of the requests it sends
+// and serves with g, instead of the default snowflake generator, and sets
+// the kite Id to a new ID of g. It must be called before the kite is run
+// or registered to kontrol.
+//
+// By default the kite Id is a TimeUUID and request IDs are snowflake IDs,
+// whose node is derived from the kite Id. Kites registering to kontrol
+// with the postgres storage must use a generator of UUIDs.
+func (k *Kite) UseIDGenerator(g IDGenerator) {
+	k.handlersMu.Lock()
+	k.idGen = g
+	k.Id = g.NewID()
+	k.handlersMu.Unlock()
+}
+
+// newID gives a new request ID.
+func (k *Kite) newID() string {
+	k.handlersMu.RLock()
+	g := k.idGen
+	k.handlersMu.RUnlock()
+
+	return g.NewID()
+}
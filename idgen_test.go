@@ -0,0 +1,117 @@
+package kite
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestULID(t *testing.T) {
+	var ids []string
+
+	for i := 0; i < 3; i++ {
+		ids = append(ids, ULID.NewID())
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	for _, id := range ids {
+		if len(id) != 26 {
+			t.Fatalf("got %q, want 26 characters", id)
+		}
+	}
+
+	if !sort.StringsAreSorted(ids) {
+		t.Fatalf("got %v, want sorted IDs", ids)
+	}
+}
+
+func TestTimeUUID(t *testing.T) {
+	var ids []string
+
+	for i := 0; i < 3; i++ {
+		id := TimeUUID.NewID()
+
+		u, err := uuid.FromString(id)
+		if err != nil {
+			t.Fatalf("FromString(%q)=%s", id, err)
+		}
+
+		if u.Version() != 7 || u.Variant() != uuid.VariantRFC4122 {
+			t.Fatalf("got version %d, variant %d", u.Version(), u.Variant())
+		}
+
+		ids = append(ids, id)
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	if !sort.StringsAreSorted(ids) {
+		t.Fatalf("got %v, want sorted IDs", ids)
+	}
+}
+
+func TestSnowflake(t *testing.T) {
+	s := NewSnowflake(42)
+
+	start := time.Now().Add(-time.Millisecond)
+	seen := make(map[string]bool)
+
+	var ids []string
+
+	for i := 0; i < 10000; i++ {
+		id := s.NewID()
+
+		if seen[id] {
+			t.Fatalf("%d: duplicated ID %q", i, id)
+		}
+
+		seen[id] = true
+		ids = append(ids, id)
+	}
+
+	if !sort.StringsAreSorted(ids) {
+		t.Fatal("want sorted IDs")
+	}
+
+	ts, node, err := ParseSnowflake(ids[len(ids)-1])
+	if err != nil {
+		t.Fatalf("ParseSnowflake()=%s", err)
+	}
+
+	if node != 42 {
+		t.Fatalf("got node %d, want 42", node)
+	}
+
+	if ts.Before(start) || ts.After(time.Now()) {
+		t.Fatalf("got time %s, want between %s and now", ts, start)
+	}
+
+	if _, _, err := ParseSnowflake("not-a-snowflake"); err == nil {
+		t.Fatal("want error for an invalid ID")
+	}
+}
+
+func TestUseIDGenerator(t *testing.T) {
+	k := New("idgen", "0.0.1")
+	defer k.Close()
+
+	_, node, err := ParseSnowflake(k.newID())
+	if err != nil {
+		t.Fatalf("ParseSnowflake()=%s", err)
+	}
+
+	if want := snowflakeNode(k.Id); node != want {
+		t.Fatalf("got node %d, want %d", node, want)
+	}
+
+	k.UseIDGenerator(IDGeneratorFunc(func() string { return "fixed" }))
+
+	if k.Id != "fixed" {
+		t.Fatalf("got kite ID %q, want %q", k.Id, "fixed")
+	}
+
+	if id := k.newID(); id != "fixed" {
+		t.Fatalf("got request ID %q, want %q", id, "fixed")
+	}
+}
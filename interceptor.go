@@ -0,0 +1,60 @@
+package kite
+
+import (
+	"time"
+
+	"github.com/koding/kite/v2/dnode"
+)
+
+// CallFunc calls the method of the remote kite with the given arguments
+// and returns its result.
+type CallFunc func(method string, args []interface{}) (*dnode.Partial, error)
+
+// Interceptor is run on every outgoing call made with Tell, Go and their
+// variants. It can inspect or modify the method and the arguments before
+// passing them to next, which continues the call, or return without
+// calling next to fail or short-circuit the call.
+type Interceptor func(method string, args []interface{}, next CallFunc) (*dnode.Partial, error)
+
+// UseInterceptor registers an interceptor for the outgoing calls of the
+// client. Calling UseInterceptor multiple times registers multiple
+// interceptors, the one registered first is run first.
+//
+// Interceptors can be used to refresh authentication, collect metrics,
+// log or mutate arguments of the calls.
+func (c *Client) UseInterceptor(interceptor Interceptor) {
+	c.interceptorsMu.Lock()
+	c.interceptors = append(c.interceptors, interceptor)
+	c.interceptorsMu.Unlock()
+}
+
+// interceptedCall gives a CallFunc, which runs the interceptors before
+// sending the method. It returns nil if the client has no interceptors.
+func (c *Client) interceptedCall(timeout time.Duration, requestID string, stream *streamFuncs) CallFunc {
+	c.interceptorsMu.RLock()
+	interceptors := c.interceptors
+	c.interceptorsMu.RUnlock()
+
+	if len(interceptors) == 0 {
+		return nil
+	}
+
+	call := CallFunc(func(method string, args []interface{}) (*dnode.Partial, error) {
+		responseChan := make(chan *response, 1)
+		c.sendMethod(method, args, timeout, requestID, stream, responseChan)
+		resp := <-responseChan
+		return resp.Result, resp.Err
+	})
+
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		call = intercept(interceptors[i], call)
+	}
+
+	return call
+}
+
+func intercept(interceptor Interceptor, next CallFunc) CallFunc {
+	return func(method string, args []interface{}) (*dnode.Partial, error) {
+		return interceptor(method, args, next)
+	}
+}
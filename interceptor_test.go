@@ -0,0 +1,72 @@
+package kite
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/dnode"
+)
+
+func TestClient_UseInterceptor(t *testing.T) {
+	cfg := config.New()
+	cfg.DisableAuthentication = true
+	cfg.Port = 3643
+
+	ksrv := NewWithConfig("interceptor-server", "0.0.1", cfg)
+	ksrv.HandleFunc("echo", func(r *Request) (interface{}, error) {
+		return r.Args.One().MustString(), nil
+	})
+
+	go ksrv.Run()
+	<-ksrv.ServerReadyNotify()
+	defer ksrv.Close()
+
+	c := New("interceptor-client", "0.0.1").NewClient("http://127.0.0.1:3643/kite")
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	var calls []string
+
+	c.UseInterceptor(func(method string, args []interface{}, next CallFunc) (*dnode.Partial, error) {
+		calls = append(calls, "first:"+method)
+
+		if method == "forbidden" {
+			return nil, errors.New("forbidden by interceptor")
+		}
+
+		return next(method, args)
+	})
+
+	c.UseInterceptor(func(method string, args []interface{}, next CallFunc) (*dnode.Partial, error) {
+		calls = append(calls, "second:"+method)
+
+		return next(method, []interface{}{args[0].(string) + " (intercepted)"})
+	})
+
+	result, err := c.Tell("echo", "hello")
+	if err != nil {
+		t.Fatalf("Tell()=%s", err)
+	}
+
+	if got, want := result.MustString(), "hello (intercepted)"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	if _, err := c.Tell("forbidden", "hello"); err == nil || err.Error() != "forbidden by interceptor" {
+		t.Fatalf("got %v, want interceptor error", err)
+	}
+
+	want := []string{"first:echo", "second:echo", "first:forbidden"}
+	if len(calls) != len(want) {
+		t.Fatalf("got %v calls, want %v", calls, want)
+	}
+
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Fatalf("got %v calls, want %v", calls, want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package kite
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/koding/kite/v2/protocol"
+)
+
+// JWKSRefreshInterval is the minimum time between fetches of the JWKS
+// document caused by tokens signed with keys, which are not in the cached
+// document. It prevents forged tokens from making the kite hammer Kontrol.
+var JWKSRefreshInterval = 10 * time.Second
+
+// jwksCache holds the keys of the JWKS document, keyed by their IDs.
+type jwksCache struct {
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+// jwksKey gives the key of the JWKS document with the given ID. The document
+// is fetched when the cached one expires, or when the key is unknown and
+// the document was not fetched for JWKSRefreshInterval. If the fetch fails,
+// the expired key is used until the document is fetched again.
+func (k *Kite) jwksKey(kid string) (*rsa.PublicKey, error) {
+	ttl := k.Config.VerifyTTL
+	if ttl <= 0 {
+		ttl = 5 * time.Minute
+	}
+
+	k.jwks.mu.Lock()
+	defer k.jwks.mu.Unlock()
+
+	since := time.Since(k.jwks.fetched)
+	key, ok := k.jwks.keys[kid]
+
+	switch {
+	case since < ttl && ok:
+		return key, nil
+	case !ok && since < JWKSRefreshInterval:
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	keys, err := k.fetchJWKS()
+	if err != nil {
+		if ok {
+			k.Log.Warning("Unable to refresh JWKS, using cached key %q: %s", kid, err)
+			return key, nil
+		}
+
+		return nil, fmt.Errorf("unable to fetch JWKS: %s", err)
+	}
+
+	k.jwks.keys = keys
+	k.jwks.fetched = time.Now()
+
+	if key, ok = keys[kid]; !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	return key, nil
+}
+
+// fetchJWKS fetches the document from Config.JWKSURL.
+func (k *Kite) fetchJWKS() (map[string]*rsa.PublicKey, error) {
+	cfg := k.config()
+
+	client := cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Get(cfg.JWKSURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	k.checkClockSkew(cfg.JWKSURL, resp.Header)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", cfg.JWKSURL, resp.Status)
+	}
+
+	var jwks protocol.JWKS
+
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(jwks.Keys))
+
+	for _, jwk := range jwks.Keys {
+		key, err := jwk.RSAPublicKey()
+		if err != nil {
+			k.Log.Warning("Skipping JWKS key %q: %s", jwk.Kid, err)
+			continue
+		}
+
+		keys[jwk.Kid] = key
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,123 @@
+package kite
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/koding/kite/v2/kitekey"
+	"github.com/koding/kite/v2/protocol"
+	"github.com/koding/kite/v2/testkeys"
+)
+
+func TestJWKS(t *testing.T) {
+	defer func(d time.Duration) { JWKSRefreshInterval = d }(JWKSRefreshInterval)
+	JWKSRefreshInterval = time.Hour
+
+	var mu sync.Mutex
+	var fetches int32
+
+	publics := map[string]string{"first": testkeys.Public}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		var jwks protocol.JWKS
+		for kid, public := range publics {
+			key, err := jwt.ParseRSAPublicKeyFromPEM([]byte(public))
+			if err != nil {
+				t.Errorf("ParseRSAPublicKeyFromPEM()=%s", err)
+			}
+			jwks.Keys = append(jwks.Keys, protocol.NewJWK(kid, key))
+		}
+
+		json.NewEncoder(w).Encode(&jwks)
+	}))
+	defer srv.Close()
+
+	k := New("jwks", "0.0.1")
+	k.Config.KontrolKey = testkeys.Public
+	k.Config.KontrolUser = "testuser"
+	k.Config.JWKSURL = srv.URL
+
+	sign := func(kid, private string) string {
+		claims := &kitekey.KiteClaims{
+			StandardClaims: jwt.StandardClaims{
+				Issuer:    "testuser",
+				Subject:   "testuser",
+				ExpiresAt: time.Now().Add(time.Minute).Unix(),
+			},
+		}
+
+		key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(private))
+		if err != nil {
+			t.Fatalf("ParseRSAPrivateKeyFromPEM()=%s", err)
+		}
+
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = kid
+
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("SignedString()=%s", err)
+		}
+
+		return signed
+	}
+
+	verify := func(token string) error {
+		_, err := jwt.ParseWithClaims(token, &kitekey.KiteClaims{}, k.RSAKey)
+		return err
+	}
+
+	want := func(n int32) {
+		if got := atomic.LoadInt32(&fetches); got != n {
+			t.Fatalf("got %d fetches, want %d", got, n)
+		}
+	}
+
+	first := sign("first", testkeys.Private)
+	second := sign("second", testkeys.PrivateSecond)
+
+	for i := 0; i < 2; i++ {
+		if err := verify(first); err != nil {
+			t.Fatalf("verify()=%s", err)
+		}
+	}
+	want(1)
+
+	if err := verify(sign("first", testkeys.PrivateEvil)); err == nil {
+		t.Fatal("expected token signed with other key to be invalid")
+	}
+
+	// The key is rotated, but the document was fetched recently.
+	mu.Lock()
+	publics["second"] = testkeys.PublicSecond
+	mu.Unlock()
+
+	if err := verify(second); err == nil {
+		t.Fatal("expected unknown key to be rejected")
+	}
+	want(1)
+
+	JWKSRefreshInterval = 0
+
+	if err := verify(second); err != nil {
+		t.Fatalf("verify()=%s", err)
+	}
+	want(2)
+
+	// Tokens without kid are verified with the kontrol key.
+	if err := verify(sign("", testkeys.Private)); err != nil {
+		t.Fatalf("verify()=%s", err)
+	}
+	want(2)
+}
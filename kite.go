@@ -10,6 +10,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -17,16 +18,15 @@ import (
 	"sync"
 	"time"
 
-	"github.com/koding/kite/config"
-	"github.com/koding/kite/kitekey"
-	"github.com/koding/kite/protocol"
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/kitekey"
+	"github.com/koding/kite/v2/protocol"
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
 	"github.com/igm/sockjs-go/sockjs"
 	"github.com/koding/cache"
-	"github.com/koding/kite/sockjsclient"
-	uuid "github.com/satori/go.uuid"
+	"github.com/koding/kite/v2/sockjsclient"
 )
 
 var hostname string
@@ -73,8 +73,34 @@ type Kite struct {
 	// WebRTCHandler handles the webrtc responses coming from a signalling server.
 	WebRTCHandler Handler
 
+	// MinClientVersion, when non-empty, is the oldest version of kites,
+	// which are supported to call methods of this kite. Calls from older
+	// kites are logged, or rejected if RejectOutdatedClients is true.
+	MinClientVersion      string
+	RejectOutdatedClients bool
+
+	// SubscriptionStore, when non-nil, persists subscriptions made
+	// with Client.Subscribe.
+	SubscriptionStore SubscriptionStore
+
+	// Discovery, when non-nil, is used by GetKites to resolve kites
+	// when kontrol is unreachable, e.g. with DNSDiscovery.
+	Discovery Discovery
+
+	// ErrorDetails, when non-nil, replaces the default serialization of
+	// debug details of errors sent to trusted callers in Error.CodeData,
+	// see Config.DebugErrors. The err is the error returned by the handler
+	// or the value it panicked with, the stack is non-nil for panics only.
+	ErrorDetails func(r *Request, err interface{}, stack []byte) interface{}
+
+	// TunnelLayer, when non-nil, unwraps the tunnels opened by a tunnel
+	// proxy, which applies a stream layer to them, see
+	// tunnelproxy.Proxy.StreamLayer. It must match the layer of the proxy.
+	TunnelLayer StreamLayer
+
 	// Handlers added with Kite.HandleFunc().
 	handlers     map[string]*Method // method map for exported methods
+	methodsMu    sync.RWMutex       // protects handlers, methods can be added after Run
 	preHandlers  []Handler          // a list of handlers that are executed before any handler
 	postHandlers []Handler          // a list of handlers that are executed after any handler
 	finalFuncs   []FinalFunc        // a list of funcs executed after any handler regardless of the error
@@ -93,7 +119,15 @@ type Kite struct {
 	// kontrolKey stores parsed Config.KontrolKey
 	kontrolKey *rsa.PublicKey
 
-	// configMu protects access to Config.{Kite,Kontrol}Key fields.
+	// jwks caches the keys of Config.JWKSURL document.
+	jwks jwksCache
+
+	// clockSkew is the last clock skew measured against Kontrol,
+	// see ClockSkew.
+	clockSkew clockSkew
+
+	// configMu protects access to Config.{Kite,Kontrol}Key fields and
+	// the fields changed by WatchConfig.
 	configMu sync.RWMutex
 
 	// verifyCache is used as a cache for verify method.
@@ -101,6 +135,11 @@ type Kite struct {
 	// The field is set by verifyInit method.
 	verifyCache *cache.MemoryTTL
 
+	// tokenIDCache caches tokens fetched by ID, see AuthenticateFromTokenID.
+	//
+	// The field is set by verifyInit method.
+	tokenIDCache *cache.MemoryTTL
+
 	// verifyFunc is a verify method used to verify auth keys.
 	//
 	// For more details see (config.Config).VerifyFunc.
@@ -119,9 +158,12 @@ type Kite struct {
 	// verifyOnce ensures all verify* fields are set up only once.
 	verifyOnce sync.Once
 
-	// mu protects assigment to verifyCache
+	// mu protects assigment to verifyCache and listener
 	mu sync.Mutex
 
+	// closed is to ensure Close is idempotent
+	closed int32
+
 	// Handlers to call when a new connection is received.
 	onConnectHandlers []func(*Client)
 
@@ -135,17 +177,79 @@ type Kite struct {
 	// registers successfully to Kontrol
 	onRegisterHandlers []func(*protocol.RegisterResult)
 
+	// onDisplacedHandlers field holds callbacks invoked when Kontrol
+	// replaces the registration of the Kite
+	onDisplacedHandlers []func(*protocol.DisplacedArgs)
+
+	// onTokenEventHandlers field holds callbacks invoked when a token
+	// of a client is issued, renewed or expires
+	onTokenEventHandlers []func(*TokenEvent)
+
+	// onPanicHandlers field holds callbacks invoked when a goroutine
+	// of a connection panics
+	onPanicHandlers []func(*Panic)
+
+	// onCallbackExpiredHandlers field holds callbacks invoked when
+	// a callback sent by a client expires
+	onCallbackExpiredHandlers []func(*Client, uint64)
+
+	// panics is the number of recovered panics, see Panics
+	panics int64
+
+	// channelHandlers holds handlers added with HandleChannel.
+	channelHandlers map[string]ChannelHandler
+
+	// trustPolicies holds policies added with Trust, keyed by method group.
+	trustPolicies map[string]*TrustPolicy
+
+	// webRTCPeers handles WebRTC sessions, set by UseWebRTC.
+	webRTCPeers *webRTCPeers
+
+	// auditSinks receive records of served requests, see UseAuditSink.
+	auditSinks []AuditSink
+
+	// eventSubs receive lifecycle events, see SubscribeEvents.
+	eventSubs []*EventSubscription
+
+	// connected holds the clients served by ServeSession, see Clients.
+	connected   map[*Client]struct{}
+	connectedMu sync.RWMutex
+
+	// topics holds topic subscriptions of the connected clients.
+	topics topics
+
+	// resumable holds served clients, whose sessions can be resumed,
+	// keyed by session ID.
+	resumable   map[string]*Client
+	resumableMu sync.Mutex
+
 	// handlersMu protects access to on*Handlers fields.
 	handlersMu sync.RWMutex
 
+	// activeRequests is the number of method calls being served,
+	// it's accessed atomically
+	activeRequests int32
+
+	// readyChecks are run before a method is served, until all of them pass.
+	readyChecks []func() error
+	ready       bool
+	readyMu     sync.Mutex // protects readyChecks and ready
+
 	// heartbeatC is used to control kite's heartbeats; sending
 	// a non-nil value on the channel makes heartbeat goroutine issue
 	// new heartbeats; sending nil value stops heartbeats
 	heartbeatC chan *heartbeatReq
 
+	// tokens renews the tokens of the clients returned by GetKites
+	tokens *tokenManager
+
+	// idGen generates request IDs, see UseIDGenerator.
+	idGen IDGenerator
+
 	// server fields, are initialized and used when
 	// TODO: move them to their own struct, just like KontrolClient
-	listener  *gracefulListener
+	listener  *GracefulListener
+	socket    net.Listener // the listener before wrapping, see Handover
 	TLSConfig *tls.Config
 	readyC    chan bool // To signal when kite is ready to accept connections
 	closeC    chan bool // To signal when kite is closed with Close()
@@ -174,7 +278,7 @@ func NewWithConfig(name, version string, cfg *config.Config) *Kite {
 		panic("kite: version must be 3-digits semantic version")
 	}
 
-	kiteID := uuid.Must(uuid.NewV4())
+	kiteID := TimeUUID.NewID()
 
 	l, setlevel := newLogger(name)
 
@@ -182,6 +286,7 @@ func NewWithConfig(name, version string, cfg *config.Config) *Kite {
 		readyConnected:  make(chan struct{}),
 		readyRegistered: make(chan struct{}),
 		registerChan:    make(chan *url.URL, 1),
+		methodsChanged:  make(chan struct{}, 1),
 	}
 
 	k := &Kite{
@@ -193,17 +298,24 @@ func NewWithConfig(name, version string, cfg *config.Config) *Kite {
 		kontrol:        kClient,
 		name:           name,
 		version:        version,
-		Id:             kiteID.String(),
+		Id:             kiteID,
+		idGen:          NewSnowflake(snowflakeNode(kiteID)),
 		readyC:         make(chan bool),
 		closeC:         make(chan bool),
 		heartbeatC:     make(chan *heartbeatReq, 1),
 		muxer:          mux.NewRouter(),
 	}
 
+	k.tokens = newTokenManager(k)
+
 	if cfg != nil && cfg.UseWebRTC {
 		k.WebRTCHandler = NewWebRCTHandler()
 	}
 
+	if cfg.TLSCertFile != "" && cfg.TLSKeyFile != "" {
+		k.UseTLSFile(cfg.TLSCertFile, cfg.TLSKeyFile)
+	}
+
 	// All sockjs communication is done through this endpoint..
 	k.muxer.PathPrefix("/kite").Handler(sockjs.NewHandler("/kite", *cfg.SockJS, k.sockjsHandler))
 
@@ -217,6 +329,9 @@ func NewWithConfig(name, version string, cfg *config.Config) *Kite {
 	// Tokens are granted by Kontrol Kite.
 	k.Authenticators["token"] = k.AuthenticateFromToken
 
+	// Large tokens can be referenced by ID, see Client.TokenByID.
+	k.Authenticators["tokenID"] = k.AuthenticateFromTokenID
+
 	// A kite accepts requests with the same username.
 	k.Authenticators["kiteKey"] = k.AuthenticateFromKiteKey
 
@@ -249,6 +364,16 @@ func (k *Kite) KiteKey() string {
 	return k.Config.KiteKey
 }
 
+// config gives a copy of the kite's config, which is safe to read
+// while the config is reloaded, see WatchConfig.
+func (k *Kite) config() *config.Config {
+	k.configMu.RLock()
+	cfg := *k.Config
+	k.configMu.RUnlock()
+
+	return &cfg
+}
+
 // KontrolKey gives a Kontrol's public key.
 //
 // The value is taken form kite key's kontrolKey claim.
@@ -278,25 +403,50 @@ func (k *Kite) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 }
 
 func (k *Kite) sockjsHandler(session sockjs.Session) {
-	defer session.Close(3000, "Go away!")
+	k.ServeSession(session)
+}
 
+// ServeSession serves the remote kite connected with the session, it blocks
+// until the session is closed. It is meant for transports, which accept
+// sessions on their own instead of the HTTP server of the kite.
+//
+// If session resumption is enabled with Config.ResumeGracePeriod, the client
+// stays connected until the grace period after the session broke passes.
+// A session, which resumes another one, is handed over to the client of
+// the resumed session.
+func (k *Kite) ServeSession(session Session) {
 	// This Client also handles the connected client.
 	// Since both sides can send/receive messages the client code is reused here.
 	c := k.NewClient("")
-	defer c.Close()
+	c.resume.served = true
 
 	c.setSession(session)
-	c.wg.Add(1)
-	go c.sendHub()
+	c.startSendHub()
+
+	k.addConnected(c)
 
 	k.callOnConnectHandlers(c)
 	c.callOnConnectHandlers()
 
 	// Run after methods are registered and delegate is set
-	c.readLoop()
+	err := c.superviseReadLoop()
+
+	for err != errResumed && c.waitResume() {
+		err = c.superviseReadLoop()
+	}
+
+	k.forgetResumable(c)
+	k.removeConnected(c)
+	k.unsubscribeTopics(c)
 
 	c.callOnDisconnectHandlers()
 	k.callOnDisconnectHandlers(c)
+
+	c.Close()
+
+	if err != errResumed {
+		session.Close(3000, "Go away!")
+	}
 }
 
 // OnConnect registers a callbacks which is called when a Kite connects
@@ -330,7 +480,83 @@ func (k *Kite) OnRegister(handler func(*protocol.RegisterResult)) {
 	k.handlersMu.Unlock()
 }
 
+// OnDisplaced registers a callback which is called when Kontrol replaces
+// the registration of the Kite, because another kite registered with
+// the same ID from a different URL.
+func (k *Kite) OnDisplaced(handler func(*protocol.DisplacedArgs)) {
+	k.handlersMu.Lock()
+	k.onDisplacedHandlers = append(k.onDisplacedHandlers, handler)
+	k.handlersMu.Unlock()
+}
+
+// OnTokenEvent registers a callback which is called when a token, which
+// is used to call a remote kite, is issued, renewed, fails to renew or
+// expires. It can be used to collect metrics or alert on kites, which
+// fail to renew their tokens.
+//
+// Handlers are called synchronously by the token renewer, they
+// must not block.
+func (k *Kite) OnTokenEvent(handler func(*TokenEvent)) {
+	k.handlersMu.Lock()
+	k.onTokenEventHandlers = append(k.onTokenEventHandlers, handler)
+	k.handlersMu.Unlock()
+}
+
+// OnCallbackExpired registers a callback which is called when a function
+// sent by a client to the remote kite expires, because it was not called
+// within Config.CallbackTTL. The id is the callback number sent in
+// the dnode message.
+func (k *Kite) OnCallbackExpired(handler func(c *Client, id uint64)) {
+	k.handlersMu.Lock()
+	k.onCallbackExpiredHandlers = append(k.onCallbackExpiredHandlers, handler)
+	k.handlersMu.Unlock()
+}
+
+// RequireReady registers a check which must pass before the kite starts
+// serving incoming method calls. Until all registered checks return nil,
+// calls are rejected with an error of type "notReadyError", which the
+// caller may retry later.
+//
+// Once all checks pass, they are not run again. Built-in "kite." methods
+// are never gated, so kontrol and other kites can still reach the kite.
+func (k *Kite) RequireReady(check func() error) {
+	k.readyMu.Lock()
+	k.readyChecks = append(k.readyChecks, check)
+	k.ready = false
+	k.readyMu.Unlock()
+}
+
+// checkReady runs readiness checks for the given method, it returns
+// non-nil error if the kite is not ready to serve it yet.
+func (k *Kite) checkReady(method string) *Error {
+	if strings.HasPrefix(method, "kite.") {
+		return nil
+	}
+
+	k.readyMu.Lock()
+	defer k.readyMu.Unlock()
+
+	if k.ready {
+		return nil
+	}
+
+	for _, check := range k.readyChecks {
+		if err := check(); err != nil {
+			return &Error{
+				Type:    "notReadyError",
+				Message: "kite is not ready: " + err.Error(),
+			}
+		}
+	}
+
+	k.ready = true
+
+	return nil
+}
+
 func (k *Kite) callOnConnectHandlers(c *Client) {
+	k.emit(&Event{Type: EventConnect, Client: c})
+
 	k.handlersMu.RLock()
 	defer k.handlersMu.RUnlock()
 
@@ -355,6 +581,8 @@ func (k *Kite) callOnFirstRequestHandlers(c *Client) {
 }
 
 func (k *Kite) callOnDisconnectHandlers(c *Client) {
+	k.emit(&Event{Type: EventDisconnect, Client: c})
+
 	k.handlersMu.RLock()
 	defer k.handlersMu.RUnlock()
 
@@ -367,6 +595,8 @@ func (k *Kite) callOnDisconnectHandlers(c *Client) {
 }
 
 func (k *Kite) callOnRegisterHandlers(r *protocol.RegisterResult) {
+	k.emit(&Event{Type: EventRegister, Register: r})
+
 	k.handlersMu.RLock()
 	defer k.handlersMu.RUnlock()
 
@@ -378,6 +608,44 @@ func (k *Kite) callOnRegisterHandlers(r *protocol.RegisterResult) {
 	}
 }
 
+func (k *Kite) callOnCallbackExpiredHandlers(c *Client, id uint64) {
+	k.handlersMu.RLock()
+	defer k.handlersMu.RUnlock()
+
+	for _, handler := range k.onCallbackExpiredHandlers {
+		func() {
+			defer nopRecover()
+			handler(c, id)
+		}()
+	}
+}
+
+func (k *Kite) callOnDisplacedHandlers(args *protocol.DisplacedArgs) {
+	k.handlersMu.RLock()
+	defer k.handlersMu.RUnlock()
+
+	for _, handler := range k.onDisplacedHandlers {
+		func() {
+			defer nopRecover()
+			handler(args)
+		}()
+	}
+}
+
+func (k *Kite) callOnTokenEventHandlers(ev *TokenEvent) {
+	k.emit(&Event{Type: EventToken, Token: ev})
+
+	k.handlersMu.RLock()
+	defer k.handlersMu.RUnlock()
+
+	for _, handler := range k.onTokenEventHandlers {
+		func() {
+			defer nopRecover()
+			handler(ev)
+		}()
+	}
+}
+
 func (k *Kite) updateAuth(reg *protocol.RegisterResult) {
 	k.configMu.Lock()
 	defer k.configMu.Unlock()
@@ -419,15 +687,12 @@ func (k *Kite) updateAuth(reg *protocol.RegisterResult) {
 
 // RSAKey returns the corresponding public key for the issuer of the token.
 // It is called by jwt-go package when validating the signature in the token.
+//
+// If Config.JWKSURL is set, tokens with a "kid" header are verified with
+// the key of the JWKS document, see Config.JWKSURL.
 func (k *Kite) RSAKey(token *jwt.Token) (interface{}, error) {
 	k.verifyOnce.Do(k.verifyInit)
 
-	kontrolKey := k.KontrolKey()
-
-	if kontrolKey == nil {
-		panic("kontrol key is not set in config")
-	}
-
 	if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
 		return nil, errors.New("invalid signing method")
 	}
@@ -441,6 +706,16 @@ func (k *Kite) RSAKey(token *jwt.Token) (interface{}, error) {
 		return nil, fmt.Errorf("issuer is not trusted: %s", claims.Issuer)
 	}
 
+	if kid, _ := token.Header["kid"].(string); kid != "" && k.config().JWKSURL != "" {
+		return k.jwksKey(kid)
+	}
+
+	kontrolKey := k.KontrolKey()
+
+	if kontrolKey == nil {
+		panic("kontrol key is not set in config")
+	}
+
 	return kontrolKey, nil
 }
 
@@ -485,44 +760,52 @@ func (err *ErrClose) Error() string {
 //
 // If the kites argument is a slice and at least one of the kites returns
 // error on Close, the Close method returns *ErrClose.
-//
-// TODO(rjeczalik): Currently (*Kite).Close and (*Client).Close does
-// not implement io.Closer interface - when [0] is resolved, this
-// method should be adopted accordingly.
-//
-//   [0] - https://github.com/koding/kite/issues/183
-//
 func Closer(kites interface{}) io.Closer {
 	switch k := kites.(type) {
 	case *Kite:
 		return closerFunc(func() []error {
-			k.Close()
-			return nil
+			return []error{k.Close()}
 		})
 	case []*Kite:
 		return closerFunc(func() []error {
-			for _, k := range k {
-				k.Close()
-			}
-			return nil
+			return closeAll(len(k), func(i int) error {
+				return k[i].Close()
+			})
 		})
 	case *Client:
 		return closerFunc(func() []error {
-			k.Close()
-			return nil
+			return []error{k.Close()}
 		})
 	case []*Client:
 		return closerFunc(func() []error {
-			for _, c := range k {
-				c.Close()
-			}
-			return nil
+			return closeAll(len(k), func(i int) error {
+				return k[i].Close()
+			})
 		})
 	default:
 		panic(fmt.Errorf("unrecognized type passed to Close %T", kites))
 	}
 }
 
+// closeAll calls fn for each of n kites, it returns nil if none of
+// the calls failed.
+func closeAll(n int, fn func(i int) error) []error {
+	errs := make([]error, n)
+	failed := false
+
+	for i := range errs {
+		if errs[i] = fn(i); errs[i] != nil {
+			failed = true
+		}
+	}
+
+	if !failed {
+		return nil
+	}
+
+	return errs
+}
+
 // Close is a wrapper for Closer that calls a Close on it.
 func Close(kites interface{}) error {
 	return Closer(kites).Close()
@@ -1,11 +1,14 @@
 package kite
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"math"
 	"math/rand"
+	"net"
 	"os"
 	"reflect"
 	"strconv"
@@ -13,13 +16,12 @@ import (
 	"testing"
 	"time"
 
-	"github.com/koding/kite/config"
-	"github.com/koding/kite/dnode"
-	"github.com/koding/kite/protocol"
-	"github.com/koding/kite/sockjsclient"
-	_ "github.com/koding/kite/testutil"
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/dnode"
+	"github.com/koding/kite/v2/protocol"
+	"github.com/koding/kite/v2/sockjsclient"
+	_ "github.com/koding/kite/v2/testutil"
 
-	"github.com/igm/sockjs-go/sockjs"
 )
 
 var timeout = flag.Duration("telltime", 4*time.Second, "Timeout for kite calls.")
@@ -74,8 +76,10 @@ func TestContext(t *testing.T) {
 
 	ch <- 1
 
-	if _, err := c.TellWithTimeout("longrunning", *timeout); err != nil {
-		t.Fatalf("TellWithTimeout()=%s", err)
+	// The call has no timeout, so the request context outlives
+	// the response until the client disconnects.
+	if _, err := c.Tell("longrunning"); err != nil {
+		t.Fatalf("Tell()=%s", err)
 	}
 
 	ch <- 3
@@ -187,12 +191,12 @@ func TestSendError(t *testing.T) {
 	<-ksrv.ServerReadyNotify()
 	defer ksrv.Close()
 
-	clientSession := make(chan sockjs.Session, 1)
+	clientSession := make(chan Session, 1)
 
 	kcli := newXhrKite("echo-client", "0.0.1")
 	kcli.Config.DisableAuthentication = true
 	c := kcli.NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", ksrv.Port()))
-	c.testHookSetSession = func(s sockjs.Session) {
+	c.testHookSetSession = func(s Session) {
 		if _, ok := s.(*sockjsclient.XHRSession); ok {
 			clientSession <- s
 		}
@@ -226,6 +230,160 @@ func TestSendError(t *testing.T) {
 	}
 }
 
+func TestBinaryArguments(t *testing.T) {
+	blob := make([]byte, 1024)
+	rand.Read(blob)
+
+	for _, transport := range []config.Transport{config.WebSocket, config.XHRPolling} {
+		ksrv := New("binary-server", "0.0.1")
+		ksrv.Config.DisableAuthentication = true
+		ksrv.Config.Transport = transport
+		ksrv.HandleFunc("reverse", func(r *Request) (interface{}, error) {
+			var p dnode.Raw
+			r.Args.One().MustUnmarshal(&p)
+
+			rev := make(dnode.Raw, len(p))
+			for i := range p {
+				rev[len(p)-1-i] = p[i]
+			}
+
+			return rev, nil
+		})
+
+		go ksrv.Run()
+		<-ksrv.ServerReadyNotify()
+
+		kcli := New("binary-client", "0.0.1")
+		kcli.Config.DisableAuthentication = true
+		kcli.Config.Transport = transport
+		c := kcli.NewClient(fmt.Sprintf("http://127.0.0.1:%d/kite", ksrv.Port()))
+
+		if err := c.Dial(); err != nil {
+			ksrv.Close()
+			t.Fatalf("%s: Dial()=%s", transport, err)
+		}
+
+		result, err := c.TellWithTimeout("reverse", *timeout, dnode.Raw(blob))
+
+		c.Close()
+		ksrv.Close()
+
+		if err != nil {
+			t.Fatalf("%s: TellWithTimeout()=%s", transport, err)
+		}
+
+		var got dnode.Raw
+		result.MustUnmarshal(&got)
+
+		if len(got) != len(blob) || got[0] != blob[len(blob)-1] || got[len(got)-1] != blob[0] {
+			t.Fatalf("%s: got %d bytes, want reversed %d bytes", transport, len(got), len(blob))
+		}
+	}
+}
+
+func TestRequireReady(t *testing.T) {
+	ksrv := New("ready-server", "0.0.1")
+	ksrv.Config.DisableAuthentication = true
+	ksrv.Config.Port = 3638
+	ksrv.HandleFunc("echo", func(r *Request) (interface{}, error) {
+		return r.Args.One().MustString(), nil
+	})
+
+	var (
+		mu       sync.Mutex
+		notReady = errors.New("cache is warming up")
+	)
+
+	ksrv.RequireReady(func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return notReady
+	})
+
+	go ksrv.Run()
+	<-ksrv.ServerReadyNotify()
+	defer ksrv.Close()
+
+	c := New("ready-client", "0.0.1").NewClient("http://127.0.0.1:3638/kite")
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	_, err := c.Tell("echo", "hello")
+	if e, ok := err.(*Error); !ok || e.Type != "notReadyError" {
+		t.Fatalf("got %#v, want notReadyError", err)
+	}
+
+	if _, err := c.Tell("kite.ping"); err != nil {
+		t.Fatalf("Tell(kite.ping)=%s", err)
+	}
+
+	mu.Lock()
+	notReady = nil
+	mu.Unlock()
+
+	if _, err := c.Tell("echo", "hello"); err != nil {
+		t.Fatalf("Tell(echo)=%s", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	ksrv := New("close-server", "0.0.1")
+	ksrv.Config.DisableAuthentication = true
+	ksrv.Config.Port = 3642
+	ksrv.HandleFunc("block", func(r *Request) (interface{}, error) {
+		<-r.Context.Done()
+		return nil, nil
+	})
+
+	go ksrv.Run()
+	<-ksrv.ServerReadyNotify()
+
+	c := New("close-client", "0.0.1").NewClient("http://127.0.0.1:3642/kite")
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Tell("block")
+		done <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Close(); err != nil {
+				t.Errorf("Close()=%s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case err := <-done:
+		if e, ok := err.(*Error); !ok || e.Type != "disconnect" {
+			t.Fatalf("got %#v, want disconnect error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for pending Tell")
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := ksrv.Close(); err != nil {
+			t.Fatalf("%d: Close()=%s", i, err)
+		}
+	}
+
+	var _ io.Closer = c
+	var _ io.Closer = ksrv
+}
+
 // Call a single method with multiple clients. This test is implemented to be
 // sure the method is calling back with in the same time and not timing out.
 func TestConcurrency(t *testing.T) {
@@ -542,3 +700,154 @@ func newXhrKite(name, version string) *Kite {
 	k.Config.Transport = config.XHRPolling
 	return k
 }
+
+func TestPreferLocal(t *testing.T) {
+	k := New("local", "0.0.1")
+	k.Config.Environment = "production"
+	k.Config.Region = "eu"
+	k.Config.PreferEnvironment = true
+	k.Config.PreferRegion = true
+
+	newClients := func(kites ...protocol.Kite) []*Client {
+		var clients []*Client
+		for _, kite := range kites {
+			c := k.NewClient("")
+			c.Kite = kite
+			clients = append(clients, c)
+		}
+		return clients
+	}
+
+	clients := newClients(
+		protocol.Kite{ID: "1", Environment: "production", Region: "us"},
+		protocol.Kite{ID: "2", Environment: "production", Region: "eu"},
+		protocol.Kite{ID: "3", Environment: "staging", Region: "eu"},
+	)
+
+	if got := k.preferLocal(clients); len(got) != 1 || got[0].ID != "2" {
+		t.Fatalf("got %+v, want kite with ID 2", got)
+	}
+
+	clients = newClients(protocol.Kite{ID: "1", Environment: "staging", Region: "us"})
+
+	if got := k.preferLocal(clients); !reflect.DeepEqual(got, clients) {
+		t.Fatalf("got %+v, want %+v", got, clients)
+	}
+}
+
+func TestRedialGiveUp(t *testing.T) {
+	k := New("redial", "0.0.1")
+	k.Config.Transport = config.WebSocket
+	k.Config.Redial = config.Backoff{
+		InitialInterval: 10 * time.Millisecond,
+		MaxInterval:     20 * time.Millisecond,
+		MaxElapsedTime:  200 * time.Millisecond,
+		Jitter:          -1,
+	}
+
+	// nothing listens on the port
+	c := k.NewClient("http://127.0.0.1:3673/kite")
+
+	var mu sync.Mutex
+	var attempts []*ReconnectAttempt
+
+	c.OnReconnectAttempt(func(a *ReconnectAttempt) {
+		mu.Lock()
+		attempts = append(attempts, a)
+		mu.Unlock()
+	})
+
+	connected, err := c.DialForever()
+	if err != nil {
+		t.Fatalf("DialForever()=%s", err)
+	}
+	defer c.Close()
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the client to give up")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(attempts) < 2 {
+		t.Fatalf("got %d attempts, want at least 2", len(attempts))
+	}
+
+	for i, a := range attempts[:len(attempts)-1] {
+		if a.Attempt != i+1 || a.Err == nil || a.GaveUp {
+			t.Errorf("%d: unexpected attempt %+v", i, a)
+		}
+
+		if want := 10 * time.Millisecond; i == 0 && a.Delay != want {
+			t.Errorf("got %s delay, want %s", a.Delay, want)
+		}
+
+		if a.Delay > 20*time.Millisecond {
+			t.Errorf("%d: got %s delay, want at most 20ms", i, a.Delay)
+		}
+	}
+
+	if last := attempts[len(attempts)-1]; !last.GaveUp {
+		t.Fatalf("got %+v, want the last attempt to give up", last)
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	// The listener accepts connections, but never responds, so dials hang.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen()=%s", err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	k := New("dialcontext", "0.0.1")
+	k.Config.Transport = config.WebSocket
+	k.Config.Websocket.HandshakeTimeout = time.Minute
+
+	url := "http://" + l.Addr().String() + "/kite"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	c := k.NewClient(url)
+
+	start := time.Now()
+	if err := c.DialContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %s", err, context.DeadlineExceeded)
+	}
+
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("DialContext() took %s after the deadline", d)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+
+	c = k.NewClient(url)
+	defer c.Close()
+
+	connected, err := c.DialForeverContext(ctx)
+	if err != nil {
+		t.Fatalf("DialForeverContext()=%s", err)
+	}
+
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the dialing to stop")
+	}
+}
@@ -0,0 +1,477 @@
+package command
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	version "github.com/hashicorp/go-version"
+	"github.com/mitchellh/cli"
+)
+
+type Build struct {
+	Ui cli.Ui
+}
+
+func NewBuild() cli.CommandFactory {
+	return func() (cli.Command, error) {
+		return &Build{Ui: DefaultUi}, nil
+	}
+}
+
+func (c *Build) Synopsis() string {
+	return "Builds and packages a kite for installation"
+}
+
+func (c *Build) Help() string {
+	helpText := `
+Usage: kitectl build [options] PACKAGE
+
+  Cross-compiles the kite in the given Go package for each platform and
+  packages the binaries as kite bundles, which "kitectl install" installs.
+  For every platform an archive named <kite>-<version>-<goos>_<goarch>.tar.gz,
+  or .zip for Windows, is written to the output directory.
+
+  The release is added to the .kite.json manifest in the output directory,
+  which is created if it does not exist, and the checksums of the archives
+  are written to the <kite>-<version>-SHA256SUMS file. Publishing the output directory as
+  <repository>/<kite> makes the release installable with -repository.
+
+  The version and the git commit are embedded in the binaries by setting
+  the string variables given by -version-var and -commit-var.
+
+Options:
+
+  -version=1.0.0             Version of the release, required.
+  -name=github.com/koding/fs.kite  Name of the kite, the import path
+                             of the package by default.
+  -platforms=linux_amd64,darwin_amd64  Comma separated GOOS_GOARCH list,
+                             the current platform by default.
+  -output=dist               Output directory.
+  -dependency NAME=CONSTRAINT  Kite the release depends on, like
+                             "github.com/koding/os.kite=>= 1.0, < 2.0",
+                             can be repeated.
+  -version-var=main.version  Variable set to the version.
+  -commit-var=main.commit    Variable set to the git commit.
+  -ldflags=FLAGS             Additional flags of the linker.
+  -sign=key.pem              Sign the archives and the checksums with the RSA
+                             private key, writing <file>.sig signatures. They
+                             can be verified with
+                             "openssl dgst -sha256 -verify public.pem -signature <file>.sig <file>".
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *Build) Run(args []string) int {
+	var deps envFlag
+	var b builder
+	var platforms, signKey string
+
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	flags.StringVar(&b.version, "version", "", "version of the release")
+	flags.StringVar(&b.name, "name", "", "name of the kite")
+	flags.StringVar(&platforms, "platforms", runtime.GOOS+"_"+runtime.GOARCH, "comma separated GOOS_GOARCH list")
+	flags.StringVar(&b.output, "output", "dist", "output directory")
+	flags.Var(&deps, "dependency", "kite the release depends on, as NAME=CONSTRAINT")
+	flags.StringVar(&b.versionVar, "version-var", "main.version", "variable set to the version")
+	flags.StringVar(&b.commitVar, "commit-var", "main.commit", "variable set to the git commit")
+	flags.StringVar(&b.ldflags, "ldflags", "", "additional flags of the linker")
+	flags.StringVar(&signKey, "sign", "", "RSA private key signing the archives")
+	flags.Parse(args)
+
+	args = flags.Args()
+
+	if len(args) != 1 {
+		c.Ui.Error("You should give a package. Example: kitectl build -version=1.0.0 ./cmd/fs")
+		return 1
+	}
+
+	b.ui, b.pkg = c.Ui, args[0]
+
+	if _, err := version.NewVersion(b.version); err != nil {
+		c.Ui.Error(fmt.Sprintf("invalid version %q: %s", b.version, err))
+		return 1
+	}
+
+	for _, p := range strings.Split(platforms, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+
+		if strings.Count(p, "_") != 1 {
+			c.Ui.Error(fmt.Sprintf("invalid platform %q, want GOOS_GOARCH", p))
+			return 1
+		}
+
+		b.platforms = append(b.platforms, p)
+	}
+
+	b.deps = make(map[string]string, len(deps))
+
+	for _, dep := range deps {
+		i := strings.IndexByte(dep, '=')
+		if i <= 0 {
+			c.Ui.Error(fmt.Sprintf("invalid dependency %q, want NAME=CONSTRAINT", dep))
+			return 1
+		}
+
+		if _, err := version.NewConstraint(dep[i+1:]); err != nil {
+			c.Ui.Error(fmt.Sprintf("invalid constraint of %s dependency: %s", dep[:i], err))
+			return 1
+		}
+
+		b.deps[dep[:i]] = dep[i+1:]
+	}
+
+	if signKey != "" {
+		p, err := ioutil.ReadFile(signKey)
+		if err != nil {
+			c.Ui.Error(err.Error())
+			return 1
+		}
+
+		if b.key, err = jwt.ParseRSAPrivateKeyFromPEM(p); err != nil {
+			c.Ui.Error(fmt.Sprintf("%s: %s", signKey, err))
+			return 1
+		}
+	}
+
+	if err := b.build(); err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+// builder builds a release of a kite.
+type builder struct {
+	ui         cli.Ui
+	pkg        string
+	name       string
+	version    string
+	platforms  []string // GOOS_GOARCH
+	output     string
+	deps       map[string]string
+	versionVar string
+	commitVar  string
+	ldflags    string
+	key        *rsa.PrivateKey // nil if the archives are not signed
+
+	commit string
+}
+
+func (b *builder) build() error {
+	out, err := goCommand(nil, "list", "-f", "{{.Name}} {{.ImportPath}}", b.pkg)
+	if err != nil {
+		return err
+	}
+
+	if fields := strings.Fields(out); len(fields) != 2 || fields[0] != "main" {
+		return fmt.Errorf("%s is not a main package", b.pkg)
+	} else if b.name == "" {
+		b.name = fields[1]
+	}
+
+	b.commit = gitCommit(b.pkg)
+
+	if err := os.MkdirAll(b.output, 0755); err != nil {
+		return err
+	}
+
+	release := &Release{
+		Version:      b.version,
+		Platforms:    make(map[string]*Binary, len(b.platforms)),
+		Dependencies: b.deps,
+	}
+
+	for _, platform := range b.platforms {
+		b.ui.Output(fmt.Sprintf("Building %s %s for %s...", b.name, b.version, platform))
+
+		archive, sum, err := b.buildPlatform(platform)
+		if err != nil {
+			return fmt.Errorf("%s: %s", platform, err)
+		}
+
+		release.Platforms[platform] = &Binary{URL: archive, SHA256: sum}
+	}
+
+	if err := b.writeChecksums(release); err != nil {
+		return err
+	}
+
+	if err := b.writeManifest(release); err != nil {
+		return err
+	}
+
+	b.ui.Output(fmt.Sprintf("Built %s %s into %s", b.name, b.version, b.output))
+
+	return nil
+}
+
+// binaryName gives the name of the kite binary, which is the last element
+// of the kite name without the .kite suffix, as expected by the installer.
+func (b *builder) binaryName() string {
+	return strings.TrimSuffix(path.Base(b.name), ".kite")
+}
+
+// buildPlatform builds and packages the kite for the platform. It gives
+// the file name of the archive and its checksum.
+func (b *builder) buildPlatform(platform string) (string, string, error) {
+	goos := platform[:strings.IndexByte(platform, '_')]
+	goarch := platform[strings.IndexByte(platform, '_')+1:]
+
+	dir, err := ioutil.TempDir("", "kitectl-build")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.RemoveAll(dir)
+
+	bin := b.binaryName()
+	if goos == "windows" {
+		bin += ".exe"
+	}
+
+	ldflags := fmt.Sprintf("-X %s=%s", b.versionVar, b.version)
+	if b.commit != "" {
+		ldflags += fmt.Sprintf(" -X %s=%s", b.commitVar, b.commit)
+	}
+	if b.ldflags != "" {
+		ldflags += " " + b.ldflags
+	}
+
+	binPath := filepath.Join(dir, bin)
+	env := []string{"GOOS=" + goos, "GOARCH=" + goarch, "CGO_ENABLED=0"}
+
+	if _, err := goCommand(env, "build", "-ldflags", ldflags, "-o", binPath, b.pkg); err != nil {
+		return "", "", err
+	}
+
+	p, err := ioutil.ReadFile(binPath)
+	if err != nil {
+		return "", "", err
+	}
+
+	// The bundle layout is <kite>-<version>.kite/bin/<kite>.
+	bundle := fmt.Sprintf("%s-%s.kite", b.binaryName(), b.version)
+	archive := fmt.Sprintf("%s-%s-%s", b.binaryName(), b.version, platform)
+
+	var buf bytes.Buffer
+
+	if goos == "windows" {
+		archive += ".zip"
+		err = writeZip(&buf, bundle, bin, p)
+	} else {
+		archive += ".tar.gz"
+		err = writeTarGz(&buf, bundle, bin, p)
+	}
+
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := b.writeFile(archive, buf.Bytes()); err != nil {
+		return "", "", err
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+
+	return archive, hex.EncodeToString(sum[:]), nil
+}
+
+// writeFile writes the file into the output directory, signing it
+// if a key is given.
+func (b *builder) writeFile(name string, p []byte) error {
+	if err := ioutil.WriteFile(filepath.Join(b.output, name), p, 0644); err != nil {
+		return err
+	}
+
+	if b.key == nil {
+		return nil
+	}
+
+	sum := sha256.Sum256(p)
+
+	sig, err := rsa.SignPKCS1v15(rand.Reader, b.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(b.output, name+".sig"), sig, 0644)
+}
+
+// writeChecksums writes the checksums of the archives of the release,
+// in the format of the sha256sum tool.
+func (b *builder) writeChecksums(release *Release) error {
+	var lines []string
+
+	for _, bin := range release.Platforms {
+		lines = append(lines, bin.SHA256+"  "+bin.URL)
+	}
+
+	sort.Strings(lines)
+
+	name := fmt.Sprintf("%s-%s-SHA256SUMS", b.binaryName(), b.version)
+
+	return b.writeFile(name, []byte(strings.Join(lines, "\n")+"\n"))
+}
+
+// writeManifest adds the release to the manifest in the output directory,
+// replacing the release of the same version.
+func (b *builder) writeManifest(release *Release) error {
+	file := filepath.Join(b.output, manifestFileName)
+
+	m := &Manifest{
+		ManifestVersion: 2,
+		Name:            b.name,
+	}
+
+	// The manifest is not read with parseManifest, which makes the URLs
+	// of the binaries absolute.
+	switch p, err := ioutil.ReadFile(file); {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(p, m); err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+
+		if m.ManifestVersion != 2 {
+			return fmt.Errorf("%s: unsupported manifest version %d", file, m.ManifestVersion)
+		}
+
+		if m.Name != b.name {
+			return fmt.Errorf("%s: manifest of %s, not %s", file, m.Name, b.name)
+		}
+	}
+
+	releases := m.Releases[:0]
+	for _, r := range m.Releases {
+		if r.Version != release.Version {
+			releases = append(releases, r)
+		}
+	}
+	m.Releases = append(releases, release)
+
+	p, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, append(p, '\n'), 0644)
+}
+
+func writeTarGz(w io.Writer, bundle, bin string, p []byte) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+
+	// The installer creates the directories from their entries.
+	for _, dir := range []string{bundle + "/", bundle + "/bin/"} {
+		err := tw.WriteHeader(&tar.Header{
+			Name:     dir,
+			Mode:     0755,
+			Typeflag: tar.TypeDir,
+			ModTime:  now,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err := tw.WriteHeader(&tar.Header{
+		Name:     bundle + "/bin/" + bin,
+		Mode:     0755,
+		Size:     int64(len(p)),
+		Typeflag: tar.TypeReg,
+		ModTime:  now,
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := tw.Write(p); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+func writeZip(w io.Writer, bundle, bin string, p []byte) error {
+	zw := zip.NewWriter(w)
+
+	hdr := &zip.FileHeader{
+		Name:   bundle + "/bin/" + bin,
+		Method: zip.Deflate,
+	}
+	hdr.SetModTime(time.Now())
+	hdr.SetMode(0755)
+
+	f, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(p); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// goCommand runs the go tool with the additional environment.
+func goCommand(env []string, args ...string) (string, error) {
+	cmd := exec.Command("go", args...)
+	cmd.Env = append(os.Environ(), env...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("go %s: %s: %s", args[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	return string(out), nil
+}
+
+// gitCommit gives the git commit of the package directory, or empty
+// string if it's not in a git repository.
+func gitCommit(pkg string) string {
+	dir, err := goCommand(nil, "list", "-f", "{{.Dir}}", pkg)
+	if err != nil {
+		return ""
+	}
+
+	out, err := exec.Command("git", "-C", strings.TrimSpace(dir), "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(out))
+}
@@ -3,7 +3,7 @@ package command
 import (
 	"os"
 
-	"github.com/koding/kite"
+	"github.com/koding/kite/v2"
 	"github.com/mitchellh/cli"
 )
 
@@ -0,0 +1,392 @@
+package command
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/protocol"
+	"github.com/mitchellh/cli"
+)
+
+var deployUnitTemplate = template.Must(template.New("unit").Funcs(template.FuncMap{
+	"quote": strconv.Quote,
+}).Parse(`[Unit]
+Description=Kite {{.Kite}}
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+ExecStart={{quote .Path}}
+Restart={{.Restart}}
+RestartSec=5
+Environment={{quote (print "KITE_HOME=" .KiteHome)}}
+{{- range .Env}}
+Environment={{quote .}}
+{{- end}}
+
+[Install]
+WantedBy={{if .System}}multi-user.target{{else}}default.target{{end}}
+`))
+
+type Deploy struct {
+	KiteClient *kite.Kite
+	Ui         cli.Ui
+}
+
+func NewDeploy() cli.CommandFactory {
+	return func() (cli.Command, error) {
+		return &Deploy{
+			KiteClient: DefaultKiteClient,
+			Ui:         DefaultUi,
+		}, nil
+	}
+}
+
+func (c *Deploy) Synopsis() string {
+	return "Deploys a kite to a remote host over SSH"
+}
+
+func (c *Deploy) Help() string {
+	helpText := `
+Usage: kitectl deploy [options] PACKAGE [USER@]HOST[:PORT]
+
+  Deploys the kite built from the given Go package to a remote Linux host
+  with systemd. The kite is cross-compiled for the host, uploaded over SSH
+  and run by a systemd service, which is replaced on subsequent deploys.
+  The host is registered to kontrol with "registerMachine", its kite.key
+  is written to ~/.kite/kite.key of the remote user. The deploy succeeds
+  once the kite registers to kontrol.
+
+  Services deployed as root are system-wide, others are "systemctl --user"
+  units of the remote user.
+
+Options:
+
+  -name=NAME                  Name the kite registers with, used to verify
+                              the registration. The package name by default.
+  -goarch=amd64               Architecture of the host, detected by default.
+  -to=https://discovery.koding.io/kite  Kontrol URL
+  -username=koding            Username
+  -identity=~/.ssh/id_rsa     Private key used for SSH authentication, besides
+                              the keys of the SSH agent.
+  -known-hosts=~/.ssh/known_hosts  Known hosts file used to verify the host.
+  -insecure                   Do not verify the host key.
+  -env KEY=VALUE              Environment variable of the kite, can be repeated
+  -restart=always             Restart policy of the service: always, on-failure or no
+  -timeout=2m                 Time to wait for the kite to register.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *Deploy) Run(args []string) int {
+	var env envFlag
+	var insecure bool
+	var timeout time.Duration
+	var name, goarch, kontrolURL, username, identity, knownHosts, restart string
+
+	flags := flag.NewFlagSet("deploy", flag.ExitOnError)
+	flags.StringVar(&name, "name", "", "name of the kite")
+	flags.StringVar(&goarch, "goarch", "", "architecture of the host")
+	flags.StringVar(&kontrolURL, "to", defaultKontrolURL, "Kontrol URL")
+	flags.StringVar(&username, "username", "", "Username")
+	flags.StringVar(&identity, "identity", "", "private key used for SSH authentication")
+	flags.StringVar(&knownHosts, "known-hosts", "", "known hosts file")
+	flags.BoolVar(&insecure, "insecure", false, "do not verify the host key")
+	flags.Var(&env, "env", "environment variable of the kite")
+	flags.StringVar(&restart, "restart", "always", "restart policy of the service")
+	flags.DurationVar(&timeout, "timeout", 2*time.Minute, "time to wait for the kite to register")
+	flags.Parse(args)
+
+	args = flags.Args()
+
+	if len(args) != 2 {
+		c.Ui.Error("You should give a package and a host. Example: kitectl deploy ./cmd/math root@example.com")
+		return 1
+	}
+
+	pkg, target := args[0], args[1]
+
+	if name == "" {
+		name = path.Base(filepath.ToSlash(pkg))
+	}
+
+	cfg := &serviceConfig{
+		Kite:    name,
+		Env:     env,
+		Restart: restart,
+	}
+
+	if err := cfg.validate(); err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	if username == "" {
+		var err error
+		if username, err = c.Ui.Ask("Username:"); err != nil {
+			c.Ui.Error(err.Error())
+			return 1
+		}
+
+		if username == "" {
+			c.Ui.Error("Username can not be empty.")
+			return 1
+		}
+	}
+
+	d := &deployer{
+		ui:         c.Ui,
+		kite:       c.KiteClient,
+		kontrolURL: kontrolURL,
+		username:   username,
+		cfg:        cfg,
+	}
+
+	c.Ui.Info(fmt.Sprintf("Connecting to %s", target))
+
+	host, err := dialHost(target, &sshOptions{
+		Identity:   identity,
+		KnownHosts: knownHosts,
+		Insecure:   insecure,
+	})
+	if err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+	defer host.Close()
+
+	if err := d.deploy(host, pkg, goarch, timeout); err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+// deployer deploys a single kite.
+type deployer struct {
+	ui         cli.Ui
+	kite       *kite.Kite
+	kontrolURL string
+	username   string
+	cfg        *serviceConfig
+}
+
+func (d *deployer) deploy(host *remoteHost, pkg, goarch string, timeout time.Duration) error {
+	info, err := host.info()
+	if err != nil {
+		return err
+	}
+
+	if info.OS != "linux" {
+		return fmt.Errorf("%s: unsupported operating system %q, only Linux hosts with systemd are supported", host, info.OS)
+	}
+
+	if goarch == "" {
+		if goarch = info.Arch; goarch == "" {
+			return fmt.Errorf("%s: unknown architecture, set it with -goarch", host)
+		}
+	}
+
+	d.cfg.KiteHome = path.Join(info.Home, ".kite")
+	binPath := path.Join(d.cfg.KiteHome, "bin", fileName(d.cfg.Kite))
+
+	d.ui.Info(fmt.Sprintf("Building %s for linux/%s", pkg, goarch))
+
+	bin, err := crossCompile(pkg, "linux", goarch)
+	if err != nil {
+		return err
+	}
+
+	d.ui.Info("Registering the host to " + d.kontrolURL)
+
+	key, err := d.registerMachine()
+	if err != nil {
+		return err
+	}
+
+	query := &protocol.KontrolQuery{
+		Username: d.username,
+		Name:     d.cfg.Kite,
+		Hostname: info.Hostname,
+	}
+
+	querier := d.newQuerier(key)
+	defer querier.Close()
+
+	// The kites running before the deploy do not verify it.
+	previous, err := kiteIDs(querier, query)
+	if err != nil {
+		return err
+	}
+
+	d.ui.Info(fmt.Sprintf("Uploading the kite to %s:%s", host, binPath))
+
+	if err := host.upload(path.Join(d.cfg.KiteHome, "kite.key"), 0600, []byte(key)); err != nil {
+		return fmt.Errorf("uploading kite.key: %s", err)
+	}
+
+	if err := host.upload(binPath, 0755, bin); err != nil {
+		return fmt.Errorf("uploading the kite: %s", err)
+	}
+
+	d.ui.Info("Installing the service " + serviceName(d.cfg.Kite))
+
+	if err := d.installService(host, info, binPath); err != nil {
+		return err
+	}
+
+	d.ui.Info("Waiting for the kite to register to kontrol")
+
+	id, err := waitKite(querier, query, previous, timeout)
+	if err != nil {
+		return err
+	}
+
+	d.ui.Info(fmt.Sprintf("Deployed successfully, the kite is registered with ID %s", id))
+
+	return nil
+}
+
+// registerMachine gives a kite.key for the remote host.
+func (d *deployer) registerMachine() (string, error) {
+	k := kite.New(d.kite.Kite().Name, d.kite.Kite().Version)
+	k.Config = d.kite.Config.Copy()
+	k.Config.Username = d.username
+
+	kontrol := k.NewClient(d.kontrolURL)
+	if err := kontrol.Dial(); err != nil {
+		return "", err
+	}
+	defer kontrol.Close()
+
+	result, err := kontrol.TellWithTimeout("registerMachine", 5*time.Minute, map[string]interface{}{})
+	if err != nil {
+		return "", err
+	}
+
+	return result.String()
+}
+
+// newQuerier gives a kite authenticated with the key of the remote host,
+// which queries kontrol for the deployed kite.
+func (d *deployer) newQuerier(key string) *kite.Kite {
+	k := kite.New(d.kite.Kite().Name, d.kite.Kite().Version)
+	k.Config = d.kite.Config.Copy()
+	k.Config.Username = d.username
+	k.Config.KontrolURL = d.kontrolURL
+	k.Config.KiteKey = key
+
+	return k
+}
+
+func (d *deployer) installService(host *remoteHost, info *hostInfo, binPath string) error {
+	system := info.UID == "0"
+	name := serviceName(d.cfg.Kite) + ".service"
+
+	unitPath := path.Join(info.Home, ".config", "systemd", "user", name)
+	if system {
+		unitPath = path.Join("/etc/systemd/system", name)
+	}
+
+	var buf bytes.Buffer
+
+	err := deployUnitTemplate.Execute(&buf, struct {
+		*serviceConfig
+		Path   string
+		System bool
+	}{d.cfg, binPath, system})
+	if err != nil {
+		return err
+	}
+
+	if err := host.upload(unitPath, 0644, buf.Bytes()); err != nil {
+		return fmt.Errorf("uploading the unit: %s", err)
+	}
+
+	systemctl := "systemctl"
+	if !system {
+		systemctl = "systemctl --user"
+
+		// Keep user services running without a login session.
+		if _, err := host.run("loginctl enable-linger", nil); err != nil {
+			d.ui.Warn(fmt.Sprintf("Cannot enable lingering, the kite may stop on logout: %s", err))
+		}
+	}
+
+	_, err = host.run(fmt.Sprintf("%[1]s daemon-reload && %[1]s enable %[2]s && %[1]s restart %[2]s",
+		systemctl, shellQuote(name)), nil)
+	return err
+}
+
+// crossCompile cross-compiles the kite.
+func crossCompile(pkg, goos, goarch string) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "kitectl-deploy")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "kite")
+	env := []string{"GOOS=" + goos, "GOARCH=" + goarch, "CGO_ENABLED=0"}
+
+	if _, err := goCommand(env, "build", "-o", out, pkg); err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadFile(out)
+}
+
+// kiteIDs gives the IDs of the kites matching the query.
+func kiteIDs(k *kite.Kite, query *protocol.KontrolQuery) (map[string]struct{}, error) {
+	clients, err := k.GetKites(query)
+	if err == kite.ErrNoKitesAvailable {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]struct{}, len(clients))
+	for _, c := range clients {
+		ids[c.Kite.ID] = struct{}{}
+	}
+
+	return ids, nil
+}
+
+// waitKite waits for a kite matching the query, which is not one
+// of the previous kites, and gives its ID.
+func waitKite(k *kite.Kite, query *protocol.KontrolQuery, previous map[string]struct{}, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		ids, err := kiteIDs(k, query)
+		if err != nil {
+			return "", err
+		}
+
+		for id := range ids {
+			if _, ok := previous[id]; !ok {
+				return id, nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return "", errors.New("timed out waiting for the kite to register, check the service logs on the host")
+		}
+
+		time.Sleep(2 * time.Second)
+	}
+}
@@ -0,0 +1,499 @@
+package command
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/kitekey"
+	"github.com/koding/kite/v2/protocol"
+	"github.com/mitchellh/cli"
+)
+
+// containerKiteHome is the KITE_HOME of kites run in containers, see
+// the Dockerfile written by "kitectl new".
+const containerKiteHome = "/etc/kite"
+
+type DockerRun struct {
+	KiteClient *kite.Kite
+	Ui         cli.Ui
+}
+
+func NewDockerRun() cli.CommandFactory {
+	return func() (cli.Command, error) {
+		return &DockerRun{
+			KiteClient: DefaultKiteClient,
+			Ui:         DefaultUi,
+		}, nil
+	}
+}
+
+func (c *DockerRun) Synopsis() string {
+	return "Runs a kite in a Docker container"
+}
+
+func (c *DockerRun) Help() string {
+	helpText := `
+Usage: kitectl docker-run [options] DIR|IMAGE
+
+  Runs a kite in a Docker container, which registers to kontrol with the
+  kite.key of the current user. If a directory with a Dockerfile is given,
+  like the one created by "kitectl new", the image is built from it first.
+
+  The port of the kite, exposed by the image, is published on the Docker
+  host and the kite registers with the address of the host and the published
+  port, given in the KITE_REGISTER_URL environment variable. An existing
+  container of the kite is replaced. The command succeeds once the kite
+  registers to kontrol.
+
+Options:
+
+  -name=NAME         Name the kite registers with, used to verify the
+                     registration. The directory or image name by default.
+  -image=NAME        Tag of the built image, the kite name by default.
+  -container=NAME    Name of the container, "kite-" and the kite name by default.
+  -port=6000         Port the kite listens on in the container, detected from
+                     the ports exposed by the image by default.
+  -publish=PORT      Port published on the Docker host, the same as the kite
+                     port if it's free, a free one otherwise.
+  -host=IP           Address of the Docker host the kite registers with,
+                     detected from DOCKER_HOST or the local interfaces.
+  -network=NAME      Network of the container. With "host" the port is not
+                     published and the kite registers with its own port.
+  -key=secret        How the kite.key is given to the kite: "secret" mounts it
+                     read-only in /etc/kite, "env" sets the KITE_KEY variable.
+  -env KEY=VALUE     Environment variable of the kite, can be repeated
+  -restart=unless-stopped  Restart policy of the container
+  -timeout=2m        Time to wait for the kite to register.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *DockerRun) Run(args []string) int {
+	var env envFlag
+	var r dockerRunner
+
+	flags := flag.NewFlagSet("docker-run", flag.ExitOnError)
+	flags.StringVar(&r.name, "name", "", "name of the kite")
+	flags.StringVar(&r.image, "image", "", "tag of the built image")
+	flags.StringVar(&r.container, "container", "", "name of the container")
+	flags.IntVar(&r.port, "port", 0, "port of the kite in the container")
+	flags.IntVar(&r.publish, "publish", 0, "port published on the Docker host")
+	flags.StringVar(&r.host, "host", "", "address of the Docker host")
+	flags.StringVar(&r.network, "network", "", "network of the container")
+	flags.StringVar(&r.keyMode, "key", "secret", "how the kite.key is given to the kite")
+	flags.Var(&env, "env", "environment variable of the kite")
+	flags.StringVar(&r.restart, "restart", "unless-stopped", "restart policy of the container")
+	flags.DurationVar(&r.timeout, "timeout", 2*time.Minute, "time to wait for the kite to register")
+	flags.Parse(args)
+
+	args = flags.Args()
+
+	if len(args) != 1 {
+		c.Ui.Error("You should give a directory or an image. Example: kitectl docker-run ./math")
+		return 1
+	}
+
+	if r.keyMode != "secret" && r.keyMode != "env" {
+		c.Ui.Error(fmt.Sprintf("invalid -key %q, it must be secret or env", r.keyMode))
+		return 1
+	}
+
+	for _, kv := range env {
+		if !strings.Contains(kv, "=") {
+			c.Ui.Error(fmt.Sprintf("invalid -env %q, it must be KEY=VALUE", kv))
+			return 1
+		}
+	}
+
+	cfg, err := config.Get()
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Cannot read kite.key, register with \"kitectl register\" first: %s", err))
+		return 1
+	}
+
+	r.ui = c.Ui
+	r.kite = c.KiteClient
+	r.kite.Config = cfg
+	r.env = env
+
+	if err := r.run(args[0]); err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+// dockerRunner runs a single kite in a container.
+type dockerRunner struct {
+	ui   cli.Ui
+	kite *kite.Kite
+
+	name      string
+	image     string
+	container string
+	port      int
+	publish   int
+	host      string
+	network   string
+	keyMode   string
+	env       []string
+	restart   string
+	timeout   time.Duration
+}
+
+func (r *dockerRunner) run(source string) error {
+	if fi, err := os.Stat(filepath.Join(source, "Dockerfile")); err == nil && !fi.IsDir() {
+		if err := r.buildImage(source); err != nil {
+			return err
+		}
+	} else {
+		if r.name == "" {
+			r.name = imageName(source)
+		}
+
+		r.image = source
+	}
+
+	if r.container == "" {
+		r.container = "kite-" + r.name
+	}
+
+	if r.port == 0 {
+		port, err := exposedPort(r.image)
+		if err != nil {
+			return err
+		}
+
+		r.port = port
+	}
+
+	registerURL, err := r.registerURL()
+	if err != nil {
+		return err
+	}
+
+	query := &protocol.KontrolQuery{
+		Username: r.kite.Config.Username,
+		Name:     r.name,
+	}
+
+	// The kites running before, like the one in the replaced
+	// container, do not verify the registration.
+	previous, err := kiteIDs(r.kite, query)
+	if err != nil {
+		return err
+	}
+
+	// The replaced container may not exist.
+	dockerCommand(nil, "rm", "-f", r.container)
+
+	r.ui.Info(fmt.Sprintf("Starting the container %s, the kite registers with %s", r.container, registerURL))
+
+	if err := r.start(registerURL); err != nil {
+		return err
+	}
+
+	if err := r.verifyPort(); err != nil {
+		return err
+	}
+
+	r.ui.Info(fmt.Sprintf("Waiting for the kite to register to kontrol, see \"docker logs %s\" for its logs", r.container))
+
+	id, err := waitKite(r.kite, query, previous, r.timeout)
+	if err != nil {
+		return err
+	}
+
+	r.ui.Info(fmt.Sprintf("The kite is running in the container %s and registered with ID %s", r.container, id))
+
+	return nil
+}
+
+// buildImage builds the image of the kite from the directory.
+func (r *dockerRunner) buildImage(dir string) error {
+	if r.name == "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+
+		r.name = filepath.Base(abs)
+	}
+
+	if r.image == "" {
+		r.image = r.name
+	}
+
+	r.ui.Info(fmt.Sprintf("Building the image %s from %s", r.image, dir))
+
+	_, err := dockerCommand(nil, "build", "-q", "-t", r.image, dir)
+	return err
+}
+
+// registerURL gives the URL the kite registers with and chooses the port
+// published on the Docker host.
+func (r *dockerRunner) registerURL() (string, error) {
+	host := r.host
+
+	if host == "" {
+		var err error
+		if host, err = dockerHostIP(); err != nil {
+			return "", fmt.Errorf("cannot detect the address of the Docker host, set it with -host: %s", err)
+		}
+	}
+
+	port := r.port
+
+	if r.network != "host" {
+		if r.publish == 0 {
+			var err error
+			if r.publish, err = freePort(r.port); err != nil {
+				return "", err
+			}
+		}
+
+		port = r.publish
+	}
+
+	u := &url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(host, strconv.Itoa(port)),
+		Path:   "/kite",
+	}
+
+	return u.String(), nil
+}
+
+func (r *dockerRunner) start(registerURL string) error {
+	args := []string{
+		"run", "-d",
+		"--name", r.container,
+		"--restart", r.restart,
+		"-e", "KITE_PORT=" + strconv.Itoa(r.port),
+		"-e", "KITE_REGISTER_URL=" + registerURL,
+	}
+
+	if r.network != "" {
+		args = append(args, "--network", r.network)
+	}
+
+	if r.network != "host" {
+		args = append(args, "-p", fmt.Sprintf("%d:%d", r.publish, r.port))
+	}
+
+	var cmdEnv []string
+
+	key, err := kitekey.Read()
+	if err != nil {
+		return err
+	}
+
+	switch r.keyMode {
+	case "secret":
+		dir, err := r.writeKey(key)
+		if err != nil {
+			return err
+		}
+
+		args = append(args,
+			"-v", dir+":"+containerKiteHome+":ro",
+			"-e", "KITE_HOME="+containerKiteHome,
+		)
+	case "env":
+		// The value is passed in the environment of the docker command,
+		// not in its arguments.
+		args = append(args, "-e", "KITE_KEY")
+		cmdEnv = append(cmdEnv, "KITE_KEY="+key)
+	}
+
+	for _, kv := range r.env {
+		args = append(args, "-e", kv)
+	}
+
+	args = append(args, r.image)
+
+	_, err = dockerCommand(cmdEnv, args...)
+	return err
+}
+
+// writeKey writes the kite.key to the directory mounted in the container
+// and gives its path.
+func (r *dockerRunner) writeKey(key string) (string, error) {
+	home, err := kitekey.KiteHome()
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(home, "docker", r.container)
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "kite.key"), []byte(key), 0600); err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
+// verifyPort ensures the kite port is published on the chosen host port.
+func (r *dockerRunner) verifyPort() error {
+	if r.network == "host" {
+		return nil
+	}
+
+	out, err := dockerCommand(nil, "port", r.container, fmt.Sprintf("%d/tcp", r.port))
+	if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		_, port, err := net.SplitHostPort(strings.TrimSpace(line))
+		if err == nil && port == strconv.Itoa(r.publish) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("port %d of the container is published on %q, not on port %d", r.port, out, r.publish)
+}
+
+// exposedPort gives the single TCP port exposed by the image.
+func exposedPort(image string) (int, error) {
+	out, err := dockerCommand(nil, "image", "inspect", "-f", "{{json .Config.ExposedPorts}}", image)
+	if err != nil {
+		return 0, err
+	}
+
+	var exposed map[string]struct{}
+
+	if err := json.Unmarshal([]byte(out), &exposed); err != nil {
+		return 0, fmt.Errorf("reading ports of %s: %s", image, err)
+	}
+
+	var ports []int
+
+	for p := range exposed {
+		if !strings.HasSuffix(p, "/tcp") {
+			continue
+		}
+
+		port, err := strconv.Atoi(strings.TrimSuffix(p, "/tcp"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid port %q of %s", p, image)
+		}
+
+		ports = append(ports, port)
+	}
+
+	if len(ports) != 1 {
+		return 0, fmt.Errorf("%s exposes %d TCP ports, set the port of the kite with -port", image, len(ports))
+	}
+
+	return ports[0], nil
+}
+
+// dockerHostIP gives the address of the Docker host, which is the host
+// of DOCKER_HOST for remote daemons and a local IP otherwise.
+func dockerHostIP() (string, error) {
+	if dockerHost := os.Getenv("DOCKER_HOST"); dockerHost != "" {
+		u, err := url.Parse(dockerHost)
+		if err != nil {
+			return "", err
+		}
+
+		if u.Scheme == "tcp" || u.Scheme == "ssh" {
+			return u.Hostname(), nil
+		}
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+
+	for _, iface := range ifaces {
+		// The addresses of the loopback and the Docker bridges are not
+		// reachable from other hosts.
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 ||
+			strings.HasPrefix(iface.Name, "docker") || strings.HasPrefix(iface.Name, "br-") ||
+			strings.HasPrefix(iface.Name, "veth") {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return "", err
+		}
+
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				return ipnet.IP.To4().String(), nil
+			}
+		}
+	}
+
+	return "", errors.New("no local IPv4 address")
+}
+
+// freePort gives the port if it's free on the local host, a free one
+// otherwise.
+func freePort(port int) (int, error) {
+	l, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		if l, err = net.Listen("tcp", ":0"); err != nil {
+			return 0, err
+		}
+	}
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// imageName gives the name of the image reference without the registry,
+// repository path and tag, e.g. "math" for "example.com/kites/math:1.0".
+func imageName(image string) string {
+	if i := strings.IndexByte(image, '@'); i != -1 {
+		image = image[:i]
+	}
+
+	name := path.Base(image)
+
+	if i := strings.IndexByte(name, ':'); i != -1 {
+		name = name[:i]
+	}
+
+	return name
+}
+
+// dockerCommand runs the docker command with the additional environment.
+func dockerCommand(env []string, args ...string) (string, error) {
+	cmd := exec.Command("docker", args...)
+	cmd.Env = append(os.Environ(), env...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("docker %s: %s: %s", args[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	return string(out), nil
+}
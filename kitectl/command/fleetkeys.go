@@ -0,0 +1,344 @@
+package command
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/protocol"
+	"github.com/mitchellh/cli"
+)
+
+// issueKeysBatch is the number of keys requested from kontrol at once.
+const issueKeysBatch = 500
+
+// hostIDRx matches host IDs, which are valid Kubernetes object names.
+var hostIDRx = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
+var secretTemplate = template.Must(template.New("secret").Funcs(template.FuncMap{
+	"quote": strconv.Quote,
+}).Parse(`---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: {{quote .Name}}
+{{- if .Namespace}}
+  namespace: {{quote .Namespace}}
+{{- end}}
+  labels:
+    app.kubernetes.io/managed-by: kitectl
+  annotations:
+    kite.koding.com/username: {{quote .Username}}
+    kite.koding.com/host: {{quote .Host}}
+type: Opaque
+data:
+  kite.key: {{.Data}}
+`))
+
+type FleetKeys struct {
+	KiteClient *kite.Kite
+	Ui         cli.Ui
+}
+
+func NewFleetKeys() cli.CommandFactory {
+	return func() (cli.Command, error) {
+		return &FleetKeys{
+			KiteClient: DefaultKiteClient,
+			Ui:         DefaultUi,
+		}, nil
+	}
+}
+
+func (c *FleetKeys) Synopsis() string {
+	return "Issues kite.key files for a fleet of hosts"
+}
+
+func (c *FleetKeys) Help() string {
+	helpText := `
+Usage: kitectl fleet-keys [options] FILE
+
+  Issues kite.key files for the hosts listed in FILE, or the standard input
+  if FILE is "-", with the "issueKeys" kontrol method. It's authorized with
+  the kite.key of the current user, who must be an admin of kontrol.
+
+  Each line of FILE is "USERNAME [HOST]", the host ID defaults to the
+  username. Empty lines and lines starting with "#" are skipped. Host IDs
+  must be lowercase letters, digits, dashes and dots.
+
+  With -format=files, the keys are written to OUTPUT/HOST/kite.key. With
+  -format=kubernetes, a manifest of secrets, one for each host, is written
+  to OUTPUT or the standard output, for example to pipe to "kubectl apply -f -".
+
+Options:
+
+  -to=URL                    Kontrol URL, the one of the kite.key by default.
+  -format=files              Output format: files or kubernetes.
+  -output=PATH               Output directory for files, "kite-keys" by default,
+                             or manifest file for kubernetes.
+  -environment=NAME          Environment whose key pair signs the keys.
+  -tenant=NAME               Tenant whose key pair signs the keys.
+  -namespace=NAME            Namespace of the secrets.
+  -secret-name=TEMPLATE      Name of the secrets, "kite-key-{{.Host}}" by default.
+                             The template is given the Username and the Host.
+`
+	return strings.TrimSpace(helpText)
+}
+
+// fleetHost is a host to issue a kite.key for.
+type fleetHost struct {
+	Username string
+	Host     string
+}
+
+func (c *FleetKeys) Run(args []string) int {
+	var kontrolURL, format, output, environment, tenant, namespace, secretName string
+
+	flags := flag.NewFlagSet("fleet-keys", flag.ExitOnError)
+	flags.StringVar(&kontrolURL, "to", "", "Kontrol URL")
+	flags.StringVar(&format, "format", "files", "output format")
+	flags.StringVar(&output, "output", "", "output path")
+	flags.StringVar(&environment, "environment", "", "environment of the key pair")
+	flags.StringVar(&tenant, "tenant", "", "tenant of the key pair")
+	flags.StringVar(&namespace, "namespace", "", "namespace of the secrets")
+	flags.StringVar(&secretName, "secret-name", "kite-key-{{.Host}}", "name of the secrets")
+	flags.Parse(args)
+
+	args = flags.Args()
+
+	if len(args) != 1 {
+		c.Ui.Error("You should give a file with the hosts. Example: kitectl fleet-keys hosts.txt")
+		return 1
+	}
+
+	if format != "files" && format != "kubernetes" {
+		c.Ui.Error(fmt.Sprintf("invalid -format %q, it must be files or kubernetes", format))
+		return 1
+	}
+
+	nameTmpl, err := template.New("name").Parse(secretName)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("invalid -secret-name: %s", err))
+		return 1
+	}
+
+	hosts, err := readFleetHosts(args[0])
+	if err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	cfg, err := config.Get()
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Cannot read kite.key: %s", err))
+		return 1
+	}
+
+	if kontrolURL == "" {
+		kontrolURL = cfg.KontrolURL
+	}
+
+	c.KiteClient.Config = cfg
+
+	kontrol := c.KiteClient.NewClient(kontrolURL)
+	kontrol.Auth = &kite.Auth{
+		Type: "kiteKey",
+		Key:  cfg.KiteKey,
+	}
+
+	if err := kontrol.Dial(); err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+	defer kontrol.Close()
+
+	keys := make([]*protocol.IssuedKey, 0, len(hosts))
+
+	for i := 0; i < len(hosts); i += issueKeysBatch {
+		batch := hosts[i:]
+		if len(batch) > issueKeysBatch {
+			batch = batch[:issueKeysBatch]
+		}
+
+		req := &protocol.IssueKeysArgs{
+			Keys: make([]*protocol.IssueKeyArgs, len(batch)),
+		}
+
+		for j, h := range batch {
+			req.Keys[j] = &protocol.IssueKeyArgs{
+				Username:    h.Username,
+				Environment: environment,
+				Tenant:      tenant,
+			}
+		}
+
+		resp, err := kontrol.TellWithTimeout("issueKeys", time.Minute, req)
+		if err != nil {
+			c.Ui.Error(err.Error())
+			return 1
+		}
+
+		var res protocol.IssueKeysResult
+		if err := resp.Unmarshal(&res); err != nil {
+			c.Ui.Error(err.Error())
+			return 1
+		}
+
+		if len(res.Keys) != len(batch) {
+			c.Ui.Error(fmt.Sprintf("kontrol issued %d keys, want %d", len(res.Keys), len(batch)))
+			return 1
+		}
+
+		keys = append(keys, res.Keys...)
+	}
+
+	// Nothing is written unless all the keys are issued, so the output
+	// describes the whole fleet.
+	failed := 0
+	for i, key := range keys {
+		if key.Error != "" {
+			c.Ui.Error(fmt.Sprintf("%s: %s", hosts[i].Host, key.Error))
+			failed++
+		}
+	}
+
+	if failed != 0 {
+		c.Ui.Error(fmt.Sprintf("Failed to issue %d of %d keys, nothing is written", failed, len(keys)))
+		return 1
+	}
+
+	if format == "files" {
+		err = c.writeKeyFiles(output, hosts, keys)
+	} else {
+		err = c.writeSecrets(output, namespace, nameTmpl, hosts, keys)
+	}
+
+	if err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+func (c *FleetKeys) writeKeyFiles(dir string, hosts []*fleetHost, keys []*protocol.IssuedKey) error {
+	if dir == "" {
+		dir = "kite-keys"
+	}
+
+	for i, key := range keys {
+		hostDir := filepath.Join(dir, hosts[i].Host)
+
+		if err := os.MkdirAll(hostDir, 0700); err != nil {
+			return err
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(hostDir, "kite.key"), []byte(key.KiteKey), 0600); err != nil {
+			return err
+		}
+	}
+
+	c.Ui.Info(fmt.Sprintf("Wrote %d kite.key files to %s", len(keys), dir))
+
+	return nil
+}
+
+func (c *FleetKeys) writeSecrets(file, namespace string, nameTmpl *template.Template, hosts []*fleetHost, keys []*protocol.IssuedKey) error {
+	var buf bytes.Buffer
+
+	for i, key := range keys {
+		var name bytes.Buffer
+		if err := nameTmpl.Execute(&name, hosts[i]); err != nil {
+			return err
+		}
+
+		err := secretTemplate.Execute(&buf, map[string]string{
+			"Name":      name.String(),
+			"Namespace": namespace,
+			"Username":  hosts[i].Username,
+			"Host":      hosts[i].Host,
+			"Data":      base64.StdEncoding.EncodeToString([]byte(key.KiteKey)),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if file == "" || file == "-" {
+		_, err := os.Stdout.Write(buf.Bytes())
+		return err
+	}
+
+	return ioutil.WriteFile(file, buf.Bytes(), 0600)
+}
+
+// readFleetHosts reads the hosts from the file, or the standard input
+// if it's "-".
+func readFleetHosts(file string) ([]*fleetHost, error) {
+	var r io.Reader = os.Stdin
+
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		r = f
+	}
+
+	var hosts []*fleetHost
+	seen := make(map[string]int)
+
+	scanner := bufio.NewScanner(r)
+
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("%s:%d: want USERNAME [HOST], got %d fields", file, line, len(fields))
+		}
+
+		h := &fleetHost{Username: fields[0], Host: fields[0]}
+		if len(fields) == 2 {
+			h.Host = fields[1]
+		}
+
+		if !hostIDRx.MatchString(h.Host) {
+			return nil, fmt.Errorf("%s:%d: invalid host ID %q", file, line, h.Host)
+		}
+
+		if prev, ok := seen[h.Host]; ok {
+			return nil, fmt.Errorf("%s:%d: host %q is already given on line %d", file, line, h.Host, prev)
+		}
+
+		seen[h.Host] = line
+		hosts = append(hosts, h)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("%s: no hosts", file)
+	}
+
+	return hosts, nil
+}
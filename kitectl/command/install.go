@@ -2,19 +2,20 @@ package command
 
 import (
 	"archive/tar"
+	"archive/zip"
 	"compress/gzip"
-	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
 	"path/filepath"
-	"runtime"
+	"sort"
 	"strings"
 
-	"github.com/koding/kite/kitekey"
+	version "github.com/hashicorp/go-version"
+	"github.com/koding/kite/v2/kitekey"
 	"github.com/mitchellh/cli"
 )
 
@@ -34,15 +35,51 @@ func (c *Install) Synopsis() string {
 
 func (c *Install) Help() string {
 	helpText := `
-Usage: kitectl install URL
+Usage: kitectl install [options] URL
 
   Installs a kite from the given URL. Example: github.com/cenkalti/math.kite
+  The kites it depends on are installed as well, unless installed already.
+
+Options:
+
+  -version=1.2.0     Version of the kite to install or a version constraint,
+                     e.g. ">= 1.2, < 2.0". The latest version by default.
+  -repository=URL    Repository of the kites, the manifest of a kite is read
+                     from <repository>/<kite>/.kite.json. Kites are installed
+                     from GitHub by default, or $KITE_REPOSITORY if it's set.
+  -upgrade           Remove other installed versions of the kite, upgrading
+                     or downgrading it to the installed one
+  -service           Register and start a service, which runs the kite: a systemd
+                     unit on Linux, a launchd property list on macOS or a Windows
+                     service. It is removed by "kitectl uninstall".
+  -env KEY=VALUE     Environment variable of the service, can be repeated
+  -restart=always    Restart policy of the service: always, on-failure or no
+  -user=name         User the service runs as, requires root
+
+  Services installed by root are system-wide, others run as the user,
+  e.g. "systemctl --user" units.
 `
 
 	return strings.TrimSpace(helpText)
 }
 
 func (c *Install) Run(args []string) int {
+	var service, upgrade bool
+	var env envFlag
+	var restart, user, constraint, repository string
+
+	flags := flag.NewFlagSet("install", flag.ExitOnError)
+	flags.StringVar(&constraint, "version", "", "version or version constraint of the kite")
+	flags.StringVar(&repository, "repository", os.Getenv("KITE_REPOSITORY"), "URL of the kite repository")
+	flags.BoolVar(&upgrade, "upgrade", false, "remove other installed versions of the kite")
+	flags.BoolVar(&service, "service", false, "register a service running the kite")
+	flags.Var(&env, "env", "environment variable of the service")
+	flags.StringVar(&restart, "restart", "always", "restart policy of the service")
+	flags.StringVar(&user, "user", "", "user the service runs as")
+	flags.Parse(args)
+
+	args = flags.Args()
+
 	if len(args) != 1 {
 		c.Ui.Error("You should give a URL. Example: github.com/cenkalti/math.kite")
 		return 1
@@ -50,139 +87,244 @@ func (c *Install) Run(args []string) int {
 
 	repoName := args[0]
 
-	// Download manifest
-	c.Ui.Output("Downloading manifest file...")
-	manifest, err := getManifest(repoName)
+	var cfg *serviceConfig
+
+	if service {
+		var err error
+		if cfg, err = newServiceConfig(""); err != nil {
+			c.Ui.Error(err.Error())
+			return 1
+		}
+
+		cfg.Env, cfg.Restart, cfg.User = env, restart, user
+
+		if err := cfg.validate(); err != nil {
+			c.Ui.Error(err.Error())
+			return 1
+		}
+	}
+
+	i := &installer{
+		ui:         c.Ui,
+		repository: repository,
+		visited:    make(map[string]bool),
+	}
+
+	fullName, fresh, err := i.install(repoName, constraint)
 	if err != nil {
 		c.Ui.Error(err.Error())
 		return 1
 	}
 
-	version, err := getVersion(manifest)
-	if err != nil {
-		c.Ui.Error(err.Error())
+	if !fresh && !upgrade {
+		c.Ui.Error(fmt.Sprintf("Already installed: %s", fullName))
 		return 1
 	}
 
-	c.Ui.Output(fmt.Sprintf("Found version: %s\n", version))
+	if upgrade {
+		if err := removeOtherVersions(fullName); err != nil {
+			c.Ui.Error(err.Error())
+			return 1
+		}
+	}
 
-	binaryURL, err := getBinaryURL(manifest)
-	if err != nil {
-		c.Ui.Error(err.Error())
-		return 1
+	if cfg != nil {
+		cfg.Kite = fullName
+
+		if err := registerService(cfg); err != nil {
+			c.Ui.Error(err.Error())
+			return 1
+		}
+
+		fmt.Println("Registered service:", serviceName(cfg.Kite))
 	}
 
-	// Make download request to the kite binary
-	fmt.Println("Downloading kite...")
-	targz, err := http.Get(binaryURL)
+	return 0
+}
+
+// installer installs kites with their dependencies.
+type installer struct {
+	ui         cli.Ui
+	repository string
+	visited    map[string]bool // kites whose dependencies are resolved
+}
+
+// install installs the latest release of the kite matching the constraint
+// and the kites it depends on. It gives the full name of the kite and whether
+// it was installed now, rather than before.
+func (i *installer) install(name, constraint string) (string, bool, error) {
+	name = strings.TrimRight(name, "/")
+	i.visited[name] = true
+
+	i.ui.Output(fmt.Sprintf("Downloading manifest file of %s...", name))
+	manifest, err := getManifest(i.repository, name)
 	if err != nil {
-		c.Ui.Error(err.Error())
-		return 1
+		return "", false, err
 	}
-	defer targz.Body.Close()
 
-	// Extract gzip
-	gz, err := gzip.NewReader(targz.Body)
+	release, err := manifest.Release(constraint)
 	if err != nil {
-		c.Ui.Error(err.Error())
-		return 1
+		return "", false, err
 	}
-	defer gz.Close()
 
-	// Extract tar
-	tempKitePath, err := ioutil.TempDir("", "kite-install-")
+	fullName := name + "/" + release.Version
+
+	installed, err := isInstalled(fullName)
 	if err != nil {
-		c.Ui.Error(err.Error())
-		return 1
+		return "", false, err
 	}
-	defer os.RemoveAll(tempKitePath)
 
-	err = extractTar(gz, tempKitePath)
-	if err != nil {
-		c.Ui.Error(err.Error())
-		return 1
+	if !installed {
+		i.ui.Output(fmt.Sprintf("Found version: %s\n", release.Version))
+
+		if err := i.installRelease(name, release); err != nil {
+			return "", false, err
+		}
+
+		i.ui.Output(fmt.Sprintf("Installed successfully: %s", fullName))
+	}
+
+	deps := make([]string, 0, len(release.Dependencies))
+	for dep := range release.Dependencies {
+		deps = append(deps, dep)
+	}
+	sort.Strings(deps)
+
+	for _, dep := range deps {
+		if i.visited[dep] {
+			continue
+		}
+
+		ok, err := isSatisfied(dep, release.Dependencies[dep])
+		if err != nil {
+			return "", false, err
+		}
+
+		if ok {
+			continue
+		}
+
+		if _, _, err := i.install(dep, release.Dependencies[dep]); err != nil {
+			return "", false, fmt.Errorf("cannot install %s dependency: %s", dep, err)
+		}
 	}
 
-	bundlePath, err := validatePackage(tempKitePath, repoName)
+	return fullName, !installed, nil
+}
+
+// installRelease downloads the bundle of the release and installs it.
+func (i *installer) installRelease(name string, release *Release) error {
+	i.ui.Output("Downloading kite...")
+	f, err := release.Binary().download()
 	if err != nil {
-		c.Ui.Error(err.Error())
-		return 1
+		return err
 	}
+	defer os.Remove(f.Name())
+	defer f.Close()
 
-	err = installKite(bundlePath, repoName, version)
+	tempKitePath, err := ioutil.TempDir("", "kite-install-")
 	if err != nil {
-		c.Ui.Error(err.Error())
-		return 1
+		return err
 	}
+	defer os.RemoveAll(tempKitePath)
 
-	fmt.Println("Installed successfully:", filepath.Join(repoName, version))
-	return 0
-}
+	// Windows bundles are zip archives, others are gzipped tarballs.
+	if strings.HasSuffix(release.Binary().URL, ".zip") {
+		if err := extractZip(f, tempKitePath); err != nil {
+			return err
+		}
+	} else {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
 
-func getManifest(repoName string) (map[string]interface{}, error) {
-	if !strings.HasPrefix(repoName, "github.com/") {
-		return nil, errors.New("Repo other than github.com is not supported for now")
+		if err := extractTar(gz, tempKitePath); err != nil {
+			return err
+		}
 	}
 
-	repoName = strings.TrimRight(repoName, "/")
-	manifestURL := "http://raw." + repoName + "/master/.kite.json"
+	bundlePath, err := validatePackage(tempKitePath, name)
+	if err != nil {
+		return err
+	}
+
+	return installKite(bundlePath, name, release.Version)
+}
 
-	res, err := http.Get(manifestURL)
+// installedVersions gives the installed versions of the kite.
+func installedVersions(name string) ([]*InstalledKite, error) {
+	kites, err := getInstalledKites("")
 	if err != nil {
 		return nil, err
 	}
-	defer res.Body.Close()
 
-	if res.StatusCode == 404 {
-		return nil, errors.New("Package is not found on the server.")
-	}
+	var versions []*InstalledKite
 
-	if res.StatusCode != 200 {
-		return nil, fmt.Errorf("Unexpected response from server: %d", res.StatusCode)
+	for _, k := range kites {
+		if k.Domain+"/"+k.User+"/"+k.Repo == name {
+			versions = append(versions, k)
+		}
 	}
 
-	body, err := ioutil.ReadAll(res.Body)
+	return versions, nil
+}
+
+// isSatisfied returns true if an installed version of the kite matches
+// the constraint.
+func isSatisfied(name, constraint string) (bool, error) {
+	c, err := version.NewConstraint(constraint)
 	if err != nil {
-		return nil, fmt.Errorf("cannot read response: %s", err.Error())
+		return false, err
 	}
 
-	manifest := make(map[string]interface{})
-	err = json.Unmarshal(body, &manifest)
+	versions, err := installedVersions(name)
 	if err != nil {
-		return nil, fmt.Errorf("invalid manifest file: %s", err.Error())
+		return false, err
 	}
 
-	return manifest, nil
+	for _, k := range versions {
+		if v, err := version.NewVersion(k.Version); err == nil && c.Check(v) {
+			return true, nil
+		}
+	}
+
+	return false, nil
 }
 
-func getBinaryURL(manifest map[string]interface{}) (string, error) {
-	platforms, ok := manifest["platforms"].(map[string]interface{})
-	if !ok {
-		return "", errors.New("no platforms key in kite manifest")
+// removeOtherVersions uninstalls the versions of the kite other than
+// the given one.
+func removeOtherVersions(fullName string) error {
+	name := fullName[:strings.LastIndex(fullName, "/")]
+
+	versions, err := installedVersions(name)
+	if err != nil {
+		return err
 	}
 
-	platform := runtime.GOOS + "_" + runtime.GOARCH
+	for _, k := range versions {
+		if k.String() == fullName {
+			continue
+		}
 
-	platformURL, ok := platforms[platform]
-	if !ok {
-		return "", fmt.Errorf("no binary available for platform: %s", platform)
-	}
+		if err := unregisterService(k.String()); err != nil {
+			return err
+		}
 
-	binaryURL, ok := platformURL.(string)
-	if !ok {
-		return "", errors.New("invalid platform URL")
-	}
+		bundlePath, err := getBundlePath(k.String())
+		if err != nil {
+			return err
+		}
 
-	return binaryURL, nil
-}
+		if err := os.RemoveAll(bundlePath); err != nil {
+			return err
+		}
 
-func getVersion(manifest map[string]interface{}) (string, error) {
-	version, ok := manifest["version"].(string)
-	if !ok {
-		return "", errors.New("invalid version string")
+		fmt.Println("Removed:", k.String())
 	}
 
-	return version, nil
+	return nil
 }
 
 // extractTar reads from the io.Reader and writes the files into the directory.
@@ -229,7 +371,9 @@ func extractTar(r io.Reader, dir string) error {
 				return err
 			}
 
-			if _, err := io.Copy(f, tr); err != nil {
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
 				return err
 			}
 		}
@@ -237,6 +381,61 @@ func extractTar(r io.Reader, dir string) error {
 	return nil
 }
 
+// extractZip writes the files of the zip archive into the directory.
+func extractZip(f *os.File, dir string) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	zr, err := zip.NewReader(f, fi.Size())
+	if err != nil {
+		return err
+	}
+
+	for _, zf := range zr.File {
+		path := filepath.Join(dir, filepath.FromSlash(zf.Name))
+
+		if !strings.HasPrefix(path, filepath.Clean(dir)+string(filepath.Separator)) {
+			return fmt.Errorf("Invalid package: invalid path %q", zf.Name)
+		}
+
+		if zf.FileInfo().IsDir() {
+			os.MkdirAll(path, 0700)
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+
+		mode := 0600
+		if isBinaryFile(zf.Name) {
+			mode = 0700
+		}
+
+		r, err := zf.Open()
+		if err != nil {
+			return err
+		}
+
+		w, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(mode))
+		if err != nil {
+			r.Close()
+			return err
+		}
+
+		_, err = io.Copy(w, r)
+		r.Close()
+		w.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // validatePackage does some checks on kite bundle and returns the bundle path.
 func validatePackage(tempKitePath, repoName string) (bundlePath string, err error) {
 	dirs, err := ioutil.ReadDir(tempKitePath)
@@ -257,7 +456,7 @@ func validatePackage(tempKitePath, repoName string) (bundlePath string, err erro
 
 	kiteName := strings.TrimSuffix(parts[len(parts)-1], ".kite")
 
-	_, err = os.Stat(filepath.Join(bundlePath, "bin", kiteName))
+	_, err = os.Stat(kiteBinary(filepath.Join(bundlePath, "bin", kiteName)))
 	return bundlePath, err
 }
 
@@ -279,7 +478,7 @@ func installKite(bundlePath, repoName, version string) error {
 // isBinaryFile returns true if the path is the path of the binary file
 // in application bundle. Example: fs-0.0.1.kite/bin/fs
 func isBinaryFile(path string) bool {
-	parts := strings.Split(path, string(os.PathSeparator))
+	parts := strings.Split(path, "/") // tar uses slashes on all platforms
 	if len(parts) != 3 {
 		return false
 	}
@@ -7,7 +7,7 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/koding/kite/kitekey"
+	"github.com/koding/kite/v2/kitekey"
 	"github.com/mitchellh/cli"
 )
 
@@ -94,7 +94,7 @@ func getInstalledKites(kiteName string) ([]*InstalledKite, error) {
 
 				for _, version := range versions {
 					versionPath := filepath.Join(repoPath, version.Name())
-					binaryPath := filepath.Join(versionPath, "bin", strings.TrimSuffix(repo.Name(), ".kite"))
+					binaryPath := kiteBinary(filepath.Join(versionPath, "bin", strings.TrimSuffix(repo.Name(), ".kite")))
 					_, err := os.Stat(binaryPath)
 					if err != nil {
 						fmt.Println(err)
@@ -0,0 +1,268 @@
+package command
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+
+	version "github.com/hashicorp/go-version"
+)
+
+// manifestFileName is the name of the manifest file in the kite repository.
+const manifestFileName = ".kite.json"
+
+// Manifest describes the releases of a kite. It is read from the .kite.json
+// file of the kite repository:
+//
+//	{
+//		"manifestVersion": 2,
+//		"name": "github.com/koding/fs.kite",
+//		"releases": [{
+//			"version": "1.1.0",
+//			"platforms": {
+//				"linux_amd64": {
+//					"url": "fs-1.1.0-linux_amd64.tar.gz",
+//					"sha256": "9f86d08..."
+//				}
+//			},
+//			"dependencies": {
+//				"github.com/koding/os.kite": ">= 1.0, < 2.0"
+//			}
+//		}]
+//	}
+//
+// Relative binary URLs are resolved against the URL of the manifest.
+// Manifests of version 1, which have the "version" and "platforms" keys
+// with binary URLs only, are read as a manifest with a single release.
+type Manifest struct {
+	ManifestVersion int        `json:"manifestVersion"`
+	Name            string     `json:"name"`
+	Releases        []*Release `json:"releases"`
+}
+
+// Release is a version of a kite.
+type Release struct {
+	Version      string             `json:"version"`
+	Platforms    map[string]*Binary `json:"platforms"`    // keyed by GOOS_GOARCH
+	Dependencies map[string]string  `json:"dependencies"` // version constraints keyed by kite names
+}
+
+// Binary is a tarball of the kite bundle for a platform.
+type Binary struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+}
+
+// manifestV1 is the manifest format before releases were listed.
+type manifestV1 struct {
+	Version   string            `json:"version"`
+	Platforms map[string]string `json:"platforms"`
+}
+
+// manifestURL gives the URL of the manifest of the kite. Without a repository
+// the manifest is read from the master branch of the kite's GitHub repository,
+// otherwise from the <repository>/<name>/.kite.json URL.
+func manifestURL(repository, name string) (string, error) {
+	name = strings.TrimRight(name, "/")
+
+	if repository != "" {
+		return strings.TrimRight(repository, "/") + "/" + name + "/" + manifestFileName, nil
+	}
+
+	if !strings.HasPrefix(name, "github.com/") {
+		return "", errors.New("Repo other than github.com is not supported without -repository")
+	}
+
+	return "http://raw." + name + "/master/" + manifestFileName, nil
+}
+
+// getManifest downloads the manifest of the kite.
+func getManifest(repository, name string) (*Manifest, error) {
+	u, err := manifestURL(repository, name)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := http.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == 404 {
+		return nil, errors.New("Package is not found on the server.")
+	}
+
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("Unexpected response from server: %d", res.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read response: %s", err.Error())
+	}
+
+	m, err := parseManifest(body, u)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest file: %s", err.Error())
+	}
+
+	return m, nil
+}
+
+// parseManifest parses the manifest read from the URL u.
+func parseManifest(data []byte, u string) (*Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+
+	switch m.ManifestVersion {
+	case 0, 1:
+		var v1 manifestV1
+		if err := json.Unmarshal(data, &v1); err != nil {
+			return nil, err
+		}
+
+		r := &Release{
+			Version:   v1.Version,
+			Platforms: make(map[string]*Binary, len(v1.Platforms)),
+		}
+
+		for platform, binaryURL := range v1.Platforms {
+			r.Platforms[platform] = &Binary{URL: binaryURL}
+		}
+
+		m.ManifestVersion, m.Releases = 1, []*Release{r}
+	case 2:
+	default:
+		return nil, fmt.Errorf("unsupported manifest version %d", m.ManifestVersion)
+	}
+
+	base, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range m.Releases {
+		if _, err := version.NewVersion(r.Version); err != nil {
+			return nil, fmt.Errorf("invalid version %q: %s", r.Version, err)
+		}
+
+		for platform, b := range r.Platforms {
+			if b == nil || b.URL == "" {
+				return nil, fmt.Errorf("no URL of %s %s binary", r.Version, platform)
+			}
+
+			ref, err := url.Parse(b.URL)
+			if err != nil {
+				return nil, fmt.Errorf("invalid URL of %s %s binary: %s", r.Version, platform, err)
+			}
+
+			b.URL = base.ResolveReference(ref).String()
+		}
+
+		for name, constraint := range r.Dependencies {
+			if _, err := version.NewConstraint(constraint); err != nil {
+				return nil, fmt.Errorf("invalid constraint of %s dependency: %s", name, err)
+			}
+		}
+	}
+
+	return &m, nil
+}
+
+// Release gives the latest release matching the version constraint,
+// which has a binary for the current platform. An empty constraint
+// matches any version.
+func (m *Manifest) Release(constraint string) (*Release, error) {
+	var c version.Constraints
+
+	if constraint != "" {
+		var err error
+		if c, err = version.NewConstraint(constraint); err != nil {
+			return nil, err
+		}
+	}
+
+	platform := runtime.GOOS + "_" + runtime.GOARCH
+
+	var releases []*Release
+	for _, r := range m.Releases {
+		if _, ok := r.Platforms[platform]; ok {
+			releases = append(releases, r)
+		}
+	}
+
+	if len(releases) == 0 {
+		return nil, fmt.Errorf("no binary available for platform: %s", platform)
+	}
+
+	// Versions are validated by parseManifest.
+	sort.Slice(releases, func(i, j int) bool {
+		return version.Must(version.NewVersion(releases[i].Version)).GreaterThan(
+			version.Must(version.NewVersion(releases[j].Version)))
+	})
+
+	for _, r := range releases {
+		if c == nil || c.Check(version.Must(version.NewVersion(r.Version))) {
+			return r, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no version matches %q for platform: %s", constraint, platform)
+}
+
+// Binary gives the binary of the release for the current platform.
+func (r *Release) Binary() *Binary {
+	return r.Platforms[runtime.GOOS+"_"+runtime.GOARCH]
+}
+
+// download downloads the binary into a temporary file, verifying its checksum
+// if the manifest has one. The caller removes the returned file.
+func (b *Binary) download() (*os.File, error) {
+	res, err := http.Get(b.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("Unexpected response from server: %d", res.StatusCode)
+	}
+
+	f, err := ioutil.TempFile("", "kite-download-")
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+
+	if _, err = io.Copy(io.MultiWriter(f, h), res.Body); err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+
+	if err == nil && b.SHA256 != "" {
+		if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, b.SHA256) {
+			err = fmt.Errorf("checksum mismatch of %s: got %s, want %s", b.URL, sum, b.SHA256)
+		}
+	}
+
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	return f, nil
+}
@@ -0,0 +1,342 @@
+package command
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/build"
+	"go/format"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/mitchellh/cli"
+)
+
+var kiteNameRx = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
+// projectTemplates are the files of a new kite project, keyed by their
+// names. The names are templates as well.
+var projectTemplates = map[string]*template.Template{
+	"main.go":           template.Must(template.New("main.go").Parse(mainTemplate)),
+	"main_test.go":      template.Must(template.New("main_test.go").Parse(mainTestTemplate)),
+	"kite.yaml":         template.Must(template.New("kite.yaml").Parse(configTemplate)),
+	"Dockerfile":        template.Must(template.New("Dockerfile").Parse(dockerfileTemplate)),
+	"{{.Name}}.service": template.Must(template.New("unit").Parse(projectUnitTemplate)),
+}
+
+const mainTemplate = `// Command {{.Name}} is a kite.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/config"
+)
+
+// version and commit are set by "kitectl build".
+var (
+	version = "0.0.1"
+	commit  = ""
+)
+
+func main() {
+	var file config.File
+
+	flags := flag.NewFlagSet("{{.Name}}", flag.ExitOnError)
+	configFile := flags.String("config", "", "Configuration file, in .json, .yaml or .toml format.")
+	register := flags.Bool("register", true, "Register to kontrol.")
+	file.Flags(flags)
+	flags.Parse(os.Args[1:])
+
+	cfg := config.New()
+	cfg.Port = {{.Port}}
+
+	// The kite.key, written by "kitectl register", is needed to register
+	// to kontrol. It may be given with the -kite-key flag instead.
+	if err := cfg.ReadKiteKey(); err != nil && *register && file.KiteKeyFile == "" {
+		log.Fatalf("cannot read kite.key: %s", err)
+	}
+
+	if *configFile != "" {
+		if err := cfg.ReadFile(*configFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := cfg.ReadEnvironmentVariables(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := file.Apply(cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	k := newKite(cfg)
+
+	go k.Run()
+	<-k.ServerReadyNotify()
+
+	k.Log.Info("Running {{.Name}} %s (commit %q)", version, commit)
+
+	if *register {
+		go k.RegisterForever(k.RegisterURL(true))
+	}
+
+	<-k.ServerCloseNotify()
+}
+
+// newKite gives the kite with its methods.
+func newKite(cfg *config.Config) *kite.Kite {
+	k := kite.NewWithConfig("{{.Name}}", version, cfg)
+
+	k.HandleFunc("hello", hello)
+	k.HandleFunc("square", square)
+
+	return k
+}
+
+// hello greets the caller.
+func hello(r *kite.Request) (interface{}, error) {
+	return "Hello, " + r.Username + "!", nil
+}
+
+// square gives the square of the number.
+func square(r *kite.Request) (interface{}, error) {
+	n, err := r.Args.One().Float64()
+	if err != nil {
+		return nil, err
+	}
+
+	return n * n, nil
+}
+`
+
+const mainTestTemplate = `package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/config"
+)
+
+func TestSquare(t *testing.T) {
+	cfg := config.New()
+	cfg.DisableAuthentication = true
+	cfg.IP = "127.0.0.1"
+	cfg.Port = 0 // any free port
+
+	k := newKite(cfg)
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	c := kite.New("client", "0.0.1").NewClient("http://127.0.0.1:" + strconv.Itoa(k.Port()) + "/kite")
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	result, err := c.TellWithTimeout("square", 4*time.Second, 4)
+	if err != nil {
+		t.Fatalf("Tell()=%s", err)
+	}
+
+	if n := result.MustFloat64(); n != 16 {
+		t.Fatalf("got %v, want 16", n)
+	}
+}
+`
+
+const configTemplate = `# Configuration of the {{.Name}} kite, read with the -config flag.
+# Environment variables, like KITE_PORT, and flags override it.
+port: {{.Port}}
+environment: development
+timeout: 30s
+`
+
+const dockerfileTemplate = `FROM golang:1.10 AS build
+
+WORKDIR /go/src/{{.Package}}
+COPY . .
+RUN go get -d ./... && CGO_ENABLED=0 go build -o /{{.Name}} .
+
+FROM alpine:3.7
+
+RUN apk add --no-cache ca-certificates
+COPY --from=build /{{.Name}} /usr/local/bin/{{.Name}}
+
+# Mount the directory with the kite.key, written by "kitectl register",
+# or run the kite with "kitectl docker-run", which does it.
+ENV KITE_HOME=/etc/kite
+VOLUME /etc/kite
+
+EXPOSE {{.Port}}
+ENTRYPOINT ["/usr/local/bin/{{.Name}}"]
+`
+
+const projectUnitTemplate = `[Unit]
+Description=Kite {{.Name}}
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+ExecStart=/usr/local/bin/{{.Name}}
+Restart=always
+RestartSec=5
+Environment=KITE_HOME=/etc/kite
+
+[Install]
+WantedBy=multi-user.target
+`
+
+type New struct {
+	Ui cli.Ui
+}
+
+func NewNew() cli.CommandFactory {
+	return func() (cli.Command, error) {
+		return &New{Ui: DefaultUi}, nil
+	}
+}
+
+func (c *New) Synopsis() string {
+	return "Creates a new kite project"
+}
+
+func (c *New) Help() string {
+	helpText := `
+Usage: kitectl new [options] NAME
+
+  Creates a runnable kite project in the NAME directory: main.go with
+  the kite and its methods, a test, a kite.yaml configuration file,
+  a Dockerfile and a systemd unit.
+
+Options:
+
+  -dir=PATH       Directory of the project, NAME by default. It must not
+                  exist or be empty.
+  -package=PATH   Import path of the project, used in the Dockerfile.
+                  Detected from GOPATH by default.
+  -port=6000      Default port of the kite.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *New) Run(args []string) int {
+	var dir, pkg string
+	var port int
+
+	flags := flag.NewFlagSet("new", flag.ExitOnError)
+	flags.StringVar(&dir, "dir", "", "directory of the project")
+	flags.StringVar(&pkg, "package", "", "import path of the project")
+	flags.IntVar(&port, "port", 6000, "default port of the kite")
+	flags.Parse(args)
+
+	args = flags.Args()
+
+	if len(args) != 1 {
+		c.Ui.Error("You should give a name. Example: kitectl new math")
+		return 1
+	}
+
+	name := args[0]
+
+	if !kiteNameRx.MatchString(name) {
+		c.Ui.Error(fmt.Sprintf("invalid name %q, it must start with a letter and contain lowercase letters, digits and dashes", name))
+		return 1
+	}
+
+	if dir == "" {
+		dir = name
+	}
+
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	if pkg == "" {
+		pkg = importPath(dir)
+	}
+
+	data := struct {
+		Name    string
+		Package string
+		Port    int
+	}{name, pkg, port}
+
+	if err := writeProject(dir, data); err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	c.Ui.Output(fmt.Sprintf("Created kite %s in %s\n", name, dir))
+	c.Ui.Output("Run it with:\n")
+	c.Ui.Output(fmt.Sprintf("  cd %s && go run main.go -register=false", dir))
+
+	return 0
+}
+
+// writeProject executes the project templates into the directory.
+func writeProject(dir string, data interface{}) error {
+	if files, err := ioutil.ReadDir(dir); err == nil && len(files) != 0 {
+		return fmt.Errorf("%s is not empty", dir)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for name, tmpl := range projectTemplates {
+		var buf bytes.Buffer
+
+		if err := template.Must(template.New("name").Parse(name)).Execute(&buf, data); err != nil {
+			return err
+		}
+
+		file := filepath.Join(dir, buf.String())
+		buf.Reset()
+
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return err
+		}
+
+		p := buf.Bytes()
+
+		if strings.HasSuffix(file, ".go") {
+			var err error
+			if p, err = format.Source(p); err != nil {
+				return fmt.Errorf("%s: %s", file, err)
+			}
+		}
+
+		if err := ioutil.WriteFile(file, p, 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// importPath gives the import path of the directory, if it's in GOPATH,
+// or its base name otherwise.
+func importPath(dir string) string {
+	for _, src := range build.Default.SrcDirs() {
+		if rel, err := filepath.Rel(src, dir); err == nil && !strings.HasPrefix(rel, "..") {
+			return filepath.ToSlash(rel)
+		}
+	}
+
+	return filepath.Base(dir)
+}
@@ -0,0 +1,36 @@
+// +build !windows
+
+package command
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// kiteBinary gives the path of the kite binary in its bundle.
+func kiteBinary(path string) string {
+	return path
+}
+
+// execKite replaces kitectl with the kite.
+func execKite(path string, args []string) error {
+	return syscall.Exec(path, args, os.Environ())
+}
+
+// listenStatus listens on the status socket of a supervised kite.
+func listenStatus(socket string) (net.Listener, error) {
+	return net.Listen("unix", socket)
+}
+
+// dialStatus connects to the status socket of a supervised kite.
+func dialStatus(socket string) (net.Conn, error) {
+	return net.DialTimeout("unix", socket, 2*time.Second)
+}
+
+// runService returns false, since kitectl is run by the init system
+// of the host instead of serving a service manager.
+func runService(s *supervisor) (bool, error) {
+	return false, nil
+}
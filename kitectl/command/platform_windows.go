@@ -0,0 +1,76 @@
+package command
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// kiteBinary gives the path of the kite binary in its bundle.
+func kiteBinary(path string) string {
+	if strings.EqualFold(filepath.Ext(path), ".exe") {
+		return path
+	}
+
+	return path + ".exe"
+}
+
+// execKite runs the kite and exits with its exit code. Windows has no exec,
+// so kitectl stays around as the parent of the kite. The kite gets the
+// Ctrl+C events of the console as well, so they are ignored here.
+func execKite(path string, args []string) error {
+	cmd := &exec.Cmd{
+		Path:   path,
+		Args:   args,
+		Env:    os.Environ(),
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+
+	signal.Ignore(os.Interrupt)
+
+	if err := cmd.Run(); err != nil {
+		if e, ok := err.(*exec.ExitError); ok {
+			os.Exit(e.Sys().(syscall.WaitStatus).ExitStatus())
+		}
+
+		return err
+	}
+
+	os.Exit(0)
+	return nil
+}
+
+// listenStatus listens for the status requests of a supervised kite. Unix
+// sockets are not available on all supported Windows versions, so it listens
+// on a loopback TCP port and writes its address into the socket file instead.
+func listenStatus(socket string) (net.Listener, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(socket, []byte(l.Addr().String()), 0644); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// dialStatus connects to the status address of a supervised kite.
+func dialStatus(socket string) (net.Conn, error) {
+	addr, err := ioutil.ReadFile(socket)
+	if err != nil {
+		return nil, err
+	}
+
+	return net.DialTimeout("tcp", strings.TrimSpace(string(addr)), 2*time.Second)
+}
@@ -0,0 +1,66 @@
+package command
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/cli"
+)
+
+type Ps struct {
+	Ui cli.Ui
+}
+
+func NewPs() cli.CommandFactory {
+	return func() (cli.Command, error) {
+		return &Ps{Ui: DefaultUi}, nil
+	}
+}
+
+func (c *Ps) Synopsis() string {
+	return "Lists supervised kites"
+}
+
+func (c *Ps) Help() string {
+	helpText := `
+Usage: kitectl ps
+
+  Lists kites started with "kitectl run -supervise".
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *Ps) Run(_ []string) int {
+	dir, err := supervisorDir()
+	if err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	sockets, err := filepath.Glob(filepath.Join(dir, "*.sock"))
+	if err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
+	c.Ui.Output(fmt.Sprintf("%-8s %-8s %-10s %-8s %-10s %s", "PID", "KITEPID", "STATE", "RESTARTS", "UPTIME", "KITE"))
+
+	for _, socket := range sockets {
+		status, err := readStatus(socket)
+		if err != nil {
+			// The supervisor is gone without cleaning up.
+			os.Remove(socket)
+			continue
+		}
+
+		uptime := time.Since(status.StartedAt) / time.Second * time.Second
+
+		c.Ui.Output(fmt.Sprintf("%-8d %-8d %-10s %-8d %-10s %s", status.SupervisorPID, status.PID,
+			status.State, status.Restarts, uptime, status.Kite))
+	}
+
+	return 0
+}
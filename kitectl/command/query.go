@@ -5,9 +5,9 @@ import (
 	"fmt"
 	"strings"
 
-	"github.com/koding/kite"
-	"github.com/koding/kite/config"
-	"github.com/koding/kite/protocol"
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/protocol"
 	"github.com/mitchellh/cli"
 )
 
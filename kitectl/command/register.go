@@ -5,8 +5,8 @@ import (
 	"strings"
 	"time"
 
-	"github.com/koding/kite"
-	"github.com/koding/kite/kitekey"
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/kitekey"
 	"github.com/mitchellh/cli"
 )
 
@@ -1,12 +1,12 @@
 package command
 
 import (
-	"os"
+	"flag"
 	"path/filepath"
 	"strings"
-	"syscall"
+	"time"
 
-	"github.com/koding/kite/kitekey"
+	"github.com/koding/kite/v2/kitekey"
 	"github.com/mitchellh/cli"
 )
 
@@ -26,14 +26,39 @@ func (c *Run) Synopsis() string {
 
 func (c *Run) Help() string {
 	helpText := `
-Usage: kitectl run kitename
+Usage: kitectl run [options] kitename [args...]
 
   Runs the given kite.
+
+Options:
+
+  -supervise         Restart the kite when it crashes, see "kitectl ps"
+  -max-backoff=1m    Maximum delay between restarts of a supervised kite
+  -log-size=10       Size in MB after which the logs of a supervised kite
+                     are rotated
+  -log-files=5       Number of rotated logs kept for a supervised kite
+
+  The output of a supervised kite is written to stdout.log and stderr.log
+  files in the ~/.kite/logs/<kitename> directory (%AppData%\Kite\logs on
+  Windows).
 `
 	return strings.TrimSpace(helpText)
 }
 
 func (c *Run) Run(args []string) int {
+	var supervise bool
+	var maxBackoff time.Duration
+	var logSize int64
+	var logFiles int
+
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	flags.BoolVar(&supervise, "supervise", false, "restart the kite when it crashes")
+	flags.DurationVar(&maxBackoff, "max-backoff", time.Minute, "maximum delay between restarts")
+	flags.Int64Var(&logSize, "log-size", 10, "size of log files in MB")
+	flags.IntVar(&logFiles, "log-files", 5, "number of rotated log files")
+	flags.Parse(args)
+
+	args = flags.Args()
 
 	// Parse kite name
 	if len(args) == 0 {
@@ -82,8 +107,33 @@ func (c *Run) Run(args []string) int {
 		return 1
 	}
 
-	binPath := filepath.Join(kiteHome, "kites", matched[0].BinPath())
-	err = syscall.Exec(binPath, args, os.Environ())
+	binPath := kiteBinary(filepath.Join(kiteHome, "kites", matched[0].BinPath()))
+
+	if supervise {
+		s := &supervisor{
+			kite:       matched[0].String(),
+			binary:     binPath,
+			args:       args,
+			logDir:     filepath.Join(kiteHome, "logs", fileName(matched[0].String())),
+			logSize:    logSize << 20,
+			logFiles:   logFiles,
+			maxBackoff: maxBackoff,
+		}
+
+		ok, err := runService(s)
+		if !ok && err == nil {
+			err = s.run()
+		}
+
+		if err != nil {
+			c.Ui.Error(err.Error())
+			return 1
+		}
+
+		return 0
+	}
+
+	err = execKite(binPath, args)
 	if err != nil {
 		c.Ui.Error(err.Error())
 		return 1
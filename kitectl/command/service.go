@@ -0,0 +1,79 @@
+package command
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/koding/kite/v2/kitekey"
+)
+
+// serviceConfig describes the service, which runs an installed kite.
+type serviceConfig struct {
+	Kite    string   // full name of the installed kite
+	Env     []string // additional environment of the kite, as KEY=VALUE
+	Restart string   // "always", "on-failure" or "no"
+	User    string   // user the kite runs as, empty for the default one
+
+	KitectlPath string // absolute path of the kitectl binary
+	KiteHome    string
+}
+
+// newServiceConfig gives the service config of the kite, filling in
+// the paths of kitectl and the Kite directory.
+func newServiceConfig(kite string) (*serviceConfig, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	if exe, err = filepath.Abs(exe); err != nil {
+		return nil, err
+	}
+
+	kiteHome, err := kitekey.KiteHome()
+	if err != nil {
+		return nil, err
+	}
+
+	return &serviceConfig{
+		Kite:        kite,
+		Restart:     "always",
+		KitectlPath: exe,
+		KiteHome:    kiteHome,
+	}, nil
+}
+
+func (cfg *serviceConfig) validate() error {
+	switch cfg.Restart {
+	case "always", "on-failure", "no":
+	default:
+		return fmt.Errorf("invalid restart policy %q, want always, on-failure or no", cfg.Restart)
+	}
+
+	for _, kv := range cfg.Env {
+		if i := strings.IndexByte(kv, '='); i <= 0 {
+			return fmt.Errorf("invalid environment variable %q, want KEY=VALUE", kv)
+		}
+	}
+
+	return nil
+}
+
+// serviceName gives the name of the service, which runs the kite.
+func serviceName(kite string) string {
+	return "kite_" + fileName(kite)
+}
+
+// envFlag is a flag.Value collecting repeated KEY=VALUE flags.
+type envFlag []string
+
+func (f *envFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *envFlag) Set(kv string) error {
+	*f = append(*f, kv)
+	return nil
+}
@@ -0,0 +1,163 @@
+package command
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+var plistTemplate = template.Must(template.New("plist").Funcs(template.FuncMap{
+	"xml": func(s string) (string, error) {
+		var buf bytes.Buffer
+		err := xml.EscapeText(&buf, []byte(s))
+		return buf.String(), err
+	},
+	"key": func(kv string) string { return kv[:strings.IndexByte(kv, '=')] },
+	"val": func(kv string) string { return kv[strings.IndexByte(kv, '=')+1:] },
+}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>{{xml .Label}}</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>{{xml .KitectlPath}}</string>
+		<string>run</string>
+		<string>{{xml .Kite}}</string>
+	</array>
+	<key>EnvironmentVariables</key>
+	<dict>
+		<key>KITE_HOME</key>
+		<string>{{xml .KiteHome}}</string>
+		{{- range .Env}}
+		<key>{{xml (key .)}}</key>
+		<string>{{xml (val .)}}</string>
+		{{- end}}
+	</dict>
+	{{- if .User}}
+	<key>UserName</key>
+	<string>{{xml .User}}</string>
+	{{- end}}
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	{{- if eq .Restart "always"}}
+	<true/>
+	{{- else if eq .Restart "on-failure"}}
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	{{- else}}
+	<false/>
+	{{- end}}
+	<key>StandardOutPath</key>
+	<string>{{xml .LogDir}}/stdout.log</string>
+	<key>StandardErrorPath</key>
+	<string>{{xml .LogDir}}/stderr.log</string>
+</dict>
+</plist>
+`))
+
+// launchdPlist gives the path of the property list of the kite and whether
+// it is a daemon. Property lists of root are daemons, ones of other users
+// are agents, which run while the user is logged in.
+func launchdPlist(kite string) (string, bool, error) {
+	name := serviceName(kite) + ".plist"
+
+	if os.Geteuid() == 0 {
+		return filepath.Join("/Library/LaunchDaemons", name), true, nil
+	}
+
+	home := os.Getenv("HOME")
+	if home == "" {
+		return "", false, fmt.Errorf("HOME is not set")
+	}
+
+	return filepath.Join(home, "Library", "LaunchAgents", name), false, nil
+}
+
+// registerService writes a launchd property list, which runs the kite,
+// and loads it. The output of the kite is written into the log directory
+// of the kite, like the output of supervised kites.
+func registerService(cfg *serviceConfig) error {
+	path, daemon, err := launchdPlist(cfg.Kite)
+	if err != nil {
+		return err
+	}
+
+	if cfg.User != "" && !daemon {
+		return fmt.Errorf("the user can be set for daemons only, run as root")
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("service %s already exists", path)
+	}
+
+	logDir := filepath.Join(cfg.KiteHome, "logs", fileName(cfg.Kite))
+
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+
+	err = plistTemplate.Execute(&buf, struct {
+		*serviceConfig
+		Label  string
+		LogDir string
+	}{cfg, serviceName(cfg.Kite), logDir})
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	if err := launchctl("load", "-w", path); err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	return nil
+}
+
+// unregisterService unloads and removes the launchd property list
+// of the kite, if there is one.
+func unregisterService(kite string) error {
+	path, _, err := launchdPlist(kite)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	if err := launchctl("unload", "-w", path); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+func launchctl(args ...string) error {
+	out, err := exec.Command("launchctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("launchctl %s: %s: %s", strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+var unitTemplate = template.Must(template.New("unit").Funcs(template.FuncMap{
+	"quote": strconv.Quote,
+}).Parse(`[Unit]
+Description=Kite {{.Kite}}
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+ExecStart={{quote .KitectlPath}} run {{quote .Kite}}
+Restart={{.Restart}}
+RestartSec=5
+{{- if .User}}
+User={{.User}}
+{{- end}}
+Environment={{quote (print "KITE_HOME=" .KiteHome)}}
+{{- range .Env}}
+Environment={{quote .}}
+{{- end}}
+
+[Install]
+WantedBy={{if .System}}multi-user.target{{else}}default.target{{end}}
+`))
+
+// systemdUnit gives the path of the unit file of the kite and whether it is
+// a system unit. Units of root are system units, units of other users are
+// user units, managed with "systemctl --user".
+func systemdUnit(kite string) (string, bool, error) {
+	name := serviceName(kite) + ".service"
+
+	if os.Geteuid() == 0 {
+		return filepath.Join("/etc/systemd/system", name), true, nil
+	}
+
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			return "", false, fmt.Errorf("HOME is not set")
+		}
+
+		dir = filepath.Join(home, ".config")
+	}
+
+	return filepath.Join(dir, "systemd", "user", name), false, nil
+}
+
+// registerService writes a systemd unit, which runs the kite, and enables it.
+func registerService(cfg *serviceConfig) error {
+	path, system, err := systemdUnit(cfg.Kite)
+	if err != nil {
+		return err
+	}
+
+	if cfg.User != "" && !system {
+		return fmt.Errorf("the user can be set for system units only, run as root")
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("service %s already exists", path)
+	}
+
+	var buf bytes.Buffer
+
+	err = unitTemplate.Execute(&buf, struct {
+		*serviceConfig
+		System bool
+	}{cfg, system})
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	if err := systemctl(system, "daemon-reload"); err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	return systemctl(system, "enable", "--now", filepath.Base(path))
+}
+
+// unregisterService disables and removes the systemd unit of the kite,
+// if there is one.
+func unregisterService(kite string) error {
+	path, system, err := systemdUnit(kite)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	if err := systemctl(system, "disable", "--now", filepath.Base(path)); err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+
+	return systemctl(system, "daemon-reload")
+}
+
+func systemctl(system bool, args ...string) error {
+	if !system {
+		args = append([]string{"--user"}, args...)
+	}
+
+	out, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %s: %s: %s", strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+
+	return nil
+}
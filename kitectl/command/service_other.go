@@ -0,0 +1,19 @@
+// +build !windows,!linux,!darwin
+
+package command
+
+import (
+	"errors"
+	"runtime"
+)
+
+// registerService is not supported on platforms without systemd, launchd
+// or the Windows service manager.
+func registerService(cfg *serviceConfig) error {
+	return errors.New("registering kites as services is not supported on " + runtime.GOOS)
+}
+
+// unregisterService does nothing, since no services are registered.
+func unregisterService(kite string) error {
+	return nil
+}
@@ -0,0 +1,160 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows/registry"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// errServiceDoesNotExist is the ERROR_SERVICE_DOES_NOT_EXIST error code.
+const errServiceDoesNotExist = syscall.Errno(1060)
+
+// registerService registers and starts a Windows service, which runs
+// the kite with "kitectl run -supervise", so it is restarted when it crashes.
+// The supervisor does not restart kites which exit cleanly, so the "always"
+// and "on-failure" restart policies are the same.
+func registerService(cfg *serviceConfig) error {
+	if cfg.Restart == "no" {
+		return errors.New("Windows services are always restarted on failure")
+	}
+
+	if cfg.User != "" {
+		return errors.New("Windows services run as LocalSystem, the user can't be set")
+	}
+
+	name := serviceName(cfg.Kite)
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(name)
+	if err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", name)
+	}
+
+	s, err = m.CreateService(name, cfg.KitectlPath, mgr.Config{
+		DisplayName: "Kite " + cfg.Kite,
+		Description: "Runs the " + cfg.Kite + " kite.",
+		StartType:   mgr.StartAutomatic,
+	}, "run", "-supervise", cfg.Kite)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// The service manager reads the environment of a service
+	// from the Environment value of its registry key.
+	env := append([]string{"KITE_HOME=" + cfg.KiteHome}, cfg.Env...)
+
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, `SYSTEM\CurrentControlSet\Services\`+name, registry.SET_VALUE)
+	if err != nil {
+		s.Delete()
+		return err
+	}
+	defer k.Close()
+
+	if err := k.SetStringsValue("Environment", env); err != nil {
+		s.Delete()
+		return err
+	}
+
+	return s.Start()
+}
+
+// unregisterService stops and removes the Windows service of the kite,
+// if there is one.
+func unregisterService(kite string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName(kite))
+	if err == errServiceDoesNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	status, err := s.Control(svc.Stop)
+	if err == nil {
+		for timeout := time.Now().Add(10 * time.Second); status.State != svc.Stopped; {
+			if time.Now().After(timeout) {
+				return fmt.Errorf("timed out stopping service %s", serviceName(kite))
+			}
+
+			time.Sleep(300 * time.Millisecond)
+
+			if status, err = s.Query(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return s.Delete()
+}
+
+// runService runs the supervisor as a Windows service, if kitectl was
+// started by the service control manager. It returns false otherwise.
+func runService(s *supervisor) (bool, error) {
+	interactive, err := svc.IsAnInteractiveSession()
+	if err != nil {
+		return false, err
+	}
+
+	if interactive {
+		return false, nil
+	}
+
+	return true, svc.Run(serviceName(s.kite), &service{s: s})
+}
+
+// service implements svc.Handler for a supervised kite.
+type service struct {
+	s *supervisor
+}
+
+func (h *service) Execute(_ []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	const accepts = svc.AcceptStop | svc.AcceptShutdown
+
+	h.s.stop = make(chan os.Signal, 1)
+
+	done := make(chan error, 1)
+	go func() { done <- h.s.run() }()
+
+	changes <- svc.Status{State: svc.Running, Accepts: accepts}
+
+	for {
+		select {
+		case err := <-done:
+			changes <- svc.Status{State: svc.StopPending}
+
+			if err != nil {
+				return true, 1
+			}
+
+			return false, 0
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				changes <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				h.s.stop <- os.Interrupt
+			}
+		}
+	}
+}
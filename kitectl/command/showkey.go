@@ -5,7 +5,7 @@ import (
 	"fmt"
 	"strings"
 
-	"github.com/koding/kite/kitekey"
+	"github.com/koding/kite/v2/kitekey"
 
 	"github.com/mitchellh/cli"
 )
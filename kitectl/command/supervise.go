@@ -0,0 +1,303 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/koding/kite/v2/kitekey"
+)
+
+// SupervisorStatus is the status of a supervised kite, which the supervisor
+// writes to each connection made to its status socket.
+type SupervisorStatus struct {
+	Kite          string    `json:"kite"`
+	Binary        string    `json:"binary"`
+	SupervisorPID int       `json:"supervisorPid"`
+	PID           int       `json:"pid,omitempty"` // zero while the kite is not running
+	State         string    `json:"state"`         // "running" or "restarting"
+	Restarts      int       `json:"restarts"`
+	StartedAt     time.Time `json:"startedAt"`
+	LastExit      string    `json:"lastExit,omitempty"`
+}
+
+// supervisor runs a kite and restarts it, when it crashes.
+type supervisor struct {
+	kite   string   // full name of the installed kite
+	binary string   // path of the kite binary
+	args   []string // arguments of the kite, including the name
+
+	logDir   string
+	logSize  int64 // size of a log file, after which it's rotated
+	logFiles int   // number of rotated log files kept
+
+	maxBackoff time.Duration
+
+	// stop stops the supervisor instead of the interrupt signals, if set.
+	stop chan os.Signal
+
+	mu     sync.Mutex
+	status SupervisorStatus
+}
+
+// supervisorDir gives the directory with status sockets of supervised kites.
+func supervisorDir() (string, error) {
+	kiteHome, err := kitekey.KiteHome()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(kiteHome, "supervise"), nil
+}
+
+// fileName gives a name of the kite usable in file names.
+func fileName(kite string) string {
+	return strings.Replace(kite, "/", "_", -1)
+}
+
+// run supervises the kite until it exits cleanly or the supervisor
+// is interrupted.
+func (s *supervisor) run() error {
+	dir, err := supervisorDir()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(s.logDir, 0755); err != nil {
+		return err
+	}
+
+	socket := filepath.Join(dir, fileName(s.kite)+"."+strconv.Itoa(os.Getpid())+".sock")
+
+	l, err := listenStatus(socket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(socket)
+	defer l.Close()
+
+	go s.serveStatus(l)
+
+	stdout := newRotatingFile(filepath.Join(s.logDir, "stdout.log"), s.logSize, s.logFiles)
+	defer stdout.Close()
+
+	stderr := newRotatingFile(filepath.Join(s.logDir, "stderr.log"), s.logSize, s.logFiles)
+	defer stderr.Close()
+
+	sig := s.stop
+	if sig == nil {
+		sig = make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		defer signal.Stop(sig)
+	}
+
+	b := backoff.NewExponentialBackOff()
+	b.MaxInterval = s.maxBackoff
+	b.MaxElapsedTime = 0 // restart forever
+
+	s.mu.Lock()
+	s.status = SupervisorStatus{
+		Kite:          s.kite,
+		Binary:        s.binary,
+		SupervisorPID: os.Getpid(),
+		StartedAt:     time.Now(),
+	}
+	s.mu.Unlock()
+
+	for {
+		cmd := &exec.Cmd{
+			Path:   s.binary,
+			Args:   s.args,
+			Env:    os.Environ(),
+			Stdout: stdout,
+			Stderr: stderr,
+		}
+
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+
+		started := time.Now()
+		s.setRunning(cmd.Process.Pid)
+
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+
+		select {
+		case err = <-done:
+		case sg := <-sig:
+			// Windows can't deliver signals to other processes.
+			if cmd.Process.Signal(sg) != nil {
+				cmd.Process.Kill()
+			}
+			<-done
+			return nil
+		}
+
+		if err == nil {
+			return nil // clean exit, nothing to restart
+		}
+
+		// A kite which was running for a while is restarted right away.
+		if time.Since(started) > s.maxBackoff {
+			b.Reset()
+		}
+
+		delay := b.NextBackOff()
+		s.setRestarting(err)
+
+		fmt.Fprintf(os.Stderr, "%s exited: %s, restarting in %s\n", s.kite, err, delay)
+
+		select {
+		case <-time.After(delay):
+		case <-sig:
+			return nil
+		}
+	}
+}
+
+func (s *supervisor) setRunning(pid int) {
+	s.mu.Lock()
+	s.status.PID = pid
+	s.status.State = "running"
+	s.mu.Unlock()
+}
+
+func (s *supervisor) setRestarting(err error) {
+	s.mu.Lock()
+	s.status.PID = 0
+	s.status.State = "restarting"
+	s.status.Restarts++
+	s.status.LastExit = err.Error()
+	s.mu.Unlock()
+}
+
+// serveStatus writes the status to each connection made to the socket.
+func (s *supervisor) serveStatus(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		status := s.status
+		s.mu.Unlock()
+
+		json.NewEncoder(conn).Encode(&status)
+		conn.Close()
+	}
+}
+
+// readStatus reads the status of the supervised kite from the socket.
+func readStatus(socket string) (*SupervisorStatus, error) {
+	conn, err := dialStatus(socket)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	var status SupervisorStatus
+
+	if err := json.NewDecoder(conn).Decode(&status); err != nil {
+		return nil, err
+	}
+
+	return &status, nil
+}
+
+// rotatingFile is a log file, which is rotated when it exceeds the size.
+// The rotated files are suffixed with ".1", ".2" and so on, up to the number
+// of kept files.
+type rotatingFile struct {
+	path  string
+	size  int64
+	files int
+
+	mu      sync.Mutex
+	f       *os.File
+	written int64
+}
+
+func newRotatingFile(path string, size int64, files int) *rotatingFile {
+	return &rotatingFile{
+		path:  path,
+		size:  size,
+		files: files,
+	}
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f != nil && r.size > 0 && r.written+int64(len(p)) > r.size {
+		r.f.Close()
+		r.f = nil
+		r.rotate()
+	}
+
+	if r.f == nil {
+		f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return 0, err
+		}
+
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return 0, err
+		}
+
+		r.f, r.written = f, fi.Size()
+	}
+
+	n, err := r.f.Write(p)
+	r.written += int64(n)
+
+	return n, err
+}
+
+// rotate shifts the rotated files by one, dropping the oldest one.
+func (r *rotatingFile) rotate() {
+	if r.files <= 0 {
+		os.Remove(r.path)
+		return
+	}
+
+	for i := r.files - 1; i > 0; i-- {
+		os.Rename(r.path+"."+strconv.Itoa(i), r.path+"."+strconv.Itoa(i+1))
+	}
+
+	os.Rename(r.path, r.path+".1")
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return nil
+	}
+
+	err := r.f.Close()
+	r.f = nil
+
+	return err
+}
@@ -1,13 +1,20 @@
 package command
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/koding/kite"
-	"github.com/koding/kite/kitekey"
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/dnode"
+	"github.com/koding/kite/v2/kitekey"
 	"github.com/mitchellh/cli"
 )
 
@@ -31,28 +38,38 @@ func (c *Tell) Synopsis() string {
 
 func (c *Tell) Help() string {
 	helpText := `
-Usage: kitectl tell [options]
+Usage: kitectl tell [options] [args...]
 
   Calls a method on a kite.
 
 Options:
 
-  -to=URL          URL of the remote kite
-  -method=divide   Method name to be invoked
-  -timeout=4       Timeout in seconds.
+  -to=URL            URL of the remote kite
+  -method=divide     Method name to be invoked
+  -timeout=4s        Timeout of the method call
+  -json-file=FILE    Read method arguments from a JSON file, use "-" for stdin.
+                     The file contains an array of arguments or a single one.
+  -callback          Pass a callback as the last argument and print its calls
+  -wait=10s          Stop waiting for callback calls after no call for this long
+  -output=pretty     Output format, "pretty" or "json"
 `
 	return strings.TrimSpace(helpText)
 }
 
 func (c *Tell) Run(args []string) int {
 
-	var to, method string
-	var timeout time.Duration
+	var to, method, jsonFile, output string
+	var timeout, wait time.Duration
+	var callback bool
 
 	flags := flag.NewFlagSet("tell", flag.ExitOnError)
 	flags.StringVar(&to, "to", "", "URL of remote kite")
 	flags.StringVar(&method, "method", "", "method to be called")
 	flags.DurationVar(&timeout, "timeout", 4*time.Second, "timeout of tell method")
+	flags.StringVar(&jsonFile, "json-file", "", "JSON file with method arguments")
+	flags.BoolVar(&callback, "callback", false, "pass a callback as the last argument")
+	flags.DurationVar(&wait, "wait", 10*time.Second, "idle time to wait for callback calls")
+	flags.StringVar(&output, "output", "pretty", "output format")
 	flags.Parse(args)
 
 	if to == "" || method == "" {
@@ -60,6 +77,17 @@ func (c *Tell) Run(args []string) int {
 		return 1
 	}
 
+	if output != "pretty" && output != "json" {
+		c.Ui.Error(fmt.Sprintf("unknown output format: %q", output))
+		return 1
+	}
+
+	params, err := c.params(jsonFile, flags.Args())
+	if err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
 	key, err := kitekey.Read()
 	if err != nil {
 		c.Ui.Error(err.Error())
@@ -77,15 +105,12 @@ func (c *Tell) Run(args []string) int {
 		return 1
 	}
 
-	// Convert args to []interface{} in order to pass it to Tell() method.
-	methodArgs := flags.Args()
-	params := make([]interface{}, len(methodArgs))
-	for i, arg := range methodArgs {
-		if number, err := strconv.Atoi(arg); err != nil {
-			params[i] = arg
-		} else {
-			params[i] = number
-		}
+	calls := make(chan *dnode.Partial, 16)
+
+	if callback {
+		params = append(params, dnode.Callback(func(args *dnode.Partial) {
+			calls <- args
+		}))
 	}
 
 	result, err := remote.TellWithTimeout(method, timeout, params...)
@@ -94,11 +119,88 @@ func (c *Tell) Run(args []string) int {
 		return 1
 	}
 
-	if result == nil {
-		c.Ui.Info("nil")
+	c.print(result, output)
+
+	if !callback {
+		return 0
+	}
+
+	for {
+		select {
+		case args := <-calls:
+			c.print(args, output)
+		case <-time.After(wait):
+			return 0
+		}
+	}
+}
+
+// params gives method arguments read from the JSON file or converted
+// from the positional command line arguments.
+func (c *Tell) params(jsonFile string, args []string) ([]interface{}, error) {
+	if jsonFile == "" {
+		// Convert args to []interface{} in order to pass it to Tell() method.
+		params := make([]interface{}, len(args))
+		for i, arg := range args {
+			if number, err := strconv.Atoi(arg); err != nil {
+				params[i] = arg
+			} else {
+				params[i] = number
+			}
+		}
+
+		return params, nil
+	}
+
+	if len(args) != 0 {
+		return nil, errors.New("positional arguments can't be used with -json-file")
+	}
+
+	var p []byte
+	var err error
+
+	if jsonFile == "-" {
+		p, err = ioutil.ReadAll(os.Stdin)
 	} else {
-		c.Ui.Info(string(result.Raw))
+		p, err = ioutil.ReadFile(jsonFile)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(p, &v); err != nil {
+		return nil, fmt.Errorf("invalid JSON arguments: %s", err)
+	}
+
+	if params, ok := v.([]interface{}); ok {
+		return params, nil
+	}
+
+	return []interface{}{v}, nil
+}
+
+func (c *Tell) print(p *dnode.Partial, output string) {
+	if p == nil {
+		if output == "json" {
+			c.Ui.Output("null")
+		} else {
+			c.Ui.Info("nil")
+		}
+		return
+	}
+
+	if output == "json" {
+		c.Ui.Output(string(p.Raw))
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, p.Raw, "", "  "); err != nil {
+		c.Ui.Info(string(p.Raw))
+		return
 	}
 
-	return 0
+	c.Ui.Info(buf.String())
 }
@@ -6,7 +6,7 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/koding/kite/kitekey"
+	"github.com/koding/kite/v2/kitekey"
 	"github.com/mitchellh/cli"
 )
 
@@ -31,6 +31,8 @@ func (c *Uninstall) Help() string {
 Usage: kitectl uninstall kitename
 
   Uninstall the given kite. Example kitename: github.com/koding/fs.kite/1.0.0
+  The service of the kite, registered with "kitectl install -service",
+  is removed as well.
 `
 	return strings.TrimSpace(helpText)
 }
@@ -54,6 +56,12 @@ func (c *Uninstall) Run(args []string) int {
 		return 1
 	}
 
+	// The service must be stopped first, Windows can't remove a running binary.
+	if err := unregisterService(fullName); err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+
 	bundlePath, err := getBundlePath(fullName)
 	if err != nil {
 		c.Ui.Error(err.Error())
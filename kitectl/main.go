@@ -5,7 +5,7 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/koding/kite/kitectl/command"
+	"github.com/koding/kite/v2/kitectl/command"
 
 	"github.com/mitchellh/cli"
 )
@@ -14,14 +14,20 @@ func main() {
 	c := cli.NewCLI(command.AppName, command.AppVersion)
 	c.Args = os.Args[1:]
 	c.Commands = map[string]cli.CommandFactory{
-		"showkey":   command.NewShowkey(),
-		"register":  command.NewRegister(),
-		"query":     command.NewQuery(),
-		"run":       command.NewRun(),
-		"tell":      command.NewTell(),
-		"uninstall": command.NewUninstall(),
-		"list":      command.NewList(),
-		"install":   command.NewInstall(),
+		"showkey":    command.NewShowkey(),
+		"register":   command.NewRegister(),
+		"query":      command.NewQuery(),
+		"run":        command.NewRun(),
+		"tell":       command.NewTell(),
+		"uninstall":  command.NewUninstall(),
+		"list":       command.NewList(),
+		"install":    command.NewInstall(),
+		"ps":         command.NewPs(),
+		"deploy":     command.NewDeploy(),
+		"build":      command.NewBuild(),
+		"new":        command.NewNew(),
+		"docker-run": command.NewDockerRun(),
+		"fleet-keys": command.NewFleetKeys(),
 	}
 
 	_, err := c.Run()
@@ -0,0 +1,12 @@
+// +build !windows
+
+package kitekey
+
+import "path/filepath"
+
+const kiteDirName = ".kite"
+
+// defaultKiteHome gives the Kite directory in the home directory.
+func defaultKiteHome(homeDir string) string {
+	return filepath.Join(homeDir, kiteDirName)
+}
@@ -0,0 +1,29 @@
+package kitekey
+
+import (
+	"os"
+	"path/filepath"
+)
+
+const (
+	kiteDirName       = "Kite"
+	legacyKiteDirName = ".kite"
+)
+
+// defaultKiteHome gives the Kite directory in the roaming application data
+// directory, %AppData%\Kite, which is what os.UserConfigDir gives on newer
+// Go versions. The ~/.kite directory is used instead if it already exists,
+// so the keys written by older versions are still found.
+func defaultKiteHome(homeDir string) string {
+	legacy := filepath.Join(homeDir, legacyKiteDirName)
+
+	if _, err := os.Stat(legacy); err == nil {
+		return legacy
+	}
+
+	if dir := os.Getenv("AppData"); dir != "" {
+		return filepath.Join(dir, kiteDirName)
+	}
+
+	return legacy
+}
@@ -3,20 +3,22 @@ package kitekey
 
 import (
 	"bytes"
+	"compress/gzip"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/dgrijalva/jwt-go"
 )
 
 const (
-	kiteDirName     = ".kite"
-	kiteKeyFileName = "kite.key"
+	kiteKeyFileName  = "kite.key"
+	kiteLockFileName = "kite.lock"
 )
 
 // KiteClaims represents JWT token claims extended with kontrolKey claim.
@@ -24,10 +26,19 @@ type KiteClaims struct {
 	jwt.StandardClaims
 	KontrolKey string `json:"kontrolKey,omitempty"`
 	KontrolURL string `json:"kontrolURL,omitempty"`
+
+	// Actor is the username of the kite, which obtained the token to act
+	// on behalf of the Subject, see the "delegateToken" kontrol method.
+	Actor string `json:"act,omitempty"`
+
+	// Tenant is the tenant of the kite the key or token was issued for,
+	// see kontrol.AddTenantKeyPair.
+	Tenant string `json:"tenant,omitempty"`
 }
 
-// KiteHome returns the home path of Kite directory.
-// The returned value can be overridden by setting KITE_HOME environment variable.
+// KiteHome returns the home path of Kite directory, which is ~/.kite or
+// %AppData%\Kite on Windows. The returned value can be overridden by setting
+// KITE_HOME environment variable.
 func KiteHome() (string, error) {
 	kiteHome := os.Getenv("KITE_HOME")
 	if kiteHome != "" {
@@ -37,7 +48,7 @@ func KiteHome() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return filepath.Join(usr.HomeDir, kiteDirName), nil
+	return defaultKiteHome(usr.HomeDir), nil
 }
 
 func kiteKeyPath() (string, error) {
@@ -48,19 +59,105 @@ func kiteKeyPath() (string, error) {
 	return filepath.Join(kiteHome, kiteKeyFileName), nil
 }
 
-// Read the contents of the kite.key file.
+// lock locks the kite.key file against concurrent writes, or against writes
+// when exclusive is false. Since the key is written over in multiple steps,
+// it is locked with a separate file. The returned function releases the lock.
+func lock(keyPath string, exclusive bool) (func(), error) {
+	f, err := os.OpenFile(filepath.Join(filepath.Dir(keyPath), kiteLockFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockFile(f, exclusive); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// remove removes the file, which may be read-only. Windows refuses
+// to remove read-only files, so it is made writable first.
+func remove(path string) error {
+	os.Chmod(path, 0600)
+	return os.Remove(path)
+}
+
+// Read the contents of the kite.key file. The file can be compressed
+// with WriteCompressed or split with WriteSplit.
+//
+// The KITE_KEY environment variable, when set, holds the key instead
+// of the file, e.g. for kites running in containers.
 func Read() (string, error) {
+	if key := os.Getenv("KITE_KEY"); key != "" {
+		return strings.TrimSpace(key), nil
+	}
+
 	keyPath, err := kiteKeyPath()
 	if err != nil {
 		return "", err
 	}
+
+	// The key is read without the lock, if it can't be taken,
+	// e.g. when the Kite directory is read-only.
+	if unlock, err := lock(keyPath, false); err == nil {
+		defer unlock()
+	}
+
 	data, err := ioutil.ReadFile(keyPath)
+	if os.IsNotExist(err) {
+		if p, e := readSplit(keyPath); e == nil {
+			data, err = p, nil
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return decode(data)
+}
+
+// readSplit reads the parts of the kite.key file written by WriteSplit.
+func readSplit(keyPath string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	for i := 1; ; i++ {
+		data, err := ioutil.ReadFile(keyPath + "." + strconv.Itoa(i))
+		if os.IsNotExist(err) && i > 1 {
+			return buf.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(data)
+	}
+}
+
+// decode decompresses the kite key, if it was compressed.
+func decode(data []byte) (string, error) {
+	if !bytes.HasPrefix(data, gzipMagic) {
+		return string(bytes.TrimSpace(data)), nil
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	p, err := ioutil.ReadAll(r)
 	if err != nil {
 		return "", err
 	}
-	return strings.TrimSpace(string(data)), nil
+
+	return string(bytes.TrimSpace(p)), nil
 }
 
+var gzipMagic = []byte{0x1f, 0x8b}
+
 // Write over the kite.key file.
 func Write(kiteKey string) error {
 	keyPath, err := kiteKeyPath()
@@ -73,13 +170,91 @@ func Write(kiteKey string) error {
 		return err
 	}
 
+	unlock, err := lock(keyPath, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	// Need to remove the previous key first because we can't write over
 	// when previous file's mode is 0400.
-	os.Remove(keyPath)
+	remove(keyPath)
+	removeSplit(keyPath)
 
 	return ioutil.WriteFile(keyPath, []byte(kiteKey), 0400)
 }
 
+// WriteCompressed writes over the kite.key file like Write, compressing
+// the key with gzip. Kite keys with embedded kontrol keys are large,
+// compressed ones are about half the size.
+func WriteCompressed(kiteKey string) error {
+	var buf bytes.Buffer
+
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(kiteKey)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return Write(buf.String())
+}
+
+// WriteSplit writes the kite key into the kite.key.1, kite.key.2, ...
+// files, each at most size bytes long, and removes the kite.key file.
+// It is meant for storages which limit the size of a single value.
+// Read joins the parts back.
+func WriteSplit(kiteKey string, size int) error {
+	if size <= 0 {
+		return fmt.Errorf("invalid part size: %d", size)
+	}
+
+	keyPath, err := kiteKeyPath()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(keyPath), 0700)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lock(keyPath, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	remove(keyPath)
+	removeSplit(keyPath)
+
+	for i := 1; len(kiteKey) > 0; i++ {
+		n := size
+		if n > len(kiteKey) {
+			n = len(kiteKey)
+		}
+
+		err := ioutil.WriteFile(keyPath+"."+strconv.Itoa(i), []byte(kiteKey[:n]), 0400)
+		if err != nil {
+			return err
+		}
+
+		kiteKey = kiteKey[n:]
+	}
+
+	return nil
+}
+
+// removeSplit removes the parts of a split kite.key file.
+func removeSplit(keyPath string) {
+	for i := 1; ; i++ {
+		if err := remove(keyPath + "." + strconv.Itoa(i)); err != nil {
+			return
+		}
+	}
+}
+
 // Parse the kite.key file and return it as JWT token.
 func Parse() (*jwt.Token, error) {
 	kiteKey, err := Read()
@@ -92,12 +267,34 @@ func Parse() (*jwt.Token, error) {
 
 // ParseFile reads the given kite key file and parses it as a JWT token.
 func ParseFile(file string) (*jwt.Token, error) {
-	kiteKey, err := ioutil.ReadFile(file)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	kiteKey, err := decode(data)
 	if err != nil {
 		return nil, err
 	}
 
-	return jwt.ParseWithClaims(string(bytes.TrimSpace(kiteKey)), &KiteClaims{}, GetKontrolKey)
+	return jwt.ParseWithClaims(kiteKey, &KiteClaims{}, GetKontrolKey)
+}
+
+// TokenID gives the ID of the token, the "jti" claim, without
+// verifying the token. See Auth of the kite package for referencing
+// tokens by ID.
+func TokenID(token string) (string, error) {
+	claims := &KiteClaims{}
+
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, claims); err != nil {
+		return "", err
+	}
+
+	if claims.Id == "" {
+		return "", errors.New("token has no ID")
+	}
+
+	return claims.Id, nil
 }
 
 // Extractor is used to extract kontrol key from JWT token.
@@ -0,0 +1,132 @@
+package kitekey_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/koding/kite/v2/kitekey"
+)
+
+func TestReadWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kitekey")
+	if err != nil {
+		t.Fatalf("TempDir()=%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := os.Getenv("KITE_HOME")
+	os.Setenv("KITE_HOME", dir)
+	defer os.Setenv("KITE_HOME", old)
+
+	key := strings.Repeat("kite.key", 100)
+
+	cases := []struct {
+		name  string
+		write func(string) error
+	}{
+		{"plain", kitekey.Write},
+		{"compressed", kitekey.WriteCompressed},
+		{"split", func(key string) error { return kitekey.WriteSplit(key, 300) }},
+		{"plain after split", kitekey.Write},
+	}
+
+	for _, cas := range cases {
+		if err := cas.write(key); err != nil {
+			t.Fatalf("%s: write=%s", cas.name, err)
+		}
+
+		got, err := kitekey.Read()
+		if err != nil {
+			t.Fatalf("%s: Read()=%s", cas.name, err)
+		}
+
+		if got != key {
+			t.Fatalf("%s: got %q, want %q", cas.name, got, key)
+		}
+	}
+
+	// Write removes the parts of a split key.
+	parts, err := filepath.Glob(filepath.Join(dir, "kite.key.*"))
+	if err != nil {
+		t.Fatalf("Glob()=%s", err)
+	}
+
+	if len(parts) != 0 {
+		t.Fatalf("got %v, want no parts", parts)
+	}
+}
+
+func TestReadEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kitekey")
+	if err != nil {
+		t.Fatalf("TempDir()=%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := os.Getenv("KITE_HOME")
+	os.Setenv("KITE_HOME", dir)
+	defer os.Setenv("KITE_HOME", old)
+
+	if err := kitekey.Write("file"); err != nil {
+		t.Fatalf("Write()=%s", err)
+	}
+
+	os.Setenv("KITE_KEY", "env\n")
+	defer os.Unsetenv("KITE_KEY")
+
+	got, err := kitekey.Read()
+	if err != nil {
+		t.Fatalf("Read()=%s", err)
+	}
+
+	if got != "env" {
+		t.Fatalf("got %q, want %q", got, "env")
+	}
+}
+
+func TestWriteConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kitekey")
+	if err != nil {
+		t.Fatalf("TempDir()=%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := os.Getenv("KITE_HOME")
+	os.Setenv("KITE_HOME", dir)
+	defer os.Setenv("KITE_HOME", old)
+
+	keys := make(map[string]bool)
+	errs := make(chan error, 10)
+
+	for i := 0; i < cap(errs); i++ {
+		key := strings.Repeat(strconv.Itoa(i), 1000)
+		keys[key] = true
+
+		go func(i int) {
+			if i%2 == 0 {
+				errs <- kitekey.WriteSplit(key, 300)
+			} else {
+				errs <- kitekey.Write(key)
+			}
+		}(i)
+	}
+
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("write=%s", err)
+		}
+	}
+
+	got, err := kitekey.Read()
+	if err != nil {
+		t.Fatalf("Read()=%s", err)
+	}
+
+	if !keys[got] {
+		t.Fatalf("got %q, want one of the written keys", got)
+	}
+}
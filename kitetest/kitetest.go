@@ -10,7 +10,7 @@ import (
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
-	"github.com/koding/kite/protocol"
+	"github.com/koding/kite/v2/protocol"
 	uuid "github.com/satori/go.uuid"
 )
 
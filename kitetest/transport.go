@@ -0,0 +1,210 @@
+package kitetest
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Session is a connection which exchanges text messages, it mirrors
+// the kite.Session interface.
+type Session interface {
+	ID() string
+	Recv() (string, error)
+	Send(string) error
+	Close(status uint32, reason string) error
+}
+
+// Pipe gives a pair of connected sessions, the client one dialed by
+// a transport under test and the server one accepted by a kite.
+type Pipe func(t *testing.T) (client, server Session)
+
+// TransportTimeout is the time each receive of the transport
+// conformance suite waits for a message.
+var TransportTimeout = 10 * time.Second
+
+// TestTransport runs the conformance suite for a transport, which is
+// meant to be used with kite.Client.Transport. Each test of the suite
+// uses a new pair of sessions given by the pipe.
+//
+// Example:
+//
+//	func TestQUICTransport(t *testing.T) {
+//		kitetest.TestTransport(t, func(t *testing.T) (client, server kitetest.Session) {
+//			...
+//		})
+//	}
+func TestTransport(t *testing.T, pipe Pipe) {
+	t.Run("Ordering", func(t *testing.T) { testOrdering(t, pipe) })
+	t.Run("LargeMessage", func(t *testing.T) { testLargeMessage(t, pipe) })
+	t.Run("ConcurrentSend", func(t *testing.T) { testConcurrentSend(t, pipe) })
+	t.Run("Close", func(t *testing.T) { testClose(t, pipe) })
+}
+
+type recvResult struct {
+	msg string
+	err error
+}
+
+// recv receives a message from the session, waiting up to TransportTimeout.
+func recv(s Session) (string, error) {
+	ch := make(chan recvResult, 1)
+
+	go func() {
+		msg, err := s.Recv()
+		ch <- recvResult{msg: msg, err: err}
+	}()
+
+	select {
+	case res := <-ch:
+		return res.msg, res.err
+	case <-time.After(TransportTimeout):
+		return "", fmt.Errorf("timed out after %s waiting for a message", TransportTimeout)
+	}
+}
+
+func closePipe(client, server Session) {
+	client.Close(3000, "Go away!")
+	server.Close(3000, "Go away!")
+}
+
+func testOrdering(t *testing.T, pipe Pipe) {
+	const n = 100
+
+	client, server := pipe(t)
+	defer closePipe(client, server)
+
+	for _, dir := range []struct {
+		name     string
+		from, to Session
+	}{
+		{"client to server", client, server},
+		{"server to client", server, client},
+	} {
+		go func(from Session) {
+			for i := 0; i < n; i++ {
+				if err := from.Send(fmt.Sprintf("message %d", i)); err != nil {
+					return
+				}
+			}
+		}(dir.from)
+
+		for i := 0; i < n; i++ {
+			msg, err := recv(dir.to)
+			if err != nil {
+				t.Fatalf("%s: Recv()=%s", dir.name, err)
+			}
+
+			if want := fmt.Sprintf("message %d", i); msg != want {
+				t.Fatalf("%s: got %q, want %q", dir.name, msg, want)
+			}
+		}
+	}
+}
+
+func testLargeMessage(t *testing.T, pipe Pipe) {
+	client, server := pipe(t)
+	defer closePipe(client, server)
+
+	// The message contains characters, which need escaping when
+	// encoded as JSON.
+	want := strings.Repeat("kite \"large\" message\n", 1<<20/21)
+
+	go client.Send(want)
+
+	msg, err := recv(server)
+	if err != nil {
+		t.Fatalf("Recv()=%s", err)
+	}
+
+	if msg != want {
+		t.Fatalf("got message of %d bytes, want %d bytes", len(msg), len(want))
+	}
+}
+
+func testConcurrentSend(t *testing.T, pipe Pipe) {
+	const senders, n = 10, 50
+
+	client, server := pipe(t)
+	defer closePipe(client, server)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, senders)
+
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < n; j++ {
+				if err := client.Send(fmt.Sprintf("%d:%d", i, j)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+
+	// Messages of a single sender must be received in order.
+	next := make([]int, senders)
+
+	for k := 0; k < senders*n; k++ {
+		msg, err := recv(server)
+		if err != nil {
+			t.Fatalf("Recv()=%s (received %d messages)", err, k)
+		}
+
+		var i, j int
+		if _, err := fmt.Sscanf(msg, "%d:%d", &i, &j); err != nil || i < 0 || i >= senders {
+			t.Fatalf("unexpected message %q", msg)
+		}
+
+		if j != next[i] {
+			t.Fatalf("got message %d from sender %d, want %d", j, i, next[i])
+		}
+
+		next[i]++
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("Send()=%s", err)
+	}
+}
+
+func testClose(t *testing.T, pipe Pipe) {
+	client, server := pipe(t)
+	defer closePipe(client, server)
+
+	// Send may block until the peer receives the message.
+	sent := make(chan error, 1)
+	go func() { sent <- client.Send("ping") }()
+
+	if _, err := recv(server); err != nil {
+		t.Fatalf("Recv()=%s", err)
+	}
+
+	if err := <-sent; err != nil {
+		t.Fatalf("Send()=%s", err)
+	}
+
+	if err := client.Close(3000, "Go away!"); err != nil {
+		t.Fatalf("Close()=%s", err)
+	}
+
+	if err := client.Send("ping"); err == nil {
+		t.Fatal("want Send() to fail after Close()")
+	}
+
+	if _, err := recv(client); err == nil {
+		t.Fatal("want Recv() to fail after Close()")
+	}
+
+	if _, err := recv(server); err == nil {
+		t.Fatal("want Recv() of the peer to fail after Close()")
+	}
+}
@@ -38,6 +38,8 @@ CREATE UNLOGGED TABLE "kite"."kite" (
     created_at timestamptz NOT NULL DEFAULT (NOW() AT TIME ZONE 'UTC'), -- you may set a global timezone
     updated_at timestamptz NOT NULL DEFAULT (NOW() AT TIME ZONE 'UTC'),
     key_id UUID NOT NULL,
+    methods TEXT, -- JSON array of the methods published by the kite
+    labels JSONB, -- JSON object of the labels of the kite
 
     CONSTRAINT "kite_key_id_fkey" FOREIGN KEY ("key_id") REFERENCES kite.key (id) ON UPDATE NO ACTION ON DELETE NO ACTION NOT DEFERRABLE INITIALLY IMMEDIATE
 );
@@ -50,3 +52,16 @@ DROP INDEX IF EXISTS kite_updated_at_btree_idx;
 
 CREATE INDEX kite_updated_at_btree_idx ON "kite"."kite" USING BTREE (updated_at DESC);
 
+-- the index supports label selectors, which use the containment operator
+DROP INDEX IF EXISTS kite_labels_gin_idx;
+
+CREATE INDEX kite_labels_gin_idx ON "kite"."kite" USING GIN (labels jsonb_path_ops);
+
+-- create the counter table, which holds quota counters
+CREATE UNLOGGED TABLE IF NOT EXISTS "kite"."counter" (
+    key TEXT PRIMARY KEY,
+    value BIGINT NOT NULL,
+    expires_at timestamptz NOT NULL
+);
+
+GRANT SELECT, INSERT, UPDATE, DELETE ON "kite"."counter" TO "kontrol";
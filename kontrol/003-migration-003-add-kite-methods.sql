@@ -0,0 +1,11 @@
+-- add methods column into kite table, it holds a JSON array of the methods
+-- published by the kite
+DO $$
+  BEGIN
+    BEGIN
+      ALTER TABLE kite.kite ADD COLUMN "methods" TEXT;
+    EXCEPTION
+      WHEN duplicate_column THEN RAISE NOTICE 'methods column already exists';
+    END;
+  END;
+$$;
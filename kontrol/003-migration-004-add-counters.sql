@@ -0,0 +1,8 @@
+-- add counter table, it holds quota counters shared by kontrol replicas
+CREATE UNLOGGED TABLE IF NOT EXISTS "kite"."counter" (
+    key TEXT PRIMARY KEY,
+    value BIGINT NOT NULL,
+    expires_at timestamptz NOT NULL
+);
+
+GRANT SELECT, INSERT, UPDATE, DELETE ON "kite"."counter" TO "kontrol";
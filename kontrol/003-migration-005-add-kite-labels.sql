@@ -0,0 +1,14 @@
+-- add labels column into kite table, it holds a JSON object of the labels
+-- the kite registered with
+DO $$
+  BEGIN
+    BEGIN
+      ALTER TABLE kite.kite ADD COLUMN "labels" JSONB;
+    EXCEPTION
+      WHEN duplicate_column THEN RAISE NOTICE 'labels column already exists';
+    END;
+  END;
+$$;
+
+-- the index supports label selectors, which use the containment operator
+CREATE INDEX IF NOT EXISTS kite_labels_gin_idx ON "kite"."kite" USING GIN (labels jsonb_path_ops);
@@ -5,9 +5,9 @@ import (
 
 	etcd "github.com/coreos/etcd/client"
 	"github.com/hashicorp/go-version"
-	"github.com/koding/kite"
-	"github.com/koding/kite/dnode"
-	"github.com/koding/kite/protocol"
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/dnode"
+	"github.com/koding/kite/v2/protocol"
 )
 
 type Event struct {
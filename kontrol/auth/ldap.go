@@ -0,0 +1,249 @@
+// Package auth provides authenticators for the "registerMachine" kontrol
+// method, which gate issuing of kite keys, see kontrol.MachineAuthenticate.
+package auth
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/koding/kite/v2"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+// LDAP authenticates users of the "registerMachine" method with their
+// LDAP or Active Directory credentials. The user is looked up by the
+// username of the registering kite and a bind with the user's password
+// is attempted, optionally followed by a check of the group membership.
+//
+// The password is read from the "password" field of the method argument:
+//
+//	{"authType": "ldap", "password": "secret"}
+//
+// Example:
+//
+//	a := &auth.LDAP{
+//		URL:         "ldaps://ldap.example.com",
+//		BaseDN:      "dc=example,dc=com",
+//		BindDN:      "cn=kontrol,ou=services,dc=example,dc=com",
+//		Password:    "...",
+//		GroupFilter: "(&(objectClass=groupOfNames)(cn=kite-users)(member=%s))",
+//	}
+//
+//	k.MachineAuthenticate = a.Authenticate
+type LDAP struct {
+	// URL is the address of the server, like "ldap://ldap.example.com:389"
+	// or "ldaps://ldap.example.com:636".
+	URL string
+
+	// BaseDN is the base of the user and group searches,
+	// like "dc=example,dc=com".
+	BaseDN string
+
+	// BindDN and Password are the credentials used to search users
+	// and groups. If BindDN is empty, the searches are anonymous.
+	BindDN   string
+	Password string
+
+	// UserFilter is the filter of the user search, where %s is replaced
+	// with the username. If empty, "(uid=%s)" is used. Active Directory
+	// users are found with "(sAMAccountName=%s)".
+	UserFilter string
+
+	// GroupFilter, when non-empty, is the filter of a group search,
+	// where %s is replaced with the DN of the user. The user is
+	// authenticated only if the search finds a group.
+	GroupFilter string
+
+	// StartTLS upgrades ldap:// connections to TLS.
+	StartTLS bool
+
+	// TLSConfig is used for ldaps:// and StartTLS connections.
+	TLSConfig *tls.Config
+
+	// Timeout bounds dialing the server and each of the requests.
+	// If zero, 15s is used.
+	Timeout time.Duration
+}
+
+// Authenticate authenticates the request of the "registerMachine" method,
+// it can be used as kontrol.MachineAuthenticate. The authType must be
+// either "ldap" or empty.
+func (l *LDAP) Authenticate(authType string, r *kite.Request) error {
+	if authType != "" && authType != "ldap" {
+		return fmt.Errorf("unsupported authentication type: %q", authType)
+	}
+
+	var args struct {
+		Password string `json:"password"`
+	}
+
+	if err := r.Args.One().Unmarshal(&args); err != nil {
+		return fmt.Errorf("invalid argument: %s", err)
+	}
+
+	username := r.Client.Kite.Username
+
+	if username == "" {
+		return errors.New("username is required")
+	}
+
+	// An empty password makes an unauthenticated bind, which succeeds.
+	if args.Password == "" {
+		return errors.New("password is required")
+	}
+
+	conn, err := l.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := l.bind(conn); err != nil {
+		return err
+	}
+
+	filter := l.UserFilter
+	if filter == "" {
+		filter = "(uid=%s)"
+	}
+
+	users, err := l.search(conn, fmt.Sprintf(filter, ldap.EscapeFilter(username)))
+	if err != nil {
+		return fmt.Errorf("unable to search user %q: %s", username, err)
+	}
+
+	switch len(users) {
+	case 0:
+		return fmt.Errorf("user %q is not found", username)
+	case 1:
+	default:
+		return fmt.Errorf("username %q matches more than one user", username)
+	}
+
+	userDN := users[0].DN
+
+	if err := conn.Bind(userDN, args.Password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return fmt.Errorf("invalid credentials of user %q", username)
+		}
+
+		return err
+	}
+
+	if l.GroupFilter == "" {
+		return nil
+	}
+
+	// The user may not be allowed to search groups.
+	if err := l.bind(conn); err != nil {
+		return err
+	}
+
+	groups, err := l.search(conn, fmt.Sprintf(l.GroupFilter, ldap.EscapeFilter(userDN)))
+	if err != nil {
+		return fmt.Errorf("unable to search groups of user %q: %s", username, err)
+	}
+
+	if len(groups) == 0 {
+		return fmt.Errorf("user %q is not a member of the group", username)
+	}
+
+	return nil
+}
+
+func (l *LDAP) timeout() time.Duration {
+	if l.Timeout != 0 {
+		return l.Timeout
+	}
+
+	return 15 * time.Second
+}
+
+func (l *LDAP) dial() (*ldap.Conn, error) {
+	u, err := url.Parse(l.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP URL: %s", err)
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		switch u.Scheme {
+		case "ldap":
+			host = net.JoinHostPort(u.Hostname(), "389")
+		case "ldaps":
+			host = net.JoinHostPort(u.Hostname(), "636")
+		}
+	}
+
+	tlsConfig := l.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: u.Hostname()}
+	}
+
+	var conn net.Conn
+
+	switch u.Scheme {
+	case "ldap":
+		conn, err = net.DialTimeout("tcp", host, l.timeout())
+	case "ldaps":
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: l.timeout()}, "tcp", host, tlsConfig)
+	default:
+		return nil, fmt.Errorf("unsupported LDAP URL scheme: %q", u.Scheme)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	c := ldap.NewConn(conn, u.Scheme == "ldaps")
+	c.SetTimeout(l.timeout())
+	c.Start()
+
+	if l.StartTLS && u.Scheme == "ldap" {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// bind binds with the search credentials.
+func (l *LDAP) bind(conn *ldap.Conn) error {
+	if l.BindDN == "" {
+		return nil
+	}
+
+	if err := conn.Bind(l.BindDN, l.Password); err != nil {
+		return fmt.Errorf("unable to bind as %q: %s", l.BindDN, err)
+	}
+
+	return nil
+}
+
+func (l *LDAP) search(conn *ldap.Conn, filter string) ([]*ldap.Entry, error) {
+	req := ldap.NewSearchRequest(
+		l.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(l.timeout()/time.Second), false,
+		filter,
+		[]string{"1.1"}, // no attributes
+		nil,
+	)
+
+	res, err := conn.Search(req)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, err
+	}
+
+	if res == nil {
+		return nil, nil
+	}
+
+	return res.Entries, nil
+}
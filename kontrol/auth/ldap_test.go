@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"net"
+	"testing"
+
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/dnode"
+	"github.com/koding/kite/v2/protocol"
+
+	ber "gopkg.in/asn1-ber.v1"
+	ldap "gopkg.in/ldap.v2"
+)
+
+// ldapServer is an embedded LDAP server, which serves binds and searches
+// of fixed entries.
+type ldapServer struct {
+	l         net.Listener
+	passwords map[string]string   // keyed by DN
+	entries   map[string][]string // DNs keyed by search filter
+}
+
+func newLDAPServer(t *testing.T) *ldapServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen()=%s", err)
+	}
+
+	s := &ldapServer{
+		l: l,
+		passwords: map[string]string{
+			"cn=kontrol,dc=example,dc=com":          "kontrol",
+			"uid=alice,ou=people,dc=example,dc=com": "alice",
+			"uid=bob,ou=people,dc=example,dc=com":   "bob",
+		},
+		entries: map[string][]string{
+			"(uid=alice)": {"uid=alice,ou=people,dc=example,dc=com"},
+			"(uid=bob)":   {"uid=bob,ou=people,dc=example,dc=com"},
+			"(&(cn=kite)(member=uid=alice,ou=people,dc=example,dc=com))": {"cn=kite,ou=groups,dc=example,dc=com"},
+		},
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *ldapServer) URL() string {
+	return "ldap://" + s.l.Addr().String()
+}
+
+func (s *ldapServer) Close() error {
+	return s.l.Close()
+}
+
+func (s *ldapServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		p, err := ber.ReadPacket(conn)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+
+		id := p.Children[0].Value.(int64)
+		op := p.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn, password := op.Children[1].Data.String(), op.Children[2].Data.String()
+
+			code := ldap.LDAPResultInvalidCredentials
+			if pass, ok := s.passwords[dn]; ok && pass == password {
+				code = ldap.LDAPResultSuccess
+			}
+
+			s.write(conn, id, result(ldap.ApplicationBindResponse, code))
+		case ldap.ApplicationSearchRequest:
+			filter, err := ldap.DecompileFilter(op.Children[6])
+			if err != nil {
+				return
+			}
+
+			for _, dn := range s.entries[filter] {
+				entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+				entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, ""))
+				entry.AppendChild(ber.NewSequence(""))
+
+				s.write(conn, id, entry)
+			}
+
+			s.write(conn, id, result(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+		default:
+			return
+		}
+	}
+}
+
+func (s *ldapServer) write(conn net.Conn, id int64, op *ber.Packet) {
+	p := ber.NewSequence("")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	p.AppendChild(op)
+
+	conn.Write(p.Bytes())
+}
+
+func result(tag ber.Tag, code int) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return p
+}
+
+func newRequest(username, args string) *kite.Request {
+	return &kite.Request{
+		Client: &kite.Client{Kite: protocol.Kite{Username: username}},
+		Args:   &dnode.Partial{Raw: []byte(args)},
+	}
+}
+
+func TestLDAP(t *testing.T) {
+	s := newLDAPServer(t)
+	defer s.Close()
+
+	a := &LDAP{
+		URL:         s.URL(),
+		BaseDN:      "dc=example,dc=com",
+		BindDN:      "cn=kontrol,dc=example,dc=com",
+		Password:    "kontrol",
+		GroupFilter: "(&(cn=kite)(member=%s))",
+	}
+
+	cases := []struct {
+		name     string
+		authType string
+		username string
+		args     string
+		ok       bool
+	}{
+		{"member", "ldap", "alice", `[{"password": "alice"}]`, true},
+		{"empty auth type", "", "alice", `[{"password": "alice"}]`, true},
+		{"invalid password", "ldap", "alice", `[{"password": "bob"}]`, false},
+		{"empty password", "ldap", "alice", `[{}]`, false},
+		{"not member", "ldap", "bob", `[{"password": "bob"}]`, false},
+		{"unknown user", "ldap", "carol", `[{"password": "carol"}]`, false},
+		{"other auth type", "kiteKey", "alice", `[{"password": "alice"}]`, false},
+	}
+
+	for _, cas := range cases {
+		t.Run(cas.name, func(t *testing.T) {
+			err := a.Authenticate(cas.authType, newRequest(cas.username, cas.args))
+
+			if cas.ok && err != nil {
+				t.Fatalf("Authenticate()=%s", err)
+			}
+
+			if !cas.ok && err == nil {
+				t.Fatal("want Authenticate() to fail")
+			}
+		})
+	}
+
+	a.BindDN = "invalid"
+
+	if err := a.Authenticate("ldap", newRequest("alice", `[{"password": "alice"}]`)); err == nil {
+		t.Fatal("want Authenticate() to fail with invalid bind DN")
+	}
+}
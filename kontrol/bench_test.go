@@ -3,8 +3,8 @@ package kontrol
 import (
 	"testing"
 
-	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
-	"github.com/koding/kite/protocol"
+	kontrolprotocol "github.com/koding/kite/v2/kontrol/protocol"
+	"github.com/koding/kite/v2/protocol"
 	uuid "github.com/satori/go.uuid"
 )
 
@@ -0,0 +1,146 @@
+package kontrol
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/koding/kite/v2"
+)
+
+// StorageDriver opens a storage of the given source, whose format is
+// specific to the driver, like a connection string. If the returned
+// storage implements KeyPairStorage as well, it stores key pairs too.
+type StorageDriver func(source string, log kite.Logger) (Storage, error)
+
+var storageDrivers = struct {
+	sync.RWMutex
+	m map[string]StorageDriver
+}{
+	m: map[string]StorageDriver{
+		"etcd":     openEtcd,
+		"memory":   openMemory,
+		"mongo":    openMongo,
+		"postgres": openPostgres,
+	},
+}
+
+// RegisterStorage makes the storage driver available under the given
+// name, so storages of third-party drivers can be used with UseStorage.
+// It's meant to be called from the init function of the driver package.
+//
+// The built-in drivers are:
+//
+//   - "etcd", whose source is a comma-separated list of etcd machines,
+//     see NewEtcd
+//   - "memory", whose source is a path of the snapshot file, or empty
+//     not to persist the kites; the snapshot is written every minute,
+//     see MemoryStorage
+//   - "mongo", whose source is a MongoDB URL, or empty to read
+//     the configuration from the environment, see NewMongo
+//   - "postgres", whose source is a lib/pq connection string, or empty
+//     to read the configuration from the environment, see NewPostgres
+//
+// RegisterStorage panics if the name is empty or already registered,
+// or the driver is nil.
+func RegisterStorage(name string, driver StorageDriver) {
+	if name == "" {
+		panic("kontrol: storage driver name cannot be empty")
+	}
+
+	if driver == nil {
+		panic(fmt.Sprintf("kontrol: storage driver %q is nil", name))
+	}
+
+	storageDrivers.Lock()
+	defer storageDrivers.Unlock()
+
+	if _, ok := storageDrivers.m[name]; ok {
+		panic(fmt.Sprintf("kontrol: storage driver %q is already registered", name))
+	}
+
+	storageDrivers.m[name] = driver
+}
+
+// StorageDrivers gives names of the registered storage drivers, sorted.
+func StorageDrivers() []string {
+	storageDrivers.RLock()
+	defer storageDrivers.RUnlock()
+
+	names := make([]string, 0, len(storageDrivers.m))
+	for name := range storageDrivers.m {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// UseStorage opens a storage of the registered driver and sets it as
+// the storage of kontrol, see SetStorage. If the storage stores key
+// pairs as well, it is set as the key pair storage too.
+func (k *Kontrol) UseStorage(driver, source string) error {
+	storageDrivers.RLock()
+	open, ok := storageDrivers.m[driver]
+	storageDrivers.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("unknown storage driver %q, registered ones are: %s",
+			driver, strings.Join(StorageDrivers(), ", "))
+	}
+
+	storage, err := open(source, k.Kite.Log)
+	if err != nil {
+		return fmt.Errorf("unable to open %q storage: %s", driver, err)
+	}
+
+	k.SetStorage(storage)
+
+	if keyPair, ok := storage.(KeyPairStorage); ok {
+		k.SetKeyPairStorage(keyPair)
+	}
+
+	return nil
+}
+
+func openEtcd(source string, log kite.Logger) (Storage, error) {
+	var machines []string
+
+	if source != "" {
+		machines = strings.Split(source, ",")
+	}
+
+	return NewEtcd(machines, log), nil
+}
+
+func openPostgres(source string, log kite.Logger) (Storage, error) {
+	if source == "" {
+		return NewPostgres(nil, log), nil
+	}
+
+	return newPostgres(source, log)
+}
+
+func openMemory(source string, log kite.Logger) (Storage, error) {
+	m := NewMemoryStorage()
+
+	if source != "" {
+		if err := m.Persist(source, time.Minute); err != nil {
+			m.Close()
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+func openMongo(source string, log kite.Logger) (Storage, error) {
+	if source == "" {
+		return NewMongo(nil, log), nil
+	}
+
+	return newMongo(source, "", 20*time.Second, log)
+}
@@ -0,0 +1,124 @@
+package kontrol
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/kitekey"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	uuid "github.com/satori/go.uuid"
+)
+
+// AddEnvironmentKeyPair adds the given key pair and scopes it to the
+// environment. If id is empty, a unique ID will be generated.
+//
+// Scoped key pairs are used to sign kite keys for kites of the environment
+// and the tokens for them. Kontrol rejects kites registering with a kite key,
+// which was signed by a key pair scoped to a different environment, and
+// does not issue tokens for kites of the environment to kites authenticated
+// with a key of a different one. This way a leaked development key can't
+// be used to obtain tokens valid in production.
+//
+// Key pairs added with AddKeyPair are not scoped and remain valid for
+// all environments.
+func (k *Kontrol) AddEnvironmentKeyPair(environment, id, public, private string) error {
+	if environment == "" {
+		return errors.New("environment is empty")
+	}
+
+	if k.keyPair == nil {
+		k.log.Warning("Key pair storage is not set. Using in memory cache")
+		k.keyPair = NewMemKeyPairStorage()
+	}
+
+	if id == "" {
+		i, err := uuid.NewV4()
+		if err != nil {
+			return err
+		}
+		id = i.String()
+	}
+
+	keyPair := &KeyPair{
+		ID:      id,
+		Public:  strings.TrimSpace(public),
+		Private: strings.TrimSpace(private),
+	}
+
+	if err := keyPair.Validate(); err != nil {
+		return err
+	}
+
+	if err := k.keyPair.AddKey(keyPair); err != nil {
+		return err
+	}
+
+	k.envKeysMu.Lock()
+	if k.envKeys == nil {
+		k.envKeys = make(map[string]*KeyPair)
+		k.keyEnvs = make(map[string]string)
+	}
+	k.envKeys[environment] = keyPair
+	k.keyEnvs[keyPair.Public] = environment
+	k.envKeysMu.Unlock()
+
+	return nil
+}
+
+// environmentKeyPair gives the key pair scoped to the given environment,
+// or nil if there is none.
+func (k *Kontrol) environmentKeyPair(environment string) *KeyPair {
+	k.envKeysMu.RLock()
+	defer k.envKeysMu.RUnlock()
+
+	return k.envKeys[environment]
+}
+
+// keyEnvironment gives the environment the given public key is scoped to,
+// or empty string if the key is not scoped.
+func (k *Kontrol) keyEnvironment(public string) string {
+	k.envKeysMu.RLock()
+	defer k.envKeysMu.RUnlock()
+
+	return k.keyEnvs[strings.TrimSpace(public)]
+}
+
+// checkKeyEnvironment returns non-nil error if the key pair is scoped
+// to an environment other than the given one.
+func (k *Kontrol) checkKeyEnvironment(keyPair *KeyPair, environment string) error {
+	if env := k.keyEnvironment(keyPair.Public); env != "" && env != environment {
+		return fmt.Errorf("kontrol key is not valid for environment %q", environment)
+	}
+
+	return nil
+}
+
+// checkTokenEnvironment returns non-nil error if the kite making
+// the request must not be given a token signed with the key pair.
+func (k *Kontrol) checkTokenEnvironment(r *kite.Request, keyPair *KeyPair) error {
+	env := k.keyEnvironment(keyPair.Public)
+	if env == "" {
+		return nil
+	}
+
+	if r.Auth == nil || r.Auth.Type != "kiteKey" {
+		return fmt.Errorf("tokens for kites in environment %q require kite key authentication", env)
+	}
+
+	ex := &kitekey.Extractor{
+		Claims: &kitekey.KiteClaims{},
+	}
+
+	if _, err := jwt.ParseWithClaims(r.Auth.Key, ex.Claims, ex.Extract); err != nil {
+		return err
+	}
+
+	if keyEnv := k.keyEnvironment(ex.Claims.KontrolKey); keyEnv != "" && keyEnv != env {
+		return fmt.Errorf("kite from environment %q is not allowed to get tokens for environment %q", keyEnv, env)
+	}
+
+	return nil
+}
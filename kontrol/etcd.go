@@ -5,14 +5,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
 	etcd "github.com/coreos/etcd/client"
 	"github.com/hashicorp/go-version"
-	"github.com/koding/kite"
-	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
-	"github.com/koding/kite/protocol"
+	"github.com/koding/kite/v2"
+	kontrolprotocol "github.com/koding/kite/v2/kontrol/protocol"
+	"github.com/koding/kite/v2/protocol"
 )
 
 // keyOrder defines the order of the query parameters.
@@ -124,10 +125,11 @@ func (e *Etcd) Add(k *protocol.Kite, v *kontrolprotocol.RegisterValue) error {
 		return err
 	}
 
-	// Also store the the kite.Key Id for easy lookup
+	// Also store the the kite.Key Id for easy lookup, the value is the
+	// kite key, which is looked up by etcdKey.
 	_, err = e.client.Set(context.TODO(),
 		etcdIDKey,
-		value,
+		k.String(),
 		&etcd.SetOptions{
 			TTL:       KeyTTL,
 			PrevExist: etcd.PrevIgnore,
@@ -166,7 +168,7 @@ func (e *Etcd) Update(k *protocol.Kite, v *kontrolprotocol.RegisterValue) error
 	// Also update the the kite.Key Id for easy lookup
 	_, err = e.client.Set(context.TODO(),
 		etcdIDKey,
-		value,
+		k.String(),
 		&etcd.SetOptions{
 			TTL:       KeyTTL,
 			PrevExist: etcd.PrevExist,
@@ -188,7 +190,98 @@ func (e *Etcd) Update(k *protocol.Kite, v *kontrolprotocol.RegisterValue) error
 	return err
 }
 
+// Incr implements the Counter interface. The counters are kept under
+// the CountersPrefix, they're incremented with compare-and-swap.
+func (e *Etcd) Incr(key string, window time.Duration) (int64, error) {
+	etcdKey := CountersPrefix + "/" + key
+
+	for {
+		resp, err := e.client.Get(context.TODO(), etcdKey, nil)
+		if etcd.IsKeyNotFound(err) {
+			_, err = e.client.Set(context.TODO(), etcdKey, "1", &etcd.SetOptions{
+				TTL:       window,
+				PrevExist: etcd.PrevNoExist,
+			})
+
+			if isEtcdError(err, etcd.ErrorCodeNodeExist) {
+				continue
+			}
+
+			if err != nil {
+				return 0, err
+			}
+
+			return 1, nil
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		n, err := strconv.ParseInt(resp.Node.Value, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("malformed counter %q: %s", key, err)
+		}
+
+		// Keep the counter expiring at the end of its window.
+		ttl := window
+		if resp.Node.Expiration != nil {
+			ttl = time.Until(*resp.Node.Expiration)
+		}
+
+		if ttl < time.Second {
+			ttl = time.Second
+		}
+
+		_, err = e.client.Set(context.TODO(), etcdKey, strconv.FormatInt(n+1, 10), &etcd.SetOptions{
+			TTL:       ttl,
+			PrevIndex: resp.Node.ModifiedIndex,
+		})
+
+		// The counter was modified or expired in the meantime, try again.
+		if isEtcdError(err, etcd.ErrorCodeTestFailed) || etcd.IsKeyNotFound(err) {
+			continue
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		return n + 1, nil
+	}
+}
+
+func isEtcdError(err error, code int) bool {
+	e, ok := err.(etcd.Error)
+	return ok && e.Code == code
+}
+
 func (e *Etcd) Get(query *protocol.KontrolQuery) (Kites, error) {
+	kites, err := e.get(query)
+	if err != nil {
+		return nil, err
+	}
+
+	// Shuffle the list
+	kites.Shuffle()
+
+	return kites, nil
+}
+
+// GetPage implements the Pager interface. Etcd can't page the kites,
+// so all of them are fetched and the page is taken afterwards.
+func (e *Etcd) GetPage(query *protocol.KontrolQuery, offset, limit int) (Kites, int, error) {
+	kites, err := e.get(query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total := kites.Page(offset, limit)
+
+	return kites, total, nil
+}
+
+func (e *Etcd) get(query *protocol.KontrolQuery) (Kites, error) {
 	// We will make a get request to etcd store with this key. So get a "etcd"
 	// key from the given query so that we can use it to query from Etcd.
 	etcdKey, err := e.etcdKey(query)
@@ -196,6 +289,11 @@ func (e *Etcd) Get(query *protocol.KontrolQuery) (Kites, error) {
 		return nil, err
 	}
 
+	selector, err := protocol.ParseLabels(query.Labels)
+	if err != nil {
+		return nil, err
+	}
+
 	// If version field contains a constraint we need no make a new query up to
 	// "name" field and filter the results after getting all versions.
 	// NewVersion returns an error if it's a constraint, like: ">= 1.0, < 1.4"
@@ -264,10 +362,15 @@ func (e *Etcd) Get(query *protocol.KontrolQuery) (Kites, error) {
 		if hasVersionConstraint {
 			kites.Filter(versionConstraint, keyRest)
 		}
+
+		// kites are ordered by modification index, so the most
+		// recent entry of each kite is kept
+		if DedupKites {
+			kites.Dedup()
+		}
 	}
 
-	// Shuffle the list
-	kites.Shuffle()
+	kites.FilterLabels(selector)
 
 	return kites, nil
 }
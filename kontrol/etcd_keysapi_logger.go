@@ -4,7 +4,7 @@ import (
 	"context"
 
 	etcd "github.com/coreos/etcd/client"
-	"github.com/koding/kite"
+	"github.com/koding/kite/v2"
 )
 
 type KeysAPILogger struct {
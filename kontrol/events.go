@@ -0,0 +1,202 @@
+package kontrol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/koding/kite/v2/protocol"
+)
+
+// EventType describes a lifecycle event of kontrol.
+type EventType string
+
+// Lifecycle events emitted by kontrol.
+const (
+	// KiteRegistered is emitted when a kite registers, either via
+	// the "register" method or via HTTP.
+	KiteRegistered EventType = "kite.registered"
+
+	// KiteDeregistered is emitted when the connection a kite registered
+	// with is closed.
+	KiteDeregistered EventType = "kite.deregistered"
+
+	// HeartbeatMissed is emitted when kontrol does not receive
+	// a heartbeat from a registered kite in time, the kite expires
+	// from the storage unless it sends a heartbeat again.
+	HeartbeatMissed EventType = "kite.heartbeatMissed"
+
+	// KeyRotated is emitted when connected kites are asked to refresh
+	// their keys with the "refreshKeys" method.
+	KeyRotated EventType = "key.rotated"
+
+	// TokenIssued is emitted when a new token is signed. Tokens served
+	// from the token cache are not reported.
+	TokenIssued EventType = "token.issued"
+)
+
+// Event describes a single lifecycle event of kontrol. Only the fields
+// relevant for the event type are set.
+type Event struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+
+	// Kite is the kite the event is about, it is not set
+	// for KeyRotated and TokenIssued events.
+	Kite *protocol.Kite `json:"kite,omitempty"`
+
+	// URL is the register URL of the kite, set for KiteRegistered.
+	URL string `json:"url,omitempty"`
+
+	// KeyID is the ID of the key pair, set for KiteRegistered
+	// and TokenIssued.
+	KeyID string `json:"keyID,omitempty"`
+
+	// Username is the user who rotated the keys or who the token was
+	// issued for.
+	Username string `json:"username,omitempty"`
+
+	// Audience is the audience of the issued token.
+	Audience string `json:"audience,omitempty"`
+}
+
+// EventPublisher delivers kontrol events to an external system, e.g.
+// a webhook or a message bus.
+type EventPublisher interface {
+	Publish(*Event) error
+}
+
+// EventPublisherFunc is a type adapter to allow the use of ordinary
+// functions as event publishers.
+type EventPublisherFunc func(*Event) error
+
+// Publish calls f(ev).
+func (f EventPublisherFunc) Publish(ev *Event) error {
+	return f(ev)
+}
+
+// EventQueueSize is the number of events, which are buffered before
+// they are delivered to publishers. Events, which do not fit into the
+// queue are dropped.
+var EventQueueSize = 1024
+
+// events delivers events to publishers in order, from a single goroutine,
+// so slow publishers do not block kontrol handlers.
+type events struct {
+	queue      chan *Event
+	publishers []EventPublisher
+	counts     map[EventType]int64
+	mu         sync.RWMutex // protects queue, publishers and counts
+}
+
+// AddEventPublisher adds the publisher, which receives all lifecycle
+// events of kontrol.
+func (k *Kontrol) AddEventPublisher(p EventPublisher) {
+	k.events.mu.Lock()
+	if k.events.queue == nil {
+		k.events.queue = make(chan *Event, EventQueueSize)
+		go k.publishEvents(k.events.queue)
+	}
+	k.events.publishers = append(k.events.publishers, p)
+	k.events.mu.Unlock()
+}
+
+// EventCounts gives the number of events emitted by kontrol so far,
+// by event type. The events are counted even if there are no publishers.
+func (k *Kontrol) EventCounts() map[EventType]int64 {
+	k.events.mu.RLock()
+	defer k.events.mu.RUnlock()
+
+	counts := make(map[EventType]int64, len(k.events.counts))
+	for typ, n := range k.events.counts {
+		counts[typ] = n
+	}
+
+	return counts
+}
+
+func (k *Kontrol) emit(ev *Event) {
+	ev.Time = time.Now().UTC()
+
+	switch ev.Type {
+	case KiteRegistered, KiteDeregistered, HeartbeatMissed:
+		k.invalidateQueries(ev.Kite)
+	}
+
+	k.events.mu.Lock()
+	if k.events.counts == nil {
+		k.events.counts = make(map[EventType]int64)
+	}
+	k.events.counts[ev.Type]++
+	queue := k.events.queue
+	k.events.mu.Unlock()
+
+	if queue == nil {
+		return
+	}
+
+	select {
+	case queue <- ev:
+	default:
+		k.log.Warning("event queue is full, dropping %q event", ev.Type)
+	}
+}
+
+func (k *Kontrol) publishEvents(queue <-chan *Event) {
+	for {
+		select {
+		case <-k.closed:
+			return
+		case ev := <-queue:
+			k.events.mu.RLock()
+			publishers := k.events.publishers
+			k.events.mu.RUnlock()
+
+			for _, p := range publishers {
+				if err := p.Publish(ev); err != nil {
+					k.log.Error("unable to publish %q event: %s", ev.Type, err)
+				}
+			}
+		}
+	}
+}
+
+// WebhookPublisher posts each event as JSON to the given URL.
+type WebhookPublisher struct {
+	// URL is the address of the webhook.
+	URL string
+
+	// Client is used to make the requests. If nil, http.DefaultClient
+	// is used.
+	Client *http.Client
+}
+
+var _ EventPublisher = (*WebhookPublisher)(nil)
+
+// Publish implements the EventPublisher interface.
+func (w *WebhookPublisher) Publish(ev *Event) error {
+	p, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Post(w.URL, "application/json", bytes.NewReader(p))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook responded with %q", resp.Status)
+	}
+
+	return nil
+}
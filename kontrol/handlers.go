@@ -1,19 +1,19 @@
 package kontrol
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/url"
-	"sync/atomic"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
-	"github.com/koding/kite"
-	"github.com/koding/kite/dnode"
-	"github.com/koding/kite/kitekey"
-	"github.com/koding/kite/kontrol/onceevery"
-	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
-	"github.com/koding/kite/protocol"
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/dnode"
+	"github.com/koding/kite/v2/kitekey"
+	kontrolprotocol "github.com/koding/kite/v2/kontrol/protocol"
+	"github.com/koding/kite/v2/protocol"
 )
 
 func (k *Kontrol) HandleRegister(r *kite.Request) (interface{}, error) {
@@ -26,7 +26,9 @@ func (k *Kontrol) HandleRegister(r *kite.Request) (interface{}, error) {
 	}
 
 	var args struct {
-		URL string `json:"url"`
+		URL     string            `json:"url"`
+		Methods []string          `json:"methods"`
+		Labels  map[string]string `json:"labels"`
 	}
 
 	if err := r.Args.One().Unmarshal(&args); err != nil {
@@ -41,6 +43,10 @@ func (k *Kontrol) HandleRegister(r *kite.Request) (interface{}, error) {
 		return nil, fmt.Errorf("invalid register URL: %s", err)
 	}
 
+	if err := protocol.ValidateLabels(args.Labels); err != nil {
+		return nil, fmt.Errorf("invalid labels: %s", err)
+	}
+
 	res := &protocol.RegisterResult{
 		URL: args.URL,
 	}
@@ -64,6 +70,10 @@ func (k *Kontrol) HandleRegister(r *kite.Request) (interface{}, error) {
 		return nil, err
 	}
 
+	if err := k.checkKeyEnvironment(keyPair, r.Client.Kite.Environment); err != nil {
+		return nil, err
+	}
+
 	if origKey != keyPair.Public {
 		// NOTE(rjeczalik): updates public key for old kites, new kites
 		// expect kite key to be updated
@@ -74,9 +84,29 @@ func (k *Kontrol) HandleRegister(r *kite.Request) (interface{}, error) {
 		return nil, err
 	}
 
+	kiteCopy := r.Client.Kite
+
+	admitArgs := &protocol.RegisterArgs{
+		URL:     args.URL,
+		Kite:    &kiteCopy,
+		Auth:    &protocol.Auth{Type: r.Auth.Type, Key: r.Auth.Key},
+		Methods: args.Methods,
+		Labels:  args.Labels,
+	}
+
+	if err := k.admit(r, admitArgs); err != nil {
+		return nil, err
+	}
+
 	value := &kontrolprotocol.RegisterValue{
-		URL:   args.URL,
-		KeyID: keyPair.ID,
+		URL:     args.URL,
+		KeyID:   keyPair.ID,
+		Methods: args.Methods,
+		Labels:  args.Labels,
+	}
+
+	if err := k.resolveConflict(r, args.URL); err != nil {
+		return nil, err
 	}
 
 	// Register first by adding the value to the storage. Return if there is
@@ -86,83 +116,160 @@ func (k *Kontrol) HandleRegister(r *kite.Request) (interface{}, error) {
 		return nil, errors.New("internal error - register")
 	}
 
-	every := onceevery.New(UpdateInterval)
-
-	ping := make(chan struct{}, 1)
-	closed := int32(0)
-
-	kiteCopy := r.Client.Kite
-
-	updaterFunc := func() {
-		for {
-			select {
-			case <-k.closed:
-				return
-			case <-ping:
-				k.log.Debug("Kite is active, got a ping %s", &kiteCopy)
-				every.Do(func() {
-					k.log.Debug("Kite is active, updating the value %s", &kiteCopy)
-					err := k.storage.Update(&kiteCopy, value)
-					if err != nil {
-						k.log.Error("storage update '%s' error: %s", &kiteCopy, err)
-					}
-				})
-			case <-time.After(HeartbeatInterval + HeartbeatDelay):
+	// track starts tracking heartbeats of the registration, replacing
+	// any previous registration of the kite
+	track := func() *heartbeat {
+		h := &heartbeat{
+			kite:  &kiteCopy,
+			owner: r.Client,
+			update: func() error {
+				return k.storage.Update(&kiteCopy, k.registerValue(kiteCopy.ID, value))
+			},
+			missed: func() {
 				k.log.Debug("Kite didn't sent any heartbeat %s.", &kiteCopy)
-				atomic.StoreInt32(&closed, 1)
-				return
-			}
+				k.emit(&Event{Type: HeartbeatMissed, Kite: &kiteCopy})
+			},
 		}
+
+		k.heartbeats.track(h)
+
+		return h
 	}
 
-	go updaterFunc()
+	track()
+
+	var heartbeat dnode.Function
+
+	heartbeat = dnode.Callback(func(args *dnode.Partial) {
+		k.log.Debug("Kite send us an heartbeat. %s", &kiteCopy)
 
-	heartbeatArgs := []interface{}{
-		HeartbeatInterval / time.Second,
-		dnode.Callback(func(args *dnode.Partial) {
-			k.log.Debug("Kite send us an heartbeat. %s", &kiteCopy)
+		k.clientLocks.Get(kiteCopy.ID).Lock()
+		defer k.clientLocks.Get(kiteCopy.ID).Unlock()
 
-			k.clientLocks.Get(kiteCopy.ID).Lock()
-			defer k.clientLocks.Get(kiteCopy.ID).Unlock()
+		h := k.beat(kiteCopy.ID)
 
-			select {
-			case ping <- struct{}{}:
-			default:
+		if h == nil {
+			if k.displaced(kiteCopy.ID, r.Client) {
+				k.log.Debug("Kite was displaced, ignoring its heartbeat %s", &kiteCopy)
+				return
 			}
 
 			// seems we miss a heartbeat, so start it again!
-			if atomic.CompareAndSwapInt32(&closed, 1, 0) {
-				k.log.Warning("Updater was closed, but we are still getting heartbeats. Starting again %s", &kiteCopy)
-
-				// it might be removed because the ttl cleaner would come
-				// before us, so try to add it again, the updater will than
-				// continue to update it afterwards.
-				k.storage.Upsert(&kiteCopy, value)
-				go updaterFunc()
-			}
-		}),
-	}
+			k.log.Warning("Updater was closed, but we are still getting heartbeats. Starting again %s", &kiteCopy)
 
-	// now trigger the remote kite so it sends us periodically an heartbeat
-	resp := r.Client.GoWithTimeout("kite.heartbeat", 4*time.Second, heartbeatArgs...)
+			// it might be removed because the ttl cleaner would come
+			// before us, so try to add it again, the scheduler will than
+			// continue to update it afterwards.
+			k.storage.Upsert(&kiteCopy, k.registerValue(kiteCopy.ID, value))
+			h = track()
+		}
 
-	go func() {
-		if err := (<-resp).Err; err != nil {
-			k.log.Error("failed requesting heartbeats from %q kite: %s", kiteCopy.Name, err)
+		// The interval is adjusted for the current registration only.
+		if h.owner != r.Client {
+			return
 		}
-	}()
+
+		if next := k.heartbeatInterval(&kiteCopy, time.Since(h.since)); k.heartbeats.setInterval(h, next) {
+			k.log.Debug("Changing heartbeat interval to %s %s", next, &kiteCopy)
+
+			k.requestHeartbeats(r.Client, next, heartbeat)
+		}
+	})
+
+	// now trigger the remote kite so it sends us periodically an heartbeat
+	k.requestHeartbeats(r.Client, HeartbeatInterval, heartbeat)
 
 	k.log.Info("Kite registered: %s", &r.Client.Kite)
 
+	k.emit(&Event{
+		Type:  KiteRegistered,
+		Kite:  &kiteCopy,
+		URL:   args.URL,
+		KeyID: keyPair.ID,
+	})
+
 	clientKite := r.Client.Kite.String()
 
+	k.clientsMu.Lock()
+	k.clients[kiteCopy.ID] = r.Client
+	k.values[kiteCopy.ID] = value
+	k.clientsMu.Unlock()
+
 	r.Client.OnDisconnect(func() {
 		k.log.Info("Kite disconnected: %s", clientKite)
+
+		k.clientsMu.Lock()
+		current := k.clients[kiteCopy.ID] == r.Client
+		if current {
+			delete(k.clients, kiteCopy.ID)
+			delete(k.values, kiteCopy.ID)
+		}
+		k.clientsMu.Unlock()
+
+		k.heartbeats.cancel(kiteCopy.ID, r.Client)
+
+		if current {
+			k.emit(&Event{Type: KiteDeregistered, Kite: &kiteCopy})
+		}
 	})
 
 	return res, nil
 }
 
+// resolveConflict applies the RegisterPolicy, when the kite of the request
+// is still registered from a different URL.
+func (k *Kontrol) resolveConflict(r *kite.Request, url string) error {
+	if k.RegisterPolicy == RegisterAllowBoth {
+		return nil
+	}
+
+	value, _ := k.lookupKite(r.Client.ID)
+	if value == nil || value.URL == url {
+		return nil
+	}
+
+	switch k.RegisterPolicy {
+	case RegisterReject:
+		k.log.Warning("Rejected register of %s from %s: registered with %s", &r.Client.Kite, url, value.URL)
+
+		return fmt.Errorf("kite is already registered with %s", value.URL)
+	case RegisterReplace:
+		k.log.Warning("Replacing registration of %s from %s with %s", &r.Client.Kite, value.URL, url)
+
+		k.clientsMu.Lock()
+		old, ok := k.clients[r.Client.ID]
+		k.clientsMu.Unlock()
+
+		if !ok || old == r.Client {
+			return nil
+		}
+
+		resp := old.GoWithTimeout("kite.displaced", 4*time.Second, &protocol.DisplacedArgs{URL: url})
+
+		go func() {
+			if err := (<-resp).Err; err != nil {
+				k.log.Error("failed notifying displaced %q kite: %s", r.Client.Name, err)
+			}
+		}()
+	}
+
+	return nil
+}
+
+// displaced tells whether the registration of the kite made with c was
+// replaced by another one.
+func (k *Kontrol) displaced(id string, c *kite.Client) bool {
+	if k.RegisterPolicy != RegisterReplace {
+		return false
+	}
+
+	k.clientsMu.Lock()
+	defer k.clientsMu.Unlock()
+
+	cur, ok := k.clients[id]
+	return ok && cur != c
+}
+
 func (k *Kontrol) HandleGetKites(r *kite.Request) (interface{}, error) {
 	var args protocol.GetKitesArgs
 
@@ -170,18 +277,123 @@ func (k *Kontrol) HandleGetKites(r *kite.Request) (interface{}, error) {
 		return nil, err
 	}
 
-	// Get kites from the storage
-	kites, err := k.storage.Get(args.Query)
+	return k.handleGetKites(r, &args, false)
+}
+
+// HandleGetMethods is like HandleGetKites, but it returns the methods
+// published by the kites instead of tokens for them.
+func (k *Kontrol) HandleGetMethods(r *kite.Request) (interface{}, error) {
+	var args protocol.GetKitesArgs
+
+	if err := r.Args.One().Unmarshal(&args); err != nil {
+		return nil, err
+	}
+
+	args.NoToken = true
+
+	return k.handleGetKites(r, &args, true)
+}
+
+// HandleUpdateMethods updates the methods published by a registered kite.
+// The kite must call it over the connection it registered with.
+func (k *Kontrol) HandleUpdateMethods(r *kite.Request) (interface{}, error) {
+	var args protocol.UpdateMethodsArgs
+
+	if err := r.Args.One().Unmarshal(&args); err != nil {
+		return nil, err
+	}
+
+	id := r.Client.Kite.ID
+
+	k.clientsMu.Lock()
+	value, ok := k.values[id]
+	if !ok || k.clients[id] != r.Client {
+		k.clientsMu.Unlock()
+		return nil, errors.New("kite is not registered")
+	}
+
+	updated := *value
+	updated.Methods = args.Methods
+	k.values[id] = &updated
+	k.clientsMu.Unlock()
+
+	if err := k.storage.Update(&r.Client.Kite, &updated); err != nil {
+		k.log.Error("storage update '%s' error: %s", &r.Client.Kite, err)
+		return nil, errors.New("internal error - updateMethods")
+	}
+
+	k.invalidateQueries(&r.Client.Kite)
+
+	return nil, nil
+}
+
+// registerValue gives the current register value of the kite, or the value
+// it was registered with, if it's no longer registered.
+func (k *Kontrol) registerValue(id string, value *kontrolprotocol.RegisterValue) *kontrolprotocol.RegisterValue {
+	k.clientsMu.Lock()
+	defer k.clientsMu.Unlock()
+
+	if v, ok := k.values[id]; ok {
+		return v
+	}
+
+	return value
+}
+
+func (k *Kontrol) handleGetKites(r *kite.Request, args *protocol.GetKitesArgs, methods bool) (interface{}, error) {
+	if args.Query == nil {
+		return nil, errors.New("invalid query: empty")
+	}
+
+	if args.Limit < 0 || args.Offset < 0 || args.MaxResults < 0 {
+		return nil, errors.New("invalid query: negative limit, offset or max results")
+	}
+
+	kites, total, err := k.getKites(args.Query, args.Offset, args.Limit)
 	if err != nil {
 		return nil, err
 	}
 
+	if args.PreferRegion != "" {
+		kites.PreferRegion(args.PreferRegion)
+	}
+
+	allowed := kites[:0]
+
 	for _, kite := range kites {
+		if args.MaxResults > 0 && len(allowed) == args.MaxResults {
+			break
+		}
+
+		// Kites of removed tenants are omitted.
+		if tenant := k.keyIDTenant(kite.KeyID); tenant != "" && k.tenantKeyPair(tenant) == nil {
+			continue
+		}
+
 		keyPair, err := k.getOrUpdateKeyID(kite.KeyID, r)
 		if err != nil {
 			return nil, err
 		}
 
+		// Kites the caller is not allowed to get a token for are omitted.
+		if err := k.checkTokenEnvironment(r, keyPair); err != nil {
+			continue
+		}
+
+		if err := k.checkTokenTenant(r, keyPair); err != nil {
+			continue
+		}
+
+		allowed = append(allowed, kite)
+
+		if !methods {
+			kite.Methods = nil
+		}
+
+		if args.NoToken {
+			continue
+		}
+
 		tok := &token{
 			audience: getAudience(args.Query),
 			username: r.Username,
@@ -199,11 +411,71 @@ func (k *Kontrol) HandleGetKites(r *kite.Request) (interface{}, error) {
 		kite.Token = token
 	}
 
+	if len(args.Fields) != 0 {
+		if err := allowed.Project(args.Fields); err != nil {
+			return nil, fmt.Errorf("invalid fields: %s", err)
+		}
+	}
+
 	return &protocol.GetKitesResult{
-		Kites: kites,
+		Kites: allowed,
+		Total: total,
 	}, nil
 }
 
+// getKites gets the kites matching the query from the storage, or from
+// the query cache if it's enabled with QueryCacheTTL. When the offset or
+// limit is non-zero, a page of the kites is returned along with the number
+// of all the matching kites.
+func (k *Kontrol) getKites(query *protocol.KontrolQuery, offset, limit int) (Kites, int, error) {
+	c := k.kiteQueryCache()
+	if c == nil {
+		return k.getStorageKites(query, offset, limit)
+	}
+
+	key := queryCacheKey(query, offset, limit)
+
+	if kites, total, ok := c.get(key); ok {
+		// storages randomize the result, so do the cached ones
+		if offset == 0 && limit == 0 {
+			kites.Shuffle()
+		}
+
+		return kites, total, nil
+	}
+
+	gen := c.generation()
+
+	kites, total, err := k.getStorageKites(query, offset, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	c.put(gen, key, query, kites, total)
+
+	return kites, total, nil
+}
+
+func (k *Kontrol) getStorageKites(query *protocol.KontrolQuery, offset, limit int) (Kites, int, error) {
+	if offset == 0 && limit == 0 {
+		kites, err := k.storage.Get(query)
+		return kites, 0, err
+	}
+
+	if p, ok := k.storage.(Pager); ok {
+		return p.GetPage(query, offset, limit)
+	}
+
+	kites, err := k.storage.Get(query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total := kites.Page(offset, limit)
+
+	return kites, total, nil
+}
+
 func (k *Kontrol) HandleGetToken(r *kite.Request) (interface{}, error) {
 	var args protocol.GetTokenArgs
 
@@ -211,8 +483,160 @@ func (k *Kontrol) HandleGetToken(r *kite.Request) (interface{}, error) {
 		return nil, fmt.Errorf("invalid query: %s", err)
 	}
 
+	return k.getToken(r, &args.KontrolQuery, args.Force)
+}
+
+// HandleGetTokens generates tokens for many kites at once. A failure for
+// one kite does not fail the whole request, the error is returned
+// in place of the kite's token instead.
+func (k *Kontrol) HandleGetTokens(r *kite.Request) (interface{}, error) {
+	var args protocol.GetTokensArgs
+
+	if err := r.Args.One().Unmarshal(&args); err != nil {
+		return nil, fmt.Errorf("invalid query: %s", err)
+	}
+
+	res := &protocol.GetTokensResult{
+		Tokens: make([]*protocol.TokenResult, len(args.Queries)),
+	}
+
+	for i, query := range args.Queries {
+		res.Tokens[i] = &protocol.TokenResult{}
+
+		if query == nil {
+			res.Tokens[i].Error = "invalid query: empty"
+			continue
+		}
+
+		token, err := k.getToken(r, query, args.Force)
+		if err != nil {
+			res.Tokens[i].Error = err.Error()
+			continue
+		}
+
+		res.Tokens[i].Token = token
+	}
+
+	return res, nil
+}
+
+// HandleGetTokenByID gives the token with the given ID, which was
+// issued by the kontrol. Kites call it to resolve tokens, which clients
+// reference by ID instead of sending them in full.
+//
+// Only the kites the token was issued for can fetch it.
+func (k *Kontrol) HandleGetTokenByID(r *kite.Request) (interface{}, error) {
+	var args protocol.GetTokenByIDArgs
+
+	if err := r.Args.One().Unmarshal(&args); err != nil {
+		return nil, fmt.Errorf("invalid argument: %s", err)
+	}
+
+	if args.ID == "" {
+		return nil, errors.New("token ID is required")
+	}
+
+	signed, err := k.tokenCache.Get(tokenIDKey(args.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &kitekey.KiteClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(signed, claims); err != nil {
+		return nil, err
+	}
+
+	if !audienceMatches(r.Username, &r.Client.Kite, claims.Audience) {
+		return nil, errors.New("token was not issued for the kite")
+	}
+
+	return signed, nil
+}
+
+// audienceMatches tells whether the kite of the user is within the audience
+// of a token, like the default audience verification of kites does.
+func audienceMatches(username string, kite *protocol.Kite, audience string) bool {
+	if audience == "/" {
+		return true
+	}
+
+	aud, err := protocol.KiteFromString(audience)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case username != aud.Username:
+		return false
+	case aud.Environment != "" && kite.Environment != aud.Environment:
+		return false
+	case aud.Name != "" && kite.Name != aud.Name:
+		return false
+	}
+
+	return true
+}
+
+// HandleDelegateToken generates a short-lived token for the kite matching
+// the query, which lets the requesting kite act on behalf of the given user.
+// Gateway kites use it to call backend kites with the identity of the user
+// they are serving. The requesting kite is recorded in the token as the
+// actor.
+//
+// The requests are authorized with Kontrol.DelegateAuthenticate, if it's
+// nil the method fails.
+func (k *Kontrol) HandleDelegateToken(r *kite.Request) (interface{}, error) {
+	var args protocol.DelegateTokenArgs
+
+	if err := r.Args.One().Unmarshal(&args); err != nil {
+		return nil, fmt.Errorf("invalid argument: %s", err)
+	}
+
+	if args.Username == "" {
+		return nil, errors.New("username is required")
+	}
+
+	// The audience of a delegated token is restricted to a single kite.
+	if args.Query == nil || args.Query.Name == "" {
+		return nil, errors.New("kite name is required")
+	}
+
+	if k.DelegateAuthenticate == nil {
+		return nil, errors.New("token delegation is not enabled")
+	}
+
+	if err := k.DelegateAuthenticate(r, args.Username); err != nil {
+		return nil, err
+	}
+
+	tok, err := k.newToken(r, args.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	tok.username = args.Username
+	tok.actor = r.Username
+	tok.ttl = k.delegateTokenTTL()
+
+	return k.generateToken(tok)
+}
+
+func (k *Kontrol) getToken(r *kite.Request, query *protocol.KontrolQuery, force bool) (string, error) {
+	tok, err := k.newToken(r, query)
+	if err != nil {
+		return "", err
+	}
+
+	tok.force = force
+
+	return k.generateToken(tok)
+}
+
+// newToken gives a token of the requesting kite for the kite matching
+// the query.
+func (k *Kontrol) newToken(r *kite.Request, query *protocol.KontrolQuery) (*token, error) {
 	// check if it's exist
-	kites, err := k.storage.Get(&args.KontrolQuery)
+	kites, err := k.storage.Get(query)
 	if err != nil {
 		return nil, err
 	}
@@ -232,13 +656,106 @@ func (k *Kontrol) HandleGetToken(r *kite.Request) (interface{}, error) {
 		return nil, err
 	}
 
-	return k.generateToken(&token{
-		audience: getAudience(&args.KontrolQuery),
+	if err := k.checkTokenEnvironment(r, keyPair); err != nil {
+		return nil, err
+	}
+
+	// Kites of other tenants are reported as missing.
+	if err := k.checkTokenTenant(r, keyPair); err != nil {
+		return nil, errors.New("no kites found")
+	}
+
+	return &token{
+		audience: getAudience(query),
 		username: r.Username,
 		issuer:   k.Kite.Kite().Username,
 		keyPair:  keyPair,
-		force:    args.Force,
-	})
+	}, nil
+}
+
+// HandleDialBack dials the kite with the given URL and pings it. Kites behind
+// NAT call it to verify their public URL is reachable before registering it,
+// see (*kite.Kite).PublicURL.
+func (k *Kontrol) HandleDialBack(r *kite.Request) (interface{}, error) {
+	var args protocol.DialBackArgs
+
+	if err := r.Args.One().Unmarshal(&args); err != nil {
+		return nil, fmt.Errorf("invalid argument: %s", err)
+	}
+
+	u, err := url.Parse(args.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %s", err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid URL scheme: %q", u.Scheme)
+	}
+
+	// Only the caller's own kite endpoint can be dialed, so the method
+	// can't be used to reach arbitrary services from kontrol's network.
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("invalid URL: %s", u)
+	}
+
+	if u.Path != "/kite" && u.Path != "/"+r.Client.Kite.Name+"-"+r.Client.Kite.Version+"/kite" {
+		return nil, fmt.Errorf("invalid URL path: %q", u.Path)
+	}
+
+	if err := k.checkDialBackHost(r, u.Hostname()); err != nil {
+		return nil, err
+	}
+
+	c := k.Kite.NewClient(u.String())
+	c.Reconnect = false
+
+	if err := c.DialTimeout(k.Kite.Config.Timeout); err != nil {
+		return nil, fmt.Errorf("unable to dial %s: %s", u, err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), k.Kite.Config.Timeout)
+	defer cancel()
+
+	if _, err := c.Ping(ctx); err != nil {
+		return nil, fmt.Errorf("unable to ping %s: %s", u, err)
+	}
+
+	return true, nil
+}
+
+// checkDialBackHost returns non-nil error if the given host does not resolve
+// solely to the remote IP of the caller.
+func (k *Kontrol) checkDialBackHost(r *kite.Request, host string) error {
+	remoteIP, _, err := net.SplitHostPort(r.Client.RemoteAddr())
+	if err != nil {
+		return fmt.Errorf("unable to read remote address: %s", err)
+	}
+
+	remote := net.ParseIP(remoteIP)
+	if remote == nil {
+		return fmt.Errorf("invalid remote address: %q", remoteIP)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), k.Kite.Config.Timeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("unable to resolve %q: %s", host, err)
+	}
+
+	if len(addrs) == 0 {
+		return fmt.Errorf("unable to resolve %q", host)
+	}
+
+	for _, addr := range addrs {
+		if !addr.IP.Equal(remote) {
+			return fmt.Errorf("host %q does not resolve to %s", host, remote)
+		}
+	}
+
+	return nil
 }
 
 func (k *Kontrol) HandleMachine(r *kite.Request) (interface{}, error) {
@@ -262,7 +779,9 @@ func (k *Kontrol) HandleMachine(r *kite.Request) (interface{}, error) {
 			return nil, fmt.Errorf("cannot authenticate user: %s", err)
 		}
 
-		keyPair, err = k.KeyPair()
+		if keyPair = k.environmentKeyPair(r.Client.Kite.Environment); keyPair == nil {
+			keyPair, err = k.KeyPair()
+		}
 	} else {
 		keyPair, err = k.pickKey(r)
 	}
@@ -293,6 +812,19 @@ func (k *Kontrol) HandleGetKey(r *kite.Request) (interface{}, error) {
 		return nil, errors.New("public key is not passed")
 	}
 
+	if tenant := k.keyTenant(ex.Claims.KontrolKey); tenant != "" {
+		if k.tenantKeyPair(tenant) != nil && k.keyPair.IsValid(ex.Claims.KontrolKey) == nil {
+			return ex.Claims.KontrolKey, nil
+		}
+
+		keyPair, err := k.updateTenantKey(tenant)
+		if err != nil {
+			return nil, err
+		}
+
+		return keyPair.Public, nil
+	}
+
 	switch k.keyPair.IsValid(ex.Claims.KontrolKey) {
 	case nil:
 		// everything is ok, just return the old one
@@ -312,6 +844,55 @@ func (k *Kontrol) HandleGetKey(r *kite.Request) (interface{}, error) {
 	return keyPair.Public, nil
 }
 
+// HandleRefreshKeys invalidates the token cache and asks all kites
+// connected to kontrol to refresh their keys, so key rotations
+// propagate without waiting for tokens to expire. It returns
+// the number of notified kites.
+func (k *Kontrol) HandleRefreshKeys(r *kite.Request) (interface{}, error) {
+	if err := k.authenticateAdmin(r); err != nil {
+		k.log.Error("refresh keys authentication error: %s", err)
+
+		return nil, fmt.Errorf("cannot authenticate user: %s", err)
+	}
+
+	k.flushTokens()
+
+	k.clientsMu.Lock()
+	clients := make([]*kite.Client, 0, len(k.clients))
+	for _, c := range k.clients {
+		clients = append(clients, c)
+	}
+	k.clientsMu.Unlock()
+
+	for _, c := range clients {
+		resp := c.GoWithTimeout("kite.refreshKey", 4*time.Second)
+
+		go func(c *kite.Client) {
+			if err := (<-resp).Err; err != nil {
+				k.log.Warning("failed requesting key refresh from %s: %s", &c.Kite, err)
+			}
+		}(c)
+	}
+
+	k.log.Info("Refreshed keys of %d kites on request of %q", len(clients), r.Username)
+
+	k.emit(&Event{Type: KeyRotated, Username: r.Username})
+
+	return len(clients), nil
+}
+
+func (k *Kontrol) authenticateAdmin(r *kite.Request) error {
+	if k.AdminAuthenticate != nil {
+		return k.AdminAuthenticate(r)
+	}
+
+	if r.Username != k.Kite.Config.Username {
+		return fmt.Errorf("user %q is not an admin", r.Username)
+	}
+
+	return nil
+}
+
 func (k *Kontrol) HandleVerify(r *kite.Request) (interface{}, error) {
 	return nil, nil
 }
@@ -326,6 +907,10 @@ func (k *Kontrol) pickKey(r *kite.Request) (*KeyPair, error) {
 		return keyPair, nil
 	}
 
+	if keyPair := k.environmentKeyPair(r.Client.Kite.Environment); keyPair != nil {
+		return keyPair, nil
+	}
+
 	return nil, errors.New("no valid authentication key found")
 }
 
@@ -351,6 +936,8 @@ func (k *Kontrol) updateKeyWithKeyPair(t *jwt.Token, keyPair *KeyPair) string {
 		claims.KontrolKey = keyPair.Public
 	}
 
+	claims.Tenant = k.keyTenant(keyPair.Public)
+
 	rsaPrivate, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(keyPair.Private))
 	if err != nil {
 		k.log.Error("key update error for %q: %s", claims.Subject, err)
@@ -372,6 +959,16 @@ func (k *Kontrol) getOrUpdateKeyPub(pub string, t *jwt.Token, r *kite.Request) (
 	var kiteKey string
 
 	kp, err := k.keyPair.GetKeyFromPublic(pub)
+
+	// Kites of a tenant are never moved out of it.
+	if tenant := k.keyTenant(pub); tenant != "" && (kp == nil || k.tenantKeyPair(tenant) == nil) {
+		if kp, err = k.updateTenantKey(tenant); err != nil {
+			return nil, "", err
+		}
+
+		return kp, k.updateKeyWithKeyPair(t, kp), nil
+	}
+
 	if err == ErrKeyDeleted {
 		kp, kiteKey = k.updateKey(t)
 	}
@@ -390,6 +987,11 @@ func (k *Kontrol) getOrUpdateKeyPub(pub string, t *jwt.Token, r *kite.Request) (
 
 func (k *Kontrol) getOrUpdateKeyID(id string, r *kite.Request) (*KeyPair, error) {
 	kp, err := k.keyPair.GetKeyFromID(id)
+
+	if tenant := k.keyIDTenant(id); tenant != "" && (kp == nil || k.tenantKeyPair(tenant) == nil) {
+		return k.updateTenantKey(tenant)
+	}
+
 	if err == ErrKeyDeleted {
 		kp, err = k.KeyPair()
 		if err != nil {
@@ -1,13 +1,16 @@
 package kontrol
 
 import (
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
-	"github.com/koding/kite"
-	"github.com/koding/kite/protocol"
-	"github.com/koding/kite/testkeys"
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/protocol"
+	"github.com/koding/kite/v2/testkeys"
 )
 
 // createTestKite creates a test kite, caller of this func should close the kite
@@ -44,3 +47,186 @@ func TestKontrol_HandleWebRTC(t *testing.T) {
 		t.Fatalf("expected hk1 error, got: %+v", err)
 	}
 }
+
+// fakeNetwork connects fakePeerConnections created by the same network
+// with in-memory data channels.
+type fakeNetwork struct {
+	mu     sync.Mutex
+	offers map[string]*fakePeerConnection
+}
+
+func (n *fakeNetwork) NewPeerConnection() (kite.PeerConnection, error) {
+	return &fakePeerConnection{
+		net: n,
+		dc:  make(chan kite.DataChannel, 1),
+	}, nil
+}
+
+type fakePeerConnection struct {
+	net   *fakeNetwork
+	dc    chan kite.DataChannel
+	onICE func(kite.ICECandidate)
+
+	mu         sync.Mutex
+	pending    kite.DataChannel
+	candidates []kite.ICECandidate
+}
+
+func (pc *fakePeerConnection) CreateOffer(label string) (string, error) {
+	sdp := "offer:" + label
+
+	pc.net.mu.Lock()
+	pc.net.offers[sdp] = pc
+	pc.net.mu.Unlock()
+
+	pc.onICE(kite.ICECandidate{Candidate: "offerer"})
+
+	return sdp, nil
+}
+
+func (pc *fakePeerConnection) CreateAnswer(offer string) (string, error) {
+	pc.net.mu.Lock()
+	remote, ok := pc.net.offers[offer]
+	delete(pc.net.offers, offer)
+	pc.net.mu.Unlock()
+
+	if !ok {
+		return "", errors.New("unknown offer")
+	}
+
+	a, b := make(chan string, 16), make(chan string, 16)
+	done := make(chan struct{})
+	once := new(sync.Once)
+
+	remote.mu.Lock()
+	remote.pending = &fakeDataChannel{in: a, out: b, done: done, once: once}
+	remote.mu.Unlock()
+
+	pc.dc <- &fakeDataChannel{in: b, out: a, done: done, once: once}
+
+	pc.onICE(kite.ICECandidate{Candidate: "answerer"})
+
+	return "answer:" + offer, nil
+}
+
+func (pc *fakePeerConnection) SetAnswer(answer string) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.pending == nil {
+		return errors.New("no offer")
+	}
+
+	pc.dc <- pc.pending
+	return nil
+}
+
+func (pc *fakePeerConnection) AddICECandidate(c kite.ICECandidate) error {
+	pc.mu.Lock()
+	pc.candidates = append(pc.candidates, c)
+	pc.mu.Unlock()
+	return nil
+}
+
+func (pc *fakePeerConnection) OnICECandidate(fn func(kite.ICECandidate)) {
+	pc.onICE = fn
+}
+
+func (pc *fakePeerConnection) DataChannel() (kite.DataChannel, error) {
+	select {
+	case dc := <-pc.dc:
+		pc.dc <- dc
+		return dc, nil
+	case <-time.After(5 * time.Second):
+		return nil, errors.New("timed out waiting for data channel")
+	}
+}
+
+func (pc *fakePeerConnection) Close() error {
+	select {
+	case dc := <-pc.dc:
+		return dc.Close()
+	default:
+		return nil
+	}
+}
+
+type fakeDataChannel struct {
+	in   <-chan string
+	out  chan<- string
+	done chan struct{}
+	once *sync.Once
+}
+
+func (dc *fakeDataChannel) Send(msg string) error {
+	select {
+	case dc.out <- msg:
+		return nil
+	case <-dc.done:
+		return errors.New("data channel closed")
+	}
+}
+
+func (dc *fakeDataChannel) Recv() (string, error) {
+	select {
+	case msg := <-dc.in:
+		return msg, nil
+	case <-dc.done:
+		return "", errors.New("data channel closed")
+	}
+}
+
+func (dc *fakeDataChannel) Close() error {
+	dc.once.Do(func() { close(dc.done) })
+	return nil
+}
+
+func TestKontrol_WebRTCSession(t *testing.T) {
+	kont, conf := startKontrol(testkeys.PrivateThird, testkeys.PublicThird, 5502)
+	defer kont.Close()
+
+	fake := &fakeNetwork{
+		offers: make(map[string]*fakePeerConnection),
+	}
+
+	hk1, err := NewHelloKite("kite1", conf)
+	if err != nil {
+		t.Fatalf("NewHelloKite()=%s", err)
+	}
+	defer hk1.Close()
+
+	hk2, err := NewHelloKite("kite2", conf)
+	if err != nil {
+		t.Fatalf("NewHelloKite()=%s", err)
+	}
+	defer hk2.Close()
+
+	for _, hk := range []*HelloKite{hk1, hk2} {
+		hk.Kite.UseWebRTC(fake.NewPeerConnection)
+
+		// The kites are already registered, announce them explicitly.
+		err := hk.Kite.SendWebRTCRequest(&protocol.WebRTCSignalMessage{Type: "announce"})
+		if err != nil {
+			t.Fatalf("%s: announce error: %s", hk.Kite.Kite().Name, err)
+		}
+	}
+
+	c, err := hk1.Kite.DialWebRTC(hk2.Kite.Id)
+	if err != nil {
+		t.Fatalf("DialWebRTC()=%s", err)
+	}
+	defer c.Close()
+
+	res, err := c.TellWithTimeout("hello", 5*time.Second)
+	if err != nil {
+		t.Fatalf("Tell()=%s", err)
+	}
+
+	if got, want := res.MustString(), "kite2 says hello"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	if _, err := hk1.Kite.DialWebRTC("unknown"); err == nil {
+		t.Fatal("expected dialing unknown kite to fail")
+	}
+}
@@ -0,0 +1,121 @@
+package kontrol
+
+import (
+	"sync"
+	"time"
+
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/dnode"
+	"github.com/koding/kite/v2/protocol"
+)
+
+// BackoffHeartbeats gives a heartbeat policy, which doubles the heartbeat
+// interval of a kite for every UpdateInterval it has been heartbeating
+// steadily, up to the max interval.
+//
+// Example:
+//
+//	k.HeartbeatPolicy = kontrol.BackoffHeartbeats(kontrol.MaxHeartbeatInterval)
+func BackoffHeartbeats(max time.Duration) func(*protocol.Kite, time.Duration) time.Duration {
+	return func(_ *protocol.Kite, stable time.Duration) time.Duration {
+		interval := HeartbeatInterval
+
+		for n := stable / UpdateInterval; n > 0 && interval < max; n-- {
+			interval *= 2
+		}
+
+		if interval > max {
+			interval = max
+		}
+
+		return interval
+	}
+}
+
+// heartbeatInterval gives the heartbeat interval of the kite according
+// to the HeartbeatPolicy, rounded to seconds.
+func (k *Kontrol) heartbeatInterval(kite *protocol.Kite, stable time.Duration) time.Duration {
+	if k.HeartbeatPolicy == nil {
+		return HeartbeatInterval
+	}
+
+	interval := k.HeartbeatPolicy(kite, stable)
+
+	if interval > MaxHeartbeatInterval {
+		interval = MaxHeartbeatInterval
+	}
+
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	return interval / time.Second * time.Second
+}
+
+// maxUnknownKites is the maximum number of IDs cached by unknownKites.
+const maxUnknownKites = 4096
+
+// unknownKites remembers the IDs of kites, which sent heartbeats while
+// not being registered, for UnknownKiteTTL. The zero value is ready to use.
+type unknownKites struct {
+	mu  sync.Mutex
+	ids map[string]time.Time // values are expiration times
+}
+
+// has reports whether the kite was not found in the storage recently.
+func (u *unknownKites) has(id string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	expires, ok := u.ids[id]
+	if ok && time.Now().After(expires) {
+		delete(u.ids, id)
+		return false
+	}
+
+	return ok
+}
+
+func (u *unknownKites) add(id string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	now := time.Now()
+
+	if u.ids == nil {
+		u.ids = make(map[string]time.Time)
+	}
+
+	if len(u.ids) >= maxUnknownKites {
+		for id, expires := range u.ids {
+			if now.After(expires) {
+				delete(u.ids, id)
+			}
+		}
+
+		// All of the kites are recent, start over instead of growing.
+		if len(u.ids) >= maxUnknownKites {
+			u.ids = make(map[string]time.Time)
+		}
+	}
+
+	u.ids[id] = now.Add(UnknownKiteTTL)
+}
+
+func (u *unknownKites) remove(id string) {
+	u.mu.Lock()
+	delete(u.ids, id)
+	u.mu.Unlock()
+}
+
+// requestHeartbeats asks the kite to call the ping callback
+// every interval.
+func (k *Kontrol) requestHeartbeats(c *kite.Client, interval time.Duration, ping dnode.Function) {
+	resp := c.GoWithTimeout("kite.heartbeat", 4*time.Second, interval/time.Second, ping)
+
+	go func() {
+		if err := (<-resp).Err; err != nil {
+			k.log.Error("failed requesting heartbeats from %q kite: %s", c.Kite.Name, err)
+		}
+	}()
+}
@@ -6,14 +6,15 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
 
-	"github.com/koding/kite"
-	"github.com/koding/kite/config"
-	"github.com/koding/kite/protocol"
-	"github.com/koding/kite/testutil"
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/protocol"
+	"github.com/koding/kite/v2/testutil"
 )
 
 var interactive = os.Getenv("TEST_INTERACTIVE") == "1"
@@ -43,7 +44,7 @@ func (c *Config) Register(hk *HelloKite) error {
 	return nil
 }
 
-func startKontrol(pem, pub string, port int) (*Kontrol, *Config) {
+func startKontrol(pem, pub string, port int, opts ...func(*Kontrol)) (*Kontrol, *Config) {
 	conf := config.New()
 	conf.Username = "testuser"
 	conf.KontrolURL = fmt.Sprintf("http://localhost:%d/kite", port)
@@ -56,15 +57,17 @@ func startKontrol(pem, pub string, port int) (*Kontrol, *Config) {
 	kon := New(conf.Copy(), "1.0.0")
 	// kon.Kite.SetLogLevel(kite.DEBUG)
 
-	switch os.Getenv("KONTROL_STORAGE") {
-	case "etcd":
-		kon.SetStorage(NewEtcd(nil, kon.Kite.Log))
-	case "postgres":
-		p := NewPostgres(nil, kon.Kite.Log)
-		kon.SetStorage(p)
-		kon.SetKeyPairStorage(p)
-	default:
-		kon.SetStorage(NewEtcd(nil, kon.Kite.Log))
+	storage := os.Getenv("KONTROL_STORAGE")
+	if storage == "" {
+		storage = "etcd"
+	}
+
+	if err := kon.UseStorage(storage, ""); err != nil {
+		panic(err)
+	}
+
+	for _, opt := range opts {
+		opt(kon)
 	}
 
 	kon.AddKeyPair("", pub, pem)
@@ -79,6 +82,58 @@ func startKontrol(pem, pub string, port int) (*Kontrol, *Config) {
 	}
 }
 
+// softKeyPairStorage is a MemKeyPairStorage, which keeps deleted key pairs
+// and reports them with ErrKeyDeleted, like the Postgres storage does.
+type softKeyPairStorage struct {
+	*MemKeyPairStorage
+
+	mu      sync.Mutex
+	deleted map[string]bool // IDs of deleted key pairs
+}
+
+func newSoftKeyPairStorage() *softKeyPairStorage {
+	return &softKeyPairStorage{
+		MemKeyPairStorage: NewMemKeyPairStorage(),
+		deleted:           make(map[string]bool),
+	}
+}
+
+func (s *softKeyPairStorage) DeleteKey(keyPair *KeyPair) error {
+	s.mu.Lock()
+	s.deleted[keyPair.ID] = true
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *softKeyPairStorage) GetKeyFromID(id string) (*KeyPair, error) {
+	return s.check(s.MemKeyPairStorage.GetKeyFromID(id))
+}
+
+func (s *softKeyPairStorage) GetKeyFromPublic(public string) (*KeyPair, error) {
+	return s.check(s.MemKeyPairStorage.GetKeyFromPublic(public))
+}
+
+func (s *softKeyPairStorage) IsValid(public string) error {
+	_, err := s.GetKeyFromPublic(public)
+	return err
+}
+
+func (s *softKeyPairStorage) check(keyPair *KeyPair, err error) (*KeyPair, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.deleted[keyPair.ID] {
+		return nil, ErrKeyDeleted
+	}
+
+	return keyPair, nil
+}
+
 func klose(clients []*kite.Client) {
 	for _, c := range clients {
 		c.Close()
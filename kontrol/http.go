@@ -8,10 +8,10 @@ import (
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
-	"github.com/koding/kite"
-	"github.com/koding/kite/kitekey"
-	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
-	"github.com/koding/kite/protocol"
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/kitekey"
+	kontrolprotocol "github.com/koding/kite/v2/kontrol/protocol"
+	"github.com/koding/kite/v2/protocol"
 )
 
 func (k *Kontrol) HandleHeartbeat(rw http.ResponseWriter, req *http.Request) {
@@ -21,32 +21,50 @@ func (k *Kontrol) HandleHeartbeat(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	k.heartbeatsMu.Lock()
-	defer k.heartbeatsMu.Unlock()
-
 	k.log.Debug("Heartbeat received '%s'", id)
-	if h, ok := k.heartbeats[id]; ok {
-		// try to reset the timer every time the remote kite sends us a
-		// heartbeat. Because the timer get reset, the timer is never fired, so
-		// the value get always updated with the updater in the background
-		// according to the write interval. If the kite doesn't send any
-		// heartbeat, the timer func is being called, which stops the updater
-		// so the key is being deleted automatically via the TTL mechanism.
-		h.timer.Reset(HeartbeatInterval + HeartbeatDelay)
-
-		k.log.Debug("Sending pong '%s'", id)
-		rw.Write([]byte("pong"))
-		return
+
+	h := k.beat(id)
+	if h == nil {
+		// The kite may have been registered by another kontrol replica, or by
+		// this one before it got restarted. If the kite is still in the storage,
+		// start tracking its heartbeats here, so any replica can process them.
+		// Kites recently not found are not looked up again until UnknownKiteTTL
+		// passes.
+		var value *kontrolprotocol.RegisterValue
+		var remoteKite *protocol.Kite
+
+		if !k.unknownKites.has(id) {
+			if value, remoteKite = k.lookupKite(id); remoteKite == nil {
+				k.unknownKites.add(id)
+			}
+		}
+
+		if remoteKite == nil {
+			// if we reach here than it has several meanings:
+			// * kite was registered before, but it has expired from the storage
+			// * kite was no registered and someone else sends an heartbeat
+			// we send back "registeragain" so the caller can be added in to the
+			// heartbeats map above.
+			k.log.Debug("Sending registeragain '%s'", id)
+			rw.Write([]byte("registeragain"))
+			return
+		}
+
+		k.log.Info("Kite registered by another kontrol, tracking its heartbeats %s", remoteKite)
+		h = k.trackHeartbeat(remoteKite, value)
+	}
+
+	pong := "pong"
+
+	// Kites sending their interval accept a new one with the pong.
+	if req.URL.Query().Get("interval") != "" {
+		interval := k.heartbeatInterval(h.kite, time.Since(h.since))
+		k.heartbeats.setInterval(h, interval)
+		pong = fmt.Sprintf("pong %d", interval/time.Second)
 	}
 
-	// if we reach here than it has several meanings:
-	// * kite was registered before, but kontrol is restarted
-	// * kite was registered before, but kontrol has lost track
-	// * kite was no registered and someone else sends an heartbeat
-	// we send back "registeragain" so the caller can be added in to the
-	// heartbeats map above.
-	k.log.Debug("Sending registeragain '%s'", id)
-	rw.Write([]byte("registeragain"))
+	k.log.Debug("Sending %s '%s'", pong, id)
+	rw.Write([]byte(pong))
 }
 
 func (k *Kontrol) HandleRegisterHTTP(rw http.ResponseWriter, req *http.Request) {
@@ -60,27 +78,122 @@ func (k *Kontrol) HandleRegisterHTTP(rw http.ResponseWriter, req *http.Request)
 
 	k.log.Info("Register (via HTTP) request from: %s", args.Kite)
 
+	reg, code, err := k.admitHTTP(&args)
+	if err != nil {
+		http.Error(rw, jsonError(err), code)
+		return
+	}
+
+	// Register first by adding the value to the storage. Return if there is
+	// any error.
+	if err := k.storage.Upsert(reg.kite, reg.value); err != nil {
+		k.log.Error("storage add '%s' error: %s", reg.kite, err)
+		http.Error(rw, jsonError(errors.New("internal error - register")), http.StatusInternalServerError)
+		return
+	}
+
+	k.registeredHTTP(reg)
+
+	// send the response back to the requester
+	if err := json.NewEncoder(rw).Encode(reg.result); err != nil {
+		errMsg := fmt.Errorf("could not encode response: '%s'", err)
+		http.Error(rw, jsonError(errMsg), http.StatusInternalServerError)
+		return
+	}
+}
+
+// HandleRegisterKites registers many kites at once, storing them with
+// a single batch upsert if the storage supports it. Each kite is
+// registered like with the "/register" HTTP endpoint, so it authenticates
+// with its own kite key and sends heartbeats to the "/heartbeat" endpoint.
+//
+// A kite that fails to register does not fail the whole request, the
+// error is returned in place of the kite's result instead.
+func (k *Kontrol) HandleRegisterKites(r *kite.Request) (interface{}, error) {
+	var args protocol.RegisterKitesArgs
+
+	if err := r.Args.One().Unmarshal(&args); err != nil {
+		return nil, fmt.Errorf("invalid register input: %s", err)
+	}
+
+	k.log.Info("Register kites request from %s for %d kites", r.Client.Kite, len(args.Kites))
+
+	results := make([]*protocol.RegisterResult, len(args.Kites))
+	regs := make([]*httpRegistration, 0, len(args.Kites))
+	kites := make([]*protocol.Kite, 0, len(args.Kites))
+	values := make([]*kontrolprotocol.RegisterValue, 0, len(args.Kites))
+
+	for i, kiteArgs := range args.Kites {
+		if kiteArgs == nil {
+			results[i] = &protocol.RegisterResult{Error: "empty register input"}
+			continue
+		}
+
+		reg, _, err := k.admitHTTP(kiteArgs)
+		if err != nil {
+			results[i] = &protocol.RegisterResult{URL: kiteArgs.URL, Error: err.Error()}
+			continue
+		}
+
+		results[i] = reg.result
+		regs = append(regs, reg)
+		kites = append(kites, reg.kite)
+		values = append(values, reg.value)
+	}
+
+	if err := upsertBatch(k.storage, kites, values); err != nil {
+		k.log.Error("storage add of %d kites error: %s", len(kites), err)
+		return nil, errors.New("internal error - registerKites")
+	}
+
+	for _, reg := range regs {
+		k.registeredHTTP(reg)
+	}
+
+	return &protocol.RegisterKitesResult{Results: results}, nil
+}
+
+// httpRegistration is an admitted registration of a kite, which sends
+// heartbeats over HTTP.
+type httpRegistration struct {
+	kite   *protocol.Kite
+	value  *kontrolprotocol.RegisterValue
+	result *protocol.RegisterResult
+}
+
+// admitHTTP authenticates and validates the registration of a kite, which
+// sends heartbeats over HTTP. On failure, it also gives the HTTP status
+// code of the error.
+func (k *Kontrol) admitHTTP(args *protocol.RegisterArgs) (*httpRegistration, int, error) {
 	// Only accept requests with kiteKey, because that's the only way one can
 	// register itself to kontrol.
-	if args.Auth.Type != "kiteKey" {
-		err := fmt.Errorf("unexpected authentication type: %s", args.Auth.Type)
-		http.Error(rw, jsonError(err), http.StatusBadRequest)
-		return
+	if args.Auth == nil || args.Auth.Type != "kiteKey" {
+		var typ string
+		if args.Auth != nil {
+			typ = args.Auth.Type
+		}
+
+		return nil, http.StatusBadRequest, fmt.Errorf("unexpected authentication type: %s", typ)
 	}
 
 	// empty url is useless for us
 	if args.URL == "" {
-		err := errors.New("empty URL")
-		http.Error(rw, jsonError(err), http.StatusBadRequest)
-		return
+		return nil, http.StatusBadRequest, errors.New("empty URL")
+	}
+
+	if args.Kite == nil {
+		return nil, http.StatusBadRequest, errors.New("empty kite")
+	}
+
+	if err := protocol.ValidateLabels(args.Labels); err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid labels: %s", err)
 	}
 
 	// decode and authenticated the token key. We'll get the authenticated
 	// username
 	username, err := k.Kite.AuthenticateSimpleKiteKey(args.Auth.Key)
 	if err != nil {
-		http.Error(rw, jsonError(err), http.StatusUnauthorized)
-		return
+		return nil, http.StatusUnauthorized, err
 	}
 	args.Kite.Username = username
 
@@ -90,8 +203,7 @@ func (k *Kontrol) HandleRegisterHTTP(rw http.ResponseWriter, req *http.Request)
 
 	t, err := jwt.ParseWithClaims(args.Auth.Key, ex.Claims, ex.Extract)
 	if err != nil {
-		http.Error(rw, jsonError(err), http.StatusBadRequest)
-		return
+		return nil, http.StatusBadRequest, err
 	}
 
 	var keyPair *KeyPair
@@ -112,8 +224,7 @@ func (k *Kontrol) HandleRegisterHTTP(rw http.ResponseWriter, req *http.Request)
 
 	keyPair, resp.KiteKey, err = k.getOrUpdateKeyPub(ex.Claims.KontrolKey, t, r)
 	if err != nil {
-		http.Error(rw, jsonError(err), http.StatusBadRequest)
-		return
+		return nil, http.StatusBadRequest, err
 	}
 
 	if ex.Claims.KontrolKey != keyPair.Public {
@@ -127,108 +238,82 @@ func (k *Kontrol) HandleRegisterHTTP(rw http.ResponseWriter, req *http.Request)
 	// Be sure we have a valid Kite representation. We should not allow someone
 	// with an empty field to be registered.
 	if err := validateKiteKey(remoteKite); err != nil {
-		http.Error(rw, jsonError(err), http.StatusBadRequest)
-		return
+		return nil, http.StatusBadRequest, err
 	}
 
-	// This will be stored into the final storage
-	value := &kontrolprotocol.RegisterValue{
-		URL:   args.URL,
-		KeyID: keyPair.ID,
-	}
+	r.Client = &kite.Client{Kite: *remoteKite}
 
-	// Register first by adding the value to the storage. Return if there is
-	// any error.
-	if err := k.storage.Upsert(remoteKite, value); err != nil {
-		k.log.Error("storage add '%s' error: %s", remoteKite, err)
-		http.Error(rw, jsonError(errors.New("internal error - register")), http.StatusInternalServerError)
-		return
+	if err := k.admit(r, args); err != nil {
+		return nil, http.StatusForbidden, err
 	}
 
-	k.heartbeatsMu.Lock()
-	defer k.heartbeatsMu.Unlock()
+	return &httpRegistration{
+		kite: remoteKite,
+		// This will be stored into the final storage
+		value: &kontrolprotocol.RegisterValue{
+			URL:    args.URL,
+			KeyID:  keyPair.ID,
+			Labels: args.Labels,
+		},
+		result: resp,
+	}, 0, nil
+}
 
-	h, ok := k.heartbeats[remoteKite.ID]
-	if ok {
-		// there is already a previous registration, use it
-		k.log.Info("Kite was already register (via HTTP), use timer cache %s", remoteKite)
+// registeredHTTP starts tracking heartbeats of the kite, after it has been
+// stored.
+func (k *Kontrol) registeredHTTP(reg *httpRegistration) {
+	k.trackHeartbeat(reg.kite, reg.value)
 
-		h.timer.Reset(HeartbeatInterval + HeartbeatDelay)
+	k.log.Info("Kite registered (via HTTP): %s", reg.kite)
 
-		// update registerURL of the previously started heartbeat goroutine
-		// so it does not get overwritten back to the old value
-		h.updateC <- func() error {
-			return k.storage.Update(remoteKite, value)
-		}
-	} else {
-		// we create a new ticker which is going to update the key periodically in
-		// the storage so it's always up to date. Instead of updating the key
-		// periodically according to the HeartBeatInterval below, we are buffering
-		// the write speed here with the UpdateInterval.
-		h = &heartbeat{
-			updateC: make(chan func() error),
-		}
+	k.emit(&Event{
+		Type:  KiteRegistered,
+		Kite:  reg.kite,
+		URL:   reg.value.URL,
+		KeyID: reg.value.KeyID,
+	})
+}
 
-		updater := time.NewTicker(UpdateInterval)
+// lookupKite gives the registered kite with the given ID from the storage.
+// It returns nil kite if there's none.
+func (k *Kontrol) lookupKite(id string) (*kontrolprotocol.RegisterValue, *protocol.Kite) {
+	kites, err := k.storage.Get(&protocol.KontrolQuery{ID: id})
+	if err != nil || len(kites) == 0 {
+		return nil, nil
+	}
 
-		go func() {
-			update := func() error {
-				return k.storage.Update(remoteKite, value)
-			}
+	value := &kontrolprotocol.RegisterValue{
+		URL:     kites[0].URL,
+		KeyID:   kites[0].KeyID,
+		Methods: kites[0].Methods,
+		Labels:  kites[0].Labels,
+	}
 
-			for {
-				select {
-				case <-k.closed:
-					return
-				case <-updater.C:
-					k.log.Debug("Kite is active (via HTTP), updating the value %s", remoteKite)
-
-					if err := update(); err != nil {
-						k.log.Error("storage update '%s' error: %s", remoteKite, err)
-					}
-				case fn, ok := <-h.updateC:
-					if !ok {
-						k.log.Info("Kite is nonactive (via HTTP). Updater is closed %s", remoteKite)
-						return
-					}
-
-					update = fn
-				}
-			}
-		}()
+	return value, &kites[0].Kite
+}
 
-		// we are now creating a timer that is going to call the function which
-		// stops the background updater if it's not resetted. The time is being
-		// resetted on a separate HTTP endpoint "/heartbeat"
-		h.timer = time.AfterFunc(HeartbeatInterval+HeartbeatDelay, func() {
+// trackHeartbeat starts or restarts tracking heartbeats of the given kite,
+// which keeps its value up to date in the storage. It gives the tracked
+// heartbeat.
+func (k *Kontrol) trackHeartbeat(remoteKite *protocol.Kite, value *kontrolprotocol.RegisterValue) *heartbeat {
+	h := &heartbeat{
+		kite: remoteKite,
+		update: func() error {
+			return k.storage.Update(remoteKite, value)
+		},
+		missed: func() {
 			k.log.Info("Kite didn't sent any heartbeat (via HTTP). Stopping the updater %s", remoteKite)
-
-			// stop the updater so it doesn't update it in the background
-			updater.Stop()
-
-			k.heartbeatsMu.Lock()
-			defer k.heartbeatsMu.Unlock()
-
-			select {
-			case <-h.updateC:
-			default:
-				close(h.updateC)
-			}
-
-			delete(k.heartbeats, remoteKite.ID)
-		})
-
-		k.heartbeats[remoteKite.ID] = h
+			k.emit(&Event{Type: HeartbeatMissed, Kite: remoteKite})
+		},
 	}
 
-	k.log.Info("Kite registered (via HTTP): %s", remoteKite)
+	k.unknownKites.remove(remoteKite.ID)
 
-	// send the response back to the requester
-	if err := json.NewEncoder(rw).Encode(resp); err != nil {
-		errMsg := fmt.Errorf("could not encode response: '%s'", err)
-		http.Error(rw, jsonError(errMsg), http.StatusInternalServerError)
-		return
+	if k.heartbeats.track(h) {
+		k.log.Info("Kite was already registered, replacing its heartbeat %s", remoteKite)
 	}
+
+	return h
 }
 
 // jsonError returns a JSON string of form {"err" : "error content"}
@@ -0,0 +1,195 @@
+package kontrol
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/koding/kite/v2"
+	kontrolprotocol "github.com/koding/kite/v2/kontrol/protocol"
+	"github.com/koding/kite/v2/protocol"
+)
+
+// memStorage is a Storage which keeps kites in memory, it supports
+// only queries by ID.
+type memStorage struct {
+	mu    sync.Mutex
+	kites map[string]*protocol.KiteWithToken
+	gets  int // number of Get calls
+}
+
+func (m *memStorage) Get(query *protocol.KontrolQuery) (Kites, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.gets++
+
+	if k, ok := m.kites[query.ID]; ok {
+		kCopy := *k
+		return Kites{&kCopy}, nil
+	}
+
+	return nil, nil
+}
+
+func (m *memStorage) Add(k *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	return m.Upsert(k, value)
+}
+
+func (m *memStorage) Update(k *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	return m.Upsert(k, value)
+}
+
+func (m *memStorage) Delete(k *protocol.Kite) error {
+	m.mu.Lock()
+	delete(m.kites, k.ID)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memStorage) Upsert(k *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	m.mu.Lock()
+	m.kites[k.ID] = &protocol.KiteWithToken{
+		Kite:  *k,
+		URL:   value.URL,
+		KeyID: value.KeyID,
+	}
+	m.mu.Unlock()
+	return nil
+}
+
+func TestHeartbeatSharedStorage(t *testing.T) {
+	storage := &memStorage{
+		kites: make(map[string]*protocol.KiteWithToken),
+	}
+
+	newKontrol := func() *Kontrol {
+		closed := make(chan struct{})
+
+		return &Kontrol{
+			heartbeats: newHeartbeatScheduler(closed),
+			closed:     closed,
+			storage:    storage,
+			log:        kite.New("kontrol", "0.0.1").Log,
+		}
+	}
+
+	// The kite is registered with the first replica, but sends its
+	// heartbeats to the second one.
+	k1, k2, k3 := newKontrol(), newKontrol(), newKontrol()
+	defer close(k1.closed)
+	defer close(k2.closed)
+	defer close(k3.closed)
+
+	remoteKite := &protocol.Kite{
+		Username:    "testuser",
+		Environment: "testing",
+		Name:        "hello",
+		Version:     "1.0.0",
+		Region:      "localhost",
+		Hostname:    "localhost",
+		ID:          "f3d2d2a1-0f35-4b1a-9f6a-1b4b1d4c8e37",
+	}
+
+	storage.Upsert(remoteKite, &kontrolprotocol.RegisterValue{URL: "http://localhost:1234/kite"})
+	k1.trackHeartbeat(remoteKite, &kontrolprotocol.RegisterValue{URL: "http://localhost:1234/kite"})
+
+	cases := []struct {
+		id   string
+		want string
+	}{
+		{remoteKite.ID, "pong"},                                   // adopted from the storage
+		{remoteKite.ID, "pong"},                                   // tracked by the replica
+		{"4d9b3c1e-7f0a-4e57-8d5b-2a6c9e1f0b42", "registeragain"}, // unknown kite
+	}
+
+	for i, cas := range cases {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/heartbeat?id="+cas.id, nil)
+
+		k2.HandleHeartbeat(rec, req)
+
+		if got := rec.Body.String(); got != cas.want {
+			t.Fatalf("%d: got %q, want %q", i, got, cas.want)
+		}
+	}
+
+	if !k2.heartbeats.tracked(remoteKite.ID) {
+		t.Fatalf("got no heartbeat for %s", remoteKite.ID)
+	}
+
+	// A kite sending its interval gets a new one when its heartbeat
+	// is adopted as well.
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/heartbeat?interval=10&id="+remoteKite.ID, nil)
+
+	k3.HandleHeartbeat(rec, req)
+
+	if got, want := rec.Body.String(), fmt.Sprintf("pong %d", HeartbeatInterval/time.Second); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestHeartbeatUnknownKite(t *testing.T) {
+	defer func(ttl time.Duration) { UnknownKiteTTL = ttl }(UnknownKiteTTL)
+	UnknownKiteTTL = 100 * time.Millisecond
+
+	storage := &memStorage{
+		kites: make(map[string]*protocol.KiteWithToken),
+	}
+
+	closed := make(chan struct{})
+	defer close(closed)
+
+	k := &Kontrol{
+		heartbeats: newHeartbeatScheduler(closed),
+		closed:     closed,
+		storage:    storage,
+		log:        kite.New("kontrol", "0.0.1").Log,
+	}
+
+	remoteKite := &protocol.Kite{
+		Username:    "testuser",
+		Environment: "testing",
+		Name:        "hello",
+		Version:     "1.0.0",
+		Region:      "localhost",
+		Hostname:    "localhost",
+		ID:          "9a7e5c3b-1d2f-4e6a-8b0c-3f5d7e9a1b2c",
+	}
+
+	heartbeat := func() string {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/heartbeat?id="+remoteKite.ID, nil)
+
+		k.HandleHeartbeat(rec, req)
+
+		return rec.Body.String()
+	}
+
+	for i := 0; i < 3; i++ {
+		if got := heartbeat(); got != "registeragain" {
+			t.Fatalf("%d: got %q, want %q", i, got, "registeragain")
+		}
+	}
+
+	if storage.gets != 1 {
+		t.Fatalf("got %d storage lookups, want 1", storage.gets)
+	}
+
+	// The kite gets registered by another replica, it's adopted
+	// once the cached lookup expires.
+	storage.Upsert(remoteKite, &kontrolprotocol.RegisterValue{URL: "http://localhost:1234/kite"})
+
+	time.Sleep(2 * UnknownKiteTTL)
+
+	if got := heartbeat(); got != "pong" {
+		t.Fatalf("got %q, want %q", got, "pong")
+	}
+
+	if storage.gets != 2 {
+		t.Fatalf("got %d storage lookups, want 2", storage.gets)
+	}
+}
@@ -0,0 +1,92 @@
+package kontrol
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/protocol"
+)
+
+// MaxIssueKeys is the maximum number of kite keys issued by a single
+// "issueKeys" request.
+var MaxIssueKeys = 1000
+
+// HandleIssueKeys issues kite keys for many users at once, which is used
+// to provision fleets of kites without running "registerMachine" on each
+// host. Each key is signed with the key pair of its tenant or environment,
+// if given, or the current key pair otherwise.
+//
+// A key that cannot be issued does not fail the whole request, the error
+// is returned in place of the key instead.
+//
+// The requests are authorized with Kontrol.AdminAuthenticate.
+func (k *Kontrol) HandleIssueKeys(r *kite.Request) (interface{}, error) {
+	if err := k.authenticateAdmin(r); err != nil {
+		k.log.Error("issue keys authentication error: %s", err)
+
+		return nil, fmt.Errorf("cannot authenticate user: %s", err)
+	}
+
+	var args protocol.IssueKeysArgs
+
+	if err := r.Args.One().Unmarshal(&args); err != nil {
+		return nil, fmt.Errorf("invalid argument: %s", err)
+	}
+
+	if len(args.Keys) > MaxIssueKeys {
+		return nil, fmt.Errorf("too many keys requested: %d, at most %d are allowed", len(args.Keys), MaxIssueKeys)
+	}
+
+	res := &protocol.IssueKeysResult{
+		Keys: make([]*protocol.IssuedKey, len(args.Keys)),
+	}
+
+	for i, key := range args.Keys {
+		if key == nil {
+			res.Keys[i] = &protocol.IssuedKey{Error: "empty key request"}
+			continue
+		}
+
+		issued := &protocol.IssuedKey{Username: key.Username}
+
+		kiteKey, err := k.issueKey(key)
+		if err != nil {
+			issued.Error = err.Error()
+		} else {
+			issued.KiteKey = kiteKey
+		}
+
+		res.Keys[i] = issued
+	}
+
+	k.log.Info("Issued %d kite keys on request of %q", len(args.Keys), r.Username)
+
+	return res, nil
+}
+
+func (k *Kontrol) issueKey(args *protocol.IssueKeyArgs) (string, error) {
+	if args.Username == "" {
+		return "", errors.New("username is required")
+	}
+
+	var keyPair *KeyPair
+
+	switch {
+	case args.Tenant != "":
+		if keyPair = k.tenantKeyPair(args.Tenant); keyPair == nil {
+			return "", fmt.Errorf("no key pair of tenant %q", args.Tenant)
+		}
+	case args.Environment != "":
+		if keyPair = k.environmentKeyPair(args.Environment); keyPair == nil {
+			return "", fmt.Errorf("no key pair of environment %q", args.Environment)
+		}
+	default:
+		var err error
+		if keyPair, err = k.KeyPair(); err != nil {
+			return "", err
+		}
+	}
+
+	return k.registerUser(args.Username, keyPair.Public, keyPair.Private)
+}
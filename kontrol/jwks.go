@@ -0,0 +1,52 @@
+package kontrol
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/koding/kite/v2/protocol"
+)
+
+// JWKS gives the public keys of the key pairs added with AddKeyPair, which
+// kontrol signs tokens with. The keys are identified by the key pair IDs,
+// which the tokens carry in their "kid" header.
+//
+// The key pairs of tenants and environments are not included, as the kites
+// they're scoped to trust them through their kite keys only.
+func (k *Kontrol) JWKS() (*protocol.JWKS, error) {
+	ids, public, _ := k.lastKeyPairs()
+
+	jwks := &protocol.JWKS{
+		Keys: make([]*protocol.JWK, 0, len(ids)),
+	}
+
+	for i, id := range ids {
+		key, err := jwt.ParseRSAPublicKeyFromPEM([]byte(public[i]))
+		if err != nil {
+			return nil, fmt.Errorf("key pair %q: %s", id, err)
+		}
+
+		jwks.Keys = append(jwks.Keys, protocol.NewJWK(id, key))
+	}
+
+	return jwks, nil
+}
+
+// HandleJWKS serves the JWKS document with the public keys kontrol signs
+// tokens with, see Config.JWKSURL of the kite package.
+func (k *Kontrol) HandleJWKS(rw http.ResponseWriter, req *http.Request) {
+	jwks, err := k.JWKS()
+	if err != nil {
+		k.log.Error("jwks: %s", err)
+		http.Error(rw, jsonError(err), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(rw).Encode(jwks); err != nil {
+		k.log.Error("jwks: could not encode response: %s", err)
+	}
+}
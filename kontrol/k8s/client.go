@@ -0,0 +1,273 @@
+package k8s
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// serviceAccountDir is where Kubernetes mounts the credentials of the
+// service account in pods.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Client is a minimal client of the Kubernetes API, which lists and
+// watches services and endpoints.
+type Client struct {
+	// URL is the URL of the API server, like "https://10.0.0.1:443".
+	URL string
+
+	// Token, when set, is the bearer token authenticating the requests.
+	Token string
+
+	// HTTPClient is used for the requests, http.DefaultClient if nil.
+	HTTPClient *http.Client
+}
+
+// InClusterClient gives a client authenticated with the service account
+// of the pod it runs in.
+func InClusterClient() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes cluster: KUBERNETES_SERVICE_HOST or KUBERNETES_SERVICE_PORT is not set")
+	}
+
+	token, err := ioutil.ReadFile(path.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := ioutil.ReadFile(path.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates in " + path.Join(serviceAccountDir, "ca.crt"))
+	}
+
+	return &Client{
+		URL:   "https://" + net.JoinHostPort(host, port),
+		Token: strings.TrimSpace(string(token)),
+		HTTPClient: &http.Client{
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				TLSClientConfig:     &tls.Config{RootCAs: pool},
+				TLSHandshakeTimeout: 10 * time.Second,
+			},
+		},
+	}, nil
+}
+
+// ObjectMeta is the metadata of a Kubernetes object.
+type ObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+}
+
+// Service is a Kubernetes service.
+type Service struct {
+	Metadata ObjectMeta `json:"metadata"`
+}
+
+// Endpoints are the addresses of the pods backing a Kubernetes service.
+type Endpoints struct {
+	Metadata ObjectMeta       `json:"metadata"`
+	Subsets  []EndpointSubset `json:"subsets,omitempty"`
+}
+
+// EndpointSubset is a set of addresses serving the same ports.
+type EndpointSubset struct {
+	Addresses []EndpointAddress `json:"addresses,omitempty"`
+	Ports     []EndpointPort    `json:"ports,omitempty"`
+}
+
+// EndpointAddress is the address of a ready pod.
+type EndpointAddress struct {
+	IP        string           `json:"ip"`
+	Hostname  string           `json:"hostname,omitempty"`
+	NodeName  string           `json:"nodeName,omitempty"`
+	TargetRef *ObjectReference `json:"targetRef,omitempty"`
+}
+
+// ObjectReference refers to the object, usually a pod, behind an address.
+type ObjectReference struct {
+	Kind      string `json:"kind,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// EndpointPort is a port of the endpoint addresses.
+type EndpointPort struct {
+	Name     string `json:"name,omitempty"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol,omitempty"`
+}
+
+// Services lists the services in the namespace, in all namespaces if
+// it's empty.
+func (c *Client) Services(namespace string) ([]Service, error) {
+	var list struct {
+		Items []Service `json:"items"`
+	}
+
+	if err := c.get(resourcePath(namespace, "services"), &list); err != nil {
+		return nil, err
+	}
+
+	return list.Items, nil
+}
+
+// Endpoints lists the endpoints in the namespace, in all namespaces if
+// it's empty.
+func (c *Client) Endpoints(namespace string) ([]Endpoints, error) {
+	var list struct {
+		Items []Endpoints `json:"items"`
+	}
+
+	if err := c.get(resourcePath(namespace, "endpoints"), &list); err != nil {
+		return nil, err
+	}
+
+	return list.Items, nil
+}
+
+// Watch watches the resources, like "services", in the namespace and
+// calls fn with the type of each event, like "ADDED" or "DELETED". The
+// existing resources are reported as added first. It returns when the
+// API server ends the watch or the done channel is closed.
+func (c *Client) Watch(namespace, resource string, done <-chan struct{}, fn func(eventType string)) error {
+	req, err := c.newRequest(resourcePath(namespace, resource) + "?watch=true&resourceVersion=0")
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	resp, err := c.httpClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(resp.Body))
+
+	for {
+		var event struct {
+			Type string `json:"type"`
+		}
+
+		if err := dec.Decode(&event); err != nil {
+			select {
+			case <-done:
+				return nil
+			default:
+			}
+
+			if err == io.EOF {
+				return nil
+			}
+
+			return err
+		}
+
+		if event.Type == "ERROR" {
+			return fmt.Errorf("watching %s: error event", resource)
+		}
+
+		fn(event.Type)
+	}
+}
+
+func (c *Client) get(path string, v interface{}) error {
+	req, err := c.newRequest(path)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *Client) newRequest(path string) (*http.Request, error) {
+	u, err := url.Parse(strings.TrimSuffix(c.URL, "/") + path)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	return req, nil
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+
+	return http.DefaultClient
+}
+
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	p, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	return fmt.Errorf("%s %s: %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status, strings.TrimSpace(string(p)))
+}
+
+func resourcePath(namespace, resource string) string {
+	if namespace == "" {
+		return "/api/v1/" + resource
+	}
+
+	return "/api/v1/namespaces/" + url.PathEscape(namespace) + "/" + resource
+}
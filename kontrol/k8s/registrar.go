@@ -0,0 +1,393 @@
+// Package k8s registers the endpoints of Kubernetes services in kontrol,
+// so workloads which are not kites themselves are discoverable by kite
+// clients with getKites.
+//
+// A service is registered when it has the AnnotationName annotation
+// or it's given in Registrar.Names. Each ready address of the service
+// endpoints is registered as a separate kite, which is removed from
+// kontrol once the address is gone.
+package k8s
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/kontrol"
+	kontrolprotocol "github.com/koding/kite/v2/kontrol/protocol"
+	"github.com/koding/kite/v2/protocol"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Annotations of the Kubernetes services, which configure their
+// registration.
+const (
+	// AnnotationName is the kite name the service is registered with,
+	// the service name if the annotation is empty.
+	AnnotationName = "kite.koding.com/name"
+
+	// AnnotationVersion is the kite version, "0.0.0" by default.
+	AnnotationVersion = "kite.koding.com/version"
+
+	// AnnotationEnvironment is the kite environment, the namespace
+	// of the service by default.
+	AnnotationEnvironment = "kite.koding.com/environment"
+
+	// AnnotationPort is the name or the number of the endpoint port
+	// registered in the kite URL. It's needed when the service has
+	// more than one port.
+	AnnotationPort = "kite.koding.com/port"
+
+	// AnnotationScheme is the scheme of the kite URL, "http" by default.
+	AnnotationScheme = "kite.koding.com/scheme"
+
+	// AnnotationPath is the path of the kite URL, "/kite" by default.
+	AnnotationPath = "kite.koding.com/path"
+)
+
+// Registrar keeps the kites registered in kontrol in sync with the
+// endpoints of Kubernetes services.
+type Registrar struct {
+	// Namespace restricts the registered services to a single
+	// namespace, services of all namespaces are registered if empty.
+	Namespace string
+
+	// Username is the username of the registered kites.
+	Username string
+
+	// Region is the region of the registered kites, "kubernetes" if empty.
+	Region string
+
+	// Names gives the kite names of services without the AnnotationName
+	// annotation, keyed by "namespace/service".
+	Names map[string]string
+
+	// KeyID is the ID of the kontrol key pair the tokens for the kites
+	// are signed with. The current key pair is used if empty.
+	KeyID string
+
+	// ResyncInterval is the interval the services are listed in, besides
+	// when they change. The registered kites are refreshed, so they do
+	// not expire, every half of kontrol.UpdateInterval, which is also
+	// the longest resync interval.
+	ResyncInterval time.Duration
+
+	client  *Client
+	storage kontrol.Storage
+	log     kite.Logger
+
+	// registered are the registered kites, keyed by ID, only accessed
+	// by the Run goroutine once it's running.
+	registered map[string]*registration
+
+	mu      sync.Mutex // protects running and closing
+	running bool
+	closing bool
+	closed  chan struct{}
+	done    chan struct{}
+}
+
+// registration is a kite registered for an endpoint address.
+type registration struct {
+	kite      *protocol.Kite
+	value     *kontrolprotocol.RegisterValue
+	updatedAt time.Time
+}
+
+// NewRegistrar gives a registrar of the services read with the client,
+// which registers their endpoints in the kontrol storage.
+func NewRegistrar(client *Client, storage kontrol.Storage, log kite.Logger) *Registrar {
+	return &Registrar{
+		client:     client,
+		storage:    storage,
+		log:        log,
+		registered: make(map[string]*registration),
+		closed:     make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// Run keeps the kites in sync with the services until the registrar
+// is closed. The registered kites are removed from kontrol on return.
+func (r *Registrar) Run() {
+	r.mu.Lock()
+	if r.closing || r.running {
+		r.mu.Unlock()
+		return
+	}
+	r.running = true
+	r.mu.Unlock()
+
+	defer close(r.done)
+
+	resync := r.ResyncInterval
+	if resync <= 0 || resync > kontrol.UpdateInterval/2 {
+		resync = kontrol.UpdateInterval / 2
+	}
+
+	changed := make(chan struct{}, 1)
+
+	for _, resource := range []string{"services", "endpoints"} {
+		go r.watch(resource, changed)
+	}
+
+	t := time.NewTicker(resync)
+	defer t.Stop()
+
+	r.syncLogged()
+
+	for {
+		select {
+		case <-changed:
+			r.syncLogged()
+		case <-t.C:
+			r.syncLogged()
+		case <-r.closed:
+			r.deregister()
+			return
+		}
+	}
+}
+
+// Close stops the registrar and waits until the kites are removed
+// from kontrol.
+func (r *Registrar) Close() error {
+	r.mu.Lock()
+	if r.closing {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closing = true
+	running := r.running
+	r.mu.Unlock()
+
+	close(r.closed)
+
+	if running {
+		<-r.done
+	} else {
+		r.deregister()
+	}
+
+	return nil
+}
+
+// watch notifies on the changed channel when the resources change,
+// restarting the watch when it ends.
+func (r *Registrar) watch(resource string, changed chan<- struct{}) {
+	for {
+		err := r.client.Watch(r.Namespace, resource, r.closed, func(string) {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		})
+
+		if err != nil {
+			r.log.Warning("k8s: watching %s: %s", resource, err)
+		}
+
+		select {
+		case <-r.closed:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (r *Registrar) syncLogged() {
+	if err := r.Sync(); err != nil {
+		r.log.Error("k8s: sync: %s", err)
+	}
+}
+
+// Sync registers the current endpoints of the services and removes the
+// kites of the addresses which are gone. It's called by Run, which
+// should be used instead.
+func (r *Registrar) Sync() error {
+	services, err := r.client.Services(r.Namespace)
+	if err != nil {
+		return err
+	}
+
+	endpoints, err := r.client.Endpoints(r.Namespace)
+	if err != nil {
+		return err
+	}
+
+	byName := make(map[string]*Endpoints, len(endpoints))
+	for i := range endpoints {
+		e := &endpoints[i]
+		byName[e.Metadata.Namespace+"/"+e.Metadata.Name] = e
+	}
+
+	now := time.Now()
+	current := make(map[string]struct{})
+
+	for i := range services {
+		svc := &services[i]
+
+		e, ok := byName[svc.Metadata.Namespace+"/"+svc.Metadata.Name]
+		if !ok {
+			continue
+		}
+
+		regs, err := r.registrations(svc, e)
+		if err != nil {
+			r.log.Warning("k8s: %s/%s: %s", svc.Metadata.Namespace, svc.Metadata.Name, err)
+			continue
+		}
+
+		for _, reg := range regs {
+			current[reg.kite.ID] = struct{}{}
+
+			old, ok := r.registered[reg.kite.ID]
+			if ok && *old.kite == *reg.kite && old.value.URL == reg.value.URL &&
+				now.Sub(old.updatedAt) < kontrol.UpdateInterval/2 {
+				continue
+			}
+
+			if err := r.storage.Upsert(reg.kite, reg.value); err != nil {
+				return err
+			}
+
+			if !ok {
+				r.log.Info("k8s: registered %s with %s", reg.kite, reg.value.URL)
+			}
+
+			reg.updatedAt = now
+			r.registered[reg.kite.ID] = reg
+		}
+	}
+
+	for id, reg := range r.registered {
+		if _, ok := current[id]; ok {
+			continue
+		}
+
+		if err := r.storage.Delete(reg.kite); err != nil {
+			return err
+		}
+
+		r.log.Info("k8s: deregistered %s", reg.kite)
+
+		delete(r.registered, id)
+	}
+
+	return nil
+}
+
+// deregister removes all the registered kites.
+func (r *Registrar) deregister() {
+	for id, reg := range r.registered {
+		if err := r.storage.Delete(reg.kite); err != nil {
+			r.log.Error("k8s: deregistering %s: %s", reg.kite, err)
+		}
+
+		delete(r.registered, id)
+	}
+}
+
+// registrations gives the kites of the service endpoints, if the service
+// is to be registered.
+func (r *Registrar) registrations(svc *Service, e *Endpoints) ([]*registration, error) {
+	meta := svc.Metadata
+	key := meta.Namespace + "/" + meta.Name
+
+	name, ok := meta.Annotations[AnnotationName]
+	if !ok {
+		if name, ok = r.Names[key]; !ok {
+			return nil, nil
+		}
+	}
+
+	if name == "" {
+		name = meta.Name
+	}
+
+	version := annotation(meta, AnnotationVersion, "0.0.0")
+	environment := annotation(meta, AnnotationEnvironment, meta.Namespace)
+	scheme := annotation(meta, AnnotationScheme, "http")
+	urlPath := annotation(meta, AnnotationPath, "/kite")
+
+	region := r.Region
+	if region == "" {
+		region = "kubernetes"
+	}
+
+	var regs []*registration
+
+	for _, subset := range e.Subsets {
+		port, err := pickPort(subset.Ports, meta.Annotations[AnnotationPort])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, addr := range subset.Addresses {
+			host := addr.IP
+			if addr.TargetRef != nil && addr.TargetRef.Name != "" {
+				host = addr.TargetRef.Name
+			} else if addr.Hostname != "" {
+				host = addr.Hostname
+			}
+
+			hostport := net.JoinHostPort(addr.IP, strconv.Itoa(port))
+
+			k := &protocol.Kite{
+				Username:    r.Username,
+				Environment: environment,
+				Name:        name,
+				Version:     version,
+				Region:      region,
+				Hostname:    host,
+				ID:          uuid.NewV5(uuid.NamespaceURL, "k8s://"+key+"/"+hostport).String(),
+			}
+
+			if err := k.Validate(); err != nil {
+				return nil, fmt.Errorf("invalid kite %s: %s", k, err)
+			}
+
+			regs = append(regs, &registration{
+				kite: k,
+				value: &kontrolprotocol.RegisterValue{
+					URL:   scheme + "://" + hostport + urlPath,
+					KeyID: r.KeyID,
+				},
+			})
+		}
+	}
+
+	return regs, nil
+}
+
+// pickPort gives the port with the given name or number, or the only
+// port if none is given.
+func pickPort(ports []EndpointPort, want string) (int, error) {
+	if want == "" {
+		if len(ports) != 1 {
+			return 0, fmt.Errorf("%d ports, choose one with the %s annotation", len(ports), AnnotationPort)
+		}
+
+		return ports[0].Port, nil
+	}
+
+	for _, p := range ports {
+		if p.Name == want || strconv.Itoa(p.Port) == want {
+			return p.Port, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no port %q", want)
+}
+
+func annotation(meta ObjectMeta, key, defaultValue string) string {
+	if v := meta.Annotations[key]; v != "" {
+		return v
+	}
+
+	return defaultValue
+}
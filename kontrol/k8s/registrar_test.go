@@ -0,0 +1,145 @@
+package k8s
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/kontrol"
+	"github.com/koding/kite/v2/protocol"
+)
+
+// fakeAPI serves the services and endpoints of a single namespace.
+type fakeAPI struct {
+	mu        sync.Mutex
+	services  []Service
+	endpoints []Endpoints
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Query().Get("watch") == "true" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"type": "ADDED"})
+		w.(http.Flusher).Flush()
+		<-req.Context().Done()
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var items interface{}
+
+	switch req.URL.Path {
+	case "/api/v1/namespaces/default/services":
+		items = f.services
+	case "/api/v1/namespaces/default/endpoints":
+		items = f.endpoints
+	default:
+		http.NotFound(w, req)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+}
+
+func (f *fakeAPI) setAddresses(ips ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var addrs []EndpointAddress
+	for _, ip := range ips {
+		addrs = append(addrs, EndpointAddress{IP: ip})
+	}
+
+	f.endpoints = []Endpoints{{
+		Metadata: ObjectMeta{Name: "math", Namespace: "default"},
+		Subsets: []EndpointSubset{{
+			Addresses: addrs,
+			Ports: []EndpointPort{
+				{Name: "metrics", Port: 9090},
+				{Name: "kite", Port: 6000},
+			},
+		}},
+	}}
+}
+
+func urls(t *testing.T, storage kontrol.Storage) []string {
+	kites, err := storage.Get(&protocol.KontrolQuery{Username: "kubernetes", Name: "math"})
+	if err != nil {
+		t.Fatalf("Get()=%s", err)
+	}
+
+	var urls []string
+	for _, k := range kites {
+		if k.Kite.Environment != "default" || k.Kite.Region != "kubernetes" {
+			t.Errorf("unexpected kite %s", &k.Kite)
+		}
+
+		urls = append(urls, k.URL)
+	}
+
+	sort.Strings(urls)
+	return urls
+}
+
+func TestRegistrar(t *testing.T) {
+	api := &fakeAPI{
+		services: []Service{{
+			Metadata: ObjectMeta{
+				Name:      "math",
+				Namespace: "default",
+				Annotations: map[string]string{
+					AnnotationName: "",
+					AnnotationPort: "kite",
+				},
+			},
+		}, {
+			Metadata: ObjectMeta{Name: "other", Namespace: "default"},
+		}},
+	}
+	api.setAddresses("10.0.0.1", "10.0.0.2")
+
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+
+	storage := kontrol.NewMemoryStorage()
+	defer storage.Close()
+
+	r := NewRegistrar(&Client{URL: ts.URL}, storage, kite.New("k8s", "0.0.1").Log)
+	r.Namespace = "default"
+	r.Username = "kubernetes"
+
+	if err := r.Sync(); err != nil {
+		t.Fatalf("Sync()=%s", err)
+	}
+
+	want := []string{"http://10.0.0.1:6000/kite", "http://10.0.0.2:6000/kite"}
+	if got := urls(t, storage); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	api.setAddresses("10.0.0.2")
+
+	if err := r.Sync(); err != nil {
+		t.Fatalf("Sync()=%s", err)
+	}
+
+	if got := urls(t, storage); len(got) != 1 || got[0] != want[1] {
+		t.Fatalf("got %v, want %v", got, want[1:])
+	}
+
+	go r.Run()
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close()=%s", err)
+	}
+
+	if got := urls(t, storage); len(got) != 0 {
+		t.Fatalf("got %v, want no kites after Close", got)
+	}
+}
@@ -1,11 +1,13 @@
 package kontrol
 
 import (
+	"fmt"
 	"math/rand"
+	"sort"
 	"strings"
 
 	"github.com/hashicorp/go-version"
-	"github.com/koding/kite/protocol"
+	"github.com/koding/kite/v2/protocol"
 )
 
 // Kites is a helpe type to work with a set of kites
@@ -30,6 +32,115 @@ func (k *Kites) Shuffle() {
 	*k = shuffled
 }
 
+// Dedup removes kites with duplicate IDs, keeping the first occurrence of
+// each one. The caller is responsible for ordering the kites so the
+// preferred one - usually the most recently updated - comes first.
+func (k *Kites) Dedup() {
+	seen := make(map[string]struct{}, len(*k))
+	deduped := make(Kites, 0, len(*k))
+
+	for _, kite := range *k {
+		if _, ok := seen[kite.Kite.ID]; ok {
+			continue
+		}
+
+		seen[kite.Kite.ID] = struct{}{}
+		deduped = append(deduped, kite)
+	}
+
+	*k = deduped
+}
+
+// Page sorts the kites by ID and keeps at most limit of them, after
+// skipping the first offset ones. A non-positive limit keeps all the kites
+// after the offset. It returns the number of kites before paging.
+func (k *Kites) Page(offset, limit int) (total int) {
+	total = len(*k)
+
+	sort.Slice(*k, func(i, j int) bool {
+		return (*k)[i].Kite.ID < (*k)[j].Kite.ID
+	})
+
+	if offset > total {
+		offset = total
+	}
+
+	*k = (*k)[offset:]
+
+	if limit > 0 && limit < len(*k) {
+		*k = (*k)[:limit]
+	}
+
+	return total
+}
+
+// PreferRegion moves the kites from the region before the other ones,
+// keeping the order of the kites within both groups.
+func (k *Kites) PreferRegion(region string) {
+	sort.SliceStable(*k, func(i, j int) bool {
+		return (*k)[i].Kite.Region == region && (*k)[j].Kite.Region != region
+	})
+}
+
+// Project clears the fields of the kites, which are not listed. Valid
+// fields are the keys of protocol.KontrolQuery.Fields, "url", "keyId",
+// "methods" and "labels".
+// The token is not affected.
+func (k Kites) Project(fields []string) error {
+	keep := make(map[string]bool, len(fields))
+
+	for _, field := range fields {
+		switch field {
+		case "username", "environment", "name", "version", "region", "hostname", "id", "url", "keyId", "methods", "labels":
+			keep[field] = true
+		default:
+			return fmt.Errorf("unknown field %q", field)
+		}
+	}
+
+	for _, kite := range k {
+		projected := &protocol.KiteWithToken{Token: kite.Token}
+
+		if keep["username"] {
+			projected.Kite.Username = kite.Kite.Username
+		}
+		if keep["environment"] {
+			projected.Kite.Environment = kite.Kite.Environment
+		}
+		if keep["name"] {
+			projected.Kite.Name = kite.Kite.Name
+		}
+		if keep["version"] {
+			projected.Kite.Version = kite.Kite.Version
+		}
+		if keep["region"] {
+			projected.Kite.Region = kite.Kite.Region
+		}
+		if keep["hostname"] {
+			projected.Kite.Hostname = kite.Kite.Hostname
+		}
+		if keep["id"] {
+			projected.Kite.ID = kite.Kite.ID
+		}
+		if keep["url"] {
+			projected.URL = kite.URL
+		}
+		if keep["keyId"] {
+			projected.KeyID = kite.KeyID
+		}
+		if keep["methods"] {
+			projected.Methods = kite.Methods
+		}
+		if keep["labels"] {
+			projected.Labels = kite.Labels
+		}
+
+		*kite = *projected
+	}
+
+	return nil
+}
+
 // Filter filters out kites with the given constraints
 func (k *Kites) Filter(constraint version.Constraints, keyRest string) {
 	filtered := make(Kites, 0)
@@ -42,6 +153,23 @@ func (k *Kites) Filter(constraint version.Constraints, keyRest string) {
 	*k = filtered
 }
 
+// FilterLabels filters out kites, which don't have all the labels
+// of the selector.
+func (k *Kites) FilterLabels(selector map[string]string) {
+	if len(selector) == 0 {
+		return
+	}
+
+	filtered := make(Kites, 0)
+	for _, kite := range *k {
+		if protocol.MatchLabels(selector, kite.Labels) {
+			filtered = append(filtered, kite)
+		}
+	}
+
+	*k = filtered
+}
+
 func isValid(k *protocol.Kite, c version.Constraints, keyRest string) bool {
 	// Check the version constraint.
 	v, _ := version.NewVersion(k.Version)
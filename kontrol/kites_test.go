@@ -5,8 +5,8 @@ import (
 	"testing"
 
 	"github.com/hashicorp/go-version"
-	"github.com/koding/kite/kontrol"
-	"github.com/koding/kite/protocol"
+	"github.com/koding/kite/v2/kontrol"
+	"github.com/koding/kite/v2/protocol"
 )
 
 func TestKitesShuffle(t *testing.T) {
@@ -64,3 +64,46 @@ func TestKitesFilter(t *testing.T) {
 		t.Fatalf("got %+v, want %+v", kites, want)
 	}
 }
+
+func TestKitesDedup(t *testing.T) {
+	kites := kontrol.Kites{
+		{Kite: protocol.Kite{ID: "1"}, URL: "http://new:1"},
+		{Kite: protocol.Kite{ID: "2"}, URL: "http://new:2"},
+		{Kite: protocol.Kite{ID: "1"}, URL: "http://old:1"},
+		{Kite: protocol.Kite{ID: "3"}, URL: "http://new:3"},
+		{Kite: protocol.Kite{ID: "2"}, URL: "http://old:2"},
+	}
+
+	want := kontrol.Kites{
+		kites[0],
+		kites[1],
+		kites[3],
+	}
+
+	kites.Dedup()
+
+	if !reflect.DeepEqual(kites, want) {
+		t.Fatalf("got %+v, want %+v", kites, want)
+	}
+}
+
+func TestKitesPage(t *testing.T) {
+	kites := kontrol.Kites{
+		{Kite: protocol.Kite{ID: "c"}},
+		{Kite: protocol.Kite{ID: "a"}},
+		{Kite: protocol.Kite{ID: "d"}},
+		{Kite: protocol.Kite{ID: "b"}},
+	}
+
+	if total := kites.Page(1, 2); total != 4 {
+		t.Fatalf("got %d total kites, want 4", total)
+	}
+
+	if len(kites) != 2 || kites[0].Kite.ID != "b" || kites[1].Kite.ID != "c" {
+		t.Fatalf("got %+v, want kites b and c", kites)
+	}
+
+	if kites.Page(5, 0); len(kites) != 0 {
+		t.Fatalf("got %d kites past the end, want 0", len(kites))
+	}
+}
@@ -5,22 +5,25 @@ package kontrol
 import (
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"strings"
 	"sync"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
-	"github.com/koding/kite"
-	"github.com/koding/kite/config"
-	"github.com/koding/kite/kitekey"
-	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/kitekey"
+	kontrolprotocol "github.com/koding/kite/v2/kontrol/protocol"
+	"github.com/koding/kite/v2/protocol"
 	uuid "github.com/satori/go.uuid"
 )
 
 const (
 	KontrolVersion = "0.0.4"
 	KitesPrefix    = "/kites"
+	CountersPrefix = "/counters"
 )
 
 var (
@@ -32,6 +35,10 @@ var (
 	// no more than a few minutes, to account for clock skew.
 	TokenLeeway = 5 * time.Minute
 
+	// DelegateTokenTTL is the default TTL of tokens issued by the
+	// "delegateToken" method, which are meant to be short-lived.
+	DelegateTokenTTL = 5 * time.Minute
+
 	// DefaultPort is a default kite port value.
 	DefaultPort = 4000
 
@@ -42,6 +49,17 @@ var (
 	// heartbeat to avoid network delays
 	HeartbeatDelay = time.Second * 20
 
+	// MaxHeartbeatInterval caps the heartbeat intervals given by
+	// Kontrol.HeartbeatPolicy. Kites heartbeating less frequently
+	// could expire from the storage, see KeyTTL.
+	MaxHeartbeatInterval = time.Second * 60
+
+	// UnknownKiteTTL is the time in which heartbeats of a kite, which was
+	// not found in the storage, are answered with "registeragain" without
+	// looking it up again. It keeps deregistered kites, or callers sending
+	// bogus IDs, from hitting the storage on every heartbeat.
+	UnknownKiteTTL = time.Second * 10
+
 	// UpdateInterval is the interval in which the key gets updated
 	// periodically. Keeping it low increase the write load to the storage, so
 	// be cautious when changing it.
@@ -52,6 +70,30 @@ var (
 	// doesn't support TTL mechanism (such as PostgreSQL), it should use a
 	// background cleaner which cleans up keys that are KeyTTL old.
 	KeyTTL = time.Second * 90
+
+	// DedupKites makes storage implementations return a single kite for
+	// each kite ID, picking the most recently updated one. A kite that
+	// registered again with a new URL before its old entry expired
+	// would be returned twice otherwise.
+	DedupKites = true
+)
+
+// RegisterPolicy describes how Kontrol resolves conflicting registrations
+// of kites with the same ID.
+type RegisterPolicy int
+
+const (
+	// RegisterReplace replaces the old registration with the new one
+	// and notifies the displaced kite, if it's connected to this Kontrol.
+	RegisterReplace RegisterPolicy = iota
+
+	// RegisterReject rejects the new registration, until the old one
+	// expires.
+	RegisterReject
+
+	// RegisterAllowBoth keeps both registrations alive, the last
+	// registration or heartbeat update wins in the storage.
+	RegisterAllowBoth
 )
 
 type Kontrol struct {
@@ -84,13 +126,77 @@ type Kontrol struct {
 	// TokenNoNBF when true does not set nbf field for generated JWT tokens.
 	TokenNoNBF bool
 
+	// AdminAuthenticate is used to authorize requests to the "refreshKeys",
+	// "createTenant" and "removeTenant" methods. If nil, only kites owned
+	// by the kontrol user are allowed.
+	AdminAuthenticate func(r *kite.Request) error
+
+	// DelegateAuthenticate is used to authorize requests to the
+	// "delegateToken" method, where a kite obtains a token to act on
+	// behalf of the given user. If nil, tokens are not delegated.
+	DelegateAuthenticate func(r *kite.Request, username string) error
+
+	// DelegateTokenTTL describes TTL for a token issued by the
+	// "delegateToken" method.
+	//
+	// If DelegateTokenTTL is 0, default global DelegateTokenTTL is used.
+	DelegateTokenTTL time.Duration
+
+	// HeartbeatPolicy, when non-nil, gives the heartbeat interval of a kite,
+	// which has been sending heartbeats steadily for the given duration.
+	// When the interval changes, the kite is asked to heartbeat with the
+	// new one. It allows backing off heartbeats of stable kites, see
+	// BackoffHeartbeats. The interval is capped at MaxHeartbeatInterval.
+	//
+	// If nil, kites heartbeat every HeartbeatInterval.
+	HeartbeatPolicy func(kite *protocol.Kite, stable time.Duration) time.Duration
+
+	// Quotas maps usernames to their quotas, users not listed there
+	// are limited by DefaultQuota.
+	Quotas map[string]*Quota
+
+	// DefaultQuota, when non-nil, limits users with no quota in Quotas.
+	DefaultQuota *Quota
+
+	// RegisterPolicy describes what happens when a kite registers with
+	// an ID, which is still registered from a different URL.
+	//
+	// By default the old registration is replaced.
+	RegisterPolicy RegisterPolicy
+
+	// QueryCacheTTL, when non-zero, enables caching of the kites matching
+	// getKites queries for the given duration, which cuts the storage load
+	// for hot queries. Cached queries matching a kite are invalidated when
+	// the kite registers, deregisters or updates its methods on this
+	// Kontrol, changes made by other Kontrol instances are visible after
+	// the cached queries expire.
+	QueryCacheTTL time.Duration
+
+	// QueryCacheSize is the maximum number of cached queries, the least
+	// recently used ones are removed first.
+	//
+	// If QueryCacheSize is 0, DefaultQueryCacheSize is used.
+	QueryCacheSize int
+
 	clientLocks *IdLock
 
-	heartbeats   map[string]*heartbeat
-	heartbeatsMu sync.Mutex // protects each clients heartbeat timer
+	// heartbeats tracks heartbeats of the registered kites
+	heartbeats *heartbeatScheduler
+
+	// unknownKites caches the IDs of kites sending heartbeats, which
+	// were not found in the storage, see UnknownKiteTTL
+	unknownKites unknownKites
+
+	tokenCache   TokenCache
+	tokenCacheMu sync.Mutex // serializes token generation
+
+	// clients holds register connections of kites, keys are kite IDs
+	clients   map[string]*kite.Client
+	clientsMu sync.Mutex // protects clients and values
 
-	tokenCache   map[string]cachedToken
-	tokenCacheMu sync.Mutex
+	// values holds the stored register values of kites, which change
+	// when the kites update their methods, keys are kite IDs
+	values map[string]*kontrolprotocol.RegisterValue
 
 	// closed notifies goroutines started by kontrol that it got closed
 	closed chan struct{}
@@ -103,6 +209,34 @@ type Kontrol struct {
 	lastIDs     []string
 	lastPublic  []string
 	lastPrivate []string
+	lastMu      sync.RWMutex // protects lastIDs, lastPublic, lastPrivate and selfKeyPair
+
+	// envKeys and keyEnvs map environments to their key pairs and
+	// public keys to their environments, see AddEnvironmentKeyPair
+	envKeys   map[string]*KeyPair
+	keyEnvs   map[string]string
+	envKeysMu sync.RWMutex
+
+	// tenants holds the key pairs of tenants, see AddTenantKeyPair
+	tenants   tenants
+	tenantsMu sync.RWMutex
+
+	// events delivers lifecycle events to publishers,
+	// see AddEventPublisher
+	events events
+
+	// beforeRegister holds the admission hooks, see OnBeforeRegister
+	beforeRegister   []func(*kite.Request, *protocol.RegisterArgs) error
+	beforeRegisterMu sync.RWMutex
+
+	// counters keeps quota counters in memory, if the storage
+	// is not a Counter
+	counters     Counter
+	countersOnce sync.Once
+
+	// queryCache caches getKites queries, see QueryCacheTTL
+	queryCache     *queryCache
+	queryCacheOnce sync.Once
 
 	// storage defines the storage of the kites.
 	storage Storage
@@ -117,11 +251,6 @@ type Kontrol struct {
 	log kite.Logger
 }
 
-type heartbeat struct {
-	updateC chan func() error
-	timer   *time.Timer
-}
-
 // New creates a new kontrol instance with the given version and config
 // instance, and the default kontrol handlers. Publickey is used for
 // validating tokens and privateKey is used for signing tokens.
@@ -141,13 +270,25 @@ func New(conf *config.Config, version string) *Kontrol {
 	kontrol := NewWithoutHandlers(conf, version)
 
 	kontrol.Kite.HandleFunc("register", kontrol.HandleRegister)
+	kontrol.Kite.HandleFunc("registerKites", kontrol.HandleRegisterKites)
 	kontrol.Kite.HandleFunc("registerMachine", kontrol.HandleMachine).DisableAuthentication()
 	kontrol.Kite.HandleFunc("getKites", kontrol.HandleGetKites)
 	kontrol.Kite.HandleFunc("getToken", kontrol.HandleGetToken)
+	kontrol.Kite.HandleFunc("getTokens", kontrol.HandleGetTokens)
+	kontrol.Kite.HandleFunc("getTokenByID", kontrol.HandleGetTokenByID)
+	kontrol.Kite.HandleFunc("delegateToken", kontrol.HandleDelegateToken)
+	kontrol.Kite.HandleFunc("dialBack", kontrol.HandleDialBack)
 	kontrol.Kite.HandleFunc("getKey", kontrol.HandleGetKey)
+	kontrol.Kite.HandleFunc("refreshKeys", kontrol.HandleRefreshKeys)
+	kontrol.Kite.HandleFunc("createTenant", kontrol.HandleCreateTenant)
+	kontrol.Kite.HandleFunc("issueKeys", kontrol.HandleIssueKeys)
+	kontrol.Kite.HandleFunc("removeTenant", kontrol.HandleRemoveTenant)
+	kontrol.Kite.HandleFunc("updateMethods", kontrol.HandleUpdateMethods)
+	kontrol.Kite.HandleFunc("kite.methods", kontrol.HandleGetMethods)
 
 	kontrol.Kite.HandleHTTPFunc("/register", kontrol.HandleRegisterHTTP)
 	kontrol.Kite.HandleHTTPFunc("/heartbeat", kontrol.HandleHeartbeat)
+	kontrol.Kite.HandleHTTPFunc("/jwks", kontrol.HandleJWKS)
 
 	return kontrol
 }
@@ -160,19 +301,35 @@ func New(conf *config.Config, version string) *Kontrol {
 //
 //     kontrol := NewWithoutHandlers(conf, version)
 //     kontrol.Kite.HandleFunc("register", kontrol.HandleRegister)
+//     kontrol.Kite.HandleFunc("registerKites", kontrol.HandleRegisterKites)
 //     kontrol.Kite.HandleFunc("registerMachine", kontrol.HandleMachine).DisableAuthentication()
 //     kontrol.Kite.HandleFunc("getKites", kontrol.HandleGetKites)
 //     kontrol.Kite.HandleFunc("getToken", kontrol.HandleGetToken)
+//     kontrol.Kite.HandleFunc("getTokens", kontrol.HandleGetTokens)
+//     kontrol.Kite.HandleFunc("getTokenByID", kontrol.HandleGetTokenByID)
+//     kontrol.Kite.HandleFunc("delegateToken", kontrol.HandleDelegateToken)
+//     kontrol.Kite.HandleFunc("dialBack", kontrol.HandleDialBack)
 //     kontrol.Kite.HandleFunc("getKey", kontrol.HandleGetKey)
+//     kontrol.Kite.HandleFunc("refreshKeys", kontrol.HandleRefreshKeys)
+//     kontrol.Kite.HandleFunc("createTenant", kontrol.HandleCreateTenant)
+//     kontrol.Kite.HandleFunc("issueKeys", kontrol.HandleIssueKeys)
+//     kontrol.Kite.HandleFunc("removeTenant", kontrol.HandleRemoveTenant)
+//     kontrol.Kite.HandleFunc("updateMethods", kontrol.HandleUpdateMethods)
+//     kontrol.Kite.HandleFunc("kite.methods", kontrol.HandleGetMethods)
 //     kontrol.Kite.HandleHTTPFunc("/heartbeat", kontrol.HandleHeartbeat)
 //     kontrol.Kite.HandleHTTPFunc("/register", kontrol.HandleRegisterHTTP)
+//     kontrol.Kite.HandleHTTPFunc("/jwks", kontrol.HandleJWKS)
 //
 func NewWithoutHandlers(conf *config.Config, version string) *Kontrol {
+	closed := make(chan struct{})
+
 	k := &Kontrol{
 		clientLocks: NewIdlock(),
-		heartbeats:  make(map[string]*heartbeat),
-		closed:      make(chan struct{}),
-		tokenCache:  make(map[string]cachedToken),
+		heartbeats:  newHeartbeatScheduler(closed),
+		closed:      closed,
+		tokenCache:  NewMemoryTokenCache(),
+		clients:     make(map[string]*kite.Client),
+		values:      make(map[string]*kontrolprotocol.RegisterValue),
 	}
 
 	// Make a copy to not modify user-provided value.
@@ -215,6 +372,42 @@ func (k *Kontrol) AddAuthenticator(keyType string, fn func(*kite.Request) error)
 	k.Kite.Authenticators[keyType] = fn
 }
 
+// OnBeforeRegister adds a hook, which is called before a kite registering
+// with kontrol is written to the storage. The hooks are called in the order
+// they were added. If any of them returns non-nil error, the registration
+// is rejected and the error is sent back to the kite.
+//
+// The hooks can be used to enforce naming conventions, quota limits or
+// to reject specific versions of kites. The kite is given by args.Kite,
+// the hooks must not modify it.
+func (k *Kontrol) OnBeforeRegister(fn func(r *kite.Request, args *protocol.RegisterArgs) error) {
+	k.beforeRegisterMu.Lock()
+	k.beforeRegister = append(k.beforeRegister, fn)
+	k.beforeRegisterMu.Unlock()
+}
+
+// admit checks the quota of the kite's owner and runs the admission hooks
+// for the registration.
+func (k *Kontrol) admit(r *kite.Request, args *protocol.RegisterArgs) error {
+	if err := k.checkKiteQuota(args.Kite); err != nil {
+		k.log.Info("Register of %s was rejected: %s", args.Kite, err)
+		return err
+	}
+
+	k.beforeRegisterMu.RLock()
+	hooks := k.beforeRegister
+	k.beforeRegisterMu.RUnlock()
+
+	for _, fn := range hooks {
+		if err := fn(r, args); err != nil {
+			k.log.Info("Register of %s was rejected: %s", args.Kite, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
 // DeleteKeyPair deletes the key with the given id or public key. (One of them
 // can be empty)
 func (k *Kontrol) DeleteKeyPair(id, public string) error {
@@ -249,6 +442,9 @@ func (k *Kontrol) DeleteKeyPair(id, public string) error {
 		return err
 	}
 
+	k.lastMu.Lock()
+	defer k.lastMu.Unlock()
+
 	deleteIndex := -1
 	for i, p := range k.lastPublic {
 		if p == pair.Public {
@@ -300,9 +496,11 @@ func (k *Kontrol) AddKeyPair(id, public, private string) error {
 	}
 
 	// set last set key pair
+	k.lastMu.Lock()
 	k.lastIDs = append(k.lastIDs, id)
 	k.lastPublic = append(k.lastPublic, public)
 	k.lastPrivate = append(k.lastPrivate, private)
+	k.lastMu.Unlock()
 
 	if err := keyPair.Validate(); err != nil {
 		return err
@@ -335,25 +533,45 @@ func (k *Kontrol) SetStorage(storage Storage) {
 	k.storage = storage
 }
 
+// Storage gives the backend storage of the kites.
+func (k *Kontrol) Storage() Storage {
+	return k.storage
+}
+
 // SetKeyPairStorage sets the backend storage that kontrol is going to use to
 // store keypairs
 func (k *Kontrol) SetKeyPairStorage(storage KeyPairStorage) {
 	k.keyPair = storage
 }
 
+// SetTokenCache sets the cache that kontrol is going to use to cache
+// signed tokens. By default an in-memory cache is used.
+func (k *Kontrol) SetTokenCache(cache TokenCache) {
+	k.tokenCache = cache
+}
+
 // Close stops kontrol and closes all connections
 func (k *Kontrol) Close() {
 	close(k.closed)
 	k.Kite.Close()
+
+	// Storages like MemoryStorage persist their state on close.
+	if c, ok := k.storage.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			k.log.Error("closing storage: %s", err)
+		}
+	}
 }
 
 // InitializeSelf registers his host by writing a key to ~/.kite/kite.key
 func (k *Kontrol) InitializeSelf() error {
-	if len(k.lastPublic) == 0 && len(k.lastPrivate) == 0 {
+	_, public, private := k.lastKeyPairs()
+
+	if len(public) == 0 && len(private) == 0 {
 		return errors.New("Please initialize AddKeyPair() method")
 	}
 
-	key, err := k.registerUser(k.Kite.Config.Username, k.lastPublic[0], k.lastPrivate[0])
+	key, err := k.registerUser(k.Kite.Config.Username, public[0], private[0])
 	if err != nil {
 		return err
 	}
@@ -374,6 +592,7 @@ func (k *Kontrol) registerUser(username, publicKey, privateKey string) (kiteKey
 		},
 		KontrolURL: k.Kite.Config.KontrolURL,
 		KontrolKey: strings.TrimSpace(publicKey),
+		Tenant:     k.keyTenant(publicKey),
 	}
 
 	rsaPrivate, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(privateKey))
@@ -454,13 +673,18 @@ func (k *Kontrol) registerSelf() {
 //
 // The value is cached on first call of the function.
 func (k *Kontrol) KeyPair() (pair *KeyPair, err error) {
-	if k.selfKeyPair != nil {
-		return k.selfKeyPair, nil
+	k.lastMu.RLock()
+	pair = k.selfKeyPair
+	k.lastMu.RUnlock()
+
+	if pair != nil {
+		return pair, nil
 	}
 
 	kiteKey := k.Kite.KiteKey()
+	ids, public, private := k.lastKeyPairs()
 
-	if kiteKey == "" || len(k.lastPublic) == 0 {
+	if kiteKey == "" || len(public) == 0 {
 		return nil, errNoSelfKeyPair
 	}
 
@@ -468,15 +692,15 @@ func (k *Kontrol) KeyPair() (pair *KeyPair, err error) {
 
 	me := new(multiError)
 
-	for i := range k.lastPublic {
-		ri := len(k.lastPublic) - i - 1
+	for i := range public {
+		ri := len(public) - i - 1
 
 		keyFn := func(token *jwt.Token) (interface{}, error) {
 			if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
 				return nil, errors.New("invalid signing method")
 			}
 
-			return jwt.ParseRSAPublicKeyFromPEM([]byte(k.lastPublic[ri]))
+			return jwt.ParseRSAPublicKeyFromPEM([]byte(public[ri]))
 		}
 
 		if _, err := jwt.ParseWithClaims(kiteKey, &kitekey.KiteClaims{}, keyFn); err != nil {
@@ -492,13 +716,30 @@ func (k *Kontrol) KeyPair() (pair *KeyPair, err error) {
 		return nil, fmt.Errorf("no matching self key pair found: %s", me)
 	}
 
-	k.selfKeyPair = &KeyPair{
-		ID:      k.lastIDs[keyIndex],
-		Public:  k.lastPublic[keyIndex],
-		Private: k.lastPrivate[keyIndex],
+	pair = &KeyPair{
+		ID:      ids[keyIndex],
+		Public:  public[keyIndex],
+		Private: private[keyIndex],
 	}
 
-	return k.selfKeyPair, nil
+	k.lastMu.Lock()
+	k.selfKeyPair = pair
+	k.lastMu.Unlock()
+
+	return pair, nil
+}
+
+// lastKeyPairs gives copies of the IDs, public and private keys of the key
+// pairs added with AddKeyPair.
+func (k *Kontrol) lastKeyPairs() (ids, public, private []string) {
+	k.lastMu.RLock()
+	defer k.lastMu.RUnlock()
+
+	ids = append([]string(nil), k.lastIDs...)
+	public = append([]string(nil), k.lastPublic...)
+	private = append([]string(nil), k.lastPrivate...)
+
+	return ids, public, private
 }
 
 func (k *Kontrol) tokenTTL() time.Duration {
@@ -509,6 +750,14 @@ func (k *Kontrol) tokenTTL() time.Duration {
 	return TokenTTL
 }
 
+func (k *Kontrol) delegateTokenTTL() time.Duration {
+	if k.DelegateTokenTTL != 0 {
+		return k.DelegateTokenTTL
+	}
+
+	return DelegateTokenTTL
+}
+
 func (k *Kontrol) tokenLeeway() time.Duration {
 	if k.TokenLeeway != 0 {
 		return k.TokenLeeway
@@ -520,38 +769,39 @@ func (k *Kontrol) tokenLeeway() time.Duration {
 type token struct {
 	audience string
 	username string
+	actor    string        // username of the kite acting on behalf of the user
+	ttl      time.Duration // if 0, tokenTTL is used
 	issuer   string
 	keyPair  *KeyPair
 	force    bool
 }
 
-type cachedToken struct {
-	signed string
-	timer  *time.Timer
+func (t *token) String() string {
+	return t.audience + t.username + t.actor + t.issuer + t.keyPair.ID
 }
 
-func (t *token) String() string {
-	return t.audience + t.username + t.issuer + t.keyPair.ID
+// tokenIDKey gives the token cache key of the token with the given ID.
+func tokenIDKey(id string) string {
+	return "id:" + id
 }
 
-// cacheToken cached the signed token under the given key.
-//
-// It also ensures the token is invalidated after its expiration time.
-//
-// If the token was already exists in the cache, it will be
-// overwritten with a new value.
-func (k *Kontrol) cacheToken(key, signed string) {
-	if ct, ok := k.tokenCache[key]; ok {
-		ct.timer.Stop()
+// flushTokens invalidates all cached tokens, so that new tokens
+// are signed with current key pairs.
+func (k *Kontrol) flushTokens() {
+	k.tokenCacheMu.Lock()
+	defer k.tokenCacheMu.Unlock()
+
+	f, ok := k.tokenCache.(interface {
+		Flush() error
+	})
+
+	if !ok {
+		k.log.Warning("token cache %T does not support flushing", k.tokenCache)
+		return
 	}
 
-	k.tokenCache[key] = cachedToken{
-		signed: signed,
-		timer: time.AfterFunc(k.tokenTTL()-k.tokenLeeway(), func() {
-			k.tokenCacheMu.Lock()
-			delete(k.tokenCache, key)
-			k.tokenCacheMu.Unlock()
-		}),
+	if err := f.Flush(); err != nil {
+		k.log.Error("unable to flush token cache: %s", err)
 	}
 }
 
@@ -564,9 +814,24 @@ func (k *Kontrol) generateToken(tok *token) (string, error) {
 	defer k.tokenCacheMu.Unlock()
 
 	if !tok.force {
-		if ct, ok := k.tokenCache[uniqKey]; ok {
-			return ct.signed, nil
+		signed, err := k.tokenCache.Get(uniqKey)
+		if err == nil {
+			return signed, nil
 		}
+
+		if err != ErrTokenNotFound {
+			k.log.Warning("unable to read token cache: %s", err)
+		}
+	}
+
+	// Delegated tokens are counted for the kite that requested them.
+	requester := tok.username
+	if tok.actor != "" {
+		requester = tok.actor
+	}
+
+	if err := k.checkTokenQuota(requester); err != nil {
+		return "", err
 	}
 
 	rsaPrivate, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(tok.keyPair.Private))
@@ -579,6 +844,11 @@ func (k *Kontrol) generateToken(tok *token) (string, error) {
 		return "", err
 	}
 
+	ttl := tok.ttl
+	if ttl == 0 {
+		ttl = k.tokenTTL()
+	}
+
 	now := time.Now().UTC()
 
 	claims := &kitekey.KiteClaims{
@@ -586,22 +856,46 @@ func (k *Kontrol) generateToken(tok *token) (string, error) {
 			Issuer:    tok.issuer,
 			Subject:   tok.username,
 			Audience:  tok.audience,
-			ExpiresAt: now.Add(k.tokenTTL()).Add(k.tokenLeeway()).UTC().Unix(),
+			ExpiresAt: now.Add(ttl).Add(k.tokenLeeway()).UTC().Unix(),
 			IssuedAt:  now.Add(-k.tokenLeeway()).UTC().Unix(),
 			Id:        id.String(),
 		},
+		Actor:  tok.actor,
+		Tenant: k.keyTenant(tok.keyPair.Public),
 	}
 
 	if !k.TokenNoNBF {
 		claims.NotBefore = now.Add(-k.tokenLeeway()).Unix()
 	}
 
-	signed, err := jwt.NewWithClaims(jwt.GetSigningMethod("RS256"), claims).SignedString(rsaPrivate)
+	t := jwt.NewWithClaims(jwt.GetSigningMethod("RS256"), claims)
+
+	// The key pair ID identifies the key in the JWKS document.
+	if tok.keyPair.ID != "" {
+		t.Header["kid"] = tok.keyPair.ID
+	}
+
+	signed, err := t.SignedString(rsaPrivate)
 	if err != nil {
 		return "", errors.New("Server error: Cannot generate a token")
 	}
 
-	k.cacheToken(uniqKey, signed)
+	k.emit(&Event{
+		Type:     TokenIssued,
+		KeyID:    tok.keyPair.ID,
+		Username: tok.username,
+		Audience: tok.audience,
+	})
+
+	if err := k.tokenCache.Set(uniqKey, signed, ttl-k.tokenLeeway()); err != nil {
+		k.log.Warning("unable to update token cache: %s", err)
+	}
+
+	// Cache the token under its ID as well, so kites can fetch
+	// the tokens referenced by ID, see HandleGetTokenByID.
+	if err := k.tokenCache.Set(tokenIDKey(claims.Id), signed, ttl-k.tokenLeeway()); err != nil {
+		k.log.Warning("unable to update token cache: %s", err)
+	}
 
 	return signed, nil
 }
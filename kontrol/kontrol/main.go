@@ -6,11 +6,14 @@ import (
 	"io/ioutil"
 	"log"
 	"net/url"
-	"os"
-
-	"github.com/koding/kite"
-	"github.com/koding/kite/config"
-	"github.com/koding/kite/kontrol"
+	"strings"
+	"time"
+
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/kontrol"
+	"github.com/koding/kite/v2/kontrol/auth"
+	"github.com/koding/kite/v2/kontrol/k8s"
 	"github.com/koding/multiconfig"
 )
 
@@ -31,6 +34,12 @@ type Kontrol struct {
 	Machines []string
 	Version  string `default:"0.0.1"`
 
+	// Storage is the name of the storage driver, see kontrol.RegisterStorage.
+	// StorageSource, when empty, defaults to Machines for the "etcd" driver
+	// and to the Postgres settings for the "postgres" one.
+	Storage       string `default:"etcd"`
+	StorageSource string
+
 	Postgres struct {
 		Host           string `default:"localhost"`
 		Port           int    `default:"5432"`
@@ -39,6 +48,48 @@ type Kontrol struct {
 		DBName         string
 		ConnectTimeout int `default:"20"`
 	}
+
+	Redis struct {
+		Addr     string
+		Password string
+		DB       int
+	}
+
+	// LDAP, when URL is set, authenticates the "registerMachine" requests
+	// with LDAP credentials, see auth.LDAP.
+	LDAP struct {
+		URL         string
+		BaseDN      string
+		BindDN      string
+		Password    string
+		UserFilter  string
+		GroupFilter string
+		StartTLS    bool
+	}
+
+	// Quota limits each user, see kontrol.Quota.
+	Quota struct {
+		MaxKites           int
+		MaxTokensPerMinute int
+	}
+
+	// Kubernetes, when Enabled, registers the endpoints of annotated
+	// Kubernetes services of the cluster kontrol runs in, see k8s.Registrar.
+	// The kites are registered with the kontrol username, unless Username
+	// is set.
+	Kubernetes struct {
+		Enabled   bool
+		Namespace string
+		Username  string
+		Region    string
+	}
+
+	// QueryCache caches getKites queries, when TTL is non-zero, see
+	// kontrol.Kontrol.QueryCacheTTL.
+	QueryCache struct {
+		TTL        time.Duration
+		MaxEntries int
+	}
 }
 
 func main() {
@@ -80,23 +131,77 @@ func main() {
 		k.RegisterURL = conf.RegisterUrl
 	}
 
-	switch os.Getenv("KONTROL_STORAGE") {
-	case "postgres":
-		postgresConf := &kontrol.PostgresConfig{
-			Host:     conf.Postgres.Host,
-			Port:     conf.Postgres.Port,
-			Username: conf.Postgres.Username,
-			Password: conf.Postgres.Password,
-			DBName:   conf.Postgres.DBName,
+	source := conf.StorageSource
+
+	if source == "" {
+		switch conf.Storage {
+		case "etcd":
+			source = strings.Join(conf.Machines, ",")
+		case "postgres":
+			postgresConf := &kontrol.PostgresConfig{
+				Host:           conf.Postgres.Host,
+				Port:           conf.Postgres.Port,
+				Username:       conf.Postgres.Username,
+				Password:       conf.Postgres.Password,
+				DBName:         conf.Postgres.DBName,
+				ConnectTimeout: conf.Postgres.ConnectTimeout,
+			}
+
+			source = postgresConf.ConnString()
+		}
+	}
+
+	if err := k.UseStorage(conf.Storage, source); err != nil {
+		log.Fatal(err)
+	}
+
+	if conf.Redis.Addr != "" {
+		r := kontrol.NewRedisTokenCache(conf.Redis.Addr)
+		r.Password = conf.Redis.Password
+		r.DB = conf.Redis.DB
+		k.SetTokenCache(r)
+	}
+
+	if conf.LDAP.URL != "" {
+		l := &auth.LDAP{
+			URL:         conf.LDAP.URL,
+			BaseDN:      conf.LDAP.BaseDN,
+			BindDN:      conf.LDAP.BindDN,
+			Password:    conf.LDAP.Password,
+			UserFilter:  conf.LDAP.UserFilter,
+			GroupFilter: conf.LDAP.GroupFilter,
+			StartTLS:    conf.LDAP.StartTLS,
+		}
+		k.MachineAuthenticate = l.Authenticate
+	}
+
+	if conf.Quota.MaxKites != 0 || conf.Quota.MaxTokensPerMinute != 0 {
+		k.DefaultQuota = &kontrol.Quota{
+			MaxKites:           conf.Quota.MaxKites,
+			MaxTokensPerMinute: conf.Quota.MaxTokensPerMinute,
+		}
+	}
+
+	k.QueryCacheTTL = conf.QueryCache.TTL
+	k.QueryCacheSize = conf.QueryCache.MaxEntries
+
+	if conf.Kubernetes.Enabled {
+		client, err := k8s.InClusterClient()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		r := k8s.NewRegistrar(client, k.Storage(), k.Kite.Log)
+		r.Namespace = conf.Kubernetes.Namespace
+		r.Username = conf.Kubernetes.Username
+		r.Region = conf.Kubernetes.Region
+
+		if r.Username == "" {
+			r.Username = k.Kite.Kite().Username
 		}
 
-		p := kontrol.NewPostgres(postgresConf, k.Kite.Log)
-		k.SetStorage(p)
-		k.SetKeyPairStorage(p)
-	case "etcd":
-		fallthrough
-	default:
-		k.SetStorage(kontrol.NewEtcd(conf.Machines, k.Kite.Log))
+		go r.Run()
+		defer r.Close()
 	}
 
 	k.AddKeyPair("", string(publicKey), string(privateKey))
@@ -1,25 +1,33 @@
 package kontrol
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
-	"github.com/koding/kite"
-	"github.com/koding/kite/kitekey"
-	"github.com/koding/kite/protocol"
-	"github.com/koding/kite/testkeys"
-	"github.com/koding/kite/testutil"
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/kitekey"
+	"github.com/koding/kite/v2/protocol"
+	"github.com/koding/kite/v2/testkeys"
+	"github.com/koding/kite/v2/testutil"
 	uuid "github.com/satori/go.uuid"
 )
 
@@ -28,10 +36,16 @@ var (
 	kon  *Kontrol
 )
 
-func init() {
+func TestMain(m *testing.M) {
+	// Kontrol is started after the flags are parsed, as the test
+	// logger reads them from the kite goroutines.
+	flag.Parse()
+
 	rand.Seed(time.Now().UTC().UnixNano())
 
 	kon, conf = startKontrol(testkeys.Private, testkeys.Public, 5500)
+
+	os.Exit(m.Run())
 }
 
 func TestUpdateKeys(t *testing.T) {
@@ -519,6 +533,95 @@ func TestGetToken(t *testing.T) {
 	}
 }
 
+func TestGetTokens(t *testing.T) {
+	m := kite.New("mathworker8", "1.1.1")
+	m.Config = conf.Config.Copy()
+	defer m.Close()
+
+	kiteURL := &url.URL{Scheme: "http", Host: "localhost:4445", Path: "/kite"}
+	_, err := m.Register(kiteURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unknown := *m.Kite()
+	unknown.Name = "unknown"
+
+	tokens, err := m.GetTokens([]*protocol.Kite{m.Kite(), &unknown})
+	if err == nil {
+		t.Fatal("expected error for unknown kite")
+	}
+
+	if len(tokens) != 2 {
+		t.Fatalf("got %d tokens, want 2", len(tokens))
+	}
+
+	if tokens[0] == "" {
+		t.Fatalf("got empty token for %s", m.Kite())
+	}
+
+	if tokens[1] != "" {
+		t.Fatalf("got %q token for unknown kite, want empty", tokens[1])
+	}
+}
+
+func TestRegisterKites(t *testing.T) {
+	m := kite.New("fleetmanager", "1.0.0")
+	m.Config = conf.Config.Copy()
+	defer m.Close()
+
+	args := make([]*protocol.RegisterArgs, 3)
+
+	for i := range args {
+		w := kite.New("fleetworker", "1.0.0")
+		w.Config = conf.Config.Copy()
+		defer w.Close()
+
+		args[i] = &protocol.RegisterArgs{
+			URL:  fmt.Sprintf("http://localhost:%d/kite", 4463+i),
+			Kite: w.Kite(),
+			Auth: &protocol.Auth{
+				Type: "kiteKey",
+				Key:  w.KiteKey(),
+			},
+		}
+	}
+
+	args[2].Auth.Key = "invalid"
+
+	results, err := m.RegisterKites(args)
+	if err != nil {
+		t.Fatalf("RegisterKites()=%s", err)
+	}
+
+	for i, res := range results[:2] {
+		if res.Error != "" {
+			t.Fatalf("%d: got error %q", i, res.Error)
+		}
+
+		if res.URL != args[i].URL {
+			t.Fatalf("%d: got %q, want %q", i, res.URL, args[i].URL)
+		}
+	}
+
+	if results[2].Error == "" {
+		t.Fatal("expected error for invalid kite key")
+	}
+
+	kites, err := m.GetKites(&protocol.KontrolQuery{
+		Username:    m.Kite().Username,
+		Environment: m.Kite().Environment,
+		Name:        "fleetworker",
+	})
+	if err != nil {
+		t.Fatalf("GetKites()=%s", err)
+	}
+
+	if len(kites) != 2 {
+		t.Fatalf("got %d kites, want 2", len(kites))
+	}
+}
+
 func TestRegisterKite(t *testing.T) {
 	kiteURL := &url.URL{Scheme: "http", Host: "localhost:4444", Path: "/kite"}
 	m := kite.New("mathworker3", "1.1.1")
@@ -535,240 +638,1388 @@ func TestRegisterKite(t *testing.T) {
 	}
 }
 
-func TestKontrol(t *testing.T) {
-	// Start mathworker
-	mathKite := kite.New("mathworker", "1.2.3")
-	mathKite.Config = conf.Config.Copy()
-	mathKite.Config.Port = 6161
-	mathKite.HandleFunc("square", Square)
-	go mathKite.Run()
-	<-mathKite.ServerReadyNotify()
-	defer mathKite.Close()
+func TestRegisterPolicy(t *testing.T) {
+	url1 := &url.URL{Scheme: "http", Host: "localhost:4446", Path: "/kite"}
+	url2 := &url.URL{Scheme: "http", Host: "localhost:4447", Path: "/kite"}
 
-	go mathKite.RegisterForever(&url.URL{Scheme: "http", Host: "127.0.0.1:" + strconv.Itoa(mathKite.Config.Port), Path: "/kite"})
-	<-mathKite.KontrolReadyNotify()
+	cases := map[string]struct {
+		policy RegisterPolicy
+		port   int
+	}{
+		"reject":  {RegisterReject, 5503},
+		"replace": {RegisterReplace, 5504},
+	}
 
-	// exp2 kite is the mathworker client
-	exp2Kite := kite.New("exp2", "0.0.1")
-	exp2Kite.Config = conf.Config.Copy()
-	defer exp2Kite.Close()
+	for name, cas := range cases {
+		t.Run(name, func(t *testing.T) {
+			kon, conf := startKontrol(testkeys.Private, testkeys.Public, cas.port)
+			kon.RegisterPolicy = cas.policy
+			defer kon.Close()
 
-	query := &protocol.KontrolQuery{
-		Username:    exp2Kite.Kite().Username,
-		Environment: exp2Kite.Kite().Environment,
-		Name:        "mathworker",
-		Version:     "~> 1.1",
+			displaced := make(chan *protocol.DisplacedArgs, 1)
+
+			m1 := kite.New("policyworker", "1.1.1")
+			m1.Config = conf.Config.Copy()
+			m1.OnDisplaced(func(args *protocol.DisplacedArgs) {
+				displaced <- args
+			})
+			defer m1.Close()
+
+			if _, err := m1.Register(url1); err != nil {
+				t.Fatalf("Register()=%s", err)
+			}
+
+			m2 := kite.New("policyworker", "1.1.1")
+			m2.Config = conf.Config.Copy()
+			m2.Id = m1.Id
+			defer m2.Close()
+
+			_, err := m2.Register(url2)
+
+			switch cas.policy {
+			case RegisterReject:
+				if err == nil || !strings.Contains(err.Error(), "already registered") {
+					t.Fatalf("got %v, want conflict error", err)
+				}
+			case RegisterReplace:
+				if err != nil {
+					t.Fatalf("Register()=%s", err)
+				}
+
+				select {
+				case args := <-displaced:
+					if args.URL != url2.String() {
+						t.Fatalf("got %q, want %q", args.URL, url2)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("timed out waiting for the kite to be displaced")
+				}
+			}
+		})
 	}
+}
 
-	// exp2 queries for mathkite
-	kites, err := exp2Kite.GetKites(query)
-	if err != nil {
-		t.Fatal(err)
+func TestEnvironmentKeyPair(t *testing.T) {
+	kon, conf := startKontrol(testkeys.Private, testkeys.Public, 5505)
+	defer kon.Close()
+
+	if err := kon.AddEnvironmentKeyPair("production", "", testkeys.PublicSecond, testkeys.PrivateSecond); err != nil {
+		t.Fatalf("AddEnvironmentKeyPair()=%s", err)
 	}
-	defer klose(kites)
 
-	if len(kites) == 0 {
-		t.Fatal("No mathworker available")
+	if err := kon.AddEnvironmentKeyPair("development", "", testkeys.PublicThird, testkeys.PrivateThird); err != nil {
+		t.Fatalf("AddEnvironmentKeyPair()=%s", err)
 	}
 
-	// exp2 connects to mathworker
-	remoteMathWorker := kites[0]
-	err = remoteMathWorker.Dial()
-	if err != nil {
-		t.Fatal("Cannot connect to remote mathworker", err)
+	newKite := func(environment, private, public string) *kite.Kite {
+		k := kite.New("envworker", "1.0.0")
+		k.Config = conf.Config.Copy()
+		k.Config.Environment = environment
+		k.Config.KiteKey = testutil.NewToken("testuser", private, public).Raw
+		k.Config.KontrolKey = public
+		return k
 	}
 
-	// Test Kontrol.GetToken
-	// TODO(rjeczalik): rework test to not touch Kontrol internals
-	kon.tokenCacheMu.Lock()
-	kon.tokenCache = make(map[string]cachedToken)
-	kon.tokenCacheMu.Unlock()
+	prod := newKite("production", testkeys.PrivateSecond, testkeys.PublicSecond)
+	defer prod.Close()
 
-	_, err = exp2Kite.GetToken(&remoteMathWorker.Kite)
-	if err != nil {
-		t.Error(err)
+	if _, err := prod.Register(&url.URL{Scheme: "http", Host: "localhost:4448", Path: "/kite"}); err != nil {
+		t.Fatalf("Register()=%s", err)
 	}
 
-	// Run "square" method
-	response, err := remoteMathWorker.TellWithTimeout("square", 4*time.Second, 2)
-	if err != nil {
-		t.Fatal(err)
+	// A development key must not be accepted for production kites.
+	fake := newKite("production", testkeys.PrivateThird, testkeys.PublicThird)
+	defer fake.Close()
+
+	if _, err := fake.Register(&url.URL{Scheme: "http", Host: "localhost:4449", Path: "/kite"}); err == nil {
+		t.Fatal("expected kontrol to deny register with a development key")
 	}
 
-	var result int
-	err = response.Unmarshal(&result)
+	dev := newKite("development", testkeys.PrivateThird, testkeys.PublicThird)
+	defer dev.Close()
+
+	if _, err := dev.GetToken(prod.Kite()); err == nil {
+		t.Fatal("expected kontrol to deny token for production kite")
+	}
+
+	global := newKite("production", testkeys.Private, testkeys.Public)
+	defer global.Close()
+
+	tok, err := global.GetToken(prod.Kite())
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("GetToken()=%s", err)
 	}
 
-	// Result must be "4"
-	if result != 4 {
-		t.Fatalf("Invalid result: %d", result)
+	if _, err := jwt.Parse(tok, func(*jwt.Token) (interface{}, error) {
+		return jwt.ParseRSAPublicKeyFromPEM([]byte(testkeys.PublicSecond))
+	}); err != nil {
+		t.Fatalf("expected token to be signed with the production key: %s", err)
 	}
-}
 
-func Square(r *kite.Request) (interface{}, error) {
-	a, err := r.Args.One().Float64()
+	key, err := prod.TellKontrolWithTimeout("registerMachine", 4*time.Second, map[string]interface{}{})
 	if err != nil {
-		return nil, err
+		t.Fatalf("registerMachine()=%s", err)
 	}
 
-	result := a * a
-	return result, nil
+	claims := &kitekey.KiteClaims{}
+
+	if _, err := jwt.ParseWithClaims(key.MustString(), claims, kitekey.GetKontrolKey); err != nil {
+		t.Fatalf("ParseWithClaims()=%s", err)
+	}
+
+	if claims.KontrolKey != strings.TrimSpace(testkeys.PublicSecond) {
+		t.Fatalf("got kite key signed with %q, want the production key", claims.KontrolKey)
+	}
 }
 
-func TestGetQueryKey(t *testing.T) {
-	// This query is valid because there are no gaps between query fields.
-	q := &protocol.KontrolQuery{
-		Username:    "cenk",
-		Environment: "production",
+func TestIssueKeys(t *testing.T) {
+	kon, conf := startKontrol(testkeys.Private, testkeys.Public, 5511)
+	defer kon.Close()
+
+	if err := kon.AddTenantKeyPair("acme", "", testkeys.PublicSecond, testkeys.PrivateSecond); err != nil {
+		t.Fatalf("AddTenantKeyPair()=%s", err)
 	}
-	key, err := GetQueryKey(q)
+
+	newKite := func(kiteKey string) *kite.Kite {
+		k := kite.New("fleetworker", "1.0.0")
+		k.Config = conf.Config.Copy()
+		k.Config.KiteKey = kiteKey
+		return k
+	}
+
+	admin := newKite(conf.Config.KiteKey)
+	defer admin.Close()
+
+	resp, err := admin.TellKontrolWithTimeout("issueKeys", 4*time.Second, &protocol.IssueKeysArgs{
+		Keys: []*protocol.IssueKeyArgs{
+			{Username: "alice"},
+			{Username: "bob", Tenant: "acme"},
+			{Username: "carol", Tenant: "globex"},
+			{},
+		},
+	})
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Fatalf("issueKeys()=%s", err)
 	}
-	if key != "/cenk/production" {
-		t.Errorf("Unexpected key: %s", key)
+
+	var res protocol.IssueKeysResult
+	if err := resp.Unmarshal(&res); err != nil {
+		t.Fatalf("Unmarshal()=%s", err)
 	}
 
-	// This is wrong because Environment field is empty.
-	// We can't make a query on etcd because wildcards are not allowed in paths.
-	q = &protocol.KontrolQuery{
-		Username: "cenk",
-		Name:     "fs",
+	if len(res.Keys) != 4 {
+		t.Fatalf("got %d keys, want 4", len(res.Keys))
 	}
-	key, err = GetQueryKey(q)
-	if err == nil {
-		t.Errorf("Error is expected")
+
+	if res.Keys[2].Error == "" || res.Keys[3].Error == "" {
+		t.Fatalf("got %+v, want errors for unknown tenant and empty username", res.Keys[2:])
 	}
-	if key != "" {
-		t.Errorf("Key is not expected: %s", key)
+
+	cases := []struct {
+		username, public string
+	}{
+		{"alice", testkeys.Public},
+		{"bob", testkeys.PublicSecond},
 	}
 
-	// This is also wrong becaus each query must have a non-empty username field.
-	q = &protocol.KontrolQuery{
-		Environment: "production",
-		Name:        "fs",
+	for i, cas := range cases {
+		key := res.Keys[i]
+
+		if key.Error != "" {
+			t.Fatalf("%s: unexpected error: %s", cas.username, key.Error)
+		}
+
+		claims := &kitekey.KiteClaims{}
+
+		if _, err := jwt.ParseWithClaims(key.KiteKey, claims, func(*jwt.Token) (interface{}, error) {
+			return jwt.ParseRSAPublicKeyFromPEM([]byte(cas.public))
+		}); err != nil {
+			t.Fatalf("%s: ParseWithClaims()=%s", cas.username, err)
+		}
+
+		if claims.Subject != cas.username {
+			t.Fatalf("got subject %q, want %q", claims.Subject, cas.username)
+		}
 	}
-	key, err = GetQueryKey(q)
-	if err == nil {
-		t.Errorf("Error is expected")
+
+	alice := newKite(res.Keys[0].KiteKey)
+	defer alice.Close()
+
+	if _, err := alice.Register(&url.URL{Scheme: "http", Host: "localhost:4461", Path: "/kite"}); err != nil {
+		t.Fatalf("Register()=%s", err)
 	}
-	if key != "" {
-		t.Errorf("Key is not expected: %s", key)
+
+	if _, err := alice.TellKontrolWithTimeout("issueKeys", 4*time.Second, &protocol.IssueKeysArgs{
+		Keys: []*protocol.IssueKeyArgs{{Username: "alice"}},
+	}); err == nil {
+		t.Fatal("expected kontrol to deny issuing keys to a non-admin user")
 	}
 }
 
-func TestKontrolMultiKey(t *testing.T) {
-	if storage := os.Getenv("KONTROL_STORAGE"); storage != "postgres" {
-		t.Skipf("%q storage does not currently implement soft key pair deletes", storage)
+func TestTenants(t *testing.T) {
+	kon, conf := startKontrol(testkeys.Private, testkeys.Public, 5507)
+	defer kon.Close()
+
+	if err := kon.AddTenantKeyPair("acme", "", testkeys.PublicSecond, testkeys.PrivateSecond); err != nil {
+		t.Fatalf("AddTenantKeyPair()=%s", err)
 	}
 
-	i := uuid.Must(uuid.NewV4())
-	secondID := i.String()
+	newKite := func(kiteKey, public string) *kite.Kite {
+		k := kite.New("tenantworker", "1.0.0")
+		k.Config = conf.Config.Copy()
+		k.Config.KiteKey = kiteKey
+		k.Config.KontrolKey = public
+		return k
+	}
 
-	// add so we can use it as key
-	if err := kon.AddKeyPair(secondID, testkeys.PublicSecond, testkeys.PrivateSecond); err != nil {
-		t.Fatal(err)
+	admin := newKite(conf.Config.KiteKey, testkeys.Public)
+	defer admin.Close()
+
+	resp, err := admin.TellKontrolWithTimeout("createTenant", 4*time.Second, &protocol.CreateTenantArgs{
+		Tenant:   "globex",
+		Username: "testuser",
+	})
+	if err != nil {
+		t.Fatalf("createTenant()=%s", err)
 	}
 
-	// Start mathworker
-	mathKite := kite.New("mathworker2", "2.0.0")
-	mathKite.Config = conf.Config.Copy()
-	mathKite.Config.Port = 6162
-	mathKite.HandleFunc("square", Square)
-	go mathKite.Run()
-	<-mathKite.ServerReadyNotify()
-	defer mathKite.Close()
+	var res protocol.CreateTenantResult
+	if err := resp.Unmarshal(&res); err != nil {
+		t.Fatalf("Unmarshal()=%s", err)
+	}
 
-	go mathKite.RegisterForever(&url.URL{Scheme: "http", Host: "127.0.0.1:" + strconv.Itoa(mathKite.Config.Port), Path: "/kite"})
-	<-mathKite.KontrolReadyNotify()
+	if tenants := kon.Tenants(); len(tenants) != 2 || tenants[0] != "acme" || tenants[1] != "globex" {
+		t.Fatalf("got %v, want [acme globex]", tenants)
+	}
 
-	// exp3 kite is the mathworker client. However it uses a different public
-	// key
-	exp3Kite := kite.New("exp3", "0.0.1")
-	exp3Kite.Config = conf.Config.Copy()
-	exp3Kite.Config.KiteKey = testutil.NewKiteKeyWithKeyPair(testkeys.PrivateSecond, testkeys.PublicSecond).Raw
-	exp3Kite.Config.KontrolKey = testkeys.PublicSecond
-	defer exp3Kite.Close()
+	acme := newKite(testutil.NewToken("testuser", testkeys.PrivateSecond, testkeys.PublicSecond).Raw, testkeys.PublicSecond)
+	defer acme.Close()
 
-	query := &protocol.KontrolQuery{
-		Username:    exp3Kite.Kite().Username,
-		Environment: exp3Kite.Kite().Environment,
-		Name:        "mathworker2",
-		Version:     "2.0.0",
+	if _, err := acme.Register(&url.URL{Scheme: "http", Host: "localhost:4451", Path: "/kite"}); err != nil {
+		t.Fatalf("Register()=%s", err)
 	}
 
-	// exp3 queries for mathkite
-	kites, err := exp3Kite.GetKites(query)
-	if err != nil {
-		t.Fatal(err)
+	globex := newKite(res.KiteKey, res.Public)
+	defer globex.Close()
+
+	if _, err := globex.Register(&url.URL{Scheme: "http", Host: "localhost:4452", Path: "/kite"}); err != nil {
+		t.Fatalf("Register()=%s", err)
 	}
-	defer klose(kites)
 
-	if len(kites) == 0 {
-		t.Fatal("No mathworker available")
+	query := &protocol.KontrolQuery{
+		Username:    "testuser",
+		Environment: conf.Config.Environment,
+		Name:        "tenantworker",
 	}
 
-	// exp3 connects to mathworker
-	remoteMathWorker := kites[0]
-	err = remoteMathWorker.Dial()
+	clients, err := globex.GetKites(query)
 	if err != nil {
-		t.Fatal("Cannot connect to remote mathworker", err)
+		t.Fatalf("GetKites()=%s", err)
 	}
+	defer klose(clients)
 
-	// Test Kontrol.GetToken
-	// TODO(rjeczalik): rework test to not touch Kontrol internals
-	kon.tokenCacheMu.Lock()
-	kon.tokenCache = make(map[string]cachedToken) // empty it
-	kon.tokenCacheMu.Unlock()
-
-	newToken, err := exp3Kite.GetToken(&remoteMathWorker.Kite)
-	if err != nil {
-		t.Error(err)
+	if len(clients) != 1 || clients[0].Kite.ID != globex.Kite().ID {
+		t.Fatalf("got %d kites, want only the kite of the same tenant", len(clients))
 	}
 
-	if remoteMathWorker.Auth.Key == newToken {
-		t.Errorf("Token renew failed. Tokens should be different after renew")
+	if _, err := admin.GetKites(query); err != kite.ErrNoKitesAvailable {
+		t.Fatalf("got %v, want %v", err, kite.ErrNoKitesAvailable)
 	}
 
-	// Run "square" method
-	response, err := remoteMathWorker.TellWithTimeout("square", 4*time.Second, 2)
-	if err != nil {
-		t.Fatal(err)
+	if _, err := globex.GetToken(acme.Kite()); err == nil {
+		t.Fatal("expected kontrol to deny token for a kite of another tenant")
 	}
 
-	var result int
-	err = response.Unmarshal(&result)
+	tok, err := acme.GetToken(acme.Kite())
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("GetToken()=%s", err)
 	}
 
-	// Result must be "4"
-	if result != 4 {
-		t.Fatalf("Invalid result: %d", result)
+	claims := &kitekey.KiteClaims{}
+
+	if _, err := jwt.ParseWithClaims(tok, claims, func(*jwt.Token) (interface{}, error) {
+		return jwt.ParseRSAPublicKeyFromPEM([]byte(testkeys.PublicSecond))
+	}); err != nil {
+		t.Fatalf("expected token to be signed with the tenant key: %s", err)
 	}
 
-	// now invalidate the second key
-	log.Printf("Invalidating %s\n", secondID)
-	if err := kon.DeleteKeyPair(secondID, ""); err != nil {
-		t.Fatal(err)
+	if claims.Tenant != "acme" {
+		t.Fatalf("got tenant %q, want %q", claims.Tenant, "acme")
 	}
 
-	// try to get a new key, this should replace exp3Kite.Config.KontrolKey
-	// with the new (in our case because PublicSecond is invalidated, it's
-	// going to use Public (the first key). Also it should return the new Key.
-	publicKey, err := exp3Kite.GetKey()
-	if err != nil {
-		t.Fatal(err)
+	if _, err := admin.TellKontrolWithTimeout("removeTenant", 4*time.Second, &protocol.RemoveTenantArgs{Tenant: "acme"}); err != nil {
+		t.Fatalf("removeTenant()=%s", err)
 	}
 
-	if publicKey != testkeys.Public {
-		t.Errorf("Key renew failed\n\twant:%s\n\tgot :%s\n", testkeys.Public, publicKey)
+	reg := newKite(testutil.NewToken("testuser", testkeys.PrivateSecond, testkeys.PublicSecond).Raw, testkeys.PublicSecond)
+	defer reg.Close()
+
+	if _, err := reg.Register(&url.URL{Scheme: "http", Host: "localhost:4453", Path: "/kite"}); err == nil {
+		t.Fatal("expected kontrol to deny register for a removed tenant")
 	}
+}
 
-	if exp3Kite.Config.KontrolKey != publicKey {
-		t.Errorf("Key renew should replace config.KontrolKey\n\twant:%s\n\tgot :%s\n",
-			testkeys.Public, publicKey)
+func TestBeforeRegister(t *testing.T) {
+	kon, conf := startKontrol(testkeys.Private, testkeys.Public, 5508)
+	defer kon.Close()
+
+	var calls []string
+
+	kon.OnBeforeRegister(func(r *kite.Request, args *protocol.RegisterArgs) error {
+		calls = append(calls, "naming")
+
+		if !strings.HasPrefix(args.Kite.Name, "svc-") {
+			return fmt.Errorf("kite name %q does not start with svc-", args.Kite.Name)
+		}
+
+		return nil
+	})
+
+	kon.OnBeforeRegister(func(r *kite.Request, args *protocol.RegisterArgs) error {
+		calls = append(calls, "version")
+
+		if args.Kite.Version == "0.0.1" {
+			return errors.New("version 0.0.1 is not allowed")
+		}
+
+		return nil
+	})
+
+	cases := []struct {
+		name    string
+		version string
+		calls   []string
+		ok      bool
+	}{
+		{"svc-worker", "1.0.0", []string{"naming", "version"}, true},
+		{"worker", "1.0.0", []string{"naming"}, false},
+		{"svc-worker", "0.0.1", []string{"naming", "version"}, false},
+	}
+
+	for i, cas := range cases {
+		calls = nil
+
+		k := kite.New(cas.name, cas.version)
+		k.Config = conf.Config.Copy()
+
+		_, err := k.Register(&url.URL{Scheme: "http", Host: fmt.Sprintf("localhost:%d", 4457+i), Path: "/kite"})
+		k.Close()
+
+		if cas.ok && err != nil {
+			t.Fatalf("%d: Register()=%s", i, err)
+		}
+
+		if !cas.ok && err == nil {
+			t.Fatalf("%d: want Register() to fail", i)
+		}
+
+		if !reflect.DeepEqual(calls, cas.calls) {
+			t.Fatalf("%d: got %v hooks called, want %v", i, calls, cas.calls)
+		}
+	}
+}
+
+func TestQuota(t *testing.T) {
+	kon, conf := startKontrol(testkeys.Private, testkeys.Public, 5509)
+	defer kon.Close()
+
+	// The counters are kept in the storage, so each run uses a new user.
+	username := fmt.Sprintf("quotauser%d", time.Now().UnixNano())
+
+	kon.Quotas = map[string]*Quota{
+		username: {MaxKites: 1, MaxTokensPerMinute: 1},
+	}
+
+	newKite := func() *kite.Kite {
+		k := kite.New("quotaworker", "1.0.0")
+		k.Config = conf.Config.Copy()
+		k.Config.Username = username
+		k.Config.KiteKey = testutil.NewToken(username, testkeys.Private, testkeys.Public).Raw
+		return k
+	}
+
+	first := newKite()
+	defer first.Close()
+
+	if _, err := first.Register(&url.URL{Scheme: "http", Host: "localhost:4460", Path: "/kite"}); err != nil {
+		t.Fatalf("Register()=%s", err)
+	}
+
+	// Registering again does not count against the quota.
+	if _, err := first.Register(&url.URL{Scheme: "http", Host: "localhost:4460", Path: "/kite"}); err != nil {
+		t.Fatalf("Register()=%s", err)
+	}
+
+	second := newKite()
+	defer second.Close()
+
+	_, err := second.Register(&url.URL{Scheme: "http", Host: "localhost:4461", Path: "/kite"})
+	if e, ok := err.(*kite.Error); !ok || e.ErrorType() != ErrorQuotaExceeded || e.CodeVal != "MaxKites" {
+		t.Fatalf("got %#v, want %s error", err, ErrorQuotaExceeded)
+	}
+
+	if _, err := first.GetToken(first.Kite()); err != nil {
+		t.Fatalf("GetToken()=%s", err)
+	}
+
+	// The token is served from cache.
+	if _, err := first.GetToken(first.Kite()); err != nil {
+		t.Fatalf("GetToken()=%s", err)
+	}
+
+	_, err = first.GetTokenForce(first.Kite())
+	if e, ok := err.(*kite.Error); !ok || e.CodeVal != "MaxTokensPerMinute" || !e.Retryable {
+		t.Fatalf("got %#v, want retryable %s error", err, ErrorQuotaExceeded)
+	}
+}
+
+func TestHeartbeatPolicy(t *testing.T) {
+	kon, conf := startKontrol(testkeys.Private, testkeys.Public, 5510)
+	defer kon.Close()
+
+	kon.HeartbeatPolicy = func(*protocol.Kite, time.Duration) time.Duration {
+		return time.Second
+	}
+
+	k := kite.New("heartbeatworker", "1.0.0")
+	k.Config = conf.Config.Copy()
+	defer k.Close()
+
+	sub := k.SubscribeEvents(16, kite.EventHeartbeat)
+	defer sub.Unsubscribe()
+
+	go k.RegisterForever(&url.URL{Scheme: "http", Host: "localhost:4462", Path: "/kite"})
+	<-k.KontrolReadyNotify()
+
+	// Heartbeats with the default interval would not fit in the timeout.
+	timeout := time.After(HeartbeatInterval / 2)
+
+	for i := 0; i < 3; i++ {
+		select {
+		case ev := <-sub.C:
+			if ev.Err != nil {
+				t.Fatalf("heartbeat failed: %s", ev.Err)
+			}
+		case <-timeout:
+			t.Fatalf("got %d heartbeats, want 3", i)
+		}
+	}
+}
+
+func TestBackoffHeartbeats(t *testing.T) {
+	policy := BackoffHeartbeats(MaxHeartbeatInterval)
+
+	cases := []struct {
+		stable time.Duration
+		want   time.Duration
+	}{
+		{0, HeartbeatInterval},
+		{UpdateInterval, 2 * HeartbeatInterval},
+		{2 * UpdateInterval, 4 * HeartbeatInterval},
+		{time.Hour, MaxHeartbeatInterval},
+	}
+
+	for _, cas := range cases {
+		if got := policy(nil, cas.stable); got != cas.want {
+			t.Errorf("policy(%s)=%s, want %s", cas.stable, got, cas.want)
+		}
+	}
+}
+
+func TestEventPublisher(t *testing.T) {
+	kon, conf := startKontrol(testkeys.Private, testkeys.Public, 5506)
+	defer kon.Close()
+
+	events := make(chan *Event, 16)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev Event
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		events <- &ev
+	}))
+	defer srv.Close()
+
+	kon.AddEventPublisher(&WebhookPublisher{URL: srv.URL})
+
+	m := kite.New("eventworker", "1.0.0")
+	m.Config = conf.Config.Copy()
+
+	if _, err := m.Register(&url.URL{Scheme: "http", Host: "localhost:4450", Path: "/kite"}); err != nil {
+		t.Fatalf("Register()=%s", err)
+	}
+
+	if _, err := m.GetToken(m.Kite()); err != nil {
+		t.Fatalf("GetToken()=%s", err)
+	}
+
+	m.Close()
+
+	for _, typ := range []EventType{KiteRegistered, TokenIssued, KiteDeregistered} {
+		select {
+		case ev := <-events:
+			if ev.Type != typ {
+				t.Fatalf("got %q event, want %q", ev.Type, typ)
+			}
+
+			if typ != TokenIssued && (ev.Kite == nil || ev.Kite.ID != m.Kite().ID) {
+				t.Fatalf("got %+v, want event for %s", ev, m.Kite())
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for %q event", typ)
+		}
+	}
+
+	if n := kon.EventCounts()[KiteRegistered]; n != 1 {
+		t.Fatalf("got %d %q events, want %d", n, KiteRegistered, 1)
+	}
+}
+
+func TestKontrol(t *testing.T) {
+	// Start mathworker
+	mathKite := kite.New("mathworker", "1.2.3")
+	mathKite.Config = conf.Config.Copy()
+	mathKite.Config.Port = 6161
+	mathKite.HandleFunc("square", Square)
+	go mathKite.Run()
+	<-mathKite.ServerReadyNotify()
+	defer mathKite.Close()
+
+	go mathKite.RegisterForever(&url.URL{Scheme: "http", Host: "127.0.0.1:" + strconv.Itoa(mathKite.Config.Port), Path: "/kite"})
+	<-mathKite.KontrolReadyNotify()
+
+	// exp2 kite is the mathworker client
+	exp2Kite := kite.New("exp2", "0.0.1")
+	exp2Kite.Config = conf.Config.Copy()
+	defer exp2Kite.Close()
+
+	query := &protocol.KontrolQuery{
+		Username:    exp2Kite.Kite().Username,
+		Environment: exp2Kite.Kite().Environment,
+		Name:        "mathworker",
+		Version:     "~> 1.1",
+	}
+
+	// exp2 queries for mathkite
+	kites, err := exp2Kite.GetKites(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer klose(kites)
+
+	if len(kites) == 0 {
+		t.Fatal("No mathworker available")
+	}
+
+	// exp2 connects to mathworker
+	remoteMathWorker := kites[0]
+	err = remoteMathWorker.Dial()
+	if err != nil {
+		t.Fatal("Cannot connect to remote mathworker", err)
+	}
+
+	// Test Kontrol.GetToken
+	// TODO(rjeczalik): rework test to not touch Kontrol internals
+	kon.flushTokens()
+
+	_, err = exp2Kite.GetToken(&remoteMathWorker.Kite)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Run "square" method
+	response, err := remoteMathWorker.TellWithTimeout("square", 4*time.Second, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result int
+	err = response.Unmarshal(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Result must be "4"
+	if result != 4 {
+		t.Fatalf("Invalid result: %d", result)
+	}
+}
+
+func TestTokenByID(t *testing.T) {
+	mathKite := kite.New("mathworker10", "1.2.3")
+	mathKite.Config = conf.Config.Copy()
+	mathKite.Config.Port = 6168
+	mathKite.HandleFunc("square", Square)
+
+	var byID int32
+	authenticate := mathKite.Authenticators["tokenID"]
+	mathKite.Authenticators["tokenID"] = func(r *kite.Request) error {
+		atomic.AddInt32(&byID, 1)
+		return authenticate(r)
+	}
+	go mathKite.Run()
+	<-mathKite.ServerReadyNotify()
+	defer mathKite.Close()
+
+	go mathKite.RegisterForever(&url.URL{Scheme: "http", Host: "127.0.0.1:6168", Path: "/kite"})
+	<-mathKite.KontrolReadyNotify()
+
+	exp10Kite := kite.New("exp10", "0.0.1")
+	exp10Kite.Config = conf.Config.Copy()
+	defer exp10Kite.Close()
+
+	kites, err := exp10Kite.GetKites(&protocol.KontrolQuery{
+		Username:    exp10Kite.Kite().Username,
+		Environment: exp10Kite.Kite().Environment,
+		Name:        "mathworker10",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer klose(kites)
+
+	remoteMathWorker := kites[0]
+	remoteMathWorker.TokenByID = true
+
+	if err := remoteMathWorker.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := remoteMathWorker.TellWithTimeout("square", 4*time.Second, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result := response.MustFloat64(); result != 9 {
+		t.Fatalf("got %v, want 9", result)
+	}
+
+	if n := atomic.LoadInt32(&byID); n != 1 {
+		t.Fatalf("got %d requests authenticated by token ID, want 1", n)
+	}
+
+	id, err := kitekey.TokenID(remoteMathWorker.Auth.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the kite the token was issued for can fetch it.
+	if _, err := exp10Kite.GetTokenByID(id); err == nil {
+		t.Fatal("expected error fetching token issued for another kite")
+	}
+
+	if _, err := mathKite.GetTokenByID(id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDelegateToken(t *testing.T) {
+	kon.DelegateAuthenticate = func(r *kite.Request, username string) error {
+		if username != "alice" {
+			return fmt.Errorf("%s cannot act on behalf of %s", r.Username, username)
+		}
+		return nil
+	}
+	defer func() { kon.DelegateAuthenticate = nil }()
+
+	backend := kite.New("backend", "1.0.0")
+	backend.Config = conf.Config.Copy()
+	backend.Config.Port = 6171
+	backend.HandleFunc("whoami", func(r *kite.Request) (interface{}, error) {
+		return []string{r.Username, r.Actor}, nil
+	})
+	go backend.Run()
+	<-backend.ServerReadyNotify()
+	defer backend.Close()
+
+	go backend.RegisterForever(&url.URL{Scheme: "http", Host: "127.0.0.1:6171", Path: "/kite"})
+	<-backend.KontrolReadyNotify()
+
+	gateway := kite.New("gateway", "0.0.1")
+	gateway.Config = conf.Config.Copy()
+	defer gateway.Close()
+
+	query := &protocol.KontrolQuery{
+		Username:    gateway.Kite().Username,
+		Environment: gateway.Kite().Environment,
+		Name:        "backend",
+	}
+
+	if _, err := gateway.DelegateToken(query, "bob"); err == nil {
+		t.Fatal("expected error delegating token for unauthorized user")
+	}
+
+	token, err := gateway.DelegateToken(query, "alice")
+	if err != nil {
+		t.Fatalf("DelegateToken()=%s", err)
+	}
+
+	claims := &kitekey.KiteClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, claims); err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.Subject != "alice" || claims.Actor != gateway.Kite().Username || !strings.HasSuffix(claims.Audience, "/backend") {
+		t.Fatalf("got sub=%q act=%q aud=%q, want delegated token for backend", claims.Subject, claims.Actor, claims.Audience)
+	}
+
+	c := gateway.NewClient("http://127.0.0.1:6171/kite")
+	c.Auth = &kite.Auth{Type: "token", Key: token}
+
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	response, err := c.TellWithTimeout("whoami", 4*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var who []string
+	if err := response.Unmarshal(&who); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(who) != 2 || who[0] != "alice" || who[1] != gateway.Kite().Username {
+		t.Fatalf("got %v, want [alice %s]", who, gateway.Kite().Username)
+	}
+}
+
+func TestDialBack(t *testing.T) {
+	k := kite.New("natworker", "1.0.0")
+	k.Config = conf.Config.Copy()
+	k.Config.Port = 6169
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	if err := k.DialBack(&url.URL{Scheme: "http", Host: "127.0.0.1:6169", Path: "/kite"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := k.DialBack(&url.URL{Scheme: "http", Host: "127.0.0.1:6170", Path: "/kite"}); err == nil {
+		t.Fatal("expected error dialing back unreachable URL")
+	}
+
+	if err := k.DialBack(&url.URL{Scheme: "http", Host: "127.0.0.1:6169", Path: "/metrics"}); err == nil {
+		t.Fatal("expected error dialing back URL with foreign path")
+	}
+
+	if err := k.DialBack(&url.URL{Scheme: "http", Host: "192.0.2.1:6169", Path: "/kite"}); err == nil {
+		t.Fatal("expected error dialing back URL with foreign host")
+	}
+}
+
+func TestListKites(t *testing.T) {
+	for i := 0; i < 3; i++ {
+		m := kite.New("pagedworker", "1.0.0")
+		m.Config = conf.Config.Copy()
+		defer m.Close()
+
+		kiteURL := &url.URL{Scheme: "http", Host: fmt.Sprintf("localhost:%d", 4451+i), Path: "/kite"}
+		if _, err := m.Register(kiteURL); err != nil {
+			t.Fatalf("Register()=%s", err)
+		}
+	}
+
+	k := kite.New("pager", "0.0.1")
+	k.Config = conf.Config.Copy()
+	defer k.Close()
+
+	query := &protocol.KontrolQuery{
+		Username:    conf.Config.Username,
+		Environment: conf.Config.Environment,
+		Name:        "pagedworker",
+	}
+
+	seen := make(map[string]bool)
+
+	for offset := 0; offset < 3; offset += 2 {
+		res, err := k.ListKites(&protocol.GetKitesArgs{
+			Query:   query,
+			Limit:   2,
+			Offset:  offset,
+			Fields:  []string{"id", "url"},
+			NoToken: true,
+		})
+		if err != nil {
+			t.Fatalf("ListKites()=%s", err)
+		}
+
+		if res.Total != 3 {
+			t.Fatalf("got %d total kites, want 3", res.Total)
+		}
+
+		if want := 2 - offset/2; len(res.Kites) != want {
+			t.Fatalf("got %d kites at offset %d, want %d", len(res.Kites), offset, want)
+		}
+
+		for _, kite := range res.Kites {
+			if kite.Token != "" || kite.Kite.Name != "" || kite.URL == "" {
+				t.Fatalf("got %+v, want only id and url", kite)
+			}
+
+			if seen[kite.Kite.ID] {
+				t.Fatalf("kite %s was returned twice", kite.Kite.ID)
+			}
+
+			seen[kite.Kite.ID] = true
+		}
+	}
+
+	if _, err := k.ListKites(&protocol.GetKitesArgs{Query: query, Fields: []string{"secret"}}); err == nil {
+		t.Fatal("expected error for unknown field")
+	}
+}
+
+func TestGetNearestKite(t *testing.T) {
+	for i, region := range []string{"eu", "us"} {
+		m := kite.New("regionworker", "1.0.0")
+		m.Config = conf.Config.Copy()
+		m.Config.Region = region
+		defer m.Close()
+
+		kiteURL := &url.URL{Scheme: "http", Host: fmt.Sprintf("localhost:%d", 4457+i), Path: "/kite"}
+		if _, err := m.Register(kiteURL); err != nil {
+			t.Fatalf("Register()=%s", err)
+		}
+	}
+
+	query := &protocol.KontrolQuery{
+		Username:    conf.Config.Username,
+		Environment: conf.Config.Environment,
+		Name:        "regionworker",
+	}
+
+	for region, want := range map[string]string{"us": "us", "eu": "eu", "asia": ""} {
+		k := kite.New("nearest", "0.0.1")
+		k.Config = conf.Config.Copy()
+		k.Config.Region = region
+		defer k.Close()
+
+		c, err := k.GetNearestKite(query)
+		if err != nil {
+			t.Fatalf("%s: GetNearestKite()=%s", region, err)
+		}
+		c.Close()
+
+		if want != "" && c.Kite.Region != want {
+			t.Fatalf("%s: got kite from %q region, want %q", region, c.Kite.Region, want)
+		}
+	}
+}
+
+func Square(r *kite.Request) (interface{}, error) {
+	a, err := r.Args.One().Float64()
+	if err != nil {
+		return nil, err
+	}
+
+	result := a * a
+	return result, nil
+}
+
+func TestGetQueryKey(t *testing.T) {
+	// This query is valid because there are no gaps between query fields.
+	q := &protocol.KontrolQuery{
+		Username:    "cenk",
+		Environment: "production",
+	}
+	key, err := GetQueryKey(q)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if key != "/cenk/production" {
+		t.Errorf("Unexpected key: %s", key)
+	}
+
+	// This is wrong because Environment field is empty.
+	// We can't make a query on etcd because wildcards are not allowed in paths.
+	q = &protocol.KontrolQuery{
+		Username: "cenk",
+		Name:     "fs",
+	}
+	key, err = GetQueryKey(q)
+	if err == nil {
+		t.Errorf("Error is expected")
+	}
+	if key != "" {
+		t.Errorf("Key is not expected: %s", key)
+	}
+
+	// This is also wrong becaus each query must have a non-empty username field.
+	q = &protocol.KontrolQuery{
+		Environment: "production",
+		Name:        "fs",
+	}
+	key, err = GetQueryKey(q)
+	if err == nil {
+		t.Errorf("Error is expected")
+	}
+	if key != "" {
+		t.Errorf("Key is not expected: %s", key)
+	}
+}
+
+func TestKontrolMultiKey(t *testing.T) {
+	if storage := os.Getenv("KONTROL_STORAGE"); storage != "postgres" {
+		t.Skipf("%q storage does not currently implement soft key pair deletes", storage)
+	}
+
+	i := uuid.Must(uuid.NewV4())
+	secondID := i.String()
+
+	// add so we can use it as key
+	if err := kon.AddKeyPair(secondID, testkeys.PublicSecond, testkeys.PrivateSecond); err != nil {
+		t.Fatal(err)
+	}
+
+	// Start mathworker
+	mathKite := kite.New("mathworker2", "2.0.0")
+	mathKite.Config = conf.Config.Copy()
+	mathKite.Config.Port = 6162
+	mathKite.HandleFunc("square", Square)
+	go mathKite.Run()
+	<-mathKite.ServerReadyNotify()
+	defer mathKite.Close()
+
+	go mathKite.RegisterForever(&url.URL{Scheme: "http", Host: "127.0.0.1:" + strconv.Itoa(mathKite.Config.Port), Path: "/kite"})
+	<-mathKite.KontrolReadyNotify()
+
+	// exp3 kite is the mathworker client. However it uses a different public
+	// key
+	exp3Kite := kite.New("exp3", "0.0.1")
+	exp3Kite.Config = conf.Config.Copy()
+	exp3Kite.Config.KiteKey = testutil.NewKiteKeyWithKeyPair(testkeys.PrivateSecond, testkeys.PublicSecond).Raw
+	exp3Kite.Config.KontrolKey = testkeys.PublicSecond
+	defer exp3Kite.Close()
+
+	query := &protocol.KontrolQuery{
+		Username:    exp3Kite.Kite().Username,
+		Environment: exp3Kite.Kite().Environment,
+		Name:        "mathworker2",
+		Version:     "2.0.0",
+	}
+
+	// exp3 queries for mathkite
+	kites, err := exp3Kite.GetKites(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer klose(kites)
+
+	if len(kites) == 0 {
+		t.Fatal("No mathworker available")
+	}
+
+	// exp3 connects to mathworker
+	remoteMathWorker := kites[0]
+	err = remoteMathWorker.Dial()
+	if err != nil {
+		t.Fatal("Cannot connect to remote mathworker", err)
+	}
+
+	// Test Kontrol.GetToken
+	// TODO(rjeczalik): rework test to not touch Kontrol internals
+	kon.flushTokens() // empty it
+
+	newToken, err := exp3Kite.GetToken(&remoteMathWorker.Kite)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if remoteMathWorker.Auth.Key == newToken {
+		t.Errorf("Token renew failed. Tokens should be different after renew")
+	}
+
+	// Run "square" method
+	response, err := remoteMathWorker.TellWithTimeout("square", 4*time.Second, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result int
+	err = response.Unmarshal(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Result must be "4"
+	if result != 4 {
+		t.Fatalf("Invalid result: %d", result)
+	}
+
+	// now invalidate the second key
+	log.Printf("Invalidating %s\n", secondID)
+	if err := kon.DeleteKeyPair(secondID, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// try to get a new key, this should replace exp3Kite.Config.KontrolKey
+	// with the new (in our case because PublicSecond is invalidated, it's
+	// going to use Public (the first key). Also it should return the new Key.
+	publicKey, err := exp3Kite.GetKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if publicKey != testkeys.Public {
+		t.Errorf("Key renew failed\n\twant:%s\n\tgot :%s\n", testkeys.Public, publicKey)
+	}
+
+	if exp3Kite.Config.KontrolKey != publicKey {
+		t.Errorf("Key renew should replace config.KontrolKey\n\twant:%s\n\tgot :%s\n",
+			testkeys.Public, publicKey)
+	}
+}
+
+func TestGetMethods(t *testing.T) {
+	m := kite.New("methodworker", "1.0.0")
+	m.Config = conf.Config.Copy()
+	m.HandleFunc("square", func(r *kite.Request) (interface{}, error) { return nil, nil })
+	defer m.Close()
+
+	kiteURL := &url.URL{Scheme: "http", Host: "localhost:4456", Path: "/kite"}
+	if _, err := m.Register(kiteURL); err != nil {
+		t.Fatalf("Register()=%s", err)
+	}
+
+	k := kite.New("methodclient", "0.0.1")
+	k.Config = conf.Config.Copy()
+	defer k.Close()
+
+	query := &protocol.KontrolQuery{
+		Username:    conf.Config.Username,
+		Environment: conf.Config.Environment,
+		Name:        "methodworker",
+	}
+
+	methods := func() string {
+		kites, err := k.GetMethods(query)
+		if err != nil {
+			t.Fatalf("GetMethods()=%s", err)
+		}
+
+		if len(kites) != 1 || kites[0].Token != "" {
+			t.Fatalf("got %+v, want one kite without token", kites)
+		}
+
+		return strings.Join(kites[0].Methods, ",")
+	}
+
+	if got := methods(); got != "square" {
+		t.Fatalf("got %q, want %q", got, "square")
+	}
+
+	// Methods registered after the registration are published as well.
+	m.HandleFunc("cube", func(r *kite.Request) (interface{}, error) { return nil, nil })
+
+	timeout := time.After(5 * time.Second)
+
+	for got := methods(); got != "cube,square"; got = methods() {
+		select {
+		case <-timeout:
+			t.Fatalf("got %q, want %q", got, "cube,square")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	// The methods are not returned by getKites.
+	res, err := k.ListKites(&protocol.GetKitesArgs{Query: query, NoToken: true})
+	if err != nil {
+		t.Fatalf("ListKites()=%s", err)
+	}
+
+	if len(res.Kites) != 1 || len(res.Kites[0].Methods) != 0 {
+		t.Fatalf("got %+v, want one kite without methods", res.Kites)
+	}
+}
+
+func TestGetKitesLabels(t *testing.T) {
+	register := func(port string, labels map[string]string) *kite.Kite {
+		w := kite.New("labelworker", "1.0.0")
+		w.Config = conf.Config.Copy()
+		w.Config.Labels = labels
+
+		if _, err := w.Register(&url.URL{Scheme: "http", Host: "localhost:" + port, Path: "/kite"}); err != nil {
+			t.Fatalf("Register()=%s", err)
+		}
+
+		return w
+	}
+
+	gpu := register("4457", map[string]string{"gpu": "true", "zone": "eu-1b"})
+	defer gpu.Close()
+
+	cpu := register("4458", map[string]string{"zone": "eu-1b"})
+	defer cpu.Close()
+
+	k := kite.New("labelclient", "0.0.1")
+	k.Config = conf.Config.Copy()
+	defer k.Close()
+
+	cases := []struct {
+		labels string
+		want   []string
+	}{
+		{"", []string{cpu.Id, gpu.Id}},
+		{"zone=eu-1b", []string{cpu.Id, gpu.Id}},
+		{"gpu=true,zone=eu-1b", []string{gpu.Id}},
+		{"gpu=false", nil},
+	}
+
+	for _, cas := range cases {
+		query := &protocol.KontrolQuery{
+			Username:    conf.Config.Username,
+			Environment: conf.Config.Environment,
+			Name:        "labelworker",
+			Labels:      cas.labels,
+		}
+
+		res, err := k.ListKites(&protocol.GetKitesArgs{Query: query, NoToken: true})
+		if err != nil {
+			t.Fatalf("%q: ListKites()=%s", cas.labels, err)
+		}
+
+		var got []string
+		for _, kite := range res.Kites {
+			got = append(got, kite.Kite.ID)
+
+			if kite.Kite.ID == gpu.Id && !reflect.DeepEqual(kite.Labels, gpu.Config.Labels) {
+				t.Fatalf("%q: got labels %v, want %v", cas.labels, kite.Labels, gpu.Config.Labels)
+			}
+		}
+
+		sort.Strings(got)
+		sort.Strings(cas.want)
+
+		if !reflect.DeepEqual(got, cas.want) {
+			t.Fatalf("%q: got %v, want %v", cas.labels, got, cas.want)
+		}
+	}
+
+	query := &protocol.KontrolQuery{
+		Username: conf.Config.Username,
+		Labels:   "gpu",
+	}
+
+	if _, err := k.ListKites(&protocol.GetKitesArgs{Query: query}); err == nil {
+		t.Fatal("want error for an invalid label selector")
+	}
+}
+
+// keyPairStorage is a storage, which stores key pairs as well.
+type keyPairStorage struct {
+	Storage
+	*MemKeyPairStorage
+}
+
+func TestUseStorage(t *testing.T) {
+	var sources []string
+
+	RegisterStorage("test", func(source string, log kite.Logger) (Storage, error) {
+		if source == "invalid" {
+			return nil, errors.New("invalid source")
+		}
+
+		sources = append(sources, source)
+
+		return &keyPairStorage{MemKeyPairStorage: NewMemKeyPairStorage()}, nil
+	})
+
+	if drivers := StorageDrivers(); !reflect.DeepEqual(drivers, []string{"etcd", "memory", "mongo", "postgres", "test"}) {
+		t.Fatalf("got %v drivers", drivers)
+	}
+
+	k := New(conf.Config.Copy(), "1.0.0")
+
+	if err := k.UseStorage("test", "source"); err != nil {
+		t.Fatalf("UseStorage()=%s", err)
+	}
+
+	if !reflect.DeepEqual(sources, []string{"source"}) {
+		t.Fatalf("got %v sources, want [source]", sources)
+	}
+
+	s, ok := k.storage.(*keyPairStorage)
+	if !ok {
+		t.Fatalf("got %T storage, want *keyPairStorage", k.storage)
+	}
+
+	if k.keyPair != KeyPairStorage(s) {
+		t.Fatalf("got %T key pair storage, want *keyPairStorage", k.keyPair)
+	}
+
+	if err := k.UseStorage("test", "invalid"); err == nil {
+		t.Fatal("want UseStorage() to fail with invalid source")
+	}
+
+	if err := k.UseStorage("unknown", ""); err == nil {
+		t.Fatal("want UseStorage() to fail with unknown driver")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("want RegisterStorage() to panic on duplicate driver")
+		}
+	}()
+
+	RegisterStorage("etcd", openEtcd)
+}
+
+func TestJWKS(t *testing.T) {
+	resp, err := http.Get("http://localhost:5500/jwks")
+	if err != nil {
+		t.Fatalf("Get()=%s", err)
+	}
+	defer resp.Body.Close()
+
+	var jwks protocol.JWKS
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		t.Fatalf("Decode()=%s", err)
+	}
+
+	if len(jwks.Keys) != len(kon.lastIDs) {
+		t.Fatalf("got %d keys, want %d", len(jwks.Keys), len(kon.lastIDs))
+	}
+
+	m := kite.New("jwks", "1.0.0")
+	m.Config = conf.Config.Copy()
+	m.Config.JWKSURL = "http://localhost:5500/jwks"
+	defer m.Close()
+
+	if _, err := m.Register(&url.URL{Scheme: "http", Host: "localhost:4467", Path: "/kite"}); err != nil {
+		t.Fatalf("Register()=%s", err)
+	}
+
+	token, err := m.GetToken(m.Kite())
+	if err != nil {
+		t.Fatalf("GetToken()=%s", err)
+	}
+
+	parsed, err := jwt.ParseWithClaims(token, &kitekey.KiteClaims{}, m.RSAKey)
+	if err != nil {
+		t.Fatalf("ParseWithClaims()=%s", err)
+	}
+
+	kid, _ := parsed.Header["kid"].(string)
+
+	var found bool
+	for _, key := range jwks.Keys {
+		found = found || key.Kid == kid
+	}
+
+	if !found {
+		t.Fatalf("token key %q not found in %+v", kid, jwks.Keys)
+	}
+}
+
+func TestRefreshKeys(t *testing.T) {
+	keys := newSoftKeyPairStorage()
+
+	kon, conf := startKontrol(testkeys.Private, testkeys.Public, 5512, func(k *Kontrol) {
+		k.SetKeyPairStorage(keys)
+	})
+	defer kon.Close()
+
+	// The worker's kite key is signed with a key pair, which is
+	// going to be rotated.
+	if err := kon.AddKeyPair("", testkeys.PublicSecond, testkeys.PrivateSecond); err != nil {
+		t.Fatalf("AddKeyPair()=%s", err)
+	}
+
+	newKite := func(name, username, private, public string) *kite.Kite {
+		k := kite.New(name, "1.0.0")
+		k.Config = conf.Config.Copy()
+		k.Config.KiteKey = testutil.NewToken(username, private, public).Raw
+		k.Config.KontrolKey = public
+		return k
+	}
+
+	regs := make(chan *protocol.RegisterResult, 4)
+
+	worker := newKite("refreshworker", "testuser", testkeys.PrivateSecond, testkeys.PublicSecond)
+	worker.OnRegister(func(reg *protocol.RegisterResult) { regs <- reg })
+	defer worker.Close()
+
+	if err := worker.RegisterForever(&url.URL{Scheme: "http", Host: "localhost:4468", Path: "/kite"}); err != nil {
+		t.Fatalf("RegisterForever()=%s", err)
+	}
+
+	select {
+	case <-regs:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the worker to register")
+	}
+
+	tok, err := worker.GetToken(worker.Kite())
+	if err != nil {
+		t.Fatalf("GetToken()=%s", err)
+	}
+
+	claims := &kitekey.KiteClaims{}
+
+	if _, _, err := new(jwt.Parser).ParseUnverified(tok, claims); err != nil {
+		t.Fatalf("ParseUnverified()=%s", err)
+	}
+
+	if _, err := kon.tokenCache.Get(tokenIDKey(claims.Id)); err != nil {
+		t.Fatalf("want the token to be cached: %s", err)
+	}
+
+	evil := newKite("evil", "evil", testkeys.Private, testkeys.Public)
+	defer evil.Close()
+
+	if _, err := evil.TellKontrolWithTimeout("refreshKeys", 4*time.Second); err == nil {
+		t.Fatal("expected kontrol to deny refreshing keys to a non-admin")
+	}
+
+	if _, err := kon.tokenCache.Get(tokenIDKey(claims.Id)); err != nil {
+		t.Fatalf("want the token to be cached after the denied refresh: %s", err)
+	}
+
+	if err := kon.DeleteKeyPair("", testkeys.PublicSecond); err != nil {
+		t.Fatalf("DeleteKeyPair()=%s", err)
+	}
+
+	admin := newKite("admin", "testuser", testkeys.Private, testkeys.Public)
+	defer admin.Close()
+
+	resp, err := admin.TellKontrolWithTimeout("refreshKeys", 4*time.Second)
+	if err != nil {
+		t.Fatalf("refreshKeys()=%s", err)
+	}
+
+	if n := int(resp.MustFloat64()); n != 1 {
+		t.Fatalf("got %d refreshed kites, want 1", n)
+	}
+
+	if _, err := kon.tokenCache.Get(tokenIDKey(claims.Id)); err != ErrTokenNotFound {
+		t.Fatalf("got %v, want %v", err, ErrTokenNotFound)
+	}
+
+	var reg *protocol.RegisterResult
+
+	select {
+	case reg = <-regs:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the worker to register again")
+	}
+
+	if reg.KiteKey == "" {
+		t.Fatal("want the worker to get a new kite key")
+	}
+
+	claims = &kitekey.KiteClaims{}
+
+	if _, err := jwt.ParseWithClaims(worker.KiteKey(), claims, kitekey.GetKontrolKey); err != nil {
+		t.Fatalf("ParseWithClaims()=%s", err)
+	}
+
+	if claims.KontrolKey != strings.TrimSpace(testkeys.Public) {
+		t.Fatalf("got kite key signed with %q, want the current key", claims.KontrolKey)
 	}
 }
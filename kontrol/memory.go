@@ -0,0 +1,329 @@
+package kontrol
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	kontrolprotocol "github.com/koding/kite/v2/kontrol/protocol"
+	"github.com/koding/kite/v2/protocol"
+)
+
+// MemoryStorage implements the Storage interface by keeping the kites
+// in memory, which makes kontrol usable without an external storage,
+// e.g. in tests or small installations with a single kontrol.
+//
+// Kites which are not updated for KeyTTL expire. The kites can be
+// persisted across restarts with Persist.
+type MemoryStorage struct {
+	mu    sync.RWMutex
+	kites map[string]*memoryKite // keyed by kite ID
+
+	file     string // snapshot file, see Persist
+	closed   chan struct{}
+	closeErr error
+	once     sync.Once
+}
+
+var (
+	_ Storage       = (*MemoryStorage)(nil)
+	_ BatchUpserter = (*MemoryStorage)(nil)
+)
+
+// memoryKite is a kite stored by MemoryStorage, it's also an entry
+// of the snapshot.
+type memoryKite struct {
+	Kite      protocol.Kite                 `json:"kite"`
+	Value     kontrolprotocol.RegisterValue `json:"value"`
+	UpdatedAt time.Time                     `json:"updatedAt"`
+}
+
+func (k *memoryKite) expired(now time.Time) bool {
+	return now.Sub(k.UpdatedAt) > KeyTTL
+}
+
+// NewMemoryStorage gives a new MemoryStorage. The storage should be
+// closed when it's no longer used, to stop removing expired kites.
+func NewMemoryStorage() *MemoryStorage {
+	m := &MemoryStorage{
+		kites:  make(map[string]*memoryKite),
+		closed: make(chan struct{}),
+	}
+
+	go m.expire()
+
+	return m
+}
+
+// Persist loads the kites from the snapshot file, if it exists, and
+// writes the snapshot of the kites to the file every interval and
+// when the storage is closed.
+func (m *MemoryStorage) Persist(file string, interval time.Duration) error {
+	if err := m.Load(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	m.mu.Lock()
+	m.file = file
+	m.mu.Unlock()
+
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				m.Snapshot(file)
+			case <-m.closed:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Snapshot writes the kites to the file as JSON. The file is replaced
+// atomically, so it's never partially written.
+func (m *MemoryStorage) Snapshot(file string) error {
+	m.mu.RLock()
+	kites := make([]*memoryKite, 0, len(m.kites))
+	for _, k := range m.kites {
+		kites = append(kites, k)
+	}
+	p, err := json.Marshal(kites)
+	m.mu.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file))
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(p); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), file)
+}
+
+// Load reads the kites from the snapshot file written by Snapshot.
+// Kites which expired in the meantime are not loaded.
+func (m *MemoryStorage) Load(file string) error {
+	p, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var kites []*memoryKite
+
+	if err := json.Unmarshal(p, &kites); err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	m.mu.Lock()
+	for _, k := range kites {
+		if !k.expired(now) {
+			m.kites[k.Kite.ID] = k
+		}
+	}
+	m.mu.Unlock()
+
+	return nil
+}
+
+// Close stops removing expired kites and writes the final snapshot,
+// if the storage is persisted.
+func (m *MemoryStorage) Close() error {
+	m.once.Do(func() {
+		close(m.closed)
+
+		m.mu.RLock()
+		file := m.file
+		m.mu.RUnlock()
+
+		if file != "" {
+			m.closeErr = m.Snapshot(file)
+		}
+	})
+
+	return m.closeErr
+}
+
+func (m *MemoryStorage) expire() {
+	t := time.NewTicker(KeyTTL / 2)
+	defer t.Stop()
+
+	for {
+		select {
+		case now := <-t.C:
+			m.mu.Lock()
+			for id, k := range m.kites {
+				if k.expired(now) {
+					delete(m.kites, id)
+				}
+			}
+			m.mu.Unlock()
+		case <-m.closed:
+			return
+		}
+	}
+}
+
+func (m *MemoryStorage) Get(query *protocol.KontrolQuery) (Kites, error) {
+	fields := query.Fields()
+
+	var empty = true
+	for _, v := range fields {
+		if v != "" {
+			empty = false
+			break
+		}
+	}
+
+	if empty {
+		return nil, ErrQueryFieldsEmpty
+	}
+
+	// NewVersion returns an error if it's a constraint, like: ">= 1.0, < 1.4"
+	var constraint version.Constraints
+	if _, err := version.NewVersion(query.Version); err != nil && query.Version != "" {
+		if constraint, err = version.NewConstraint(query.Version); err != nil {
+			// version is a malformed, just return the error
+			return nil, err
+		}
+
+		delete(fields, "version")
+	}
+
+	selector, err := protocol.ParseLabels(query.Labels)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	kites := make(Kites, 0)
+
+	m.mu.RLock()
+	for _, k := range m.kites {
+		if !k.expired(now) && matchKite(&k.Kite, fields, constraint) && protocol.MatchLabels(selector, k.Value.Labels) {
+			kites = append(kites, &protocol.KiteWithToken{
+				Kite:    k.Kite,
+				URL:     k.Value.URL,
+				KeyID:   k.Value.KeyID,
+				Methods: append([]string(nil), k.Value.Methods...),
+				Labels:  copyLabels(k.Value.Labels),
+			})
+		}
+	}
+	m.mu.RUnlock()
+
+	// randomize the result
+	kites.Shuffle()
+
+	return kites, nil
+}
+
+// matchKite tells whether the kite has the non-empty fields and its version
+// satisfies the constraint, if it's non-nil.
+func matchKite(k *protocol.Kite, fields map[string]string, constraint version.Constraints) bool {
+	kiteFields := k.Query().Fields()
+
+	for key, v := range fields {
+		if v != "" && kiteFields[key] != v {
+			return false
+		}
+	}
+
+	if constraint != nil {
+		v, err := version.NewVersion(k.Version)
+		if err != nil || !constraint.Check(v) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (m *MemoryStorage) Add(kite *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	m.set(kite, value)
+	return nil
+}
+
+func (m *MemoryStorage) Update(kite *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	// The kite may have expired in the meantime, it's added again then.
+	m.set(kite, value)
+	return nil
+}
+
+func (m *MemoryStorage) Upsert(kite *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
+	m.set(kite, value)
+	return nil
+}
+
+// UpsertBatch implements the BatchUpserter interface.
+func (m *MemoryStorage) UpsertBatch(kites []*protocol.Kite, values []*kontrolprotocol.RegisterValue) error {
+	if len(kites) != len(values) {
+		return errors.New("memory: number of kites and values differ")
+	}
+
+	for i, kite := range kites {
+		m.set(kite, values[i])
+	}
+
+	return nil
+}
+
+func (m *MemoryStorage) Delete(kite *protocol.Kite) error {
+	m.mu.Lock()
+	delete(m.kites, kite.ID)
+	m.mu.Unlock()
+
+	return nil
+}
+
+func (m *MemoryStorage) set(kite *protocol.Kite, value *kontrolprotocol.RegisterValue) {
+	k := &memoryKite{
+		Kite:      *kite,
+		Value:     *value,
+		UpdatedAt: time.Now(),
+	}
+
+	k.Value.Methods = append([]string(nil), value.Methods...)
+	k.Value.Labels = copyLabels(value.Labels)
+
+	m.mu.Lock()
+	m.kites[kite.ID] = k
+	m.mu.Unlock()
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+
+	copy := make(map[string]string, len(labels))
+	for k, v := range labels {
+		copy[k] = v
+	}
+
+	return copy
+}
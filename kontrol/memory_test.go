@@ -0,0 +1,165 @@
+package kontrol_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/koding/kite/v2/kontrol"
+	kontrolprotocol "github.com/koding/kite/v2/kontrol/protocol"
+	"github.com/koding/kite/v2/protocol"
+)
+
+func memoryKite(id, version, region string) *protocol.Kite {
+	return &protocol.Kite{
+		Username:    "devrim",
+		Environment: "test",
+		Name:        "mathworker",
+		Version:     version,
+		Region:      region,
+		Hostname:    "localhost",
+		ID:          id,
+	}
+}
+
+func ids(kites kontrol.Kites) []string {
+	var ids []string
+	for _, k := range kites {
+		ids = append(ids, k.Kite.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestMemoryStorage(t *testing.T) {
+	m := kontrol.NewMemoryStorage()
+	defer m.Close()
+
+	value := &kontrolprotocol.RegisterValue{URL: "http://localhost:4000/kite", KeyID: "key"}
+
+	m.Add(memoryKite("1", "1.0.0", "sj"), value)
+	m.Upsert(memoryKite("2", "1.1.0", "sj"), value)
+	m.Update(memoryKite("3", "2.0.0", "ams"), value)
+
+	cases := []struct {
+		query *protocol.KontrolQuery
+		want  []string
+	}{
+		{&protocol.KontrolQuery{Username: "devrim"}, []string{"1", "2", "3"}},
+		{&protocol.KontrolQuery{Username: "devrim", Region: "sj"}, []string{"1", "2"}},
+		{&protocol.KontrolQuery{Username: "devrim", Version: "1.1.0"}, []string{"2"}},
+		{&protocol.KontrolQuery{Username: "devrim", Version: "< 2.0.0"}, []string{"1", "2"}},
+		{&protocol.KontrolQuery{Username: "devrim", Version: ">= 1.1.0", Region: "ams"}, []string{"3"}},
+		{&protocol.KontrolQuery{ID: "3"}, []string{"3"}},
+		{&protocol.KontrolQuery{Username: "other"}, nil},
+	}
+
+	for _, cas := range cases {
+		kites, err := m.Get(cas.query)
+		if err != nil {
+			t.Fatalf("%+v: Get()=%s", cas.query, err)
+		}
+
+		if got := ids(kites); !equalStrings(got, cas.want) {
+			t.Fatalf("%+v: got %v, want %v", cas.query, got, cas.want)
+		}
+	}
+
+	if _, err := m.Get(&protocol.KontrolQuery{}); err != kontrol.ErrQueryFieldsEmpty {
+		t.Fatalf("got %v, want %s", err, kontrol.ErrQueryFieldsEmpty)
+	}
+
+	m.Delete(memoryKite("2", "1.1.0", "sj"))
+
+	kites, err := m.Get(&protocol.KontrolQuery{Username: "devrim"})
+	if err != nil {
+		t.Fatalf("Get()=%s", err)
+	}
+
+	if got := ids(kites); !equalStrings(got, []string{"1", "3"}) {
+		t.Fatalf("got %v, want [1 3]", got)
+	}
+
+	if kites[0].URL != value.URL || kites[0].KeyID != value.KeyID {
+		t.Fatalf("got %+v, want kite with %+v", kites[0], value)
+	}
+
+	labeled := &kontrolprotocol.RegisterValue{
+		URL:    value.URL,
+		KeyID:  value.KeyID,
+		Labels: map[string]string{"gpu": "true", "zone": "eu-1b"},
+	}
+
+	m.Upsert(memoryKite("4", "1.0.0", "sj"), labeled)
+
+	for labels, want := range map[string][]string{
+		"zone=eu-1b":          {"4"},
+		"gpu=true,zone=eu-1b": {"4"},
+		"gpu=false":           nil,
+	} {
+		kites, err := m.Get(&protocol.KontrolQuery{Username: "devrim", Labels: labels})
+		if err != nil {
+			t.Fatalf("%q: Get()=%s", labels, err)
+		}
+
+		if got := ids(kites); !equalStrings(got, want) {
+			t.Fatalf("%q: got %v, want %v", labels, got, want)
+		}
+	}
+}
+
+func TestMemoryStoragePersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kontrol")
+	if err != nil {
+		t.Fatalf("TempDir()=%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "kites.json")
+	value := &kontrolprotocol.RegisterValue{URL: "http://localhost:4000/kite", KeyID: "key"}
+
+	m := kontrol.NewMemoryStorage()
+
+	if err := m.Persist(file, time.Hour); err != nil {
+		t.Fatalf("Persist()=%s", err)
+	}
+
+	m.Add(memoryKite("1", "1.0.0", "sj"), value)
+
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close()=%s", err)
+	}
+
+	m = kontrol.NewMemoryStorage()
+	defer m.Close()
+
+	if err := m.Persist(file, time.Hour); err != nil {
+		t.Fatalf("Persist()=%s", err)
+	}
+
+	kites, err := m.Get(&protocol.KontrolQuery{Username: "devrim"})
+	if err != nil {
+		t.Fatalf("Get()=%s", err)
+	}
+
+	if got := ids(kites); !equalStrings(got, []string{"1"}) {
+		t.Fatalf("got %v, want [1]", got)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -3,11 +3,12 @@ package kontrol
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
 
 	etcd "github.com/coreos/etcd/client"
-	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
-	"github.com/koding/kite/protocol"
+	kontrolprotocol "github.com/koding/kite/v2/kontrol/protocol"
+	"github.com/koding/kite/v2/protocol"
 )
 
 // Node is a wrapper around an etcd node to provide additional
@@ -58,9 +59,11 @@ func (n *Node) Kite() (*protocol.KiteWithToken, error) {
 	}
 
 	return &protocol.KiteWithToken{
-		Kite:  *kite,
-		URL:   val.URL,
-		KeyID: val.KeyID,
+		Kite:    *kite,
+		URL:     val.URL,
+		KeyID:   val.KeyID,
+		Methods: val.Methods,
+		Labels:  val.Labels,
 	}, nil
 }
 
@@ -92,11 +95,16 @@ func (n *Node) Value() (kontrolprotocol.RegisterValue, error) {
 }
 
 // Kites returns a list of kites that are gathered by collecting recursively
-// all nodes under the current node.
+// all nodes under the current node. The most recently modified kites
+// come first.
 func (n *Node) Kites() (Kites, error) {
 	// Get all nodes recursively.
 	nodes := n.Flatten()
 
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Node.ModifiedIndex > nodes[j].Node.ModifiedIndex
+	})
+
 	// Convert etcd nodes to kites.
 	var err error
 	kites := make(Kites, len(nodes))
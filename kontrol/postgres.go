@@ -2,6 +2,7 @@ package kontrol
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/url"
@@ -12,9 +13,9 @@ import (
 	sq "github.com/lann/squirrel"
 	"github.com/lib/pq"
 
-	"github.com/koding/kite"
-	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
-	"github.com/koding/kite/protocol"
+	"github.com/koding/kite/v2"
+	kontrolprotocol "github.com/koding/kite/v2/kontrol/protocol"
+	"github.com/koding/kite/v2/protocol"
 	"github.com/koding/multiconfig"
 )
 
@@ -40,7 +41,9 @@ type Postgres struct {
 
 var (
 	_ Storage        = (*Postgres)(nil)
+	_ Pager          = (*Postgres)(nil)
 	_ KeyPairStorage = (*Postgres)(nil)
+	_ Counter        = (*Postgres)(nil)
 )
 
 func NewPostgres(conf *PostgresConfig, log kite.Logger) *Postgres {
@@ -66,14 +69,26 @@ func NewPostgres(conf *PostgresConfig, log kite.Logger) *Postgres {
 		}
 	}
 
-	connString := fmt.Sprintf(
+	p, err := newPostgres(conf.ConnString(), log)
+	if err != nil {
+		panic(err)
+	}
+
+	return p
+}
+
+// ConnString gives the lib/pq connection string of the configuration.
+func (conf *PostgresConfig) ConnString() string {
+	return fmt.Sprintf(
 		"host=%s port=%d dbname=%s user=%s password=%s sslmode=disable connect_timeout=%d",
 		conf.Host, conf.Port, conf.DBName, conf.Username, conf.Password, conf.ConnectTimeout,
 	)
+}
 
+func newPostgres(connString string, log kite.Logger) (*Postgres, error) {
 	db, err := sql.Open("postgres", connString)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	p := &Postgres{
@@ -84,7 +99,7 @@ func NewPostgres(conf *PostgresConfig, log kite.Logger) *Postgres {
 	cleanInterval := 120 * time.Second // clean every 120 second
 	go p.RunCleaner(cleanInterval, KeyTTL)
 
-	return p
+	return p, nil
 }
 
 // RunCleaner deletes every "interval" duration rows which are older than
@@ -124,7 +139,98 @@ func (p *Postgres) CleanExpiredRows(expire time.Duration) (int64, error) {
 	return rows.RowsAffected()
 }
 
+// Incr implements the Counter interface. The counters are kept in the
+// kite.counter table, expired counters are restarted on increment.
+func (p *Postgres) Incr(key string, window time.Duration) (int64, error) {
+	incr := `INSERT INTO kite.counter (key, value, expires_at)
+		VALUES ($1, 1, (now() at time zone 'utc') + ((INTERVAL '1 millisecond') * $2))
+		ON CONFLICT (key) DO UPDATE SET
+			value = CASE WHEN kite.counter.expires_at < (now() at time zone 'utc')
+				THEN 1 ELSE kite.counter.value + 1 END,
+			expires_at = CASE WHEN kite.counter.expires_at < (now() at time zone 'utc')
+				THEN EXCLUDED.expires_at ELSE kite.counter.expires_at END
+		RETURNING value`
+
+	var n int64
+
+	if err := p.DB.QueryRow(incr, key, int64(window/time.Millisecond)).Scan(&n); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
 func (p *Postgres) Get(query *protocol.KontrolQuery) (Kites, error) {
+	kites, err := p.get(query)
+	if err != nil {
+		return nil, err
+	}
+
+	// randomize the result
+	kites.Shuffle()
+
+	return kites, nil
+}
+
+// GetPage implements the Pager interface. Queries without a version
+// constraint are paged by the database.
+func (p *Postgres) GetPage(query *protocol.KontrolQuery, offset, limit int) (Kites, int, error) {
+	if _, err := version.NewVersion(query.Version); err != nil && query.Version != "" {
+		// version constraints are checked after the kites are fetched
+		kites, err := p.get(query)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		total := kites.Page(offset, limit)
+
+		return kites, total, nil
+	}
+
+	where, err := whereQuery(query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	psql := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
+
+	countQuery, args, err := psql.Select("COUNT(*)").From("kite.kite").Where(where).ToSql()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var total int
+	if err := p.DB.QueryRow(countQuery, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	page := psql.Select(kiteColumns...).From("kite.kite").Where(where).OrderBy("id").Offset(uint64(offset))
+	if limit > 0 {
+		page = page.Limit(uint64(limit))
+	}
+
+	sqlQuery, args, err := page.ToSql()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := p.DB.Query(sqlQuery, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	kites, err := scanKites(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return kites, total, nil
+}
+
+// get gives the kites matching the query, ordered from the most recently
+// updated one.
+func (p *Postgres) get(query *protocol.KontrolQuery) (Kites, error) {
 	// only let query with usernames, otherwise the whole tree will be fetched
 	// which is not good for us
 	sqlQuery, args, err := selectQuery(query)
@@ -150,6 +256,7 @@ func (p *Postgres) Get(query *protocol.KontrolQuery) (Kites, error) {
 			Username:    query.Username,
 			Environment: query.Environment,
 			Name:        query.Name,
+			Labels:      query.Labels,
 		}
 
 		// We will make a get request to all nodes under this name
@@ -170,6 +277,50 @@ func (p *Postgres) Get(query *protocol.KontrolQuery) (Kites, error) {
 	}
 	defer rows.Close()
 
+	kites, err := scanKites(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// rows are ordered by updated_at, so the most recent entry
+	// of each kite is kept
+	if DedupKites {
+		kites.Dedup()
+	}
+
+	// if it's just single result there is no need to filter
+	// according to the version constraint
+	if len(kites) == 1 {
+		return kites, nil
+	}
+
+	// Filter kites by version constraint
+	if hasVersionConstraint {
+		kites.Filter(versionConstraint, keyRest)
+	}
+
+	return kites, nil
+}
+
+// kiteColumns are the columns of the kite.kite table read by scanKites.
+var kiteColumns = []string{
+	"username",
+	"environment",
+	"kitename",
+	"version",
+	"region",
+	"hostname",
+	"id",
+	"url",
+	"updated_at",
+	"created_at",
+	"key_id",
+	"methods",
+	"labels",
+}
+
+// scanKites reads the kites from the rows of the kite.kite table.
+func scanKites(rows *sql.Rows) (Kites, error) {
 	var (
 		username    string
 		environment string
@@ -182,6 +333,8 @@ func (p *Postgres) Get(query *protocol.KontrolQuery) (Kites, error) {
 		updated_at  time.Time
 		created_at  time.Time
 		keyId       string
+		methods     sql.NullString
+		labels      sql.NullString
 	)
 
 	kites := make(Kites, 0)
@@ -199,12 +352,14 @@ func (p *Postgres) Get(query *protocol.KontrolQuery) (Kites, error) {
 			&updated_at,
 			&created_at,
 			&keyId,
+			&methods,
+			&labels,
 		)
 		if err != nil {
 			return nil, err
 		}
 
-		kites = append(kites, &protocol.KiteWithToken{
+		kite := &protocol.KiteWithToken{
 			Kite: protocol.Kite{
 				Username:    username,
 				Environment: environment,
@@ -216,26 +371,26 @@ func (p *Postgres) Get(query *protocol.KontrolQuery) (Kites, error) {
 			},
 			URL:   url,
 			KeyID: keyId,
-		})
-	}
+		}
 
-	if err := rows.Err(); err != nil {
-		return nil, err
-	}
+		if methods.Valid {
+			if err := json.Unmarshal([]byte(methods.String), &kite.Methods); err != nil {
+				return nil, err
+			}
+		}
 
-	// if it's just single result there is no need to shuffle or filter
-	// according to the version constraint
-	if len(kites) == 1 {
-		return kites, nil
-	}
+		if labels.Valid {
+			if err := json.Unmarshal([]byte(labels.String), &kite.Labels); err != nil {
+				return nil, err
+			}
+		}
 
-	// Filter kites by version constraint
-	if hasVersionConstraint {
-		kites.Filter(versionConstraint, keyRest)
+		kites = append(kites, kite)
 	}
 
-	// randomize the result
-	kites.Shuffle()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
 	return kites, nil
 }
@@ -267,8 +422,8 @@ func (p *Postgres) Upsert(kiteProt *protocol.Kite, value *kontrolprotocol.Regist
 		}
 	}()
 
-	res, err := tx.Exec(`UPDATE kite.kite SET url = $1, key_id = $3, updated_at = (now() at time zone 'utc') WHERE id = $2`,
-		value.URL, kiteProt.ID, value.KeyID)
+	res, err := tx.Exec(`UPDATE kite.kite SET url = $1, key_id = $3, methods = $4, labels = $5, updated_at = (now() at time zone 'utc') WHERE id = $2`,
+		value.URL, kiteProt.ID, value.KeyID, methodsValue(value.Methods), labelsValue(value.Labels))
 	if err != nil {
 		return err
 	}
@@ -283,7 +438,7 @@ func (p *Postgres) Upsert(kiteProt *protocol.Kite, value *kontrolprotocol.Regist
 		return nil
 	}
 
-	insertSQL, args, err := insertKiteQuery(kiteProt, value.URL, value.KeyID)
+	insertSQL, args, err := insertKiteQuery(kiteProt, value)
 	if err != nil {
 		return err
 	}
@@ -292,6 +447,70 @@ func (p *Postgres) Upsert(kiteProt *protocol.Kite, value *kontrolprotocol.Regist
 	return err
 }
 
+// UpsertBatchSize is the maximum number of kites upserted by a single
+// statement of Postgres.UpsertBatch, it keeps the number of the statement
+// parameters below the limit of PostgreSQL.
+var UpsertBatchSize = 1000
+
+// UpsertBatch implements the BatchUpserter interface. The kites are upserted
+// with multi-row INSERT ... ON CONFLICT statements, which require
+// PostgreSQL 9.5 or later.
+func (p *Postgres) UpsertBatch(kites []*protocol.Kite, values []*kontrolprotocol.RegisterValue) error {
+	if len(kites) != len(values) {
+		return errors.New("postgres: number of kites and values differ")
+	}
+
+	// A single statement can't affect the same row twice, so only
+	// the last value of each kite is upserted.
+	last := make(map[string]int, len(kites))
+
+	for i, kiteProt := range kites {
+		// check that the incoming URL is valid to prevent malformed input
+		if _, err := url.Parse(values[i].URL); err != nil {
+			return err
+		}
+
+		if values[i].KeyID == "" {
+			return errors.New("postgres: keyId is empty. Aborting upsert")
+		}
+
+		last[kiteProt.ID] = i
+	}
+
+	insert := insertKites()
+	n := 0
+
+	for i, kiteProt := range kites {
+		if last[kiteProt.ID] != i {
+			continue
+		}
+
+		insert = insert.Values(kiteRow(kiteProt, values[i])...)
+		n++
+
+		if n == UpsertBatchSize || i == len(kites)-1 {
+			if err := p.upsertRows(insert); err != nil {
+				return err
+			}
+
+			insert = insertKites()
+			n = 0
+		}
+	}
+
+	return nil
+}
+
+func (p *Postgres) upsertRows(insert sq.InsertBuilder) error {
+	sqlQuery, args, err := insert.Suffix(`ON CONFLICT (id) DO UPDATE SET url = EXCLUDED.url, key_id = EXCLUDED.key_id, methods = EXCLUDED.methods, labels = EXCLUDED.labels, updated_at = (now() at time zone 'utc')`).ToSql()
+	if err != nil {
+		return err
+	}
+
+	_, err = p.DB.Exec(sqlQuery, args...)
+	return err
+}
+
 func (p *Postgres) Add(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) error {
 	// check that the incoming URL is valid to prevent malformed input
 	_, err := url.Parse(value.URL)
@@ -299,7 +518,7 @@ func (p *Postgres) Add(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterV
 		return err
 	}
 
-	sqlQuery, args, err := insertKiteQuery(kiteProt, value.URL, value.KeyID)
+	sqlQuery, args, err := insertKiteQuery(kiteProt, value)
 	if err != nil {
 		return err
 	}
@@ -317,9 +536,9 @@ func (p *Postgres) Update(kiteProt *protocol.Kite, value *kontrolprotocol.Regist
 
 	// TODO: also consider just using WHERE id = kiteProt.ID, see how it's
 	// performs out
-	_, err = p.DB.Exec(`UPDATE kite.kite SET url = $1, updated_at = (now() at time zone 'utc') 
+	_, err = p.DB.Exec(`UPDATE kite.kite SET url = $1, methods = $3, labels = $4, updated_at = (now() at time zone 'utc') 
 	WHERE id = $2`,
-		value.URL, kiteProt.ID)
+		value.URL, kiteProt.ID, methodsValue(value.Methods), labelsValue(value.Labels))
 
 	return err
 }
@@ -334,7 +553,16 @@ func (p *Postgres) Delete(kiteProt *protocol.Kite) error {
 func selectQuery(query *protocol.KontrolQuery) (string, []interface{}, error) {
 	psql := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
 
-	kites := psql.Select("*").From("kite.kite")
+	andQuery, err := whereQuery(query)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return psql.Select(kiteColumns...).From("kite.kite").Where(andQuery).OrderBy("updated_at DESC").ToSql()
+}
+
+// whereQuery gives the condition matching kites of the query.
+func whereQuery(query *protocol.KontrolQuery) (sq.And, error) {
 	fields := query.Fields()
 	andQuery := sq.And{}
 
@@ -354,25 +582,32 @@ func selectQuery(query *protocol.KontrolQuery) (string, []interface{}, error) {
 	}
 
 	if len(andQuery) == 0 {
-		return "", nil, ErrQueryFieldsEmpty
+		return nil, ErrQueryFieldsEmpty
 	}
 
-	return kites.Where(andQuery).ToSql()
-}
+	labels, err := protocol.ParseLabels(query.Labels)
+	if err != nil {
+		return nil, err
+	}
 
-// inseryKiteQuery inserts the given kite, url and key to the kite.kite table
-func insertKiteQuery(kiteProt *protocol.Kite, url, keyId string) (string, []interface{}, error) {
-	psql := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
+	// the labels column is indexed with GIN, which supports
+	// the containment operator
+	if len(labels) != 0 {
+		andQuery = append(andQuery, sq.Expr("labels @> ?::jsonb", labelsValue(labels)))
+	}
 
-	kiteValues := kiteProt.Values()
-	values := make([]interface{}, len(kiteValues))
+	return andQuery, nil
+}
 
-	for i, kiteVal := range kiteValues {
-		values[i] = kiteVal
-	}
+// inseryKiteQuery inserts the given kite, url, key, methods and labels to the kite.kite table
+func insertKiteQuery(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) (string, []interface{}, error) {
+	return insertKites().Values(kiteRow(kiteProt, value)...).ToSql()
+}
 
-	values = append(values, url)
-	values = append(values, keyId)
+// insertKites gives an INSERT statement of the kite.kite table, which
+// rows are given by kiteRow.
+func insertKites() sq.InsertBuilder {
+	psql := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
 
 	return psql.Insert("kite.kite").Columns(
 		"username",
@@ -384,7 +619,56 @@ func insertKiteQuery(kiteProt *protocol.Kite, url, keyId string) (string, []inte
 		"id",
 		"url",
 		"key_id",
-	).Values(values...).ToSql()
+		"methods",
+		"labels",
+	)
+}
+
+// kiteRow gives the values of the kite.kite table row for the given kite.
+func kiteRow(kiteProt *protocol.Kite, value *kontrolprotocol.RegisterValue) []interface{} {
+	kiteValues := kiteProt.Values()
+	values := make([]interface{}, len(kiteValues))
+
+	for i, kiteVal := range kiteValues {
+		values[i] = kiteVal
+	}
+
+	values = append(values, value.URL)
+	values = append(values, value.KeyID)
+	values = append(values, methodsValue(value.Methods))
+	values = append(values, labelsValue(value.Labels))
+
+	return values
+}
+
+// methodsValue gives the value of the methods column, which stores
+// the methods as a JSON array.
+func methodsValue(methods []string) interface{} {
+	if len(methods) == 0 {
+		return nil
+	}
+
+	p, err := json.Marshal(methods)
+	if err != nil {
+		return nil
+	}
+
+	return string(p)
+}
+
+// labelsValue gives the value of the labels column, which stores
+// the labels as a JSONB object.
+func labelsValue(labels map[string]string) interface{} {
+	if len(labels) == 0 {
+		return nil
+	}
+
+	p, err := json.Marshal(labels)
+	if err != nil {
+		return nil
+	}
+
+	return string(p)
 }
 
 /*
@@ -9,4 +9,10 @@ type RegisterValue struct {
 	// This is currently only used by Kontrol itself internally, however it
 	// might be changed in the future.
 	KeyID string `json:"key_id"`
+
+	// Methods are the methods published by the kite.
+	Methods []string `json:"methods,omitempty"`
+
+	// Labels are the labels the kite registered with.
+	Labels map[string]string `json:"labels,omitempty"`
 }
@@ -0,0 +1,196 @@
+package kontrol
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/koding/kite/v2/protocol"
+)
+
+// DefaultQueryCacheSize is the maximum number of cached getKites queries,
+// if Kontrol.QueryCacheSize is 0.
+var DefaultQueryCacheSize = 1024
+
+// queryCache caches the kites matching getKites queries, so the storage is
+// not hit by hot queries. An entry is removed when it expires, when a kite
+// matching its query registers, deregisters or updates, or when the cache
+// is full and the entry is the least recently used one.
+type queryCache struct {
+	ttl  time.Duration
+	size int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // values are *queryCacheEntry
+	lru     *list.List               // most recently used entries first
+
+	// gen is incremented on every invalidation, results fetched from
+	// the storage before an invalidation are not cached
+	gen uint64
+}
+
+type queryCacheEntry struct {
+	key        string
+	fields     map[string]string
+	constraint version.Constraints
+	kites      Kites
+	total      int
+	expires    time.Time
+}
+
+func newQueryCache(ttl time.Duration, size int) *queryCache {
+	if size <= 0 {
+		size = DefaultQueryCacheSize
+	}
+
+	return &queryCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func queryCacheKey(query *protocol.KontrolQuery, offset, limit int) string {
+	p, err := json.Marshal(query)
+	if err != nil {
+		panic(err) // KontrolQuery consists of strings only
+	}
+
+	return fmt.Sprintf("%d/%d/%s", offset, limit, p)
+}
+
+// generation gives the value that must be passed to put for the kites,
+// which are going to be read from the storage.
+func (c *queryCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.gen
+}
+
+// get gives a copy of the cached kites for the key, as the callers modify
+// the kites they get.
+func (c *queryCache) get(key string) (Kites, int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, 0, false
+	}
+
+	e := el.Value.(*queryCacheEntry)
+
+	if time.Now().After(e.expires) {
+		c.remove(el)
+		return nil, 0, false
+	}
+
+	c.lru.MoveToFront(el)
+
+	return copyKites(e.kites), e.total, true
+}
+
+// put caches the kites for the key, unless the cache was invalidated
+// since gen was obtained.
+func (c *queryCache) put(gen uint64, key string, query *protocol.KontrolQuery, kites Kites, total int) {
+	fields := query.Fields()
+
+	var constraint version.Constraints
+	if _, err := version.NewVersion(query.Version); err != nil && query.Version != "" {
+		if constraint, err = version.NewConstraint(query.Version); err != nil {
+			return
+		}
+
+		delete(fields, "version")
+	}
+
+	e := &queryCacheEntry{
+		key:        key,
+		fields:     fields,
+		constraint: constraint,
+		kites:      copyKites(kites),
+		total:      total,
+		expires:    time.Now().Add(c.ttl),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+
+	c.entries[key] = c.lru.PushFront(e)
+
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// invalidate removes the entries whose queries match the kite.
+func (c *queryCache) invalidate(kite *protocol.Kite) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+
+		if e := el.Value.(*queryCacheEntry); matchKite(kite, e.fields, e.constraint) {
+			c.remove(el)
+		}
+
+		el = next
+	}
+}
+
+func (c *queryCache) remove(el *list.Element) {
+	delete(c.entries, el.Value.(*queryCacheEntry).key)
+	c.lru.Remove(el)
+}
+
+func copyKites(kites Kites) Kites {
+	if kites == nil {
+		return nil
+	}
+
+	copied := make(Kites, len(kites))
+	for i, kite := range kites {
+		kiteCopy := *kite
+		copied[i] = &kiteCopy
+	}
+
+	return copied
+}
+
+// kiteQueryCache gives the cache of getKites queries, or nil if caching
+// is disabled with zero QueryCacheTTL.
+func (k *Kontrol) kiteQueryCache() *queryCache {
+	if k.QueryCacheTTL <= 0 {
+		return nil
+	}
+
+	k.queryCacheOnce.Do(func() {
+		k.queryCache = newQueryCache(k.QueryCacheTTL, k.QueryCacheSize)
+	})
+
+	return k.queryCache
+}
+
+// invalidateQueries removes the cached queries matching the kite, it's
+// called whenever the kite changes in the storage.
+func (k *Kontrol) invalidateQueries(kite *protocol.Kite) {
+	if c := k.kiteQueryCache(); c != nil && kite != nil {
+		c.invalidate(kite)
+	}
+}
@@ -0,0 +1,97 @@
+package kontrol
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	kontrolprotocol "github.com/koding/kite/v2/kontrol/protocol"
+	"github.com/koding/kite/v2/protocol"
+)
+
+type countingStorage struct {
+	Storage
+	gets int32
+}
+
+func (c *countingStorage) Get(query *protocol.KontrolQuery) (Kites, error) {
+	atomic.AddInt32(&c.gets, 1)
+	return c.Storage.Get(query)
+}
+
+func TestQueryCache(t *testing.T) {
+	mem := NewMemoryStorage()
+	defer mem.Close()
+
+	storage := &countingStorage{Storage: mem}
+
+	k := &Kontrol{
+		storage:        storage,
+		QueryCacheTTL:  200 * time.Millisecond,
+		QueryCacheSize: 2,
+	}
+
+	foo := &protocol.Kite{Username: "devrim", Environment: "test", Name: "foo", Version: "1.0.0", ID: "foo-1"}
+	bar := &protocol.Kite{Username: "devrim", Environment: "test", Name: "bar", Version: "1.0.0", ID: "bar-1"}
+
+	for _, kite := range []*protocol.Kite{foo, bar} {
+		if err := mem.Add(kite, &kontrolprotocol.RegisterValue{URL: "http://localhost/kite"}); err != nil {
+			t.Fatalf("Add()=%s", err)
+		}
+	}
+
+	fooQuery := &protocol.KontrolQuery{Username: "devrim", Name: "foo"}
+	barQuery := &protocol.KontrolQuery{Username: "devrim", Name: "bar"}
+
+	get := func(query *protocol.KontrolQuery, want int) Kites {
+		kites, _, err := k.getKites(query, 0, 0)
+		if err != nil {
+			t.Fatalf("getKites()=%s", err)
+		}
+		if len(kites) != want {
+			t.Fatalf("got %d kites, want %d", len(kites), want)
+		}
+		return kites
+	}
+
+	gets := func(want int32) {
+		if n := atomic.LoadInt32(&storage.gets); n != want {
+			t.Fatalf("got %d storage queries, want %d", n, want)
+		}
+	}
+
+	// The cached kites can be modified by the caller.
+	get(fooQuery, 1)[0].Token = "token"
+	if kites := get(fooQuery, 1); kites[0].Token != "" {
+		t.Fatalf("got token %q, want none", kites[0].Token)
+	}
+	gets(1)
+
+	// A change of another kite does not invalidate the query.
+	k.emit(&Event{Type: KiteRegistered, Kite: bar})
+	get(fooQuery, 1)
+	gets(1)
+
+	foo2 := *foo
+	foo2.ID = "foo-2"
+
+	if err := mem.Add(&foo2, &kontrolprotocol.RegisterValue{URL: "http://localhost/kite"}); err != nil {
+		t.Fatalf("Add()=%s", err)
+	}
+
+	k.emit(&Event{Type: KiteRegistered, Kite: &foo2})
+	get(fooQuery, 2)
+	gets(2)
+
+	// The least recently used query is evicted.
+	get(barQuery, 1)
+	get(&protocol.KontrolQuery{Username: "devrim", Environment: "test"}, 3)
+	gets(4)
+	get(fooQuery, 2)
+	gets(5)
+
+	time.Sleep(300 * time.Millisecond)
+
+	get(fooQuery, 2)
+	gets(6)
+}
@@ -0,0 +1,160 @@
+package kontrol
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/protocol"
+)
+
+// ErrorQuotaExceeded is the type of errors returned when a user
+// exceeds its quota, see Quota.
+const ErrorQuotaExceeded kite.ErrorType = "quotaExceeded"
+
+func init() {
+	kite.RegisterErrorType(ErrorQuotaExceeded, false)
+}
+
+// Quota describes the limits of a single user. Zero value of a limit
+// means no limit.
+type Quota struct {
+	// MaxKites is the maximum number of kites registered by the user.
+	MaxKites int
+
+	// MaxTokensPerMinute is the maximum number of tokens issued for
+	// the user within a minute. Tokens served from the token cache
+	// are not counted.
+	MaxTokensPerMinute int
+}
+
+// quota gives the quota of the user, or nil if the user is not limited.
+func (k *Kontrol) quota(username string) *Quota {
+	if q, ok := k.Quotas[username]; ok {
+		return q
+	}
+
+	return k.DefaultQuota
+}
+
+// quotaError gives a structured error of the exceeded limit. The code
+// of the error is the name of the limit, like "MaxKites".
+func quotaError(code string, retryable bool, format string, args ...interface{}) error {
+	return &kite.Error{
+		Type:      string(ErrorQuotaExceeded),
+		Message:   "quota exceeded: " + fmt.Sprintf(format, args...),
+		CodeVal:   code,
+		Retryable: retryable,
+	}
+}
+
+// checkKiteQuota returns non-nil error if registering the kite would
+// exceed the quota of its owner. Kites registering again are not
+// counted twice.
+func (k *Kontrol) checkKiteQuota(kite *protocol.Kite) error {
+	q := k.quota(kite.Username)
+	if q == nil || q.MaxKites == 0 {
+		return nil
+	}
+
+	kites, err := k.storage.Get(&protocol.KontrolQuery{Username: kite.Username})
+
+	// Etcd reports users with no kites as not found.
+	if err != nil && !etcd.IsKeyNotFound(err) {
+		return err
+	}
+
+	n := 0
+	for _, other := range kites {
+		if other.Kite.ID != kite.ID {
+			n++
+		}
+	}
+
+	if n >= q.MaxKites {
+		return quotaError("MaxKites", false, "user %q has reached the limit of %d registered kites", kite.Username, q.MaxKites)
+	}
+
+	return nil
+}
+
+// checkTokenQuota counts a token issued for the user and returns non-nil
+// error if the user has exceeded its quota.
+func (k *Kontrol) checkTokenQuota(username string) error {
+	q := k.quota(username)
+	if q == nil || q.MaxTokensPerMinute == 0 {
+		return nil
+	}
+
+	n, err := k.counter().Incr("tokens/"+username, time.Minute)
+	if err != nil {
+		return err
+	}
+
+	if n > int64(q.MaxTokensPerMinute) {
+		return quotaError("MaxTokensPerMinute", true, "user %q has reached the limit of %d tokens per minute", username, q.MaxTokensPerMinute)
+	}
+
+	return nil
+}
+
+// counter gives the counters of the storage, if it has any. Otherwise the
+// counters are kept in memory and quotas are enforced per replica.
+func (k *Kontrol) counter() Counter {
+	if c, ok := k.storage.(Counter); ok {
+		return c
+	}
+
+	k.countersOnce.Do(func() {
+		k.log.Warning("Storage does not implement Counter. Using in memory counters")
+		k.counters = newMemCounter()
+	})
+
+	return k.counters
+}
+
+// memCounter is an in memory implementation of Counter.
+type memCounter struct {
+	mu     sync.Mutex
+	counts map[string]*memCount
+}
+
+type memCount struct {
+	n       int64
+	expires time.Time
+}
+
+var _ Counter = (*memCounter)(nil)
+
+func newMemCounter() *memCounter {
+	return &memCounter{
+		counts: make(map[string]*memCount),
+	}
+}
+
+// Incr implements the Counter interface.
+func (m *memCounter) Incr(key string, window time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+
+	c, ok := m.counts[key]
+	if !ok || now.After(c.expires) {
+		// Remove expired counters, so they don't pile up.
+		for key, c := range m.counts {
+			if now.After(c.expires) {
+				delete(m.counts, key)
+			}
+		}
+
+		c = &memCount{expires: now.Add(window)}
+		m.counts[key] = c
+	}
+
+	c.n++
+
+	return c.n, nil
+}
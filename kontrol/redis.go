@@ -0,0 +1,289 @@
+package kontrol
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// RedisTokenCache is a TokenCache backed by a Redis server, which can
+// be shared by many kontrol instances.
+type RedisTokenCache struct {
+	// Addr is the address of the Redis server, like "localhost:6379".
+	Addr string
+
+	// Password, when non-empty, is used to authenticate to the server.
+	Password string
+
+	// DB is the number of the Redis database to use.
+	DB int
+
+	// Prefix is prepended to all the keys. By default "kontrol:token:".
+	Prefix string
+
+	// Timeout is used for dialing and each command sent to the server.
+	// By default 5s.
+	Timeout time.Duration
+
+	idle chan *redisConn
+}
+
+var _ TokenCache = (*RedisTokenCache)(nil)
+
+// NewRedisTokenCache gives new RedisTokenCache for the given server address.
+func NewRedisTokenCache(addr string) *RedisTokenCache {
+	return &RedisTokenCache{
+		Addr:   addr,
+		Prefix: "kontrol:token:",
+		idle:   make(chan *redisConn, 8),
+	}
+}
+
+// Get implements the TokenCache interface.
+func (r *RedisTokenCache) Get(key string) (string, error) {
+	reply, err := r.do("GET", r.Prefix+key)
+	if err != nil {
+		return "", err
+	}
+
+	token, ok := reply.(string)
+	if !ok {
+		return "", ErrTokenNotFound
+	}
+
+	return token, nil
+}
+
+// Set implements the TokenCache interface.
+func (r *RedisTokenCache) Set(key, token string, ttl time.Duration) error {
+	ms := int64(ttl / time.Millisecond)
+	if ms <= 0 {
+		return nil
+	}
+
+	_, err := r.do("SET", r.Prefix+key, token, "PX", strconv.FormatInt(ms, 10))
+	return err
+}
+
+// Delete implements the TokenCache interface.
+func (r *RedisTokenCache) Delete(key string) error {
+	_, err := r.do("DEL", r.Prefix+key)
+	return err
+}
+
+// Flush removes all the tokens with the cache's prefix.
+func (r *RedisTokenCache) Flush() error {
+	cursor := "0"
+
+	for {
+		reply, err := r.do("SCAN", cursor, "MATCH", r.Prefix+"*", "COUNT", "100")
+		if err != nil {
+			return err
+		}
+
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return errors.New("redis: unexpected SCAN reply")
+		}
+
+		cursor, _ = page[0].(string)
+		keys, _ := page[1].([]interface{})
+
+		if len(keys) != 0 {
+			args := make([]string, 0, len(keys)+1)
+			args = append(args, "DEL")
+
+			for _, key := range keys {
+				if s, ok := key.(string); ok {
+					args = append(args, s)
+				}
+			}
+
+			if _, err := r.do(args...); err != nil {
+				return err
+			}
+		}
+
+		if cursor == "0" || cursor == "" {
+			return nil
+		}
+	}
+}
+
+// Close closes idle connections to the server.
+func (r *RedisTokenCache) Close() error {
+	for {
+		select {
+		case c := <-r.idle:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (r *RedisTokenCache) timeout() time.Duration {
+	if r.Timeout != 0 {
+		return r.Timeout
+	}
+
+	return 5 * time.Second
+}
+
+// do sends a single command to the server and reads its reply.
+func (r *RedisTokenCache) do(args ...string) (interface{}, error) {
+	c, err := r.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := c.do(r.timeout(), args...)
+
+	if _, ok := err.(redisError); ok || err == nil {
+		r.put(c)
+	} else {
+		c.conn.Close()
+	}
+
+	return reply, err
+}
+
+func (r *RedisTokenCache) conn() (*redisConn, error) {
+	select {
+	case c := <-r.idle:
+		return c, nil
+	default:
+	}
+
+	conn, err := net.DialTimeout("tcp", r.Addr, r.timeout())
+	if err != nil {
+		return nil, err
+	}
+
+	c := &redisConn{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+
+	if r.Password != "" {
+		if _, err := c.do(r.timeout(), "AUTH", r.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if r.DB != 0 {
+		if _, err := c.do(r.timeout(), "SELECT", strconv.Itoa(r.DB)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (r *RedisTokenCache) put(c *redisConn) {
+	select {
+	case r.idle <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+// redisError is an error reply sent by the server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn is a connection speaking the Redis protocol (RESP).
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+
+	w := bufio.NewWriter(c.conn)
+
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	return c.read()
+}
+
+// read reads a single reply. Bulk and simple strings are returned as
+// string, nil bulk strings as nil, integers as int64 and arrays as
+// []interface{}.
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed reply")
+	}
+
+	typ, line := line[0], line[1:len(line)-2]
+
+	switch typ {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, redisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, err
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		p := make([]byte, n+2)
+
+		if _, err := io.ReadFull(c.r, p); err != nil {
+			return nil, err
+		}
+
+		return string(p[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, err
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		values := make([]interface{}, n)
+
+		for i := range values {
+			if values[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+
+		return values, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", typ)
+	}
+}
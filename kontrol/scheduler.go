@@ -0,0 +1,307 @@
+package kontrol
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/koding/kite/v2/protocol"
+)
+
+// HeartbeatStats describes the heartbeats tracked by kontrol.
+type HeartbeatStats struct {
+	Kites     int   // number of kites, which heartbeats are tracked
+	Beats     int64 // number of received heartbeats
+	Updates   int64 // number of storage updates made on heartbeats
+	Failures  int64 // number of failed storage updates
+	Missed    int64 // number of kites, which stopped sending heartbeats
+	Cancelled int64 // number of kites, which disconnected
+	Replaced  int64 // number of registrations replaced by newer ones
+}
+
+// HeartbeatStats gives the statistics of the heartbeats tracked by kontrol.
+func (k *Kontrol) HeartbeatStats() HeartbeatStats {
+	return k.heartbeats.stats()
+}
+
+// heartbeat is a tracked heartbeat of a registered kite.
+type heartbeat struct {
+	kite  *protocol.Kite
+	since time.Time   // when the kite started heartbeating
+	owner interface{} // the registration the heartbeat belongs to, if any
+
+	// update writes the value of the kite to the storage, it's called
+	// on heartbeats every UpdateInterval
+	update func() error
+
+	// missed is called when the kite does not send a heartbeat
+	// in time, after the heartbeat stopped being tracked
+	missed func()
+
+	// guarded by heartbeatScheduler.mu
+	interval time.Duration // current heartbeat interval of the kite
+	last     time.Time     // last heartbeat
+	updated  time.Time     // last storage update
+	deadline time.Time     // when the heartbeat is missed
+	index    int           // index in heartbeatScheduler.queue, -1 if not tracked
+}
+
+// heartbeatScheduler tracks the heartbeats of the registered kites, at most
+// one for each kite ID, with a single timer firing at the nearest deadline.
+type heartbeatScheduler struct {
+	// statistics, accessed atomically, kept first for 64-bit alignment
+	numBeats, numUpdates, numFailures int64
+	numMissed, numCancelled           int64
+	numReplaced                       int64
+
+	delay  time.Duration // compensation added to the heartbeat intervals
+	closed <-chan struct{}
+	once   sync.Once
+	wake   chan struct{}
+
+	mu    sync.Mutex
+	beats map[string]*heartbeat // keyed by kite ID
+	queue heartbeatQueue
+}
+
+func newHeartbeatScheduler(closed <-chan struct{}) *heartbeatScheduler {
+	return &heartbeatScheduler{
+		delay:  HeartbeatDelay,
+		closed: closed,
+		wake:   make(chan struct{}, 1),
+		beats:  make(map[string]*heartbeat),
+	}
+}
+
+// track starts tracking the heartbeat, it replaces the heartbeat of the same
+// kite if there's one already. It tells whether the heartbeat was replaced.
+func (s *heartbeatScheduler) track(h *heartbeat) bool {
+	s.once.Do(func() { go s.run() })
+
+	now := time.Now()
+
+	if h.interval == 0 {
+		h.interval = HeartbeatInterval
+	}
+	if h.since.IsZero() {
+		h.since = now
+	}
+
+	h.last = now
+	h.updated = now // the kite has been just stored
+	h.deadline = now.Add(h.interval + s.delay)
+
+	s.mu.Lock()
+	old, replaced := s.beats[h.kite.ID]
+	if replaced {
+		heap.Remove(&s.queue, old.index)
+	}
+	s.beats[h.kite.ID] = h
+	heap.Push(&s.queue, h)
+	s.mu.Unlock()
+
+	if replaced {
+		atomic.AddInt64(&s.numReplaced, 1)
+	}
+
+	s.notify()
+
+	return replaced
+}
+
+// beat resets the deadline of the kite's heartbeat. It gives nil if the
+// heartbeat is not tracked, and tells whether the kite's value should be
+// written to the storage, which is due when it would not be written for
+// longer than UpdateInterval otherwise.
+func (s *heartbeatScheduler) beat(id string) (h *heartbeat, due bool) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, ok := s.beats[id]
+	if !ok {
+		return nil, false
+	}
+
+	atomic.AddInt64(&s.numBeats, 1)
+
+	h.last = now
+	h.deadline = now.Add(h.interval + s.delay)
+	heap.Fix(&s.queue, h.index)
+
+	if now.Sub(h.updated)+h.interval > UpdateInterval {
+		h.updated = now
+		atomic.AddInt64(&s.numUpdates, 1)
+		return h, true
+	}
+
+	return h, false
+}
+
+// setInterval changes the heartbeat interval of the kite, it tells whether
+// the interval was changed.
+func (s *heartbeatScheduler) setInterval(h *heartbeat, interval time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if h.interval == interval {
+		return false
+	}
+
+	h.interval = interval
+	h.deadline = h.last.Add(interval + s.delay)
+
+	if h.index != -1 {
+		heap.Fix(&s.queue, h.index)
+	}
+
+	// the deadline may have come closer
+	s.notify()
+
+	return true
+}
+
+// cancel stops tracking the heartbeat of the kite, if it belongs to
+// the owner.
+func (s *heartbeatScheduler) cancel(id string, owner interface{}) {
+	s.mu.Lock()
+	h, ok := s.beats[id]
+	if ok && h.owner == owner {
+		heap.Remove(&s.queue, h.index)
+		delete(s.beats, id)
+	}
+	s.mu.Unlock()
+
+	if ok && h.owner == owner {
+		atomic.AddInt64(&s.numCancelled, 1)
+	}
+}
+
+// tracked tells whether the heartbeat of the kite is tracked.
+func (s *heartbeatScheduler) tracked(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.beats[id]
+	return ok
+}
+
+func (s *heartbeatScheduler) stats() HeartbeatStats {
+	s.mu.Lock()
+	kites := len(s.beats)
+	s.mu.Unlock()
+
+	return HeartbeatStats{
+		Kites:     kites,
+		Beats:     atomic.LoadInt64(&s.numBeats),
+		Updates:   atomic.LoadInt64(&s.numUpdates),
+		Failures:  atomic.LoadInt64(&s.numFailures),
+		Missed:    atomic.LoadInt64(&s.numMissed),
+		Cancelled: atomic.LoadInt64(&s.numCancelled),
+		Replaced:  atomic.LoadInt64(&s.numReplaced),
+	}
+}
+
+func (s *heartbeatScheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *heartbeatScheduler) run() {
+	t := time.NewTimer(time.Hour)
+	defer t.Stop()
+
+	for {
+		s.mu.Lock()
+		next := time.Hour
+		if len(s.queue) != 0 {
+			next = time.Until(s.queue[0].deadline)
+		}
+		s.mu.Unlock()
+
+		if !t.Stop() {
+			select {
+			case <-t.C:
+			default:
+			}
+		}
+		t.Reset(next)
+
+		select {
+		case <-s.closed:
+			return
+		case <-s.wake:
+		case now := <-t.C:
+			s.expire(now)
+		}
+	}
+}
+
+// expire stops tracking heartbeats, which missed their deadlines.
+func (s *heartbeatScheduler) expire(now time.Time) {
+	var missed []*heartbeat
+
+	s.mu.Lock()
+	for len(s.queue) != 0 && !s.queue[0].deadline.After(now) {
+		h := heap.Pop(&s.queue).(*heartbeat)
+		delete(s.beats, h.kite.ID)
+		missed = append(missed, h)
+	}
+	s.mu.Unlock()
+
+	atomic.AddInt64(&s.numMissed, int64(len(missed)))
+
+	for _, h := range missed {
+		if h.missed != nil {
+			h.missed()
+		}
+	}
+}
+
+// heartbeatQueue is a heap of heartbeats ordered by their deadlines.
+type heartbeatQueue []*heartbeat
+
+func (q heartbeatQueue) Len() int           { return len(q) }
+func (q heartbeatQueue) Less(i, j int) bool { return q[i].deadline.Before(q[j].deadline) }
+
+func (q heartbeatQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *heartbeatQueue) Push(x interface{}) {
+	h := x.(*heartbeat)
+	h.index = len(*q)
+	*q = append(*q, h)
+}
+
+func (q *heartbeatQueue) Pop() interface{} {
+	old := *q
+	h := old[len(old)-1]
+	old[len(old)-1] = nil
+	h.index = -1
+	*q = old[:len(old)-1]
+	return h
+}
+
+// beat handles a heartbeat of the kite, writing its value to the storage
+// when it's due. It gives nil if the kite's heartbeats are not tracked.
+func (k *Kontrol) beat(id string) *heartbeat {
+	h, due := k.heartbeats.beat(id)
+
+	if due {
+		k.log.Debug("Kite is active, updating the value %s", h.kite)
+
+		if err := h.update(); err != nil {
+			atomic.AddInt64(&k.heartbeats.numFailures, 1)
+			k.log.Error("storage update '%s' error: %s", h.kite, err)
+		}
+	}
+
+	return h
+}
@@ -0,0 +1,96 @@
+package kontrol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/koding/kite/v2/protocol"
+)
+
+func TestHeartbeatScheduler(t *testing.T) {
+	closed := make(chan struct{})
+	defer close(closed)
+
+	s := newHeartbeatScheduler(closed)
+	s.delay = 0
+
+	missed := make(chan string, 4)
+
+	newHeartbeat := func(id string, owner interface{}, interval time.Duration) *heartbeat {
+		return &heartbeat{
+			kite:     &protocol.Kite{ID: id},
+			owner:    owner,
+			interval: interval,
+			update:   func() error { return nil },
+			missed:   func() { missed <- owner.(string) },
+		}
+	}
+
+	// The latest registration of a kite replaces the previous one.
+	s.track(newHeartbeat("foo", "first", 50*time.Millisecond))
+
+	if !s.track(newHeartbeat("foo", "second", 50*time.Millisecond)) {
+		t.Fatal("want heartbeat to be replaced")
+	}
+
+	// Only the owner cancels the heartbeat.
+	s.cancel("foo", "first")
+
+	if h, due := s.beat("foo"); h == nil || h.owner != "second" || due {
+		t.Fatalf("got %v, %t, want heartbeat of the second registration", h, due)
+	}
+
+	select {
+	case owner := <-missed:
+		if owner != "second" {
+			t.Fatalf("got missed heartbeat of %q, want %q", owner, "second")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for missed heartbeat")
+	}
+
+	if s.tracked("foo") {
+		t.Fatal("want missed heartbeat not to be tracked")
+	}
+
+	s.track(newHeartbeat("bar", "bar", 50*time.Millisecond))
+	s.cancel("bar", "bar")
+
+	if s.tracked("bar") {
+		t.Fatal("want cancelled heartbeat not to be tracked")
+	}
+
+	h := newHeartbeat("baz", "baz", UpdateInterval/2)
+	s.track(h)
+
+	s.mu.Lock()
+	h.updated = time.Now().Add(-UpdateInterval)
+	s.mu.Unlock()
+
+	if _, due := s.beat("baz"); !due {
+		t.Fatal("want update to be due")
+	}
+
+	if _, due := s.beat("baz"); due {
+		t.Fatal("want update not to be due")
+	}
+
+	select {
+	case owner := <-missed:
+		t.Fatalf("got unexpected missed heartbeat of %q", owner)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	want := HeartbeatStats{
+		Kites:     1,
+		Beats:     3,
+		Updates:   1,
+		Missed:    1,
+		Cancelled: 1,
+		Replaced:  1,
+	}
+
+	if got := s.stats(); got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
@@ -1,8 +1,11 @@
 package kontrol
 
 import (
-	kontrolprotocol "github.com/koding/kite/kontrol/protocol"
-	"github.com/koding/kite/protocol"
+	"errors"
+	"time"
+
+	kontrolprotocol "github.com/koding/kite/v2/kontrol/protocol"
+	"github.com/koding/kite/v2/protocol"
 )
 
 // Storage is an interface to a kite storage. A storage should be safe to
@@ -23,3 +26,56 @@ type Storage interface {
 	// Upsert inserts or updates the value for the given kite
 	Upsert(kite *protocol.Kite, value *kontrolprotocol.RegisterValue) error
 }
+
+// Pager is implemented by storages, which can page the kites matching
+// a query. For other storages, all the kites are retrieved with Get and
+// the page is taken afterwards.
+type Pager interface {
+	// GetPage retrieves at most limit kites matching the query, ordered
+	// by ID, after skipping the first offset ones. A zero limit means no
+	// limit. It also returns the number of all the matching kites.
+	GetPage(query *protocol.KontrolQuery, offset, limit int) (kites Kites, total int, err error)
+}
+
+// Counter is implemented by storages, which can keep counters shared
+// by kontrol replicas. Kontrol uses them to enforce quotas, for other
+// storages the counters are kept in memory of each replica.
+type Counter interface {
+	// Incr increments the counter with the given key and returns its
+	// new value. The counter expires after the window passes since
+	// its first increment.
+	Incr(key string, window time.Duration) (int64, error)
+}
+
+// BatchUpserter is implemented by storages, which can insert or update
+// many kites in a single round trip. For other storages, the kites are
+// upserted one by one.
+type BatchUpserter interface {
+	// UpsertBatch inserts or updates the values for the given kites,
+	// values[i] being the value of kites[i].
+	UpsertBatch(kites []*protocol.Kite, values []*kontrolprotocol.RegisterValue) error
+}
+
+// upsertBatch upserts the kites with a single UpsertBatch call, if the
+// storage is a BatchUpserter, or with an Upsert call for each kite.
+func upsertBatch(storage Storage, kites []*protocol.Kite, values []*kontrolprotocol.RegisterValue) error {
+	if len(kites) != len(values) {
+		return errors.New("number of kites and values differ")
+	}
+
+	if len(kites) == 0 {
+		return nil
+	}
+
+	if b, ok := storage.(BatchUpserter); ok {
+		return b.UpsertBatch(kites, values)
+	}
+
+	for i, kite := range kites {
+		if err := storage.Upsert(kite, values[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,325 @@
+package kontrol
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/kitekey"
+	"github.com/koding/kite/v2/protocol"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	uuid "github.com/satori/go.uuid"
+)
+
+// tenants maps tenants to their key pairs and key pairs back to
+// their tenants, see AddTenantKeyPair.
+type tenants struct {
+	keys    map[string][]*KeyPair // the last key pair is the current one
+	publics map[string]string     // tenants keyed by public keys
+	ids     map[string]string     // tenants keyed by key pair IDs
+}
+
+// AddTenantKeyPair adds the given key pair and scopes it to the tenant,
+// creating the tenant if it does not exist yet. If id is empty, a unique
+// ID will be generated. The last key pair added for a tenant is used to
+// sign its new kite keys and tokens, the older ones remain valid until
+// they are deleted.
+//
+// Tenants isolate kites of different organizations served by a single
+// kontrol. The tenant of a kite is the tenant of the key pair, which
+// signed its kite key. Kites and tokens are scoped by tenant - queries
+// made by kites of one tenant do not return kites of another and no
+// tokens are issued across tenants. Kites authenticated with keys added
+// with AddKeyPair or AddEnvironmentKeyPair belong to no tenant, they
+// form a separate namespace as well.
+//
+// Tenants are not persisted, they need to be added on each start of
+// kontrol.
+func (k *Kontrol) AddTenantKeyPair(tenant, id, public, private string) error {
+	if tenant == "" {
+		return errors.New("tenant is empty")
+	}
+
+	if k.keyPair == nil {
+		k.log.Warning("Key pair storage is not set. Using in memory cache")
+		k.keyPair = NewMemKeyPairStorage()
+	}
+
+	if id == "" {
+		i, err := uuid.NewV4()
+		if err != nil {
+			return err
+		}
+		id = i.String()
+	}
+
+	keyPair := &KeyPair{
+		ID:      id,
+		Public:  strings.TrimSpace(public),
+		Private: strings.TrimSpace(private),
+	}
+
+	if err := keyPair.Validate(); err != nil {
+		return err
+	}
+
+	if t := k.keyTenant(keyPair.Public); t != "" && t != tenant {
+		return fmt.Errorf("key pair is already scoped to tenant %q", t)
+	}
+
+	if err := k.keyPair.AddKey(keyPair); err != nil {
+		return err
+	}
+
+	k.tenantsMu.Lock()
+	if k.tenants.keys == nil {
+		k.tenants.keys = make(map[string][]*KeyPair)
+		k.tenants.publics = make(map[string]string)
+		k.tenants.ids = make(map[string]string)
+	}
+	k.tenants.keys[tenant] = append(k.tenants.keys[tenant], keyPair)
+	k.tenants.publics[keyPair.Public] = tenant
+	k.tenants.ids[keyPair.ID] = tenant
+	k.tenantsMu.Unlock()
+
+	return nil
+}
+
+// RemoveTenant deletes all key pairs of the tenant. Kite keys and tokens
+// of the tenant are no longer valid and its kites are not allowed
+// to register again.
+func (k *Kontrol) RemoveTenant(tenant string) error {
+	k.tenantsMu.Lock()
+	keys, ok := k.tenants.keys[tenant]
+	delete(k.tenants.keys, tenant)
+	k.tenantsMu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("tenant %q does not exist", tenant)
+	}
+
+	// The keys remain mapped to the tenant, so kites holding them are
+	// not given keys of other tenants on key update.
+	for _, keyPair := range keys {
+		if err := k.keyPair.DeleteKey(keyPair); err != nil && err != ErrKeyDeleted {
+			return err
+		}
+	}
+
+	k.flushTokens()
+
+	return nil
+}
+
+// Tenants gives names of all the tenants, sorted.
+func (k *Kontrol) Tenants() []string {
+	k.tenantsMu.RLock()
+	defer k.tenantsMu.RUnlock()
+
+	tenants := make([]string, 0, len(k.tenants.keys))
+	for tenant := range k.tenants.keys {
+		tenants = append(tenants, tenant)
+	}
+
+	sort.Strings(tenants)
+
+	return tenants
+}
+
+// tenantKeyPair gives the current key pair of the tenant, or nil if
+// the tenant does not exist.
+func (k *Kontrol) tenantKeyPair(tenant string) *KeyPair {
+	k.tenantsMu.RLock()
+	defer k.tenantsMu.RUnlock()
+
+	if keys := k.tenants.keys[tenant]; len(keys) != 0 {
+		return keys[len(keys)-1]
+	}
+
+	return nil
+}
+
+// keyTenant gives the tenant the given public key is scoped to,
+// or empty string if the key is not scoped.
+func (k *Kontrol) keyTenant(public string) string {
+	k.tenantsMu.RLock()
+	defer k.tenantsMu.RUnlock()
+
+	return k.tenants.publics[strings.TrimSpace(public)]
+}
+
+// keyIDTenant gives the tenant the key pair with the given ID is scoped to,
+// or empty string if the key pair is not scoped.
+func (k *Kontrol) keyIDTenant(id string) string {
+	k.tenantsMu.RLock()
+	defer k.tenantsMu.RUnlock()
+
+	return k.tenants.ids[id]
+}
+
+// updateTenantKey gives the current key pair of the tenant, which replaces
+// the no longer valid key pair of the tenant's kite.
+func (k *Kontrol) updateTenantKey(tenant string) (*KeyPair, error) {
+	if keyPair := k.tenantKeyPair(tenant); keyPair != nil {
+		return keyPair, nil
+	}
+
+	return nil, fmt.Errorf("tenant %q does not exist", tenant)
+}
+
+// requestTenant gives the tenant of the kite making the request. The tenant
+// of a kite key is given by the key pair that signed it, the tenant
+// of a token is read from its claims.
+func (k *Kontrol) requestTenant(r *kite.Request) (string, error) {
+	if r.Auth == nil {
+		return "", nil
+	}
+
+	switch r.Auth.Type {
+	case "kiteKey", "token":
+	default:
+		return "", nil
+	}
+
+	// The key was already verified by the authenticator.
+	claims := &kitekey.KiteClaims{}
+
+	if _, _, err := new(jwt.Parser).ParseUnverified(r.Auth.Key, claims); err != nil {
+		return "", err
+	}
+
+	if r.Auth.Type == "token" {
+		return claims.Tenant, nil
+	}
+
+	return k.keyTenant(claims.KontrolKey), nil
+}
+
+// checkTokenTenant returns non-nil error if the kite making the request
+// belongs to a tenant other than the one of the key pair.
+func (k *Kontrol) checkTokenTenant(r *kite.Request, keyPair *KeyPair) error {
+	tenant, err := k.requestTenant(r)
+	if err != nil {
+		return err
+	}
+
+	if keyTenant := k.keyTenant(keyPair.Public); keyTenant != tenant {
+		return errors.New("kite belongs to a different tenant")
+	}
+
+	return nil
+}
+
+// HandleCreateTenant creates a tenant, or adds a new key pair to an
+// existing one. If the key pair is not given, a new one is generated.
+// When the username is given, a kite key of the user is issued for
+// the tenant, which is used to bootstrap its kites.
+//
+// The requests are authorized with Kontrol.AdminAuthenticate.
+func (k *Kontrol) HandleCreateTenant(r *kite.Request) (interface{}, error) {
+	if err := k.authenticateAdmin(r); err != nil {
+		k.log.Error("create tenant authentication error: %s", err)
+
+		return nil, fmt.Errorf("cannot authenticate user: %s", err)
+	}
+
+	var args protocol.CreateTenantArgs
+
+	if err := r.Args.One().Unmarshal(&args); err != nil {
+		return nil, fmt.Errorf("invalid argument: %s", err)
+	}
+
+	if args.Tenant == "" {
+		return nil, errors.New("tenant is required")
+	}
+
+	if (args.Public == "") != (args.Private == "") {
+		return nil, errors.New("both public and private keys are required")
+	}
+
+	if args.Public == "" {
+		var err error
+		if args.Public, args.Private, err = generateKeyPair(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := k.AddTenantKeyPair(args.Tenant, args.ID, args.Public, args.Private); err != nil {
+		return nil, err
+	}
+
+	keyPair := k.tenantKeyPair(args.Tenant)
+
+	res := &protocol.CreateTenantResult{
+		ID:     keyPair.ID,
+		Public: keyPair.Public,
+	}
+
+	if args.Username != "" {
+		var err error
+		if res.KiteKey, err = k.registerUser(args.Username, keyPair.Public, keyPair.Private); err != nil {
+			return nil, err
+		}
+	}
+
+	k.log.Info("Created key pair %q of tenant %q on request of %q", keyPair.ID, args.Tenant, r.Username)
+
+	return res, nil
+}
+
+// HandleRemoveTenant removes the tenant and all of its key pairs.
+//
+// The requests are authorized with Kontrol.AdminAuthenticate.
+func (k *Kontrol) HandleRemoveTenant(r *kite.Request) (interface{}, error) {
+	if err := k.authenticateAdmin(r); err != nil {
+		k.log.Error("remove tenant authentication error: %s", err)
+
+		return nil, fmt.Errorf("cannot authenticate user: %s", err)
+	}
+
+	var args protocol.RemoveTenantArgs
+
+	if err := r.Args.One().Unmarshal(&args); err != nil {
+		return nil, fmt.Errorf("invalid argument: %s", err)
+	}
+
+	if err := k.RemoveTenant(args.Tenant); err != nil {
+		return nil, err
+	}
+
+	k.log.Info("Removed tenant %q on request of %q", args.Tenant, r.Username)
+
+	return nil, nil
+}
+
+// generateKeyPair generates a new RSA key pair, encoded in PEM blocks.
+func generateKeyPair() (public, private string, err error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", "", err
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	public = string(pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: pub,
+	}))
+
+	private = string(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}))
+
+	return public, private, nil
+}
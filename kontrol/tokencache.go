@@ -0,0 +1,122 @@
+package kontrol
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrTokenNotFound is returned by TokenCache when there's no token
+// cached for the given key.
+var ErrTokenNotFound = errors.New("token not found")
+
+// TokenCache caches tokens signed by kontrol, so the same token is
+// returned for the same audience, user and key pair until it expires.
+//
+// A TokenCache that is shared between kontrol instances, like
+// the RedisTokenCache, makes horizontally scaled kontrols return
+// consistent tokens.
+//
+// If the implementation has a Flush() error method, it is used
+// to invalidate all tokens when kontrol is asked to refresh keys.
+type TokenCache interface {
+	// Get gives the token cached under the given key. If there's none,
+	// it returns ErrTokenNotFound.
+	Get(key string) (string, error)
+
+	// Set caches the token under the given key for the ttl duration.
+	Set(key, token string, ttl time.Duration) error
+
+	// Delete removes the token cached under the given key.
+	Delete(key string) error
+}
+
+// MemoryTokenCache is an in-memory TokenCache. It's used by default.
+type MemoryTokenCache struct {
+	mu     sync.Mutex
+	tokens map[string]cachedToken
+}
+
+var _ TokenCache = (*MemoryTokenCache)(nil)
+
+type cachedToken struct {
+	signed string
+	timer  *time.Timer
+}
+
+// NewMemoryTokenCache gives new, empty MemoryTokenCache.
+func NewMemoryTokenCache() *MemoryTokenCache {
+	return &MemoryTokenCache{
+		tokens: make(map[string]cachedToken),
+	}
+}
+
+// Get implements the TokenCache interface.
+func (m *MemoryTokenCache) Get(key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ct, ok := m.tokens[key]
+	if !ok {
+		return "", ErrTokenNotFound
+	}
+
+	return ct.signed, nil
+}
+
+// Set implements the TokenCache interface.
+//
+// If the token already exists in the cache, it's overwritten
+// with a new value.
+func (m *MemoryTokenCache) Set(key, token string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if ct, ok := m.tokens[key]; ok {
+		ct.timer.Stop()
+	}
+
+	var ct cachedToken
+
+	ct = cachedToken{
+		signed: token,
+		timer: time.AfterFunc(ttl, func() {
+			m.mu.Lock()
+			if cur, ok := m.tokens[key]; ok && cur.timer == ct.timer {
+				delete(m.tokens, key)
+			}
+			m.mu.Unlock()
+		}),
+	}
+
+	m.tokens[key] = ct
+
+	return nil
+}
+
+// Delete implements the TokenCache interface.
+func (m *MemoryTokenCache) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if ct, ok := m.tokens[key]; ok {
+		ct.timer.Stop()
+		delete(m.tokens, key)
+	}
+
+	return nil
+}
+
+// Flush removes all cached tokens.
+func (m *MemoryTokenCache) Flush() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, ct := range m.tokens {
+		ct.timer.Stop()
+	}
+
+	m.tokens = make(map[string]cachedToken)
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package kontrol
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func testTokenCache(t *testing.T, c TokenCache) {
+	if _, err := c.Get("foo"); err != ErrTokenNotFound {
+		t.Fatalf("got %v, want %v", err, ErrTokenNotFound)
+	}
+
+	if err := c.Set("foo", "token1", time.Minute); err != nil {
+		t.Fatalf("Set()=%s", err)
+	}
+
+	if err := c.Set("bar", "token2", 100*time.Millisecond); err != nil {
+		t.Fatalf("Set()=%s", err)
+	}
+
+	if tok, err := c.Get("foo"); err != nil || tok != "token1" {
+		t.Fatalf("got %q, %v, want %q", tok, err, "token1")
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	if _, err := c.Get("bar"); err != ErrTokenNotFound {
+		t.Fatalf("got %v, want %v", err, ErrTokenNotFound)
+	}
+
+	if err := c.Delete("foo"); err != nil {
+		t.Fatalf("Delete()=%s", err)
+	}
+
+	if _, err := c.Get("foo"); err != ErrTokenNotFound {
+		t.Fatalf("got %v, want %v", err, ErrTokenNotFound)
+	}
+}
+
+func TestMemoryTokenCache(t *testing.T) {
+	testTokenCache(t, NewMemoryTokenCache())
+}
+
+func TestRedisTokenCache(t *testing.T) {
+	addr := os.Getenv("KONTROL_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("KONTROL_REDIS_ADDR is not set")
+	}
+
+	c := NewRedisTokenCache(addr)
+	c.Prefix = "kontrol:test:"
+	defer c.Close()
+
+	testTokenCache(t, c)
+
+	if err := c.Set("foo", "token", time.Minute); err != nil {
+		t.Fatalf("Set()=%s", err)
+	}
+
+	if err := c.Flush(); err != nil {
+		t.Fatalf("Flush()=%s", err)
+	}
+
+	if _, err := c.Get("foo"); err != ErrTokenNotFound {
+		t.Fatalf("got %v, want %v", err, ErrTokenNotFound)
+	}
+}
@@ -7,11 +7,13 @@ import (
 	"math/rand"
 	"net/url"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/koding/kite/dnode"
-	"github.com/koding/kite/protocol"
+	"github.com/koding/kite/v2/dnode"
+	"github.com/koding/kite/v2/protocol"
+	"github.com/koding/kite/v2/sockjsclient"
 )
 
 const (
@@ -40,6 +42,11 @@ type kontrolClient struct {
 
 	// registerChan registers the url's it receives from the channel to Kontrol
 	registerChan chan *url.URL
+
+	// methodsChanged is signaled when a method is registered, so the methods
+	// published to kontrol are updated once the kite is registered.
+	methodsChanged chan struct{}
+	oncePublishing sync.Once
 }
 
 type registerResult struct {
@@ -74,6 +81,10 @@ func (k *Kite) SetupKontrolClient() error {
 		k.Log.Info("Connected to Kontrol")
 		k.Log.Debug("Connected to Kontrol with session %q", client.session.ID())
 
+		if ws, ok := client.getSession().(*sockjsclient.WebsocketSession); ok && ws.Response() != nil {
+			k.checkClockSkew(k.Config.KontrolURL, ws.Response().Header)
+		}
+
 		// try to re-register on connect
 		k.kontrol.Lock()
 		if k.kontrol.lastRegisteredURL != nil {
@@ -106,6 +117,9 @@ func (k *Kite) SetupKontrolClient() error {
 // with Client.Dial() before using each Kite. An error is returned when no
 // kites are available.
 //
+// If kontrol is unreachable and Kite.Discovery is set, the kites
+// are discovered with it instead.
+//
 // The returned clients have token renewer running, which is leaked
 // when a single *Client is not closed. A handy utility to ease closing
 // the clients is a Close function:
@@ -126,7 +140,7 @@ func (k *Kite) GetKites(query *protocol.KontrolQuery) ([]*Client, error) {
 		return nil, err
 	}
 
-	clients, err := k.getKites(protocol.GetKitesArgs{Query: query})
+	clients, err := k.getKitesOrDiscover(query)
 	if err != nil {
 		return nil, err
 	}
@@ -135,14 +149,45 @@ func (k *Kite) GetKites(query *protocol.KontrolQuery) ([]*Client, error) {
 		return nil, ErrNoKitesAvailable
 	}
 
-	return clients, nil
+	return k.preferLocal(clients), nil
+}
+
+// preferLocal gives the clients that are in the same environment and
+// region as the local kite, as configured with Config.PreferEnvironment
+// and Config.PreferRegion. If there is no such client, all clients are
+// returned. The clients that were filtered out are closed.
+func (k *Kite) preferLocal(clients []*Client) []*Client {
+	if !k.Config.PreferEnvironment && !k.Config.PreferRegion {
+		return clients
+	}
+
+	var preferred, rest []*Client
+
+	for _, c := range clients {
+		switch {
+		case k.Config.PreferEnvironment && c.Kite.Environment != k.Config.Environment:
+			rest = append(rest, c)
+		case k.Config.PreferRegion && c.Kite.Region != k.Config.Region:
+			rest = append(rest, c)
+		default:
+			preferred = append(preferred, c)
+		}
+	}
+
+	if len(preferred) == 0 {
+		return clients
+	}
+
+	Close(rest)
+
+	return preferred
 }
 
 // used internally for GetKites() and WatchKites()
 func (k *Kite) getKites(args protocol.GetKitesArgs) ([]*Client, error) {
 	<-k.kontrol.readyConnected
 
-	response, err := k.kontrol.TellWithTimeout("getKites", k.Config.Timeout, args)
+	response, err := k.kontrol.TellWithTimeout("getKites", k.config().Timeout, args)
 	if err != nil {
 		return nil, err
 	}
@@ -174,12 +219,148 @@ func (k *Kite) getKites(args protocol.GetKitesArgs) ([]*Client, error) {
 		}
 
 		token.RenewWhenExpires()
-		c.closeRenewer = token.disconnect
 	}
 
 	return clients, nil
 }
 
+// GetNearestKite returns a client of a single kite matching the query,
+// preferably one from the region of the local kite, see Config.Region.
+// If there is no such kite, a kite from other region is returned.
+// An error is returned when no kites are available.
+//
+// As with GetKites, the client must be dialed and closed by the caller.
+func (k *Kite) GetNearestKite(query *protocol.KontrolQuery) (*Client, error) {
+	if err := k.SetupKontrolClient(); err != nil {
+		return nil, err
+	}
+
+	clients, err := k.getKites(protocol.GetKitesArgs{
+		Query:        query,
+		PreferRegion: k.Config.Region,
+		MaxResults:   1,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(clients) == 0 {
+		return nil, ErrNoKitesAvailable
+	}
+
+	// Older kontrols ignore the region preference and the limit.
+	nearest := 0
+	for i, c := range clients {
+		if c.Kite.Region == k.Config.Region {
+			nearest = i
+			break
+		}
+	}
+
+	c := clients[nearest]
+	clients = append(clients[:nearest], clients[nearest+1:]...)
+
+	if len(clients) != 0 {
+		Close(clients)
+	}
+
+	return c, nil
+}
+
+// ListKites returns the kites matching the query as they are stored in
+// Kontrol, without creating clients for them. It's meant for discovery,
+// where args can page the kites, limit their fields and skip generation
+// of tokens, see protocol.GetKitesArgs.
+func (k *Kite) ListKites(args *protocol.GetKitesArgs) (*protocol.GetKitesResult, error) {
+	if err := k.SetupKontrolClient(); err != nil {
+		return nil, err
+	}
+
+	<-k.kontrol.readyConnected
+
+	response, err := k.kontrol.TellWithTimeout("getKites", k.config().Timeout, args)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &protocol.GetKitesResult{}
+
+	if err := response.Unmarshal(result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// GetMethods returns the kites matching the query along with the methods
+// they published to Kontrol, which are the names of their methods except
+// the "kite." builtins. The kites are returned without tokens.
+func (k *Kite) GetMethods(query *protocol.KontrolQuery) ([]*protocol.KiteWithToken, error) {
+	if err := k.SetupKontrolClient(); err != nil {
+		return nil, err
+	}
+
+	<-k.kontrol.readyConnected
+
+	args := &protocol.GetKitesArgs{
+		Query: query,
+	}
+
+	response, err := k.kontrol.TellWithTimeout("kite.methods", k.config().Timeout, args)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &protocol.GetKitesResult{}
+
+	if err := response.Unmarshal(result); err != nil {
+		return nil, err
+	}
+
+	return result.Kites, nil
+}
+
+// publishedMethods gives the methods of the kite published to Kontrol.
+func (k *Kite) publishedMethods() []string {
+	var methods []string
+
+	for _, method := range k.Methods() {
+		if !strings.HasPrefix(method, "kite.") {
+			methods = append(methods, method)
+		}
+	}
+
+	return methods
+}
+
+// methodsChanged signals the methods publisher, it does not block.
+func (k *Kite) methodsChanged() {
+	select {
+	case k.kontrol.methodsChanged <- struct{}{}:
+	default:
+	}
+}
+
+// publishMethods updates the methods published to Kontrol whenever
+// a method is registered, until the kite is closed.
+func (k *Kite) publishMethods() {
+	for {
+		select {
+		case <-k.closeC:
+			return
+		case <-k.kontrol.methodsChanged:
+		}
+
+		args := &protocol.UpdateMethodsArgs{
+			Methods: k.publishedMethods(),
+		}
+
+		if _, err := k.kontrol.TellWithTimeout("updateMethods", k.config().Timeout, args); err != nil {
+			k.Log.Warning("Cannot update methods published to Kontrol: %s", err)
+		}
+	}
+}
+
 // GetToken is used to get a token for a single Kite.
 //
 // In case of calling GetToken multiple times, it usually
@@ -191,7 +372,30 @@ func (k *Kite) GetToken(kite *protocol.Kite) (string, error) {
 
 	<-k.kontrol.readyConnected
 
-	result, err := k.kontrol.TellWithTimeout("getToken", k.Config.Timeout, kite)
+	result, err := k.kontrol.TellWithTimeout("getToken", k.config().Timeout, kite)
+	if err != nil {
+		return "", err
+	}
+
+	var tkn string
+	err = result.Unmarshal(&tkn)
+	if err != nil {
+		return "", err
+	}
+
+	return tkn, nil
+}
+
+// GetTokenByID is used to fetch the token with the given ID from Kontrol.
+// Only tokens issued for the Kite can be fetched.
+func (k *Kite) GetTokenByID(id string) (string, error) {
+	if err := k.SetupKontrolClient(); err != nil {
+		return "", err
+	}
+
+	<-k.kontrol.readyConnected
+
+	result, err := k.kontrol.TellWithTimeout("getTokenByID", k.config().Timeout, &protocol.GetTokenByIDArgs{ID: id})
 	if err != nil {
 		return "", err
 	}
@@ -205,6 +409,126 @@ func (k *Kite) GetToken(kite *protocol.Kite) (string, error) {
 	return tkn, nil
 }
 
+// DelegateToken is used to get a short-lived token for the kite matching
+// the query, which authenticates calls as made by the given user. Kontrol
+// must authorize the Kite to act on behalf of the user.
+func (k *Kite) DelegateToken(query *protocol.KontrolQuery, username string) (string, error) {
+	if err := k.SetupKontrolClient(); err != nil {
+		return "", err
+	}
+
+	<-k.kontrol.readyConnected
+
+	args := &protocol.DelegateTokenArgs{
+		Query:    query,
+		Username: username,
+	}
+
+	result, err := k.kontrol.TellWithTimeout("delegateToken", k.config().Timeout, args)
+	if err != nil {
+		return "", err
+	}
+
+	var tkn string
+	err = result.Unmarshal(&tkn)
+	if err != nil {
+		return "", err
+	}
+
+	return tkn, nil
+}
+
+// GetTokens is used to obtain tokens for many kites with a single
+// request to Kontrol. Tokens are returned in the same order as the kites.
+//
+// If a token could not be obtained for some of the kites, their tokens
+// are empty and the returned error describes the failures.
+func (k *Kite) GetTokens(kites []*protocol.Kite) ([]string, error) {
+	if err := k.SetupKontrolClient(); err != nil {
+		return nil, err
+	}
+
+	<-k.kontrol.readyConnected
+
+	args := &protocol.GetTokensArgs{
+		Queries: make([]*protocol.KontrolQuery, len(kites)),
+	}
+
+	for i, kite := range kites {
+		args.Queries[i] = kite.Query()
+	}
+
+	result, err := k.kontrol.TellWithTimeout("getTokens", k.config().Timeout, args)
+	if err != nil {
+		return nil, err
+	}
+
+	var res protocol.GetTokensResult
+	if err := result.Unmarshal(&res); err != nil {
+		return nil, err
+	}
+
+	if len(res.Tokens) != len(kites) {
+		return nil, fmt.Errorf("got %d tokens for %d kites", len(res.Tokens), len(kites))
+	}
+
+	var failed []string
+	tokens := make([]string, len(kites))
+
+	for i, tok := range res.Tokens {
+		if tok == nil || tok.Error != "" {
+			msg := "no token"
+			if tok != nil {
+				msg = tok.Error
+			}
+
+			failed = append(failed, fmt.Sprintf("%s: %s", kites[i], msg))
+			continue
+		}
+
+		tokens[i] = tok.Token
+	}
+
+	if len(failed) != 0 {
+		return tokens, fmt.Errorf("failed to get tokens for %d kites: %s", len(failed), strings.Join(failed, "; "))
+	}
+
+	return tokens, nil
+}
+
+// RegisterKites registers many kites to Kontrol with a single request,
+// e.g. by a fleet manager. Each kite is registered as with RegisterHTTP,
+// so it authenticates with its own kite key given in args, and it must
+// send heartbeats to Kontrol's "/heartbeat" endpoint to stay registered.
+//
+// Results are returned in the same order as the args, a result of a kite
+// that failed to register has its Error set.
+func (k *Kite) RegisterKites(args []*protocol.RegisterArgs) ([]*protocol.RegisterResult, error) {
+	if err := k.SetupKontrolClient(); err != nil {
+		return nil, err
+	}
+
+	<-k.kontrol.readyConnected
+
+	result, err := k.kontrol.TellWithTimeout("registerKites", k.config().Timeout, &protocol.RegisterKitesArgs{
+		Kites: args,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var res protocol.RegisterKitesResult
+	if err := result.Unmarshal(&res); err != nil {
+		return nil, err
+	}
+
+	if len(res.Results) != len(args) {
+		return nil, fmt.Errorf("got %d results for %d kites", len(res.Results), len(args))
+	}
+
+	return res.Results, nil
+}
+
 // SendWebRTCRequest sends requests to kontrol for signalling purposes.
 func (k *Kite) SendWebRTCRequest(req *protocol.WebRTCSignalMessage) error {
 	if err := k.SetupKontrolClient(); err != nil {
@@ -213,7 +537,7 @@ func (k *Kite) SendWebRTCRequest(req *protocol.WebRTCSignalMessage) error {
 
 	<-k.kontrol.readyConnected
 
-	_, err := k.kontrol.TellWithTimeout(WebRTCHandlerName, k.Config.Timeout, req)
+	_, err := k.kontrol.TellWithTimeout(WebRTCHandlerName, k.config().Timeout, req)
 	return err
 }
 
@@ -233,7 +557,7 @@ func (k *Kite) GetTokenForce(kite *protocol.Kite) (string, error) {
 		Force:        true,
 	}
 
-	result, err := k.kontrol.TellWithTimeout("getToken", k.Config.Timeout, args)
+	result, err := k.kontrol.TellWithTimeout("getToken", k.config().Timeout, args)
 	if err != nil {
 		return "", err
 	}
@@ -258,7 +582,7 @@ func (k *Kite) GetKey() (string, error) {
 
 	<-k.kontrol.readyConnected
 
-	result, err := k.kontrol.TellWithTimeout("getKey", k.Config.Timeout)
+	result, err := k.kontrol.TellWithTimeout("getKey", k.config().Timeout)
 	if err != nil {
 		return "", err
 	}
@@ -276,6 +600,57 @@ func (k *Kite) GetKey() (string, error) {
 	return key, nil
 }
 
+// handleRefreshKey is called by kontrol after its keys were rotated.
+// It fetches the current kontrol key and registers again to get
+// a kite key signed with it.
+func (k *Kite) handleRefreshKey(r *Request) (interface{}, error) {
+	k.kontrol.Lock()
+	kontrol, u := k.kontrol.Client, k.kontrol.lastRegisteredURL
+	k.kontrol.Unlock()
+
+	if kontrol == nil || r.Client != kontrol {
+		return nil, errors.New("key refresh can be requested by kontrol only")
+	}
+
+	go func() {
+		if _, err := k.GetKey(); err != nil {
+			k.Log.Warning("Key refresh failed: %s", err)
+		}
+
+		if u != nil {
+			select {
+			case k.kontrol.registerChan <- u:
+			default:
+			}
+		}
+	}()
+
+	return nil, nil
+}
+
+// handleDisplaced is called by kontrol after another kite registered
+// with the ID of this kite from a different URL.
+func (k *Kite) handleDisplaced(r *Request) (interface{}, error) {
+	k.kontrol.Lock()
+	kontrol := k.kontrol.Client
+	k.kontrol.Unlock()
+
+	if kontrol == nil || r.Client != kontrol {
+		return nil, errors.New("displacement can be notified by kontrol only")
+	}
+
+	var args protocol.DisplacedArgs
+	if err := r.Args.One().Unmarshal(&args); err != nil {
+		return nil, err
+	}
+
+	k.Log.Warning("Registration was replaced by a kite registered with %s", args.URL)
+
+	go k.callOnDisplacedHandlers(&args)
+
+	return nil, nil
+}
+
 // NewKeyRenewer renews the internal key every given interval
 func (k *Kite) NewKeyRenewer(interval time.Duration) {
 	ticker := time.NewTicker(interval)
@@ -360,13 +735,21 @@ func (k *Kite) Register(kiteURL *url.URL) (*registerResult, error) {
 
 	<-k.kontrol.readyConnected
 
+	// The methods registered so far are published with the registration.
+	select {
+	case <-k.kontrol.methodsChanged:
+	default:
+	}
+
 	args := protocol.RegisterArgs{
-		URL: kiteURL.String(),
+		URL:     kiteURL.String(),
+		Methods: k.publishedMethods(),
+		Labels:  k.Config.Labels,
 	}
 
 	k.Log.Info("Registering to kontrol with URL: %s", kiteURL.String())
 
-	response, err := k.kontrol.TellWithTimeout("register", k.Config.Timeout, args)
+	response, err := k.kontrol.TellWithTimeout("register", k.config().Timeout, args)
 	if err != nil {
 		return nil, err
 	}
@@ -387,6 +770,8 @@ func (k *Kite) Register(kiteURL *url.URL) (*registerResult, error) {
 
 	k.callOnRegisterHandlers(&rr)
 
+	k.kontrol.oncePublishing.Do(func() { go k.publishMethods() })
+
 	return &registerResult{parsed}, nil
 }
 
@@ -485,7 +870,7 @@ func (k *Kite) registerToProxyKite(c *Client, kiteURL *url.URL) (*url.URL, error
 
 	// this could be tunnelproxy or reverseproxy. Tunnelproxy doesn't need an
 	// URL however Reverseproxy needs one.
-	result, err := c.TellWithTimeout("register", k.Config.Timeout, kiteURL.String())
+	result, err := c.TellWithTimeout("register", k.config().Timeout, kiteURL.String())
 	if err != nil {
 		k.Log.Error("Proxy register error: %s", err.Error())
 		return nil, err
@@ -514,14 +899,16 @@ func (k *Kite) TellKontrolWithTimeout(method string, timeout time.Duration, args
 		return nil, err
 	}
 
+	connectTimeout := k.config().Timeout
+
 	// Wait for readyConnect, or timeout
 	select {
-	case <-time.After(k.Config.Timeout):
+	case <-time.After(connectTimeout):
 		return nil, &Error{
 			Type: "timeout",
 			Message: fmt.Sprintf(
 				"Timed out registering to kontrol for %s method after %s",
-				method, k.Config.Timeout,
+				method, connectTimeout,
 			),
 		}
 	case <-k.kontrol.readyConnected:
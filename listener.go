@@ -0,0 +1,133 @@
+package kite
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// errListenerClosed is returned by Accept of a closed GracefulListener.
+var errListenerClosed = errors.New("use of closed network connection")
+
+// GracefulListener is a net.Listener which keeps track of the accepted
+// connections and closes them upon Close, to ensure no dangling
+// websocket/xhr sessions outlive the server.
+//
+// It is used by kites, and can be used by servers embedding kites or
+// by proxies to coordinate their shutdown.
+type GracefulListener struct {
+	net.Listener
+
+	// DrainTimeout is the time Close waits for the active connections
+	// to be closed by their owners, before closing them forcibly.
+	//
+	// If zero, the connections are closed immediately.
+	DrainTimeout time.Duration
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	idle   chan struct{} // closed when the last connection is closed
+	closed bool
+}
+
+// NewGracefulListener gives new GracefulListener which accepts
+// connections from l.
+func NewGracefulListener(l net.Listener) *GracefulListener {
+	return &GracefulListener{
+		Listener: l,
+		conns:    make(map[net.Conn]struct{}),
+	}
+}
+
+// Accept implements the net.Listener interface.
+func (l *GracefulListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		conn.Close()
+		return nil, errListenerClosed
+	}
+	l.conns[conn] = struct{}{}
+	l.mu.Unlock()
+
+	return &gracefulConn{
+		Conn: conn,
+		l:    l,
+	}, nil
+}
+
+// ActiveConns gives the number of accepted connections, which are
+// not closed yet.
+func (l *GracefulListener) ActiveConns() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.conns)
+}
+
+// Close stops accepting new connections, waits up to DrainTimeout for
+// the active connections to be closed and closes the remaining ones.
+func (l *GracefulListener) Close() error {
+	err := l.Listener.Close()
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return err
+	}
+	l.closed = true
+
+	var idle chan struct{}
+	if l.DrainTimeout > 0 && len(l.conns) != 0 {
+		idle = make(chan struct{})
+		l.idle = idle
+	}
+	l.mu.Unlock()
+
+	if idle != nil {
+		select {
+		case <-idle:
+		case <-time.After(l.DrainTimeout):
+		}
+	}
+
+	l.mu.Lock()
+	conns := l.conns
+	l.conns = make(map[net.Conn]struct{})
+	l.idle = nil
+	l.mu.Unlock()
+
+	for conn := range conns {
+		conn.Close()
+	}
+
+	return err
+}
+
+func (l *GracefulListener) remove(conn net.Conn) {
+	l.mu.Lock()
+	delete(l.conns, conn)
+	if len(l.conns) == 0 && l.idle != nil {
+		close(l.idle)
+		l.idle = nil
+	}
+	l.mu.Unlock()
+}
+
+type gracefulConn struct {
+	net.Conn
+
+	l *GracefulListener
+}
+
+func (c *gracefulConn) Close() error {
+	c.l.remove(c.Conn)
+
+	return c.Conn.Close()
+}
@@ -0,0 +1,71 @@
+package kite
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGracefulListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen()=%s", err)
+	}
+
+	gl := NewGracefulListener(l)
+	gl.DrainTimeout = 5 * time.Second
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := gl.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial()=%s", err)
+		}
+		defer c.Close()
+
+		conns = append(conns, <-accepted)
+	}
+
+	if n := gl.ActiveConns(); n != 2 {
+		t.Fatalf("got %d active connections, want 2", n)
+	}
+
+	conns[0].Close()
+
+	if n := gl.ActiveConns(); n != 1 {
+		t.Fatalf("got %d active connections, want 1", n)
+	}
+
+	// The last connection is closed by its owner while draining.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		conns[1].Close()
+	}()
+
+	start := time.Now()
+
+	gl.Close()
+
+	if d := time.Since(start); d > gl.DrainTimeout/2 {
+		t.Fatalf("Close took %s, want it to return after connections are closed", d)
+	}
+
+	if n := gl.ActiveConns(); n != 0 {
+		t.Fatalf("got %d active connections, want 0", n)
+	}
+
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Fatal("expected listener to be closed")
+	}
+}
@@ -44,7 +44,13 @@ type Logger interface {
 // environment. It returns Info by default if no environment variable
 // is set.
 func getLogLevel() Level {
-	switch strings.ToUpper(os.Getenv("KITE_LOG_LEVEL")) {
+	return parseLevel(os.Getenv("KITE_LOG_LEVEL"))
+}
+
+// parseLevel converts the level name into a Level value. It returns
+// INFO for unknown names.
+func parseLevel(s string) Level {
+	switch strings.ToUpper(s) {
 	case "DEBUG":
 		return DEBUG
 	case "WARNING":
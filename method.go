@@ -1,10 +1,14 @@
 package kite
 
 import (
+	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/juju/ratelimit"
+	"github.com/koding/cache"
 )
 
 // MethodHandling defines how to handle chaining of kite.Handler middlewares.
@@ -61,6 +65,9 @@ type Method struct {
 	// the given auth type in the request.
 	authenticate bool
 
+	// group is used to look up the trust policy of the method.
+	group string
+
 	// handling defines how to handle chaining of kite.Handler middlewares.
 	handling MethodHandling
 
@@ -71,7 +78,23 @@ type Method struct {
 	// bucket is used for throttling the method by certain rule
 	bucket *ratelimit.Bucket
 
-	mu sync.Mutex // protects handler slices
+	// limiter is used for throttling the method for each caller separately
+	limiter *identityLimiter
+
+	// slots limits the handlers of the method running at once, maxQueued
+	// is the number of requests allowed to wait for a slot
+	slots     chan struct{}
+	maxQueued int32
+	queued    int32 // accessed atomically
+
+	// cache holds results of the method if caching is enabled
+	cache       *cache.MemoryTTL
+	cacheTTL    time.Duration
+	cacheKey    CacheKeyFunc
+	invalidates []*Method // methods which caches are invalidated by this one
+	cacheMu     sync.Mutex
+
+	mu sync.Mutex // protects handler slices, bucket, limiter and slots
 }
 
 // addHandle is an internal method to add a handler
@@ -88,10 +111,38 @@ func (k *Kite) addHandle(method string, handler Handler) *Method {
 		handling:     k.MethodHandling,
 	}
 
+	k.methodsMu.Lock()
 	k.handlers[method] = m
+	k.methodsMu.Unlock()
+
+	k.methodsChanged()
+
 	return m
 }
 
+// method gives the registered method of the given name.
+func (k *Kite) method(name string) (*Method, bool) {
+	k.methodsMu.RLock()
+	defer k.methodsMu.RUnlock()
+
+	m, ok := k.handlers[name]
+	return m, ok
+}
+
+// Methods gives the sorted names of the registered methods.
+func (k *Kite) Methods() []string {
+	k.methodsMu.RLock()
+	methods := make([]string, 0, len(k.handlers))
+	for name := range k.handlers {
+		methods = append(methods, name)
+	}
+	k.methodsMu.RUnlock()
+
+	sort.Strings(methods)
+
+	return methods
+}
+
 // DisableAuthentication disables authentication check for this method.
 func (m *Method) DisableAuthentication() *Method {
 	m.authenticate = false
@@ -109,6 +160,9 @@ func (m *Method) DisableAuthentication() *Method {
 // example to have throttle with 30 req/second, you need to have a fillinterval
 // of 33.33 milliseconds.
 func (m *Method) Throttle(fillInterval time.Duration, capacity int64) *Method {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	// don't do anything if the bucket is initialized already
 	if m.bucket != nil {
 		return m
@@ -122,6 +176,267 @@ func (m *Method) Throttle(fillInterval time.Duration, capacity int64) *Method {
 	return m
 }
 
+// setThrottle replaces the bucket of the method, as opposed to Throttle,
+// which keeps the existing one. A non-positive capacity disables throttling.
+func (m *Method) setThrottle(fillInterval time.Duration, capacity int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if capacity <= 0 || fillInterval <= 0 {
+		m.bucket = nil
+		return
+	}
+
+	m.bucket = ratelimit.NewBucket(fillInterval, capacity)
+}
+
+// ThrottleKeyFunc gives the identity of the caller, which the request
+// is throttled for.
+type ThrottleKeyFunc func(*Request) string
+
+// ThrottleByUsername throttles requests of each user separately.
+func ThrottleByUsername(r *Request) string {
+	return r.Username
+}
+
+// ThrottleByKiteID throttles requests of each remote kite separately.
+func ThrottleByKiteID(r *Request) string {
+	return r.Client.Kite.ID
+}
+
+// ThrottleBy throttles the method separately for each caller, identified
+// by the key given by keyFunc, so a single noisy caller does not starve
+// the other ones. Each caller gets its own token bucket, see Throttle for
+// the meaning of fillInterval and capacity. The capacity is the number
+// of requests a caller can burst with.
+//
+// Buckets of callers, which have not called the method for the idle
+// duration, are evicted. A non-positive idle defaults to the time
+// the bucket takes to fill up completely, after which an evicted bucket
+// is no different from a new one.
+//
+// ThrottleBy can be used together with Throttle, in which case a request
+// must be allowed by both of them.
+func (m *Method) ThrottleBy(keyFunc ThrottleKeyFunc, fillInterval time.Duration, capacity int64, idle time.Duration) *Method {
+	if idle <= 0 {
+		idle = fillInterval * time.Duration(capacity)
+	}
+
+	l := &identityLimiter{
+		key:          keyFunc,
+		fillInterval: fillInterval,
+		capacity:     capacity,
+		buckets:      cache.NewMemoryWithTTL(idle),
+	}
+
+	l.buckets.StartGC(idle)
+
+	m.mu.Lock()
+	if m.limiter != nil {
+		m.limiter.buckets.StopGC()
+	}
+	m.limiter = l
+	m.mu.Unlock()
+
+	return m
+}
+
+// identityLimiter keeps a token bucket for each caller of a method.
+type identityLimiter struct {
+	key          ThrottleKeyFunc
+	fillInterval time.Duration
+	capacity     int64
+
+	mu      sync.Mutex // serializes bucket creation
+	buckets *cache.MemoryTTL
+}
+
+// take takes a token from the bucket of the caller. It returns false,
+// if the bucket is empty.
+func (l *identityLimiter) take(r *Request) bool {
+	key := l.key(r)
+
+	l.mu.Lock()
+	var bucket *ratelimit.Bucket
+	if v, err := l.buckets.Get(key); err == nil {
+		bucket = v.(*ratelimit.Bucket)
+	} else {
+		bucket = ratelimit.NewBucket(l.fillInterval, l.capacity)
+	}
+	// Set refreshes the time the caller was seen.
+	l.buckets.Set(key, bucket)
+	l.mu.Unlock()
+
+	return bucket.TakeAvailable(1) != 0
+}
+
+// MaxConcurrent limits the number of handlers of the method running at once
+// to n, so expensive methods do not exhaust the resources of the kite.
+// Requests in excess are rejected with an ErrorTooBusy error, unless
+// they're allowed to wait for their turn with MaxQueued.
+//
+// A non-positive n removes the limit.
+func (m *Method) MaxConcurrent(n int) *Method {
+	m.mu.Lock()
+	if n > 0 {
+		m.slots = make(chan struct{}, n)
+	} else {
+		m.slots = nil
+	}
+	m.mu.Unlock()
+
+	return m
+}
+
+// MaxQueued allows up to n requests to wait for the handlers of the method
+// to finish, when the method is limited with MaxConcurrent. The requests
+// wait until the caller disconnects.
+func (m *Method) MaxQueued(n int) *Method {
+	atomic.StoreInt32(&m.maxQueued, int32(n))
+	return m
+}
+
+// acquire waits for a slot to run the handlers of the method. The returned
+// func releases the slot.
+func (m *Method) acquire(r *Request) (release func(), err *Error) {
+	m.mu.Lock()
+	slots := m.slots
+	m.mu.Unlock()
+
+	if slots == nil {
+		return func() {}, nil
+	}
+
+	release = func() { <-slots }
+
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	tooBusy := &Error{
+		Type:    string(ErrorTooBusy),
+		Message: fmt.Sprintf("The maximum of %d concurrent calls of %q is reached.", cap(slots), m.name),
+	}
+
+	if atomic.AddInt32(&m.queued, 1) > atomic.LoadInt32(&m.maxQueued) {
+		atomic.AddInt32(&m.queued, -1)
+		return nil, tooBusy
+	}
+	defer atomic.AddInt32(&m.queued, -1)
+
+	var done <-chan struct{}
+	if r.Context != nil {
+		done = r.Context.Done()
+	}
+
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	case <-done:
+		return nil, tooBusy
+	}
+}
+
+// ActiveRequests gives the number of method calls being served by the kite,
+// including the ones waiting for their turn, see Method.MaxConcurrent.
+func (k *Kite) ActiveRequests() int {
+	return int(atomic.LoadInt32(&k.activeRequests))
+}
+
+// CacheKeyFunc gives a key the result of the request is cached under.
+// If the returned key is empty, the result is not cached.
+type CacheKeyFunc func(*Request) string
+
+// Cache caches results of the method for the ttl duration, so the main
+// handler is not called again for the same request. The pre and post handlers
+// are still called for every request. Results are cached separately
+// for each user, under the key given by keyFunc. If keyFunc is nil,
+// the request arguments are used as the key.
+//
+// A non-positive ttl disables caching.
+//
+// Only idempotent methods, which do not take callbacks, should be cached.
+// Errors are never cached. Cached results are shared between requests,
+// so they must not be modified.
+func (m *Method) Cache(ttl time.Duration, keyFunc CacheKeyFunc) *Method {
+	if keyFunc == nil {
+		keyFunc = argsCacheKey
+	}
+
+	m.cacheMu.Lock()
+	m.cacheTTL = ttl
+	m.cacheKey = keyFunc
+	if ttl > 0 {
+		m.resetCache()
+	} else if m.cache != nil {
+		m.cache.StopGC()
+		m.cache = nil
+	}
+	m.cacheMu.Unlock()
+
+	return m
+}
+
+// Invalidates makes the method invalidate the cached results of the given
+// methods each time it's served successfully. It is meant for methods
+// which change the state the cached methods return.
+func (m *Method) Invalidates(methods ...*Method) *Method {
+	m.mu.Lock()
+	m.invalidates = append(m.invalidates, methods...)
+	m.mu.Unlock()
+
+	return m
+}
+
+// InvalidateCache removes all cached results of the method.
+func (m *Method) InvalidateCache() {
+	m.cacheMu.Lock()
+	if m.cache != nil {
+		m.resetCache()
+	}
+	m.cacheMu.Unlock()
+}
+
+// resetCache replaces the cache with an empty one. It must be called with
+// cacheMu held.
+func (m *Method) resetCache() {
+	if m.cache != nil {
+		m.cache.StopGC()
+	}
+
+	m.cache = cache.NewMemoryWithTTL(m.cacheTTL)
+	m.cache.StartGC(m.cacheTTL)
+}
+
+// cached gives the cache and the key the result of the request is cached
+// under. It returns nil cache if the result is not cached.
+func (m *Method) cached(r *Request) (*cache.MemoryTTL, string) {
+	m.cacheMu.Lock()
+	c, keyFunc := m.cache, m.cacheKey
+	m.cacheMu.Unlock()
+
+	if c == nil {
+		return nil, ""
+	}
+
+	key := keyFunc(r)
+	if key == "" {
+		return nil, ""
+	}
+
+	return c, r.Username + "\x00" + key
+}
+
+func argsCacheKey(r *Request) string {
+	if r.Args == nil {
+		return "null"
+	}
+
+	return string(r.Args.Raw)
+}
+
 // PreHandler adds a new kite handler which is executed before the method.
 func (m *Method) PreHandle(handler Handler) *Method {
 	m.preHandlers = append(m.preHandlers, handler)
@@ -157,7 +472,9 @@ func (m *Method) FinalFunc(f FinalFunc) *Method {
 }
 
 // Handle registers the handler for the given method. The handler is called
-// when a method call is received from a Kite.
+// when a method call is received from a Kite. Methods can be registered
+// after the kite is started as well, in which case the method list published
+// to kontrol is updated, see Kite.GetMethods.
 func (k *Kite) Handle(method string, handler Handler) *Method {
 	return k.addHandle(method, handler)
 }
@@ -205,6 +522,24 @@ func (k *Kite) FinalFunc(f FinalFunc) {
 }
 
 func (m *Method) ServeKite(r *Request) (interface{}, error) {
+	resp, err := m.serve(r)
+	if err != nil {
+		return m.final(r, nil, err)
+	}
+
+	m.mu.Lock()
+	invalidates := m.invalidates
+	m.mu.Unlock()
+
+	for _, method := range invalidates {
+		method.InvalidateCache()
+	}
+
+	return m.final(r, resp, nil)
+}
+
+// serve calls the pre, main and post handlers of the method.
+func (m *Method) serve(r *Request) (interface{}, error) {
 	var firstResp interface{}
 	var resp interface{}
 	var err error
@@ -222,7 +557,7 @@ func (m *Method) ServeKite(r *Request) (interface{}, error) {
 	for _, handler := range preHandlers {
 		resp, err = handler.ServeKite(r)
 		if err != nil {
-			return m.final(r, nil, err)
+			return nil, err
 		}
 
 		if m.handling == ReturnFirst && resp != nil && firstResp == nil {
@@ -233,9 +568,9 @@ func (m *Method) ServeKite(r *Request) (interface{}, error) {
 	preHandlers = nil // garbage collect it
 
 	// now call our base handler
-	resp, err = m.handler.ServeKite(r)
+	resp, err = m.handle(r)
 	if err != nil {
-		return m.final(r, nil, err)
+		return nil, err
 	}
 
 	// also save it dependent on the handling mechanism
@@ -256,7 +591,7 @@ func (m *Method) ServeKite(r *Request) (interface{}, error) {
 	for _, handler := range postHandlers {
 		resp, err = handler.ServeKite(r)
 		if err != nil {
-			return m.final(r, nil, err)
+			return nil, err
 		}
 
 		if m.handling == ReturnFirst && resp != nil && firstResp == nil {
@@ -273,7 +608,29 @@ func (m *Method) ServeKite(r *Request) (interface{}, error) {
 		resp = firstResp
 	}
 
-	return m.final(r, resp, nil)
+	return resp, nil
+}
+
+// handle calls the main handler of the method, or gives its cached result
+// if caching is enabled.
+func (m *Method) handle(r *Request) (interface{}, error) {
+	c, key := m.cached(r)
+	if c == nil {
+		return m.handler.ServeKite(r)
+	}
+
+	if resp, err := c.Get(key); err == nil {
+		return resp, nil
+	}
+
+	resp, err := m.handler.ServeKite(r)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Set(key, resp)
+
+	return resp, nil
 }
 
 func (m *Method) final(r *Request, resp interface{}, err error) (interface{}, error) {
@@ -4,8 +4,11 @@ import (
 	"context"
 	"errors"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/koding/kite/v2/config"
 )
 
 func TestMethod_Throttling(t *testing.T) {
@@ -54,6 +57,123 @@ func TestMethod_Throttling(t *testing.T) {
 	}
 }
 
+func TestMethod_ThrottleBy(t *testing.T) {
+	cfg := config.New()
+	cfg.DisableAuthentication = true
+	cfg.Port = 10002
+
+	k := NewWithConfig("testkite", "0.0.1", cfg)
+	k.HandleFunc("foo", func(r *Request) (interface{}, error) {
+		return "handle", nil
+	}).ThrottleBy(ThrottleByUsername, time.Minute, 2, 0)
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	dial := func(username string) *Client {
+		ccfg := config.New()
+		ccfg.Username = username
+
+		c := NewWithConfig("exp", "0.0.1", ccfg).NewClient("http://127.0.0.1:10002/kite")
+		if err := c.Dial(); err != nil {
+			t.Fatal(err)
+		}
+
+		return c
+	}
+
+	noisy := dial("noisy")
+	defer noisy.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := noisy.TellWithTimeout("foo", 4*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := noisy.TellWithTimeout("foo", 4*time.Second)
+	if kErr, ok := err.(*Error); !ok || kErr.Type != "requestLimitError" {
+		t.Fatalf("got %v, want requestLimitError", err)
+	}
+
+	quiet := dial("quiet")
+	defer quiet.Close()
+
+	if _, err := quiet.TellWithTimeout("foo", 4*time.Second); err != nil {
+		t.Fatalf("got %v, want other users not to be throttled", err)
+	}
+}
+
+func TestMethod_MaxConcurrent(t *testing.T) {
+	cfg := config.New()
+	cfg.DisableAuthentication = true
+	cfg.Port = 10003
+
+	started := make(chan struct{}, 2)
+	unblock := make(chan struct{})
+
+	k := NewWithConfig("testkite", "0.0.1", cfg)
+	k.HandleFunc("build", func(r *Request) (interface{}, error) {
+		started <- struct{}{}
+		<-unblock
+		return "built", nil
+	}).MaxConcurrent(1).MaxQueued(1)
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	// Responses are awaited one at a time by a client, so each call
+	// is made with a separate one.
+	dial := func() *Client {
+		c := New("exp", "0.0.1").NewClient("http://127.0.0.1:10003/kite")
+		if err := c.Dial(); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	c1, c2, c3 := dial(), dial(), dial()
+	defer c1.Close()
+	defer c2.Close()
+	defer c3.Close()
+
+	first := c1.GoWithTimeout("build", 4*time.Second)
+	<-started
+
+	queued := c2.GoWithTimeout("build", 4*time.Second)
+
+	// Wait for the second call to be queued.
+	for i := 0; k.ActiveRequests() != 2; i++ {
+		if i == 100 {
+			t.Fatalf("got %d active requests, want 2", k.ActiveRequests())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, err := c3.TellWithTimeout("build", 4*time.Second)
+	if kErr, ok := err.(*Error); !ok || kErr.ErrorType() != ErrorTooBusy || !IsRetryable(err) {
+		t.Fatalf("got %v, want retryable %s error", err, ErrorTooBusy)
+	}
+
+	close(unblock)
+
+	for _, resp := range []chan *response{first, queued} {
+		if r := <-resp; r.Err != nil {
+			t.Fatal(r.Err)
+		}
+	}
+
+	// The requests are done shortly after their responses are sent.
+	for i := 0; k.ActiveRequests() != 0; i++ {
+		if i == 100 {
+			t.Fatalf("got %d active requests, want 0", k.ActiveRequests())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func TestMethod_Latest(t *testing.T) {
 	k := New("testkite", "0.0.1")
 	k.Config.DisableAuthentication = true
@@ -246,3 +366,129 @@ func TestMethod_Base(t *testing.T) {
 	}
 
 }
+
+func TestMethod_Cache(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+	k.Config.Port = 10001
+
+	var calls int32
+
+	get := k.HandleFunc("get", func(r *Request) (interface{}, error) {
+		return atomic.AddInt32(&calls, 1), nil
+	}).Cache(time.Minute, nil)
+
+	k.HandleFunc("set", func(r *Request) (interface{}, error) {
+		return nil, nil
+	}).Invalidates(get)
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient("http://127.0.0.1:10001/kite")
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	call := func(method string, args ...interface{}) int {
+		result, err := c.TellWithTimeout(method, 4*time.Second, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if method != "get" {
+			return 0
+		}
+
+		return int(result.MustFloat64())
+	}
+
+	cases := []struct {
+		method string
+		args   []interface{}
+		want   int
+	}{
+		{"get", []interface{}{"foo"}, 1},
+		{"get", []interface{}{"foo"}, 1}, // cached
+		{"get", []interface{}{"bar"}, 2}, // different arguments
+		{"set", nil, 0},
+		{"get", []interface{}{"foo"}, 3}, // invalidated
+		{"get", []interface{}{"bar"}, 4}, // invalidated
+	}
+
+	for i, cas := range cases {
+		if got := call(cas.method, cas.args...); got != cas.want {
+			t.Fatalf("%d: %s: got %d, want %d", i, cas.method, got, cas.want)
+		}
+	}
+}
+
+func TestMethod_CachePreHandle(t *testing.T) {
+	k := New("testkite", "0.0.1")
+	k.Config.DisableAuthentication = true
+	k.Config.Port = 10004
+
+	var calls, checks int32
+	var deny atomic.Value
+	deny.Store(false)
+
+	k.PreHandleFunc(func(r *Request) (interface{}, error) {
+		atomic.AddInt32(&checks, 1)
+
+		if deny.Load().(bool) {
+			return nil, errors.New("not allowed")
+		}
+
+		return nil, nil
+	})
+
+	k.HandleFunc("get", func(r *Request) (interface{}, error) {
+		return atomic.AddInt32(&calls, 1), nil
+	}).Cache(time.Minute, nil)
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := New("exp", "0.0.1").NewClient("http://127.0.0.1:10004/kite")
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	cases := []struct {
+		deny bool
+		want int // 0 means the call is rejected
+	}{
+		{false, 1},
+		{false, 1}, // cached
+		{true, 0},  // rejected, even though cached
+		{false, 1}, // cached
+	}
+
+	for i, cas := range cases {
+		deny.Store(cas.deny)
+
+		result, err := c.TellWithTimeout("get", 4*time.Second)
+		if cas.want == 0 {
+			if err == nil {
+				t.Fatalf("%d: want the call to be rejected", i)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%d: TellWithTimeout()=%s", i, err)
+		}
+
+		if got := int(result.MustFloat64()); got != cas.want {
+			t.Fatalf("%d: got %d, want %d", i, got, cas.want)
+		}
+	}
+
+	if got := atomic.LoadInt32(&checks); got != int32(len(cases)) {
+		t.Fatalf("got %d pre handler calls, want %d", got, len(cases))
+	}
+}
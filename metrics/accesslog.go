@@ -0,0 +1,179 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// AccessLogEntry describes a single request served by a proxy.
+type AccessLogEntry struct {
+	Time       time.Time     `json:"time"`       // when the request was received
+	RemoteAddr string        `json:"remoteAddr"` // address of the client
+	Method     string        `json:"method"`
+	Host       string        `json:"host"`
+	Path       string        `json:"path"`
+	KiteID     string        `json:"kiteID,omitempty"` // ID of the backend kite, if known
+	Status     int           `json:"status"`           // 101 for upgraded websocket connections
+	BytesIn    int64         `json:"bytesIn"`          // request or websocket data received
+	BytesOut   int64         `json:"bytesOut"`         // response or websocket data sent
+	Latency    time.Duration `json:"latency"`          // until the response or connection finished
+}
+
+// String gives the entry in the logfmt format.
+func (e *AccessLogEntry) String() string {
+	return fmt.Sprintf("remote=%s method=%s host=%q path=%q kite=%q status=%d in=%d out=%d latency=%s",
+		e.RemoteAddr, e.Method, e.Host, e.Path, e.KiteID, e.Status, e.BytesIn, e.BytesOut, e.Latency)
+}
+
+// ResponseWriter records the status and the number of bytes of a response.
+// It supports hijacking, the data of hijacked connections, like proxied
+// websockets, is counted as well.
+type ResponseWriter struct {
+	http.ResponseWriter
+
+	status   int
+	bytesIn  int64 // accessed atomically
+	bytesOut int64 // accessed atomically
+}
+
+// NewResponseWriter wraps w, counting the bytes of the request body.
+func NewResponseWriter(w http.ResponseWriter, req *http.Request) *ResponseWriter {
+	rw := &ResponseWriter{ResponseWriter: w}
+
+	if req.Body != nil {
+		req.Body = &countingBody{ReadCloser: req.Body, n: &rw.bytesIn}
+	}
+
+	return rw
+}
+
+// Status gives the status of the response, 200 if it was not written.
+func (rw *ResponseWriter) Status() int {
+	if rw.status == 0 {
+		return http.StatusOK
+	}
+
+	return rw.status
+}
+
+// BytesIn gives the number of bytes of the request body and data read
+// from the hijacked connection.
+func (rw *ResponseWriter) BytesIn() int64 {
+	return atomic.LoadInt64(&rw.bytesIn)
+}
+
+// BytesOut gives the number of bytes of the response body and data written
+// to the hijacked connection.
+func (rw *ResponseWriter) BytesOut() int64 {
+	return atomic.LoadInt64(&rw.bytesOut)
+}
+
+// WriteHeader implements the http.ResponseWriter interface.
+func (rw *ResponseWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements the http.ResponseWriter interface.
+func (rw *ResponseWriter) Write(p []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+
+	n, err := rw.ResponseWriter.Write(p)
+	atomic.AddInt64(&rw.bytesOut, int64(n))
+
+	return n, err
+}
+
+// Flush implements the http.Flusher interface.
+func (rw *ResponseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CloseNotify implements the http.CloseNotifier interface.
+func (rw *ResponseWriter) CloseNotify() <-chan bool {
+	if cn, ok := rw.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+
+	return make(chan bool)
+}
+
+// Hijack implements the http.Hijacker interface.
+func (rw *ResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking is not supported")
+	}
+
+	conn, brw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if rw.status == 0 {
+		rw.status = http.StatusSwitchingProtocols
+	}
+
+	c := &countingConn{Conn: conn, rw: rw}
+
+	// Make the buffered reader and writer use the counting connection,
+	// keeping the data already read by the server.
+	if n := brw.Reader.Buffered(); n != 0 {
+		p, _ := brw.Reader.Peek(n)
+		atomic.AddInt64(&rw.bytesIn, int64(n))
+		brw.Reader.Reset(io.MultiReader(bytes.NewReader(append([]byte(nil), p...)), c))
+	} else {
+		brw.Reader.Reset(c)
+	}
+
+	if err := brw.Writer.Flush(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	brw.Writer.Reset(c)
+
+	return c, brw, nil
+}
+
+type countingConn struct {
+	net.Conn
+	rw *ResponseWriter
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.rw.bytesIn, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.rw.bytesOut, int64(n))
+	return n, err
+}
+
+type countingBody struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(b.n, int64(n))
+	return n, err
+}
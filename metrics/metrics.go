@@ -0,0 +1,337 @@
+// Package metrics implements Prometheus metrics and access logs for HTTP
+// servers, like the reverse proxy and the tunnel proxy.
+//
+// The metrics are exported in the Prometheus text exposition format
+// by Registry, which is an http.Handler meant to be served on /metrics.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the default buckets of histograms, in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// Registry holds metrics and exports them.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// metric is a single metric family.
+type metric interface {
+	write(buf *bytes.Buffer)
+}
+
+// NewRegistry gives new, empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	r.metrics = append(r.metrics, m)
+	r.mu.Unlock()
+}
+
+// ServeHTTP implements the http.Handler interface, it writes all
+// the metrics in the Prometheus text exposition format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var buf bytes.Buffer
+
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	for _, m := range metrics {
+		m.write(&buf)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// desc describes a metric family.
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) writeHeader(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", d.name, helpEscaper.Replace(d.help))
+	fmt.Fprintf(buf, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s: got %d label values, want %d", d.name, len(values), len(d.labels)))
+	}
+
+	return strings.Join(values, "\xff")
+}
+
+// writeSample writes a single sample, extra is an additional label
+// like the "le" label of histogram buckets.
+func (d *desc) writeSample(buf *bytes.Buffer, suffix string, values []string, extra string, v float64) {
+	buf.WriteString(d.name)
+	buf.WriteString(suffix)
+
+	if len(values) != 0 || extra != "" {
+		buf.WriteByte('{')
+
+		for i, value := range values {
+			if i != 0 {
+				buf.WriteByte(',')
+			}
+
+			fmt.Fprintf(buf, `%s="%s"`, d.labels[i], labelEscaper.Replace(value))
+		}
+
+		if extra != "" {
+			if len(values) != 0 {
+				buf.WriteByte(',')
+			}
+
+			buf.WriteString(extra)
+		}
+
+		buf.WriteByte('}')
+	}
+
+	buf.WriteByte(' ')
+	buf.WriteString(formatFloat(v))
+	buf.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// sortedKeys gives the keys of the label values in a stable order.
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Counter is a monotonically increasing value, partitioned by labels.
+type Counter struct {
+	desc
+
+	mu     sync.Mutex
+	values map[string]float64
+	labels map[string][]string
+}
+
+// NewCounter creates and registers a new counter with the given label names.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		desc:   desc{name: name, help: help, typ: "counter", labels: labels},
+		values: make(map[string]float64),
+		labels: make(map[string][]string),
+	}
+
+	r.register(c)
+
+	return c
+}
+
+// Inc increments the counter with the given label values by 1.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v, which must not be negative, to the counter with
+// the given label values.
+func (c *Counter) Add(v float64, values ...string) {
+	key := c.key(values)
+
+	c.mu.Lock()
+	if _, ok := c.labels[key]; !ok {
+		c.labels[key] = append([]string(nil), values...)
+	}
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+// Value gives the value of the counter with the given label values.
+func (c *Counter) Value(values ...string) float64 {
+	key := c.key(values)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.values[key]
+}
+
+func (c *Counter) write(buf *bytes.Buffer) {
+	c.writeHeader(buf)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range sortedKeys(c.labels) {
+		c.writeSample(buf, "", c.labels[key], "", c.values[key])
+	}
+}
+
+// Gauge is a value, which can go up and down, partitioned by labels.
+type Gauge struct {
+	Counter
+}
+
+// NewGauge creates and registers a new gauge with the given label names.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{
+		Counter: Counter{
+			desc:   desc{name: name, help: help, typ: "gauge", labels: labels},
+			values: make(map[string]float64),
+			labels: make(map[string][]string),
+		},
+	}
+
+	r.register(g)
+
+	return g
+}
+
+// Set sets the gauge with the given label values to v.
+func (g *Gauge) Set(v float64, values ...string) {
+	key := g.key(values)
+
+	g.mu.Lock()
+	if _, ok := g.labels[key]; !ok {
+		g.labels[key] = append([]string(nil), values...)
+	}
+	g.values[key] = v
+	g.mu.Unlock()
+}
+
+// GaugeFunc is a gauge, which value is read when the metrics are exported.
+type GaugeFunc struct {
+	desc
+	fn func() float64
+}
+
+// NewGaugeFunc creates and registers a new gauge, which value is given by fn.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{
+		desc: desc{name: name, help: help, typ: "gauge"},
+		fn:   fn,
+	}
+
+	r.register(g)
+
+	return g
+}
+
+func (g *GaugeFunc) write(buf *bytes.Buffer) {
+	g.writeHeader(buf)
+	g.writeSample(buf, "", nil, "", g.fn())
+}
+
+// Histogram counts observed values, like request latencies, in buckets.
+type Histogram struct {
+	desc
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+	labels map[string][]string
+}
+
+type histogramValue struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates and registers a new histogram with the given
+// upper bounds of the buckets and label names. If buckets is nil,
+// DefaultBuckets are used.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+
+	h := &Histogram{
+		desc:    desc{name: name, help: help, typ: "histogram", labels: labels},
+		buckets: append([]float64(nil), buckets...),
+		values:  make(map[string]*histogramValue),
+		labels:  make(map[string][]string),
+	}
+
+	sort.Float64s(h.buckets)
+
+	r.register(h)
+
+	return h
+}
+
+// Observe adds the value to the histogram with the given label values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	key := h.key(values)
+	i := sort.SearchFloat64s(h.buckets, v)
+
+	h.mu.Lock()
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+		h.labels[key] = append([]string(nil), values...)
+	}
+	if i < len(h.buckets) {
+		hv.counts[i]++
+	}
+	hv.count++
+	hv.sum += v
+	h.mu.Unlock()
+}
+
+func (h *Histogram) write(buf *bytes.Buffer) {
+	h.writeHeader(buf)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, key := range sortedKeys(h.labels) {
+		values, hv := h.labels[key], h.values[key]
+
+		var cumulative uint64
+
+		for i, le := range h.buckets {
+			cumulative += hv.counts[i]
+			h.writeSample(buf, "_bucket", values, `le="`+formatFloat(le)+`"`, float64(cumulative))
+		}
+
+		h.writeSample(buf, "_bucket", values, `le="+Inf"`, float64(hv.count))
+		h.writeSample(buf, "_sum", values, "", hv.sum)
+		h.writeSample(buf, "_count", values, "", float64(hv.count))
+	}
+}
@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+
+	c := r.NewCounter("requests_total", "Number of requests.", "code")
+	c.Inc("200")
+	c.Add(2, "200")
+	c.Inc("404")
+
+	g := r.NewGauge("temperature", "Current \"temperature\".")
+	g.Set(-1.5)
+
+	r.NewGaugeFunc("answer", "The answer.", func() float64 { return 42 })
+
+	h := r.NewHistogram("latency_seconds", "Latency\nof requests.", []float64{1, 0.5}, "path")
+	h.Observe(0.25, `/a"b`)
+	h.Observe(0.75, `/a"b`)
+	h.Observe(2, `/a"b`)
+
+	if v := c.Value("200"); v != 3 {
+		t.Fatalf("got %v, want 3", v)
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	want := `# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{code="200"} 3
+requests_total{code="404"} 1
+# HELP temperature Current "temperature".
+# TYPE temperature gauge
+temperature -1.5
+# HELP answer The answer.
+# TYPE answer gauge
+answer 42
+# HELP latency_seconds Latency\nof requests.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{path="/a\"b",le="0.5"} 1
+latency_seconds_bucket{path="/a\"b",le="1"} 2
+latency_seconds_bucket{path="/a\"b",le="+Inf"} 3
+latency_seconds_sum{path="/a\"b"} 3
+latency_seconds_count{path="/a\"b"} 3
+`
+
+	if got := rec.Body.String(); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("got %q content type", ct)
+	}
+}
+
+func TestResponseWriterHijack(t *testing.T) {
+	done := make(chan *ResponseWriter, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := NewResponseWriter(w, r)
+
+		conn, brw, err := rw.Hijack()
+		if err != nil {
+			t.Errorf("Hijack()=%s", err)
+			return
+		}
+		defer conn.Close()
+
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n\r\n")
+		brw.Flush()
+
+		line, _ := brw.ReadString('\n')
+		brw.WriteString(line)
+		brw.Flush()
+
+		done <- rw
+	}))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\nping\n"))
+
+	r := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("ReadResponse()=%s", err)
+	}
+	resp.Body.Close()
+
+	if line, _ := r.ReadString('\n'); line != "ping\n" {
+		t.Fatalf("got %q, want %q", line, "ping\n")
+	}
+
+	rw := <-done
+
+	if rw.Status() != http.StatusSwitchingProtocols || rw.BytesIn() != 5 || rw.BytesOut() != 41 {
+		t.Fatalf("got status=%d in=%d out=%d", rw.Status(), rw.BytesIn(), rw.BytesOut())
+	}
+}
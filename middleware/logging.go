@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"github.com/koding/kite/v2"
+)
+
+// Logging logs each request, with the caller, the session it came over
+// and the time it took. Failed requests are logged at the warning level,
+// the others at the info one.
+func Logging(log kite.Logger) *Middleware {
+	return &Middleware{
+		Pre: kite.HandlerFunc(func(r *kite.Request) (interface{}, error) {
+			markStart(r)
+			return nil, nil
+		}),
+		Final: func(r *kite.Request, resp interface{}, err error) (interface{}, error) {
+			if err != nil {
+				log.Warning("%s %q from %s (%s, %s) failed in %s: %s",
+					r.ID, r.Method, r.Username, r.RemoteAddr, r.TransportName, requestDuration(r), err)
+			} else {
+				log.Info("%s %q from %s (%s, %s) served in %s",
+					r.ID, r.Method, r.Username, r.RemoteAddr, r.TransportName, requestDuration(r))
+			}
+
+			return resp, err
+		},
+	}
+}
@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/metrics"
+)
+
+// Metrics records the requests in the registry, which exports them
+// in the Prometheus format:
+//
+//	kite_requests_total{method,status}
+//	kite_request_duration_seconds{method}
+//
+// The status is "ok" for the requests which succeeded, and the type
+// of the error, like "authorizationError", for the others.
+func Metrics(registry *metrics.Registry) *Middleware {
+	requests := registry.NewCounter("kite_requests_total",
+		"Number of served kite requests.", "method", "status")
+	duration := registry.NewHistogram("kite_request_duration_seconds",
+		"Duration of served kite requests.", nil, "method")
+
+	return &Middleware{
+		Pre: kite.HandlerFunc(func(r *kite.Request) (interface{}, error) {
+			markStart(r)
+			return nil, nil
+		}),
+		Final: func(r *kite.Request, resp interface{}, err error) (interface{}, error) {
+			status := "ok"
+			if err != nil {
+				status = errorType(err)
+			}
+
+			requests.Inc(r.Method, status)
+			duration.Observe(requestDuration(r).Seconds(), r.Method)
+
+			return resp, err
+		},
+	}
+}
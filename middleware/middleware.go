@@ -0,0 +1,177 @@
+// Package middleware implements the handlers of concerns shared by most
+// kites: panic recovery, request logging, metrics and authorization.
+//
+// The middlewares are installed on all the methods of a kite with Use,
+// or on a single method with UseMethod. Panics of the method handlers
+// are not seen by the pre and post handlers, so they are recovered by
+// wrapping the handlers with Recover instead:
+//
+//	k.Handle("square", middleware.Recover(square, nil))
+//
+//	middleware.Use(k,
+//		middleware.Logging(k.Log),
+//		middleware.Metrics(registry),
+//		middleware.Allow("alice", "bob"),
+//	)
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/koding/kite/v2"
+)
+
+// ErrorPanic is the type of the errors returned by DefaultRecover.
+const ErrorPanic kite.ErrorType = "panicError"
+
+func init() {
+	kite.RegisterErrorType(ErrorPanic, false)
+}
+
+// Middleware is a set of handlers run along with the methods of a kite,
+// each of them is optional.
+type Middleware struct {
+	// Pre is run before the method handler, an error rejects
+	// the request.
+	Pre kite.Handler
+
+	// Post is run after the method handler succeeded.
+	Post kite.Handler
+
+	// Final is run last, with the result of the method.
+	Final kite.FinalFunc
+}
+
+// Use installs the middlewares on all the methods of the kite, they are
+// run in the given order. The pre handlers of the kite are run after the
+// ones of the methods, see Kite.PreHandle.
+func Use(k *kite.Kite, mws ...*Middleware) {
+	for _, mw := range mws {
+		if mw.Pre != nil {
+			k.PreHandle(mw.Pre)
+		}
+
+		if mw.Post != nil {
+			k.PostHandle(mw.Post)
+		}
+
+		if mw.Final != nil {
+			k.FinalFunc(mw.Final)
+		}
+	}
+}
+
+// UseMethod installs the middlewares on the method.
+func UseMethod(m *kite.Method, mws ...*Middleware) *kite.Method {
+	for _, mw := range mws {
+		if mw.Pre != nil {
+			m.PreHandle(mw.Pre)
+		}
+
+		if mw.Post != nil {
+			m.PostHandle(mw.Post)
+		}
+
+		if mw.Final != nil {
+			m.FinalFunc(mw.Final)
+		}
+	}
+
+	return m
+}
+
+// RecoverFunc gives the error returned to the caller in place of
+// the value v, which a handler panicked with.
+type RecoverFunc func(r *kite.Request, v interface{}, stack []byte) error
+
+// Recover gives a handler which calls h, turning its panics into errors
+// with fn. If fn is nil, DefaultRecover is used.
+func Recover(h kite.Handler, fn RecoverFunc) kite.Handler {
+	if fn == nil {
+		fn = DefaultRecover
+	}
+
+	return kite.HandlerFunc(func(r *kite.Request) (result interface{}, err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				result, err = nil, fn(r, v, debug.Stack())
+			}
+		}()
+
+		return h.ServeKite(r)
+	})
+}
+
+// DefaultRecover logs the panic with the stack trace and gives an error
+// of the ErrorPanic type, which does not disclose the panic to the caller.
+func DefaultRecover(r *kite.Request, v interface{}, stack []byte) error {
+	r.LocalKite.Log.Error("panic in %q handler (request %s): %v\n%s", r.Method, r.ID, v, stack)
+
+	return &kite.Error{
+		Type:      string(ErrorPanic),
+		Message:   fmt.Sprintf("internal error serving %q", r.Method),
+		RequestID: r.ID,
+	}
+}
+
+// Allow rejects the requests of the users not listed in usernames
+// with an authorization error.
+func Allow(usernames ...string) *Middleware {
+	allowed := make(map[string]bool, len(usernames))
+	for _, username := range usernames {
+		allowed[username] = true
+	}
+
+	return &Middleware{
+		Pre: kite.HandlerFunc(func(r *kite.Request) (interface{}, error) {
+			if allowed[r.Username] {
+				return nil, nil
+			}
+
+			return nil, &kite.Error{
+				Type:    string(kite.ErrorAuthorization),
+				Message: fmt.Sprintf("user %q is not allowed to call %q", r.Username, r.Method),
+			}
+		}),
+	}
+}
+
+type startKey struct{}
+
+// markStart records the time the request started at, unless an earlier
+// middleware did.
+func markStart(r *kite.Request) {
+	if _, ok := r.Context.Value(startKey{}).(time.Time); ok {
+		return
+	}
+
+	ctx := r.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	r.Context = context.WithValue(ctx, startKey{}, time.Now())
+}
+
+// requestDuration gives the time since the request started, or 0 if the start
+// was not recorded, e.g. the request was rejected by a middleware run
+// before.
+func requestDuration(r *kite.Request) time.Duration {
+	if start, ok := r.Context.Value(startKey{}).(time.Time); ok {
+		return time.Since(start)
+	}
+
+	return 0
+}
+
+// errorType gives the type of the error, as sent to the caller.
+func errorType(err error) string {
+	if e, ok := err.(*kite.Error); ok && e.Type != "" {
+		return e.Type
+	}
+
+	return string(kite.ErrorGeneric)
+}
@@ -0,0 +1,127 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/metrics"
+)
+
+// testLogger records the messages logged at the info and warning levels.
+type testLogger struct {
+	kite.Logger
+
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *testLogger) Info(format string, args ...interface{}) {
+	l.log("INFO "+format, args...)
+}
+
+func (l *testLogger) Warning(format string, args ...interface{}) {
+	l.log("WARNING "+format, args...)
+}
+
+func (l *testLogger) log(format string, args ...interface{}) {
+	l.mu.Lock()
+	l.msgs = append(l.msgs, fmt.Sprintf(format, args...))
+	l.mu.Unlock()
+}
+
+func (l *testLogger) messages() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.msgs...)
+}
+
+func TestMiddleware(t *testing.T) {
+	cfg := config.New()
+	cfg.Port = 3674
+	cfg.DisableAuthentication = true
+
+	k := kite.NewWithConfig("middleware", "0.0.1", cfg)
+
+	log := &testLogger{Logger: k.Log}
+	registry := metrics.NewRegistry()
+
+	k.HandleFunc("echo", func(r *kite.Request) (interface{}, error) {
+		return r.Args.One().MustString(), nil
+	})
+
+	k.Handle("panic", Recover(kite.HandlerFunc(func(r *kite.Request) (interface{}, error) {
+		panic("secret")
+	}), nil))
+
+	UseMethod(k.HandleFunc("admin", func(r *kite.Request) (interface{}, error) {
+		return "ok", nil
+	}), Allow("admin"))
+
+	Use(k, Logging(log), Metrics(registry))
+
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	ck := kite.New("middleware-client", "0.0.1")
+	ck.Config.Username = "alice"
+
+	c := ck.NewClient("http://127.0.0.1:3674/kite")
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	resp, err := c.Tell("echo", "hello")
+	if err != nil {
+		t.Fatalf("Tell(echo)=%s", err)
+	}
+
+	if s := resp.MustString(); s != "hello" {
+		t.Fatalf("got %q, want %q", s, "hello")
+	}
+
+	_, err = c.Tell("panic")
+	if e, ok := err.(*kite.Error); !ok || e.Type != string(ErrorPanic) || strings.Contains(e.Message, "secret") {
+		t.Fatalf("got %#v, want %s error not disclosing the panic", err, ErrorPanic)
+	}
+
+	_, err = c.Tell("admin")
+	if e, ok := err.(*kite.Error); !ok || e.Type != string(kite.ErrorAuthorization) {
+		t.Fatalf("got %#v, want %s error", err, kite.ErrorAuthorization)
+	}
+
+	msgs := log.messages()
+	if len(msgs) != 3 {
+		t.Fatalf("got %d log messages, want 3: %q", len(msgs), msgs)
+	}
+
+	if !strings.HasPrefix(msgs[0], "INFO ") || !strings.Contains(msgs[0], `"echo" from alice`) {
+		t.Errorf("unexpected log message %q", msgs[0])
+	}
+
+	for _, msg := range msgs[1:] {
+		if !strings.HasPrefix(msg, "WARNING ") {
+			t.Errorf("got %q, want warning", msg)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	registry.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	for _, want := range []string{
+		`kite_requests_total{method="echo",status="ok"} 1`,
+		`kite_requests_total{method="panic",status="panicError"} 1`,
+		`kite_requests_total{method="admin",status="authorizationError"} 1`,
+		`kite_request_duration_seconds_count{method="echo"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics do not contain %q:\n%s", want, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,393 @@
+package kite
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/koding/kite/v2/protocol"
+)
+
+// DefaultSTUNServers are used to detect the public IP address of a kite,
+// when NATOptions.STUNServers is empty.
+var DefaultSTUNServers = []string{
+	"stun.l.google.com:19302",
+	"stun1.l.google.com:19302",
+}
+
+// PortMapper maps a port of the kite on the NAT gateway, so the kite is
+// reachable from the outside.
+type PortMapper interface {
+	// MapPort maps the internal TCP port. It returns the external port
+	// and the lifetime of the mapping, after which it has to be renewed.
+	// A zero lifetime means the mapping is permanent.
+	MapPort(internal int) (external int, lifetime time.Duration, err error)
+}
+
+// NATOptions configures detection of the public URL of a kite running
+// behind NAT, see PublicURL.
+type NATOptions struct {
+	// STUNServers are used, in order, to detect the public IP address.
+	// If empty, DefaultSTUNServers are used.
+	STUNServers []string
+
+	// PortMapper, if non-nil, maps the port of the kite on the gateway,
+	// e.g. with NAT-PMP. Otherwise the port is expected to be forwarded
+	// already and the public port is the one the kite listens on.
+	PortMapper PortMapper
+
+	// DialBack, if non-nil, is used to verify the public URL is reachable.
+	// If nil, Kontrol is asked to dial the kite back, see Kite.DialBack.
+	DialBack func(*url.URL) error
+
+	// Timeout limits each of the STUN requests. If zero, Config.Timeout
+	// is used.
+	Timeout time.Duration
+}
+
+// PublicURL detects the URL under which the kite is reachable from the
+// outside, when it runs behind NAT. The public IP is detected with STUN,
+// the port is optionally mapped with the PortMapper and the URL is verified
+// by dialing the kite back.
+//
+// The kite must be already running, so it can be dialed back.
+func (k *Kite) PublicURL(opts *NATOptions) (*url.URL, error) {
+	u, _, err := k.publicURL(opts)
+	return u, err
+}
+
+func (k *Kite) publicURL(opts *NATOptions) (*url.URL, time.Duration, error) {
+	if opts == nil {
+		opts = &NATOptions{}
+	}
+
+	servers := opts.STUNServers
+	if len(servers) == 0 {
+		servers = DefaultSTUNServers
+	}
+
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = k.config().Timeout
+	}
+
+	var ip net.IP
+	var err error
+
+	for _, server := range servers {
+		if ip, err = stunPublicIP(server, timeout); err == nil {
+			break
+		}
+
+		k.Log.Debug("STUN request to %q failed: %s", server, err)
+	}
+
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to detect public IP: %s", err)
+	}
+
+	port := k.Port()
+	if port == 0 {
+		port = k.Config.Port
+	}
+
+	var lifetime time.Duration
+
+	if opts.PortMapper != nil {
+		if port, lifetime, err = opts.PortMapper.MapPort(port); err != nil {
+			return nil, 0, fmt.Errorf("unable to map port: %s", err)
+		}
+	}
+
+	scheme := "http"
+	if k.TLSConfig != nil {
+		scheme = "https"
+	}
+
+	u := &url.URL{
+		Scheme: scheme,
+		Host:   net.JoinHostPort(ip.String(), strconv.Itoa(port)),
+		Path:   "/" + k.name + "-" + k.version + "/kite",
+	}
+
+	dialBack := opts.DialBack
+	if dialBack == nil {
+		dialBack = k.DialBack
+	}
+
+	if err := dialBack(u); err != nil {
+		return nil, 0, fmt.Errorf("%s is not reachable: %s", u, err)
+	}
+
+	return u, lifetime, nil
+}
+
+// RegisterBehindNAT detects the public URL of the kite with PublicURL and
+// registers it with RegisterForever. If the port mapping expires, it is
+// renewed in the background and, when the public port changes, the kite
+// registers again with the new URL.
+func (k *Kite) RegisterBehindNAT(opts *NATOptions) error {
+	u, lifetime, err := k.publicURL(opts)
+	if err != nil {
+		return err
+	}
+
+	if lifetime > 0 {
+		go k.renewPortMapping(opts.PortMapper, u, lifetime)
+	}
+
+	return k.RegisterForever(u)
+}
+
+func (k *Kite) renewPortMapping(m PortMapper, u *url.URL, lifetime time.Duration) {
+	host, _, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return
+	}
+
+	for {
+		select {
+		case <-k.closeC:
+			return
+		case <-time.After(lifetime / 2):
+		}
+
+		port, l, err := m.MapPort(k.Port())
+		if err != nil {
+			k.Log.Error("unable to renew port mapping: %s", err)
+			lifetime = 2 * kontrolRetryDuration
+			continue
+		}
+
+		if l > 0 {
+			lifetime = l
+		}
+
+		if newHost := net.JoinHostPort(host, strconv.Itoa(port)); newHost != u.Host {
+			newURL := *u
+			newURL.Host = newHost
+			u = &newURL
+
+			k.Log.Info("Public port has changed, registering with %s", u)
+
+			select {
+			case k.kontrol.registerChan <- u:
+			default:
+			}
+		}
+	}
+}
+
+// STUN message constants, see RFC 5389.
+const (
+	stunBindingRequest   = 0x0001
+	stunBindingResponse  = 0x0101
+	stunMagicCookie      = 0x2112A442
+	stunMappedAddress    = 0x0001
+	stunXorMappedAddress = 0x0020
+)
+
+// stunPublicIP sends a STUN binding request to the server and gives
+// the reflexive address from the response.
+func stunPublicIP(server string, timeout time.Duration) (net.IP, error) {
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	req := make([]byte, 20)
+	binary.BigEndian.PutUint16(req[0:], stunBindingRequest)
+	binary.BigEndian.PutUint32(req[4:], stunMagicCookie)
+	if _, err := rand.Read(req[8:20]); err != nil {
+		return nil, err
+	}
+
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	p := make([]byte, 1024)
+
+	for {
+		n, err := conn.Read(p)
+		if err != nil {
+			return nil, err
+		}
+
+		if n < 20 || binary.BigEndian.Uint16(p[0:]) != stunBindingResponse || !bytes.Equal(p[8:20], req[8:20]) {
+			continue // not a response to our request
+		}
+
+		return parseSTUNResponse(p[:n])
+	}
+}
+
+func parseSTUNResponse(p []byte) (net.IP, error) {
+	length := int(binary.BigEndian.Uint16(p[2:]))
+	if 20+length > len(p) {
+		return nil, errors.New("truncated STUN response")
+	}
+
+	var mapped net.IP
+
+	for attrs := p[20 : 20+length]; len(attrs) >= 4; {
+		typ := binary.BigEndian.Uint16(attrs[0:])
+		n := int(binary.BigEndian.Uint16(attrs[2:]))
+
+		if 4+n > len(attrs) {
+			return nil, errors.New("truncated STUN attribute")
+		}
+
+		value := attrs[4 : 4+n]
+
+		switch typ {
+		case stunXorMappedAddress:
+			ip := stunAddress(value)
+			for i := range ip {
+				ip[i] ^= p[4+i] // magic cookie, then transaction ID
+			}
+			if ip != nil {
+				return ip, nil
+			}
+		case stunMappedAddress:
+			mapped = stunAddress(value)
+		}
+
+		// attributes are padded to a multiple of 4 bytes
+		if n%4 != 0 {
+			n += 4 - n%4
+		}
+
+		if 4+n > len(attrs) {
+			break
+		}
+
+		attrs = attrs[4+n:]
+	}
+
+	if mapped == nil {
+		return nil, errors.New("no mapped address in STUN response")
+	}
+
+	return mapped, nil
+}
+
+// stunAddress gives the IP of the MAPPED-ADDRESS-like attribute value.
+func stunAddress(value []byte) net.IP {
+	if len(value) < 4 {
+		return nil
+	}
+
+	switch value[1] {
+	case 0x01:
+		if len(value) < 8 {
+			return nil
+		}
+		return net.IP(append([]byte(nil), value[4:8]...))
+	case 0x02:
+		if len(value) < 20 {
+			return nil
+		}
+		return net.IP(append([]byte(nil), value[4:20]...))
+	default:
+		return nil
+	}
+}
+
+// NATPMP maps ports with the NAT Port Mapping Protocol, see RFC 6886.
+type NATPMP struct {
+	// Gateway is the address of the NAT gateway, e.g. "192.168.1.1".
+	// If the port is not given, 5351 is used.
+	Gateway string
+
+	// Lifetime is the requested lifetime of the mapping, 2 hours
+	// by default.
+	Lifetime time.Duration
+
+	// Timeout limits the mapping request, 5 seconds by default.
+	Timeout time.Duration
+}
+
+var _ PortMapper = (*NATPMP)(nil)
+
+// MapPort implements the PortMapper interface.
+func (m *NATPMP) MapPort(internal int) (int, time.Duration, error) {
+	gateway := m.Gateway
+	if _, _, err := net.SplitHostPort(gateway); err != nil {
+		gateway = net.JoinHostPort(gateway, "5351")
+	}
+
+	lifetime := m.Lifetime
+	if lifetime == 0 {
+		lifetime = 2 * time.Hour
+	}
+
+	timeout := m.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+
+	conn, err := net.Dial("udp", gateway)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+
+	// version 0, opcode 2 (map TCP), reserved, internal port,
+	// suggested external port and the lifetime in seconds
+	req := make([]byte, 12)
+	req[1] = 2
+	binary.BigEndian.PutUint16(req[4:], uint16(internal))
+	binary.BigEndian.PutUint16(req[6:], uint16(internal))
+	binary.BigEndian.PutUint32(req[8:], uint32(lifetime/time.Second))
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := conn.Write(req); err != nil {
+		return 0, 0, err
+	}
+
+	resp := make([]byte, 16)
+
+	n, err := conn.Read(resp)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if n < 16 || resp[1] != 128+2 {
+		return 0, 0, errors.New("invalid NAT-PMP response")
+	}
+
+	if code := binary.BigEndian.Uint16(resp[2:]); code != 0 {
+		return 0, 0, fmt.Errorf("NAT-PMP mapping failed with result code %d", code)
+	}
+
+	external := int(binary.BigEndian.Uint16(resp[10:]))
+	granted := time.Duration(binary.BigEndian.Uint32(resp[12:])) * time.Second
+
+	return external, granted, nil
+}
+
+// DialBack asks Kontrol to dial the kite with the given URL and ping it.
+// It is used to verify the URL is reachable before registering it.
+func (k *Kite) DialBack(u *url.URL) error {
+	if err := k.SetupKontrolClient(); err != nil {
+		return err
+	}
+
+	<-k.kontrol.readyConnected
+
+	_, err := k.kontrol.TellWithTimeout("dialBack", k.config().Timeout, &protocol.DialBackArgs{URL: u.String()})
+	return err
+}
@@ -0,0 +1,118 @@
+package kite
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/koding/kite/v2/config"
+)
+
+// serveUDP serves a single request received on a UDP socket, it gives
+// the address of the socket.
+func serveUDP(t *testing.T, reply func(req []byte) []byte) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket()=%s", err)
+	}
+
+	go func() {
+		defer conn.Close()
+
+		p := make([]byte, 1024)
+
+		n, addr, err := conn.ReadFrom(p)
+		if err != nil {
+			return
+		}
+
+		conn.WriteTo(reply(p[:n]), addr)
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+// stunReply replies with the XOR-MAPPED-ADDRESS of the ip and port.
+func stunReply(ip net.IP, port int) func([]byte) []byte {
+	return func(req []byte) []byte {
+		resp := make([]byte, 32)
+		copy(resp, req[:20])
+		binary.BigEndian.PutUint16(resp[0:], stunBindingResponse)
+		binary.BigEndian.PutUint16(resp[2:], 12)
+
+		binary.BigEndian.PutUint16(resp[20:], stunXorMappedAddress)
+		binary.BigEndian.PutUint16(resp[22:], 8)
+		resp[25] = 0x01
+		binary.BigEndian.PutUint16(resp[26:], uint16(port)^uint16(stunMagicCookie>>16))
+
+		for i, b := range ip.To4() {
+			resp[28+i] = b ^ req[4+i]
+		}
+
+		return resp
+	}
+}
+
+func natpmpReply(external int, lifetime uint32) func([]byte) []byte {
+	return func(req []byte) []byte {
+		resp := make([]byte, 16)
+		resp[1] = 128 + req[1]
+		copy(resp[8:10], req[4:6])
+		binary.BigEndian.PutUint16(resp[10:], uint16(external))
+		binary.BigEndian.PutUint32(resp[12:], lifetime)
+		return resp
+	}
+}
+
+func TestPublicURL(t *testing.T) {
+	cfg := config.New()
+	cfg.Port = 3659
+
+	k := NewWithConfig("nat", "0.0.1", cfg)
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	var dialed *url.URL
+
+	opts := &NATOptions{
+		STUNServers: []string{serveUDP(t, stunReply(net.ParseIP("203.0.113.7"), 50000))},
+		PortMapper: &NATPMP{
+			Gateway: serveUDP(t, natpmpReply(40000, 3600)),
+		},
+		DialBack: func(u *url.URL) error {
+			dialed = u
+			return nil
+		},
+		Timeout: 5 * time.Second,
+	}
+
+	u, err := k.PublicURL(opts)
+	if err != nil {
+		t.Fatalf("PublicURL()=%s", err)
+	}
+
+	const want = "http://203.0.113.7:40000/nat-0.0.1/kite"
+
+	if u.String() != want {
+		t.Fatalf("got %q, want %q", u, want)
+	}
+
+	if dialed == nil || dialed.String() != want {
+		t.Fatalf("got dialed back %v, want %q", dialed, want)
+	}
+
+	// The URL is rejected, when it is not reachable.
+	opts.STUNServers = []string{serveUDP(t, stunReply(net.ParseIP("203.0.113.7"), 50000))}
+	opts.PortMapper = nil
+	opts.DialBack = func(*url.URL) error {
+		return errors.New("connection refused")
+	}
+
+	if _, err := k.PublicURL(opts); err == nil {
+		t.Fatal("expected PublicURL() to fail when dial back fails")
+	}
+}
@@ -0,0 +1,38 @@
+// +build nats
+
+package natstransport
+
+import (
+	nats "github.com/nats-io/go-nats"
+)
+
+type natsConn struct {
+	nc *nats.Conn
+}
+
+// NewConn adapts the NATS connection to the Conn interface.
+func NewConn(nc *nats.Conn) Conn {
+	return natsConn{nc: nc}
+}
+
+func (c natsConn) Publish(subject, reply string, data []byte) error {
+	return c.nc.PublishRequest(subject, reply, data)
+}
+
+func (c natsConn) Subscribe(subject string, handler func(*Msg)) (Subscription, error) {
+	return c.nc.Subscribe(subject, natsHandler(handler))
+}
+
+func (c natsConn) QueueSubscribe(subject, queue string, handler func(*Msg)) (Subscription, error) {
+	return c.nc.QueueSubscribe(subject, queue, natsHandler(handler))
+}
+
+func natsHandler(handler func(*Msg)) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		handler(&Msg{
+			Subject: msg.Subject,
+			Reply:   msg.Reply,
+			Data:    msg.Data,
+		})
+	}
+}
@@ -0,0 +1,373 @@
+// Package natstransport implements a kite transport, which exchanges dnode
+// messages over NATS subjects instead of direct SockJS connections.
+//
+// A kite serves the sessions on a subject with a queue group, so each
+// new session is accepted by one of the kites subscribed to the subject:
+//
+//	natstransport.Serve(k, conn, "kite.math")
+//
+// Clients dial the kite with the "nats://<subject>" URL:
+//
+//	c := k.NewClient(natstransport.URL("kite.math"))
+//	c.Transport = &natstransport.Transport{Conn: conn}
+//
+// The URL can also be registered to Kontrol with k.RegisterURL, so kites
+// discovered with GetKites are dialed over NATS as well.
+//
+// Each message must fit into the maximum payload of the NATS server,
+// which is 1MB by default.
+package natstransport
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/utils"
+)
+
+// Msg is a message received from NATS.
+type Msg struct {
+	Subject string
+	Reply   string
+	Data    []byte
+}
+
+// Subscription is a subscription to a NATS subject.
+type Subscription interface {
+	Unsubscribe() error
+}
+
+// Conn is a connection to NATS. NewConn adapts a *nats.Conn, when built
+// with the "nats" build tag.
+//
+// Messages must be delivered to a single subscription in the order
+// they were published.
+type Conn interface {
+	// Publish publishes the data to the subject, with the optional
+	// reply subject.
+	Publish(subject, reply string, data []byte) error
+
+	// Subscribe subscribes the handler to the subject.
+	Subscribe(subject string, handler func(*Msg)) (Subscription, error)
+
+	// QueueSubscribe subscribes the handler to the subject as a member
+	// of the queue group. Each message is delivered to one member only.
+	QueueSubscribe(subject, queue string, handler func(*Msg)) (Subscription, error)
+}
+
+// Frames of the session protocol, each message published to a session
+// subject starts with one of them.
+const (
+	frameOpen    = 'o'
+	frameMessage = 'm'
+	frameClose   = 'c'
+)
+
+var (
+	// ErrSessionClosed is returned by Send and Recv of a closed session.
+	ErrSessionClosed = errors.New("session is closed")
+
+	// ErrListenerClosed is returned by Accept of a closed listener.
+	ErrListenerClosed = errors.New("listener is closed")
+)
+
+// URL gives the URL of kites served on the subject.
+func URL(subject string) string {
+	return "nats://" + subject
+}
+
+// Subject gives the subject of the "nats://<subject>" URL.
+func Subject(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+
+	if u.Scheme != "nats" {
+		return "", fmt.Errorf("unsupported scheme %q, want \"nats\"", u.Scheme)
+	}
+
+	if u.Host == "" {
+		return "", fmt.Errorf("no subject in %q", rawurl)
+	}
+
+	return u.Host + strings.Replace(strings.TrimSuffix(u.Path, "/"), "/", ".", -1), nil
+}
+
+// Transport dials kites over NATS, see kite.Client.Transport.
+type Transport struct {
+	Conn Conn
+}
+
+var _ kite.Transport = (*Transport)(nil)
+
+// Dial implements the kite.Transport interface. It requests a new session
+// from one of the kites served on the subject of the URL and waits up
+// to cfg.Timeout for it to be accepted.
+func (t *Transport) Dial(rawurl string, cfg *config.Config) (kite.Session, error) {
+	subject, err := Subject(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	id := utils.RandomString(20)
+	s := newSession(t.Conn, id, subject+"."+id+".s")
+
+	if err := s.subscribe(subject + "." + id + ".c"); err != nil {
+		return nil, err
+	}
+
+	if err := t.Conn.Publish(subject, subject+"."+id+".c", []byte(id)); err != nil {
+		s.closeLocal()
+		return nil, err
+	}
+
+	var timeout <-chan time.Time
+	if cfg.Timeout > 0 {
+		timeout = time.After(cfg.Timeout)
+	}
+
+	select {
+	case <-s.opened:
+		return s, nil
+	case <-s.closed:
+		return nil, ErrSessionClosed
+	case <-timeout:
+		s.closeLocal()
+		return nil, fmt.Errorf("no kite accepted the session on %q within %s", subject, cfg.Timeout)
+	}
+}
+
+// Listener accepts sessions requested on a subject.
+type Listener struct {
+	conn    Conn
+	subject string
+	sub     Subscription
+
+	sessions chan *session
+	closed   chan struct{}
+	once     sync.Once
+}
+
+// Listen subscribes to the subject with the queue group of the same name
+// and accepts the requested sessions.
+func Listen(conn Conn, subject string) (*Listener, error) {
+	l := &Listener{
+		conn:     conn,
+		subject:  subject,
+		sessions: make(chan *session),
+		closed:   make(chan struct{}),
+	}
+
+	sub, err := conn.QueueSubscribe(subject, subject, l.handle)
+	if err != nil {
+		return nil, err
+	}
+
+	l.sub = sub
+
+	return l, nil
+}
+
+func (l *Listener) handle(msg *Msg) {
+	if msg.Reply == "" {
+		return
+	}
+
+	id := string(msg.Data)
+	s := newSession(l.conn, id, msg.Reply)
+
+	if err := s.subscribe(l.subject + "." + id + ".s"); err != nil {
+		return
+	}
+
+	if err := l.conn.Publish(msg.Reply, "", []byte{frameOpen}); err != nil {
+		s.closeLocal()
+		return
+	}
+
+	select {
+	case l.sessions <- s:
+	case <-l.closed:
+		s.Close(3000, "Go away!")
+	}
+}
+
+// Accept waits for the next requested session.
+func (l *Listener) Accept() (kite.Session, error) {
+	select {
+	case s := <-l.sessions:
+		return s, nil
+	case <-l.closed:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close stops accepting the sessions. The accepted sessions are not closed.
+func (l *Listener) Close() error {
+	var err error
+
+	l.once.Do(func() {
+		close(l.closed)
+		err = l.sub.Unsubscribe()
+	})
+
+	return err
+}
+
+// Serve accepts the sessions requested on the subject and serves them
+// with the kite, until the returned listener is closed.
+func Serve(k *kite.Kite, conn Conn, subject string) (*Listener, error) {
+	l, err := Listen(conn, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			s, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go k.ServeSession(s)
+		}
+	}()
+
+	return l, nil
+}
+
+// session is one side of a session, it publishes messages to the subject
+// of the other side and receives the messages published to its own one.
+type session struct {
+	id   string
+	conn Conn
+	peer string
+	sub  Subscription
+
+	msgs   chan string
+	opened chan struct{}
+	closed chan struct{}
+	open   sync.Once
+	once   sync.Once
+}
+
+var _ kite.Session = (*session)(nil)
+var _ kite.BinarySession = (*session)(nil)
+
+func newSession(conn Conn, id, peer string) *session {
+	return &session{
+		id:     id,
+		conn:   conn,
+		peer:   peer,
+		msgs:   make(chan string, 64),
+		opened: make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+}
+
+func (s *session) subscribe(subject string) error {
+	sub, err := s.conn.Subscribe(subject, s.handle)
+	if err != nil {
+		return err
+	}
+
+	s.sub = sub
+
+	return nil
+}
+
+func (s *session) handle(msg *Msg) {
+	if len(msg.Data) == 0 {
+		return
+	}
+
+	switch msg.Data[0] {
+	case frameOpen:
+		s.open.Do(func() { close(s.opened) })
+	case frameMessage:
+		select {
+		case s.msgs <- string(msg.Data[1:]):
+		case <-s.closed:
+		}
+	case frameClose:
+		s.closeLocal()
+	}
+}
+
+// ID implements the kite.Session interface.
+func (s *session) ID() string {
+	return s.id
+}
+
+// TransportName gives the name of the transport, see kite.Client.TransportName.
+func (s *session) TransportName() string {
+	return "nats"
+}
+
+// Binary implements the kite.BinarySession interface, NATS delivers
+// messages byte for byte.
+func (s *session) Binary() bool {
+	return true
+}
+
+// Recv implements the kite.Session interface.
+func (s *session) Recv() (string, error) {
+	// Messages received before the session was closed are delivered first.
+	select {
+	case msg := <-s.msgs:
+		return msg, nil
+	default:
+	}
+
+	select {
+	case msg := <-s.msgs:
+		return msg, nil
+	case <-s.closed:
+		return "", ErrSessionClosed
+	}
+}
+
+// Send implements the kite.Session interface.
+func (s *session) Send(msg string) error {
+	select {
+	case <-s.closed:
+		return ErrSessionClosed
+	default:
+	}
+
+	return s.conn.Publish(s.peer, "", append([]byte{frameMessage}, msg...))
+}
+
+// Close implements the kite.Session interface, it notifies the other side
+// of the session.
+func (s *session) Close(uint32, string) error {
+	if !s.closeLocal() {
+		return ErrSessionClosed
+	}
+
+	return s.conn.Publish(s.peer, "", []byte{frameClose})
+}
+
+// closeLocal closes the session without notifying the other side, it
+// returns false if the session was already closed.
+func (s *session) closeLocal() bool {
+	ok := false
+
+	s.once.Do(func() {
+		ok = true
+		close(s.closed)
+
+		if s.sub != nil {
+			s.sub.Unsubscribe()
+		}
+	})
+
+	return ok
+}
@@ -0,0 +1,226 @@
+package natstransport_test
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/kitetest"
+	"github.com/koding/kite/v2/natstransport"
+)
+
+// broker is an in-memory NATS server.
+type broker struct {
+	mu   sync.Mutex
+	subs map[string][]*sub
+}
+
+type sub struct {
+	b       *broker
+	subject string
+	queue   string
+	msgs    chan *natstransport.Msg
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newBroker() *broker {
+	return &broker{subs: make(map[string][]*sub)}
+}
+
+func (b *broker) Publish(subject, reply string, data []byte) error {
+	msg := &natstransport.Msg{
+		Subject: subject,
+		Reply:   reply,
+		Data:    append([]byte(nil), data...),
+	}
+
+	b.mu.Lock()
+	var subs []*sub
+	queues := make(map[string][]*sub)
+	for _, s := range b.subs[subject] {
+		if s.queue == "" {
+			subs = append(subs, s)
+		} else {
+			queues[s.queue] = append(queues[s.queue], s)
+		}
+	}
+	for _, members := range queues {
+		subs = append(subs, members[rand.Intn(len(members))])
+	}
+	b.mu.Unlock()
+
+	for _, s := range subs {
+		select {
+		case s.msgs <- msg:
+		case <-s.done:
+		}
+	}
+
+	return nil
+}
+
+func (b *broker) Subscribe(subject string, handler func(*natstransport.Msg)) (natstransport.Subscription, error) {
+	return b.QueueSubscribe(subject, "", handler)
+}
+
+func (b *broker) QueueSubscribe(subject, queue string, handler func(*natstransport.Msg)) (natstransport.Subscription, error) {
+	s := &sub{
+		b:       b,
+		subject: subject,
+		queue:   queue,
+		msgs:    make(chan *natstransport.Msg, 1024),
+		done:    make(chan struct{}),
+	}
+
+	b.mu.Lock()
+	b.subs[subject] = append(b.subs[subject], s)
+	b.mu.Unlock()
+
+	go func() {
+		for {
+			select {
+			case msg := <-s.msgs:
+				handler(msg)
+			case <-s.done:
+				return
+			}
+		}
+	}()
+
+	return s, nil
+}
+
+func (s *sub) Unsubscribe() error {
+	s.once.Do(func() {
+		s.b.mu.Lock()
+		subs := s.b.subs[s.subject]
+		for i, other := range subs {
+			if other == s {
+				s.b.subs[s.subject] = append(subs[:i:i], subs[i+1:]...)
+				break
+			}
+		}
+		s.b.mu.Unlock()
+
+		close(s.done)
+	})
+
+	return nil
+}
+
+func TestSubject(t *testing.T) {
+	cases := map[string]string{
+		"nats://kite.math":       "kite.math",
+		"nats://kite/math/1.0.0": "kite.math.1.0.0",
+	}
+
+	for rawurl, want := range cases {
+		got, err := natstransport.Subject(rawurl)
+		if err != nil {
+			t.Fatalf("%s: Subject()=%s", rawurl, err)
+		}
+
+		if got != want {
+			t.Fatalf("%s: got %q, want %q", rawurl, got, want)
+		}
+	}
+
+	for _, rawurl := range []string{"http://127.0.0.1:3636/kite", "nats://"} {
+		if _, err := natstransport.Subject(rawurl); err == nil {
+			t.Fatalf("%s: want Subject() to fail", rawurl)
+		}
+	}
+}
+
+func TestTransport(t *testing.T) {
+	b := newBroker()
+
+	l, err := natstransport.Listen(b, "kite.test")
+	if err != nil {
+		t.Fatalf("Listen()=%s", err)
+	}
+	defer l.Close()
+
+	tr := &natstransport.Transport{Conn: b}
+
+	kitetest.TestTransport(t, func(t *testing.T) (client, server kitetest.Session) {
+		client, err := tr.Dial(natstransport.URL("kite.test"), config.New())
+		if err != nil {
+			t.Fatalf("Dial()=%s", err)
+		}
+
+		server, err = l.Accept()
+		if err != nil {
+			t.Fatalf("Accept()=%s", err)
+		}
+
+		return client, server
+	})
+}
+
+func TestServe(t *testing.T) {
+	b := newBroker()
+
+	// Two kites in the same queue group serve the subject.
+	served := make(chan string, 16)
+
+	for _, name := range []string{"math-1", "math-2"} {
+		k := kite.New(name, "0.0.1")
+		k.Config.DisableAuthentication = true
+		k.HandleFunc("square", func(r *kite.Request) (interface{}, error) {
+			served <- r.LocalKite.Kite().Name
+			a := r.Args.One().MustFloat64()
+			return a * a, nil
+		})
+
+		l, err := natstransport.Serve(k, b, "kite.math")
+		if err != nil {
+			t.Fatalf("Serve()=%s", err)
+		}
+		defer l.Close()
+	}
+
+	k := kite.New("client", "0.0.1")
+	k.Config.Timeout = 5 * time.Second
+
+	for i := 0; i < 4; i++ {
+		c := k.NewClient(natstransport.URL("kite.math"))
+		c.Transport = &natstransport.Transport{Conn: b}
+
+		if err := c.Dial(); err != nil {
+			t.Fatalf("Dial()=%s", err)
+		}
+
+		result, err := c.Tell("square", 4)
+		if err != nil {
+			t.Fatalf("Tell()=%s", err)
+		}
+
+		if n := result.MustFloat64(); n != 16 {
+			t.Fatalf("got %v, want 16", n)
+		}
+
+		c.Close()
+	}
+
+	if len(served) != 4 {
+		t.Fatalf("got %d requests served, want 4", len(served))
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	cfg := config.New()
+	cfg.Timeout = 100 * time.Millisecond
+
+	tr := &natstransport.Transport{Conn: newBroker()}
+
+	if _, err := tr.Dial(natstransport.URL("kite.none"), cfg); err == nil {
+		t.Fatal("want Dial() to fail without listeners")
+	}
+}
+
+var _ kite.Transport = (*natstransport.Transport)(nil)
@@ -0,0 +1,83 @@
+package kite
+
+import (
+	"context"
+	"time"
+)
+
+// latencyWeight is the weight of a new round-trip time sample
+// in the moving average given by Client.Latency.
+const latencyWeight = 0.2
+
+// Ping calls "kite.ping" method of the remote kite and gives the round-trip
+// time of the call. Each successful ping updates the moving average given
+// by Latency.
+func (c *Client) Ping(ctx context.Context) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+
+	select {
+	case resp := <-c.Go("kite.ping"):
+		if resp.Err != nil {
+			return 0, resp.Err
+		}
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	rtt := time.Since(start)
+
+	c.latencyMu.Lock()
+	if c.latency == 0 {
+		c.latency = rtt
+	} else {
+		c.latency += time.Duration(latencyWeight * float64(rtt-c.latency))
+	}
+	c.latencyMu.Unlock()
+
+	return rtt, nil
+}
+
+// Latency gives the exponential moving average of round-trip times
+// measured by Ping, or 0 if the remote kite was not pinged yet.
+func (c *Client) Latency() time.Duration {
+	c.latencyMu.Lock()
+	defer c.latencyMu.Unlock()
+
+	return c.latency
+}
+
+// startPings pings the remote kite every PingInterval until
+// the client disconnects.
+func (c *Client) startPings() {
+	interval := c.PingInterval
+	if interval <= 0 {
+		return
+	}
+
+	ctx := c.context()
+
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			pingCtx, cancel := context.WithTimeout(ctx, interval)
+			_, err := c.Ping(pingCtx)
+			cancel()
+
+			if err != nil && ctx.Err() == nil {
+				c.LocalKite.Log.Debug("Pinging %s failed: %s", c.URL, err)
+			}
+
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
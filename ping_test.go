@@ -0,0 +1,56 @@
+package kite
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/koding/kite/v2/config"
+)
+
+func TestClient_Ping(t *testing.T) {
+	cfg := config.New()
+	cfg.Port = 3653
+
+	k := NewWithConfig("ping", "0.0.1", cfg)
+
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	c := New("ping-client", "0.0.1").NewClient("http://127.0.0.1:3653/kite")
+	c.PingInterval = 50 * time.Millisecond
+
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	timeout := time.After(5 * time.Second)
+
+	for c.Latency() == 0 {
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for periodic ping")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rtt, err := c.Ping(ctx)
+	if err != nil {
+		t.Fatalf("Ping()=%s", err)
+	}
+
+	if rtt <= 0 {
+		t.Fatalf("got rtt=%s, want > 0", rtt)
+	}
+
+	cancel()
+
+	if _, err := c.Ping(ctx); err != context.Canceled {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,65 @@
+package protocol
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// JWKS is a JSON Web Key Set, see RFC 7517. Kontrol serves the public keys
+// it signs tokens with as a JWKS document, so kites can verify tokens
+// signed with any of the active key pairs.
+type JWKS struct {
+	Keys []*JWK `json:"keys"`
+}
+
+// JWK is a single RSA public key of a JWKS document.
+type JWK struct {
+	Kty string `json:"kty"`           // key type, always "RSA"
+	Kid string `json:"kid"`           // key pair ID, the "kid" header of tokens
+	Use string `json:"use,omitempty"` // public key use, "sig"
+	Alg string `json:"alg,omitempty"` // signing algorithm, "RS256"
+	N   string `json:"n"`             // base64url-encoded modulus
+	E   string `json:"e"`             // base64url-encoded exponent
+}
+
+// NewJWK gives the JWK of the RSA public key of the key pair with the given ID.
+func NewJWK(kid string, key *rsa.PublicKey) *JWK {
+	return &JWK{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		Alg: "RS256",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// RSAPublicKey gives the RSA public key of the JWK.
+func (j *JWK) RSAPublicKey() (*rsa.PublicKey, error) {
+	if j.Kty != "RSA" {
+		return nil, fmt.Errorf("unsupported key type %q", j.Kty)
+	}
+
+	n, err := base64.RawURLEncoding.DecodeString(j.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus: %s", err)
+	}
+
+	e, err := base64.RawURLEncoding.DecodeString(j.E)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exponent: %s", err)
+	}
+
+	exp := new(big.Int).SetBytes(e)
+	if len(n) == 0 || !exp.IsInt64() || exp.Int64() < 2 || exp.Int64() > 1<<31-1 {
+		return nil, errors.New("invalid RSA public key")
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(exp.Int64()),
+	}, nil
+}
@@ -0,0 +1,93 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MaxLabels is the maximum number of labels a kite can register with.
+const MaxLabels = 64
+
+// ParseLabels parses labels in the "key=value,key=value" form, which is
+// the form of KontrolQuery.Labels selectors and the KITE_LABELS variable.
+// An empty string gives nil labels.
+func ParseLabels(s string) (map[string]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	labels := make(map[string]string)
+
+	for _, pair := range strings.Split(s, ",") {
+		i := strings.IndexByte(pair, '=')
+		if i == -1 {
+			return nil, fmt.Errorf("invalid label %q: want key=value", strings.TrimSpace(pair))
+		}
+
+		key, value := strings.TrimSpace(pair[:i]), strings.TrimSpace(pair[i+1:])
+
+		if _, ok := labels[key]; ok {
+			return nil, fmt.Errorf("duplicated label %q", key)
+		}
+
+		labels[key] = value
+	}
+
+	if err := ValidateLabels(labels); err != nil {
+		return nil, err
+	}
+
+	return labels, nil
+}
+
+// FormatLabels is the inverse of ParseLabels, the labels are sorted by key.
+func FormatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+// ValidateLabels checks the labels can be formatted with FormatLabels
+// and parsed back. Keys must be non-empty, they cannot contain "=" or ","
+// and values cannot contain ",".
+func ValidateLabels(labels map[string]string) error {
+	if len(labels) > MaxLabels {
+		return fmt.Errorf("too many labels: %d, at most %d are allowed", len(labels), MaxLabels)
+	}
+
+	for key, value := range labels {
+		if key == "" {
+			return errors.New("empty label key")
+		}
+
+		if strings.ContainsAny(key, "=,") || key != strings.TrimSpace(key) {
+			return fmt.Errorf("invalid label key %q", key)
+		}
+
+		if strings.Contains(value, ",") || value != strings.TrimSpace(value) {
+			return fmt.Errorf("invalid value of label %q", key)
+		}
+	}
+
+	return nil
+}
+
+// MatchLabels tells whether the labels contain all the labels
+// of the selector.
+func MatchLabels(selector, labels map[string]string) bool {
+	for key, value := range selector {
+		if v, ok := labels[key]; !ok || v != value {
+			return false
+		}
+	}
+
+	return true
+}
@@ -8,7 +8,7 @@ import (
 	"errors"
 	"strings"
 
-	"github.com/koding/kite/dnode"
+	"github.com/koding/kite/v2/dnode"
 )
 
 // Kite is the base struct containing the public fields. It is usually embedded
@@ -117,6 +117,36 @@ type RegisterArgs struct {
 	URL  string `json:"url"`
 	Kite *Kite  `json:"kite,omitempty"`
 	Auth *Auth  `json:"auth,omitempty"`
+
+	// Methods lists the methods the kite exposes, they're published
+	// to the clients querying kontrol with the "kite.methods" method.
+	Methods []string `json:"methods,omitempty"`
+
+	// Labels are arbitrary key-value pairs describing the kite, like
+	// "gpu=true" or "zone=eu-1b", which clients select kites by with
+	// KontrolQuery.Labels. See ValidateLabels for valid labels.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// RegisterKitesArgs is a request value for the "registerKites" kontrol
+// method, which registers many kites at once. Each kite is registered as
+// with the "/register" HTTP endpoint, so it authenticates with its own
+// kite key and sends heartbeats to the "/heartbeat" endpoint.
+type RegisterKitesArgs struct {
+	Kites []*RegisterArgs `json:"kites"`
+}
+
+// RegisterKitesResult is a response value for the "registerKites" kontrol
+// method. Results are in the same order as the requested kites, a result
+// of a kite that failed to register has its Error set.
+type RegisterKitesResult struct {
+	Results []*RegisterResult `json:"results"`
+}
+
+// UpdateMethodsArgs is a request value for the "updateMethods" kontrol
+// method, which a registered kite calls when its methods change.
+type UpdateMethodsArgs struct {
+	Methods []string `json:"methods"`
 }
 
 type Auth struct {
@@ -143,10 +173,47 @@ type RegisterResult struct {
 	KiteKey string `json:"kiteKey,omitempty"`
 }
 
+// DisplacedArgs is sent by Kontrol to a kite, which registration was
+// replaced by a kite registering with the same ID from another URL.
+type DisplacedArgs struct {
+	URL string `json:"url"` // URL of the new registration
+}
+
+// Capabilities is a manifest exchanged by kites with
+// the "kite.capabilities" method.
+type Capabilities struct {
+	Version          string   `json:"version"`                    // version of the kite
+	Methods          []string `json:"methods"`                    // methods the kite handles
+	Features         []string `json:"features,omitempty"`         // supported protocol features
+	MinClientVersion string   `json:"minClientVersion,omitempty"` // oldest version of supported callers
+}
+
 type GetKitesArgs struct {
 	Query         *KontrolQuery   `json:"query"`
 	WatchCallback dnode.Function  `json:"watchCallback"`
 	Who           json.RawMessage `json:"who"`
+
+	// Limit and Offset, when non-zero, page the kites matching the query.
+	// Paged kites are ordered by ID instead of being shuffled.
+	Limit  int `json:"limit,omitempty"`
+	Offset int `json:"offset,omitempty"`
+
+	// Fields, when non-empty, lists the fields of the returned kites,
+	// the other ones are left empty. Valid fields are the keys of
+	// KontrolQuery.Fields, "url", "keyId" and "methods".
+	Fields []string `json:"fields,omitempty"`
+
+	// NoToken skips generating tokens for the returned kites, when they
+	// are only discovered and not called.
+	NoToken bool `json:"noToken,omitempty"`
+
+	// PreferRegion, when non-empty, makes the kites from the region
+	// returned before the kites from other regions, usually it's
+	// the region of the caller.
+	PreferRegion string `json:"preferRegion,omitempty"`
+
+	// MaxResults, when non-zero, limits the number of returned kites.
+	MaxResults int `json:"maxResults,omitempty"`
 }
 
 // GetTokenArgs is a request value for the "getToken" kontrol method.
@@ -156,12 +223,100 @@ type GetTokenArgs struct {
 	Force bool `json:"force"` // force creation of a new token
 }
 
+// DelegateTokenArgs is a request value for the "delegateToken" kontrol method.
+type DelegateTokenArgs struct {
+	Query    *KontrolQuery `json:"query"`    // kite to generate a token for, the name is required
+	Username string        `json:"username"` // user to act on behalf of
+}
+
+// CreateTenantArgs is a request value for the "createTenant" kontrol method.
+type CreateTenantArgs struct {
+	Tenant   string `json:"tenant"`             // name of the tenant
+	ID       string `json:"id,omitempty"`       // ID of the key pair, generated if empty
+	Public   string `json:"public,omitempty"`   // public key, the key pair is generated if empty
+	Private  string `json:"private,omitempty"`  // private key, the key pair is generated if empty
+	Username string `json:"username,omitempty"` // user to issue a kite key for
+}
+
+// CreateTenantResult is a response value for the "createTenant" kontrol method.
+type CreateTenantResult struct {
+	ID      string `json:"id"`                // ID of the key pair
+	Public  string `json:"public"`            // public key of the key pair
+	KiteKey string `json:"kiteKey,omitempty"` // kite key of the user, if requested
+}
+
+// IssueKeysArgs is a request value for the "issueKeys" kontrol method,
+// which issues kite keys for many users at once.
+type IssueKeysArgs struct {
+	Keys []*IssueKeyArgs `json:"keys"`
+}
+
+// IssueKeyArgs describes a single kite key to issue.
+type IssueKeyArgs struct {
+	Username    string `json:"username"`              // user to issue the kite key for
+	Environment string `json:"environment,omitempty"` // environment whose key pair signs the kite key
+	Tenant      string `json:"tenant,omitempty"`      // tenant whose key pair signs the kite key
+}
+
+// IssueKeysResult is a response value for the "issueKeys" kontrol method.
+// Keys are in the same order as the requested ones, a key that could not
+// be issued has its Error set.
+type IssueKeysResult struct {
+	Keys []*IssuedKey `json:"keys"`
+}
+
+// IssuedKey is a kite key issued for a single user.
+type IssuedKey struct {
+	Username string `json:"username"`
+	KiteKey  string `json:"kiteKey,omitempty"`
+	Error    string `json:"err,omitempty"`
+}
+
+// RemoveTenantArgs is a request value for the "removeTenant" kontrol method.
+type RemoveTenantArgs struct {
+	Tenant string `json:"tenant"` // name of the tenant
+}
+
+// GetTokenByIDArgs is a request value for the "getTokenByID" kontrol method.
+type GetTokenByIDArgs struct {
+	ID string `json:"id"` // ID of the token, the "jti" claim
+}
+
+// DialBackArgs is a request value for the "dialBack" kontrol method.
+type DialBackArgs struct {
+	URL string `json:"url"` // URL of the kite to dial
+}
+
+// GetTokensArgs is a request value for the "getTokens" kontrol method.
+type GetTokensArgs struct {
+	Queries []*KontrolQuery `json:"queries"` // kites to generate tokens for
+
+	Force bool `json:"force"` // force creation of new tokens
+}
+
+// GetTokensResult is a response value for the "getTokens" kontrol method.
+// Tokens are in the same order as the requested queries.
+type GetTokensResult struct {
+	Tokens []*TokenResult `json:"tokens"`
+}
+
+// TokenResult is a token generated for a single kite, or an error
+// if it could not be generated.
+type TokenResult struct {
+	Token string `json:"token,omitempty"`
+	Error string `json:"err,omitempty"`
+}
+
 type WhoResult struct {
 	Query *KontrolQuery `json:"query"`
 }
 
 type GetKitesResult struct {
 	Kites []*KiteWithToken `json:"kites"`
+
+	// Total is the number of kites matching the query, it's set
+	// for paged requests only.
+	Total int `json:"total,omitempty"`
 }
 
 type KiteWithToken struct {
@@ -169,6 +324,13 @@ type KiteWithToken struct {
 	URL   string `json:"url"`
 	KeyID string `json:"keyId,omitempty"`
 	Token string `json:"token"`
+
+	// Methods are the methods published by the kite, they're returned
+	// by the "kite.methods" kontrol method only.
+	Methods []string `json:"methods,omitempty"`
+
+	// Labels are the labels the kite registered with.
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 // KiteEvent is the struct that is sent as an argument in watchCallback of
@@ -202,6 +364,12 @@ type KontrolQuery struct {
 	Region      string `json:"region"`
 	Hostname    string `json:"hostname"`
 	ID          string `json:"id"`
+
+	// Labels, when non-empty, selects kites registered with all the
+	// labels, given in the "key=value,key=value" form, see ParseLabels.
+	// The labels alone are not a valid query, they narrow down the kites
+	// matching the other fields.
+	Labels string `json:"labels,omitempty"`
 }
 
 func (k KontrolQuery) Fields() map[string]string {
@@ -61,3 +61,28 @@ func TestKiteQuery(t *testing.T) {
 	expect(q.Version, "version")
 	expect(q.Hostname, "hostname")
 }
+
+func TestParseLabels(t *testing.T) {
+	labels, err := ParseLabels(" gpu=true, zone=eu-1b ")
+	if err != nil {
+		t.Fatalf("ParseLabels()=%s", err)
+	}
+
+	if got := FormatLabels(labels); got != "gpu=true,zone=eu-1b" {
+		t.Errorf("got %q, want %q", got, "gpu=true,zone=eu-1b")
+	}
+
+	if !MatchLabels(map[string]string{"gpu": "true"}, labels) {
+		t.Errorf("want %v to match gpu=true", labels)
+	}
+
+	if MatchLabels(map[string]string{"gpu": "false"}, labels) {
+		t.Errorf("want %v not to match gpu=false", labels)
+	}
+
+	for _, s := range []string{"gpu", "=true", "gpu=true,gpu=false"} {
+		if _, err := ParseLabels(s); err == nil {
+			t.Errorf("%q: want error", s)
+		}
+	}
+}
@@ -85,7 +85,7 @@ func ParseWebRTCSignalMessage(msg string) (*WebRTCSignalMessage, error) {
 
 func validateOperation(op string) error {
 	switch strings.ToUpper(op) {
-	case "ANSWER", "OFFER", "CANDIDATE", "LEAVE":
+	case "ANSWER", "OFFER", "CANDIDATE", "LEAVE", "ANNOUNCE":
 		return nil
 	default:
 		return errInvalidOp
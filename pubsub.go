@@ -0,0 +1,273 @@
+package kite
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/koding/kite/v2/dnode"
+)
+
+// Topics are dot-separated names, like "builds.linux.done". The topics
+// clients subscribe to may contain wildcards: "*" matches a single
+// segment and ">", which must be the last segment, matches one or more
+// trailing segments. A subscription to "builds.*.done" receives messages
+// published to "builds.linux.done", one to "builds.>" receives all
+// messages of the builds.
+//
+// Messages are published with Kite.Publish to the clients, which
+// subscribed with Client.SubscribeTopic. They are delivered over the
+// clients' sessions in the order they were published.
+
+// TopicQueueSize is the number of published messages queued for each
+// subscription. If a subscriber does not keep up and its queue is full,
+// further messages are dropped for it until the queue drains.
+var TopicQueueSize = 256
+
+// TopicHandler is called with the topic and the payload of every message
+// published to a topic the client subscribed to.
+type TopicHandler func(topic string, payload *dnode.Partial)
+
+// topicArgs are the arguments of "kite.subscribe" and "kite.unsubscribe".
+type topicArgs struct {
+	Topic string `json:"topic"`
+}
+
+// topicMessage is a published message queued for a subscriber.
+type topicMessage struct {
+	topic   string
+	payload interface{}
+}
+
+// topicSubscriber delivers the messages published to the topics matching
+// the pattern to the callback of a client.
+type topicSubscriber struct {
+	client   *Client
+	pattern  []string
+	callback dnode.Function
+	queue    chan topicMessage
+	done     chan struct{}
+	dropped  int64 // accessed atomically
+}
+
+func (s *topicSubscriber) deliver() {
+	for {
+		select {
+		case msg := <-s.queue:
+			if err := s.callback.Call(msg.topic, msg.payload); err != nil {
+				s.client.LocalKite.Log.Debug("Unable to deliver message on %q: %s", msg.topic, err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// topics holds the topic subscriptions of the connected clients,
+// keyed by the subscribed topic.
+type topics struct {
+	sync.RWMutex
+	m map[*Client]map[string]*topicSubscriber
+}
+
+// Publish sends the message with the payload to all clients subscribed
+// to the topic, which must not contain wildcards. It does not wait for
+// the message to be delivered. It returns the number of subscriptions
+// the message was queued for.
+func (k *Kite) Publish(topic string, payload interface{}) (int, error) {
+	segments, err := splitTopic(topic)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, s := range segments {
+		if s == "*" || s == ">" {
+			return 0, fmt.Errorf("cannot publish to wildcard topic %q", topic)
+		}
+	}
+
+	k.topics.RLock()
+	defer k.topics.RUnlock()
+
+	var n int
+
+	for _, subs := range k.topics.m {
+		for pattern, s := range subs {
+			if !matchTopic(s.pattern, segments) {
+				continue
+			}
+
+			select {
+			case s.queue <- topicMessage{topic: topic, payload: payload}:
+				n++
+			default:
+				if atomic.AddInt64(&s.dropped, 1) == 1 {
+					k.Log.Warning("Subscription of %s to %q is full, dropping messages", s.client.Kite, pattern)
+				}
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// handleSubscribe subscribes the caller to the topic, the messages are
+// delivered to the callback passed as the second argument.
+func (k *Kite) handleSubscribe(r *Request) (interface{}, error) {
+	var args topicArgs
+	var callback dnode.Function
+
+	a, err := r.Args.SliceOfLength(2)
+	if err == nil {
+		err = a[0].Unmarshal(&args)
+	}
+	if err == nil {
+		callback, err = a[1].Function()
+	}
+	if err != nil {
+		return nil, &Error{Type: "argumentError", Message: err.Error()}
+	}
+
+	pattern, err := splitTopic(args.Topic)
+	if err != nil {
+		return nil, &Error{Type: "argumentError", Message: err.Error()}
+	}
+
+	s := &topicSubscriber{
+		client:   r.Client,
+		pattern:  pattern,
+		callback: callback,
+		queue:    make(chan topicMessage, TopicQueueSize),
+		done:     make(chan struct{}),
+	}
+
+	k.topics.Lock()
+	if k.topics.m == nil {
+		k.topics.m = make(map[*Client]map[string]*topicSubscriber)
+	}
+	subs, ok := k.topics.m[r.Client]
+	if !ok {
+		subs = make(map[string]*topicSubscriber)
+		k.topics.m[r.Client] = subs
+	}
+	old := subs[args.Topic]
+	subs[args.Topic] = s
+	k.topics.Unlock()
+
+	// The subscription is made again when the client reconnects
+	// or resumes its session.
+	if old != nil {
+		close(old.done)
+	}
+
+	go s.deliver()
+
+	return true, nil
+}
+
+// handleUnsubscribe removes the caller's subscription to the topic.
+func (k *Kite) handleUnsubscribe(r *Request) (interface{}, error) {
+	var args topicArgs
+
+	if err := r.Args.One().Unmarshal(&args); err != nil {
+		return nil, &Error{Type: "argumentError", Message: err.Error()}
+	}
+
+	k.topics.Lock()
+	s, ok := k.topics.m[r.Client][args.Topic]
+	if ok {
+		delete(k.topics.m[r.Client], args.Topic)
+	}
+	k.topics.Unlock()
+
+	if ok {
+		close(s.done)
+	}
+
+	return ok, nil
+}
+
+// unsubscribeTopics removes the subscriptions of the disconnected client.
+func (k *Kite) unsubscribeTopics(c *Client) {
+	k.topics.Lock()
+	subs := k.topics.m[c]
+	delete(k.topics.m, c)
+	k.topics.Unlock()
+
+	for _, s := range subs {
+		close(s.done)
+	}
+}
+
+// SubscribeTopic subscribes to the messages published by the remote kite
+// to the topic, which may contain wildcards. The handler is called for
+// every message, one at a time.
+//
+// The subscription is made with Subscribe, so it's made again each time
+// the client reconnects, until it's removed with UnsubscribeTopic.
+func (c *Client) SubscribeTopic(topic string, handler TopicHandler) (*Subscription, error) {
+	if _, err := splitTopic(topic); err != nil {
+		return nil, err
+	}
+
+	return c.Subscribe("kite.subscribe", topicArgs{Topic: topic}, func(_ *Subscription, args *dnode.Partial) {
+		a, err := args.SliceOfLength(2)
+		if err != nil {
+			c.LocalKite.Log.Warning("Invalid message on topic %q: %s", topic, err)
+			return
+		}
+
+		t, err := a[0].String()
+		if err != nil {
+			c.LocalKite.Log.Warning("Invalid message on topic %q: %s", topic, err)
+			return
+		}
+
+		handler(t, a[1])
+	})
+}
+
+// UnsubscribeTopic removes the subscription made with SubscribeTopic.
+func (c *Client) UnsubscribeTopic(s *Subscription) error {
+	if err := c.Unsubscribe(s.ID); err != nil {
+		return err
+	}
+
+	var args topicArgs
+	if err := json.Unmarshal(s.Args, &args); err != nil {
+		return err
+	}
+
+	_, err := c.TellWithTimeout("kite.unsubscribe", c.config().Timeout, args)
+	return err
+}
+
+// splitTopic splits the topic into its segments.
+func splitTopic(topic string) ([]string, error) {
+	segments := strings.Split(topic, ".")
+
+	for i, s := range segments {
+		if s == "" || (s == ">" && i != len(segments)-1) {
+			return nil, fmt.Errorf("invalid topic %q", topic)
+		}
+	}
+
+	return segments, nil
+}
+
+// matchTopic tells whether the topic matches the subscribed pattern.
+func matchTopic(pattern, topic []string) bool {
+	for i, p := range pattern {
+		if p == ">" {
+			return len(topic) > i
+		}
+
+		if i == len(topic) || (p != "*" && p != topic[i]) {
+			return false
+		}
+	}
+
+	return len(pattern) == len(topic)
+}
@@ -0,0 +1,156 @@
+package kite
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/dnode"
+)
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		pattern, topic string
+		match          bool
+	}{
+		{"builds.linux.done", "builds.linux.done", true},
+		{"builds.linux.done", "builds.darwin.done", false},
+		{"builds.*.done", "builds.linux.done", true},
+		{"builds.*.done", "builds.linux.failed", false},
+		{"builds.*", "builds.linux.done", false},
+		{"builds.>", "builds.linux.done", true},
+		{"builds.>", "builds", false},
+		{">", "builds", true},
+		{"builds.linux", "builds.linux.done", false},
+	}
+
+	for _, cas := range cases {
+		pattern, err := splitTopic(cas.pattern)
+		if err != nil {
+			t.Fatalf("splitTopic(%q)=%s", cas.pattern, err)
+		}
+
+		topic, err := splitTopic(cas.topic)
+		if err != nil {
+			t.Fatalf("splitTopic(%q)=%s", cas.topic, err)
+		}
+
+		if match := matchTopic(pattern, topic); match != cas.match {
+			t.Errorf("%q, %q: got %t, want %t", cas.pattern, cas.topic, match, cas.match)
+		}
+	}
+
+	for _, topic := range []string{"", "builds.", "builds..done", "builds.>.done"} {
+		if _, err := splitTopic(topic); err == nil {
+			t.Errorf("%q: expected error", topic)
+		}
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	cfg := config.New()
+	cfg.Port = 3671
+	cfg.DisableAuthentication = true
+
+	k := NewWithConfig("publisher", "0.0.1", cfg)
+
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	c := New("subscriber", "0.0.1").NewClient("http://127.0.0.1:3671/kite")
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	received := make(chan string, 16)
+
+	sub, err := c.SubscribeTopic("builds.*.done", func(topic string, payload *dnode.Partial) {
+		received <- topic + "=" + payload.MustString()
+	})
+	if err != nil {
+		t.Fatalf("SubscribeTopic()=%s", err)
+	}
+
+	if _, err := k.Publish("builds.*.done", "x"); err == nil {
+		t.Fatal("expected error publishing to a wildcard topic")
+	}
+
+	publish := func(topic, payload string, want int) {
+		n, err := k.Publish(topic, payload)
+		if err != nil {
+			t.Fatalf("Publish()=%s", err)
+		}
+		if n != want {
+			t.Fatalf("%s: got %d subscriptions, want %d", topic, n, want)
+		}
+	}
+
+	publish("builds.linux.failed", "1", 0)
+	publish("builds.linux.done", "2", 1)
+	publish("builds.darwin.done", "3", 1)
+
+	for _, want := range []string{"builds.linux.done=2", "builds.darwin.done=3"} {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+
+	if err := c.UnsubscribeTopic(sub); err != nil {
+		t.Fatalf("UnsubscribeTopic()=%s", err)
+	}
+
+	publish("builds.linux.done", "4", 0)
+}
+
+func TestPubSubBackpressure(t *testing.T) {
+	defer func(size int) { TopicQueueSize = size }(TopicQueueSize)
+	TopicQueueSize = 2
+
+	k := New("publisher", "0.0.1")
+
+	blocked := make(chan struct{})
+	defer close(blocked)
+
+	c := k.NewClient("")
+
+	// The subscriber's callback never returns.
+	msg := &dnode.Message{
+		Arguments: &dnode.Partial{Raw: []byte(`[{"topic":"logs.>"},"[Function]"]`)},
+		Callbacks: map[string]dnode.Path{"0": {float64(1)}}, // as decoded from JSON
+	}
+
+	err := dnode.ParseCallbacks(msg, func(uint64, []interface{}) error {
+		<-blocked
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ParseCallbacks()=%s", err)
+	}
+
+	if _, err := k.handleSubscribe(&Request{Client: c, Args: msg.Arguments}); err != nil {
+		t.Fatalf("handleSubscribe()=%s", err)
+	}
+	defer k.unsubscribeTopics(c)
+
+	var queued int
+	for i := 0; i < 10; i++ {
+		n, err := k.Publish("logs.app", strings.Repeat("x", i))
+		if err != nil {
+			t.Fatalf("Publish()=%s", err)
+		}
+		queued += n
+	}
+
+	// One message is being delivered, the queue holds the next ones.
+	if queued > TopicQueueSize+1 {
+		t.Fatalf("got %d queued messages, want at most %d", queued, TopicQueueSize+1)
+	}
+}
@@ -0,0 +1,336 @@
+package kite
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// ErrQueueFull is returned when a message can't be buffered because
+// the outgoing queue of a Client has reached its capacity.
+var ErrQueueFull = errors.New("can't send, outgoing queue is full")
+
+// DropPolicy defines which message is discarded when the outgoing
+// queue is full.
+type DropPolicy int
+
+const (
+	// DropNewest rejects the message that is being queued. This is the default.
+	DropNewest DropPolicy = iota
+
+	// DropOldest discards the oldest message in the queue to make room
+	// for the new one. Messages are never discarded from SpillFile,
+	// once it's full the new message is rejected like with DropNewest,
+	// so the order of messages is kept.
+	DropOldest
+)
+
+// QueueOptions configures buffering of outgoing messages while a Client
+// is not connected to the remote kite.
+type QueueOptions struct {
+	// Size is the maximum number of messages kept in memory.
+	//
+	// If Size is 0, the default value of 1024 is used.
+	Size int
+
+	// Policy defines which message is dropped when the queue is full.
+	Policy DropPolicy
+
+	// SpillFile, when non-empty, is a path to a file where messages
+	// that do not fit in memory are written to instead of being dropped.
+	// The file is truncated when the queue is created, it does not
+	// persist messages across process restarts.
+	SpillFile string
+
+	// SpillSize is the maximum number of messages written to SpillFile.
+	//
+	// If SpillSize is 0, the number of spilled messages is not limited.
+	SpillSize int
+}
+
+func (opts *QueueOptions) size() int {
+	if opts.Size > 0 {
+		return opts.Size
+	}
+	return 1024
+}
+
+// sendQueue buffers outgoing messages while the client is offline.
+type sendQueue struct {
+	opts *QueueOptions
+
+	mu     sync.Mutex
+	online bool
+	closed bool
+	msgs   []*message
+	spill  *spillFile
+}
+
+func newSendQueue(opts *QueueOptions) (*sendQueue, error) {
+	q := &sendQueue{
+		opts: opts,
+	}
+
+	if opts.SpillFile != "" {
+		f, err := os.OpenFile(opts.SpillFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return nil, err
+		}
+
+		q.spill = &spillFile{f: f}
+	}
+
+	return q, nil
+}
+
+// push buffers the msg if the queue is offline. It returns false
+// if the queue is online and the message should be sent directly.
+func (q *sendQueue) push(msg *message) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	switch {
+	case q.closed:
+		return false, errors.New("can't send, client is closed")
+	case q.online:
+		return false, nil
+	case len(q.msgs) < q.opts.size() && (q.spill == nil || q.spill.len() == 0):
+		q.msgs = append(q.msgs, msg)
+		return true, nil
+	case q.spill != nil && (q.opts.SpillSize == 0 || q.spill.len() < q.opts.SpillSize):
+		if err := q.spill.write(msg); err != nil {
+			return false, err
+		}
+		return true, nil
+	case q.opts.Policy == DropOldest && len(q.msgs) != 0 && (q.spill == nil || q.spill.len() == 0):
+		// The new message can't be put in memory ahead of the spilled ones.
+		dropped := q.msgs[0]
+		q.msgs = append(q.msgs[1:], msg)
+		dropped.fail(ErrQueueFull)
+		return true, nil
+	default:
+		return false, ErrQueueFull
+	}
+}
+
+// pop removes the oldest message from the queue. If the queue is empty,
+// it is marked as online and pop returns nil - since then every push
+// is going to be rejected until the queue goes offline again.
+func (q *sendQueue) pop() (*message, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.msgs) == 0 && q.spill != nil && q.spill.len() != 0 {
+		msgs, err := q.spill.readAll()
+		if err != nil {
+			return nil, err
+		}
+
+		q.msgs = msgs
+	}
+
+	if len(q.msgs) == 0 {
+		q.online = true
+		return nil, nil
+	}
+
+	msg := q.msgs[0]
+	q.msgs[0] = nil
+	q.msgs = q.msgs[1:]
+
+	return msg, nil
+}
+
+// unpop puts back the message which failed to be sent.
+func (q *sendQueue) unpop(msg *message) {
+	q.mu.Lock()
+	q.msgs = append([]*message{msg}, q.msgs...)
+	q.mu.Unlock()
+}
+
+func (q *sendQueue) setOffline() {
+	q.mu.Lock()
+	q.online = false
+	q.mu.Unlock()
+}
+
+// close fails all pending messages with the given error.
+func (q *sendQueue) close(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+
+	for _, msg := range q.msgs {
+		msg.fail(err)
+	}
+
+	q.msgs = nil
+
+	if q.spill != nil {
+		for _, errC := range q.spill.errCs {
+			if errC != nil {
+				errC <- err
+			}
+		}
+
+		q.spill.f.Close()
+		q.spill = nil
+	}
+}
+
+func (q *sendQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := len(q.msgs)
+	if q.spill != nil {
+		n += q.spill.len()
+	}
+
+	return n
+}
+
+// spillFile stores length-prefixed message payloads in a file.
+//
+// Error channels can't be written to a file, they are kept
+// in memory in the same order as the payloads.
+type spillFile struct {
+	f     *os.File
+	errCs []chan<- error
+}
+
+func (s *spillFile) len() int {
+	return len(s.errCs)
+}
+
+func (s *spillFile) write(msg *message) error {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(msg.p)))
+
+	if _, err := s.f.Write(n[:]); err != nil {
+		return err
+	}
+
+	if _, err := s.f.Write(msg.p); err != nil {
+		return err
+	}
+
+	s.errCs = append(s.errCs, msg.errC)
+
+	return nil
+}
+
+// readAll reads all spilled messages and truncates the file.
+func (s *spillFile) readAll() ([]*message, error) {
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(s.f)
+	msgs := make([]*message, 0, len(s.errCs))
+
+	for _, errC := range s.errCs {
+		var n [4]byte
+
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return nil, err
+		}
+
+		p := make([]byte, binary.BigEndian.Uint32(n[:]))
+
+		if _, err := io.ReadFull(r, p); err != nil {
+			return nil, err
+		}
+
+		msgs = append(msgs, &message{
+			p:    p,
+			errC: errC,
+		})
+	}
+
+	if err := s.f.Truncate(0); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	s.errCs = nil
+
+	return msgs, nil
+}
+
+// sendQueue gives the outgoing queue of the client, creating it
+// on first use. It returns nil if c.Queue is nil.
+func (c *Client) sendQueue() *sendQueue {
+	if c.Queue == nil {
+		return nil
+	}
+
+	c.queueOnce.Do(func() {
+		q, err := newSendQueue(c.Queue)
+		if err != nil {
+			c.LocalKite.Log.Error("unable to create outgoing queue: %s", err)
+
+			// Fall back to in-memory queue.
+			opts := *c.Queue
+			opts.SpillFile = ""
+			q, _ = newSendQueue(&opts)
+		}
+
+		c.queue = q
+	})
+
+	return c.queue
+}
+
+// flushQueue sends all buffered messages over the newly connected session.
+func (c *Client) flushQueue() {
+	q := c.sendQueue()
+	if q == nil {
+		return
+	}
+
+	ctx := c.context()
+
+	for {
+		msg, err := q.pop()
+		if err != nil {
+			c.LocalKite.Log.Error("unable to read outgoing queue: %s", err)
+			return
+		}
+
+		if msg == nil {
+			return
+		}
+
+		select {
+		case c.send <- msg:
+		case <-ctx.Done():
+			q.unpop(msg)
+			return
+		case <-c.closeChan:
+			q.unpop(msg)
+			return
+		}
+	}
+}
+
+// offlineQueue makes the queue buffer outgoing messages until
+// the client connects again.
+func (c *Client) offlineQueue() {
+	if q := c.sendQueue(); q != nil {
+		q.setOffline()
+	}
+}
+
+func (msg *message) fail(err error) {
+	if msg.errC != nil {
+		msg.errC <- err
+	}
+}
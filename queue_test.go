@@ -0,0 +1,175 @@
+package kite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func newTestMessage(p string) (*message, <-chan error) {
+	errC := make(chan error, 1)
+
+	return &message{
+		p:    []byte(p),
+		errC: errC,
+	}, errC
+}
+
+func drain(t *testing.T, q *sendQueue) []string {
+	var got []string
+
+	for {
+		msg, err := q.pop()
+		if err != nil {
+			t.Fatalf("pop()=%s", err)
+		}
+
+		if msg == nil {
+			return got
+		}
+
+		got = append(got, string(msg.p))
+	}
+}
+
+func TestSendQueue_Policy(t *testing.T) {
+	cases := map[string]struct {
+		policy  DropPolicy
+		want    []string
+		dropped string
+	}{
+		"drop newest": {DropNewest, []string{"a", "b"}, ""},
+		"drop oldest": {DropOldest, []string{"b", "c"}, "a"},
+	}
+
+	for name, cas := range cases {
+		t.Run(name, func(t *testing.T) {
+			q, err := newSendQueue(&QueueOptions{Size: 2, Policy: cas.policy})
+			if err != nil {
+				t.Fatalf("newSendQueue()=%s", err)
+			}
+
+			var errCs []<-chan error
+
+			for i, p := range []string{"a", "b", "c"} {
+				msg, errC := newTestMessage(p)
+				errCs = append(errCs, errC)
+
+				queued, err := q.push(msg)
+
+				if i == 2 && cas.policy == DropNewest {
+					if err != ErrQueueFull {
+						t.Fatalf("got %v, want %v", err, ErrQueueFull)
+					}
+					continue
+				}
+
+				if err != nil || !queued {
+					t.Fatalf("push(%d)=%t, %v", i, queued, err)
+				}
+			}
+
+			if cas.dropped != "" {
+				select {
+				case err := <-errCs[0]:
+					if err != ErrQueueFull {
+						t.Fatalf("got %v, want %v", err, ErrQueueFull)
+					}
+				default:
+					t.Fatal("expected the oldest message to be failed")
+				}
+			}
+
+			if got := drain(t, q); !reflect.DeepEqual(got, cas.want) {
+				t.Fatalf("got %v, want %v", got, cas.want)
+			}
+
+			// Once drained, the queue is online and does not buffer.
+			msg, _ := newTestMessage("d")
+
+			if queued, err := q.push(msg); err != nil || queued {
+				t.Fatalf("push()=%t, %v", queued, err)
+			}
+		})
+	}
+}
+
+func TestSendQueue_Spill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kite-queue")
+	if err != nil {
+		t.Fatalf("TempDir()=%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := newSendQueue(&QueueOptions{
+		Size:      1,
+		SpillFile: filepath.Join(dir, "spill"),
+	})
+	if err != nil {
+		t.Fatalf("newSendQueue()=%s", err)
+	}
+
+	want := []string{"a", "b", "c"}
+
+	for _, p := range want {
+		msg, _ := newTestMessage(p)
+
+		if queued, err := q.push(msg); err != nil || !queued {
+			t.Fatalf("push(%q)=%t, %v", p, queued, err)
+		}
+	}
+
+	if n := q.len(); n != len(want) {
+		t.Fatalf("got %d, want %d", n, len(want))
+	}
+
+	if got := drain(t, q); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	q.close(ErrQueueFull)
+}
+
+func TestSendQueue_SpillDropOldest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kite-queue")
+	if err != nil {
+		t.Fatalf("TempDir()=%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := newSendQueue(&QueueOptions{
+		Size:      2,
+		Policy:    DropOldest,
+		SpillFile: filepath.Join(dir, "spill"),
+		SpillSize: 2,
+	})
+	if err != nil {
+		t.Fatalf("newSendQueue()=%s", err)
+	}
+
+	want := []string{"a", "b", "c", "d"}
+
+	for _, p := range want {
+		msg, _ := newTestMessage(p)
+
+		if queued, err := q.push(msg); err != nil || !queued {
+			t.Fatalf("push(%q)=%t, %v", p, queued, err)
+		}
+	}
+
+	// The queue is full, the new message must not be sent ahead
+	// of the spilled ones.
+	msg, _ := newTestMessage("e")
+
+	if _, err := q.push(msg); err != ErrQueueFull {
+		t.Fatalf("got %v, want %v", err, ErrQueueFull)
+	}
+
+	if got := drain(t, q); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	q.close(ErrQueueFull)
+}
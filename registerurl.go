@@ -19,7 +19,23 @@ const publicEcho = "http://echoip.com"
 // methods Register(), RegisterToProxy(), etc.) It needs to be called after all
 // configurations are done (like TLS, Port,etc.). If local is true a local IP
 // is used, otherwise a public IP is being used.
+//
+// If Config.RegisterURL is set, it's returned instead, with the default
+// path if it has none.
 func (k *Kite) RegisterURL(local bool) *url.URL {
+	if k.Config.RegisterURL != "" {
+		u, err := url.Parse(k.Config.RegisterURL)
+		if err != nil {
+			return nil
+		}
+
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/" + k.name + "-" + k.version + "/kite"
+		}
+
+		return u
+	}
+
 	var ip net.IP
 	var err error
 
@@ -40,9 +56,16 @@ func (k *Kite) RegisterURL(local bool) *url.URL {
 		scheme = "https"
 	}
 
+	// Prefer the port the kite actually listens on, which may differ
+	// from the configured one when a port range is used.
+	port := k.Port()
+	if port == 0 {
+		port = k.Config.Port
+	}
+
 	return &url.URL{
 		Scheme: scheme,
-		Host:   ip.String() + ":" + strconv.Itoa(k.Config.Port),
+		Host:   ip.String() + ":" + strconv.Itoa(port),
 		Path:   "/" + k.name + "-" + k.version + "/kite",
 	}
 }
@@ -5,20 +5,24 @@ import (
 	"errors"
 	"fmt"
 	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/koding/cache"
-	"github.com/koding/kite/dnode"
-	"github.com/koding/kite/kitekey"
-	"github.com/koding/kite/protocol"
-	"github.com/koding/kite/sockjsclient"
-	"github.com/koding/kite/utils"
+	"github.com/koding/kite/v2/dnode"
+	"github.com/koding/kite/v2/kitekey"
+	"github.com/koding/kite/v2/protocol"
+	"github.com/koding/kite/v2/sockjsclient"
 )
 
 // Request contains information about the incoming request.
 type Request struct {
 	// ID is an unique string, which may be used for tracing the request.
+	// It is the ID sent by the caller, if any, and it's sent back in
+	// the Response and every Error. Calls made with Client.TellWithContext
+	// using the Context of the request are sent with the same ID.
 	ID string
 
 	// Method defines the method name which is invoked by the incoming request.
@@ -28,6 +32,10 @@ type Request struct {
 	// This is authenticated and validated if authentication is enabled.
 	Username string
 
+	// Actor is the username of the kite, which made the request on behalf
+	// of Username with a delegated token. It's empty for other requests.
+	Actor string
+
 	// Args defines the incoming arguments for the given method.
 	Args *dnode.Partial
 
@@ -41,14 +49,46 @@ type Request struct {
 	// the type of authentication. This is not used when authentication is disabled.
 	Auth *Auth
 
+	// Metadata holds the metadata sent by the remote kite along with
+	// the request, see Client.Metadata.
+	Metadata map[string]string
+
+	// RemoteAddr, UserAgent and TransportName describe the session the
+	// request was received over, see the methods of Client with the
+	// same names.
+	RemoteAddr    string
+	UserAgent     string
+	TransportName string
+
 	// Context holds a context that used by the current ServeKite handler. Any
 	// items added to the Context can be fetched from other handlers in the
 	// chain. This is useful with PreHandle and PostHandle handlers to pass
 	// data between handlers.
 	//
 	// The context is canceled when client has disconnected or session
-	// was prematurely terminated.
+	// was prematurely terminated. If the caller waits for the response
+	// with a timeout, like with Client.TellWithTimeout, the context
+	// is canceled as well when the timeout passes, so the handler can
+	// abort work no one waits for, or once the response is sent.
+	// The ID of the request can be obtained from it with RequestIDFromContext.
 	Context context.Context
+
+	streamFuncs *streamFuncs // set if the caller reads a stream
+	stream      *Stream
+	streamMu    sync.Mutex // protects stream
+}
+
+type requestIDKey struct{}
+
+// WithRequestID gives a copy of the ctx, which carries the request ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext gives the request ID carried by the ctx.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok && id != ""
 }
 
 // Response is the type of the object that is returned from request handlers
@@ -56,6 +96,7 @@ type Request struct {
 type Response struct {
 	Error  *Error      `json:"error" dnode:"-"`
 	Result interface{} `json:"result"`
+	ID     string      `json:"id,omitempty"`
 }
 
 // runMethod is called when a method is received from remote Kite.
@@ -63,22 +104,37 @@ func (c *Client) runMethod(method *Method, args *dnode.Partial) {
 	var (
 		callFunc func(interface{}, *Error)
 		request  *Request
+		cancel   context.CancelFunc
 	)
 
+	atomic.AddInt32(&c.LocalKite.activeRequests, 1)
+	defer atomic.AddInt32(&c.LocalKite.activeRequests, -1)
+
 	// Recover dnode argument errors and send them back. The caller can use
 	// functions like MustString(), MustSlice()... without the fear of panic.
 	defer func() {
 		if r := recover(); r != nil {
+			stack := debug.Stack()
 			debug.PrintStack()
 			kiteErr := createError(request, r)
 			c.LocalKite.Log.Error(kiteErr.Error()) // let's log it too :)
-			callFunc(nil, kiteErr)
+			if request != nil {
+				request.endStream(kiteErr)
+			}
+			callFunc(nil, withDetails(request, method, kiteErr, r, stack))
+		}
+
+		// Release the context of the request once it's responded.
+		if cancel != nil {
+			cancel()
 		}
 	}()
 
 	// The request that will be constructed from incoming dnode message.
-	request, callFunc = c.newRequest(method.name, args)
-	if method.authenticate {
+	request, callFunc, cancel = c.newRequest(method.name, args)
+	callFunc = c.LocalKite.auditFunc(request, callFunc)
+
+	if method.authenticate && !c.LocalKite.trusted(request, method.group) {
 		if err := request.authenticate(); err != nil {
 			callFunc(nil, createError(request, err))
 			return
@@ -89,6 +145,18 @@ func (c *Client) runMethod(method *Method, args *dnode.Partial) {
 		request.Username = request.Client.Kite.Username
 	}
 
+	// Reject or warn about calls from outdated kites.
+	if err := c.LocalKite.checkClientVersion(c, method.name); err != nil {
+		callFunc(nil, createError(request, err))
+		return
+	}
+
+	// Reject the call until the kite's dependencies are ready.
+	if err := c.LocalKite.checkReady(method.name); err != nil {
+		callFunc(nil, createError(request, err))
+		return
+	}
+
 	method.mu.Lock()
 	if !method.initialized {
 		method.preHandlers = append(method.preHandlers, c.LocalKite.preHandlers...)
@@ -96,6 +164,7 @@ func (c *Client) runMethod(method *Method, args *dnode.Partial) {
 		method.finalFuncs = append(method.finalFuncs, c.LocalKite.finalFuncs...)
 		method.initialized = true
 	}
+	bucket, limiter := method.bucket, method.limiter
 	method.mu.Unlock()
 
 	// check if any throttling is enabled and then check token's available.
@@ -103,7 +172,10 @@ func (c *Client) runMethod(method *Method, args *dnode.Partial) {
 	// is going to take one token from the bucket. If many requests come in (in
 	// span time larger than the bucket's frequency), there will be no token's
 	// available more so it will return a zero.
-	if method.bucket != nil && method.bucket.TakeAvailable(1) == 0 {
+	//
+	// Callers are additionally throttled separately, if the method has
+	// per-caller limits.
+	if (bucket != nil && bucket.TakeAvailable(1) == 0) || (limiter != nil && !limiter.take(request)) {
 		callFunc(nil, &Error{
 			Type:      "requestLimitError",
 			Message:   "The maximum request rate is exceeded.",
@@ -112,10 +184,23 @@ func (c *Client) runMethod(method *Method, args *dnode.Partial) {
 		return
 	}
 
+	release, busyErr := method.acquire(request)
+	if busyErr != nil {
+		callFunc(nil, createError(request, busyErr))
+		return
+	}
+	defer release()
+
 	// Call the handler functions.
 	result, err := method.ServeKite(request)
 
-	callFunc(result, createError(request, err))
+	kiteErr := withDetails(request, method, createError(request, err), err, nil)
+
+	// End the stream before the response, so the caller reads
+	// all the chunks.
+	request.endStream(kiteErr)
+
+	callFunc(result, kiteErr)
 }
 
 // runCallback is called when a callback method call is received from remote Kite.
@@ -132,13 +217,15 @@ func (c *Client) runCallback(callback func(*dnode.Partial), args *dnode.Partial)
 }
 
 // newRequest returns a new *Request from the method and arguments passed.
-func (c *Client) newRequest(method string, args *dnode.Partial) (*Request, func(interface{}, *Error)) {
+// The cancel func releases the context of the request, it must be called
+// after the response is sent.
+func (c *Client) newRequest(method string, args *dnode.Partial) (*Request, func(interface{}, *Error), context.CancelFunc) {
 	// Parse dnode method arguments: [options]
 	var options callOptions
 	args.One().MustUnmarshal(&options)
 
 	// Notify the handlers registered with Kite.OnFirstRequest().
-	if _, ok := c.session.(*sockjsclient.WebsocketSession); !ok {
+	if _, ok := c.session.(*sockjsclient.WebsocketSession); !ok && !dialedByTransport(c.session) {
 		c.firstRequestHandlersNotified.Do(func() {
 			c.m.Lock()
 			c.Kite = options.Kite
@@ -147,26 +234,51 @@ func (c *Client) newRequest(method string, args *dnode.Partial) (*Request, func(
 		})
 	}
 
+	// Reuse the ID of the caller, so the request can be correlated
+	// across kites.
+	id := options.RequestID
+	if id == "" {
+		id = c.LocalKite.newID()
+	}
+
+	ctx := c.context()
+	cancel := context.CancelFunc(func() {})
+
+	// Bound the request by the deadline of the caller.
+	if options.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(options.Timeout)*time.Millisecond)
+	}
+
 	request := &Request{
-		ID:        utils.RandomString(16),
+		ID:        id,
 		Method:    method,
 		Args:      options.WithArgs,
 		LocalKite: c.LocalKite,
 		Client:    c,
 		Auth:      options.Auth,
-		Context:   c.context(),
+		Metadata:  options.Metadata,
+		Context:   WithRequestID(ctx, id),
+
+		streamFuncs: options.Stream,
 	}
 
+	request.RemoteAddr, request.UserAgent, request.TransportName = c.sessionInfo()
+
 	// Call response callback function, send back our response
 	callFunc := func(result interface{}, err *Error) {
 		if options.ResponseCallback.Caller == nil {
 			return
 		}
 
+		if err != nil && err.RequestID == "" {
+			err.RequestID = id
+		}
+
 		// Only argument to the callback.
 		response := Response{
 			Result: result,
 			Error:  err,
+			ID:     id,
 		}
 
 		if err := options.ResponseCallback.Call(response); err != nil {
@@ -174,7 +286,7 @@ func (c *Client) newRequest(method string, args *dnode.Partial) (*Request, func(
 		}
 	}
 
-	return request, callFunc
+	return request, callFunc, cancel
 }
 
 // authenticate tries to authenticate the user by selecting appropriate
@@ -190,6 +302,10 @@ func (r *Request) authenticate() *Error {
 		return nil
 	}
 
+	if dialedByTransport(r.Client.session) {
+		return nil
+	}
+
 	if r.Auth == nil {
 		return &Error{
 			Type:    "authenticationError",
@@ -225,7 +341,10 @@ func (r *Request) authenticate() *Error {
 func (k *Kite) AuthenticateFromToken(r *Request) error {
 	k.verifyOnce.Do(k.verifyInit)
 
-	token, err := jwt.ParseWithClaims(r.Auth.Key, &kitekey.KiteClaims{}, r.LocalKite.RSAKey)
+	// The time claims are validated below with Config.TokenLeeway.
+	p := &jwt.Parser{SkipClaimsValidation: true}
+
+	token, err := p.ParseWithClaims(r.Auth.Key, &kitekey.KiteClaims{}, r.LocalKite.RSAKey)
 
 	if e, ok := err.(*jwt.ValidationError); ok {
 		// Translate public key mismatch errors to token-is-expired one.
@@ -249,6 +368,10 @@ func (k *Kite) AuthenticateFromToken(r *Request) error {
 		return errors.New("token does not have valid claims")
 	}
 
+	if err := k.validateTokenTime(claims); err != nil {
+		return err
+	}
+
 	if claims.Audience == "" {
 		return errors.New("token has no audience")
 	}
@@ -262,15 +385,48 @@ func (k *Kite) AuthenticateFromToken(r *Request) error {
 		return err
 	}
 
-	// We don't check for exp and nbf claims here because jwt-go package
-	// already checks them.
-
 	// replace the requester username so we reflect the validated
 	r.Username = claims.Subject
+	r.Actor = claims.Actor
 
 	return nil
 }
 
+// AuthenticateFromTokenID is the default Authenticator for the "tokenID"
+// authentication type. The client sends only the ID of the token, which
+// is fetched from Kontrol on first use and cached afterwards.
+func (k *Kite) AuthenticateFromTokenID(r *Request) error {
+	k.verifyOnce.Do(k.verifyInit)
+
+	id := r.Auth.Key
+
+	var token string
+
+	if k.tokenIDCache != nil {
+		if v, err := k.tokenIDCache.Get(id); err == nil {
+			token = v.(string)
+		}
+	}
+
+	if token == "" {
+		var err error
+		if token, err = k.GetTokenByID(id); err != nil {
+			return fmt.Errorf("unable to fetch token %q: %s", id, err)
+		}
+
+		if k.tokenIDCache != nil {
+			k.tokenIDCache.Set(id, token)
+		}
+	}
+
+	r.Auth = &Auth{
+		Type: "token",
+		Key:  token,
+	}
+
+	return k.AuthenticateFromToken(r)
+}
+
 // AuthenticateFromKiteKey authenticates user from kite key.
 func (k *Kite) AuthenticateFromKiteKey(r *Request) error {
 	claims := &kitekey.KiteClaims{}
@@ -340,9 +496,11 @@ func (k *Kite) verifyInit() {
 	if ttl > 0 {
 		k.mu.Lock()
 		k.verifyCache = cache.NewMemoryWithTTL(ttl)
+		k.tokenIDCache = cache.NewMemoryWithTTL(ttl)
 		k.mu.Unlock()
 
 		k.verifyCache.StartGC(ttl / 2)
+		k.tokenIDCache.StartGC(ttl / 2)
 	}
 
 	key, err := jwt.ParseRSAPublicKeyFromPEM([]byte(k.Config.KontrolKey))
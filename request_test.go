@@ -0,0 +1,255 @@
+package kite
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/koding/kite/v2/config"
+)
+
+func TestRequestID(t *testing.T) {
+	cfg := config.New()
+	cfg.Port = 3662
+	cfg.DisableAuthentication = true
+
+	k := NewWithConfig("requestid", "0.0.1", cfg)
+
+	ids := make(chan string, 1)
+
+	k.HandleFunc("inner", func(r *Request) (interface{}, error) {
+		ids <- r.ID
+		return nil, errors.New("inner failed")
+	})
+
+	k.HandleFunc("outer", func(r *Request) (interface{}, error) {
+		c := r.LocalKite.NewClient("http://127.0.0.1:3662/kite")
+		if err := c.Dial(); err != nil {
+			return nil, err
+		}
+		defer c.Close()
+
+		return c.TellWithContext(r.Context, "inner")
+	})
+
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	c := New("requestid-client", "0.0.1").NewClient("http://127.0.0.1:3662/kite")
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	_, err := c.TellWithContext(WithRequestID(context.Background(), "abc"), "outer")
+	if err == nil {
+		t.Fatal("want TellWithContext() to fail")
+	}
+
+	if id := <-ids; id != "abc" {
+		t.Fatalf("got downstream request ID %q, want %q", id, "abc")
+	}
+
+	if e, ok := err.(*Error); !ok || e.RequestID != "abc" {
+		t.Fatalf("got %#v, want error with request ID %q", err, "abc")
+	}
+
+	_, err = c.Tell("inner")
+	if err == nil {
+		t.Fatal("want Tell() to fail")
+	}
+
+	id := <-ids
+	if e, ok := err.(*Error); !ok || id == "" || e.RequestID != id {
+		t.Fatalf("got %#v, want error with request ID %q", err, id)
+	}
+}
+
+func TestRequestDeadline(t *testing.T) {
+	cfg := config.New()
+	cfg.Port = 3665
+	cfg.DisableAuthentication = true
+
+	k := NewWithConfig("deadline", "0.0.1", cfg)
+
+	deadlines := make(chan bool, 1)
+	aborted := make(chan error, 1)
+
+	k.HandleFunc("slow", func(r *Request) (interface{}, error) {
+		_, ok := r.Context.Deadline()
+		deadlines <- ok
+
+		select {
+		case <-r.Context.Done():
+			aborted <- r.Context.Err()
+		case <-time.After(2 * time.Second):
+			aborted <- nil
+		}
+
+		return nil, nil
+	})
+
+	contexts := make(chan context.Context, 1)
+
+	k.HandleFunc("fast", func(r *Request) (interface{}, error) {
+		contexts <- r.Context
+		return nil, nil
+	})
+
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	c := New("deadline-client", "0.0.1").NewClient("http://127.0.0.1:3665/kite")
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	if _, err := c.TellWithTimeout("slow", 100*time.Millisecond); err == nil {
+		t.Fatal("want TellWithTimeout() to time out")
+	}
+
+	if ok := <-deadlines; !ok {
+		t.Fatal("want request context to have a deadline")
+	}
+
+	if err := <-aborted; err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %s", err, context.DeadlineExceeded)
+	}
+
+	if _, err := c.TellWithTimeout("fast", time.Second); err != nil {
+		t.Fatalf("TellWithTimeout()=%s", err)
+	}
+
+	select {
+	case <-(<-contexts).Done():
+	case <-time.After(time.Second):
+		t.Fatal("want request context to be released after the response")
+	}
+
+	go c.Tell("slow")
+
+	if ok := <-deadlines; ok {
+		t.Fatal("want request context to have no deadline")
+	}
+}
+
+func TestRequestMetadata(t *testing.T) {
+	cfg := config.New()
+	cfg.Port = 3666
+	cfg.DisableAuthentication = true
+
+	k := NewWithConfig("metadata", "0.0.1", cfg)
+
+	k.HandleFunc("metadata", func(r *Request) (interface{}, error) {
+		return r.Metadata, nil
+	})
+
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	ccfg := config.New()
+	ccfg.Metadata = map[string]string{"tenant": "koding"}
+
+	c := NewWithConfig("metadata-client", "0.0.1", ccfg).NewClient("http://127.0.0.1:3666/kite")
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	c.WithMetadata("tenant", "acme").WithMetadata("locale", "en-US")
+
+	res, err := c.Tell("metadata")
+	if err != nil {
+		t.Fatalf("Tell()=%s", err)
+	}
+
+	var got map[string]string
+	if err := res.Unmarshal(&got); err != nil {
+		t.Fatalf("Unmarshal()=%s", err)
+	}
+
+	want := map[string]string{"tenant": "acme", "locale": "en-US"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	if ccfg.Metadata["tenant"] != "koding" {
+		t.Fatalf("got %q, want config metadata to be unchanged", ccfg.Metadata["tenant"])
+	}
+}
+
+func TestRequestSessionInfo(t *testing.T) {
+	cfg := config.New()
+	cfg.Port = 3672
+	cfg.DisableAuthentication = true
+
+	k := NewWithConfig("sessioninfo", "0.0.1", cfg)
+
+	k.HandleFunc("info", func(r *Request) (interface{}, error) {
+		return []string{r.RemoteAddr, r.UserAgent, r.TransportName}, nil
+	})
+
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	cases := map[config.Transport]string{
+		config.WebSocket:  "websocket",
+		config.XHRPolling: "xhr",
+	}
+
+	for transport, name := range cases {
+		t.Run(name, func(t *testing.T) {
+			ck := New("sessioninfo-client", "0.0.1")
+			ck.Config.Transport = transport
+
+			c := ck.NewClient("http://127.0.0.1:3672/kite")
+			if err := c.Dial(); err != nil {
+				t.Fatalf("Dial()=%s", err)
+			}
+			defer c.Close()
+
+			if got, want := c.RemoteAddr(), "127.0.0.1:3672"; got != want {
+				t.Errorf("got client remote address %q, want %q", got, want)
+			}
+
+			if got := c.TransportName(); got != name {
+				t.Errorf("got client transport %q, want %q", got, name)
+			}
+
+			resp, err := c.Tell("info")
+			if err != nil {
+				t.Fatalf("Tell()=%s", err)
+			}
+
+			var info []string
+			if err := resp.Unmarshal(&info); err != nil {
+				t.Fatalf("Unmarshal()=%s", err)
+			}
+
+			if len(info) != 3 {
+				t.Fatalf("got %v, want remote address, user agent and transport", info)
+			}
+
+			if host, _, err := net.SplitHostPort(info[0]); err != nil || host != "127.0.0.1" {
+				t.Errorf("got remote address %q, want 127.0.0.1:port", info[0])
+			}
+
+			if info[1] == "" {
+				t.Error("want non-empty user agent")
+			}
+
+			if info[2] != name {
+				t.Errorf("got transport %q, want %q", info[2], name)
+			}
+		})
+	}
+}
@@ -0,0 +1,475 @@
+package kite
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/koding/kite/v2/utils"
+)
+
+// Session resumption lets a client, which reconnects within
+// Config.ResumeGracePeriod, continue its previous session. The remote
+// kite keeps the disconnected Client around for the grace period, so
+// callbacks and pending method calls of both sides keep working.
+//
+// Both sides count the dnode messages sent and received during the session
+// and keep the last resumeBufferSize sent messages. On reconnect the client
+// sends a resume frame with the session ID and the number of messages it
+// received, the remote kite replies with a resumed frame with its own number
+// and both sides send again the messages the other side has not received.
+//
+// The frames are not dnode messages and they are exchanged only after
+// the remote kite accepted the session ID with the "kite.resume" method,
+// so kites which do not support resumption never receive them.
+const (
+	resumeFrame   = "kite.resume:"
+	resumedFrame  = "kite.resumed:"
+	rejectedFrame = "kite.rejected"
+)
+
+// resumeBufferSize is the number of sent messages kept for retransmission.
+// The session can't be resumed, if the other side has missed more of them.
+const resumeBufferSize = 1024
+
+var (
+	errResumed        = errors.New("session was resumed by another client")
+	errResumeRejected = errors.New("session resumption was rejected")
+)
+
+// resumeArgs is the payload of the resume and resumed frames.
+type resumeArgs struct {
+	ID       string `json:"id,omitempty"`
+	Received uint64 `json:"received"`
+}
+
+// resumeRequest is sent to the suspended client, which is being resumed
+// with the new session.
+type resumeRequest struct {
+	session  Session
+	received uint64
+	done     chan error
+}
+
+// resumeState keeps the state of session resumption of a Client.
+type resumeState struct {
+	// mu protects the fields below and serializes sending over the session,
+	// so the messages are counted in the order they are sent.
+	mu sync.Mutex
+
+	id      string   // ID of the session, non-empty when resumable
+	enabled bool     // whether sent messages are kept
+	served  bool     // whether the client was created by ServeSession
+	sent    uint64   // number of sent messages
+	buf     [][]byte // the last sent messages, up to resumeBufferSize
+
+	received uint64 // number of received messages, accessed atomically
+
+	requests chan *resumeRequest
+}
+
+// isControlFrame reports whether the received data is a resumption
+// frame, dnode messages are always JSON objects.
+func isControlFrame(p []byte) bool {
+	return strings.HasPrefix(string(p), "kite.")
+}
+
+// resetResume starts counting messages of a new session.
+func (c *Client) resetResume() {
+	c.resume.mu.Lock()
+	c.resume.id = ""
+	c.resume.enabled = c.config().ResumeGracePeriod > 0
+	c.resume.sent = 0
+	c.resume.buf = nil
+	c.resetAcks()
+	c.resume.mu.Unlock()
+
+	atomic.StoreUint64(&c.resume.received, 0)
+}
+
+func (c *Client) resumeID() string {
+	c.resume.mu.Lock()
+	defer c.resume.mu.Unlock()
+
+	return c.resume.id
+}
+
+// resumable reports whether the session can be resumed.
+func (c *Client) resumable() bool {
+	return c.resumeID() != ""
+}
+
+// sendPayload sends the payload over the current session and counts it.
+// It gives the session used, which is nil if the client is not connected.
+func (c *Client) sendPayload(p []byte) (Session, error) {
+	c.resume.mu.Lock()
+	defer c.resume.mu.Unlock()
+
+	session := c.getSession()
+	if session == nil {
+		return nil, nil
+	}
+
+	c.resume.sent++
+
+	c.trackAck(c.resume.sent, p)
+
+	if c.resume.enabled {
+		c.resume.buf = append(c.resume.buf, p)
+
+		if n := len(c.resume.buf); n > resumeBufferSize {
+			c.resume.buf = c.resume.buf[n-resumeBufferSize:]
+		}
+	}
+
+	msg, err := encodePayload(session, p)
+	if err != nil {
+		return session, err
+	}
+
+	return session, session.Send(msg)
+}
+
+// sendFrame sends the control frame over the session, it is not counted.
+func (c *Client) sendFrame(session Session, frame string) error {
+	c.resume.mu.Lock()
+	defer c.resume.mu.Unlock()
+
+	return session.Send(frame)
+}
+
+// acceptResume continues the session over the new one. The messages
+// the other side has not received are sent again, after the optional
+// frame.
+func (c *Client) acceptResume(session Session, received uint64, frame string) error {
+	c.resume.mu.Lock()
+	defer c.resume.mu.Unlock()
+
+	first := c.resume.sent - uint64(len(c.resume.buf))
+
+	if received > c.resume.sent || received < first {
+		return fmt.Errorf("messages after %d are not available", received)
+	}
+
+	if frame != "" {
+		if err := session.Send(frame); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range c.resume.buf[received-first:] {
+		msg, err := encodePayload(session, p)
+		if err != nil {
+			return err
+		}
+
+		if err := session.Send(msg); err != nil {
+			return err
+		}
+	}
+
+	c.setSession(session)
+
+	// Drop the interrupt of the previous session, if any.
+	select {
+	case <-c.interrupt:
+	default:
+	}
+
+	c.startSendHub()
+
+	return nil
+}
+
+// registerResume registers the session with the remote kite, so it can
+// be resumed after reconnect.
+func (c *Client) registerResume() {
+	// Clients of connected kites are resumed by the kites themselves.
+	if c.URL == "" || c.config().ResumeGracePeriod <= 0 {
+		return
+	}
+
+	id := utils.RandomString(20)
+
+	if _, err := c.TellWithTimeout("kite.resume", c.config().Timeout, id); err != nil {
+		c.LocalKite.Log.Debug("Session resumption with %s is not available: %s", c.URL, err)
+		return
+	}
+
+	c.resume.mu.Lock()
+	c.resume.id = id
+	c.resume.mu.Unlock()
+}
+
+// resumeSession redials the remote kite and resumes the session. It gives
+// false, if the session was not resumed within the grace period.
+func (c *Client) resumeSession() bool {
+	grace := c.config().ResumeGracePeriod
+	id := c.resumeID()
+
+	if grace <= 0 || id == "" {
+		return false
+	}
+
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = grace
+
+	for c.reconnect() {
+		c.LocalKite.Log.Info("Resuming session with '%s' kite: %s", c.Kite.Name, c.URL)
+
+		session, err := c.dialSession()
+		if err == nil {
+			if err = c.handshakeResume(session, id); err == nil {
+				return true
+			}
+
+			session.Close(3000, "Go away!")
+
+			if err == errResumeRejected {
+				return false
+			}
+		}
+
+		c.LocalKite.Log.Warning("Resuming session with '%s' kite error: %s: %v", c.Kite.Name, c.URL, err)
+
+		next := b.NextBackOff()
+		if next == backoff.Stop {
+			return false
+		}
+
+		select {
+		case <-time.After(next):
+		case <-c.closeChan:
+			return false
+		}
+	}
+
+	return false
+}
+
+// handshakeResume asks the remote kite to resume the session over
+// the new one.
+func (c *Client) handshakeResume(session Session, id string) error {
+	args, err := json.Marshal(&resumeArgs{
+		ID:       id,
+		Received: atomic.LoadUint64(&c.resume.received),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := c.sendFrame(session, resumeFrame+string(args)); err != nil {
+		return err
+	}
+
+	for {
+		msg, err := recvTimeout(session, c.config().Timeout)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case msg == rejectedFrame:
+			return errResumeRejected
+		case strings.HasPrefix(msg, resumedFrame):
+			var resumed resumeArgs
+
+			if err := json.Unmarshal([]byte(msg[len(resumedFrame):]), &resumed); err != nil {
+				return err
+			}
+
+			return c.acceptResume(session, resumed.Received, "")
+		}
+
+		// Messages sent by the remote kite over the new session, before
+		// it was resumed, are dropped along with the new session.
+	}
+}
+
+func recvTimeout(session Session, timeout time.Duration) (string, error) {
+	type recv struct {
+		msg string
+		err error
+	}
+
+	done := make(chan recv, 1)
+
+	go func() {
+		msg, err := session.Recv()
+		done <- recv{msg, err}
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+
+	select {
+	case r := <-done:
+		return r.msg, r.err
+	case <-expired:
+		return "", fmt.Errorf("no response within %s", timeout)
+	}
+}
+
+// handleControlFrame handles the ack frames and the resume frames received
+// by a served client. It returns errResumed, if the session was handed
+// over to the resumed client.
+func (c *Client) handleControlFrame(p []byte) error {
+	if strings.HasPrefix(string(p), ackFrame) {
+		c.handleAck(p)
+		return nil
+	}
+
+	var args resumeArgs
+
+	if !strings.HasPrefix(string(p), resumeFrame) || json.Unmarshal(p[len(resumeFrame):], &args) != nil {
+		c.LocalKite.Log.Warning("unexpected control frame: %s", p)
+		return nil
+	}
+
+	session := c.getSession()
+	if session == nil {
+		return nil
+	}
+
+	old := c.LocalKite.resumableClient(args.ID)
+	if old == nil || old == c {
+		return c.sendFrame(session, rejectedFrame)
+	}
+
+	// Messages sent by this client must not be mixed with the resumed ones.
+	c.resume.mu.Lock()
+	c.setSession(nil)
+	c.resume.mu.Unlock()
+
+	if err := old.requestResume(session, args.Received); err != nil {
+		c.LocalKite.Log.Debug("Unable to resume session %q: %s", args.ID, err)
+
+		c.setSession(session)
+
+		return c.sendFrame(session, rejectedFrame)
+	}
+
+	return errResumed
+}
+
+// requestResume asks the suspended client to continue over the session.
+func (c *Client) requestResume(session Session, received uint64) error {
+	req := &resumeRequest{
+		session:  session,
+		received: received,
+		done:     make(chan error, 1),
+	}
+
+	// The remote kite may have reconnected before the old session broke
+	// on this side, close it so the client gets suspended.
+	if old := c.getSession(); old != nil {
+		old.Close(3000, "Go away!")
+	}
+
+	select {
+	case c.resume.requests <- req:
+		return <-req.done
+	case <-time.After(c.config().ResumeGracePeriod):
+		return errors.New("session is not suspended")
+	case <-c.closeChan:
+		return errors.New("client is closed")
+	}
+}
+
+// waitResume suspends the served client, whose session broke, until
+// it's resumed by the remote kite. It gives false, if the client was not
+// resumed within the grace period.
+func (c *Client) waitResume() bool {
+	grace := c.config().ResumeGracePeriod
+	id := c.resumeID()
+
+	if grace <= 0 || id == "" {
+		return false
+	}
+
+	c.LocalKite.Log.Debug("Session %q is suspended for %s", id, grace)
+
+	t := time.NewTimer(grace)
+	defer t.Stop()
+
+	for {
+		select {
+		case req := <-c.resume.requests:
+			var received resumeArgs
+			received.Received = atomic.LoadUint64(&c.resume.received)
+
+			frame, err := json.Marshal(&received)
+			if err == nil {
+				err = c.acceptResume(req.session, req.received, resumedFrame+string(frame))
+			}
+
+			req.done <- err
+
+			if err == nil {
+				c.LocalKite.Log.Debug("Session %q is resumed", id)
+				return true
+			}
+		case <-t.C:
+			return false
+		case <-c.closeChan:
+			return false
+		case <-c.LocalKite.closeC:
+			return false
+		}
+	}
+}
+
+// handleResume registers the session of the caller, so it can be resumed
+// after the caller reconnects.
+func (k *Kite) handleResume(r *Request) (interface{}, error) {
+	if k.Config.ResumeGracePeriod <= 0 || !r.Client.resume.served {
+		return nil, errors.New("session resumption is disabled")
+	}
+
+	var id string
+	if err := r.Args.One().Unmarshal(&id); err != nil || id == "" {
+		return nil, errors.New("invalid session ID")
+	}
+
+	r.Client.resume.mu.Lock()
+	r.Client.resume.id = id
+	r.Client.resume.enabled = true
+	r.Client.resume.mu.Unlock()
+
+	k.resumableMu.Lock()
+	if k.resumable == nil {
+		k.resumable = make(map[string]*Client)
+	}
+	k.resumable[id] = r.Client
+	k.resumableMu.Unlock()
+
+	return true, nil
+}
+
+func (k *Kite) resumableClient(id string) *Client {
+	k.resumableMu.Lock()
+	defer k.resumableMu.Unlock()
+
+	return k.resumable[id]
+}
+
+// forgetResumable removes the client, whose session is over.
+func (k *Kite) forgetResumable(c *Client) {
+	id := c.resumeID()
+	if id == "" {
+		return
+	}
+
+	k.resumableMu.Lock()
+	if k.resumable[id] == c {
+		delete(k.resumable, id)
+	}
+	k.resumableMu.Unlock()
+}
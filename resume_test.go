@@ -0,0 +1,94 @@
+package kite
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/koding/kite/v2/config"
+)
+
+func TestResumeSession(t *testing.T) {
+	cfg := config.New()
+	cfg.Port = 3660
+	cfg.DisableAuthentication = true
+	cfg.ResumeGracePeriod = 10 * time.Second
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+
+	k := NewWithConfig("resume", "0.0.1", cfg)
+	k.HandleFunc("wait", func(r *Request) (interface{}, error) {
+		started <- struct{}{}
+		<-release
+		return "done", nil
+	})
+	k.HandleFunc("echo", func(r *Request) (interface{}, error) {
+		return r.Args.One().MustString(), nil
+	})
+
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	ccfg := config.New()
+	ccfg.ResumeGracePeriod = 10 * time.Second
+
+	c := NewWithConfig("resume-client", "0.0.1", ccfg).NewClient("http://127.0.0.1:3660/kite")
+
+	var disconnects int32
+	c.OnDisconnect(func() {
+		atomic.AddInt32(&disconnects, 1)
+	})
+
+	connected, err := c.DialForever()
+	if err != nil {
+		t.Fatalf("DialForever()=%s", err)
+	}
+	defer c.Close()
+
+	<-connected
+
+	for timeout := time.After(5 * time.Second); !c.resumable(); {
+		select {
+		case <-timeout:
+			t.Fatal("session was not registered for resumption")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	done := c.Go("wait")
+
+	<-started
+
+	// Break the connection while the call is pending, the response is sent
+	// while the client is disconnected.
+	c.getSession().Close(3000, "Go away!")
+	close(release)
+
+	select {
+	case resp := <-done:
+		if resp.Err != nil {
+			t.Fatalf("Go()=%s", resp.Err)
+		}
+
+		if s := resp.Result.MustString(); s != "done" {
+			t.Fatalf("got %q, want %q", s, "done")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for response")
+	}
+
+	result, err := c.TellWithTimeout("echo", 5*time.Second, "hello")
+	if err != nil {
+		t.Fatalf("Tell()=%s", err)
+	}
+
+	if s := result.MustString(); s != "hello" {
+		t.Fatalf("got %q, want %q", s, "hello")
+	}
+
+	if n := atomic.LoadInt32(&disconnects); n != 0 {
+		t.Fatalf("got %d disconnects, want 0", n)
+	}
+}
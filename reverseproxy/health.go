@@ -0,0 +1,172 @@
+package reverseproxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/koding/kite/v2"
+)
+
+var (
+	// DefaultHealthCheckInterval is used when Proxy.HealthCheckInterval is 0.
+	DefaultHealthCheckInterval = 10 * time.Second
+
+	// DefaultHealthCheckTimeout is used when Proxy.HealthCheckTimeout is 0.
+	DefaultHealthCheckTimeout = 5 * time.Second
+
+	// DefaultHealthCheckFailures is used when Proxy.HealthCheckFailures is 0.
+	DefaultHealthCheckFailures = 2
+)
+
+// healthChecker holds the state of health checks of the backend kites,
+// keyed by the target URLs. It's used by a single goroutine.
+type healthChecker struct {
+	clients  map[string]*kite.Client
+	failures map[string]int
+}
+
+func (p *Proxy) healthCheckInterval() time.Duration {
+	if p.HealthCheckInterval != 0 {
+		return p.HealthCheckInterval
+	}
+	return DefaultHealthCheckInterval
+}
+
+func (p *Proxy) healthCheckTimeout() time.Duration {
+	if p.HealthCheckTimeout > 0 {
+		return p.HealthCheckTimeout
+	}
+	return DefaultHealthCheckTimeout
+}
+
+func (p *Proxy) healthCheckFailures() int {
+	if p.HealthCheckFailures > 0 {
+		return p.HealthCheckFailures
+	}
+	return DefaultHealthCheckFailures
+}
+
+// healthCheck checks the backends every HealthCheckInterval until
+// the proxy is closed.
+func (p *Proxy) healthCheck() {
+	interval := p.healthCheckInterval()
+	if interval < 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.checkHealth()
+		case <-p.closeC:
+			for _, c := range p.health.clients {
+				c.Close()
+			}
+			return
+		}
+	}
+}
+
+// checkHealth pings all backends concurrently. A backend, which fails
+// HealthCheckFailures pings in a row, is marked unhealthy and is not
+// routed to until it answers a ping again.
+func (p *Proxy) checkHealth() {
+	h := &p.health
+
+	if h.clients == nil {
+		h.clients = make(map[string]*kite.Client)
+		h.failures = make(map[string]int)
+	}
+
+	urls := p.Routes.urls()
+	current := make(map[string]struct{}, len(urls))
+
+	for _, u := range urls {
+		current[u] = struct{}{}
+	}
+
+	// Forget the backends removed from the routing table.
+	for u := range h.failures {
+		if _, ok := current[u]; !ok {
+			delete(h.failures, u)
+			p.Routes.SetHealthy(u, true)
+		}
+	}
+
+	for u, c := range h.clients {
+		if _, ok := current[u]; !ok {
+			c.Close()
+			delete(h.clients, u)
+		}
+	}
+
+	clients := make([]*kite.Client, len(urls))
+	dial := make([]bool, len(urls))
+	errs := make([]error, len(urls))
+
+	for i, u := range urls {
+		if clients[i] = h.clients[u]; clients[i] == nil {
+			clients[i] = p.Kite.NewClient(u)
+			dial[i] = true
+		}
+	}
+
+	timeout := p.healthCheckTimeout()
+
+	var wg sync.WaitGroup
+
+	for i := range urls {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			errs[i] = ping(clients[i], dial[i], timeout)
+		}(i)
+	}
+
+	wg.Wait()
+
+	threshold := p.healthCheckFailures()
+
+	for i, u := range urls {
+		if errs[i] == nil {
+			h.clients[u] = clients[i]
+
+			if h.failures[u] >= threshold {
+				p.Kite.Log.Info("Backend %q is healthy again", u)
+				p.Routes.SetHealthy(u, true)
+			}
+
+			delete(h.failures, u)
+			continue
+		}
+
+		// The client is dialed again on the next check.
+		clients[i].Close()
+		delete(h.clients, u)
+
+		if h.failures[u]++; h.failures[u] == threshold {
+			p.Kite.Log.Warning("Backend %q is unhealthy, not routing to it: %s", u, errs[i])
+			p.Routes.SetHealthy(u, false)
+		} else {
+			p.Kite.Log.Debug("Health check of backend %q failed: %s", u, errs[i])
+		}
+	}
+}
+
+// ping calls the "kite.ping" method of the backend, dialing it first
+// if dial is true.
+func ping(c *kite.Client, dial bool, timeout time.Duration) error {
+	if dial {
+		if err := c.DialTimeout(timeout); err != nil {
+			return err
+		}
+	}
+
+	_, err := c.TellWithTimeout("kite.ping", timeout)
+	return err
+}
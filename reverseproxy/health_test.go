@@ -0,0 +1,69 @@
+package reverseproxy
+
+import (
+	"testing"
+
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/config"
+)
+
+func TestHealthCheck(t *testing.T) {
+	const backendURL = "http://127.0.0.1:7778/kite"
+
+	conf := config.New()
+	conf.Port = 7779
+
+	p := New(conf)
+	p.HealthCheckFailures = 2
+	defer func() {
+		for _, c := range p.health.clients {
+			c.Close()
+		}
+	}()
+
+	p.Routes.Add("route", Target{KiteID: "backend", URL: backendURL, Weight: 1})
+
+	// The backend is not running, it becomes unhealthy after two checks.
+	p.checkHealth()
+
+	if !p.Routes.Healthy(backendURL) {
+		t.Fatal("expected backend to be healthy after a single failure")
+	}
+
+	p.checkHealth()
+
+	if p.Routes.Healthy(backendURL) {
+		t.Fatal("expected backend to be unhealthy")
+	}
+
+	if _, err := p.Routes.Pick("route", ""); err != ErrNoHealthyTarget {
+		t.Fatalf("got %v, want %v", err, ErrNoHealthyTarget)
+	}
+
+	backendConf := config.New()
+	backendConf.Port = 7778
+	backendConf.DisableAuthentication = true
+
+	backend := kite.NewWithConfig("backend", "0.0.1", backendConf)
+	go backend.Run()
+	<-backend.ServerReadyNotify()
+	defer backend.Close()
+
+	p.checkHealth()
+
+	if !p.Routes.Healthy(backendURL) {
+		t.Fatal("expected backend to be healthy again")
+	}
+
+	if _, err := p.Routes.Pick("route", ""); err != nil {
+		t.Fatalf("Pick()=%s", err)
+	}
+
+	// Removed backends are forgotten.
+	p.Routes.RemoveKite("backend")
+	p.checkHealth()
+
+	if len(p.health.clients) != 0 || len(p.health.failures) != 0 {
+		t.Fatalf("got %d clients and %d failures, want none", len(p.health.clients), len(p.health.failures))
+	}
+}
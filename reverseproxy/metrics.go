@@ -0,0 +1,121 @@
+package reverseproxy
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/koding/kite/v2/metrics"
+)
+
+// proxyMetrics are the Prometheus metrics of the proxied requests.
+type proxyMetrics struct {
+	requests *metrics.Counter
+	duration *metrics.Histogram
+	bytesIn  *metrics.Counter
+	bytesOut *metrics.Counter
+}
+
+func (p *Proxy) newMetrics() {
+	p.Metrics = metrics.NewRegistry()
+
+	p.metrics = proxyMetrics{
+		requests: p.Metrics.NewCounter("kite_reverseproxy_requests_total",
+			"Number of proxied requests.", "route", "code"),
+		duration: p.Metrics.NewHistogram("kite_reverseproxy_request_duration_seconds",
+			"Duration of proxied requests, until the websocket connection is closed for websockets.", nil, "route"),
+		bytesIn: p.Metrics.NewCounter("kite_reverseproxy_received_bytes_total",
+			"Number of bytes received from the clients.", "route"),
+		bytesOut: p.Metrics.NewCounter("kite_reverseproxy_sent_bytes_total",
+			"Number of bytes sent to the clients.", "route"),
+	}
+
+	p.Metrics.NewGaugeFunc("kite_reverseproxy_routes", "Number of routes.", func() float64 {
+		return float64(len(p.Routes.Routes()))
+	})
+
+	p.Metrics.NewGaugeFunc("kite_reverseproxy_unhealthy_backends", "Number of backends which failed health checks.", func() float64 {
+		n := 0
+		for _, targets := range p.Routes.Routes() {
+			for _, t := range targets {
+				if t.Unhealthy {
+					n++
+				}
+			}
+		}
+		return float64(n)
+	})
+}
+
+// requestInfo is filled by the backend while proxying a request.
+type requestInfo struct {
+	mu     sync.Mutex
+	route  string
+	kiteID string
+}
+
+func (ri *requestInfo) set(route, kiteID string) {
+	ri.mu.Lock()
+	ri.route, ri.kiteID = route, kiteID
+	ri.mu.Unlock()
+}
+
+func (ri *requestInfo) get() (route, kiteID string) {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+
+	return ri.route, ri.kiteID
+}
+
+type requestInfoKey struct{}
+
+// setRequestInfo records the route and the backend kite of the request
+// for the access log and metrics.
+func setRequestInfo(req *http.Request, route, kiteID string) {
+	if ri, ok := req.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		ri.set(route, kiteID)
+	}
+}
+
+// proxied wraps h with access logging and metrics of the proxied requests.
+func (p *Proxy) proxied(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		ri := &requestInfo{}
+		rw := metrics.NewResponseWriter(w, req)
+
+		h.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), requestInfoKey{}, ri)))
+
+		route, kiteID := ri.get()
+		latency := time.Since(start)
+
+		p.metrics.requests.Inc(route, strconv.Itoa(rw.Status()))
+		p.metrics.duration.Observe(latency.Seconds(), route)
+		p.metrics.bytesIn.Add(float64(rw.BytesIn()), route)
+		p.metrics.bytesOut.Add(float64(rw.BytesOut()), route)
+
+		p.accessLog(&metrics.AccessLogEntry{
+			Time:       start,
+			RemoteAddr: req.RemoteAddr,
+			Method:     req.Method,
+			Host:       req.Host,
+			Path:       req.URL.Path,
+			KiteID:     kiteID,
+			Status:     rw.Status(),
+			BytesIn:    rw.BytesIn(),
+			BytesOut:   rw.BytesOut(),
+			Latency:    latency,
+		})
+	})
+}
+
+func (p *Proxy) accessLog(e *metrics.AccessLogEntry) {
+	if p.AccessLog != nil {
+		p.AccessLog(e)
+		return
+	}
+
+	p.Kite.Log.Info("%s", e)
+}
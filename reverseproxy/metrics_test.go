@@ -0,0 +1,56 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/metrics"
+)
+
+func TestAccessLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.URL.Path))
+	}))
+	defer backend.Close()
+
+	var entries []*metrics.AccessLogEntry
+
+	p := New(config.New())
+	p.AccessLog = func(e *metrics.AccessLogEntry) { entries = append(entries, e) }
+	p.Routes.Add("route", Target{KiteID: "a", URL: backend.URL + "/kite", Weight: 1})
+
+	rec := httptest.NewRecorder()
+	p.handler().ServeHTTP(rec, httptest.NewRequest("GET", "http://proxy.example.com/proxy/route/info", nil))
+
+	if got, want := rec.Body.String(), "hello /kite/info"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(entries))
+	}
+
+	e := entries[0]
+
+	if e.KiteID != "a" || e.Status != http.StatusOK || e.BytesOut != int64(rec.Body.Len()) || e.Host != "proxy.example.com" {
+		t.Fatalf("unexpected entry: %s", e)
+	}
+
+	rec = httptest.NewRecorder()
+	p.handler().ServeHTTP(rec, httptest.NewRequest("GET", "http://proxy.example.com/metrics", nil))
+
+	for _, want := range []string{
+		`kite_reverseproxy_requests_total{route="route",code="200"} 1`,
+		`kite_reverseproxy_request_duration_seconds_count{route="route"} 1`,
+		`kite_reverseproxy_sent_bytes_total{route="route"} 16`,
+		`kite_reverseproxy_routes 1`,
+		`kite_reverseproxy_unhealthy_backends 0`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics do not contain %q:\n%s", want, rec.Body)
+		}
+	}
+}
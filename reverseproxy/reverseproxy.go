@@ -1,7 +1,10 @@
 package reverseproxy
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"net/http/httputil"
@@ -9,12 +12,14 @@ import (
 	"path"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/koding/kite"
-	"github.com/koding/kite/config"
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/metrics"
 	"github.com/koding/websocketproxy"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 const (
@@ -22,18 +27,58 @@ const (
 	Name    = "proxy"
 )
 
+// KiteIDHeader is a request header which, when set by a client, is used
+// as a key for sticky sessions. If it's not set, requests are routed
+// by their SockJS session ID.
+const KiteIDHeader = "X-Kite-Id"
+
+// RegisterOptions are optional arguments of the "register" method.
+type RegisterOptions struct {
+	// Route is a name of the route the kite is added to. Kites registered
+	// to the same route share the proxy URL. By default each kite gets
+	// its own route named after its ID.
+	Route string `json:"route"`
+
+	// Weight of the kite within the route, 1 by default.
+	Weight int `json:"weight"`
+
+	// Hostname is a public hostname of the route, like "foo.example.com".
+	// Requests to the hostname, told by the TLS server name (SNI) or
+	// the Host header, are proxied to the route with their paths
+	// unchanged, so the kite is reachable at the hostname as if it
+	// was served directly. The hostname must resolve to the proxy.
+	Hostname string `json:"hostname"`
+}
+
+// RoutesArgs are arguments of the "routes" method, which is used
+// to inspect and modify the routing table at runtime.
+type RoutesArgs struct {
+	// Action is one of "list" (default), "set" or "remove".
+	Action string `json:"action"`
+
+	// Route is a name of the route to modify.
+	Route string `json:"route"`
+
+	// Targets are new targets of the route for the "set" action.
+	Targets []Target `json:"targets"`
+
+	// URL of the target to remove for the "remove" action. If empty,
+	// the whole route is removed.
+	URL string `json:"url"`
+}
+
 type Proxy struct {
 	Kite *kite.Kite
 
-	listener  net.Listener
+	listener  *kite.GracefulListener
 	TLSConfig *tls.Config
 
 	readyC chan bool // To signal when kite is ready to accept connections
 	closeC chan bool // To signal when kite is closed with Close()
 
-	// Holds registered kites. Keys are kite IDs.
-	kites   map[string]url.URL
-	kitesMu sync.Mutex
+	// Routes holds registered kites. Route names are used
+	// in the proxy URLs.
+	Routes *RoutingTable
 
 	// muxer for proxy
 	mux            *http.ServeMux
@@ -44,6 +89,41 @@ type Proxy struct {
 	Scheme     string
 	PublicHost string // If given it must match the domain in certificate.
 	PublicPort int    // Uses for registering and defining the public port.
+
+	// HealthCheckInterval is the interval at which the proxy pings the
+	// backend kites. When 0, DefaultHealthCheckInterval is used.
+	// When <0, the backends are not checked.
+	HealthCheckInterval time.Duration
+
+	// HealthCheckTimeout is the timeout of a single ping. When 0,
+	// DefaultHealthCheckTimeout is used.
+	HealthCheckTimeout time.Duration
+
+	// HealthCheckFailures is the number of failed pings in a row, after
+	// which the backend is no longer routed to. When 0,
+	// DefaultHealthCheckFailures is used.
+	HealthCheckFailures int
+
+	// ACME, when non-nil, is used to obtain certificates for PublicHost
+	// and the hostnames of the routes from an ACME CA, like Let's Encrypt,
+	// when serving TLS. The certificates are stored in ACME.Cache, like
+	// autocert.DirCache, so they survive restarts. If ACME.HostPolicy
+	// is nil, certificates are obtained only for the known hostnames.
+	//
+	// ListenAndServe answers the http-01 challenges of the CA, so it must
+	// be reachable on port 80 of the hostnames.
+	ACME *autocert.Manager
+
+	// Metrics holds the Prometheus metrics of the proxy, which are
+	// served on /metrics.
+	Metrics *metrics.Registry
+
+	// AccessLog, when non-nil, is called after each proxied request
+	// is served. By default the entries are logged with Kite.Log.
+	AccessLog func(*metrics.AccessLogEntry)
+
+	health  healthChecker
+	metrics proxyMetrics
 }
 
 func New(conf *config.Config) *Proxy {
@@ -52,16 +132,21 @@ func New(conf *config.Config) *Proxy {
 
 	p := &Proxy{
 		Kite:   k,
-		kites:  make(map[string]url.URL),
+		Routes: NewRoutingTable(),
 		readyC: make(chan bool),
 		closeC: make(chan bool),
 		mux:    http.NewServeMux(),
 	}
 
+	p.newMetrics()
+
 	// third part kites are going to use this to register themself to
 	// proxy-kite and get a proxy url, which they use for register to kontrol.
 	p.Kite.HandleFunc("register", p.handleRegister)
 
+	// management method for the routing table
+	p.Kite.HandleFunc("routes", p.handleRoutes)
+
 	// create our websocketproxy http.handler
 
 	p.websocketProxy = &websocketproxy.WebsocketProxy{
@@ -81,17 +166,66 @@ func New(conf *config.Config) *Proxy {
 	}
 
 	p.mux.Handle("/", k)
-	p.mux.Handle("/proxy/", p)
+	p.mux.Handle("/proxy/", p.proxied(p))
+	p.mux.Handle("/metrics", p.Metrics)
 
 	// OnDisconnect is called whenever a kite is disconnected from us.
 	k.OnDisconnect(func(r *kite.Client) {
 		k.Log.Info("Removing kite Id '%s' from proxy. It's disconnected", r.Kite.ID)
-		delete(p.kites, r.Kite.ID)
+		p.Routes.RemoveKite(r.Kite.ID)
 	})
 
 	return p
 }
 
+// handler gives the handler of the proxy server. Requests to the hostnames
+// of the routes are proxied, others are served by the mux.
+func (p *Proxy) handler() http.Handler {
+	proxy := p.proxied(p)
+
+	var h http.Handler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if _, ok := p.Routes.HostRoute(requestHost(req)); ok {
+			proxy.ServeHTTP(rw, req)
+			return
+		}
+
+		p.mux.ServeHTTP(rw, req)
+	})
+
+	if p.ACME != nil {
+		h = p.ACME.HTTPHandler(h)
+	}
+
+	return h
+}
+
+// requestHost gives the hostname the request was sent to.
+func requestHost(req *http.Request) string {
+	if req.TLS != nil && req.TLS.ServerName != "" {
+		return req.TLS.ServerName
+	}
+
+	if host, _, err := net.SplitHostPort(req.Host); err == nil {
+		return host
+	}
+
+	return req.Host
+}
+
+// hostPolicy allows ACME to obtain certificates only for PublicHost
+// and the hostnames of the routes.
+func (p *Proxy) hostPolicy(_ context.Context, host string) error {
+	if strings.EqualFold(host, p.PublicHost) {
+		return nil
+	}
+
+	if _, ok := p.Routes.HostRoute(host); ok {
+		return nil
+	}
+
+	return fmt.Errorf("unknown hostname %q", host)
+}
+
 // ServeHTTP implements the http.Handler interface.
 func (p *Proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	if isWebsocket(req) {
@@ -123,17 +257,48 @@ func (p *Proxy) ReadyNotify() chan bool {
 }
 
 func (p *Proxy) handleRegister(r *kite.Request) (interface{}, error) {
-	kiteUrl, err := url.Parse(r.Args.One().MustString())
+	args := r.Args.MustSlice()
+	if len(args) == 0 {
+		return nil, errors.New("missing kite url")
+	}
+
+	kiteUrl, err := url.Parse(args[0].MustString())
 	if err != nil {
 		return nil, err
 	}
 
-	p.kites[r.Client.ID] = *kiteUrl
+	opts := RegisterOptions{
+		Route:  r.Client.ID,
+		Weight: 1,
+	}
+
+	if len(args) > 1 {
+		args[1].MustUnmarshal(&opts)
+
+		if opts.Route == "" {
+			opts.Route = r.Client.ID
+		}
+	}
+
+	p.Routes.Add(opts.Route, Target{
+		KiteID: r.Client.ID,
+		URL:    kiteUrl.String(),
+		Weight: opts.Weight,
+	})
 
 	proxyURL := url.URL{
 		Scheme: p.Scheme,
 		Host:   p.PublicHost + ":" + strconv.Itoa(p.PublicPort),
-		Path:   "/proxy/" + r.Client.ID,
+		Path:   "/proxy/" + opts.Route,
+	}
+
+	if opts.Hostname != "" {
+		if err := p.Routes.SetHost(opts.Hostname, opts.Route); err != nil {
+			return nil, err
+		}
+
+		proxyURL.Host = opts.Hostname + ":" + strconv.Itoa(p.PublicPort)
+		proxyURL.Path = kiteUrl.Path
 	}
 
 	s := proxyURL.String()
@@ -142,7 +307,41 @@ func (p *Proxy) handleRegister(r *kite.Request) (interface{}, error) {
 	return s, nil
 }
 
+func (p *Proxy) handleRoutes(r *kite.Request) (interface{}, error) {
+	if r.Username != p.Kite.Config.Username {
+		return nil, errors.New("not authorized to manage routes")
+	}
+
+	var args RoutesArgs
+
+	if r.Args != nil {
+		if a, err := r.Args.Slice(); err == nil && len(a) != 0 {
+			a[0].MustUnmarshal(&args)
+		}
+	}
+
+	switch args.Action {
+	case "", "list":
+	case "set":
+		p.Routes.Set(args.Route, args.Targets)
+	case "remove":
+		if args.URL == "" {
+			p.Routes.Set(args.Route, nil)
+		} else {
+			p.Routes.Remove(args.Route, args.URL)
+		}
+	default:
+		return nil, fmt.Errorf("unknown action %q", args.Action)
+	}
+
+	return p.Routes.Routes(), nil
+}
+
 func (p *Proxy) backend(req *http.Request) *url.URL {
+	if route, ok := p.Routes.HostRoute(requestHost(req)); ok {
+		return p.hostBackend(req, route)
+	}
+
 	withoutProxy := strings.TrimPrefix(req.URL.Path, "/proxy")
 	paths := strings.Split(withoutProxy, "/")
 
@@ -154,18 +353,14 @@ func (p *Proxy) backend(req *http.Request) *url.URL {
 	// remove the first empty path
 	paths = paths[1:]
 
-	// get our kiteId and individuals paths
-	kiteId, rest := paths[0], path.Join(paths[1:]...)
+	// get our route and individuals paths
+	route, rest := paths[0], path.Join(paths[1:]...)
 
 	p.Kite.Log.Info("[%s] Incoming proxy request for scheme: '%s', endpoint '/%s'",
-		kiteId, req.URL.Scheme, rest)
-
-	p.kitesMu.Lock()
-	defer p.kitesMu.Unlock()
+		route, req.URL.Scheme, rest)
 
-	backendURL, ok := p.kites[kiteId]
-	if !ok {
-		p.Kite.Log.Error("kite for id '%s' is not found: %s", kiteId, req.URL.String())
+	backendURL := p.pick(req, route, stickyKey(req, paths[1:]))
+	if backendURL == nil {
 		return nil
 	}
 
@@ -174,8 +369,65 @@ func (p *Proxy) backend(req *http.Request) *url.URL {
 	backendURL.Scheme = req.URL.Scheme
 	backendURL.Path += "/" + rest
 
-	p.Kite.Log.Info("[%s] Proxying to backend url: '%s'.", kiteId, backendURL.String())
-	return &backendURL
+	p.Kite.Log.Info("[%s] Proxying to backend url: '%s'.", route, backendURL.String())
+	return backendURL
+}
+
+// hostBackend gives the backend URL of the request sent to the hostname
+// of the route. The request path is passed to the backend as is.
+func (p *Proxy) hostBackend(req *http.Request, route string) *url.URL {
+	p.Kite.Log.Info("[%s] Incoming proxy request for host: '%s', endpoint '%s'",
+		route, requestHost(req), req.URL.Path)
+
+	paths := strings.Split(strings.TrimPrefix(req.URL.Path, "/"), "/")
+
+	backendURL := p.pick(req, route, stickyKey(req, paths))
+	if backendURL == nil {
+		return nil
+	}
+
+	backendURL.Scheme = req.URL.Scheme
+	backendURL.Path = req.URL.Path
+
+	p.Kite.Log.Info("[%s] Proxying to backend url: '%s'.", route, backendURL.String())
+	return backendURL
+}
+
+// pick gives the URL of the backend kite of the route, which serves
+// the request, or nil if there is none.
+func (p *Proxy) pick(req *http.Request, route, key string) *url.URL {
+	setRequestInfo(req, route, "")
+
+	target, err := p.Routes.PickTarget(route, key)
+	if err != nil {
+		p.Kite.Log.Error("kite for route '%s' is not found: %s", route, req.URL.String())
+		return nil
+	}
+
+	setRequestInfo(req, route, target.KiteID)
+
+	u, err := url.Parse(target.URL)
+	if err != nil {
+		p.Kite.Log.Error("Invalid url of kite '%s': %s", target.KiteID, err)
+		return nil
+	}
+
+	return u
+}
+
+// stickyKey gives a key used to route all requests of a single client
+// to the same backend. The paths end with SockJS endpoints, like
+// /123/kjasd213/websocket.
+func stickyKey(req *http.Request, paths []string) string {
+	if id := req.Header.Get(KiteIDHeader); id != "" {
+		return id
+	}
+
+	if len(paths) >= 3 {
+		return paths[len(paths)-2] // SockJS session ID
+	}
+
+	return ""
 }
 
 func (p *Proxy) director(req *http.Request) {
@@ -193,48 +445,68 @@ func (p *Proxy) director(req *http.Request) {
 // ListenAndServe listens on the TCP network address addr and then calls Serve
 // with handler to handle requests on incoming connections.
 func (p *Proxy) ListenAndServe() error {
-	var err error
-	p.listener, err = net.Listen("tcp4",
+	l, err := net.Listen("tcp4",
 		net.JoinHostPort(p.Kite.Config.IP, strconv.Itoa(p.Kite.Config.Port)))
 	if err != nil {
 		return err
 	}
+
+	p.listener = kite.NewGracefulListener(l)
 	p.Kite.Log.Info("Listening on: %s", p.listener.Addr().String())
 
 	close(p.readyC)
 
+	go p.healthCheck()
+
 	server := http.Server{
-		Handler: p.mux,
+		Handler: p.handler(),
 	}
 
 	defer close(p.closeC)
 	return server.Serve(p.listener)
 }
 
+// ListenAndServeTLS is like ListenAndServe, but it serves TLS connections
+// with the certificate from the given files. If ACME is set, the files
+// may be empty, the certificates obtained with ACME are used for PublicHost
+// and the hostnames of the routes, and the certificate from the files,
+// if any, for other hostnames.
 func (p *Proxy) ListenAndServeTLS(certFile, keyFile string) error {
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		p.Kite.Log.Fatal("Could not load cert/key files: %s", err.Error())
+	tlsConfig := &tls.Config{}
+
+	if certFile != "" || keyFile != "" || p.ACME == nil {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			p.Kite.Log.Fatal("Could not load cert/key files: %s", err.Error())
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
 
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{cert},
+	if p.ACME != nil {
+		if p.ACME.HostPolicy == nil {
+			p.ACME.HostPolicy = p.hostPolicy
+		}
+
+		tlsConfig.GetCertificate = p.getCertificate(tlsConfig)
 	}
 
-	p.listener, err = net.Listen("tcp",
+	l, err := net.Listen("tcp",
 		net.JoinHostPort(p.Kite.Config.IP, strconv.Itoa(p.Kite.Config.Port)))
 	if err != nil {
 		p.Kite.Log.Fatal(err.Error())
 	}
+
+	p.listener = kite.NewGracefulListener(tls.NewListener(l, tlsConfig))
 	p.Kite.Log.Info("Listening on: %s", p.listener.Addr().String())
 
 	// now we are ready
 	close(p.readyC)
 
-	p.listener = tls.NewListener(p.listener, tlsConfig)
+	go p.healthCheck()
 
 	server := &http.Server{
-		Handler:   p.mux,
+		Handler:   p.handler(),
 		TLSConfig: tlsConfig,
 	}
 
@@ -242,6 +514,20 @@ func (p *Proxy) ListenAndServeTLS(certFile, keyFile string) error {
 	return server.Serve(p.listener)
 }
 
+// getCertificate gives the certificate of ACME for the requested server
+// name. If it cannot be obtained, the certificate of the config is used.
+func (p *Proxy) getCertificate(cfg *tls.Config) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := p.ACME.GetCertificate(hello)
+		if err != nil && len(cfg.Certificates) != 0 {
+			p.Kite.Log.Debug("Using default certificate for %q: %s", hello.ServerName, err)
+			return nil, nil
+		}
+
+		return cert, err
+	}
+}
+
 func (p *Proxy) Run() {
 	p.ListenAndServe()
 }
@@ -8,8 +8,8 @@ import (
 	"os"
 	"strconv"
 
-	"github.com/koding/kite/config"
-	"github.com/koding/kite/reverseproxy"
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/reverseproxy"
 )
 
 var (
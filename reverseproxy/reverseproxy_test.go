@@ -1,6 +1,9 @@
 package reverseproxy
 
 import (
+	"context"
+	"crypto/tls"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"strconv"
@@ -9,12 +12,12 @@ import (
 	"time"
 
 	"github.com/fatih/color"
-	"github.com/koding/kite"
-	"github.com/koding/kite/config"
-	"github.com/koding/kite/kontrol"
-	"github.com/koding/kite/protocol"
-	"github.com/koding/kite/testkeys"
-	"github.com/koding/kite/testutil"
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/kontrol"
+	"github.com/koding/kite/v2/protocol"
+	"github.com/koding/kite/v2/testkeys"
+	"github.com/koding/kite/v2/testutil"
 )
 
 func TestWebSocketProxy(t *testing.T) {
@@ -177,3 +180,44 @@ func TestWebSocketProxy(t *testing.T) {
 		t.Fatalf("Wrong reply: %s", s)
 	}
 }
+
+func TestHostRouting(t *testing.T) {
+	p := New(config.New())
+	p.PublicHost = "proxy.example.com"
+
+	p.Routes.Add("route", Target{KiteID: "a", URL: "http://127.0.0.1:7000/kite", Weight: 1})
+
+	if err := p.Routes.SetHost("foo.example.com", "route"); err != nil {
+		t.Fatalf("SetHost()=%s", err)
+	}
+
+	req := httptest.NewRequest("GET", "http://foo.example.com:4999/kite/123/abcd/websocket", nil)
+	req.URL.Scheme = "ws"
+
+	u := p.backend(req)
+	if u == nil {
+		t.Fatal("no backend for the hostname")
+	}
+
+	if want := "ws://127.0.0.1:7000/kite/123/abcd/websocket"; u.String() != want {
+		t.Fatalf("got %q, want %q", u, want)
+	}
+
+	// The TLS server name takes precedence over the Host header.
+	req = httptest.NewRequest("GET", "https://proxy.example.com/kite/info", nil)
+	req.TLS = &tls.ConnectionState{ServerName: "foo.example.com"}
+
+	if host := requestHost(req); host != "foo.example.com" {
+		t.Fatalf("got %q, want %q", host, "foo.example.com")
+	}
+
+	for host, ok := range map[string]bool{
+		"proxy.example.com": true,
+		"foo.example.com":   true,
+		"bar.example.com":   false,
+	} {
+		if err := p.hostPolicy(context.Background(), host); (err == nil) != ok {
+			t.Errorf("%s: got %v, want allowed=%t", host, err, ok)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package reverseproxy
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// ErrNoRoute is returned when a route has no targets.
+var ErrNoRoute = errors.New("no targets for the route")
+
+// ErrNoHealthyTarget is returned when all targets of a route are unhealthy.
+var ErrNoHealthyTarget = errors.New("no healthy targets for the route")
+
+// Target is a single backend kite of a route.
+type Target struct {
+	// KiteID is the ID of the kite that serves the target.
+	KiteID string `json:"kiteID"`
+
+	// URL is the kite URL, like "http://10.0.0.1:3000/kite".
+	URL string `json:"url"`
+
+	// Weight defines how often the target is picked compared to
+	// the other targets of the route. Targets with zero weight
+	// are picked only by sticky sessions.
+	Weight int `json:"weight"`
+
+	// Unhealthy is set by Routes for targets which failed health checks.
+	// It's ignored by Add and Set.
+	Unhealthy bool `json:"unhealthy,omitempty"`
+}
+
+// RoutingTable maps route names to weighted backend kites.
+//
+// Each client is routed to the same target of a route for as long
+// as the target exists and is healthy (sticky sessions). Unhealthy
+// targets are not picked until they are marked healthy again.
+type RoutingTable struct {
+	mu        sync.Mutex
+	routes    map[string][]Target
+	sticky    map[string]map[string]string // route -> client ID -> target URL
+	unhealthy map[string]struct{}          // target URLs
+	hosts     map[string]string            // hostname -> route
+}
+
+// NewRoutingTable gives new, empty routing table.
+func NewRoutingTable() *RoutingTable {
+	return &RoutingTable{
+		routes:    make(map[string][]Target),
+		sticky:    make(map[string]map[string]string),
+		unhealthy: make(map[string]struct{}),
+		hosts:     make(map[string]string),
+	}
+}
+
+// Add adds the target to the route, replacing the existing one
+// with the same URL. The target is considered healthy.
+func (rt *RoutingTable) Add(route string, t Target) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	t.Unhealthy = false
+	delete(rt.unhealthy, t.URL)
+
+	targets := rt.routes[route]
+
+	for i := range targets {
+		if targets[i].URL == t.URL {
+			targets[i] = t
+			return
+		}
+	}
+
+	rt.routes[route] = append(targets, t)
+}
+
+// Set replaces all targets of the route. If targets is empty,
+// the route is removed.
+func (rt *RoutingTable) Set(route string, targets []Target) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if len(targets) == 0 {
+		rt.delete(route)
+		return
+	}
+
+	rt.routes[route] = append([]Target(nil), targets...)
+
+	for i := range rt.routes[route] {
+		rt.routes[route][i].Unhealthy = false
+	}
+
+	rt.expire(route)
+}
+
+// Remove removes the target with the given URL from the route.
+func (rt *RoutingTable) Remove(route, targetURL string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	rt.remove(route, func(t *Target) bool { return t.URL == targetURL })
+}
+
+// RemoveKite removes all targets of the given kite from all routes.
+func (rt *RoutingTable) RemoveKite(kiteID string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	for route := range rt.routes {
+		rt.remove(route, func(t *Target) bool { return t.KiteID == kiteID })
+	}
+}
+
+// Routes gives a copy of all the routes.
+func (rt *RoutingTable) Routes() map[string][]Target {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	routes := make(map[string][]Target, len(rt.routes))
+
+	for route, targets := range rt.routes {
+		targets = append([]Target(nil), targets...)
+
+		for i := range targets {
+			_, targets[i].Unhealthy = rt.unhealthy[targets[i].URL]
+		}
+
+		routes[route] = targets
+	}
+
+	return routes
+}
+
+// SetHealthy marks all targets with the given URL as healthy or unhealthy.
+// Unhealthy targets are not picked and the sticky sessions of their
+// clients are removed, so the clients are routed to other targets.
+func (rt *RoutingTable) SetHealthy(targetURL string, healthy bool) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if healthy {
+		delete(rt.unhealthy, targetURL)
+		return
+	}
+
+	rt.unhealthy[targetURL] = struct{}{}
+
+	for route := range rt.sticky {
+		rt.expire(route)
+	}
+}
+
+// Healthy tells whether the target with the given URL is healthy.
+func (rt *RoutingTable) Healthy(targetURL string) bool {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	_, ok := rt.unhealthy[targetURL]
+	return !ok
+}
+
+// SetHost makes requests to the hostname be routed to the route, which
+// must exist. If route is empty, the hostname is removed. Hostnames are
+// removed along with their routes.
+func (rt *RoutingTable) SetHost(host, route string) error {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	host = strings.ToLower(host)
+
+	if route == "" {
+		delete(rt.hosts, host)
+		return nil
+	}
+
+	if _, ok := rt.routes[route]; !ok {
+		return ErrNoRoute
+	}
+
+	if r, ok := rt.hosts[host]; ok && r != route {
+		return fmt.Errorf("hostname %q is already used by route %q", host, r)
+	}
+
+	rt.hosts[host] = route
+	return nil
+}
+
+// HostRoute gives the route of the hostname.
+func (rt *RoutingTable) HostRoute(host string) (string, bool) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	route, ok := rt.hosts[strings.ToLower(host)]
+	return route, ok
+}
+
+// Hosts gives a copy of the hostnames and their routes.
+func (rt *RoutingTable) Hosts() map[string]string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	hosts := make(map[string]string, len(rt.hosts))
+
+	for host, route := range rt.hosts {
+		hosts[host] = route
+	}
+
+	return hosts
+}
+
+// urls gives the URLs of all the targets.
+func (rt *RoutingTable) urls() []string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	seen := make(map[string]struct{})
+	var urls []string
+
+	for _, targets := range rt.routes {
+		for _, t := range targets {
+			if _, ok := seen[t.URL]; !ok {
+				seen[t.URL] = struct{}{}
+				urls = append(urls, t.URL)
+			}
+		}
+	}
+
+	return urls
+}
+
+// Pick selects a target of the route for the given client and gives
+// its URL. See PickTarget.
+func (rt *RoutingTable) Pick(route, clientID string) (*url.URL, error) {
+	t, err := rt.PickTarget(route, clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	return url.Parse(t.URL)
+}
+
+// PickTarget selects a target of the route for the given client.
+//
+// If the client was already routed to a target which still exists,
+// the same target is returned. Otherwise a healthy target is picked
+// randomly according to the target weights. If clientID is empty,
+// the session is not sticky.
+func (rt *RoutingTable) PickTarget(route, clientID string) (Target, error) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	targets := rt.routes[route]
+
+	if clientID != "" {
+		if u, ok := rt.sticky[route][clientID]; ok {
+			for _, t := range targets {
+				if t.URL == u {
+					return t, nil
+				}
+			}
+		}
+	}
+
+	total, healthy := 0, 0
+	for _, t := range targets {
+		if t.Weight > 0 {
+			total += t.Weight
+
+			if _, ok := rt.unhealthy[t.URL]; !ok {
+				healthy += t.Weight
+			}
+		}
+	}
+
+	switch {
+	case total == 0:
+		return Target{}, ErrNoRoute
+	case healthy == 0:
+		return Target{}, ErrNoHealthyTarget
+	}
+
+	n := rand.Intn(healthy)
+
+	var target Target
+	for _, target = range targets {
+		if _, ok := rt.unhealthy[target.URL]; ok || target.Weight <= 0 {
+			continue
+		}
+
+		if n -= target.Weight; n < 0 {
+			break
+		}
+	}
+
+	if clientID != "" {
+		if rt.sticky[route] == nil {
+			rt.sticky[route] = make(map[string]string)
+		}
+
+		rt.sticky[route][clientID] = target.URL
+	}
+
+	return target, nil
+}
+
+func (rt *RoutingTable) remove(route string, fn func(*Target) bool) {
+	targets := rt.routes[route][:0]
+
+	for _, t := range rt.routes[route] {
+		if !fn(&t) {
+			targets = append(targets, t)
+		}
+	}
+
+	if len(targets) == 0 {
+		rt.delete(route)
+		return
+	}
+
+	rt.routes[route] = targets
+	rt.expire(route)
+}
+
+// delete removes the route along with its sticky sessions and hostnames.
+func (rt *RoutingTable) delete(route string) {
+	delete(rt.routes, route)
+	delete(rt.sticky, route)
+
+	for host, r := range rt.hosts {
+		if r == route {
+			delete(rt.hosts, host)
+		}
+	}
+}
+
+// expire removes sticky sessions for targets which no longer
+// exist in the route or are unhealthy.
+func (rt *RoutingTable) expire(route string) {
+	urls := make(map[string]struct{}, len(rt.routes[route]))
+
+	for _, t := range rt.routes[route] {
+		if _, ok := rt.unhealthy[t.URL]; !ok {
+			urls[t.URL] = struct{}{}
+		}
+	}
+
+	for clientID, u := range rt.sticky[route] {
+		if _, ok := urls[u]; !ok {
+			delete(rt.sticky[route], clientID)
+		}
+	}
+}
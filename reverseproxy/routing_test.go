@@ -0,0 +1,161 @@
+package reverseproxy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRoutingTable(t *testing.T) {
+	rt := NewRoutingTable()
+
+	rt.Add("route", Target{KiteID: "a", URL: "http://a/kite", Weight: 1})
+	rt.Add("route", Target{KiteID: "b", URL: "http://b/kite", Weight: 0})
+
+	for i := 0; i < 16; i++ {
+		u, err := rt.Pick("route", "")
+		if err != nil {
+			t.Fatalf("Pick()=%s", err)
+		}
+
+		if u.Host != "a" {
+			t.Fatalf("got %q, want %q", u.Host, "a")
+		}
+	}
+
+	// Sticky session survives weight changes.
+	if _, err := rt.Pick("route", "client"); err != nil {
+		t.Fatalf("Pick()=%s", err)
+	}
+
+	rt.Add("route", Target{KiteID: "a", URL: "http://a/kite", Weight: 0})
+	rt.Add("route", Target{KiteID: "b", URL: "http://b/kite", Weight: 1})
+
+	u, err := rt.Pick("route", "client")
+	if err != nil {
+		t.Fatalf("Pick()=%s", err)
+	}
+
+	if u.Host != "a" {
+		t.Fatalf("got %q, want %q", u.Host, "a")
+	}
+
+	// Removing the target expires the sticky session.
+	rt.RemoveKite("a")
+
+	if u, err = rt.Pick("route", "client"); err != nil {
+		t.Fatalf("Pick()=%s", err)
+	}
+
+	if u.Host != "b" {
+		t.Fatalf("got %q, want %q", u.Host, "b")
+	}
+
+	want := map[string][]Target{
+		"route": {{KiteID: "b", URL: "http://b/kite", Weight: 1}},
+	}
+
+	if got := rt.Routes(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	rt.Set("route", nil)
+
+	if _, err := rt.Pick("route", "client"); err != ErrNoRoute {
+		t.Fatalf("got %v, want %v", err, ErrNoRoute)
+	}
+}
+
+func TestRoutingTableHealth(t *testing.T) {
+	rt := NewRoutingTable()
+
+	rt.Add("route", Target{KiteID: "a", URL: "http://a/kite", Weight: 1})
+	rt.Add("route", Target{KiteID: "b", URL: "http://b/kite", Weight: 1})
+
+	rt.SetHealthy("http://a/kite", false)
+
+	if rt.Healthy("http://a/kite") {
+		t.Fatal("expected target a to be unhealthy")
+	}
+
+	for i := 0; i < 16; i++ {
+		u, err := rt.Pick("route", "")
+		if err != nil {
+			t.Fatalf("Pick()=%s", err)
+		}
+
+		if u.Host != "b" {
+			t.Fatalf("got %q, want %q", u.Host, "b")
+		}
+	}
+
+	if _, err := rt.Pick("route", "client"); err != nil {
+		t.Fatalf("Pick()=%s", err)
+	}
+
+	// Unhealthy target expires the sticky session.
+	rt.SetHealthy("http://a/kite", true)
+	rt.SetHealthy("http://b/kite", false)
+
+	u, err := rt.Pick("route", "client")
+	if err != nil {
+		t.Fatalf("Pick()=%s", err)
+	}
+
+	if u.Host != "a" {
+		t.Fatalf("got %q, want %q", u.Host, "a")
+	}
+
+	want := map[string][]Target{
+		"route": {
+			{KiteID: "a", URL: "http://a/kite", Weight: 1},
+			{KiteID: "b", URL: "http://b/kite", Weight: 1, Unhealthy: true},
+		},
+	}
+
+	if got := rt.Routes(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	rt.SetHealthy("http://a/kite", false)
+
+	if _, err := rt.Pick("route", "client"); err != ErrNoHealthyTarget {
+		t.Fatalf("got %v, want %v", err, ErrNoHealthyTarget)
+	}
+
+	// Registering the target again makes it healthy.
+	rt.Add("route", Target{KiteID: "a", URL: "http://a/kite", Weight: 1})
+
+	if !rt.Healthy("http://a/kite") {
+		t.Fatal("expected target a to be healthy")
+	}
+}
+
+func TestRoutingTableHosts(t *testing.T) {
+	rt := NewRoutingTable()
+
+	if err := rt.SetHost("foo.example.com", "route"); err != ErrNoRoute {
+		t.Fatalf("got %v, want %v", err, ErrNoRoute)
+	}
+
+	rt.Add("route", Target{KiteID: "a", URL: "http://a/kite", Weight: 1})
+	rt.Add("other", Target{KiteID: "b", URL: "http://b/kite", Weight: 1})
+
+	if err := rt.SetHost("Foo.Example.com", "route"); err != nil {
+		t.Fatalf("SetHost()=%s", err)
+	}
+
+	if err := rt.SetHost("foo.example.com", "other"); err == nil {
+		t.Fatal("expected hostname of another route to be rejected")
+	}
+
+	if route, ok := rt.HostRoute("FOO.example.com"); !ok || route != "route" {
+		t.Fatalf("got %q, %t, want %q", route, ok, "route")
+	}
+
+	// Removing the route removes its hostnames.
+	rt.RemoveKite("a")
+
+	if hosts := rt.Hosts(); len(hosts) != 0 {
+		t.Fatalf("got %v, want no hostnames", hosts)
+	}
+}
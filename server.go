@@ -10,7 +10,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 )
 
 // Run is a blocking method. It runs the kite server and then accepts requests
@@ -38,27 +38,53 @@ func (k *Kite) Run() {
 }
 
 // Close stops the server and the kontrol client instance.
-func (k *Kite) Close() {
+//
+// Close is safe to be called many times and concurrently, only the first
+// call closes the kite, the subsequent ones return nil. If closing failed
+// for more than one reason, the first error is returned and the rest
+// is logged.
+func (k *Kite) Close() error {
+	if !atomic.CompareAndSwapInt32(&k.closed, 0, 1) {
+		return nil
+	}
+
 	k.Log.Info("Closing kite...")
 
+	var errs []error
+
 	k.kontrol.Lock()
 	if k.kontrol != nil && k.kontrol.Client != nil {
-		k.kontrol.Close()
+		if err := k.kontrol.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing kontrol client: %s", err))
+		}
 	}
 	k.kontrol.Unlock()
 
-	if k.listener != nil {
-		k.listener.Close()
-		k.listener = nil
-	}
-
 	k.mu.Lock()
+	listener := k.listener
+	k.listener = nil
 	cache := k.verifyCache
 	k.mu.Unlock()
 
+	if listener != nil {
+		if err := listener.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing listener: %s", err))
+		}
+	}
+
 	if cache != nil {
 		cache.StopGC()
 	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	for _, err := range errs[1:] {
+		k.Log.Error("%s", err)
+	}
+
+	return errs[0]
 }
 
 func (k *Kite) Addr() string {
@@ -69,13 +95,15 @@ func (k *Kite) Addr() string {
 // calls Serve to handle requests on incoming connectionk.
 func (k *Kite) listenAndServe() error {
 	// create a new one if there doesn't exist
-	l, err := net.Listen("tcp4", k.Addr())
+	l, err := k.listen()
 	if err != nil {
 		return err
 	}
 
 	k.Log.Info("New listening: %s", l.Addr())
 
+	socket := l
+
 	if k.TLSConfig != nil {
 		if k.TLSConfig.NextProtos == nil {
 			k.TLSConfig.NextProtos = []string{"http/1.1"}
@@ -83,7 +111,16 @@ func (k *Kite) listenAndServe() error {
 		l = tls.NewListener(l, k.TLSConfig)
 	}
 
-	k.listener = newGracefulListener(l)
+	gl := NewGracefulListener(l)
+
+	k.mu.Lock()
+	k.listener = gl
+	k.socket = socket
+	if atomic.LoadInt32(&k.closed) == 1 {
+		// The kite was closed before it started serving.
+		gl.Close()
+	}
+	k.mu.Unlock()
 
 	// listener is ready, notify waiters.
 	close(k.readyC)
@@ -91,7 +128,45 @@ func (k *Kite) listenAndServe() error {
 	defer close(k.closeC) // serving is finished, notify waiters.
 	k.Log.Info("Serving...")
 
-	return k.serve(k.listener, k)
+	return k.serve(gl, k)
+}
+
+// listen listens on k.Addr(), or on the first free port in the
+// Config.Port-Config.MaxPort range if MaxPort is set. If Config.Listen
+// is set, it listens on the given address instead. A socket handed over
+// by the previous process of the kite is used instead, see Handover.
+func (k *Kite) listen() (net.Listener, error) {
+	if fd := os.Getenv(listenFDEnv); fd != "" {
+		// Only the first kite of the process inherits the socket.
+		os.Unsetenv(listenFDEnv)
+		return inheritListener(fd)
+	}
+
+	switch addr := k.Config.Listen; {
+	case strings.HasPrefix(addr, unixListenPrefix):
+		return listenUnix(addr)
+	case addr != "":
+		return net.Listen("tcp", addr)
+	}
+
+	if k.Config.Port == 0 || k.Config.MaxPort <= k.Config.Port {
+		return net.Listen("tcp4", k.Addr())
+	}
+
+	var err error
+
+	for port := k.Config.Port; port <= k.Config.MaxPort; port++ {
+		var l net.Listener
+
+		l, err = net.Listen("tcp4", net.JoinHostPort(k.Config.IP, strconv.Itoa(port)))
+		if err == nil {
+			return l, nil
+		}
+
+		k.Log.Debug("Unable to listen on port %d: %s", port, err)
+	}
+
+	return nil, fmt.Errorf("no free port in %d-%d range: %s", k.Config.Port, k.Config.MaxPort, err)
 }
 
 func (k *Kite) serve(l net.Listener, h http.Handler) error {
@@ -103,6 +178,7 @@ func (k *Kite) serve(l net.Listener, h http.Handler) error {
 
 // Port returns the TCP port number that the kite listens.
 // Port must be called after the listener is initialized.
+// If Config.MaxPort is set, it gives the port chosen from the range.
 // You can use ServerReadyNotify function to get notified when listener is ready.
 //
 // Kite starts to listen the port when Run() is called.
@@ -116,11 +192,30 @@ func (k *Kite) serve(l net.Listener, h http.Handler) error {
 //   port := k.Port()
 //
 func (k *Kite) Port() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
 	if k.listener == nil {
 		return 0
 	}
 
-	return k.listener.Addr().(*net.TCPAddr).Port
+	// A kite listening on a Unix domain socket has no port.
+	addr, ok := k.listener.Addr().(*net.TCPAddr)
+	if !ok {
+		return 0
+	}
+
+	return addr.Port
+}
+
+// Listener gives the listener the kite serves on, which can be used
+// to track its active connections. It returns nil until the kite
+// starts to listen.
+func (k *Kite) Listener() *GracefulListener {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.listener
 }
 
 func (k *Kite) UseTLS(certPEM, keyPEM string) {
@@ -157,64 +252,3 @@ func (k *Kite) ServerCloseNotify() chan bool {
 func (k *Kite) ServerReadyNotify() chan bool {
 	return k.readyC
 }
-
-// gracefulListener closes all accepted connections upon Close to ensure
-// no dangling websocket/xhr sessions outlive the kite.
-type gracefulListener struct {
-	net.Listener
-
-	conns   map[net.Conn]struct{}
-	connsMu sync.Mutex
-}
-
-func newGracefulListener(l net.Listener) *gracefulListener {
-	return &gracefulListener{
-		Listener: l,
-		conns:    make(map[net.Conn]struct{}),
-	}
-}
-
-func (l *gracefulListener) Accept() (net.Conn, error) {
-	conn, err := l.Listener.Accept()
-	if err != nil {
-		return nil, err
-	}
-
-	l.connsMu.Lock()
-	l.conns[conn] = struct{}{}
-	l.connsMu.Unlock()
-
-	return &gracefulConn{
-		Conn: conn,
-		close: func() {
-			l.connsMu.Lock()
-			delete(l.conns, conn)
-			l.connsMu.Unlock()
-		},
-	}, nil
-}
-
-func (l *gracefulListener) Close() error {
-	err := l.Listener.Close()
-
-	l.connsMu.Lock()
-	for conn := range l.conns {
-		conn.Close()
-	}
-	l.conns = nil
-	l.connsMu.Unlock()
-
-	return err
-}
-
-type gracefulConn struct {
-	net.Conn
-
-	close func()
-}
-
-func (c *gracefulConn) Close() error {
-	c.close()
-
-	return c.Conn.Close()
-}
@@ -0,0 +1,55 @@
+package kite
+
+import (
+	"net"
+	"testing"
+
+	"github.com/koding/kite/v2/config"
+)
+
+func TestKite_PortRange(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:3647")
+	if err != nil {
+		t.Fatalf("Listen()=%s", err)
+	}
+	defer l.Close()
+
+	cfg := config.New()
+	cfg.IP = "127.0.0.1"
+	cfg.Port = 3647
+	cfg.MaxPort = 3649
+
+	k := NewWithConfig("portrange", "0.0.1", cfg)
+
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	if port := k.Port(); port != 3648 {
+		t.Fatalf("got port %d, want %d", port, 3648)
+	}
+
+	if u := k.RegisterURL(true); u != nil && u.Port() != "3648" {
+		t.Fatalf("got register URL %s, want port %d", u, 3648)
+	}
+}
+
+func TestKite_RegisterURLConfig(t *testing.T) {
+	cases := map[string]string{
+		"http://10.0.0.1:32768/kite": "http://10.0.0.1:32768/kite",
+		"http://10.0.0.1:32768":      "http://10.0.0.1:32768/registerurl-0.0.1/kite",
+	}
+
+	for registerURL, want := range cases {
+		cfg := config.New()
+		cfg.RegisterURL = registerURL
+
+		k := NewWithConfig("registerurl", "0.0.1", cfg)
+
+		if u := k.RegisterURL(true); u == nil || u.String() != want {
+			t.Errorf("%s: got register URL %s, want %s", registerURL, u, want)
+		}
+
+		k.Close()
+	}
+}
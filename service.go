@@ -0,0 +1,218 @@
+package kite
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ServiceTagger is implemented by service receivers, which set options
+// of their methods registered with RegisterService.
+//
+// KiteTags gives the tags keyed by Go method names. The tags use the
+// struct tag syntax and the following keys are recognized:
+//
+//	name:"..."      - name of the kite method, instead of the derived one
+//	auth:"false"    - disables authentication, see Method.DisableAuthentication
+//	throttle:"d,n"  - throttles the method, see Method.Throttle
+//	group:"..."     - sets the method group, see Method.Group
+//
+// Example:
+//
+//	func (*Os) KiteTags() map[string]string {
+//		return map[string]string{
+//			"Version":       `auth:"false"`,
+//			"ReadDirectory": `throttle:"100ms,50"`,
+//		}
+//	}
+type ServiceTagger interface {
+	KiteTags() map[string]string
+}
+
+var (
+	requestType = reflect.TypeOf((*Request)(nil))
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// RegisterService registers the exported methods of the receiver as kite
+// methods, similar to net/rpc. The methods are named "<name>.<method>",
+// with the first letter of the Go method name lowercased, e.g.
+// "os.readDirectory" for the ReadDirectory method of the "os" service.
+// If the name is empty, the method names are not prefixed.
+//
+// Methods must have one of the following signatures:
+//
+//	func (t *T) Method(r *kite.Request) (result R, err error)
+//	func (t *T) Method(r *kite.Request, args A) (result R, err error)
+//
+// In the latter case the first argument of the call is unmarshaled into
+// a value of type A. Other exported methods are ignored.
+//
+// It returns the registered methods keyed by their kite names, so they
+// can be configured further.
+func (k *Kite) RegisterService(name string, receiver interface{}) (map[string]*Method, error) {
+	v := reflect.ValueOf(receiver)
+	if !v.IsValid() || (v.Kind() == reflect.Ptr && v.IsNil()) {
+		return nil, errors.New("service receiver is nil")
+	}
+
+	var tags map[string]string
+	if t, ok := receiver.(ServiceTagger); ok {
+		tags = t.KiteTags()
+	}
+
+	var opts []*serviceOptions
+
+	// The tags are parsed first, so no method is registered if any is invalid.
+	for i := 0; i < v.NumMethod(); i++ {
+		typ := v.Type().Method(i)
+
+		handler, ok := serviceHandler(v.Method(i))
+		if !ok {
+			continue
+		}
+
+		o, err := parseServiceTag(reflect.StructTag(tags[typ.Name]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag of %s method: %s", typ.Name, err)
+		}
+
+		if o.name == "" {
+			o.name = serviceMethodName(name, typ.Name)
+		}
+
+		o.handler = handler
+		opts = append(opts, o)
+	}
+
+	if len(opts) == 0 {
+		return nil, fmt.Errorf("%T has no exported methods of suitable signature", receiver)
+	}
+
+	methods := make(map[string]*Method, len(opts))
+
+	for _, o := range opts {
+		m := k.HandleFunc(o.name, o.handler)
+
+		if o.noAuth {
+			m.DisableAuthentication()
+		}
+
+		if o.capacity > 0 {
+			m.Throttle(o.interval, o.capacity)
+		}
+
+		if o.group != "" {
+			m.Group(o.group)
+		}
+
+		methods[o.name] = m
+	}
+
+	return methods, nil
+}
+
+// serviceOptions are options of a service method, set with its tag.
+type serviceOptions struct {
+	name     string
+	handler  HandlerFunc
+	noAuth   bool
+	interval time.Duration
+	capacity int64
+	group    string
+}
+
+func serviceMethodName(service, method string) string {
+	r, n := utf8.DecodeRuneInString(method)
+	method = string(unicode.ToLower(r)) + method[n:]
+
+	if service == "" {
+		return method
+	}
+
+	return service + "." + method
+}
+
+// serviceHandler adapts the method value to a handler, it returns false
+// if the method has an unsupported signature.
+func serviceHandler(fn reflect.Value) (HandlerFunc, bool) {
+	t := fn.Type()
+
+	if t.IsVariadic() || t.NumIn() < 1 || t.NumIn() > 2 || t.In(0) != requestType {
+		return nil, false
+	}
+
+	if t.NumOut() != 2 || t.Out(1) != errorType {
+		return nil, false
+	}
+
+	return func(r *Request) (interface{}, error) {
+		in := []reflect.Value{reflect.ValueOf(r)}
+
+		if t.NumIn() == 2 {
+			arg := reflect.New(t.In(1))
+
+			args, err := r.Args.SliceOfLength(1)
+			if err == nil {
+				err = args[0].Unmarshal(arg.Interface())
+			}
+
+			if err != nil {
+				return nil, &Error{
+					Type:    "argumentError",
+					Message: err.Error(),
+				}
+			}
+
+			in = append(in, arg.Elem())
+		}
+
+		out := fn.Call(in)
+
+		err, _ := out[1].Interface().(error)
+
+		return out[0].Interface(), err
+	}, true
+}
+
+func parseServiceTag(tag reflect.StructTag) (*serviceOptions, error) {
+	o := &serviceOptions{
+		name:  tag.Get("name"),
+		group: tag.Get("group"),
+	}
+
+	if s, ok := tag.Lookup("auth"); ok {
+		auth, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("auth: %s", err)
+		}
+
+		o.noAuth = !auth
+	}
+
+	if s, ok := tag.Lookup("throttle"); ok {
+		i := strings.IndexByte(s, ',')
+		if i == -1 {
+			return nil, fmt.Errorf("throttle: want \"<interval>,<capacity>\", got %q", s)
+		}
+
+		interval, err := time.ParseDuration(s[:i])
+		if err != nil {
+			return nil, fmt.Errorf("throttle: %s", err)
+		}
+
+		capacity, err := strconv.ParseInt(s[i+1:], 10, 64)
+		if err != nil || capacity <= 0 {
+			return nil, fmt.Errorf("throttle: invalid capacity %q", s[i+1:])
+		}
+
+		o.interval, o.capacity = interval, capacity
+	}
+
+	return o, nil
+}
@@ -0,0 +1,94 @@
+package kite
+
+import (
+	"testing"
+
+	"github.com/koding/kite/v2/config"
+)
+
+type mathService struct {
+	calls int
+}
+
+func (s *mathService) Square(r *Request, n float64) (float64, error) {
+	s.calls++
+	return n * n, nil
+}
+
+func (s *mathService) Version(r *Request) (string, error) {
+	return "1.0.0", nil
+}
+
+func (s *mathService) Ignored(n int) int {
+	return n
+}
+
+func (s *mathService) KiteTags() map[string]string {
+	return map[string]string{
+		"Version": `auth:"false" group:"public"`,
+		"Square":  `throttle:"1s,10"`,
+	}
+}
+
+func TestRegisterService(t *testing.T) {
+	cfg := config.New()
+	cfg.Port = 3661
+	cfg.DisableAuthentication = true
+
+	k := NewWithConfig("service", "0.0.1", cfg)
+
+	svc := &mathService{}
+
+	methods, err := k.RegisterService("math", svc)
+	if err != nil {
+		t.Fatalf("RegisterService()=%s", err)
+	}
+
+	if len(methods) != 2 || methods["math.square"] == nil || methods["math.version"] == nil {
+		t.Fatalf("got %v, want math.square and math.version methods", methods)
+	}
+
+	if m := methods["math.version"]; m.authenticate || m.group != "public" {
+		t.Fatalf("got authenticate=%t group=%q, want false and %q", m.authenticate, m.group, "public")
+	}
+
+	if methods["math.square"].bucket == nil {
+		t.Fatal("want math.square to be throttled")
+	}
+
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	c := New("service-client", "0.0.1").NewClient("http://127.0.0.1:3661/kite")
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	result, err := c.Tell("math.square", 4)
+	if err != nil {
+		t.Fatalf("Tell()=%s", err)
+	}
+
+	if n := result.MustFloat64(); n != 16 || svc.calls != 1 {
+		t.Fatalf("got %v (%d calls), want 16 (1 call)", n, svc.calls)
+	}
+
+	if _, err := c.Tell("math.square", "four"); err == nil {
+		t.Fatal("want Tell() to fail with invalid argument")
+	}
+
+	result, err = c.Tell("math.version")
+	if err != nil {
+		t.Fatalf("Tell()=%s", err)
+	}
+
+	if s := result.MustString(); s != "1.0.0" {
+		t.Fatalf("got %q, want %q", s, "1.0.0")
+	}
+
+	if _, err := k.RegisterService("", struct{}{}); err == nil {
+		t.Fatal("want RegisterService() to fail without suitable methods")
+	}
+}
@@ -0,0 +1,154 @@
+package kite
+
+import (
+	"net/http"
+	"path"
+
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/dnode"
+)
+
+// Session is a connection to a remote kite, which exchanges text messages.
+// The sockjs.Session interface, which is implemented by the sessions of
+// the sockjsclient package, is a superset of it.
+//
+// Implementations must deliver messages in order, must be safe for
+// concurrent Send calls and must fail Recv and Send after Close.
+// Third-party implementations can verify it with the conformance suite,
+// see kitetest.TestTransport.
+type Session interface {
+	// ID gives the unique identifier of the session.
+	ID() string
+
+	// Recv blocks until a message is received.
+	Recv() (string, error)
+
+	// Send sends a message.
+	Send(string) error
+
+	// Close closes the session with the given status code and reason.
+	Close(status uint32, reason string) error
+}
+
+// SessionInfo is implemented by sessions, which describe the connection
+// to the remote kite, see Client.RemoteAddr, Client.UserAgent and
+// Client.TransportName. Each of the methods is optional, a session may
+// implement only some of them.
+type SessionInfo interface {
+	// RemoteAddr gives the network address of the remote kite.
+	RemoteAddr() string
+
+	// UserAgent gives the User-Agent of the request, which opened
+	// the session.
+	UserAgent() string
+
+	// TransportName gives the name of the transport, like "websocket".
+	TransportName() string
+}
+
+// sessionInfo gives the description of the session connection. The
+// sessions accepted by the kite server describe themselves with the
+// HTTP request, which opened them.
+func sessionInfo(session Session) (remoteAddr, userAgent, transport string) {
+	if ts, ok := session.(*transportSession); ok {
+		session = ts.Session
+	}
+
+	if s, ok := session.(interface {
+		Request() *http.Request
+	}); ok {
+		if req := s.Request(); req != nil {
+			remoteAddr = req.RemoteAddr
+			userAgent = req.UserAgent()
+
+			// The SockJS transport is the last element of the URL
+			// path, like "/kite/123/abcd/xhr_streaming".
+			if req.URL != nil {
+				transport = path.Base(req.URL.Path)
+			}
+		}
+	}
+
+	if s, ok := session.(interface {
+		RemoteAddr() string
+	}); ok {
+		remoteAddr = s.RemoteAddr()
+	}
+
+	if s, ok := session.(interface {
+		UserAgent() string
+	}); ok {
+		userAgent = s.UserAgent()
+	}
+
+	if s, ok := session.(interface {
+		TransportName() string
+	}); ok {
+		transport = s.TransportName()
+	}
+
+	return remoteAddr, userAgent, transport
+}
+
+// BinarySession is implemented by sessions, which deliver messages byte
+// for byte. The binary arguments, see dnode.Raw, are sent as is over them,
+// while over the other sessions they are base64 encoded.
+type BinarySession interface {
+	// Binary reports whether the session delivers arbitrary bytes.
+	Binary() bool
+}
+
+// encodePayload gives the message to send over the session.
+func encodePayload(session Session, p []byte) (string, error) {
+	if ts, ok := session.(*transportSession); ok {
+		session = ts.Session
+	}
+
+	if s, ok := session.(BinarySession); ok && s.Binary() {
+		return string(p), nil
+	}
+
+	p, err := dnode.EncodeAttachments(p)
+	if err != nil {
+		return "", err
+	}
+
+	return string(p), nil
+}
+
+// Transport dials sessions to remote kites, see Client.Transport.
+type Transport interface {
+	Dial(url string, cfg *config.Config) (Session, error)
+}
+
+// TransportFunc is a type adapter to allow the use of ordinary functions
+// as transports.
+type TransportFunc func(url string, cfg *config.Config) (Session, error)
+
+// Dial calls f(url, cfg).
+func (f TransportFunc) Dial(url string, cfg *config.Config) (Session, error) {
+	return f(url, cfg)
+}
+
+// transportSession wraps a session dialed with Client.Transport. Like
+// with the sessions dialed by the sockjsclient package, requests received
+// over it are not authenticated.
+type transportSession struct {
+	Session
+}
+
+func (c *Client) dialTransport() (Session, error) {
+	session, err := c.Transport.Dial(c.URL, c.config())
+	if err != nil {
+		return nil, err
+	}
+
+	return &transportSession{session}, nil
+}
+
+// dialedByTransport tells whether the session was dialed with
+// Client.Transport.
+func dialedByTransport(session Session) bool {
+	_, ok := session.(*transportSession)
+	return ok
+}
@@ -0,0 +1,94 @@
+package kite
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/dnode"
+	"github.com/koding/kite/v2/sockjsclient"
+)
+
+func TestClient_Transport(t *testing.T) {
+	cfg := config.New()
+	cfg.Port = 3658
+	cfg.DisableAuthentication = true
+
+	k := NewWithConfig("transport", "0.0.1", cfg)
+	k.HandleFunc("echo", func(r *Request) (interface{}, error) {
+		return r.Args.One().MustString(), nil
+	})
+
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	var dials int32
+
+	c := New("transport-client", "0.0.1").NewClient("http://127.0.0.1:3658/kite")
+	c.Transport = TransportFunc(func(url string, cfg *config.Config) (Session, error) {
+		atomic.AddInt32(&dials, 1)
+		return sockjsclient.DialWebsocket(url, cfg)
+	})
+
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	if !dialedByTransport(c.getSession()) {
+		t.Fatalf("got %T, want session dialed by transport", c.getSession())
+	}
+
+	result, err := c.Tell("echo", "hello")
+	if err != nil {
+		t.Fatalf("Tell()=%s", err)
+	}
+
+	if s := result.MustString(); s != "hello" {
+		t.Fatalf("got %q, want %q", s, "hello")
+	}
+
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Fatalf("got %d dials, want 1", n)
+	}
+}
+
+type binarySession struct {
+	Session
+}
+
+func (binarySession) Binary() bool { return true }
+
+func TestEncodePayload(t *testing.T) {
+	blob := []byte{0x00, 0xff, 0x1e, '\n'}
+	p := dnode.AppendAttachments([]byte(`{"method":"foo"}`), [][]byte{blob})
+
+	msg, err := encodePayload(&transportSession{binarySession{}}, p)
+	if err != nil {
+		t.Fatalf("encodePayload()=%s", err)
+	}
+
+	if msg != string(p) {
+		t.Fatalf("got %q, want raw %q", msg, p)
+	}
+
+	if msg, err = encodePayload(&transportSession{}, p); err != nil {
+		t.Fatalf("encodePayload()=%s", err)
+	}
+
+	if !utf8.ValidString(msg) {
+		t.Fatalf("got %q, want valid UTF-8", msg)
+	}
+
+	_, attachments, err := dnode.SplitAttachments([]byte(msg))
+	if err != nil {
+		t.Fatalf("SplitAttachments()=%s", err)
+	}
+
+	if len(attachments) != 1 || !bytes.Equal(attachments[0], blob) {
+		t.Fatalf("got %q, want %q", attachments, blob)
+	}
+}
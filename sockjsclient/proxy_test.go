@@ -0,0 +1,110 @@
+package sockjsclient_test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"sync/atomic"
+	"testing"
+
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/kitetest"
+	"github.com/koding/kite/v2/sockjsclient"
+)
+
+// proxy is a HTTP forward proxy, which requires basic authentication.
+type proxy struct {
+	*httptest.Server
+	requests int32
+}
+
+func newProxy() *proxy {
+	p := &proxy{}
+	p.Server = httptest.NewServer(p)
+	return p
+}
+
+func (p *proxy) URL(user, pass string) string {
+	return "http://" + user + ":" + pass + "@" + p.Listener.Addr().String()
+}
+
+func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, pass, ok := proxyAuth(r); !ok || user != "user" || pass != "pass" {
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+
+	atomic.AddInt32(&p.requests, 1)
+
+	if r.Method != "CONNECT" {
+		r.Header.Del("Proxy-Authorization")
+		(&httputil.ReverseProxy{Director: func(*http.Request) {}}).ServeHTTP(w, r)
+		return
+	}
+
+	remote, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		remote.Close()
+		return
+	}
+
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+
+	go func() {
+		io.Copy(remote, conn)
+		remote.Close()
+	}()
+
+	go func() {
+		io.Copy(conn, remote)
+		conn.Close()
+	}()
+}
+
+func proxyAuth(r *http.Request) (user, pass string, ok bool) {
+	req := &http.Request{Header: http.Header{
+		"Authorization": r.Header["Proxy-Authorization"],
+	}}
+
+	return req.BasicAuth()
+}
+
+func testProxy(t *testing.T, dial dialFunc) {
+	p := newProxy()
+	defer p.Close()
+
+	cfg := config.New()
+	cfg.ProxyURL = p.URL("user", "pass")
+
+	testTransport(t, cfg, dial)
+
+	if atomic.LoadInt32(&p.requests) == 0 {
+		t.Fatal("want requests to be sent through the proxy")
+	}
+
+	cfg.ProxyURL = p.URL("user", "invalid")
+
+	if _, err := dial("http://127.0.0.1:1/kite", cfg); err == nil {
+		t.Fatal("want Dial() to fail with invalid proxy credentials")
+	}
+}
+
+func TestWebsocketProxy(t *testing.T) {
+	testProxy(t, func(url string, cfg *config.Config) (kitetest.Session, error) {
+		return sockjsclient.DialWebsocket(url, cfg)
+	})
+}
+
+func TestXHRProxy(t *testing.T) {
+	testProxy(t, func(url string, cfg *config.Config) (kitetest.Session, error) {
+		return sockjsclient.DialXHR(url, cfg)
+	})
+}
@@ -16,10 +16,11 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/koding/kite/config"
-	"github.com/koding/kite/utils"
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/utils"
 
 	"github.com/igm/sockjs-go/sockjs"
+	"golang.org/x/net/proxy"
 )
 
 // ErrSessionClosed is returned by Send/Recv methods when
@@ -76,6 +77,7 @@ type WebsocketSession struct {
 	messages []string
 	closed   int32
 	req      *http.Request
+	resp     *http.Response
 
 	mu    sync.Mutex
 	conn  *websocket.Conn
@@ -146,9 +148,14 @@ func DialWebsocket(uri string, cfg *config.Config) (*WebsocketSession, error) {
 	serverID := threeDigits()
 	sessionID := utils.RandomString(20)
 
+	dialer, err := websocketDialer(u, cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	u = makeWebsocketURL(u, serverID, sessionID)
 
-	conn, _, err := cfg.Websocket.Dial(u.String(), h)
+	conn, resp, err := dialer.Dial(u.String(), h)
 	if err != nil {
 		return nil, err
 	}
@@ -159,10 +166,41 @@ func DialWebsocket(uri string, cfg *config.Config) (*WebsocketSession, error) {
 		URL:    u,
 		Header: h,
 	}
+	session.resp = resp
 
 	return session, nil
 }
 
+// websocketDialer gives a copy of cfg.Websocket, which dials the remote
+// kite through the proxy given by cfg.Proxy. A dialer which has custom
+// Proxy or NetDial set is used as is.
+func websocketDialer(u *url.URL, cfg *config.Config) (*websocket.Dialer, error) {
+	dialer := *cfg.Websocket
+
+	if dialer.Proxy != nil || dialer.NetDial != nil {
+		return &dialer, nil
+	}
+
+	proxyURL, err := cfg.Proxy(&http.Request{URL: u})
+	if err != nil || proxyURL == nil {
+		return &dialer, err
+	}
+
+	switch proxyURL.Scheme {
+	case "socks5":
+		socks, err := proxy.FromURL(proxyURL, &net.Dialer{Timeout: dialer.HandshakeTimeout})
+		if err != nil {
+			return nil, err
+		}
+
+		dialer.NetDial = socks.Dial
+	default:
+		dialer.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &dialer, nil
+}
+
 // ConnectWebsocketSession dials the remote specified in the opts and
 // creates new websocket session.
 //
@@ -189,6 +227,20 @@ func (w *WebsocketSession) RemoteAddr() string {
 	return w.conn.RemoteAddr().String()
 }
 
+// UserAgent gives the User-Agent header of the websocket handshake.
+func (w *WebsocketSession) UserAgent() string {
+	if w.req == nil {
+		return ""
+	}
+
+	return w.req.UserAgent()
+}
+
+// TransportName gives the name of the SockJS transport of the session.
+func (w *WebsocketSession) TransportName() string {
+	return "websocket"
+}
+
 // ID returns a session id.
 func (w *WebsocketSession) ID() string {
 	return w.id
@@ -299,6 +351,12 @@ func (w *WebsocketSession) Request() *http.Request {
 	return w.req
 }
 
+// Response gives the response to the websocket handshake of the dialed
+// session, or nil if the session was not created with DialWebsocket.
+func (w *WebsocketSession) Response() *http.Response {
+	return w.resp
+}
+
 // threeDigits is used to generate a server_id.
 func threeDigits() string {
 	return strconv.FormatInt(100+int64(utils.Int31n(900)), 10)
@@ -4,7 +4,7 @@ import (
 	"net/url"
 	"testing"
 
-	"github.com/koding/kite/sockjsclient"
+	"github.com/koding/kite/v2/sockjsclient"
 )
 
 func TestMakeWebsocketURL(t *testing.T) {
@@ -0,0 +1,54 @@
+package sockjsclient_test
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/igm/sockjs-go/sockjs"
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/kitetest"
+	"github.com/koding/kite/v2/sockjsclient"
+)
+
+type dialFunc func(string, *config.Config) (kitetest.Session, error)
+
+func testTransport(t *testing.T, cfg *config.Config, dial dialFunc) {
+	sessions := make(chan sockjs.Session, 1)
+
+	// The server notices a closed XHR session after the disconnect delay.
+	opts := sockjs.DefaultOptions
+	opts.DisconnectDelay = time.Second
+
+	srv := httptest.NewServer(sockjs.NewHandler("/kite", opts, func(s sockjs.Session) {
+		sessions <- s
+	}))
+	defer srv.Close()
+
+	kitetest.TestTransport(t, func(t *testing.T) (client, server kitetest.Session) {
+		client, err := dial(srv.URL+"/kite", cfg.Copy())
+		if err != nil {
+			t.Fatalf("Dial()=%s", err)
+		}
+
+		select {
+		case server = <-sessions:
+		case <-time.After(kitetest.TransportTimeout):
+			t.Fatal("timed out waiting for server session")
+		}
+
+		return client, server
+	})
+}
+
+func TestWebsocketTransport(t *testing.T) {
+	testTransport(t, config.New(), func(url string, cfg *config.Config) (kitetest.Session, error) {
+		return sockjsclient.DialWebsocket(url, cfg)
+	})
+}
+
+func TestXHRTransport(t *testing.T) {
+	testTransport(t, config.New(), func(url string, cfg *config.Config) (kitetest.Session, error) {
+		return sockjsclient.DialXHR(url, cfg)
+	})
+}
@@ -8,11 +8,12 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptrace"
 	"sync"
 	"time"
 
-	"github.com/koding/kite/config"
-	"github.com/koding/kite/utils"
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/utils"
 
 	"github.com/igm/sockjs-go/sockjs"
 )
@@ -38,6 +39,7 @@ type XHRSession struct {
 	messages   []string
 	abort      chan struct{}
 	req        *http.Request
+	remoteAddr string
 	state      sockjs.SessionState
 }
 
@@ -51,9 +53,26 @@ func DialXHR(uri string, cfg *config.Config) (*XHRSession, error) {
 	serverID := threeDigits()
 	sessionID := utils.RandomString(20)
 	sessionURL := uri + "/" + serverID + "/" + sessionID
+	client := cfg.ProxyClient(cfg.XHR)
+
+	req, err := http.NewRequest("POST", sessionURL+"/xhr", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "text/plain")
+
+	// The polls may be sent over other connections, the address of
+	// the one which opened the session is the remote address.
+	var remoteAddr string
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			remoteAddr = info.Conn.RemoteAddr().String()
+		},
+	}))
 
 	// start the initial session handshake
-	sessionResp, err := cfg.XHR.Post(sessionURL+"/xhr", "text/plain", nil)
+	sessionResp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -74,10 +93,11 @@ func DialXHR(uri string, cfg *config.Config) (*XHRSession, error) {
 	}
 
 	return &XHRSession{
-		client:     cfg.XHR,
+		client:     client,
 		timeout:    cfg.Timeout,
 		sessionID:  sessionID,
 		sessionURL: sessionURL,
+		remoteAddr: remoteAddr,
 		state:      sockjs.SessionActive,
 		abort:      make(chan struct{}, 1),
 	}, nil
@@ -173,6 +193,27 @@ func (x *XHRSession) Request() *http.Request {
 	return x.req
 }
 
+// RemoteAddr gives network address of the remote kite, the one of the
+// connection which opened the session.
+func (x *XHRSession) RemoteAddr() string {
+	return x.remoteAddr
+}
+
+// UserAgent gives the User-Agent the session was opened with. The
+// sessions dialed with DialXHR do not have a request, so it's empty.
+func (x *XHRSession) UserAgent() string {
+	if x.req == nil {
+		return ""
+	}
+
+	return x.req.UserAgent()
+}
+
+// TransportName gives the name of the SockJS transport of the session.
+func (x *XHRSession) TransportName() string {
+	return "xhr"
+}
+
 func (x *XHRSession) handleResp(resp *http.Response) (msg string, again bool, err error) {
 	defer resp.Body.Close()
 
@@ -0,0 +1,414 @@
+package kite
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/koding/kite/v2/dnode"
+)
+
+// StreamWindow is the number of chunks of a stream sent ahead of the ones
+// read by the caller, before Stream.Write blocks until they are read.
+var StreamWindow = 16
+
+// ErrStreamClosed is returned when writing to a stream, which was closed
+// by the caller or whose session was disconnected, and when reading from
+// a stream after it was closed.
+var ErrStreamClosed = errors.New("stream is closed")
+
+// ErrNoStream is returned by Request.Stream if the caller does not read
+// the result as a stream, see Client.TellStream.
+var ErrNoStream = errors.New("caller does not read a stream")
+
+// streamFuncs are the functions of the caller reading the stream.
+type streamFuncs struct {
+	Open  dnode.Function `json:"open"`
+	Chunk dnode.Function `json:"chunk"`
+	End   dnode.Function `json:"end"`
+}
+
+// streamWriterFuncs are the functions of the handler writing the stream,
+// given to the caller when the stream is opened.
+type streamWriterFuncs struct {
+	Ack    dnode.Function `json:"ack"`
+	Cancel dnode.Function `json:"cancel"`
+}
+
+// streamChunk is a chunk of the stream. The chunks are numbered, so they
+// are read in order if callbacks are run concurrently.
+type streamChunk struct {
+	Seq  int       `json:"seq"`
+	Data dnode.Raw `json:"data"`
+}
+
+// streamEnd ends the stream after Count chunks were written.
+type streamEnd struct {
+	Count int    `json:"count"`
+	Err   *Error `json:"err,omitempty"`
+}
+
+// Stream writes the result of a method in chunks, which the caller reads
+// with the reader given by Client.TellStream, so large results are not
+// buffered whole on either side. It's given by Request.Stream.
+//
+// The stream is ended when the handler returns, the caller gets the error
+// returned by the handler, if any, after reading all the chunks.
+type Stream struct {
+	remote streamFuncs
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	credits int  // number of chunks we can send
+	seq     int  // number of sent chunks
+	closed  bool // set when the stream got canceled or ended
+	ended   chan struct{}
+}
+
+// Stream gives the stream the result of the method is written to in
+// chunks, it returns ErrNoStream if the caller does not read a stream.
+// Calling it many times gives the same stream.
+func (r *Request) Stream() (*Stream, error) {
+	r.streamMu.Lock()
+	defer r.streamMu.Unlock()
+
+	if r.stream != nil {
+		return r.stream, nil
+	}
+
+	if r.streamFuncs == nil || !r.streamFuncs.Chunk.IsValid() {
+		return nil, ErrNoStream
+	}
+
+	s := &Stream{
+		remote:  *r.streamFuncs,
+		credits: StreamWindow,
+		ended:   make(chan struct{}),
+	}
+
+	s.cond = sync.NewCond(&s.mu)
+
+	if err := s.remote.Open.Call(s.funcs()); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		select {
+		case <-r.Context.Done():
+			s.close()
+		case <-s.ended:
+		}
+	}()
+
+	r.stream = s
+
+	return s, nil
+}
+
+// endStream ends the stream of the request, if it was opened, with
+// the error returned by the handler.
+func (r *Request) endStream(err *Error) {
+	r.streamMu.Lock()
+	s := r.stream
+	r.streamMu.Unlock()
+
+	if s != nil {
+		s.end(err)
+	}
+}
+
+func (s *Stream) funcs() streamWriterFuncs {
+	return streamWriterFuncs{
+		Ack: dnode.PersistentCallback(func(args *dnode.Partial) {
+			n := args.One().MustFloat64()
+
+			s.mu.Lock()
+			s.credits += int(n)
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		}),
+		Cancel: dnode.PersistentCallback(func(*dnode.Partial) {
+			s.close()
+		}),
+	}
+}
+
+// Write sends p as a single chunk to the caller. It blocks when the caller
+// does not read the chunks fast enough.
+func (s *Stream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	for s.credits == 0 && !s.closed {
+		s.cond.Wait()
+	}
+
+	if s.closed {
+		s.mu.Unlock()
+		return 0, ErrStreamClosed
+	}
+
+	s.credits--
+	seq := s.seq
+	s.seq++
+	s.mu.Unlock()
+
+	if err := s.remote.Chunk.Call(&streamChunk{Seq: seq, Data: p}); err != nil {
+		s.close()
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// close makes the pending and next writes fail with ErrStreamClosed.
+func (s *Stream) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *Stream) end(err *Error) {
+	defer close(s.ended)
+
+	s.mu.Lock()
+	if s.closed && err == nil {
+		// The caller is gone or canceled the stream.
+		s.mu.Unlock()
+		return
+	}
+
+	s.closed = true
+	count := s.seq
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.remote.End.Call(&streamEnd{Count: count, Err: err})
+}
+
+// streamReader reads the chunks of a stream in order.
+type streamReader struct {
+	remote streamWriterFuncs
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	chunks   map[int][]byte // received chunks not read yet
+	next     int            // seq of the next chunk to read
+	buf      []byte         // unread part of the current chunk
+	consumed int            // number of read chunks not yet acked
+	opened   bool           // set when the remote functions are received
+	count    int            // number of chunks in the stream, -1 until ended
+	err      error          // error after the chunks are read
+	closed   bool           // set when closed by the reader
+}
+
+func newStreamReader() *streamReader {
+	r := &streamReader{
+		chunks: make(map[int][]byte),
+		count:  -1,
+	}
+
+	r.cond = sync.NewCond(&r.mu)
+
+	return r
+}
+
+// funcs gives local functions to be called by the handler.
+func (r *streamReader) funcs() *streamFuncs {
+	return &streamFuncs{
+		Open: dnode.PersistentCallback(func(args *dnode.Partial) {
+			var remote streamWriterFuncs
+			if err := args.One().Unmarshal(&remote); err != nil {
+				r.fail(err)
+				return
+			}
+
+			r.mu.Lock()
+			r.remote = remote
+			r.opened = true
+			r.mu.Unlock()
+
+			// Ack the chunks read before the stream was opened,
+			// if callbacks run concurrently.
+			r.ack(0)
+		}),
+		Chunk: dnode.PersistentCallback(func(args *dnode.Partial) {
+			var chunk streamChunk
+			if err := args.One().Unmarshal(&chunk); err != nil {
+				r.fail(err)
+				return
+			}
+
+			r.mu.Lock()
+			r.chunks[chunk.Seq] = chunk.Data
+			exceeded := len(r.chunks) > StreamWindow
+			r.cond.Broadcast()
+			r.mu.Unlock()
+
+			if exceeded {
+				// The other side does not respect the window.
+				r.fail(errors.New("stream window exceeded"))
+			}
+		}),
+		End: dnode.PersistentCallback(func(args *dnode.Partial) {
+			var end streamEnd
+			if err := args.One().Unmarshal(&end); err != nil {
+				r.fail(err)
+				return
+			}
+
+			r.mu.Lock()
+			r.count = end.Count
+			if end.Err != nil {
+				r.err = end.Err
+			}
+			r.cond.Broadcast()
+			r.mu.Unlock()
+		}),
+	}
+}
+
+// done is called with the response of the method. An error fails the
+// stream, otherwise an unopened stream is empty.
+func (r *streamReader) done(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case err != nil && r.count == -1:
+		r.count, r.err = r.next+len(r.chunks), err
+	case !r.opened && r.count == -1:
+		r.count = 0
+	}
+
+	r.cond.Broadcast()
+}
+
+// fail ends the stream with the error, discarding the unread chunks.
+func (r *streamReader) fail(err error) {
+	r.mu.Lock()
+	if r.err == nil {
+		r.err = err
+	}
+	r.count = r.next
+	r.chunks = make(map[int][]byte)
+	r.buf = nil
+	r.cond.Broadcast()
+	r.mu.Unlock()
+
+	r.cancel()
+}
+
+// Read implements the io.Reader interface. It returns io.EOF after all the
+// chunks were read, or the error the handler returned.
+func (r *streamReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+
+	for len(r.buf) == 0 {
+		if r.closed {
+			r.mu.Unlock()
+			return 0, ErrStreamClosed
+		}
+
+		if chunk, ok := r.chunks[r.next]; ok {
+			delete(r.chunks, r.next)
+			r.next++
+			r.consumed++
+			r.buf = chunk
+
+			if len(chunk) == 0 {
+				continue
+			}
+
+			break
+		}
+
+		if r.count != -1 && r.next >= r.count {
+			err := r.err
+			r.mu.Unlock()
+
+			if err == nil {
+				err = io.EOF
+			}
+
+			return 0, err
+		}
+
+		r.cond.Wait()
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	r.mu.Unlock()
+
+	r.ack(StreamWindow / 2)
+
+	return n, nil
+}
+
+// ack lets the handler know it can send more, once at least min chunks
+// were read since the last ack.
+func (r *streamReader) ack(min int) {
+	r.mu.Lock()
+	n := r.consumed
+	ok := r.opened && n > 0 && n >= min
+	if ok {
+		r.consumed = 0
+	}
+	ack := r.remote.Ack
+	r.mu.Unlock()
+
+	if ok {
+		ack.Call(n)
+	}
+}
+
+// Close implements the io.Closer interface, it cancels the stream
+// if it's not read until the end.
+func (r *streamReader) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+
+	r.closed = true
+	ended := r.count != -1
+	r.cond.Broadcast()
+	r.mu.Unlock()
+
+	if !ended {
+		r.cancel()
+	}
+
+	return nil
+}
+
+func (r *streamReader) cancel() {
+	r.mu.Lock()
+	cancel := r.remote.Cancel
+	r.mu.Unlock()
+
+	if cancel.IsValid() {
+		cancel.Call()
+	}
+}
+
+// TellStream calls the method of the remote kite, which writes its result
+// to the stream given by Request.Stream, and gives a reader of the stream.
+// The reader returns io.EOF after reading the whole stream, or the error
+// the method failed with. The result of the method is discarded.
+//
+// The reader must be closed, which cancels the stream if it's not read
+// until the end.
+func (c *Client) TellStream(method string, args ...interface{}) (io.ReadCloser, error) {
+	r := newStreamReader()
+
+	responseChan := c.goWithID(method, 0, "", args, r.funcs())
+
+	go func() {
+		resp := <-responseChan
+		r.done(resp.Err)
+	}()
+
+	return r, nil
+}
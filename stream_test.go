@@ -0,0 +1,141 @@
+package kite
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/koding/kite/v2/config"
+)
+
+func TestStream(t *testing.T) {
+	cfg := config.New()
+	cfg.Port = 3675
+	cfg.DisableAuthentication = true
+
+	k := NewWithConfig("stream", "0.0.1", cfg)
+
+	var want bytes.Buffer
+	for i := 0; i < 10*StreamWindow; i++ {
+		fmt.Fprintf(&want, "chunk %d\n", i)
+	}
+
+	k.HandleFunc("stream", func(r *Request) (interface{}, error) {
+		s, err := r.Stream()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, line := range bytes.SplitAfter(want.Bytes(), []byte("\n")) {
+			if _, err := s.Write(line); err != nil {
+				return nil, err
+			}
+		}
+
+		return nil, nil
+	})
+
+	k.HandleFunc("fail", func(r *Request) (interface{}, error) {
+		s, err := r.Stream()
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := s.Write([]byte("partial")); err != nil {
+			return nil, err
+		}
+
+		return nil, errors.New("failed after a chunk")
+	})
+
+	canceled := make(chan error, 1)
+
+	k.HandleFunc("endless", func(r *Request) (interface{}, error) {
+		s, err := r.Stream()
+		if err != nil {
+			return nil, err
+		}
+
+		for {
+			if _, err := s.Write([]byte("more")); err != nil {
+				canceled <- err
+				return nil, err
+			}
+		}
+	})
+
+	k.HandleFunc("nostream", func(r *Request) (interface{}, error) {
+		return r.Stream()
+	})
+
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	c := New("client", "0.0.1").NewClient("http://127.0.0.1:3675/kite")
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	rc, err := c.TellStream("stream")
+	if err != nil {
+		t.Fatalf("TellStream()=%s", err)
+	}
+
+	got, err := ioutil.ReadAll(rc)
+	rc.Close()
+
+	if err != nil {
+		t.Fatalf("ReadAll()=%s", err)
+	}
+
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Fatalf("got %d bytes, want %d in order", len(got), want.Len())
+	}
+
+	rc, err = c.TellStream("fail")
+	if err != nil {
+		t.Fatalf("TellStream()=%s", err)
+	}
+
+	got, err = ioutil.ReadAll(rc)
+	rc.Close()
+
+	if string(got) != "partial" {
+		t.Fatalf("got %q, want %q", got, "partial")
+	}
+
+	if e, ok := err.(*Error); !ok || e.Message != "failed after a chunk" {
+		t.Fatalf("got %#v, want the handler error", err)
+	}
+
+	rc, err = c.TellStream("endless")
+	if err != nil {
+		t.Fatalf("TellStream()=%s", err)
+	}
+
+	p := make([]byte, 4)
+	if _, err := rc.Read(p); err != nil {
+		t.Fatalf("Read()=%s", err)
+	}
+
+	rc.Close()
+
+	select {
+	case err := <-canceled:
+		if err != ErrStreamClosed {
+			t.Fatalf("got %v, want %v", err, ErrStreamClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the stream to be canceled")
+	}
+
+	_, err = c.Tell("nostream")
+	if e, ok := err.(*Error); !ok || e.Message != ErrNoStream.Error() {
+		t.Fatalf("got %v, want %v", err, ErrNoStream)
+	}
+}
@@ -0,0 +1,152 @@
+package kite
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// maxLayeredMessage is the size limit of a message received over
+// a layered session.
+const maxLayeredMessage = 64 << 20
+
+// StreamLayer transforms the byte stream of a session, e.g. to add
+// transparent compression or an extra encryption layer, see
+// NewLayeredSession.
+//
+// Data written to the stream returned by Wrap must be written through
+// to the given stream by the time Write returns, so for example
+// a compressing layer must flush on every Write. The remote end of
+// the session must be wrapped with a matching layer.
+type StreamLayer interface {
+	// Wrap returns a stream that transforms data written to and read
+	// from the given one.
+	Wrap(rwc io.ReadWriteCloser) (io.ReadWriteCloser, error)
+}
+
+// StreamLayerFunc is an adapter to allow the use of ordinary functions
+// as stream layers.
+type StreamLayerFunc func(io.ReadWriteCloser) (io.ReadWriteCloser, error)
+
+// Wrap calls f(rwc).
+func (f StreamLayerFunc) Wrap(rwc io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+	return f(rwc)
+}
+
+// NewLayeredSession gives a session, which sends and receives the messages
+// of the given session through the given layer.
+//
+// The messages are length-prefixed in the layered stream and the bytes
+// produced by the layer are sent as base64-encoded messages, so binary
+// output of the layer survives text-only transports.
+func NewLayeredSession(session Session, layer StreamLayer) (Session, error) {
+	rwc, err := layer.Wrap(&sessionStream{session: session})
+	if err != nil {
+		return nil, err
+	}
+
+	return &layeredSession{
+		Session: session,
+		rwc:     rwc,
+	}, nil
+}
+
+type layeredSession struct {
+	Session // the underlying session
+
+	rwc    io.ReadWriteCloser
+	sendMu sync.Mutex // serializes writes of messages
+}
+
+var _ Session = (*layeredSession)(nil)
+
+func (s *layeredSession) Send(msg string) error {
+	p := make([]byte, 4+len(msg))
+	binary.BigEndian.PutUint32(p, uint32(len(msg)))
+	copy(p[4:], msg)
+
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	_, err := s.rwc.Write(p)
+	return err
+}
+
+func (s *layeredSession) Recv() (string, error) {
+	var n [4]byte
+
+	if _, err := io.ReadFull(s.rwc, n[:]); err != nil {
+		return "", err
+	}
+
+	size := binary.BigEndian.Uint32(n[:])
+	if size > maxLayeredMessage {
+		return "", errors.New("layered message is too big")
+	}
+
+	p := make([]byte, size)
+
+	if _, err := io.ReadFull(s.rwc, p); err != nil {
+		return "", err
+	}
+
+	return string(p), nil
+}
+
+// Binary implements the BinarySession interface, the layered stream
+// carries messages byte for byte.
+func (s *layeredSession) Binary() bool {
+	return true
+}
+
+func (s *layeredSession) Close(status uint32, reason string) error {
+	err := s.Session.Close(status, reason)
+
+	// The layer is closed after the session, so a pending Send fails
+	// instead of blocking Close.
+	s.sendMu.Lock()
+	s.rwc.Close()
+	s.sendMu.Unlock()
+
+	return err
+}
+
+// sessionStream is a byte stream over a session, each Write is sent
+// as a single base64-encoded message.
+type sessionStream struct {
+	session Session
+	buf     []byte // remaining part of the last message
+}
+
+func (s *sessionStream) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		msg, err := s.session.Recv()
+		if err != nil {
+			return 0, err
+		}
+
+		if s.buf, err = base64.StdEncoding.DecodeString(msg); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+
+	return n, nil
+}
+
+func (s *sessionStream) Write(p []byte) (int, error) {
+	if err := s.session.Send(base64.StdEncoding.EncodeToString(p)); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Close does nothing, the session is closed by layeredSession.
+func (s *sessionStream) Close() error {
+	return nil
+}
@@ -0,0 +1,357 @@
+package kite
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/koding/kite/v2/dnode"
+	"github.com/koding/kite/v2/utils"
+)
+
+// Subscription describes a method call with a callback, which the remote
+// kite keeps calling to notify about events, like a watch.
+//
+// Subscriptions made with Client.Subscribe are made again each time
+// the client reconnects. If the local kite has a SubscriptionStore,
+// they are also persisted, so they can be restored with
+// Kite.RestoreSubscriptions after the process restarts.
+type Subscription struct {
+	// ID uniquely identifies the subscription.
+	ID string `json:"id"`
+
+	// URL is the URL of the remote kite.
+	URL string `json:"url"`
+
+	// Method is the name of the subscribed method.
+	Method string `json:"method"`
+
+	// Args is the JSON-encoded argument of the method.
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+// SubscriptionHandler is called with the arguments the remote kite calls
+// the callback of a subscription with.
+type SubscriptionHandler func(*Subscription, *dnode.Partial)
+
+// SubscriptionStore persists subscription descriptors. Implementations
+// must be safe for concurrent use.
+type SubscriptionStore interface {
+	// Put stores the subscription, replacing one with the same ID.
+	Put(*Subscription) error
+
+	// Delete removes the subscription with the given ID.
+	Delete(id string) error
+
+	// List gives all the stored subscriptions.
+	List() ([]*Subscription, error)
+}
+
+// subscription is a Subscription made by a client.
+type subscription struct {
+	*Subscription
+	handler SubscriptionHandler
+}
+
+// Subscribe calls the method of the remote kite with args and a callback,
+// which calls the handler. The remote method receives the args and
+// the callback as its arguments.
+//
+// The subscription is made again each time the client reconnects, until
+// it's removed with Unsubscribe.
+func (c *Client) Subscribe(method string, args interface{}, handler SubscriptionHandler) (*Subscription, error) {
+	p, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Subscription{
+		ID:     utils.RandomString(16),
+		URL:    c.URL,
+		Method: method,
+		Args:   p,
+	}
+
+	if err := c.subscribe(s, handler); err != nil {
+		return nil, err
+	}
+
+	if store := c.LocalKite.SubscriptionStore; store != nil {
+		if err := store.Put(s); err != nil {
+			c.Unsubscribe(s.ID)
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Unsubscribe stops making the subscription with the given ID again and
+// removes it from the SubscriptionStore. The handler is not called anymore.
+func (c *Client) Unsubscribe(id string) error {
+	c.subscriptionsMu.Lock()
+	delete(c.subscriptions, id)
+	c.subscriptionsMu.Unlock()
+
+	if store := c.LocalKite.SubscriptionStore; store != nil {
+		return store.Delete(id)
+	}
+
+	return nil
+}
+
+func (c *Client) subscribe(s *Subscription, handler SubscriptionHandler) error {
+	sub := &subscription{
+		Subscription: s,
+		handler:      handler,
+	}
+
+	c.subscriptionsMu.Lock()
+	c.initSubscriptions()
+	c.subscriptions[s.ID] = sub
+	c.subscriptionsMu.Unlock()
+
+	if err := c.callSubscription(sub); err != nil {
+		c.subscriptionsMu.Lock()
+		delete(c.subscriptions, s.ID)
+		c.subscriptionsMu.Unlock()
+
+		return err
+	}
+
+	return nil
+}
+
+// initSubscriptions makes the client subscribe again after every reconnect.
+// It must be called with subscriptionsMu held.
+func (c *Client) initSubscriptions() {
+	if c.subscriptions != nil {
+		return
+	}
+
+	c.subscriptions = make(map[string]*subscription)
+
+	c.OnConnect(func() {
+		// Connect handlers are run one by one, do not block them.
+		go c.resubscribe()
+	})
+}
+
+// callSubscription calls the subscribed method.
+func (c *Client) callSubscription(sub *subscription) error {
+	cb := dnode.PersistentCallback(func(args *dnode.Partial) {
+		c.subscriptionsMu.Lock()
+		_, ok := c.subscriptions[sub.ID]
+		c.subscriptionsMu.Unlock()
+
+		if ok {
+			sub.handler(sub.Subscription, args)
+		}
+	})
+
+	_, err := c.Tell(sub.Method, sub.Args, cb)
+	return err
+}
+
+// resubscribe makes all the subscriptions again after the client reconnected.
+func (c *Client) resubscribe() {
+	c.subscriptionsMu.Lock()
+	subs := make([]*subscription, 0, len(c.subscriptions))
+	for _, sub := range c.subscriptions {
+		subs = append(subs, sub)
+	}
+	c.subscriptionsMu.Unlock()
+
+	for _, sub := range subs {
+		if err := c.callSubscription(sub); err != nil {
+			c.LocalKite.Log.Error("Cannot subscribe to %q of %s: %s", sub.Method, c.URL, err)
+		}
+	}
+}
+
+// RestoreSubscriptions restores all the subscriptions stored in the
+// SubscriptionStore. The handlers are looked up by the method name,
+// subscriptions for methods without a handler are skipped.
+//
+// A client is dialed for each remote kite. Calling the returned clients
+// is authenticated with the kite key, the caller is responsible
+// for closing them.
+func (k *Kite) RestoreSubscriptions(handlers map[string]SubscriptionHandler) ([]*Client, error) {
+	if k.SubscriptionStore == nil {
+		return nil, errors.New("no subscription store")
+	}
+
+	subs, err := k.SubscriptionStore.List()
+	if err != nil {
+		return nil, err
+	}
+
+	clients := make(map[string]*Client)
+	var result []*Client
+
+	for _, s := range subs {
+		handler, ok := handlers[s.Method]
+		if !ok {
+			continue
+		}
+
+		c, ok := clients[s.URL]
+		if !ok {
+			c = k.NewClient(s.URL)
+
+			if key := k.KiteKey(); key != "" {
+				c.Auth = &Auth{
+					Type: "kiteKey",
+					Key:  key,
+				}
+			}
+
+			clients[s.URL] = c
+			result = append(result, c)
+		}
+
+		// The subscriptions are made once the client connects.
+		c.subscriptionsMu.Lock()
+		c.initSubscriptions()
+		c.subscriptions[s.ID] = &subscription{
+			Subscription: s,
+			handler:      handler,
+		}
+		c.subscriptionsMu.Unlock()
+	}
+
+	for _, c := range result {
+		if _, err := c.DialForever(); err != nil {
+			Close(result)
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// FileSubscriptionStore is a SubscriptionStore which keeps subscriptions
+// in a JSON file.
+type FileSubscriptionStore struct {
+	// Path is the path of the file.
+	Path string
+
+	mu sync.Mutex
+}
+
+var _ SubscriptionStore = (*FileSubscriptionStore)(nil)
+
+// NewFileSubscriptionStore gives new FileSubscriptionStore for the given file.
+func NewFileSubscriptionStore(path string) *FileSubscriptionStore {
+	return &FileSubscriptionStore{
+		Path: path,
+	}
+}
+
+// Put implements the SubscriptionStore interface.
+func (f *FileSubscriptionStore) Put(s *Subscription) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	subs, err := f.read()
+	if err != nil {
+		return err
+	}
+
+	subs[s.ID] = s
+
+	return f.write(subs)
+}
+
+// Delete implements the SubscriptionStore interface.
+func (f *FileSubscriptionStore) Delete(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	subs, err := f.read()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := subs[id]; !ok {
+		return nil
+	}
+
+	delete(subs, id)
+
+	return f.write(subs)
+}
+
+// List implements the SubscriptionStore interface.
+func (f *FileSubscriptionStore) List() ([]*Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	subs, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*Subscription, 0, len(subs))
+	for _, s := range subs {
+		list = append(list, s)
+	}
+
+	return list, nil
+}
+
+func (f *FileSubscriptionStore) read() (map[string]*Subscription, error) {
+	subs := make(map[string]*Subscription)
+
+	p, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return subs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(p, &subs); err != nil {
+		return nil, err
+	}
+
+	return subs, nil
+}
+
+// write replaces the file atomically, so it's never left half-written.
+func (f *FileSubscriptionStore) write(subs map[string]*Subscription) error {
+	p, err := json.MarshalIndent(subs, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(f.Path), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.Path), filepath.Base(f.Path))
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(p); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), f.Path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package kite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/koding/kite/v2/dnode"
+)
+
+func TestSubscription(t *testing.T) {
+	ksrv := New("subscription-server", "0.0.1")
+	ksrv.Config.DisableAuthentication = true
+	ksrv.Config.Port = 3641
+	ksrv.HandleFunc("watch", func(r *Request) (interface{}, error) {
+		args := r.Args.MustSliceOfLength(2)
+
+		topic := args[0].MustString()
+		cb := args[1].MustFunction()
+
+		go cb.Call("event on " + topic)
+
+		return nil, nil
+	})
+
+	go ksrv.Run()
+	<-ksrv.ServerReadyNotify()
+	defer ksrv.Close()
+
+	dir, err := ioutil.TempDir("", "kite-subscription")
+	if err != nil {
+		t.Fatalf("TempDir()=%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFileSubscriptionStore(filepath.Join(dir, "subscriptions.json"))
+	events := make(chan string, 1)
+
+	handler := func(s *Subscription, args *dnode.Partial) {
+		events <- args.One().MustString()
+	}
+
+	wait := func() string {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for event")
+			return ""
+		}
+	}
+
+	k := New("subscription-client", "0.0.1")
+	k.SubscriptionStore = store
+
+	c := k.NewClient("http://127.0.0.1:3641/kite")
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+
+	s, err := c.Subscribe("watch", "disk", handler)
+	if err != nil {
+		t.Fatalf("Subscribe()=%s", err)
+	}
+
+	if got := wait(); got != "event on disk" {
+		t.Fatalf("got %q, want %q", got, "event on disk")
+	}
+
+	c.Close()
+
+	// Restore the subscription as if the process was restarted.
+	k = New("subscription-client", "0.0.1")
+	k.SubscriptionStore = store
+
+	clients, err := k.RestoreSubscriptions(map[string]SubscriptionHandler{
+		"watch": handler,
+	})
+	if err != nil {
+		t.Fatalf("RestoreSubscriptions()=%s", err)
+	}
+	defer Close(clients)
+
+	if len(clients) != 1 {
+		t.Fatalf("got %d clients, want 1", len(clients))
+	}
+
+	if got := wait(); got != "event on disk" {
+		t.Fatalf("got %q, want %q", got, "event on disk")
+	}
+
+	if err := clients[0].Unsubscribe(s.ID); err != nil {
+		t.Fatalf("Unsubscribe()=%s", err)
+	}
+
+	subs, err := store.List()
+	if err != nil {
+		t.Fatalf("List()=%s", err)
+	}
+
+	if len(subs) != 0 {
+		t.Fatalf("got %d subscriptions, want 0", len(subs))
+	}
+}
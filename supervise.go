@@ -0,0 +1,98 @@
+package kite
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+
+	"github.com/koding/kite/v2/sockjsclient"
+)
+
+// Panic describes a panic recovered in one of the goroutines, which serve
+// a connection to a remote kite.
+//
+// When readLoop or sendHub panics, the session is closed and, if the client
+// is configured to reconnect, redialed. Method handlers and callbacks
+// recover their panics on their own and are not reported.
+type Panic struct {
+	// Goroutine is the name of the goroutine, "readLoop" or "sendHub".
+	Goroutine string
+
+	// Client is the connection the goroutine served.
+	Client *Client
+
+	// Value is the value passed to panic.
+	Value interface{}
+
+	// Stack is the stack trace of the goroutine.
+	Stack []byte
+}
+
+// Error implements the built-in error interface.
+func (p *Panic) Error() string {
+	return fmt.Sprintf("%s panicked: %v", p.Goroutine, p.Value)
+}
+
+// OnPanic registers a callback which is called when a goroutine of
+// a connection panics. It can be used to report crashes.
+func (k *Kite) OnPanic(handler func(*Panic)) {
+	k.handlersMu.Lock()
+	k.onPanicHandlers = append(k.onPanicHandlers, handler)
+	k.handlersMu.Unlock()
+}
+
+// Panics gives the number of panics recovered in goroutines of the kite's
+// connections.
+func (k *Kite) Panics() int64 {
+	return atomic.LoadInt64(&k.panics)
+}
+
+func (k *Kite) callOnPanicHandlers(p *Panic) {
+	k.emit(&Event{Type: EventPanic, Client: p.Client, Err: p})
+
+	k.handlersMu.RLock()
+	defer k.handlersMu.RUnlock()
+
+	for _, handler := range k.onPanicHandlers {
+		func() {
+			defer nopRecover()
+			handler(p)
+		}()
+	}
+}
+
+// handlePanic reports the panic v recovered in the goroutine and closes
+// the session, as its state is unknown. The run method calls disconnect
+// handlers afterwards and redials, if Reconnect is true.
+func (c *Client) handlePanic(goroutine string, v interface{}) *Panic {
+	p := &Panic{
+		Goroutine: goroutine,
+		Client:    c,
+		Value:     v,
+		Stack:     debug.Stack(),
+	}
+
+	c.LocalKite.Log.Error("%s\n%s", p, p.Stack)
+
+	atomic.AddInt64(&c.LocalKite.panics, 1)
+	c.LocalKite.callOnPanicHandlers(p)
+
+	if session := c.getSession(); session != nil {
+		if err := session.Close(3000, "Go away!"); err != nil && !sockjsclient.IsSessionClosed(err) {
+			c.LocalKite.Log.Debug("error closing session %s: %s", session.ID(), err)
+		}
+	}
+
+	return p
+}
+
+// superviseReadLoop runs readLoop, a panic ends the session.
+func (c *Client) superviseReadLoop() (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = c.handlePanic("readLoop", v)
+		}
+	}()
+
+	return c.readLoop()
+}
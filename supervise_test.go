@@ -0,0 +1,76 @@
+package kite
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/koding/kite/v2/config"
+)
+
+// panicLogger panics when a message with the given prefix is logged
+// on the debug level.
+type panicLogger struct {
+	Logger
+	prefix string
+}
+
+func (l panicLogger) Debug(format string, args ...interface{}) {
+	if strings.HasPrefix(format, l.prefix) {
+		panic("debug: " + format)
+	}
+	l.Logger.Debug(format, args...)
+}
+
+func TestClient_PanicRecovery(t *testing.T) {
+	cfg := config.New()
+	cfg.Port = 3655
+
+	k := NewWithConfig("supervise", "0.0.1", cfg)
+
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	ck := New("supervise-client", "0.0.1")
+	ck.Log = panicLogger{Logger: ck.Log, prefix: "readloop received"}
+
+	panics := make(chan *Panic, 1)
+	ck.OnPanic(func(p *Panic) {
+		panics <- p
+	})
+
+	c := ck.NewClient("http://127.0.0.1:3655/kite")
+
+	disconnected := make(chan struct{}, 1)
+	c.OnDisconnect(func() {
+		disconnected <- struct{}{}
+	})
+
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	// The response makes the readLoop of the client panic.
+	go c.Tell("kite.ping")
+
+	select {
+	case p := <-panics:
+		if p.Goroutine != "readLoop" || p.Client != c || len(p.Stack) == 0 {
+			t.Fatalf("got %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for panic")
+	}
+
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for disconnect")
+	}
+
+	if n := ck.Panics(); n != 1 {
+		t.Fatalf("got %d panics, want %d", n, 1)
+	}
+}
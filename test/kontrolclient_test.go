@@ -6,12 +6,12 @@ import (
 	"testing"
 	"time"
 
-	"github.com/koding/kite"
-	"github.com/koding/kite/config"
-	"github.com/koding/kite/kontrol"
-	"github.com/koding/kite/protocol"
-	"github.com/koding/kite/testkeys"
-	"github.com/koding/kite/testutil"
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/kontrol"
+	"github.com/koding/kite/v2/protocol"
+	"github.com/koding/kite/v2/testkeys"
+	"github.com/koding/kite/v2/testutil"
 )
 
 var (
@@ -7,9 +7,9 @@ import (
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
-	"github.com/koding/kite/config"
-	"github.com/koding/kite/kitekey"
-	"github.com/koding/kite/testkeys"
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/kitekey"
+	"github.com/koding/kite/v2/testkeys"
 	"github.com/koding/logging"
 	uuid "github.com/satori/go.uuid"
 )
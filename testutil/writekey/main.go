@@ -3,8 +3,8 @@ package main
 import (
 	"flag"
 	"fmt"
-	"github.com/koding/kite/kitekey"
-	"github.com/koding/kite/testutil"
+	"github.com/koding/kite/v2/kitekey"
+	"github.com/koding/kite/v2/testutil"
 	"os"
 )
 
@@ -7,8 +7,8 @@ import (
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
-	"github.com/koding/kite/kitekey"
-	"github.com/koding/kite/protocol"
+	"github.com/koding/kite/v2/kitekey"
+	"github.com/koding/kite/v2/protocol"
 )
 
 const (
@@ -16,150 +16,489 @@ const (
 	retryInterval = 10 * time.Second
 )
 
+// TokenEventType describes what happened to the token of a Client.
+type TokenEventType int
+
+const (
+	// TokenIssued is sent when a token is given to the renewer.
+	TokenIssued TokenEventType = iota
+
+	// TokenRenewed is sent after the token was renewed.
+	TokenRenewed
+
+	// TokenRenewFailed is sent when renewing the token failed,
+	// it's retried later.
+	TokenRenewFailed
+
+	// TokenExpired is sent when the remote kite rejected a call
+	// because the token has expired.
+	TokenExpired
+)
+
+var tokenEventTypes = map[TokenEventType]string{
+	TokenIssued:      "issued",
+	TokenRenewed:     "renewed",
+	TokenRenewFailed: "renewFailed",
+	TokenExpired:     "expired",
+}
+
+// String implements the fmt.Stringer interface.
+func (t TokenEventType) String() string {
+	if s, ok := tokenEventTypes[t]; ok {
+		return s
+	}
+
+	return fmt.Sprintf("TokenEventType(%d)", int(t))
+}
+
+// TokenEvent describes a change in the lifecycle of a token, which
+// is used to call a remote kite.
+type TokenEvent struct {
+	Type TokenEventType
+
+	// Kite is the remote kite the token is used for.
+	Kite protocol.Kite
+
+	// ValidUntil is the expiration time of the current token.
+	ValidUntil time.Time
+
+	// TTL is the time left until the current token expires, it's
+	// negative if it has already expired.
+	TTL time.Duration
+
+	// Err is the reason the renewal failed, set for TokenRenewFailed only.
+	Err error
+}
+
 // TokenRenewer renews the token of a Client just before it expires.
+//
+// The tokens are renewed by the token manager of the local kite, which
+// shares a token among the clients of the same remote kite and audience,
+// and renews tokens expiring close to each other with a single request
+// to kontrol.
+//
+// The lifecycle of the token can be observed with Kite.OnTokenEvent.
 type TokenRenewer struct {
-	client           *Client
-	localKite        *Kite
-	validUntil       time.Time
-	signalRenewToken chan struct{}
-	disconnect       chan struct{}
-	once             sync.Once // for c.installHandlers
-	renewLoopWG      sync.WaitGroup
+	client    *Client
+	localKite *Kite
+	token     *managedToken
+	once      sync.Once // for t.installHandlers
 }
 
 func NewTokenRenewer(r *Client, k *Kite) (*TokenRenewer, error) {
 	t := &TokenRenewer{
-		client:           r,
-		localKite:        k,
-		signalRenewToken: make(chan struct{}),
-		disconnect:       make(chan struct{}),
+		client:    r,
+		localKite: k,
+	}
+
+	validUntil, audience, err := parseToken(k, r.Auth.Key)
+	if err != nil {
+		return t, err
 	}
-	return t, t.parse(r.Auth.Key)
+
+	t.token = k.tokens.add(r, validUntil, audience)
+
+	k.tokens.sendEvent(t.token, TokenIssued, nil)
+
+	return t, nil
 }
 
-// parse the token string and set
-func (t *TokenRenewer) parse(tokenString string) error {
+// parseToken gives the expiration time and the audience of the token.
+func parseToken(k *Kite, tokenString string) (time.Time, string, error) {
 	claims := &kitekey.KiteClaims{}
 
-	_, err := jwt.ParseWithClaims(tokenString, claims, t.localKite.RSAKey)
+	_, err := jwt.ParseWithClaims(tokenString, claims, k.RSAKey)
 	if err != nil {
 		valErr, ok := err.(*jwt.ValidationError)
 		if !ok {
-			return err
+			return time.Time{}, "", err
 		}
 
 		// do noy return for ValidationErrorSignatureValid. This is because we
 		// might asked for a kite who's public Key is different what we have.
 		// We still should be able to send them requests.
 		if (valErr.Errors & jwt.ValidationErrorSignatureInvalid) == 0 {
-			return fmt.Errorf("Cannot parse token: %s", err)
+			return time.Time{}, "", fmt.Errorf("Cannot parse token: %s", err)
 		}
 	}
 
-	t.validUntil = time.Unix(claims.ExpiresAt, 0).UTC()
-	return nil
+	return time.Unix(claims.ExpiresAt, 0).UTC(), claims.Audience, nil
 }
 
-// RenewWhenExpires renews the token before it expires.
+// RenewWhenExpires renews the token before it expires, while the client
+// is connected, until it's closed.
 func (t *TokenRenewer) RenewWhenExpires() {
-	t.once.Do(t.installHandlers)
+	if t.token != nil {
+		t.once.Do(t.installHandlers)
+	}
 }
 
 func (t *TokenRenewer) installHandlers() {
-	t.client.OnConnect(t.startRenewLoop)
-	t.client.OnTokenExpire(t.sendRenewTokenSignal)
-	t.client.OnDisconnect(t.sendDisconnectSignal)
+	m := t.localKite.tokens
+
+	t.client.OnConnect(func() {
+		m.setConnected(t.client, t.token, true)
+	})
+	t.client.OnTokenExpire(func() {
+		m.sendEvent(t.token, TokenExpired, nil)
+		m.renewNow(t.token)
+	})
+	t.client.OnDisconnect(func() {
+		m.setConnected(t.client, t.token, false)
+	})
+
+	t.client.closeRenewer = func() {
+		m.remove(t.client, t.token)
+	}
+}
+
+// renewBucket is the time window, in which the expiring tokens are
+// renewed together.
+const renewBucket = 10 * time.Second
+
+// tokenKey identifies a token shared by clients.
+type tokenKey struct {
+	kiteID   string
+	audience string
+}
+
+// managedToken is a token shared by the clients of the same remote kite.
+type managedToken struct {
+	key        tokenKey
+	kite       protocol.Kite
+	token      string
+	validUntil time.Time
+	renewAt    time.Time // zero if the renewal is not scheduled
+	lastRenew  time.Time
+
+	// clients are the clients using the token, the value tells
+	// whether the client is connected.
+	clients map[*Client]bool
+}
+
+// tokenManager renews the tokens of the clients of a kite with a single
+// goroutine, which runs while there are tokens to renew.
+type tokenManager struct {
+	kite *Kite
+
+	mu      sync.Mutex // protects the fields below
+	tokens  map[tokenKey]*managedToken
+	running bool
+	wake    chan struct{}
+}
+
+func newTokenManager(k *Kite) *tokenManager {
+	return &tokenManager{
+		kite:   k,
+		tokens: make(map[tokenKey]*managedToken),
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// add adds the client with its token to the manager. The clients of
+// the same remote kite and audience share the token, which expires
+// the latest.
+func (m *tokenManager) add(c *Client, validUntil time.Time, audience string) *managedToken {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := tokenKey{kiteID: c.Kite.ID, audience: audience}
+
+	t, ok := m.tokens[key]
+	if !ok {
+		t = &managedToken{
+			key:     key,
+			kite:    c.Kite,
+			clients: make(map[*Client]bool),
+		}
+
+		m.tokens[key] = t
+	}
+
+	if validUntil.After(t.validUntil) {
+		t.token = c.Auth.Key
+		t.validUntil = validUntil
+
+		if !t.renewAt.IsZero() {
+			t.renewAt = validUntil.Add(-renewBefore)
+		}
+
+		for other := range t.clients {
+			other.setAuthKey(t.token)
+		}
+	} else {
+		c.setAuthKey(t.token)
+	}
+
+	t.clients[c] = false
+
+	return t
+}
+
+// remove removes the closed client, the token is no longer renewed
+// if no other client uses it.
+func (m *tokenManager) remove(c *Client, t *managedToken) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(t.clients, c)
+
+	if len(t.clients) == 0 && m.tokens[t.key] == t {
+		delete(m.tokens, t.key)
+	}
+
+	m.signal()
+}
+
+// setConnected schedules the renewal of the token while any of its
+// clients is connected.
+func (m *tokenManager) setConnected(c *Client, t *managedToken, connected bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := t.clients[c]; !ok {
+		return
+	}
+
+	t.clients[c] = connected
+
+	switch {
+	case connected && t.renewAt.IsZero():
+		t.renewAt = t.validUntil.Add(-renewBefore)
+	case !connected && !t.anyConnected():
+		t.renewAt = time.Time{}
+	}
+
+	m.start()
+}
+
+// renewNow renews the token right away, e.g. when the remote kite
+// rejected it as expired. The renewals are at least a second apart,
+// so a burst of rejected calls does not flood kontrol.
+func (m *tokenManager) renewNow(t *managedToken) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.tokens[t.key] != t {
+		return
+	}
+
+	t.renewAt = time.Now().UTC()
+
+	if min := t.lastRenew.Add(time.Second); t.renewAt.Before(min) {
+		t.renewAt = min
+	}
+
+	m.start()
+}
+
+func (t *managedToken) anyConnected() bool {
+	for _, connected := range t.clients {
+		if connected {
+			return true
+		}
+	}
+
+	return false
+}
+
+// start starts the renewing goroutine, if it's not running, or wakes
+// it up to reschedule the renewals.
+func (m *tokenManager) start() {
+	if !m.running {
+		m.running = true
+		go m.run()
+		return
+	}
+
+	m.signal()
 }
 
-func (t *TokenRenewer) renewLoop() {
-	t.renewLoopWG.Add(1)
-	defer t.renewLoopWG.Done()
+func (m *tokenManager) signal() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
 
-	// renews token before it expires (sends the first signal to the goroutine below)
-	go time.AfterFunc(t.renewDuration(), t.sendRenewTokenSignal)
+func (m *tokenManager) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
 
-	// renew token on signal util remote kite disconnects.
 	for {
-		select {
-		case <-t.signalRenewToken:
-			switch err := t.renewToken(); {
-			case err == nil:
-				go time.AfterFunc(t.renewDuration(), t.sendRenewTokenSignal)
-			case err == ErrNoKitesAvailable || strings.Contains(err.Error(), "no kites found"):
-				// If kite went down we're not going to renew the token,
-				// as we need to dial either way.
-				//
-				// This case handles a situation, when kite missed
-				// disconnect signal (observed to happen with XHR transport).
+		m.mu.Lock()
+		if len(m.tokens) == 0 {
+			m.running = false
+			m.mu.Unlock()
+			return
+		}
+
+		next := m.nextRenewal()
+		m.mu.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
 			default:
-				t.localKite.Log.Error("token renewer: %s Cannot renew token for Kite: %s I will retry in %d seconds...",
-					err, t.client.ID, retryInterval/time.Second)
-				// Need to sleep here litle bit because a signal is sent
-				// when an expired token is detected on incoming request.
-				// This sleep prevents the signal from coming too fast.
-				time.Sleep(1 * time.Second)
-				go time.AfterFunc(retryInterval, t.sendRenewTokenSignal)
 			}
-		case <-t.disconnect:
+		}
+
+		if next.IsZero() {
+			timer.Reset(time.Hour)
+		} else {
+			timer.Reset(next.Sub(time.Now().UTC()))
+		}
+
+		select {
+		case <-timer.C:
+			m.renewDue()
+		case <-m.wake:
+		case <-m.kite.closeC:
+			m.mu.Lock()
+			m.running = false
+			m.mu.Unlock()
 			return
 		}
 	}
 }
 
-// The duration from now to the time token needs to be renewed.
-// Needs to be calculated after renewing the token.
-func (t *TokenRenewer) renewDuration() time.Duration {
-	return t.validUntil.Add(-renewBefore).Sub(time.Now().UTC())
+// nextRenewal gives the earliest scheduled renewal, or zero time
+// if none is scheduled.
+func (m *tokenManager) nextRenewal() time.Time {
+	var next time.Time
+
+	for _, t := range m.tokens {
+		if !t.renewAt.IsZero() && (next.IsZero() || t.renewAt.Before(next)) {
+			next = t.renewAt
+		}
+	}
+
+	return next
 }
 
-func (t *TokenRenewer) startRenewLoop() {
-	// In case when t.client missed a disconnect signal (e.g. due to timeout observed
-	// by the remote end), previous renewLoop will be still running.
-	t.sendDisconnectSignal()
+// renewDue renews the tokens, whose renewal is due within renewBucket.
+func (m *tokenManager) renewDue() {
+	now := time.Now().UTC()
+
+	m.mu.Lock()
+	var due []*managedToken
+	for _, t := range m.tokens {
+		if !t.renewAt.IsZero() && t.renewAt.Before(now.Add(renewBucket)) {
+			t.renewAt = time.Time{}
+			t.lastRenew = now
+			due = append(due, t)
+		}
+	}
+	m.mu.Unlock()
+
+	if len(due) == 0 {
+		return
+	}
 
-	// if we don't wait to observe previous renewLoop goroutine handle the disconnect
-	// signal, we'd have a race resulting in new renewLoop goroutine handling it.
-	t.renewLoopWG.Wait()
+	tokens, errs := m.getTokens(due)
 
-	go t.renewLoop()
+	for i, t := range due {
+		m.renewed(t, tokens[i], errs[i])
+	}
 }
 
-func (t *TokenRenewer) sendRenewTokenSignal() {
-	// Needs to be non-blocking because tokenRenewer may be stopped.
-	select {
-	case t.signalRenewToken <- struct{}{}:
-	default:
+// getTokens gets new tokens from kontrol, with a single request if there
+// are many of them.
+func (m *tokenManager) getTokens(due []*managedToken) ([]string, []error) {
+	tokens := make([]string, len(due))
+	errs := make([]error, len(due))
+
+	kites := make([]*protocol.Kite, len(due))
+	for i, t := range due {
+		kites[i] = &protocol.Kite{ID: t.kite.ID}
+	}
+
+	if len(kites) > 1 {
+		toks, err := m.kite.GetTokens(kites)
+
+		// Kontrol may not support getTokens, the tokens are
+		// requested one by one then. The ones which failed in
+		// the batch are retried alone to tell the error of each.
+		if err == nil || toks != nil {
+			copy(tokens, toks)
+		}
 	}
+
+	for i, kite := range kites {
+		if tokens[i] == "" {
+			tokens[i], errs[i] = m.kite.GetToken(kite)
+		}
+	}
+
+	return tokens, errs
 }
 
-func (t *TokenRenewer) sendDisconnectSignal() {
-	// Needs to be non-blocking because tokenRenewer may be stopped.
-	select {
-	case t.disconnect <- struct{}{}:
+// renewed gives the renewed token to the clients, or schedules
+// a retry if the renewal failed.
+func (m *tokenManager) renewed(t *managedToken, token string, err error) {
+	var validUntil time.Time
+
+	if err == nil {
+		validUntil, _, err = parseToken(m.kite, token)
+	}
+
+	switch {
+	case err == nil:
+	case err == ErrNoKitesAvailable || strings.Contains(err.Error(), "no kites found"):
+		// If kite went down we're not going to renew the token,
+		// as we need to dial either way.
+		//
+		// This case handles a situation, when kite missed
+		// disconnect signal (observed to happen with XHR transport).
+		return
 	default:
+		m.sendEvent(t, TokenRenewFailed, err)
+
+		m.kite.Log.Error("token renewer: %s Cannot renew token for Kite: %s I will retry in %d seconds...",
+			err, t.kite.ID, retryInterval/time.Second)
+
+		m.mu.Lock()
+		if t.anyConnected() && t.renewAt.IsZero() {
+			t.renewAt = time.Now().UTC().Add(retryInterval)
+		}
+		m.mu.Unlock()
+
+		return
 	}
-}
 
-// renewToken gets a new token from a kontrolClient, parses it and sets it as the token.
-func (t *TokenRenewer) renewToken() error {
-	renew := &protocol.Kite{
-		ID: t.client.Kite.ID,
+	m.mu.Lock()
+	t.token = token
+	t.validUntil = validUntil
+
+	if t.anyConnected() {
+		t.renewAt = validUntil.Add(-renewBefore)
 	}
 
-	token, err := t.localKite.GetToken(renew)
-	if err != nil {
-		return err
+	clients := make([]*Client, 0, len(t.clients))
+	for c := range t.clients {
+		clients = append(clients, c)
 	}
+	m.mu.Unlock()
 
-	if err = t.parse(token); err != nil {
-		return err
+	for _, c := range clients {
+		c.setAuthKey(token)
+		c.callOnTokenRenewHandlers(token)
 	}
 
-	t.client.authMu.Lock()
-	t.client.Auth.Key = token
-	t.client.authMu.Unlock()
+	m.sendEvent(t, TokenRenewed, nil)
+}
 
-	t.client.callOnTokenRenewHandlers(token)
+// sendEvent notifies the handlers registered with Kite.OnTokenEvent.
+func (m *tokenManager) sendEvent(t *managedToken, typ TokenEventType, err error) {
+	m.mu.Lock()
+	validUntil := t.validUntil
+	m.mu.Unlock()
 
-	return nil
+	m.kite.callOnTokenEventHandlers(&TokenEvent{
+		Type:       typ,
+		Kite:       t.kite,
+		ValidUntil: validUntil,
+		TTL:        validUntil.Sub(time.Now().UTC()),
+		Err:        err,
+	})
 }
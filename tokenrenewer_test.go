@@ -0,0 +1,146 @@
+package kite
+
+import (
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/koding/kite/v2/kitekey"
+	"github.com/koding/kite/v2/protocol"
+	"github.com/koding/kite/v2/testkeys"
+)
+
+func newTestToken(t *testing.T, ttl time.Duration) (*kitekey.KiteClaims, string) {
+	claims := &kitekey.KiteClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    "testuser",
+			Subject:   "testuser",
+			ExpiresAt: time.Now().Add(ttl).Unix(),
+		},
+	}
+
+	key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(testkeys.Private))
+	if err != nil {
+		t.Fatalf("ParseRSAPrivateKeyFromPEM()=%s", err)
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+	if err != nil {
+		t.Fatalf("SignedString()=%s", err)
+	}
+
+	return claims, token
+}
+
+func TestTokenRenewer_OnTokenEvent(t *testing.T) {
+	k := New("token-client", "0.0.1")
+	k.Config.KontrolKey = testkeys.Public
+	k.Config.KontrolUser = "testuser"
+	k.Config.KontrolURL = "" // renewing fails without kontrol
+
+	events := make(chan *TokenEvent, 16)
+	k.OnTokenEvent(func(ev *TokenEvent) {
+		events <- ev
+	})
+
+	// The token expires before renewBefore, so it's renewed right away.
+	claims, token := newTestToken(t, 10*time.Second)
+
+	c := k.NewClient("http://127.0.0.1:3644/kite")
+	c.Kite = protocol.Kite{ID: "remote-kite"}
+	c.Auth = &Auth{Type: "token", Key: token}
+
+	r, err := NewTokenRenewer(c, k)
+	if err != nil {
+		t.Fatalf("NewTokenRenewer()=%s", err)
+	}
+	r.RenewWhenExpires()
+
+	wait := func(typ TokenEventType) *TokenEvent {
+		timeout := time.After(5 * time.Second)
+
+		for {
+			select {
+			case ev := <-events:
+				if ev.Type == typ {
+					return ev
+				}
+			case <-timeout:
+				t.Fatalf("timed out waiting for %s event", typ)
+			}
+		}
+	}
+
+	ev := wait(TokenIssued)
+	if ev.Kite.ID != "remote-kite" {
+		t.Fatalf("got %q kite, want %q", ev.Kite.ID, "remote-kite")
+	}
+
+	if ev.TTL <= 0 || ev.TTL > 10*time.Second {
+		t.Fatalf("got %s TTL, want (0s, 10s]", ev.TTL)
+	}
+
+	c.callOnTokenExpireHandlers()
+
+	if ev := wait(TokenExpired); ev.ValidUntil.Unix() != claims.ExpiresAt {
+		t.Fatalf("got %s expiration, want %s", ev.ValidUntil, time.Unix(claims.ExpiresAt, 0))
+	}
+
+	c.callOnConnectHandlers()
+	defer c.Close()
+
+	if ev := wait(TokenRenewFailed); ev.Err == nil {
+		t.Fatal("expected renew failure to carry an error")
+	}
+}
+
+func TestTokenRenewer_SharedToken(t *testing.T) {
+	k := New("token-client", "0.0.1")
+	k.Config.KontrolKey = testkeys.Public
+	k.Config.KontrolUser = "testuser"
+
+	_, older := newTestToken(t, 10*time.Minute)
+	_, newer := newTestToken(t, 20*time.Minute)
+
+	var clients []*Client
+
+	for _, token := range []string{older, newer, older} {
+		c := k.NewClient("http://127.0.0.1:3644/kite")
+		c.Kite = protocol.Kite{ID: "remote-kite"}
+		c.Auth = &Auth{Type: "token", Key: token}
+
+		r, err := NewTokenRenewer(c, k)
+		if err != nil {
+			t.Fatalf("NewTokenRenewer()=%s", err)
+		}
+		r.RenewWhenExpires()
+
+		clients = append(clients, c)
+	}
+
+	k.tokens.mu.Lock()
+	n := len(k.tokens.tokens)
+	k.tokens.mu.Unlock()
+
+	if n != 1 {
+		t.Fatalf("got %d tokens, want 1 shared by all clients", n)
+	}
+
+	for i, c := range clients {
+		if c.Auth.Key != newer {
+			t.Errorf("%d: client does not use the latest token", i)
+		}
+	}
+
+	for _, c := range clients {
+		c.Close()
+	}
+
+	k.tokens.mu.Lock()
+	n = len(k.tokens.tokens)
+	k.tokens.mu.Unlock()
+
+	if n != 0 {
+		t.Fatalf("got %d tokens after closing the clients, want 0", n)
+	}
+}
@@ -0,0 +1,550 @@
+// Package transfer implements chunked file transfers between two kites.
+//
+// The receiving (or serving) kite registers transfer methods with a Server:
+//
+//	s := &transfer.Server{Root: "/var/lib/files"}
+//	s.Register(k)
+//
+// The other kite uses SendFile to upload a local file or ReceiveFile
+// to download a remote one over a connected *kite.Client. Files are sent
+// in chunks, verified with SHA-256 checksum and optionally resumed
+// from where the previous, interrupted transfer has stopped.
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/ratelimit"
+	"github.com/koding/kite/v2"
+)
+
+// Method names registered by Server.Register.
+const (
+	MethodStat  = "transfer.stat"
+	MethodRead  = "transfer.read"
+	MethodWrite = "transfer.write"
+)
+
+// DefaultChunkSize is the size of a single chunk, used when
+// Options.ChunkSize is 0.
+const DefaultChunkSize = 256 * 1024
+
+// ErrChecksum is returned when the transferred file's checksum does not
+// match the source one.
+var ErrChecksum = errors.New("transfer: checksum mismatch")
+
+// StatArgs is a request value for the "transfer.stat" method.
+type StatArgs struct {
+	Path string `json:"path"`
+
+	// Hash requests a SHA-256 checksum of the file content.
+	Hash bool `json:"hash,omitempty"`
+
+	// HashSize, when non-zero, limits the checksum to the first
+	// HashSize bytes of the file.
+	HashSize int64 `json:"hashSize,omitempty"`
+}
+
+// FileInfo is a response value for the "transfer.stat" method.
+type FileInfo struct {
+	Path   string `json:"path"`
+	Exists bool   `json:"exists"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// ReadArgs is a request value for the "transfer.read" method.
+type ReadArgs struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"`
+	Size   int    `json:"size"`
+}
+
+// WriteArgs is a request value for the "transfer.write" method.
+type WriteArgs struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"`
+	Data   []byte `json:"data"`
+
+	// Truncate makes the file truncated before the data is written.
+	Truncate bool `json:"truncate,omitempty"`
+}
+
+// Options configures a single transfer.
+type Options struct {
+	// ChunkSize is the maximum number of bytes sent with a single call.
+	//
+	// If ChunkSize is 0, DefaultChunkSize is used.
+	ChunkSize int
+
+	// Rate limits the transfer speed to the given number of bytes
+	// per second.
+	//
+	// If Rate is 0, the speed is not limited.
+	Rate int64
+
+	// Resume makes the transfer continue from where the previous one
+	// has stopped, if the already transferred part of the file
+	// matches the source one.
+	Resume bool
+
+	// Timeout is the max time waiting for a response for a single chunk.
+	//
+	// If Timeout is 0, there's no timeout.
+	Timeout time.Duration
+
+	// Progress, when non-nil, is called after each chunk is transferred
+	// with the number of bytes transferred so far and the file size.
+	Progress func(n, size int64)
+}
+
+func (opts *Options) chunkSize() int {
+	if opts != nil && opts.ChunkSize > 0 {
+		return opts.ChunkSize
+	}
+	return DefaultChunkSize
+}
+
+func (opts *Options) bucket() *ratelimit.Bucket {
+	if opts == nil || opts.Rate <= 0 {
+		return nil
+	}
+
+	capacity := opts.Rate
+	if n := int64(opts.chunkSize()); capacity < n {
+		capacity = n
+	}
+
+	return ratelimit.NewBucketWithRate(float64(opts.Rate), capacity)
+}
+
+func (opts *Options) progress(n, size int64) {
+	if opts != nil && opts.Progress != nil {
+		opts.Progress(n, size)
+	}
+}
+
+func (opts *Options) timeout() time.Duration {
+	if opts != nil {
+		return opts.Timeout
+	}
+	return 0
+}
+
+// SendFile uploads the local file src to the dst path on the remote kite.
+func SendFile(c *kite.Client, src, dst string, opts *Options) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := fi.Size()
+
+	var offset int64
+
+	if opts != nil && opts.Resume {
+		if offset, err = sendOffset(c, f, dst, size, opts); err != nil {
+			return err
+		}
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	bucket := opts.bucket()
+	buf := make([]byte, opts.chunkSize())
+
+	for truncate := offset == 0; truncate || offset < size; truncate = false {
+		n, err := io.ReadFull(f, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		if bucket != nil {
+			bucket.Wait(int64(n))
+		}
+
+		args := &WriteArgs{
+			Path:     dst,
+			Offset:   offset,
+			Data:     buf[:n],
+			Truncate: truncate,
+		}
+
+		if _, err := c.TellWithTimeout(MethodWrite, opts.timeout(), args); err != nil {
+			return err
+		}
+
+		offset += int64(n)
+		opts.progress(offset, size)
+
+		if n == 0 {
+			break
+		}
+	}
+
+	sum, err := hashFile(src, 0)
+	if err != nil {
+		return err
+	}
+
+	remote, err := stat(c, &StatArgs{Path: dst, Hash: true}, opts)
+	if err != nil {
+		return err
+	}
+
+	if remote.SHA256 != sum {
+		return ErrChecksum
+	}
+
+	return nil
+}
+
+// sendOffset gives the offset the upload should be resumed from.
+func sendOffset(c *kite.Client, f *os.File, dst string, size int64, opts *Options) (int64, error) {
+	remote, err := stat(c, &StatArgs{Path: dst}, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	if !remote.Exists || remote.Size == 0 || remote.Size > size {
+		return 0, nil
+	}
+
+	remote, err = stat(c, &StatArgs{Path: dst, Hash: true, HashSize: remote.Size}, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	sum, err := hash(f, remote.Size)
+	if err != nil {
+		return 0, err
+	}
+
+	if sum != remote.SHA256 {
+		return 0, nil
+	}
+
+	return remote.Size, nil
+}
+
+// ReceiveFile downloads the src file from the remote kite and writes
+// it to the local dst path.
+func ReceiveFile(c *kite.Client, src, dst string, opts *Options) error {
+	remote, err := stat(c, &StatArgs{Path: src, Hash: true}, opts)
+	if err != nil {
+		return err
+	}
+
+	if !remote.Exists {
+		return fmt.Errorf("transfer: %s does not exist", src)
+	}
+
+	var offset int64
+
+	if opts != nil && opts.Resume {
+		if offset, err = receiveOffset(c, src, dst, remote.Size, opts); err != nil {
+			return err
+		}
+	}
+
+	flag := os.O_WRONLY | os.O_CREATE
+	if offset == 0 {
+		flag |= os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(dst, flag, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err := receive(c, f, src, offset, remote.Size, opts); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	sum, err := hashFile(dst, 0)
+	if err != nil {
+		return err
+	}
+
+	if sum != remote.SHA256 {
+		return ErrChecksum
+	}
+
+	return nil
+}
+
+func receive(c *kite.Client, f *os.File, src string, offset, size int64, opts *Options) error {
+	bucket := opts.bucket()
+
+	for offset < size {
+		args := &ReadArgs{
+			Path:   src,
+			Offset: offset,
+			Size:   opts.chunkSize(),
+		}
+
+		resp, err := c.TellWithTimeout(MethodRead, opts.timeout(), args)
+		if err != nil {
+			return err
+		}
+
+		var p []byte
+		if err := resp.Unmarshal(&p); err != nil {
+			return err
+		}
+
+		if len(p) == 0 {
+			return io.ErrUnexpectedEOF
+		}
+
+		if bucket != nil {
+			bucket.Wait(int64(len(p)))
+		}
+
+		if _, err := f.WriteAt(p, offset); err != nil {
+			return err
+		}
+
+		offset += int64(len(p))
+		opts.progress(offset, size)
+	}
+
+	return nil
+}
+
+// receiveOffset gives the offset the download should be resumed from.
+func receiveOffset(c *kite.Client, src, dst string, size int64, opts *Options) (int64, error) {
+	fi, err := os.Stat(dst)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if fi.Size() == 0 || fi.Size() > size {
+		return 0, nil
+	}
+
+	remote, err := stat(c, &StatArgs{Path: src, Hash: true, HashSize: fi.Size()}, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	sum, err := hashFile(dst, fi.Size())
+	if err != nil {
+		return 0, err
+	}
+
+	if sum != remote.SHA256 {
+		return 0, nil
+	}
+
+	return fi.Size(), nil
+}
+
+func stat(c *kite.Client, args *StatArgs, opts *Options) (*FileInfo, error) {
+	resp, err := c.TellWithTimeout(MethodStat, opts.timeout(), args)
+	if err != nil {
+		return nil, err
+	}
+
+	var fi FileInfo
+	if err := resp.Unmarshal(&fi); err != nil {
+		return nil, err
+	}
+
+	return &fi, nil
+}
+
+// Server serves transfer methods for files under the Root directory.
+type Server struct {
+	// Root is a directory all the transferred files are read from
+	// and written to.
+	//
+	// Required.
+	Root string
+}
+
+// Register registers transfer methods on the given kite.
+func (s *Server) Register(k *kite.Kite) {
+	k.HandleFunc(MethodStat, s.HandleStat)
+	k.HandleFunc(MethodRead, s.HandleRead)
+	k.HandleFunc(MethodWrite, s.HandleWrite)
+}
+
+// HandleStat is a handler for the "transfer.stat" method.
+func (s *Server) HandleStat(r *kite.Request) (interface{}, error) {
+	var args StatArgs
+
+	if err := r.Args.One().Unmarshal(&args); err != nil {
+		return nil, err
+	}
+
+	path, err := s.path(args.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return &FileInfo{Path: args.Path}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.IsDir() {
+		return nil, fmt.Errorf("transfer: %s is a directory", args.Path)
+	}
+
+	info := &FileInfo{
+		Path:   args.Path,
+		Exists: true,
+		Size:   fi.Size(),
+	}
+
+	if args.Hash {
+		if info.SHA256, err = hashFile(path, args.HashSize); err != nil {
+			return nil, err
+		}
+	}
+
+	return info, nil
+}
+
+// HandleRead is a handler for the "transfer.read" method.
+func (s *Server) HandleRead(r *kite.Request) (interface{}, error) {
+	var args ReadArgs
+
+	if err := r.Args.One().Unmarshal(&args); err != nil {
+		return nil, err
+	}
+
+	if args.Size <= 0 || args.Size > DefaultChunkSize*16 {
+		return nil, fmt.Errorf("transfer: invalid chunk size %d", args.Size)
+	}
+
+	path, err := s.path(args.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := make([]byte, args.Size)
+
+	n, err := f.ReadAt(p, args.Offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return p[:n], nil
+}
+
+// HandleWrite is a handler for the "transfer.write" method.
+func (s *Server) HandleWrite(r *kite.Request) (interface{}, error) {
+	var args WriteArgs
+
+	if err := r.Args.One().Unmarshal(&args); err != nil {
+		return nil, err
+	}
+
+	path, err := s.path(args.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	flag := os.O_WRONLY | os.O_CREATE
+	if args.Truncate {
+		flag |= os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// Do not allow holes in the file.
+	if args.Offset > fi.Size() {
+		f.Close()
+		return nil, fmt.Errorf("transfer: offset %d is past the end of file (%d)", args.Offset, fi.Size())
+	}
+
+	if _, err := f.WriteAt(args.Data, args.Offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return nil, f.Close()
+}
+
+// path gives the absolute path for the given one, ensuring
+// it does not escape the Root directory.
+func (s *Server) path(path string) (string, error) {
+	if s.Root == "" {
+		return "", errors.New("transfer: root directory is not set")
+	}
+
+	if path == "" {
+		return "", errors.New("transfer: empty path")
+	}
+
+	return filepath.Join(s.Root, filepath.FromSlash(filepath.Clean("/"+path))), nil
+}
+
+// hashFile gives a SHA-256 checksum of the first n bytes of the file,
+// or the whole file if n is 0.
+func hashFile(path string, n int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return hash(f, n)
+}
+
+func hash(r io.ReaderAt, n int64) (string, error) {
+	if n == 0 {
+		n = 1<<63 - 1
+	}
+
+	h := sha256.New()
+
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, n)); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,99 @@
+package transfer_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/transfer"
+)
+
+func TestTransfer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kite-transfer")
+	if err != nil {
+		t.Fatalf("TempDir()=%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatalf("Mkdir()=%s", err)
+	}
+
+	k := kite.New("files", "0.0.1")
+	k.Config.DisableAuthentication = true
+	k.Config.Port = 5656
+
+	s := &transfer.Server{Root: root}
+	s.Register(k)
+
+	go k.Run()
+	defer k.Close()
+	<-k.ServerReadyNotify()
+
+	c := kite.New("client", "0.0.1").NewClient("http://127.0.0.1:5656/kite")
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	content := make([]byte, 100*1024+17)
+	rand.Read(content)
+
+	src := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(src, content, 0644); err != nil {
+		t.Fatalf("WriteFile()=%s", err)
+	}
+
+	opts := &transfer.Options{
+		ChunkSize: 16 * 1024,
+		Timeout:   4 * time.Second,
+	}
+
+	if err := transfer.SendFile(c, src, "/sub/../file", opts); err != nil {
+		t.Fatalf("SendFile()=%s", err)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(root, "file"))
+	if err != nil {
+		t.Fatalf("ReadFile()=%s", err)
+	}
+
+	if !bytes.Equal(got, content) {
+		t.Fatal("sent file does not match the source one")
+	}
+
+	// Write half of the file and resume the download.
+	dst := filepath.Join(dir, "dst")
+	if err := ioutil.WriteFile(dst, content[:len(content)/2], 0644); err != nil {
+		t.Fatalf("WriteFile()=%s", err)
+	}
+
+	var transferred []int64
+
+	opts.Resume = true
+	opts.Progress = func(n, size int64) {
+		transferred = append(transferred, n)
+	}
+
+	if err := transfer.ReceiveFile(c, "file", dst, opts); err != nil {
+		t.Fatalf("ReceiveFile()=%s", err)
+	}
+
+	if got, err = ioutil.ReadFile(dst); err != nil {
+		t.Fatalf("ReadFile()=%s", err)
+	}
+
+	if !bytes.Equal(got, content) {
+		t.Fatal("received file does not match the source one")
+	}
+
+	if len(transferred) == 0 || transferred[0] <= int64(len(content)/2) {
+		t.Fatalf("expected the download to be resumed, got %v", transferred)
+	}
+}
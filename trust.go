@@ -0,0 +1,150 @@
+package kite
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustPolicy describes remote kites which are allowed to call methods
+// without being authenticated with a token or kite key. It is meant for
+// kites running inside a private network, where kontrol is not deployed.
+//
+// A request is trusted when it comes from one of the Networks or when
+// the client presented a TLS certificate with one of the SPIFFEIDs.
+type TrustPolicy struct {
+	// Networks are the trusted source address ranges.
+	Networks []*net.IPNet
+
+	// SPIFFEIDs are the trusted SPIFFE IDs, like
+	// "spiffe://example.org/billing". An ID ending with "/*" matches
+	// all the IDs under the given path.
+	//
+	// The ID is read from the URI SAN of a client certificate, which
+	// must be verified by the server, so Kite.TLSConfig must have
+	// ClientAuth and ClientCAs set.
+	SPIFFEIDs []string
+
+	// Username is the username of trusted requests. If empty, the username
+	// sent by the remote kite is used.
+	Username string
+}
+
+// NewTrustPolicy gives a policy which trusts the given networks
+// in CIDR notation, like "10.0.0.0/8".
+func NewTrustPolicy(cidrs ...string) (*TrustPolicy, error) {
+	p := &TrustPolicy{}
+
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		p.Networks = append(p.Networks, ipnet)
+	}
+
+	return p, nil
+}
+
+// Trust makes methods of the given group accept requests matching the
+// policy without authentication. Methods are put into groups with
+// Method.Group, methods without a group belong to the "" group.
+//
+// Requests which do not match the policy are authenticated as usual.
+func (k *Kite) Trust(group string, p *TrustPolicy) {
+	k.handlersMu.Lock()
+	if k.trustPolicies == nil {
+		k.trustPolicies = make(map[string]*TrustPolicy)
+	}
+	k.trustPolicies[group] = p
+	k.handlersMu.Unlock()
+}
+
+// Group puts the method into the given group, which is used to configure
+// trust policies with Kite.Trust.
+func (m *Method) Group(group string) *Method {
+	m.group = group
+	return m
+}
+
+// trusted returns true if the request can be served without authentication
+// according to the trust policy of the given method group. If so, it sets
+// the username of the request.
+func (k *Kite) trusted(r *Request, group string) bool {
+	k.handlersMu.RLock()
+	p, ok := k.trustPolicies[group]
+	k.handlersMu.RUnlock()
+
+	if !ok || !p.match(r) {
+		return false
+	}
+
+	if p.Username != "" {
+		r.Client.SetUsername(p.Username)
+	}
+
+	r.Username = r.Client.Kite.Username
+
+	return true
+}
+
+func (p *TrustPolicy) match(r *Request) bool {
+	session, ok := r.Client.getSession().(interface {
+		Request() *http.Request
+	})
+	if !ok {
+		return false
+	}
+
+	req := session.Request()
+	if req == nil {
+		return false
+	}
+
+	if len(p.Networks) != 0 {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+
+		if ip := net.ParseIP(host); ip != nil {
+			for _, ipnet := range p.Networks {
+				if ipnet.Contains(ip) {
+					return true
+				}
+			}
+		}
+	}
+
+	if len(p.SPIFFEIDs) != 0 && req.TLS != nil && len(req.TLS.VerifiedChains) != 0 {
+		for _, uri := range req.TLS.VerifiedChains[0][0].URIs {
+			if uri.Scheme != "spiffe" {
+				continue
+			}
+
+			if matchSPIFFEID(p.SPIFFEIDs, uri.String()) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func matchSPIFFEID(patterns []string, id string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "/*") {
+			if strings.HasPrefix(id, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+			continue
+		}
+
+		if pattern == id {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,70 @@
+package kite
+
+import (
+	"testing"
+)
+
+func TestTrust(t *testing.T) {
+	ksrv := New("trust-server", "0.0.1")
+	ksrv.Config.Port = 3640
+	ksrv.HandleFunc("whoami", func(r *Request) (interface{}, error) {
+		return r.Username, nil
+	})
+	ksrv.HandleFunc("admin.whoami", func(r *Request) (interface{}, error) {
+		return r.Username, nil
+	}).Group("admin")
+
+	p, err := NewTrustPolicy("127.0.0.0/8", "::1/128")
+	if err != nil {
+		t.Fatalf("NewTrustPolicy()=%s", err)
+	}
+	p.Username = "mesh"
+
+	ksrv.Trust("", p)
+
+	go ksrv.Run()
+	<-ksrv.ServerReadyNotify()
+	defer ksrv.Close()
+
+	c := New("trust-client", "0.0.1").NewClient("http://127.0.0.1:3640/kite")
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	result, err := c.Tell("whoami")
+	if err != nil {
+		t.Fatalf("Tell(whoami)=%s", err)
+	}
+
+	if got := result.MustString(); got != "mesh" {
+		t.Fatalf("got %q, want %q", got, "mesh")
+	}
+
+	_, err = c.Tell("admin.whoami")
+	if e, ok := err.(*Error); !ok || e.Type != "authenticationError" {
+		t.Fatalf("got %#v, want authenticationError", err)
+	}
+}
+
+func TestMatchSPIFFEID(t *testing.T) {
+	patterns := []string{
+		"spiffe://example.org/billing",
+		"spiffe://example.org/ns/prod/*",
+	}
+
+	cases := map[string]bool{
+		"spiffe://example.org/billing":         true,
+		"spiffe://example.org/billing/worker":  false,
+		"spiffe://example.org/ns/prod/payment": true,
+		"spiffe://example.org/ns/prod":         false,
+		"spiffe://example.org/ns/dev/payment":  false,
+		"spiffe://other.org/billing":           false,
+	}
+
+	for id, want := range cases {
+		if got := matchSPIFFEID(patterns, id); got != want {
+			t.Errorf("%s: got %t, want %t", id, got, want)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package tunnelproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/websocket"
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/utils"
+)
+
+// ForwardArgs are arguments of the "forward" method of the proxy.
+type ForwardArgs struct {
+	// Port is the requested public port. If 0, a random port is used.
+	Port int `json:"port"`
+}
+
+// ForwardResult is a result of the "forward" method of the proxy.
+type ForwardResult struct {
+	// ID of the forwarding.
+	ID string `json:"id"`
+
+	// Addr is the public address connections are forwarded from.
+	Addr string `json:"addr"`
+
+	// URL is a websocket URL the kite dials to receive
+	// the forwarded connections.
+	URL string `json:"url"`
+}
+
+// forward is a public TCP listener which connections are forwarded
+// to a kite over a multiplexed session.
+type forward struct {
+	id      string
+	kiteID  string
+	l       net.Listener
+	started chan struct{} // closed when the kite connects
+	once    sync.Once
+}
+
+func (f *forward) close() {
+	f.l.Close()
+}
+
+func (f *forward) serve(sess *Session) {
+	defer sess.Close()
+
+	go func() {
+		<-sess.CloseNotify()
+		f.l.Close()
+	}()
+
+	for {
+		conn, err := f.l.Accept()
+		if err != nil {
+			return
+		}
+
+		st, err := sess.Open()
+		if err != nil {
+			conn.Close()
+			return
+		}
+
+		go JoinStreams(conn, st)
+	}
+}
+
+// handleForwardRequest opens a public TCP listener for the requesting kite
+// and gives it the URL to receive the forwarded connections from.
+func (p *Proxy) handleForwardRequest(r *kite.Request) (interface{}, error) {
+	const timeout = 1 * time.Minute
+
+	var args ForwardArgs
+
+	if r.Args != nil {
+		if a, err := r.Args.Slice(); err == nil && len(a) != 0 {
+			a[0].MustUnmarshal(&args)
+		}
+	}
+
+	l, err := net.Listen("tcp", net.JoinHostPort(p.Kite.Config.IP, strconv.Itoa(args.Port)))
+	if err != nil {
+		return nil, err
+	}
+
+	f := &forward{
+		id:      utils.RandomString(16),
+		kiteID:  r.Client.ID,
+		l:       l,
+		started: make(chan struct{}),
+	}
+
+	signed, err := p.signToken(jwt.MapClaims{
+		"sub": f.kiteID,
+		"fwd": f.id,
+	}, timeout)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	p.forwardsMu.Lock()
+	p.forwards[f.id] = f
+	p.forwardsMu.Unlock()
+
+	// Stop forwarding if the kite does not connect in time.
+	go func() {
+		select {
+		case <-f.started:
+		case <-time.After(timeout):
+			p.closeForward(f.id)
+		}
+	}()
+
+	forwardURL := *p.url
+	forwardURL.Path = "/forward/" + f.id
+	forwardURL.RawQuery = "token=" + signed
+
+	host, _, err := net.SplitHostPort(p.PublicHost)
+	if err != nil {
+		host = p.PublicHost
+	}
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	p.Kite.Log.Info("Forwarding port %s to kite %s", port, f.kiteID)
+
+	return &ForwardResult{
+		ID:   f.id,
+		Addr: net.JoinHostPort(host, port),
+		URL:  forwardURL.String(),
+	}, nil
+}
+
+// handleForward is the kite side of the port forwarding.
+func (p *Proxy) handleForward(w http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(req.URL.Path, "/forward/")
+
+	claims, err := p.parseToken(req.URL.Query().Get("token"))
+	if err != nil {
+		p.Kite.Log.Error("Invalid forward token: %s", err)
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	if fwd, _ := claims["fwd"].(string); fwd != id {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	p.forwardsMu.Lock()
+	f, ok := p.forwards[id]
+	p.forwardsMu.Unlock()
+
+	if !ok {
+		p.Kite.Log.Error("Forward not found: %s", id)
+		http.NotFound(w, req)
+		return
+	}
+
+	setRequestKite(req, f.kiteID)
+
+	started := false
+	f.once.Do(func() {
+		close(f.started)
+		started = true
+	})
+
+	if !started {
+		http.Error(w, "forward already started", http.StatusConflict)
+		return
+	}
+
+	defer p.closeForward(id)
+
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
+	}
+
+	conn, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		p.Kite.Log.Error("Cannot upgrade forward connection: %s", err)
+		return
+	}
+
+	f.serve(NewWebsocketSession(conn, false))
+}
+
+func (p *Proxy) closeForward(id string) {
+	p.forwardsMu.Lock()
+	f, ok := p.forwards[id]
+	delete(p.forwards, id)
+	p.forwardsMu.Unlock()
+
+	if ok {
+		f.close()
+	}
+}
+
+// closeForwards closes all forwards of the given kite.
+func (p *Proxy) closeForwards(kiteID string) {
+	p.forwardsMu.Lock()
+	var ids []string
+	for id, f := range p.forwards {
+		if f.kiteID == kiteID {
+			ids = append(ids, id)
+		}
+	}
+	p.forwardsMu.Unlock()
+
+	for _, id := range ids {
+		p.closeForward(id)
+	}
+}
+
+func (p *Proxy) signToken(claims jwt.MapClaims, ttl time.Duration) (string, error) {
+	const leeway = time.Duration(1 * time.Minute)
+
+	rsaPrivate, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(p.privKey))
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(ttl).Add(leeway).Unix()
+	claims["nbf"] = now.Add(-leeway).Unix()
+
+	return jwt.NewWithClaims(jwt.GetSigningMethod("RS256"), claims).SignedString(rsaPrivate)
+}
+
+func (p *Proxy) parseToken(tokenString string) (jwt.MapClaims, error) {
+	getPublicKey := func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, errors.New("invalid signing method")
+		}
+
+		return jwt.ParseRSAPublicKeyFromPEM([]byte(p.pubKey))
+	}
+
+	token, err := jwt.Parse(tokenString, getPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return token.Claims.(jwt.MapClaims), nil
+}
+
+// Forwarder forwards connections from a public port of a tunnel proxy
+// to a local address.
+type Forwarder struct {
+	// Addr is the public address of the forwarded port.
+	Addr string
+
+	localAddr string
+	sess      *Session
+}
+
+// Forward asks the tunnel proxy, which c is connected to, to forward
+// connections from a public port to the given local address. If port
+// is 0, the proxy picks a random one.
+//
+// Connections are forwarded until the Forwarder is closed or the kite
+// disconnects from the proxy.
+func Forward(c *kite.Client, localAddr string, port int) (*Forwarder, error) {
+	result, err := c.TellWithTimeout("forward", 4*time.Second, &ForwardArgs{Port: port})
+	if err != nil {
+		return nil, err
+	}
+
+	var res ForwardResult
+	if err := result.Unmarshal(&res); err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(res.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	requestHeader := http.Header{}
+	requestHeader.Add("Origin", "http://"+u.Host)
+
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), requestHeader)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to %s: %s", u.Host, err)
+	}
+
+	f := &Forwarder{
+		Addr:      res.Addr,
+		localAddr: localAddr,
+		sess:      NewWebsocketSession(conn, true),
+	}
+
+	go f.serve()
+
+	return f, nil
+}
+
+func (f *Forwarder) serve() {
+	for {
+		st, err := f.sess.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			conn, err := net.Dial("tcp", f.localAddr)
+			if err != nil {
+				st.Close()
+				return
+			}
+
+			JoinStreams(conn, st)
+		}()
+	}
+}
+
+// CloseNotify returns a channel that is closed when forwarding stops.
+func (f *Forwarder) CloseNotify() <-chan struct{} {
+	return f.sess.CloseNotify()
+}
+
+// Close stops forwarding.
+func (f *Forwarder) Close() error {
+	return f.sess.Close()
+}
+
+// NewWebsocketSession creates a new multiplexed session over the websocket
+// connection, see NewSession.
+func NewWebsocketSession(conn *websocket.Conn, client bool) *Session {
+	return NewSession(&wsConn{Conn: conn}, client)
+}
+
+// wsConn is a stream over websocket binary messages.
+type wsConn struct {
+	*websocket.Conn
+	r io.Reader
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.r == nil {
+			_, r, err := c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			c.r = r
+		}
+
+		n, err := c.r.Read(p)
+		if err == io.EOF {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
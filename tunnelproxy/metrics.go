@@ -0,0 +1,123 @@
+package tunnelproxy
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/koding/kite/v2/metrics"
+)
+
+// proxyMetrics are the Prometheus metrics of the served requests.
+type proxyMetrics struct {
+	requests *metrics.Counter
+	duration *metrics.Histogram
+	bytesIn  *metrics.Counter
+	bytesOut *metrics.Counter
+}
+
+func (p *Proxy) newMetrics() {
+	p.Metrics = metrics.NewRegistry()
+
+	p.metrics = proxyMetrics{
+		requests: p.Metrics.NewCounter("kite_tunnelproxy_requests_total",
+			"Number of served requests.", "kind", "code"),
+		duration: p.Metrics.NewHistogram("kite_tunnelproxy_request_duration_seconds",
+			"Duration of served requests, until the connection is closed for tunnels.", nil, "kind"),
+		bytesIn: p.Metrics.NewCounter("kite_tunnelproxy_received_bytes_total",
+			"Number of bytes received from the clients.", "kind"),
+		bytesOut: p.Metrics.NewCounter("kite_tunnelproxy_sent_bytes_total",
+			"Number of bytes sent to the clients.", "kind"),
+	}
+
+	p.Metrics.NewGaugeFunc("kite_tunnelproxy_virtual_hosts", "Number of exposed virtual hosts.", func() float64 {
+		p.vhostsMu.Lock()
+		defer p.vhostsMu.Unlock()
+
+		return float64(len(p.vhosts))
+	})
+
+	p.Metrics.NewGaugeFunc("kite_tunnelproxy_forwards", "Number of forwarded ports.", func() float64 {
+		p.forwardsMu.Lock()
+		defer p.forwardsMu.Unlock()
+
+		return float64(len(p.forwards))
+	})
+}
+
+// requestKind gives the kind of the request served by the mux for
+// the metrics: "proxy", "tunnel", "forward" or "vhost" for the endpoints
+// of the proxy, "kite" otherwise. Requests to the virtual hosts are
+// of the "virtualhost" kind.
+func requestKind(req *http.Request) string {
+	switch kind := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)[0]; kind {
+	case "proxy", "tunnel", "forward", "vhost":
+		return kind
+	}
+
+	return "kite"
+}
+
+// requestInfo is filled by the handlers once they know the kite
+// the request is served by, if it's not known upfront.
+type requestInfo struct {
+	mu     sync.Mutex
+	kiteID string
+}
+
+type requestInfoKey struct{}
+
+// setRequestKite records the kite of the request for the access log.
+func setRequestKite(req *http.Request, kiteID string) {
+	if ri, ok := req.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		ri.mu.Lock()
+		ri.kiteID = kiteID
+		ri.mu.Unlock()
+	}
+}
+
+// serveLogged serves the request with h, recording it in the access log
+// and the metrics.
+func (p *Proxy) serveLogged(w http.ResponseWriter, req *http.Request, h http.Handler, kind, kiteID string) {
+	start := time.Now()
+	ri := &requestInfo{kiteID: kiteID}
+	rw := metrics.NewResponseWriter(w, req)
+
+	h.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), requestInfoKey{}, ri)))
+
+	ri.mu.Lock()
+	kiteID = ri.kiteID
+	ri.mu.Unlock()
+
+	latency := time.Since(start)
+
+	p.metrics.requests.Inc(kind, strconv.Itoa(rw.Status()))
+	p.metrics.duration.Observe(latency.Seconds(), kind)
+	p.metrics.bytesIn.Add(float64(rw.BytesIn()), kind)
+	p.metrics.bytesOut.Add(float64(rw.BytesOut()), kind)
+
+	p.accessLog(&metrics.AccessLogEntry{
+		Time:       start,
+		RemoteAddr: req.RemoteAddr,
+		Method:     req.Method,
+		Host:       req.Host,
+		Path:       req.URL.Path,
+		KiteID:     kiteID,
+		Status:     rw.Status(),
+		BytesIn:    rw.BytesIn(),
+		BytesOut:   rw.BytesOut(),
+		Latency:    latency,
+	})
+}
+
+func (p *Proxy) accessLog(e *metrics.AccessLogEntry) {
+	if p.AccessLog != nil {
+		p.AccessLog(e)
+		return
+	}
+
+	p.Kite.Log.Info("%s", e)
+}
@@ -0,0 +1,524 @@
+package tunnelproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Frame types of the multiplexing protocol.
+const (
+	frameOpen   byte = iota + 1 // opens a new stream
+	frameData                   // carries stream data
+	frameWindow                 // grants the sender more window
+	frameClose                  // half-closes the stream
+)
+
+const (
+	frameHeaderSize = 9         // type (1) + stream ID (4) + length (4)
+	maxFrameSize    = 32 * 1024 // max data frame payload
+	streamWindow    = 256 * 1024
+)
+
+// ErrSessionClosed is returned when using a closed multiplexed session.
+var ErrSessionClosed = errors.New("session is closed")
+
+// errTimeout is returned by Stream operations after their deadline.
+var errTimeout net.Error = timeoutError{}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Stats are the traffic statistics of a Session.
+type Stats struct {
+	BytesIn  int64 `json:"bytesIn"`  // stream data received
+	BytesOut int64 `json:"bytesOut"` // stream data sent
+	Streams  int64 `json:"streams"`  // streams opened by either side
+}
+
+// Add gives the sum of the statistics.
+func (s Stats) Add(other Stats) Stats {
+	return Stats{
+		BytesIn:  s.BytesIn + other.BytesIn,
+		BytesOut: s.BytesOut + other.BytesOut,
+		Streams:  s.Streams + other.Streams,
+	}
+}
+
+// Session multiplexes many streams over a single connection, like a TCP
+// connection or a websocket. Streams are flow-controlled with a fixed
+// receive window, so a slow reader does not block the other streams.
+//
+// The Session is used by tunnelproxy for port forwarding, where the proxy
+// opens a stream for each accepted TCP connection and the kite behind
+// the proxy accepts them.
+type Session struct {
+	conn  io.ReadWriteCloser
+	stats Stats // accessed atomically
+
+	wmu sync.Mutex // serializes frame writes
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	err     error
+
+	acceptC chan *Stream
+	closeC  chan struct{}
+}
+
+// NewSession creates a new multiplexed session over the given connection.
+// The two sides of the connection must use different values of client.
+func NewSession(conn io.ReadWriteCloser, client bool) *Session {
+	s := &Session{
+		conn:    conn,
+		streams: make(map[uint32]*Stream),
+		nextID:  2,
+		acceptC: make(chan *Stream, 64),
+		closeC:  make(chan struct{}),
+	}
+
+	if client {
+		s.nextID = 1
+	}
+
+	go s.readLoop()
+
+	return s
+}
+
+// Open opens a new stream.
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+
+	st := newStream(s, s.nextID)
+	s.streams[st.id] = st
+	s.nextID += 2
+	s.mu.Unlock()
+
+	atomic.AddInt64(&s.stats.Streams, 1)
+
+	if err := s.writeFrame(frameOpen, st.id, 0, nil); err != nil {
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// Accept waits for a stream opened by the other side.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.acceptC:
+		return st, nil
+	case <-s.closeC:
+		return nil, s.closeErr()
+	}
+}
+
+// Close closes the session and all its streams.
+func (s *Session) Close() error {
+	s.close(ErrSessionClosed)
+	return nil
+}
+
+// CloseNotify returns a channel that is closed when the session is closed.
+func (s *Session) CloseNotify() <-chan struct{} {
+	return s.closeC
+}
+
+// Stats gives the traffic statistics of the session.
+func (s *Session) Stats() Stats {
+	return Stats{
+		BytesIn:  atomic.LoadInt64(&s.stats.BytesIn),
+		BytesOut: atomic.LoadInt64(&s.stats.BytesOut),
+		Streams:  atomic.LoadInt64(&s.stats.Streams),
+	}
+}
+
+// Listener gives a listener accepting the streams opened by the other
+// side, so the session can be served by a net/http server.
+func (s *Session) Listener() net.Listener {
+	return sessionListener{s}
+}
+
+type sessionListener struct {
+	s *Session
+}
+
+func (l sessionListener) Accept() (net.Conn, error) { return l.s.Accept() }
+func (l sessionListener) Close() error              { return l.s.Close() }
+func (l sessionListener) Addr() net.Addr            { return streamAddr{} }
+
+// streamAddr is the address of multiplexed streams.
+type streamAddr struct{}
+
+func (streamAddr) Network() string { return "tunnel" }
+func (streamAddr) String() string  { return "tunnel" }
+
+func (s *Session) closeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Session) close(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[uint32]*Stream)
+	s.mu.Unlock()
+
+	close(s.closeC)
+	s.conn.Close()
+
+	for _, st := range streams {
+		st.reset(err)
+	}
+}
+
+// writeFrame writes a single frame, n is the length of the payload
+// or the window increment for window frames.
+func (s *Session) writeFrame(typ byte, id uint32, n int, p []byte) error {
+	var hdr [frameHeaderSize]byte
+	hdr[0] = typ
+	binary.BigEndian.PutUint32(hdr[1:5], id)
+	binary.BigEndian.PutUint32(hdr[5:9], uint32(n))
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	if err := s.closeErr(); err != nil {
+		return err
+	}
+
+	// Write header and payload at once, so message-based
+	// connections receive whole frames.
+	if _, err := s.conn.Write(append(hdr[:], p...)); err != nil {
+		s.close(err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *Session) readLoop() {
+	var hdr [frameHeaderSize]byte
+
+	for {
+		if _, err := io.ReadFull(s.conn, hdr[:]); err != nil {
+			s.close(err)
+			return
+		}
+
+		typ := hdr[0]
+		id := binary.BigEndian.Uint32(hdr[1:5])
+		n := binary.BigEndian.Uint32(hdr[5:9])
+
+		var p []byte
+
+		if typ != frameWindow && n != 0 {
+			if n > maxFrameSize {
+				s.close(errors.New("frame too large"))
+				return
+			}
+
+			p = make([]byte, n)
+
+			if _, err := io.ReadFull(s.conn, p); err != nil {
+				s.close(err)
+				return
+			}
+		}
+
+		s.mu.Lock()
+		st, ok := s.streams[id]
+		if typ == frameOpen && !ok && s.err == nil {
+			st = newStream(s, id)
+			s.streams[id] = st
+		}
+		s.mu.Unlock()
+
+		switch typ {
+		case frameOpen:
+			if ok {
+				s.close(errors.New("stream already exists"))
+				return
+			}
+
+			atomic.AddInt64(&s.stats.Streams, 1)
+
+			select {
+			case s.acceptC <- st:
+			case <-s.closeC:
+				return
+			}
+		case frameData:
+			atomic.AddInt64(&s.stats.BytesIn, int64(len(p)))
+
+			if ok {
+				st.push(p)
+			}
+		case frameWindow:
+			if ok {
+				st.grant(int(n))
+			}
+		case frameClose:
+			if ok {
+				st.closeRead(io.EOF)
+			}
+		default:
+			s.close(errors.New("unknown frame type"))
+			return
+		}
+	}
+}
+
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// Stream is a single bidirectional stream of a Session. It implements
+// net.Conn, so it can carry protocols like HTTP.
+type Stream struct {
+	id uint32
+	s  *Session
+
+	mu            sync.Mutex
+	cond          *sync.Cond
+	buf           []byte
+	readErr       error     // set when the remote side closed the stream
+	err           error     // set when the session is closed
+	window        int       // how many bytes we can send
+	closed        bool      // set when the local side closed the stream
+	readClosed    bool      // set when the remote side closed the stream
+	readDeadline  time.Time // zero if none
+	writeDeadline time.Time // zero if none
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+}
+
+var _ net.Conn = (*Stream)(nil)
+
+func newStream(s *Session, id uint32) *Stream {
+	st := &Stream{
+		id:     id,
+		s:      s,
+		window: streamWindow,
+	}
+
+	st.cond = sync.NewCond(&st.mu)
+
+	return st
+}
+
+// Read reads data sent by the other side of the stream.
+func (st *Stream) Read(p []byte) (int, error) {
+	st.mu.Lock()
+	for len(st.buf) == 0 && st.readErr == nil && st.err == nil && !expired(st.readDeadline) {
+		st.cond.Wait()
+	}
+
+	if len(st.buf) == 0 && st.readErr == nil && st.err == nil {
+		st.mu.Unlock()
+		return 0, errTimeout
+	}
+
+	if len(st.buf) == 0 {
+		err := st.readErr
+		if err == nil {
+			err = st.err
+		}
+		st.mu.Unlock()
+		return 0, err
+	}
+
+	n := copy(p, st.buf)
+	st.buf = st.buf[n:]
+	st.mu.Unlock()
+
+	// Let the other side know it can send more.
+	st.s.writeFrame(frameWindow, st.id, n, nil)
+
+	return n, nil
+}
+
+// Write sends data to the other side of the stream. It blocks when
+// the other side does not read the data fast enough.
+func (st *Stream) Write(p []byte) (int, error) {
+	var written int
+
+	for len(p) != 0 {
+		st.mu.Lock()
+		for st.window == 0 && st.err == nil && !st.closed && !expired(st.writeDeadline) {
+			st.cond.Wait()
+		}
+
+		if st.window == 0 && st.err == nil && !st.closed {
+			st.mu.Unlock()
+			return written, errTimeout
+		}
+
+		if st.closed {
+			st.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+
+		if st.err != nil {
+			err := st.err
+			st.mu.Unlock()
+			return written, err
+		}
+
+		n := len(p)
+		if n > st.window {
+			n = st.window
+		}
+		if n > maxFrameSize {
+			n = maxFrameSize
+		}
+
+		st.window -= n
+		st.mu.Unlock()
+
+		if err := st.s.writeFrame(frameData, st.id, n, p[:n]); err != nil {
+			return written, err
+		}
+
+		atomic.AddInt64(&st.s.stats.BytesOut, int64(n))
+
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// Close closes the stream for writing. The stream can still be read
+// until the other side closes it.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	readClosed := st.readClosed
+	st.cond.Broadcast()
+	st.mu.Unlock()
+
+	if readClosed {
+		st.s.remove(st.id)
+	}
+
+	return st.s.writeFrame(frameClose, st.id, 0, nil)
+}
+
+// LocalAddr implements the net.Conn interface.
+func (st *Stream) LocalAddr() net.Addr { return streamAddr{} }
+
+// RemoteAddr implements the net.Conn interface.
+func (st *Stream) RemoteAddr() net.Addr { return streamAddr{} }
+
+// SetDeadline implements the net.Conn interface.
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.setDeadline(&st.readDeadline, &st.readTimer, t)
+	st.setDeadline(&st.writeDeadline, &st.writeTimer, t)
+	return nil
+}
+
+// SetReadDeadline implements the net.Conn interface.
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.setDeadline(&st.readDeadline, &st.readTimer, t)
+	return nil
+}
+
+// SetWriteDeadline implements the net.Conn interface.
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.setDeadline(&st.writeDeadline, &st.writeTimer, t)
+	return nil
+}
+
+// setDeadline sets the deadline and the timer, which wakes up
+// the blocked operations when the deadline passes.
+func (st *Stream) setDeadline(deadline *time.Time, timer **time.Timer, t time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	*deadline = t
+
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+
+	if !t.IsZero() {
+		*timer = time.AfterFunc(time.Until(t), func() {
+			st.mu.Lock()
+			st.cond.Broadcast()
+			st.mu.Unlock()
+		})
+	}
+
+	st.cond.Broadcast()
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+func (st *Stream) push(p []byte) {
+	st.mu.Lock()
+	st.buf = append(st.buf, p...)
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+func (st *Stream) grant(n int) {
+	st.mu.Lock()
+	st.window += n
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+// reset fails all pending and future operations on the stream.
+func (st *Stream) reset(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+func (st *Stream) closeRead(err error) {
+	st.mu.Lock()
+	if st.readErr == nil {
+		st.readErr = err
+	}
+	st.readClosed = true
+	closed := st.closed
+	st.cond.Broadcast()
+	st.mu.Unlock()
+
+	if closed {
+		st.s.remove(st.id)
+	}
+}
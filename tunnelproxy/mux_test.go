@@ -0,0 +1,68 @@
+package tunnelproxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func TestSession(t *testing.T) {
+	c1, c2 := net.Pipe()
+
+	client := NewSession(c1, true)
+	defer client.Close()
+
+	server := NewSession(c2, false)
+	defer server.Close()
+
+	// Echo all streams on the client side.
+	go func() {
+		for {
+			st, err := client.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				io.Copy(st, st)
+				st.Close()
+			}()
+		}
+	}()
+
+	want := make([]byte, 3*streamWindow+1)
+	rand.Read(want)
+
+	errC := make(chan error, 4)
+
+	for i := 0; i < cap(errC); i++ {
+		go func() {
+			st, err := server.Open()
+			if err != nil {
+				errC <- err
+				return
+			}
+
+			go func() {
+				st.Write(want)
+				st.Close()
+			}()
+
+			got, err := ioutil.ReadAll(st)
+			if err == nil && !bytes.Equal(got, want) {
+				err = io.ErrUnexpectedEOF
+			}
+
+			errC <- err
+		}()
+	}
+
+	for i := 0; i < cap(errC); i++ {
+		if err := <-errC; err != nil {
+			t.Fatalf("stream %d: %s", i, err)
+		}
+	}
+}
@@ -9,11 +9,14 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/koding/kite"
-	"github.com/koding/kite/config"
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/metrics"
+	"github.com/koding/kite/v2/protocol"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/igm/sockjs-go/sockjs"
@@ -31,7 +34,7 @@ var (
 type Proxy struct {
 	Kite *kite.Kite
 
-	listener  net.Listener
+	listener  *kite.GracefulListener
 	TLSConfig *tls.Config
 
 	readyC chan bool // To signal when kite is ready to accept connections
@@ -45,12 +48,42 @@ type Proxy struct {
 	privKey string
 
 	// Holds registered kites. Keys are kite IDs.
-	kites map[string]*PrivateKite
+	kites   map[string]*PrivateKite
+	kitesMu sync.Mutex
+
+	// Holds forwarded ports. Keys are forward IDs.
+	forwards   map[string]*forward
+	forwardsMu sync.Mutex
+
+	// Holds virtual hosts. Keys are hostnames.
+	vhosts   map[string]*vhost
+	vhostsMu sync.Mutex
+
+	// VirtualHostDomain is the domain of the virtual hosts exposed with
+	// the "expose" method, like "tunnel.example.com". Its wildcard DNS
+	// record must point to the proxy. If empty, the hostname of
+	// PublicHost is used.
+	VirtualHostDomain string
 
 	mux *http.ServeMux
 
 	RegisterToKontrol bool
 
+	// StreamLayer, when non-nil, is called for each registered kite
+	// and gives a layer that is applied to all of its tunnel streams,
+	// or nil if the streams should be left intact.
+	StreamLayer func(*protocol.Kite) StreamLayer
+
+	// Metrics holds the Prometheus metrics of the proxy, which are
+	// served on /metrics.
+	Metrics *metrics.Registry
+
+	// AccessLog, when non-nil, is called after each request is served.
+	// By default the entries are logged with Kite.Log.
+	AccessLog func(*metrics.AccessLogEntry)
+
+	metrics proxyMetrics
+
 	url *url.URL
 }
 
@@ -70,20 +103,34 @@ func New(conf *config.Config, version, pubKey, privKey string) *Proxy {
 		pubKey:            pubKey,
 		privKey:           privKey,
 		kites:             make(map[string]*PrivateKite),
+		forwards:          make(map[string]*forward),
+		vhosts:            make(map[string]*vhost),
 		mux:               http.NewServeMux(),
 		RegisterToKontrol: true,
 		PublicHost:        DefaultPublicHost,
 	}
 
+	p.newMetrics()
+
 	p.Kite.HandleFunc("register", p.handleRegister)
+	p.Kite.HandleFunc("forward", p.handleForwardRequest)
+	p.Kite.HandleFunc("expose", p.handleExpose)
 
 	p.mux.Handle("/", p.Kite)
 	p.mux.Handle("/proxy/", sockjsHandlerWithRequest("/proxy", sockjs.DefaultOptions, p.handleProxy))    // Handler for clients outside
 	p.mux.Handle("/tunnel/", sockjsHandlerWithRequest("/tunnel", sockjs.DefaultOptions, p.handleTunnel)) // Handler for kites behind
+	p.mux.HandleFunc("/forward/", p.handleForward)                                                       // Handler for forwarded ports
+	p.mux.HandleFunc("/vhost/", p.handleVirtualHost)                                                     // Handler for virtual hosts
+	p.mux.Handle("/metrics", p.Metrics)
 
 	// Remove URL from the map when PrivateKite disconnects.
 	k.OnDisconnect(func(r *kite.Client) {
+		p.kitesMu.Lock()
 		delete(p.kites, r.Kite.ID)
+		p.kitesMu.Unlock()
+
+		p.closeForwards(r.Kite.ID)
+		p.closeVirtualHosts(r.Kite.ID)
 	})
 
 	return p
@@ -113,14 +160,41 @@ func (s *Proxy) ReadyNotify() chan bool {
 
 func (p *Proxy) Close() {
 	p.listener.Close()
+
+	p.forwardsMu.Lock()
+	for _, f := range p.forwards {
+		f.close()
+	}
+	p.forwardsMu.Unlock()
+
+	p.vhostsMu.Lock()
+	for _, v := range p.vhosts {
+		v.close()
+	}
+	p.vhostsMu.Unlock()
+
+	p.kitesMu.Lock()
+	kites := make([]*PrivateKite, 0, len(p.kites))
 	for _, k := range p.kites {
+		kites = append(kites, k)
+	}
+	p.kitesMu.Unlock()
+
+	for _, k := range kites {
 		k.Close()
-		for _, t := range k.tunnels {
-			t.Close()
-		}
+		k.closeTunnels()
 	}
 }
 
+// privateKite gives the registered kite with the given ID.
+func (p *Proxy) privateKite(kiteID string) (*PrivateKite, bool) {
+	p.kitesMu.Lock()
+	defer p.kitesMu.Unlock()
+
+	k, ok := p.kites[kiteID]
+	return k, ok
+}
+
 func (p *Proxy) Start() {
 	go p.Run()
 	<-p.readyC
@@ -131,12 +205,13 @@ func (p *Proxy) Run() {
 }
 
 func (p *Proxy) listenAndServe() error {
-	var err error
-	p.listener, err = net.Listen("tcp", net.JoinHostPort(p.Kite.Config.IP, strconv.Itoa(p.Kite.Config.Port)))
+	l, err := net.Listen("tcp", net.JoinHostPort(p.Kite.Config.IP, strconv.Itoa(p.Kite.Config.Port)))
 	if err != nil {
 		return err
 	}
 
+	p.listener = kite.NewGracefulListener(l)
+
 	p.Kite.Log.Info("Listening on: %s", p.listener.Addr().String())
 
 	close(p.readyC)
@@ -152,11 +227,19 @@ func (p *Proxy) listenAndServe() error {
 	}
 
 	defer close(p.closeC)
-	return http.Serve(p.listener, p.mux)
+	return http.Serve(p.listener, p.handler())
 }
 
 func (p *Proxy) handleRegister(r *kite.Request) (interface{}, error) {
-	p.kites[r.Client.ID] = newPrivateKite(r.Client)
+	k := newPrivateKite(r.Client)
+
+	if p.StreamLayer != nil {
+		k.layer = p.StreamLayer(&r.Client.Kite)
+	}
+
+	p.kitesMu.Lock()
+	p.kites[r.Client.ID] = k
+	p.kitesMu.Unlock()
 
 	proxyURL := url.URL{
 		Scheme:   "http",
@@ -174,8 +257,9 @@ func (p *Proxy) handleProxy(session sockjs.Session, req *http.Request) {
 	const leeway = time.Duration(1 * time.Minute)
 
 	kiteID := req.URL.Query().Get("kiteID")
+	setRequestKite(req, kiteID)
 
-	client, ok := p.kites[kiteID]
+	client, ok := p.privateKite(kiteID)
 	if !ok {
 		p.Kite.Log.Error("Remote kite is not found: %s", req.URL.String())
 		return
@@ -210,7 +294,7 @@ func (p *Proxy) handleProxy(session sockjs.Session, req *http.Request) {
 	tunnelURL.RawQuery = "token=" + signed
 
 	_, err = client.TellWithTimeout("kite.tunnel",
-		4*time.Second, map[string]string{"url": tunnelURL.String()})
+		4*time.Second, map[string]interface{}{"url": tunnelURL.String(), "layer": tunnel.layer != nil})
 	if err != nil {
 		p.Kite.Log.Error("Cannot open tunnel to the kite: %s err: %s", client.Kite, err.Error())
 		return
@@ -244,16 +328,18 @@ func (p *Proxy) handleTunnel(session sockjs.Session, req *http.Request) {
 
 	kiteID := token.Claims.(jwt.MapClaims)["sub"].(string)
 	seq := uint64(token.Claims.(jwt.MapClaims)["seq"].(float64))
+	setRequestKite(req, kiteID)
 
-	client, ok := p.kites[kiteID]
+	client, ok := p.privateKite(kiteID)
 	if !ok {
 		p.Kite.Log.Error("Remote kite is not found: %s", kiteID)
 		return
 	}
 
-	tunnel, ok := client.tunnels[seq]
+	tunnel, ok := client.tunnel(seq)
 	if !ok {
 		p.Kite.Log.Error("Tunnel not found: %d", seq)
+		return
 	}
 
 	go tunnel.Run(session)
@@ -270,10 +356,14 @@ type PrivateKite struct {
 	*kite.Client
 
 	// Connections to kites behind the proxy. Keys are kite IDs.
-	tunnels map[uint64]*Tunnel
+	tunnels   map[uint64]*Tunnel
+	tunnelsMu sync.Mutex
 
 	// Last tunnel number
 	seq uint64
+
+	// Layer applied to tunnel streams, may be nil.
+	layer StreamLayer
 }
 
 func newPrivateKite(r *kite.Client) *PrivateKite {
@@ -287,18 +377,45 @@ func (k *PrivateKite) newTunnel(local sockjs.Session) *Tunnel {
 	t := &Tunnel{
 		id:        atomic.AddUint64(&k.seq, 1),
 		localConn: local,
+		layer:     k.layer,
 		startChan: make(chan bool),
 		closeChan: make(chan bool),
 	}
 
 	// Add to map.
+	k.tunnelsMu.Lock()
 	k.tunnels[t.id] = t
+	k.tunnelsMu.Unlock()
 
 	// Delete from map on close.
 	go func() {
 		<-t.CloseNotify()
+
+		k.tunnelsMu.Lock()
 		delete(k.tunnels, t.id)
+		k.tunnelsMu.Unlock()
 	}()
 
 	return t
 }
+
+func (k *PrivateKite) tunnel(seq uint64) (*Tunnel, bool) {
+	k.tunnelsMu.Lock()
+	defer k.tunnelsMu.Unlock()
+
+	t, ok := k.tunnels[seq]
+	return t, ok
+}
+
+func (k *PrivateKite) closeTunnels() {
+	k.tunnelsMu.Lock()
+	tunnels := make([]*Tunnel, 0, len(k.tunnels))
+	for _, t := range k.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	k.tunnelsMu.Unlock()
+
+	for _, t := range tunnels {
+		t.Close()
+	}
+}
@@ -1,6 +1,8 @@
 package tunnelproxy
 
 import (
+	"compress/gzip"
+	"io"
 	"log"
 	"os"
 	"strings"
@@ -8,11 +10,12 @@ import (
 	"time"
 
 	"github.com/fatih/color"
-	"github.com/koding/kite"
-	"github.com/koding/kite/config"
-	"github.com/koding/kite/kontrol"
-	"github.com/koding/kite/testkeys"
-	"github.com/koding/kite/testutil"
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/kontrol"
+	"github.com/koding/kite/v2/protocol"
+	"github.com/koding/kite/v2/testkeys"
+	"github.com/koding/kite/v2/testutil"
 )
 
 func TestProxy(t *testing.T) {
@@ -104,3 +107,97 @@ func TestProxy(t *testing.T) {
 		t.Fatalf("Wrong reply: %s", s)
 	}
 }
+
+// gzipStream compresses the data written to the stream and decompresses
+// the data read from it.
+type gzipStream struct {
+	rwc io.ReadWriteCloser
+	w   *gzip.Writer
+	r   *gzip.Reader // created on first Read, as it reads the header
+}
+
+func gzipLayer(rwc io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+	return &gzipStream{rwc: rwc, w: gzip.NewWriter(rwc)}, nil
+}
+
+func (s *gzipStream) Read(p []byte) (int, error) {
+	if s.r == nil {
+		r, err := gzip.NewReader(s.rwc)
+		if err != nil {
+			return 0, err
+		}
+		s.r = r
+	}
+
+	return s.r.Read(p)
+}
+
+func (s *gzipStream) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	return n, s.w.Flush()
+}
+
+func (s *gzipStream) Close() error {
+	s.w.Close()
+	return s.rwc.Close()
+}
+
+func TestProxyStreamLayer(t *testing.T) {
+	conf := config.New()
+	conf.Port = 4997
+	conf.DisableAuthentication = true
+	conf.Transport = config.WebSocket // tunnel only works via WebSocket
+
+	prx := New(conf.Copy(), "0.1.0", testkeys.Public, testkeys.Private)
+	prx.RegisterToKontrol = false
+	prx.PublicHost = "localhost:4997"
+	prx.StreamLayer = func(*protocol.Kite) StreamLayer {
+		return StreamLayerFunc(gzipLayer)
+	}
+	prx.Start()
+	defer prx.Close()
+
+	backend := kite.New("backend", "1.0.0")
+	backend.Config = conf.Copy()
+	backend.TunnelLayer = StreamLayerFunc(gzipLayer)
+	backend.HandleFunc("echo", func(r *kite.Request) (interface{}, error) {
+		return r.Args.One().MustString(), nil
+	})
+
+	prxClt := backend.NewClient("http://localhost:4997/kite")
+	if err := prxClt.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer prxClt.Close()
+
+	result, err := prxClt.TellWithTimeout("register", 4*time.Second)
+	if err != nil {
+		t.Fatalf("register()=%s", err)
+	}
+
+	caller := kite.New("caller", "1.0.0")
+	caller.Config = conf.Copy()
+
+	remote := caller.NewClient(result.MustString())
+	if err := remote.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer remote.Close()
+
+	want := strings.Repeat("hello tunnel ", 1024)
+
+	for i := 0; i < 3; i++ {
+		result, err := remote.TellWithTimeout("echo", 4*time.Second, want)
+		if err != nil {
+			t.Fatalf("%d: echo()=%s", i, err)
+		}
+
+		if got := result.MustString(); got != want {
+			t.Fatalf("%d: got %d bytes, want %d", i, len(got), len(want))
+		}
+	}
+}
@@ -5,11 +5,13 @@ import (
 	"sync"
 
 	"github.com/igm/sockjs-go/sockjs"
+	"github.com/koding/kite/v2"
 )
 
 type Tunnel struct {
 	id          uint64         // key in kites's tunnels map
 	localConn   sockjs.Session // conn to local kite
+	layer       StreamLayer    // optional layer for the remote stream
 	startChan   chan bool      // to signal started state
 	closeChan   chan bool      // to signal closed state
 	closed      bool           // to prevent closing closeChan again
@@ -39,8 +41,20 @@ func (t *Tunnel) StartNotify() chan bool {
 
 func (t *Tunnel) Run(remoteConn sockjs.Session) {
 	close(t.startChan)
-	<-JoinStreams(SessionReadWriteCloser{t.localConn}, SessionReadWriteCloser{remoteConn})
-	t.Close()
+	defer t.Close()
+
+	if t.layer == nil {
+		<-JoinStreams(&SessionReadWriteCloser{session: t.localConn}, &SessionReadWriteCloser{session: remoteConn})
+		return
+	}
+
+	remote, err := kite.NewLayeredSession(remoteConn, t.layer)
+	if err != nil {
+		remoteConn.Close(3000, "Go away!")
+		return
+	}
+
+	<-joinSessions(t.localConn, remote)
 }
 
 func JoinStreams(local, remote io.ReadWriteCloser) chan error {
@@ -59,23 +73,69 @@ func JoinStreams(local, remote io.ReadWriteCloser) chan error {
 	return errc
 }
 
+// StreamLayer transforms the stream between the proxy and a backend kite,
+// e.g. to add transparent compression or an extra encryption layer.
+// The backend kite unwraps the stream with Kite.TunnelLayer, which must
+// match the layer of the proxy, see kite.StreamLayer.
+type StreamLayer = kite.StreamLayer
+
+// StreamLayerFunc is an adapter to allow the use of ordinary functions
+// as stream layers.
+type StreamLayerFunc = kite.StreamLayerFunc
+
+// joinSessions copies messages between the sessions, until one of them
+// fails.
+func joinSessions(local, remote kite.Session) chan error {
+	errc := make(chan error, 2)
+
+	copy := func(dst, src kite.Session) {
+		var err error
+
+		for {
+			var msg string
+
+			if msg, err = src.Recv(); err != nil {
+				break
+			}
+
+			if err = dst.Send(msg); err != nil {
+				break
+			}
+		}
+
+		src.Close(3000, "Go away!")
+		dst.Close(3000, "Go away!")
+		errc <- err
+	}
+
+	go copy(local, remote)
+	go copy(remote, local)
+
+	return errc
+}
+
 type SessionReadWriteCloser struct {
 	session sockjs.Session
+	buf     []byte // remaining part of the last message
 }
 
-func (s SessionReadWriteCloser) Read(b []byte) (int, error) {
-	str, err := s.session.Recv()
-	if err != nil {
-		return 0, err
+func (s *SessionReadWriteCloser) Read(b []byte) (int, error) {
+	if len(s.buf) == 0 {
+		str, err := s.session.Recv()
+		if err != nil {
+			return 0, err
+		}
+		s.buf = []byte(str)
 	}
-	copy(b, []byte(str))
-	return len(str), nil
+	n := copy(b, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
 }
 
-func (s SessionReadWriteCloser) Write(b []byte) (int, error) {
+func (s *SessionReadWriteCloser) Write(b []byte) (int, error) {
 	return len(b), s.session.Send(string(b))
 }
 
-func (s SessionReadWriteCloser) Close() error {
+func (s *SessionReadWriteCloser) Close() error {
 	return s.session.Close(3000, "Go away!")
 }
@@ -0,0 +1,221 @@
+// Package tunnelclient exposes local HTTP handlers of a kite to the public
+// network through a tunnel proxy, under virtual hosts of the proxy.
+//
+// The requests sent to a virtual host are proxied over a single websocket
+// connection, which multiplexes a stream for every HTTP connection,
+// so kites behind firewall or NAT can serve HTTP without any listener.
+package tunnelclient
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/gorilla/websocket"
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/tunnelproxy"
+)
+
+// ErrClosed is returned when connecting a closed Tunnel.
+var ErrClosed = errors.New("tunnel is closed")
+
+// Stats are the traffic statistics of a Tunnel.
+type Stats struct {
+	tunnelproxy.Stats
+
+	// Reconnects is the number of times the tunnel was reconnected.
+	Reconnects int64 `json:"reconnects"`
+}
+
+// Tunnel serves the requests sent to a virtual host of the tunnel proxy.
+type Tunnel struct {
+	client    *kite.Client
+	handler   http.Handler
+	subdomain string
+
+	mu     sync.Mutex
+	host   string
+	url    string
+	sess   *tunnelproxy.Session // nil while reconnecting
+	stats  Stats                // of the previous sessions
+	closed bool
+
+	closeC chan struct{}
+}
+
+// Expose asks the tunnel proxy, which c is connected to, for a virtual host
+// with the given subdomain and serves the requests sent to it with h.
+// If subdomain is empty, the proxy generates one.
+//
+// When the tunnel disconnects, it's connected again with the same virtual
+// host, until the Tunnel is closed. For the tunnel to survive restarts
+// of the proxy, c should be dialed with Reconnect set.
+func Expose(c *kite.Client, subdomain string, h http.Handler) (*Tunnel, error) {
+	t := &Tunnel{
+		client:    c,
+		handler:   h,
+		subdomain: subdomain,
+		closeC:    make(chan struct{}),
+	}
+
+	if err := t.connect(); err != nil {
+		return nil, err
+	}
+
+	go t.run()
+
+	return t, nil
+}
+
+// Host gives the hostname of the virtual host, like "3f2a9c1b.example.com".
+func (t *Tunnel) Host() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.host
+}
+
+// URL gives the public URL of the virtual host.
+func (t *Tunnel) URL() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.url
+}
+
+// Stats gives the traffic statistics of the tunnel, including
+// the previous connections.
+func (t *Tunnel) Stats() Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := t.stats
+	if t.sess != nil {
+		stats.Stats = stats.Stats.Add(t.sess.Stats())
+	}
+
+	return stats
+}
+
+// Close stops serving the virtual host.
+func (t *Tunnel) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	sess := t.sess
+	t.mu.Unlock()
+
+	close(t.closeC)
+
+	if sess != nil {
+		return sess.Close()
+	}
+
+	return nil
+}
+
+// connect requests the virtual host and serves the requests sent to it.
+func (t *Tunnel) connect() error {
+	result, err := t.client.TellWithTimeout("expose", 4*time.Second, &tunnelproxy.ExposeArgs{
+		Subdomain: t.subdomain,
+	})
+	if err != nil {
+		return err
+	}
+
+	var res tunnelproxy.ExposeResult
+	if err := result.Unmarshal(&res); err != nil {
+		return err
+	}
+
+	u, err := url.Parse(res.TunnelURL)
+	if err != nil {
+		return err
+	}
+
+	requestHeader := http.Header{}
+	requestHeader.Add("Origin", "http://"+u.Host)
+
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), requestHeader)
+	if err != nil {
+		return fmt.Errorf("cannot connect to %s: %s", u.Host, err)
+	}
+
+	sess := tunnelproxy.NewWebsocketSession(conn, true)
+
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		sess.Close()
+		return ErrClosed
+	}
+	t.host = res.Host
+	t.url = res.URL
+	t.sess = sess
+	t.mu.Unlock()
+
+	// Reconnect to the same virtual host.
+	t.subdomain = strings.SplitN(res.Host, ".", 2)[0]
+
+	go (&http.Server{Handler: t.handler}).Serve(sess.Listener())
+
+	return nil
+}
+
+// run connects the tunnel again each time it disconnects.
+func (t *Tunnel) run() {
+	for {
+		t.mu.Lock()
+		sess := t.sess
+		t.mu.Unlock()
+
+		select {
+		case <-sess.CloseNotify():
+		case <-t.closeC:
+			return
+		}
+
+		t.mu.Lock()
+		t.stats.Stats = t.stats.Stats.Add(sess.Stats())
+		t.sess = nil
+		t.mu.Unlock()
+
+		t.client.LocalKite.Log.Warning("Tunnel of %s disconnected, reconnecting", t.Host())
+
+		b := backoff.NewExponentialBackOff()
+		b.MaxElapsedTime = 0 // retry until closed
+
+		for {
+			select {
+			case <-time.After(b.NextBackOff()):
+			case <-t.closeC:
+				return
+			}
+
+			err := t.connect()
+			if err == nil {
+				break
+			}
+
+			if err == ErrClosed {
+				return
+			}
+
+			t.client.LocalKite.Log.Warning("Reconnecting tunnel of %s error: %s", t.Host(), err)
+		}
+
+		t.mu.Lock()
+		t.stats.Reconnects++
+		t.mu.Unlock()
+
+		t.client.LocalKite.Log.Info("Tunnel of %s reconnected", t.Host())
+	}
+}
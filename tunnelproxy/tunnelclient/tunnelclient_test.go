@@ -0,0 +1,116 @@
+package tunnelclient
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/metrics"
+	"github.com/koding/kite/v2/testkeys"
+	"github.com/koding/kite/v2/tunnelproxy"
+)
+
+func TestExpose(t *testing.T) {
+	conf := config.New()
+	conf.Port = 4998
+	conf.DisableAuthentication = true
+
+	proxy := tunnelproxy.New(conf, "0.1.0", testkeys.Public, testkeys.Private)
+	proxy.RegisterToKontrol = false
+	proxy.PublicHost = "127.0.0.1:4998"
+	proxy.VirtualHostDomain = "tunnel.test"
+
+	logged := make(chan *metrics.AccessLogEntry, 16)
+	proxy.AccessLog = func(e *metrics.AccessLogEntry) {
+		if e.Path == "/world" {
+			logged <- e
+		}
+	}
+	proxy.Start()
+	defer proxy.Close()
+
+	k := kite.New("exposer", "1.0.0")
+	k.Config = config.New()
+
+	c := k.NewClient("http://127.0.0.1:4998/kite")
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	tun, err := Expose(c, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.URL.Path))
+	}))
+	if err != nil {
+		t.Fatalf("Expose()=%s", err)
+	}
+	defer tun.Close()
+
+	get := func() {
+		req, err := http.NewRequest("GET", "http://127.0.0.1:4998/world", nil)
+		if err != nil {
+			t.Fatalf("NewRequest()=%s", err)
+		}
+		req.Host = tun.Host() + ":4998"
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Do()=%s", err)
+		}
+		defer resp.Body.Close()
+
+		p, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("ReadAll()=%s", err)
+		}
+
+		if got, want := string(p), "hello /world"; got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+
+	get()
+
+	select {
+	case e := <-logged:
+		if e.KiteID != k.Kite().ID || e.Status != http.StatusOK || e.BytesOut == 0 {
+			t.Fatalf("unexpected access log entry: %s", e)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the access log entry")
+	}
+
+	if stats := tun.Stats(); stats.BytesIn == 0 || stats.BytesOut == 0 || stats.Streams == 0 {
+		t.Fatalf("got %+v, want non-zero stats", stats)
+	}
+
+	if stats := proxy.VirtualHostStats()[tun.Host()]; stats.BytesIn == 0 || stats.BytesOut == 0 {
+		t.Fatalf("got %+v, want non-zero proxy stats", stats)
+	}
+
+	host := tun.Host()
+
+	// Break the tunnel, it is expected to reconnect to the same host.
+	tun.mu.Lock()
+	tun.sess.Close()
+	tun.mu.Unlock()
+
+	timeout := time.After(10 * time.Second)
+
+	for tun.Stats().Reconnects == 0 {
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for the tunnel to reconnect")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	if tun.Host() != host {
+		t.Fatalf("got %q, want %q", tun.Host(), host)
+	}
+
+	get()
+}
@@ -5,8 +5,8 @@ import (
 	"io/ioutil"
 	"log"
 
-	"github.com/koding/kite/config"
-	"github.com/koding/kite/tunnelproxy"
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/tunnelproxy"
 )
 
 func main() {
@@ -0,0 +1,301 @@
+package tunnelproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/websocket"
+	"github.com/koding/kite/v2"
+	"github.com/koding/kite/v2/utils"
+)
+
+// ExposeArgs are arguments of the "expose" method of the proxy.
+type ExposeArgs struct {
+	// Subdomain is the requested subdomain of the virtual host.
+	// If empty, a random one is generated.
+	Subdomain string `json:"subdomain"`
+}
+
+// ExposeResult is a result of the "expose" method of the proxy.
+type ExposeResult struct {
+	// Host is the hostname of the virtual host, like "3f2a9c1b.example.com".
+	Host string `json:"host"`
+
+	// URL is the public URL of the virtual host.
+	URL string `json:"url"`
+
+	// TunnelURL is a websocket URL the kite dials to receive
+	// the requests sent to the virtual host.
+	TunnelURL string `json:"tunnelURL"`
+}
+
+var subdomainRx = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// vhost is a virtual host which requests are proxied to a kite over
+// a multiplexed session.
+type vhost struct {
+	host   string
+	id     string
+	kiteID string
+	proxy  *httputil.ReverseProxy
+
+	mu   sync.Mutex
+	sess *Session // nil until the kite connects
+	prev Stats    // of the previous sessions
+}
+
+func newVhost(host, kiteID string) *vhost {
+	v := &vhost{
+		host:   host,
+		id:     utils.RandomString(16),
+		kiteID: kiteID,
+	}
+
+	v.proxy = &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = v.host
+		},
+		Transport: &http.Transport{
+			Dial: func(string, string) (net.Conn, error) {
+				sess := v.session()
+				if sess == nil {
+					return nil, errors.New("tunnel is not connected")
+				}
+
+				return sess.Open()
+			},
+			MaxIdleConnsPerHost: 16,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+
+	return v
+}
+
+func (v *vhost) session() *Session {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.sess
+}
+
+// setSession replaces the session of the kite, closing the previous one.
+func (v *vhost) setSession(sess *Session) {
+	v.mu.Lock()
+	old := v.sess
+	v.sess = sess
+	if old != nil {
+		v.prev = v.prev.Add(old.Stats())
+	}
+	v.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	v.proxy.Transport.(*http.Transport).CloseIdleConnections()
+}
+
+func (v *vhost) close() {
+	v.setSession(nil)
+}
+
+// stats gives the traffic statistics of all the sessions of the virtual host.
+func (v *vhost) stats() Stats {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.sess == nil {
+		return v.prev
+	}
+
+	return v.prev.Add(v.sess.Stats())
+}
+
+// handler gives the handler of the proxy server. Requests to the virtual
+// hosts are proxied to their kites, others are served by the mux.
+func (p *Proxy) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if v := p.virtualHost(req.Host); v != nil {
+			p.serveLogged(w, req, v.proxy, "virtualhost", v.kiteID)
+			return
+		}
+
+		p.serveLogged(w, req, p.mux, requestKind(req), "")
+	})
+}
+
+func (p *Proxy) virtualHost(hostport string) *vhost {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+
+	p.vhostsMu.Lock()
+	defer p.vhostsMu.Unlock()
+
+	return p.vhosts[strings.ToLower(host)]
+}
+
+// VirtualHostStats gives the traffic statistics of the virtual hosts,
+// keyed by their hostnames.
+func (p *Proxy) VirtualHostStats() map[string]Stats {
+	p.vhostsMu.Lock()
+	defer p.vhostsMu.Unlock()
+
+	stats := make(map[string]Stats, len(p.vhosts))
+	for host, v := range p.vhosts {
+		stats[host] = v.stats()
+	}
+
+	return stats
+}
+
+// virtualHostDomain gives the domain of the virtual hosts.
+func (p *Proxy) virtualHostDomain() string {
+	if p.VirtualHostDomain != "" {
+		return strings.ToLower(p.VirtualHostDomain)
+	}
+
+	host, _, err := net.SplitHostPort(p.PublicHost)
+	if err != nil {
+		host = p.PublicHost
+	}
+
+	return strings.ToLower(host)
+}
+
+// handleExpose creates a virtual host for the requesting kite and gives it
+// the URL to receive the requests from. A kite, which reconnects, gets
+// the same virtual host by requesting the same subdomain.
+func (p *Proxy) handleExpose(r *kite.Request) (interface{}, error) {
+	const timeout = 1 * time.Minute
+
+	var args ExposeArgs
+
+	if r.Args != nil {
+		if a, err := r.Args.Slice(); err == nil && len(a) != 0 {
+			a[0].MustUnmarshal(&args)
+		}
+	}
+
+	subdomain := strings.ToLower(args.Subdomain)
+	if subdomain == "" {
+		subdomain = utils.RandomString(8)
+	}
+
+	if !subdomainRx.MatchString(subdomain) {
+		return nil, fmt.Errorf("invalid subdomain %q", args.Subdomain)
+	}
+
+	host := subdomain + "." + p.virtualHostDomain()
+
+	p.vhostsMu.Lock()
+	v, ok := p.vhosts[host]
+	if ok && v.kiteID != r.Client.ID {
+		p.vhostsMu.Unlock()
+		return nil, fmt.Errorf("subdomain %q is already taken", subdomain)
+	}
+	if !ok {
+		v = newVhost(host, r.Client.ID)
+		p.vhosts[host] = v
+	}
+	p.vhostsMu.Unlock()
+
+	signed, err := p.signToken(jwt.MapClaims{
+		"sub":   v.kiteID,
+		"vhost": v.host,
+		"vid":   v.id,
+	}, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	tunnelURL := *p.url
+	tunnelURL.Path = "/vhost/" + v.host
+	tunnelURL.RawQuery = "token=" + signed
+
+	publicURL := "http://" + v.host
+	if _, port, err := net.SplitHostPort(p.PublicHost); err == nil {
+		publicURL = "http://" + net.JoinHostPort(v.host, port)
+	}
+
+	p.Kite.Log.Info("Exposing kite %s at %s", v.kiteID, publicURL)
+
+	return &ExposeResult{
+		Host:      v.host,
+		URL:       publicURL,
+		TunnelURL: tunnelURL.String(),
+	}, nil
+}
+
+// handleVirtualHost is the kite side of the virtual host.
+func (p *Proxy) handleVirtualHost(w http.ResponseWriter, req *http.Request) {
+	host := strings.TrimPrefix(req.URL.Path, "/vhost/")
+
+	claims, err := p.parseToken(req.URL.Query().Get("token"))
+	if err != nil {
+		p.Kite.Log.Error("Invalid virtual host token: %s", err)
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	p.vhostsMu.Lock()
+	v, ok := p.vhosts[host]
+	p.vhostsMu.Unlock()
+
+	if !ok {
+		p.Kite.Log.Error("Virtual host not found: %s", host)
+		http.NotFound(w, req)
+		return
+	}
+
+	setRequestKite(req, v.kiteID)
+
+	if vid, _ := claims["vid"].(string); vid != v.id || claims["vhost"] != host {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
+	}
+
+	conn, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		p.Kite.Log.Error("Cannot upgrade virtual host connection: %s", err)
+		return
+	}
+
+	sess := NewWebsocketSession(conn, false)
+	v.setSession(sess)
+
+	<-sess.CloseNotify()
+}
+
+// closeVirtualHosts removes all virtual hosts of the given kite.
+func (p *Proxy) closeVirtualHosts(kiteID string) {
+	p.vhostsMu.Lock()
+	var closed []*vhost
+	for host, v := range p.vhosts {
+		if v.kiteID == kiteID {
+			delete(p.vhosts, host)
+			closed = append(closed, v)
+		}
+	}
+	p.vhostsMu.Unlock()
+
+	for _, v := range closed {
+		v.close()
+	}
+}
@@ -0,0 +1,256 @@
+package kite
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+type requestKey struct{}
+
+// RequestFromContext gives the request, whose context is passed to
+// a handler created with Typed.
+func RequestFromContext(ctx context.Context) (*Request, bool) {
+	r, ok := ctx.Value(requestKey{}).(*Request)
+	return r, ok
+}
+
+// Typed adapts fn to a HandlerFunc. The fn must be a function of the form:
+//
+//	func(ctx context.Context, args T) (result R, err error)
+//
+// The first argument of the call is unmarshaled into a value of type T,
+// which is validated with the "validate" tags of its struct fields:
+//
+//	type SquareArgs struct {
+//		Number float64 `json:"number" validate:"required,max=1000"`
+//		Name   string  `json:"name" validate:"min=1,max=64"`
+//	}
+//
+// The "required" rule rejects zero values, "min" and "max" bound numbers
+// or lengths of strings, slices and maps. Nested structs are validated
+// as well. If the argument is invalid, the handler fails with an error
+// of type "badRequest", whose code is the rule that failed.
+//
+// The ctx is canceled when the caller disconnects, the request can be
+// obtained from it with RequestFromContext.
+//
+// Typed panics if fn is not of the form above. It does not use type
+// parameters, since the kite supports Go versions which predate them.
+func Typed(fn interface{}) HandlerFunc {
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+
+	if t.Kind() != reflect.Func || t.IsVariadic() || t.NumIn() != 2 || t.In(0) != contextType ||
+		t.NumOut() != 2 || t.Out(1) != errorType {
+		panic(fmt.Errorf("kite: Typed requires func(context.Context, T) (R, error), got %T", fn))
+	}
+
+	return func(r *Request) (interface{}, error) {
+		arg := reflect.New(t.In(1))
+
+		args, err := r.Args.SliceOfLength(1)
+		if err == nil {
+			err = args[0].Unmarshal(arg.Interface())
+		}
+
+		if err != nil {
+			return nil, &Error{
+				Type:    "badRequest",
+				Message: err.Error(),
+				CodeVal: "invalid",
+			}
+		}
+
+		if err := validate(arg.Elem(), ""); err != nil {
+			return nil, err
+		}
+
+		ctx := r.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+
+		out := v.Call([]reflect.Value{
+			reflect.ValueOf(context.WithValue(ctx, requestKey{}, r)),
+			arg.Elem(),
+		})
+
+		err, _ = out[1].Interface().(error)
+
+		return out[0].Interface(), err
+	}
+}
+
+// Call calls the method of the remote kite and unmarshals its result into
+// the value pointed to by result, so the caller does not need to unmarshal
+// the result of Tell:
+//
+//	var square float64
+//	if err := c.Call(ctx, "square", &square, SquareArgs{Number: 4}); err != nil {
+//		return err
+//	}
+//
+// The call is made like with TellWithContext. The result may be nil if
+// the caller is not interested in it. The returned error is always
+// an *Error, if the result can't be unmarshaled its type is
+// "invalidResponse".
+//
+// Call is the counterpart of Typed for the callers, it takes a pointer
+// to the result instead of a type parameter for the same reason.
+func (c *Client) Call(ctx context.Context, method string, result interface{}, args ...interface{}) error {
+	partial, err := c.TellWithContext(ctx, method, args...)
+	if err != nil {
+		if _, ok := err.(*Error); !ok {
+			err = WrapErr(ErrorGeneric, err)
+		}
+
+		return err
+	}
+
+	// A null result leaves the value unchanged, as with json.Unmarshal.
+	if result == nil || partial == nil {
+		return nil
+	}
+
+	if err := partial.Unmarshal(result); err != nil {
+		return WrapErr(ErrorInvalidResponse, err)
+	}
+
+	return nil
+}
+
+// validate validates the fields of the struct v with their "validate" tags.
+func validate(v reflect.Value, path string) *Error {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+
+		v = v.Elem()
+	}
+
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		if f.PkgPath != "" { // unexported
+			continue
+		}
+
+		name := fieldName(f, path)
+		value := v.Field(i)
+
+		if tag := f.Tag.Get("validate"); tag != "" {
+			for _, rule := range strings.Split(tag, ",") {
+				if err := validateRule(value, strings.TrimSpace(rule)); err != "" {
+					return &Error{
+						Type:    "badRequest",
+						Message: fmt.Sprintf("invalid %q argument: %s", name, err),
+						CodeVal: strings.SplitN(rule, "=", 2)[0],
+					}
+				}
+			}
+		}
+
+		if err := validate(value, name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fieldName gives the path of the field, as it's named in JSON.
+func fieldName(f reflect.StructField, path string) string {
+	name := f.Name
+
+	if s := strings.Split(f.Tag.Get("json"), ",")[0]; s != "" && s != "-" {
+		name = s
+	}
+
+	if path == "" {
+		return name
+	}
+
+	return path + "." + name
+}
+
+// validateRule gives the reason, why the value does not pass the rule.
+func validateRule(v reflect.Value, rule string) string {
+	name, arg := rule, ""
+	if i := strings.IndexByte(rule, '='); i != -1 {
+		name, arg = rule[:i], rule[i+1:]
+	}
+
+	switch name {
+	case "":
+		return ""
+	case "required":
+		if isZero(v) {
+			return "is required"
+		}
+		return ""
+	case "min", "max":
+	default:
+		return fmt.Sprintf("unknown rule %q", name)
+	}
+
+	bound, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		return fmt.Sprintf("invalid %s rule %q", name, arg)
+	}
+
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return "" // use "required" to reject missing values
+		}
+
+		v = v.Elem()
+	}
+
+	var n float64
+	what := "value"
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n = float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n = float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		n = v.Float()
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		n = float64(v.Len())
+		what = "length"
+	default:
+		return ""
+	}
+
+	if name == "min" && n < bound {
+		return fmt.Sprintf("%s must be at least %s", what, arg)
+	}
+
+	if name == "max" && n > bound {
+		return fmt.Sprintf("%s must be at most %s", what, arg)
+	}
+
+	return ""
+}
+
+func isZero(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map:
+		return v.IsNil() || (v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface && v.Len() == 0)
+	default:
+		return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+	}
+}
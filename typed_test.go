@@ -0,0 +1,132 @@
+package kite
+
+import (
+	"context"
+	"testing"
+
+	"github.com/koding/kite/v2/config"
+	"github.com/koding/kite/v2/dnode"
+)
+
+type squareArgs struct {
+	Number float64  `json:"number" validate:"required,max=1000"`
+	Name   string   `json:"name" validate:"min=1,max=8"`
+	Tags   []string `json:"tags" validate:"max=2"`
+}
+
+func TestTyped(t *testing.T) {
+	var got *Request
+
+	handler := Typed(func(ctx context.Context, args squareArgs) (float64, error) {
+		got, _ = RequestFromContext(ctx)
+		return args.Number * args.Number, nil
+	})
+
+	cases := []struct {
+		args string
+		code string // empty if valid
+	}{
+		{`[{"number": 4, "name": "four"}]`, ""},
+		{`[{"name": "four"}]`, "required"},
+		{`[{"number": 4000, "name": "four"}]`, "max"},
+		{`[{"number": 4, "name": ""}]`, "min"},
+		{`[{"number": 4, "name": "four", "tags": ["a", "b", "c"]}]`, "max"},
+		{`[{"number": "four"}]`, "invalid"},
+		{`[]`, "invalid"},
+	}
+
+	for _, cas := range cases {
+		r := &Request{Args: &dnode.Partial{Raw: []byte(cas.args)}}
+
+		result, err := handler(r)
+
+		if cas.code == "" {
+			if err != nil {
+				t.Fatalf("%s: handler()=%s", cas.args, err)
+			}
+
+			if result.(float64) != 16 {
+				t.Fatalf("%s: got %v, want 16", cas.args, result)
+			}
+
+			if got != r {
+				t.Fatalf("%s: got request %p, want %p", cas.args, got, r)
+			}
+
+			continue
+		}
+
+		e, ok := err.(*Error)
+		if !ok {
+			t.Fatalf("%s: got %#v, want *Error", cas.args, err)
+		}
+
+		if e.Type != "badRequest" || e.CodeVal != cas.code {
+			t.Fatalf("%s: got %s (%s), want badRequest (%s)", cas.args, e, e.CodeVal, cas.code)
+		}
+	}
+}
+
+func TestTypedPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("want Typed() to panic")
+		}
+	}()
+
+	Typed(func(args squareArgs) (float64, error) { return 0, nil })
+}
+
+func TestClientCall(t *testing.T) {
+	cfg := config.New()
+	cfg.Port = 3669
+	cfg.DisableAuthentication = true
+
+	k := NewWithConfig("square", "0.0.1", cfg)
+	k.HandleFunc("square", Typed(func(ctx context.Context, args squareArgs) (float64, error) {
+		return args.Number * args.Number, nil
+	}))
+	k.HandleFunc("nothing", func(r *Request) (interface{}, error) {
+		return nil, nil
+	})
+
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	c := New("caller", "0.0.1").NewClient("http://127.0.0.1:3669/kite")
+	if err := c.Dial(); err != nil {
+		t.Fatalf("Dial()=%s", err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+
+	var square float64
+	if err := c.Call(ctx, "square", &square, squareArgs{Number: 4, Name: "four"}); err != nil {
+		t.Fatalf("Call()=%s", err)
+	}
+
+	if square != 16 {
+		t.Fatalf("got %v, want 16", square)
+	}
+
+	if err := c.Call(ctx, "nothing", &square); err != nil {
+		t.Fatalf("Call()=%s", err)
+	}
+
+	if err := c.Call(ctx, "square", nil, squareArgs{Number: 4, Name: "four"}); err != nil {
+		t.Fatalf("Call()=%s", err)
+	}
+
+	var name string
+	err := c.Call(ctx, "square", &name, squareArgs{Number: 4, Name: "four"})
+	if e, ok := err.(*Error); !ok || e.Type != string(ErrorInvalidResponse) {
+		t.Fatalf("got %#v, want invalidResponse error", err)
+	}
+
+	err = c.Call(ctx, "square", &square, squareArgs{Name: "four"})
+	if e, ok := err.(*Error); !ok || e.Type != "badRequest" {
+		t.Fatalf("got %#v, want badRequest error", err)
+	}
+}
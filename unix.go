@@ -0,0 +1,107 @@
+package kite
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/koding/kite/v2/config"
+)
+
+const (
+	unixListenPrefix = "unix://"
+	unixURLPrefix    = "ws+unix://"
+)
+
+// UnixURL gives the URL of a kite listening on the Unix domain socket,
+// which can be dialed with Client. The path is the path of the kite
+// handler, "/kite" if empty.
+//
+// Example:
+//
+//	k.Config.Listen = "unix:///var/run/math.sock"
+//
+//	c := k.NewClient(kite.UnixURL("/var/run/math.sock", "/kite"))
+//	// c.URL == "ws+unix:///var/run/math.sock:/kite"
+func UnixURL(socket, path string) string {
+	if path == "" {
+		path = "/kite"
+	}
+
+	return unixURLPrefix + socket + ":" + path
+}
+
+// parseUnixURL gives the socket path and the path of the kite handler
+// of the "ws+unix://<socket>:<path>" URL. It returns false for other URLs.
+func parseUnixURL(rawurl string) (socket, path string, ok bool) {
+	if !strings.HasPrefix(rawurl, unixURLPrefix) {
+		return "", "", false
+	}
+
+	socket = strings.TrimPrefix(rawurl, unixURLPrefix)
+	path = "/kite"
+
+	if i := strings.LastIndex(socket, ":"); i != -1 {
+		socket, path = socket[:i], socket[i+1:]
+	}
+
+	return socket, path, socket != ""
+}
+
+// unixConfig gives a copy of the configuration, whose transports connect
+// to the Unix domain socket instead of the host of a dialed URL.
+func unixConfig(cfg *config.Config, socket string) *config.Config {
+	cfg = cfg.Copy()
+
+	dial := func(context.Context, string, string) (net.Conn, error) {
+		return net.Dial("unix", socket)
+	}
+
+	if cfg.Websocket != nil {
+		cfg.Websocket.NetDial = func(string, string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		}
+	}
+
+	if cfg.XHR != nil {
+		cfg.XHR.Transport = &http.Transport{DialContext: dial}
+	}
+
+	return cfg
+}
+
+// dialURL gives the URL to dial the remote kite with and the configuration
+// to dial it with.
+func (c *Client) dialURL() (string, *config.Config) {
+	socket, path, ok := parseUnixURL(c.URL)
+	if !ok {
+		return c.URL, c.config()
+	}
+
+	// The host is not used for dialing, the connection is made
+	// to the socket instead.
+	return "http://unix" + path, unixConfig(c.config(), socket)
+}
+
+// listenUnix listens on the Unix domain socket of the "unix://<path>"
+// address. A stale socket left by a previous kite is removed first.
+func listenUnix(addr string) (net.Listener, error) {
+	socket := strings.TrimPrefix(addr, unixListenPrefix)
+	if socket == "" {
+		return nil, fmt.Errorf("no socket path in %q", addr)
+	}
+
+	if fi, err := os.Stat(socket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("socket %q is in use", socket)
+		}
+
+		os.Remove(socket)
+	}
+
+	return net.Listen("unix", socket)
+}
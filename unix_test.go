@@ -0,0 +1,84 @@
+package kite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/koding/kite/v2/config"
+)
+
+func TestParseUnixURL(t *testing.T) {
+	cases := map[string]struct {
+		socket, path string
+		ok           bool
+	}{
+		"ws+unix:///var/run/math.sock:/kite":      {"/var/run/math.sock", "/kite", true},
+		"ws+unix:///var/run/math.sock":            {"/var/run/math.sock", "/kite", true},
+		"ws+unix:///tmp/math.sock:/math-1.0/kite": {"/tmp/math.sock", "/math-1.0/kite", true},
+		"http://127.0.0.1:3636/kite":              {"", "", false},
+	}
+
+	for rawurl, cas := range cases {
+		socket, path, ok := parseUnixURL(rawurl)
+		if ok != cas.ok || socket != cas.socket || path != cas.path {
+			t.Errorf("%s: got (%q, %q, %t), want (%q, %q, %t)", rawurl, socket, path, ok, cas.socket, cas.path, cas.ok)
+		}
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kite")
+	if err != nil {
+		t.Fatalf("TempDir()=%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "math.sock")
+
+	cfg := config.New()
+	cfg.Listen = "unix://" + socket
+	cfg.DisableAuthentication = true
+
+	k := NewWithConfig("math", "0.0.1", cfg)
+	k.HandleFunc("square", func(r *Request) (interface{}, error) {
+		a := r.Args.One().MustFloat64()
+		return a * a, nil
+	})
+
+	go k.Run()
+	<-k.ServerReadyNotify()
+	defer k.Close()
+
+	if port := k.Port(); port != 0 {
+		t.Fatalf("got port %d, want 0", port)
+	}
+
+	for _, transport := range []config.Transport{config.WebSocket, config.XHRPolling} {
+		cfg := config.New()
+		cfg.Transport = transport
+
+		c := NewWithConfig("math-client", "0.0.1", cfg).NewClient(UnixURL(socket, ""))
+
+		if err := c.Dial(); err != nil {
+			t.Fatalf("%s: Dial()=%s", transport, err)
+		}
+
+		result, err := c.Tell("square", 3)
+		if err != nil {
+			t.Fatalf("%s: Tell()=%s", transport, err)
+		}
+
+		if n := result.MustFloat64(); n != 9 {
+			t.Fatalf("%s: got %v, want 9", transport, n)
+		}
+
+		c.Close()
+	}
+
+	// The socket is in use, another kite can't take it over.
+	if _, err := listenUnix(cfg.Listen); err == nil {
+		t.Fatal("expected listenUnix() to fail for socket in use")
+	}
+}
@@ -0,0 +1,536 @@
+package kite
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/igm/sockjs-go/sockjs"
+	"github.com/koding/kite/v2/protocol"
+	"github.com/koding/kite/v2/utils"
+)
+
+// Signal message types exchanged by the peers through the kontrol relay.
+const (
+	signalOffer     = "offer"
+	signalAnswer    = "answer"
+	signalCandidate = "candidate"
+	signalLeave     = "leave"
+	signalAnnounce  = "announce"
+)
+
+// defaultWebRTCTimeout is used by DialWebRTC, when Config.Timeout is not set.
+const defaultWebRTCTimeout = 30 * time.Second
+
+var errWebRTCNotEnabled = errors.New("webrtc is not enabled, call UseWebRTC first")
+
+// ICECandidate describes a single ICE candidate of a peer connection.
+type ICECandidate struct {
+	Candidate     string `json:"candidate"`
+	SDPMid        string `json:"sdpMid,omitempty"`
+	SDPMLineIndex int    `json:"sdpMLineIndex"`
+}
+
+// DataChannel is a reliable, ordered WebRTC data channel carrying
+// text messages.
+type DataChannel interface {
+	// Send sends a single message to the remote peer.
+	Send(msg string) error
+
+	// Recv blocks until a message is received from the remote peer.
+	// It returns a non-nil error after the channel is closed.
+	Recv() (string, error)
+
+	// Close closes the data channel.
+	Close() error
+}
+
+// PeerConnection is a WebRTC peer connection. The kite package does not
+// depend on a particular WebRTC stack, applications plug one in with
+// Kite.UseWebRTC.
+type PeerConnection interface {
+	// CreateOffer creates a data channel with the given label and gives
+	// the SDP offer describing it.
+	CreateOffer(label string) (sdp string, err error)
+
+	// CreateAnswer sets the remote SDP offer and gives the SDP answer.
+	CreateAnswer(offer string) (sdp string, err error)
+
+	// SetAnswer sets the remote SDP answer for the offer created
+	// with CreateOffer.
+	SetAnswer(answer string) error
+
+	// AddICECandidate adds a candidate received from the remote peer.
+	AddICECandidate(ICECandidate) error
+
+	// OnICECandidate registers a function, which is called for each
+	// local candidate that is gathered.
+	OnICECandidate(func(ICECandidate))
+
+	// DataChannel blocks until the data channel is open and returns it.
+	DataChannel() (DataChannel, error)
+
+	// Close closes the connection and its data channel. It may be
+	// called more than once.
+	Close() error
+}
+
+// webRTCPayload is the payload of the signal messages sent between peers.
+type webRTCPayload struct {
+	ConnectionID string        `json:"connectionId"`
+	Sdp          *webRTCSdp    `json:"sdp,omitempty"`
+	Candidate    *ICECandidate `json:"candidate,omitempty"`
+}
+
+type webRTCSdp struct {
+	Type string `json:"type"`
+	Sdp  string `json:"sdp"`
+}
+
+// webRTCPeer is a peer connection, which is being negotiated or
+// carries a session.
+type webRTCPeer struct {
+	id     string // connection ID
+	remote string // remote kite ID
+	pc     PeerConnection
+	answer chan string // receives the remote answer, used by the offerer
+
+	mu          sync.Mutex
+	remoteSet   bool           // whether the remote description is set
+	pendingICEs []ICECandidate // remote candidates received before that
+	signaled    bool           // whether the offer or answer is sent
+	localICEs   []ICECandidate // local candidates gathered before that
+}
+
+func (p *webRTCPeer) addICECandidate(c ICECandidate) error {
+	p.mu.Lock()
+	if !p.remoteSet {
+		p.pendingICEs = append(p.pendingICEs, c)
+		p.mu.Unlock()
+		return nil
+	}
+	p.mu.Unlock()
+
+	return p.pc.AddICECandidate(c)
+}
+
+// setRemote marks the remote description as set and adds
+// the buffered candidates.
+func (p *webRTCPeer) setRemote() error {
+	p.mu.Lock()
+	p.remoteSet = true
+	candidates := p.pendingICEs
+	p.pendingICEs = nil
+	p.mu.Unlock()
+
+	for _, c := range candidates {
+		if err := p.pc.AddICECandidate(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addLocalICECandidate sends the local candidate to the remote peer,
+// or buffers it until the offer or answer is sent.
+func (p *webRTCPeer) addLocalICECandidate(w *webRTCPeers, c ICECandidate) {
+	p.mu.Lock()
+	if !p.signaled {
+		p.localICEs = append(p.localICEs, c)
+		p.mu.Unlock()
+		return
+	}
+	p.mu.Unlock()
+
+	if err := w.send(p, signalCandidate, &webRTCPayload{Candidate: &c}); err != nil {
+		w.k.Log.Error("Cannot send ICE candidate to %s: %s", p.remote, err)
+	}
+}
+
+// setSignaled marks the offer or answer as sent and sends
+// the buffered local candidates.
+func (p *webRTCPeer) setSignaled(w *webRTCPeers) {
+	p.mu.Lock()
+	p.signaled = true
+	candidates := p.localICEs
+	p.localICEs = nil
+	p.mu.Unlock()
+
+	for _, c := range candidates {
+		p.addLocalICECandidate(w, c)
+	}
+}
+
+// webRTCPeers handles the signal messages relayed by kontrol.
+type webRTCPeers struct {
+	k     *Kite
+	newPC func() (PeerConnection, error)
+
+	mu    sync.Mutex
+	peers map[string]*webRTCPeer
+}
+
+// UseWebRTC makes the kite accept and dial sessions over WebRTC data
+// channels, so kites behind NAT can talk to each other directly.
+//
+// The peer connections are created with newPC. The offers, answers and
+// ICE candidates are exchanged through kontrol, which must have
+// Config.UseWebRTC enabled. UseWebRTC must be called before the kite
+// registers to kontrol, which announces the kite to the relay.
+func (k *Kite) UseWebRTC(newPC func() (PeerConnection, error)) {
+	peers := &webRTCPeers{
+		k:     k,
+		newPC: newPC,
+		peers: make(map[string]*webRTCPeer),
+	}
+
+	k.handlersMu.Lock()
+	k.webRTCPeers = peers
+	k.handlersMu.Unlock()
+
+	k.WebRTCHandler = peers
+	k.Handle(WebRTCHandlerName, peers)
+
+	// Make kontrol aware of the kite, so it can relay the offers to it.
+	k.OnRegister(func(*protocol.RegisterResult) {
+		go func() {
+			err := k.SendWebRTCRequest(&protocol.WebRTCSignalMessage{Type: signalAnnounce})
+			if err != nil {
+				k.Log.Error("Cannot announce to webrtc relay: %s", err)
+			}
+		}()
+	})
+}
+
+// DialWebRTC connects to the kite with the given ID over a WebRTC data
+// channel, negotiated through kontrol. The returned client is connected
+// and calls are authenticated with the kite key.
+//
+// The client does not reconnect, a new one must be dialed when
+// it disconnects.
+func (k *Kite) DialWebRTC(kiteID string) (*Client, error) {
+	k.handlersMu.RLock()
+	peers := k.webRTCPeers
+	k.handlersMu.RUnlock()
+
+	if peers == nil {
+		return nil, errWebRTCNotEnabled
+	}
+
+	timeout := k.config().Timeout
+	if timeout == 0 {
+		timeout = defaultWebRTCTimeout
+	}
+
+	p, err := peers.newPeer(utils.RandomString(16), kiteID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	dc, err := peers.offer(p, timeout)
+	if err != nil {
+		peers.remove(p)
+		return nil, err
+	}
+
+	c := k.NewClient("")
+	c.Kite = protocol.Kite{ID: kiteID}
+
+	if key := k.KiteKey(); key != "" {
+		c.Auth = &Auth{
+			Type: "kiteKey",
+			Key:  key,
+		}
+	}
+
+	c.OnDisconnect(func() {
+		peers.remove(p)
+	})
+
+	c.setSession(newDataChannelSession(p.id, dc, p.pc))
+	c.wg.Add(1)
+	go c.sendHub()
+	go c.callOnConnectHandlers()
+	go c.run()
+
+	return c, nil
+}
+
+// newPeer creates a peer connection with the given ID to the remote kite.
+// The offerer waits for the answer of the remote kite.
+func (w *webRTCPeers) newPeer(id, remote string, offerer bool) (*webRTCPeer, error) {
+	pc, err := w.newPC()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &webRTCPeer{
+		id:     id,
+		remote: remote,
+		pc:     pc,
+	}
+
+	if offerer {
+		p.answer = make(chan string, 1)
+	}
+
+	pc.OnICECandidate(func(c ICECandidate) {
+		p.addLocalICECandidate(w, c)
+	})
+
+	w.mu.Lock()
+	w.peers[id] = p
+	w.mu.Unlock()
+
+	return p, nil
+}
+
+func (w *webRTCPeers) get(id string) (*webRTCPeer, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	p, ok := w.peers[id]
+	return p, ok
+}
+
+func (w *webRTCPeers) remove(p *webRTCPeer) {
+	w.mu.Lock()
+	delete(w.peers, p.id)
+	w.mu.Unlock()
+
+	p.pc.Close()
+}
+
+// offer sends an offer to the remote peer and waits for its answer
+// and the data channel to open.
+func (w *webRTCPeers) offer(p *webRTCPeer, timeout time.Duration) (DataChannel, error) {
+	sdp, err := p.pc.CreateOffer(p.id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.send(p, signalOffer, &webRTCPayload{Sdp: &webRTCSdp{Type: signalOffer, Sdp: sdp}})
+	if err != nil {
+		return nil, err
+	}
+
+	p.setSignaled(w)
+
+	select {
+	case answer := <-p.answer:
+		if err := p.pc.SetAnswer(answer); err != nil {
+			return nil, err
+		}
+	case <-time.After(timeout):
+		w.send(p, signalLeave, &webRTCPayload{})
+		return nil, fmt.Errorf("no answer from %s after %s", p.remote, timeout)
+	}
+
+	if err := p.setRemote(); err != nil {
+		return nil, err
+	}
+
+	return p.pc.DataChannel()
+}
+
+func (w *webRTCPeers) send(p *webRTCPeer, typ string, payload *webRTCPayload) error {
+	payload.ConnectionID = p.id
+
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	return w.k.SendWebRTCRequest(&protocol.WebRTCSignalMessage{
+		Type:    typ,
+		Dst:     p.remote,
+		Payload: raw,
+	})
+}
+
+// ServeKite implements the Handler interface, it handles the signal
+// messages relayed from the remote peers.
+func (w *webRTCPeers) ServeKite(r *Request) (interface{}, error) {
+	var msg protocol.WebRTCSignalMessage
+
+	if err := r.Args.One().Unmarshal(&msg); err != nil {
+		return nil, fmt.Errorf("invalid query: %s", err)
+	}
+
+	var payload webRTCPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		return nil, fmt.Errorf("invalid payload: %s", err)
+	}
+
+	if payload.ConnectionID == "" {
+		return nil, errors.New("connection id not set")
+	}
+
+	switch strings.ToLower(msg.Type) {
+	case signalOffer:
+		if payload.Sdp == nil {
+			return nil, errors.New("offer without sdp")
+		}
+
+		return nil, w.accept(msg.Src, payload.ConnectionID, payload.Sdp.Sdp)
+	case signalAnswer:
+		p, ok := w.get(payload.ConnectionID)
+		if !ok || p.answer == nil || payload.Sdp == nil {
+			return nil, errors.New("unexpected answer")
+		}
+
+		select {
+		case p.answer <- payload.Sdp.Sdp:
+		default:
+		}
+	case signalCandidate:
+		p, ok := w.get(payload.ConnectionID)
+		if !ok || payload.Candidate == nil {
+			return nil, errors.New("unexpected candidate")
+		}
+
+		return nil, p.addICECandidate(*payload.Candidate)
+	case signalLeave:
+		if p, ok := w.get(payload.ConnectionID); ok {
+			w.remove(p)
+		}
+	default:
+		return nil, fmt.Errorf("unknown signal type %q", msg.Type)
+	}
+
+	return nil, nil
+}
+
+// accept answers the offer and serves the session once the data
+// channel opens.
+func (w *webRTCPeers) accept(remote, id, offer string) error {
+	if _, ok := w.get(id); ok {
+		return errors.New("connection already exists")
+	}
+
+	p, err := w.newPeer(id, remote, false)
+	if err != nil {
+		return err
+	}
+
+	sdp, err := p.pc.CreateAnswer(offer)
+	if err != nil {
+		w.remove(p)
+		return err
+	}
+
+	if err := p.setRemote(); err != nil {
+		w.remove(p)
+		return err
+	}
+
+	// The answer is sent after the offer request returns, since kontrol
+	// relays the signal messages one by one.
+	go func() {
+		err := w.send(p, signalAnswer, &webRTCPayload{Sdp: &webRTCSdp{Type: signalAnswer, Sdp: sdp}})
+		if err != nil {
+			w.k.Log.Error("Cannot send answer to %s: %s", remote, err)
+			w.remove(p)
+			return
+		}
+
+		p.setSignaled(w)
+
+		dc, err := p.pc.DataChannel()
+		if err != nil {
+			w.k.Log.Error("Cannot open data channel with %s: %s", remote, err)
+			w.remove(p)
+			return
+		}
+
+		w.k.sockjsHandler(newDataChannelSession(id, dc, p.pc))
+
+		w.remove(p)
+	}()
+
+	return nil
+}
+
+// dataChannelSession is a sockjs.Session over a WebRTC data channel.
+type dataChannelSession struct {
+	id string
+	dc DataChannel
+	pc PeerConnection
+
+	mu    sync.Mutex
+	state sockjs.SessionState
+}
+
+var _ sockjs.Session = (*dataChannelSession)(nil)
+
+func newDataChannelSession(id string, dc DataChannel, pc PeerConnection) *dataChannelSession {
+	return &dataChannelSession{
+		id:    id,
+		dc:    dc,
+		pc:    pc,
+		state: sockjs.SessionActive,
+	}
+}
+
+// ID implements the sockjs.Session interface.
+func (s *dataChannelSession) ID() string {
+	return s.id
+}
+
+// Request implements the sockjs.Session interface. Data channel
+// sessions are not made over HTTP, so it always returns nil.
+func (s *dataChannelSession) Request() *http.Request {
+	return nil
+}
+
+// TransportName implements the SessionInfo interface.
+func (s *dataChannelSession) TransportName() string {
+	return "webrtc"
+}
+
+// Recv implements the sockjs.Session interface.
+func (s *dataChannelSession) Recv() (string, error) {
+	msg, err := s.dc.Recv()
+	if err != nil {
+		s.setState(sockjs.SessionClosed)
+		return "", err
+	}
+
+	return msg, nil
+}
+
+// Send implements the sockjs.Session interface.
+func (s *dataChannelSession) Send(msg string) error {
+	if s.GetSessionState() != sockjs.SessionActive {
+		return sockjs.ErrSessionNotOpen
+	}
+
+	return s.dc.Send(msg)
+}
+
+// Close implements the sockjs.Session interface.
+func (s *dataChannelSession) Close(uint32, string) error {
+	s.setState(sockjs.SessionClosed)
+
+	s.dc.Close()
+	return s.pc.Close()
+}
+
+// GetSessionState implements the sockjs.Session interface.
+func (s *dataChannelSession) GetSessionState() sockjs.SessionState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.state
+}
+
+func (s *dataChannelSession) setState(state sockjs.SessionState) {
+	s.mu.Lock()
+	s.state = state
+	s.mu.Unlock()
+}